@@ -0,0 +1,92 @@
+package ring
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SendState describes how ready the TCPMsgRing is to send to an address; see
+// TCPMsgRing.SendState.
+type SendState struct {
+	Addr string
+	// Queued is how many messages are buffered for the address, waiting for
+	// its connection to write them, out of QueueCapacity, the configured
+	// BufferedMessagesPerAddress.
+	Queued        int
+	QueueCapacity int
+	// InFlight is how many sends are waiting to queue messages for the
+	// address, out of MaxInFlight; these are only tracked when the
+	// MaxInFlightPerAddress is set, otherwise both are 0.
+	InFlight    int
+	MaxInFlight int
+	// Connected is true if a connection to the address is established;
+	// messages are still queued while a connection is being made.
+	Connected bool
+	// CircuitBreaker is the state of the address' circuit breaker.
+	CircuitBreaker CircuitBreakerState
+	// Ready is true if a message sent to the address right now would be
+	// queued without waiting and without being dropped by the circuit
+	// breaker or in flight limit; false indicates the peer is congested or
+	// unavailable and upper layers may want to shed or reroute the load.
+	Ready bool
+}
+
+// SendState returns how ready the TCPMsgRing is to send to the address. This
+// is a snapshot; concurrent sends may change the state at any time.
+func (t *TCPMsgRing) SendState(addr string) *SendState {
+	s := &SendState{
+		Addr:           addr,
+		QueueCapacity:  t.bufferedMessagesPerAddress,
+		MaxInFlight:    int(t.maxInFlightPerAddress),
+		CircuitBreaker: t.CircuitBreakerState(addr),
+	}
+	if msgChan := t.lookupMsgChanForAddr(addr); msgChan != nil {
+		s.Queued = len(msgChan)
+	}
+	if t.maxInFlightPerAddress > 0 {
+		t.inFlightLock.RLock()
+		if inFlight := t.inFlight[addr]; inFlight != nil {
+			s.InFlight = int(atomic.LoadInt32(inFlight))
+		}
+		t.inFlightLock.RUnlock()
+	}
+	t.connectedLock.RLock()
+	s.Connected = t.connected[addr] > 0
+	t.connectedLock.RUnlock()
+	s.Ready = s.Queued < s.QueueCapacity && (s.MaxInFlight == 0 || s.InFlight < s.MaxInFlight)
+	if s.Ready && t.circuitBreakers != nil {
+		s.Ready = t.circuitBreakers.allow(addr, time.Now())
+	}
+	return s
+}
+
+// NodeSendState returns the SendState for the node's address in the current
+// ring, or nil if there is no ring or no such node.
+func (t *TCPMsgRing) NodeSendState(nodeID uint64) *SendState {
+	ring, addressIndex := t.ringAndAddressIndex()
+	if ring == nil {
+		return nil
+	}
+	node := ring.Node(nodeID)
+	if node == nil {
+		return nil
+	}
+	return t.SendState(node.Address(addressIndex))
+}
+
+// CanSendToNode returns true if a message to the node could be queued right
+// now without blocking; see SendState.Ready.
+func (t *TCPMsgRing) CanSendToNode(nodeID uint64) bool {
+	s := t.NodeSendState(nodeID)
+	return s != nil && s.Ready
+}
+
+// setConnected notes a connection to the address being established or, with
+// a negative delta, closed.
+func (t *TCPMsgRing) setConnected(addr string, delta int) {
+	t.connectedLock.Lock()
+	if t.connected[addr] += delta; t.connected[addr] <= 0 {
+		delete(t.connected, addr)
+	}
+	t.connectedLock.Unlock()
+}
@@ -0,0 +1,41 @@
+package ring
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTCPMsgRingSendState(t *testing.T) {
+	msgring, _ := NewTCPMsgRing(&TCPMsgRingConfig{BufferedMessagesPerAddress: 1, MaxInFlightPerAddress: 1})
+	defer msgring.Shutdown()
+	r, _, nB, err := newTestRing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgring.SetRing(r)
+	if !msgring.CanSendToNode(nB.ID()) {
+		t.Fatal("expected to be able to send")
+	}
+	if msgring.CanSendToNode(12345) {
+		t.Fatal("unknown node should not be sendable")
+	}
+	// Created ahead of time so no connection is attempted.
+	msgChan, _ := msgring.msgChanForAddr(nB.Address(0))
+	msgChan <- newTestMsg()
+	s := msgring.NodeSendState(nB.ID())
+	if s.Ready || s.Queued != 1 || s.QueueCapacity != 1 || s.Connected {
+		t.Fatalf("%#v", s)
+	}
+	go msgring.msgToAddr(newTestMsg(), nB.Address(0), time.Second)
+	for msgring.SendState(nB.Address(0)).InFlight != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	(<-msgChan).Free()
+	for len(msgChan) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	(<-msgChan).Free()
+	for !msgring.SendState(nB.Address(0)).Ready {
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -1,19 +1,28 @@
 package ring
 
 import (
+	"bytes"
 	"compress/gzip"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"math"
+	"math/rand"
 	"time"
 )
 
 const (
 	// BUILDERVERSION is the builder file format version written to and checked
 	// for in the builder file header. If the on disk format of the builder changes
-	// this version should be incremented.
-	BUILDERVERSION = "RINGBUILDERv0001"
+	// this version should be incremented, once per release, with LoadBuilder
+	// still reading the previous release's files.
+	BUILDERVERSION = "RINGBUILDERv0002"
+	// builderVersion1 is the builder file format of the first release, before
+	// node capacities became 64 bit and the builder gained its generation,
+	// per node inactive policies and network zones, and the settings following
+	// MoveWait. LoadBuilder reads it, giving the newer settings NewBuilder's
+	// defaults; persisting the loaded Builder migrates it to BUILDERVERSION.
+	builderVersion1 = "RINGBUILDERv0001"
 )
 
 // Builder is used to construct Rings over time. Rings are the immutable state
@@ -21,6 +30,7 @@ const (
 type Builder struct {
 	tierBase
 	version                       int64
+	generation                    uint64
 	dirty                         bool
 	nodes                         []*node
 	partitionBitCount             uint16
@@ -30,8 +40,35 @@ type Builder struct {
 	maxPartitionBitCount          uint16
 	moveWait                      uint16
 	moveWaitBase                  int64
+	dispersionPointsAllowed       byte
+	movesPerPartition             byte
+	rebalanceTrigger              RebalanceTrigger
+	placementMode                 PlacementMode
+	keyHasher                     string
+	rebalanceThreshold            byte
+	maxMovePercentage             byte
+	capacityReserve               byte
+	nodeCapacityReserves          map[uint64]byte
+	nodeDrains                    map[uint64]int32
 	config                        []byte
 	idBits                        int
+	addressRoles                  []string
+	tierCorrelations              [][][]string
+	affinityGroups                []*AffinityGroup
+	strictDispersion              int
+	partitionModes                map[Partition]PartitionMode
+	regionLevel                   int
+	regionTargets                 map[string]int
+	moveHistory                   []moveCount
+	capacitySchedules             []*CapacitySchedule
+	lastRebalanceReport           *RebalanceReport
+	rebalanceListener             func(e *RebalanceEvent)
+	tieBreaker                    TieBreaker
+	metrics                       *BuilderMetrics
+	// now and nodeIDSource, if set, replace the clock and the random node
+	// IDs, so a replay of the same operations builds identical rings.
+	now          func() time.Time
+	nodeIDSource rand.Source
 }
 
 // NewBuilder creates an empty Builder with all default settings.
@@ -54,7 +91,10 @@ func NewBuilder(idBits int) *Builder {
 		// memory.
 		maxPartitionBitCount: 23,
 		moveWait:             60, // 1 hour default
-		idBits:               idBits,
+		// 255 places no limit; tier dispersion always wins over balance.
+		dispersionPointsAllowed: 255,
+		strictDispersion:        -1,
+		idBits:                  idBits,
 	}
 	b.replicaToPartitionToNodeIndex[0] = []int32{-1, -1}
 	b.replicaToPartitionToLastMove[0] = []uint16{math.MaxUint16, math.MaxUint16}
@@ -62,7 +102,9 @@ func NewBuilder(idBits int) *Builder {
 }
 
 // LoadBuilder creates a new Builder instance based on the persisted data from
-// the Reader (presumably previously saved with the Persist method).
+// the Reader (presumably previously saved with the Persist method). The
+// persisted data's checksum is verified, so a corrupted or truncated file is
+// an error rather than a Builder with silently damaged state.
 func LoadBuilder(r io.Reader) (*Builder, error) {
 	// CONSIDER: This code uses binary.Read which incurs fleeting allocations;
 	// these could be reduced by creating a buffer upfront and using
@@ -77,7 +119,8 @@ func LoadBuilder(r io.Reader) (*Builder, error) {
 	if err != nil {
 		return nil, err
 	}
-	if string(header) != BUILDERVERSION {
+	v1 := string(header) == builderVersion1
+	if string(header) != BUILDERVERSION && !v1 {
 		return nil, fmt.Errorf("unknown header %s", string(header))
 	}
 	b := &Builder{}
@@ -85,13 +128,17 @@ func LoadBuilder(r io.Reader) (*Builder, error) {
 	if err != nil {
 		return nil, err
 	}
-	var configBytes int32
-	err = binary.Read(gr, binary.BigEndian, &configBytes)
+	if !v1 {
+		err = binary.Read(gr, binary.BigEndian, &b.generation)
+		if err != nil {
+			return nil, err
+		}
+	}
+	configBytes, err := readLength(gr, "config length")
 	if err != nil {
 		return nil, err
 	}
-	b.config = make([]byte, configBytes)
-	_, err = io.ReadFull(gr, b.config)
+	b.config, err = readBytes(gr, configBytes)
 	if err != nil {
 		return nil, err
 	}
@@ -106,40 +153,40 @@ func LoadBuilder(r io.Reader) (*Builder, error) {
 	} else if b.idBits > 64 {
 		b.idBits = 64
 	}
-	var vint32 int32
-	err = binary.Read(gr, binary.BigEndian, &vint32)
+	vint32, err := readLength(gr, "number of tiers")
 	if err != nil {
 		return nil, err
 	}
-	b.tiers = make([][]string, vint32)
+	b.tiers = make([][]string, 0, allocLength(vint32))
 	for i := int32(0); i < vint32; i++ {
 		var vvint32 int32
-		err = binary.Read(gr, binary.BigEndian, &vvint32)
+		vvint32, err = readLength(gr, "number of tier positions")
 		if err != nil {
 			return nil, err
 		}
-		b.tiers[i] = make([]string, vvint32)
+		tier := make([]string, 0, allocLength(vvint32))
 		for j := int32(0); j < vvint32; j++ {
 			var vvvint32 int32
-			err = binary.Read(gr, binary.BigEndian, &vvvint32)
+			vvvint32, err = readLength(gr, "name length")
 			if err != nil {
 				return nil, err
 			}
-			byts := make([]byte, vvvint32)
-			_, err = io.ReadFull(gr, byts)
+			var byts []byte
+			byts, err = readBytes(gr, vvvint32)
 			if err != nil {
 				return nil, err
 			}
-			b.tiers[i][j] = string(byts)
+			tier = append(tier, string(byts))
 		}
+		b.tiers = append(b.tiers, tier)
 	}
-	err = binary.Read(gr, binary.BigEndian, &vint32)
+	vint32, err = readLength(gr, "number of nodes")
 	if err != nil {
 		return nil, err
 	}
-	b.nodes = make([]*node, vint32)
+	b.nodes = make([]*node, 0, allocLength(vint32))
 	for i := int32(0); i < vint32; i++ {
-		b.nodes[i] = &node{builder: b, tierBase: &b.tierBase}
+		b.nodes = append(b.nodes, &node{builder: b, tierBase: &b.tierBase})
 		err = binary.Read(gr, binary.BigEndian, &b.nodes[i].id)
 		if err != nil {
 			return nil, err
@@ -152,92 +199,133 @@ func LoadBuilder(r io.Reader) (*Builder, error) {
 		if tf == 1 {
 			b.nodes[i].inactive = true
 		}
-		err = binary.Read(gr, binary.BigEndian, &b.nodes[i].capacity)
-		if err != nil {
-			return nil, err
+		if v1 {
+			var capacity uint32
+			err = binary.Read(gr, binary.BigEndian, &capacity)
+			if err != nil {
+				return nil, err
+			}
+			b.nodes[i].capacity = uint64(capacity)
+		} else {
+			err = binary.Read(gr, binary.BigEndian, &b.nodes[i].inactivePolicy)
+			if err != nil {
+				return nil, err
+			}
+			err = binary.Read(gr, binary.BigEndian, &b.nodes[i].capacity)
+			if err != nil {
+				return nil, err
+			}
 		}
 		var vvint32 int32
-		err = binary.Read(gr, binary.BigEndian, &vvint32)
+		vvint32, err = readLength(gr, "number of tier positions")
 		if err != nil {
 			return nil, err
 		}
-		b.nodes[i].tierIndexes = make([]int32, vvint32)
-		for j := int32(0); j < vvint32; j++ {
-			err = binary.Read(gr, binary.BigEndian, &b.nodes[i].tierIndexes[j])
-			if err != nil {
-				return nil, err
-			}
+		b.nodes[i].tierIndexes, err = readInt32s(gr, vvint32)
+		if err != nil {
+			return nil, err
 		}
-		err = binary.Read(gr, binary.BigEndian, &vvint32)
+		vvint32, err = readLength(gr, "number of addresses")
 		if err != nil {
 			return nil, err
 		}
-		b.nodes[i].addresses = make([]string, vvint32)
+		b.nodes[i].addresses = make([]string, 0, allocLength(vvint32))
 		for j := int32(0); j < vvint32; j++ {
 			var vvvint32 int32
-			err = binary.Read(gr, binary.BigEndian, &vvvint32)
+			vvvint32, err = readLength(gr, "address length")
 			if err != nil {
 				return nil, err
 			}
-			byts := make([]byte, vvvint32)
-			_, err = io.ReadFull(gr, byts)
+			var byts []byte
+			byts, err = readBytes(gr, vvvint32)
 			if err != nil {
 				return nil, err
 			}
-			b.nodes[i].addresses[j] = string(byts)
+			b.nodes[i].addresses = append(b.nodes[i].addresses, string(byts))
 		}
-		err = binary.Read(gr, binary.BigEndian, &vvint32)
+		vvint32, err = readLength(gr, "meta length")
 		if err != nil {
 			return nil, err
 		}
-		byts := make([]byte, vvint32)
-		_, err = io.ReadFull(gr, byts)
+		var byts []byte
+		byts, err = readBytes(gr, vvint32)
 		if err != nil {
 			return nil, err
 		}
 		b.nodes[i].meta = string(byts)
 		var cbytes int32
-		err = binary.Read(gr, binary.BigEndian, &cbytes)
+		cbytes, err = readLength(gr, "config length")
+		if err != nil {
+			return nil, err
+		}
+		b.nodes[i].config, err = readBytes(gr, cbytes)
 		if err != nil {
 			return nil, err
 		}
-		b.nodes[i].config = make([]byte, cbytes)
-		_, err = io.ReadFull(gr, b.nodes[i].config)
+		if v1 {
+			continue
+		}
+		vvint32, err = readLength(gr, "network zone length")
+		if err != nil {
+			return nil, err
+		}
+		byts, err = readBytes(gr, vvint32)
 		if err != nil {
 			return nil, err
 		}
+		b.nodes[i].networkZone = string(byts)
+	}
+	if _, err = sumCapacity(b.nodes); err != nil {
+		return nil, err
 	}
 	err = binary.Read(gr, binary.BigEndian, &b.partitionBitCount)
 	if err != nil {
 		return nil, err
 	}
-	err = binary.Read(gr, binary.BigEndian, &vint32)
+	vint32, err = readLength(gr, "number of replicas")
 	if err != nil {
 		return nil, err
 	}
-	b.replicaToPartitionToNodeIndex = make([][]int32, vint32)
+	b.replicaToPartitionToNodeIndex = make([][]int32, 0, allocLength(vint32))
 	for i := int32(0); i < vint32; i++ {
 		var vvint32 int32
 		err = binary.Read(gr, binary.BigEndian, &vvint32)
 		if err != nil {
 			return nil, err
 		}
-		b.replicaToPartitionToNodeIndex[i] = make([]int32, vvint32)
-		err = binary.Read(gr, binary.BigEndian, b.replicaToPartitionToNodeIndex[i])
+		if err = checkPartitionCount(vvint32, b.partitionBitCount); err != nil {
+			return nil, err
+		}
+		var partitionToNodeIndex []int32
+		partitionToNodeIndex, err = readInt32s(gr, vvint32)
+		if err != nil {
+			return nil, err
+		}
+		b.replicaToPartitionToNodeIndex = append(b.replicaToPartitionToNodeIndex, partitionToNodeIndex)
 	}
 	err = binary.Read(gr, binary.BigEndian, &vint32)
 	if err != nil {
 		return nil, err
 	}
-	b.replicaToPartitionToLastMove = make([][]uint16, vint32)
+	if vint32 != int32(len(b.replicaToPartitionToNodeIndex)) {
+		return nil, fmt.Errorf("%d replicas of last moves for %d replicas of assignments", vint32, len(b.replicaToPartitionToNodeIndex))
+	}
+	b.replicaToPartitionToLastMove = make([][]uint16, 0, vint32)
 	for i := int32(0); i < vint32; i++ {
 		var vvint32 int32
 		err = binary.Read(gr, binary.BigEndian, &vvint32)
 		if err != nil {
 			return nil, err
 		}
-		b.replicaToPartitionToLastMove[i] = make([]uint16, vvint32)
-		err = binary.Read(gr, binary.BigEndian, b.replicaToPartitionToLastMove[i])
+		if err = checkPartitionCount(vvint32, b.partitionBitCount); err != nil {
+			return nil, err
+		}
+		var partitionToLastMove []uint16
+		partitionToLastMove, err = readUint16s(gr, vvint32)
+		if err != nil {
+			return nil, err
+		}
+		b.replicaToPartitionToLastMove = append(b.replicaToPartitionToLastMove, partitionToLastMove)
 	}
 	err = binary.Read(gr, binary.BigEndian, &b.pointsAllowed)
 	if err != nil {
@@ -251,12 +339,125 @@ func LoadBuilder(r io.Reader) (*Builder, error) {
 	if err != nil {
 		return nil, err
 	}
+	if v1 {
+		b.dispersionPointsAllowed = 255
+		b.strictDispersion = -1
+		err = readToGzipEnd(gr)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+	err = binary.Read(gr, binary.BigEndian, &b.dispersionPointsAllowed)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Read(gr, binary.BigEndian, &b.movesPerPartition)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Read(gr, binary.BigEndian, &b.rebalanceTrigger)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Read(gr, binary.BigEndian, &b.rebalanceThreshold)
+	if err != nil {
+		return nil, err
+	}
+	vint32, err = readLength(gr, "number of address roles")
+	if err != nil {
+		return nil, err
+	}
+	b.addressRoles = make([]string, 0, allocLength(vint32))
+	for i := int32(0); i < vint32; i++ {
+		var vvint32 int32
+		vvint32, err = readLength(gr, "address role length")
+		if err != nil {
+			return nil, err
+		}
+		var byts []byte
+		byts, err = readBytes(gr, vvint32)
+		if err != nil {
+			return nil, err
+		}
+		b.addressRoles = append(b.addressRoles, string(byts))
+	}
+	err = b.readTierCorrelations(gr)
+	if err != nil {
+		return nil, err
+	}
+	err = b.readAffinityGroups(gr)
+	if err != nil {
+		return nil, err
+	}
+	err = b.readStrictDispersion(gr)
+	if err != nil {
+		return nil, err
+	}
+	b.partitionModes, err = readPartitionModes(gr)
+	if err != nil {
+		return nil, err
+	}
+	err = b.readRegionTargets(gr)
+	if err != nil {
+		return nil, err
+	}
+	err = b.readMoveHistory(gr)
+	if err != nil {
+		return nil, err
+	}
+	err = b.readCapacitySchedules(gr)
+	if err != nil {
+		return nil, err
+	}
+	err = b.readMaxMovePercentage(gr)
+	if err != nil {
+		return nil, err
+	}
+	err = b.readCapacityReserves(gr)
+	if err != nil {
+		return nil, err
+	}
+	err = b.readNodeDrains(gr)
+	if err != nil {
+		return nil, err
+	}
+	err = b.readPlacementMode(gr)
+	if err != nil {
+		return nil, err
+	}
+	b.keyHasher, _, err = readKeyHasher(gr)
+	if err != nil {
+		return nil, err
+	}
+	err = readToGzipEnd(gr)
+	if err != nil {
+		return nil, err
+	}
 	return b, nil
 }
 
+// Generation is the count of times the Builder has been persisted, as of its
+// loading or its last Persist; PersistRingOrBuilder uses it to detect another
+// process having persisted the same builder file in the meantime.
+func (b *Builder) Generation() uint64 {
+	return b.generation
+}
+
 // Persist saves the Builder state to the given Writer for later reloading via
-// the LoadBuilder method.
+// the LoadBuilder method; this increments the Generation.
 func (b *Builder) Persist(w io.Writer) error {
+	if err := b.persist(w, b.generation+1); err != nil {
+		return err
+	}
+	b.generation++
+	return nil
+}
+
+// persist saves the Builder state as Persist does, but with the generation
+// given and without changing the Builder's own; copies made by way of the
+// persisted form use the current generation.
+func (b *Builder) persist(w io.Writer, generation uint64) error {
 	b.minimizeTiers()
 	// CONSIDER: This code uses binary.Write which incurs fleeting allocations;
 	// these could be reduced by creating a buffer upfront and using
@@ -271,6 +472,10 @@ func (b *Builder) Persist(w io.Writer) error {
 	if err != nil {
 		return err
 	}
+	err = binary.Write(gw, binary.BigEndian, generation)
+	if err != nil {
+		return err
+	}
 	if len(b.config) > math.MaxInt32 {
 		return fmt.Errorf("%d config bytes is too large; max is %d", len(b.config), math.MaxInt32)
 	}
@@ -336,6 +541,10 @@ func (b *Builder) Persist(w io.Writer) error {
 		if err != nil {
 			return err
 		}
+		err = binary.Write(gw, binary.BigEndian, n.inactivePolicy)
+		if err != nil {
+			return err
+		}
 		err = binary.Write(gw, binary.BigEndian, n.capacity)
 		if err != nil {
 			return err
@@ -397,6 +606,18 @@ func (b *Builder) Persist(w io.Writer) error {
 		if err != nil {
 			return err
 		}
+		byts = []byte(n.networkZone)
+		if len(byts) > math.MaxInt32 {
+			return fmt.Errorf("%d network zone length is too large; max is %d", len(byts), math.MaxInt32)
+		}
+		err = binary.Write(gw, binary.BigEndian, int32(len(byts)))
+		if err != nil {
+			return err
+		}
+		_, err = gw.Write(byts)
+		if err != nil {
+			return err
+		}
 	}
 	err = binary.Write(gw, binary.BigEndian, b.partitionBitCount)
 	if err != nil {
@@ -454,7 +675,106 @@ func (b *Builder) Persist(w io.Writer) error {
 	if err != nil {
 		return err
 	}
-	return nil
+	err = binary.Write(gw, binary.BigEndian, b.dispersionPointsAllowed)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(gw, binary.BigEndian, b.movesPerPartition)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(gw, binary.BigEndian, b.rebalanceTrigger)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(gw, binary.BigEndian, b.rebalanceThreshold)
+	if err != nil {
+		return err
+	}
+	if len(b.addressRoles) > math.MaxInt32 {
+		return fmt.Errorf("%d address roles is too large; max is %d", len(b.addressRoles), math.MaxInt32)
+	}
+	err = binary.Write(gw, binary.BigEndian, int32(len(b.addressRoles)))
+	if err != nil {
+		return err
+	}
+	for _, role := range b.addressRoles {
+		byts := []byte(role)
+		if len(byts) > math.MaxInt32 {
+			return fmt.Errorf("%d address role length is too large; max is %d", len(byts), math.MaxInt32)
+		}
+		err = binary.Write(gw, binary.BigEndian, int32(len(byts)))
+		if err != nil {
+			return err
+		}
+		_, err = gw.Write(byts)
+		if err != nil {
+			return err
+		}
+	}
+	err = b.writeTierCorrelations(gw)
+	if err != nil {
+		return err
+	}
+	err = b.writeAffinityGroups(gw)
+	if err != nil {
+		return err
+	}
+	err = b.writeStrictDispersion(gw)
+	if err != nil {
+		return err
+	}
+	err = writePartitionModes(gw, b.partitionModes)
+	if err != nil {
+		return err
+	}
+	err = b.writeRegionTargets(gw)
+	if err != nil {
+		return err
+	}
+	err = b.writeMoveHistory(gw)
+	if err != nil {
+		return err
+	}
+	err = b.writeCapacitySchedules(gw)
+	if err != nil {
+		return err
+	}
+	err = b.writeMaxMovePercentage(gw)
+	if err != nil {
+		return err
+	}
+	err = b.writeCapacityReserves(gw)
+	if err != nil {
+		return err
+	}
+	err = b.writeNodeDrains(gw)
+	if err != nil {
+		return err
+	}
+	err = b.writePlacementMode(gw)
+	if err != nil {
+		return err
+	}
+	return writeKeyHasher(gw, b.keyHasher)
+}
+
+// deepCopy returns a deep copy of the Builder by way of its persisted form, so
+// every persisted setting is copied, along with the settings that are not
+// persisted but affect rebalancing. The Builder's Generation is left as is,
+// so a DryRun does not hide a conflicting persist from PersistRingOrBuilder.
+func (b *Builder) deepCopy() (*Builder, error) {
+	var buf bytes.Buffer
+	if err := b.persist(&buf, b.generation); err != nil {
+		return nil, err
+	}
+	c, err := LoadBuilder(&buf)
+	if err != nil {
+		return nil, err
+	}
+	c.tieBreaker = b.tieBreaker
+	c.now = b.now
+	return c, nil
 }
 
 func (b *Builder) minimizeTiers() {
@@ -464,7 +784,10 @@ func (b *Builder) minimizeTiers() {
 	}
 	for _, n := range b.nodes {
 		for lv, i := range n.tierIndexes {
-			u[lv][i] = true
+			// A level with only empty values may have no entries at all.
+			if int(i) < len(u[lv]) {
+				u[lv][i] = true
+			}
 		}
 	}
 	for lv, us := range u {
@@ -481,6 +804,9 @@ func (b *Builder) minimizeTiers() {
 		}
 	}
 	for lv := 0; lv < len(b.tiers); lv++ {
+		if len(b.tiers[lv]) == 0 {
+			continue
+		}
 		ts := make([]string, 1, len(b.tiers[lv]))
 		for _, t := range b.tiers[lv][1:] {
 			if t != "" {
@@ -551,6 +877,57 @@ func (b *Builder) SetMoveWait(minutes uint16) {
 	b.moveWait = minutes
 }
 
+// DispersionPointsAllowed is the number of percentage points overweight a
+// node may become in order to keep the replicas of a partition in distinct
+// tiers. When the best tier dispersed node is already this overweight, the
+// rebalancer settles for less dispersion and chooses among nodes at lower
+// tier levels instead, down to just choosing the node that desires the most
+// replicas. For example, 3 means accepting up to 3% imbalance to keep zone
+// dispersion perfect. The default of 255 places no limit, always favoring
+// dispersion over balance.
+func (b *Builder) DispersionPointsAllowed() byte {
+	return b.dispersionPointsAllowed
+}
+
+func (b *Builder) SetDispersionPointsAllowed(points byte) {
+	b.dispersionPointsAllowed = points
+}
+
+// MovesPerPartition is the number of replicas of any one partition the
+// rebalancer may reassign within the move wait. Lower values favor minimizing
+// data movement, keeping more replicas of each partition in place while data
+// moves; higher values let rings reach balance in fewer rebalances. The
+// default of 0 means fewer than half the replicas: one less than the replica
+// count, halved and rounded down, but at least 1.
+func (b *Builder) MovesPerPartition() byte {
+	return b.movesPerPartition
+}
+
+func (b *Builder) SetMovesPerPartition(moves byte) {
+	b.movesPerPartition = moves
+}
+
+// RebalanceTrigger indicates when the Ring method rebalances; see
+// RebalanceTrigger. The default is RebalanceAlways.
+func (b *Builder) RebalanceTrigger() RebalanceTrigger {
+	return b.rebalanceTrigger
+}
+
+func (b *Builder) SetRebalanceTrigger(trigger RebalanceTrigger) {
+	b.rebalanceTrigger = trigger
+}
+
+// RebalanceThreshold is the number of percentage points over or under that a
+// node may be before the Ring method rebalances, with RebalanceOverThreshold.
+// The default of 0 means to use the PointsAllowed.
+func (b *Builder) RebalanceThreshold() byte {
+	return b.rebalanceThreshold
+}
+
+func (b *Builder) SetRebalanceThreshold(points byte) {
+	b.rebalanceThreshold = points
+}
+
 // Config is the raw encoded global configuration.
 func (b *Builder) Config() []byte {
 	return b.config
@@ -561,6 +938,24 @@ func (b *Builder) SetConfig(config []byte) {
 	b.config = config
 }
 
+// AddressRoles returns the names given to the node address indexes; for
+// example, []string{"replication", "client"} would indicate Node.Address(0) is
+// the replication address and Node.Address(1) is the client address.
+func (b *Builder) AddressRoles() []string {
+	rv := make([]string, len(b.addressRoles))
+	copy(rv, b.addressRoles)
+	return rv
+}
+
+// SetAddressRoles names the node address indexes so users of the ring, such as
+// TCPMsgRing, can look up addresses by role rather than by a fragile
+// positional index. See AddressRoles.
+func (b *Builder) SetAddressRoles(roles []string) {
+	b.dirty = true
+	b.addressRoles = make([]string, len(roles))
+	copy(b.addressRoles, roles)
+}
+
 // IDBits is the number of bits in use for node IDs.
 func (b *Builder) IDBits() int {
 	return b.idBits
@@ -570,10 +965,12 @@ func (b *Builder) IDBits() int {
 // given. This can be useful in testing, as the ring algorithms will not
 // reassign replicas for a partition more often than once per MoveWait in order
 // to let reassignments take effect before moving the same data yet again.
+// The records saturate at math.MaxUint16 minutes rather than wrapping around,
+// which would make long settled partitions look just moved.
 func (b *Builder) PretendElapsed(minutes uint16) {
 	for _, partitionToLastMove := range b.replicaToPartitionToLastMove {
 		for partition := len(partitionToLastMove) - 1; partition >= 0; partition-- {
-			if math.MaxUint16-partitionToLastMove[partition] > minutes {
+			if partitionToLastMove[partition] > math.MaxUint16-minutes {
 				partitionToLastMove[partition] = math.MaxUint16
 			} else {
 				partitionToLastMove[partition] += minutes
@@ -595,11 +992,20 @@ func (b *Builder) Nodes() NodeSlice {
 // AddNode will add a new node to the builder for data assigment. Actual data
 // assignment won't ocurr until the Ring method is called, so you can add
 // multiple nodes or alter node values after creation if desired.
-func (b *Builder) AddNode(active bool, capacity uint32, tiers []string, addresses []string, meta string, config []byte) (BuilderNode, error) {
+func (b *Builder) AddNode(active bool, capacity uint64, tiers []string, addresses []string, meta string, config []byte) (BuilderNode, error) {
+	if err := b.checkCapacity(nil, capacity); err != nil {
+		return nil, err
+	}
 	b.dirty = true
 	addressesCopy := make([]string, len(addresses))
 	copy(addressesCopy, addresses)
-	n, err := newNode(b, &b.tierBase, b.nodes)
+	var n *node
+	var err error
+	if b.nodeIDSource != nil {
+		n, err = newNodeWithSource(b, &b.tierBase, b.nodes, b.nodeIDSource)
+	} else {
+		n, err = newNode(b, &b.tierBase, b.nodes)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -615,6 +1021,33 @@ func (b *Builder) AddNode(active bool, capacity uint32, tiers []string, addresse
 	return n, nil
 }
 
+// reassignNow reassigns the replicas of the inactive node right away, rather
+// than waiting for the next rebalance; see InactiveReassignImmediately.
+func (b *Builder) reassignNow(n *node) {
+	for i, bn := range b.nodes {
+		if bn == n {
+			newRebalancer(b).reassignDeactivatedNode(int32(i))
+			return
+		}
+	}
+}
+
+// checkCapacity returns an error if giving the node the capacity, or adding a
+// node with the capacity if node is nil, would overflow the total capacity.
+func (b *Builder) checkCapacity(n *node, capacity uint64) error {
+	total, err := sumCapacity(b.nodes)
+	if err != nil {
+		return err
+	}
+	if n != nil {
+		total -= n.capacity
+	}
+	if total+capacity < total {
+		return fmt.Errorf("capacity %d would overflow the total capacity of %d", capacity, total)
+	}
+	return nil
+}
+
 // RemoveNode will remove the node from the list of nodes for this
 // builder/ring. Note that this can be relatively expensive as all nodes that
 // had been added after the removed node had been originally added will have
@@ -626,6 +1059,8 @@ func (b *Builder) RemoveNode(nodeID uint64) {
 	for i, n := range b.nodes {
 		if n.id == nodeID {
 			b.dirty = true
+			delete(b.nodeCapacityReserves, nodeID)
+			delete(b.nodeDrains, nodeID)
 			copy(b.nodes[i:], b.nodes[i+1:])
 			b.nodes = b.nodes[:len(b.nodes)-1]
 			for _, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
@@ -642,6 +1077,149 @@ func (b *Builder) RemoveNode(nodeID uint64) {
 	}
 }
 
+// BuilderStats gives the sizes of the Builder's internal structures, so
+// operators of long-lived builders can see when GC would be worthwhile.
+type BuilderStats struct {
+	NodeCount         int
+	InactiveNodeCount int
+	// DepartedNodeCount is the number of inactive nodes that no longer have
+	// any partition replicas assigned; these are what GC would remove.
+	DepartedNodeCount int
+	// TierValueCount is the number of distinct tier values stored across all
+	// levels, UnusedTierValueCount being those no node refers to anymore.
+	TierValueCount       int
+	UnusedTierValueCount int
+	// AssignmentEntries is the number of replica-to-partition-to-node
+	// entries, and LastMoveEntries the number of replica-to-partition
+	// last-move entries; these are governed by the replica count and
+	// partition count rather than by the node history.
+	AssignmentEntries int
+	LastMoveEntries   int
+	// RegionTargetShortfalls is the number of partitions whose assignments
+	// do not meet the region targets; see SetRegionTargets.
+	RegionTargetShortfalls int
+	// ReservedCapacity is how much of the active nodes' capacity is held
+	// back from balancing as headroom; see SetCapacityReserve.
+	ReservedCapacity uint64
+	// Drains gives the progress of the nodes marked draining, in ascending
+	// order of node ID; see SetNodeDraining.
+	Drains []*NodeDrain
+	// DispersionViolations counts, by level, the partitions whose replicas
+	// are less dispersed than the active nodes would allow: index 0 counts
+	// partitions with replicas sharing a node even though enough active
+	// nodes exist to keep them apart, index 1 those sharing a tier level 0
+	// value even though enough such values have active nodes, and so on for
+	// each tier level. Correlated tier values count as the same value; see
+	// CorrelateTiers.
+	DispersionViolations []int
+	// MovesLastDay and MovesLastWeek are the number of partition replicas
+	// moved by rebalances within the last day and week, by the hour, and
+	// ChurnLastDay and ChurnLastWeek are those as percentages of the
+	// AssignmentEntries; see MoveHistory.
+	MovesLastDay  int
+	MovesLastWeek int
+	ChurnLastDay  float64
+	ChurnLastWeek float64
+}
+
+// Stats returns the current sizes of the Builder's internal structures.
+func (b *Builder) Stats() *BuilderStats {
+	s := &BuilderStats{NodeCount: len(b.nodes)}
+	assigned := b.assignedNodeIndexes()
+	for i, n := range b.nodes {
+		if n.inactive {
+			s.InactiveNodeCount++
+			if !assigned[i] {
+				s.DepartedNodeCount++
+			}
+		}
+	}
+	used := make([]map[int32]bool, len(b.tiers))
+	for lv := range used {
+		used[lv] = make(map[int32]bool)
+	}
+	for _, n := range b.nodes {
+		for lv, i := range n.tierIndexes {
+			used[lv][i] = true
+		}
+	}
+	for lv, tier := range b.tiers {
+		for i := 1; i < len(tier); i++ {
+			s.TierValueCount++
+			if !used[lv][int32(i)] {
+				s.UnusedTierValueCount++
+			}
+		}
+	}
+	for _, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+		s.AssignmentEntries += len(partitionToNodeIndex)
+	}
+	for _, partitionToLastMove := range b.replicaToPartitionToLastMove {
+		s.LastMoveEntries += len(partitionToLastMove)
+	}
+	s.RegionTargetShortfalls = len(b.RegionTargetShortfalls())
+	for _, n := range b.nodes {
+		if !n.inactive {
+			s.ReservedCapacity += n.capacity - n.unreservedCapacity()
+		}
+	}
+	s.Drains = b.drains()
+	s.DispersionViolations = b.dispersionViolations()
+	now := b.clock()
+	s.MovesLastDay = b.movesSince(now.Add(-23 * time.Hour))
+	s.MovesLastWeek = b.movesSince(now.Add(-(7*24 - 1) * time.Hour))
+	if s.AssignmentEntries > 0 {
+		s.ChurnLastDay = float64(s.MovesLastDay) * 100 / float64(s.AssignmentEntries)
+		s.ChurnLastWeek = float64(s.MovesLastWeek) * 100 / float64(s.AssignmentEntries)
+	}
+	return s
+}
+
+func (b *Builder) assignedNodeIndexes() []bool {
+	assigned := make([]bool, len(b.nodes))
+	for _, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+		for _, nodeIndex := range partitionToNodeIndex {
+			if nodeIndex >= 0 {
+				assigned[nodeIndex] = true
+			}
+		}
+	}
+	return assigned
+}
+
+// GC removes departed nodes, those that are inactive and no longer have any
+// partition replicas assigned, and then drops any tier values no longer in
+// use. It returns the number of nodes removed.
+//
+// The retention value is the number of minutes that must have passed since
+// the last reassignment of any partition replica before any nodes will be
+// removed, since a recently departed node may still hold data being moved to
+// its replacements; usually this would be the MoveWait. Note that nodes must
+// be deactivated, and a Ring generated to reassign their partitions, before
+// they can be collected.
+func (b *Builder) GC(retention uint16) int {
+	for _, partitionToLastMove := range b.replicaToPartitionToLastMove {
+		for _, lastMove := range partitionToLastMove {
+			if lastMove < retention {
+				b.minimizeTiers()
+				return 0
+			}
+		}
+	}
+	assigned := b.assignedNodeIndexes()
+	var departed []uint64
+	for i, n := range b.nodes {
+		if n.inactive && !assigned[i] {
+			departed = append(departed, n.id)
+		}
+	}
+	for _, nodeID := range departed {
+		b.RemoveNode(nodeID)
+	}
+	b.minimizeTiers()
+	return len(departed)
+}
+
 // Node returns the node instance identified, if there is one.
 func (b *Builder) Node(nodeID uint64) BuilderNode {
 	for _, n := range b.nodes {
@@ -664,10 +1242,36 @@ func (b *Builder) Tiers() [][]string {
 	return rv
 }
 
+func (b *Builder) clock() time.Time {
+	if b.now != nil {
+		return b.now()
+	}
+	return time.Now()
+}
+
 // Ring returns a Ring instance of the data defined by the builder. This will
-// cause any pending rebalancing actions to be performed. The Ring returned
-// will be immutable; to obtain updated ring data, Ring() must be called again.
+// cause any pending rebalancing actions to be performed, depending on the
+// RebalanceTrigger. The Ring returned will be immutable; to obtain updated
+// ring data, Ring() must be called again.
 func (b *Builder) Ring() Ring {
+	return b.ring(-1, nil)
+}
+
+// RingWithMoveBudget is the same as Ring but the rebalance will move at most
+// the number of partition replicas given, leaving further rebalancing for
+// later calls; this keeps the data movement caused by any one new ring
+// bounded. Replicas on nodes deactivated for reassignment are moved
+// regardless of the budget, though they do count against it, and unassigned
+// replicas are always assigned. See RebalanceReport.MoveBudgetExhausted.
+func (b *Builder) RingWithMoveBudget(moves int) Ring {
+	if moves < 0 {
+		moves = 0
+	}
+	return b.ring(moves, nil)
+}
+
+func (b *Builder) ring(moveBudget int, scope *tierScope) Ring {
+	start := time.Now()
 	validNodes := false
 	for _, n := range b.nodes {
 		if !n.inactive {
@@ -677,8 +1281,8 @@ func (b *Builder) Ring() Ring {
 	if !validNodes {
 		panic("no valid nodes yet")
 	}
-	newBase := time.Now().UnixNano()
-	d := (time.Now().UnixNano() - b.moveWaitBase) / 6000000000 // minutes
+	newBase := b.clock().UnixNano()
+	d := (newBase - b.moveWaitBase) / 6000000000 // minutes
 	if d > 0 {
 		var d16 uint16 = math.MaxUint16
 		if d < math.MaxUint16 {
@@ -687,11 +1291,33 @@ func (b *Builder) Ring() Ring {
 		b.PretendElapsed(d16)
 		b.moveWaitBase = newBase
 	}
-	if b.resizeIfNeeded() {
+	rebalance := b.rebalanceTriggered()
+	resized := rebalance && b.resizeIfNeeded()
+	if resized {
 		b.dirty = true
 	}
-	if newRebalancer(b).rebalance() {
-		b.dirty = true
+	if b.maxMovePercentage > 0 {
+		if budget := b.movePercentageBudget(int(b.maxMovePercentage)); moveBudget < 0 || budget < moveBudget {
+			moveBudget = budget
+		}
+	}
+	rb := newScopedRebalancer(b, scope)
+	if moveBudget >= 0 {
+		rb.budgeted = true
+		rb.movesLeft = moveBudget
+	}
+	if rebalance {
+		if rb.rebalance() {
+			b.dirty = true
+		}
+	} else {
+		// A Ring cannot have unassigned replicas, so those are always
+		// assigned.
+		rb.report.Skipped = true
+		rb.assignUnassigned()
+		if rb.altered {
+			b.dirty = true
+		}
 	}
 	if b.dirty {
 		b.dirty = false
@@ -704,20 +1330,53 @@ func (b *Builder) Ring() Ring {
 	}
 	nodes := make([]*node, len(b.nodes))
 	copy(nodes, b.nodes)
+	usableCapacities := make([]uint64, len(b.nodes))
+	for i, n := range b.nodes {
+		usableCapacities[i] = n.usableCapacity()
+	}
 	replicaToPartitionToNodeIndex := make([][]int32, len(b.replicaToPartitionToNodeIndex))
 	for i := 0; i < len(replicaToPartitionToNodeIndex); i++ {
 		replicaToPartitionToNodeIndex[i] = make([]int32, len(b.replicaToPartitionToNodeIndex[i]))
 		copy(replicaToPartitionToNodeIndex[i], b.replicaToPartitionToNodeIndex[i])
 	}
-	return &ring{
-		tierBase:          tierBase{tiers: tiers},
-		version:           b.version,
-		localNodeIndex:    -1,
-		partitionBitCount: b.partitionBitCount,
-		nodes:             nodes,
+	addressRoles := make([]string, len(b.addressRoles))
+	copy(addressRoles, b.addressRoles)
+	// The name was checked when set or loaded.
+	keyHasher, _ := registeredKeyHasher(b.keyHasher)
+	r := &ring{
+		tierBase:                      tierBase{tiers: tiers},
+		version:                       b.version,
+		localNodeIndex:                -1,
+		partitionBitCount:             b.partitionBitCount,
+		nodes:                         nodes,
 		replicaToPartitionToNodeIndex: replicaToPartitionToNodeIndex,
-		config: b.config,
-	}
+		config:                        b.config,
+		addressRoles:                  addressRoles,
+		partitionModes:                b.PartitionModes(),
+		usableCapacities:              usableCapacities,
+		keyHasherName:                 b.keyHasher,
+		keyHasher:                     keyHasher,
+	}
+	stats := r.Stats()
+	rb.report.Resized = resized
+	rb.report.PartitionBitCountCapped = b.partitionBitCount >= b.maxPartitionBitCount
+	rb.report.RegionTargetShortfalls = len(b.RegionTargetShortfalls())
+	rb.report.MaxUnderNodePercentage = stats.MaxUnderNodePercentage
+	rb.report.MaxOverNodePercentage = stats.MaxOverNodePercentage
+	rb.report.WithinPointsAllowed = stats.MaxUnderNodePercentage <= float64(b.pointsAllowed) && stats.MaxOverNodePercentage <= float64(b.pointsAllowed)
+	b.recordMoves(time.Unix(0, newBase), rb.report.Moves())
+	b.lastRebalanceReport = rb.report
+	if b.metrics != nil {
+		b.metrics.observe(rb.report, b.partitionBitCount, time.Since(start))
+	}
+	return r
+}
+
+// LastRebalanceReport returns the report of the rebalance done by the last
+// call to Ring, or nil if Ring has not yet been called; this is not
+// persisted with the Builder.
+func (b *Builder) LastRebalanceReport() *RebalanceReport {
+	return b.lastRebalanceReport
 }
 
 func (b *Builder) resizeIfNeeded() bool {
@@ -732,21 +1391,25 @@ func (b *Builder) resizeIfNeeded() bool {
 	totalCapacity := uint64(0)
 	for _, n := range b.nodes {
 		if !n.inactive {
-			totalCapacity += (uint64)(n.capacity)
+			totalCapacity += n.usableCapacity()
 		}
 	}
 	partitionCount := len(b.replicaToPartitionToNodeIndex[0])
 	partitionBitCount := b.partitionBitCount
 	pointsAllowed := float64(b.pointsAllowed) * 0.01
 	for _, n := range b.nodes {
-		if n.inactive {
+		if n.inactive || n.usableCapacity() == 0 {
 			continue
 		}
-		desiredPartitionCount := float64(partitionCount) * float64(replicaCount) * (float64(n.capacity) / float64(totalCapacity))
-		under := (desiredPartitionCount - float64(int(desiredPartitionCount))) / desiredPartitionCount
+		// The desired partition count is whole + fraction, computed exactly
+		// so huge capacities do not lose the fraction to float rounding.
+		whole, rem := desiredAssignments(n.usableCapacity(), totalCapacity, uint64(partitionCount)*uint64(replicaCount))
+		fraction := float64(rem) / float64(totalCapacity)
+		desiredPartitionCount := float64(whole) + fraction
+		under := fraction / desiredPartitionCount
 		over := float64(0)
-		if desiredPartitionCount > float64(int(desiredPartitionCount)) {
-			over = (float64(int(desiredPartitionCount)+1) - desiredPartitionCount) / desiredPartitionCount
+		if rem > 0 {
+			over = (1 - fraction) / desiredPartitionCount
 		}
 		if under > pointsAllowed || over > pointsAllowed {
 			partitionCount <<= 1
@@ -758,18 +1421,7 @@ func (b *Builder) resizeIfNeeded() bool {
 	}
 	// Grow the partitionToNodeIndex slices if the partition count grew.
 	if partitionCount > len(b.replicaToPartitionToNodeIndex[0]) {
-		shift := partitionBitCount - b.partitionBitCount
-		for replica := 0; replica < replicaCount; replica++ {
-			partitionToNodeIndex := make([]int32, partitionCount)
-			partitionToLastMove := make([]uint16, partitionCount)
-			for partition := 0; partition < partitionCount; partition++ {
-				partitionToNodeIndex[partition] = b.replicaToPartitionToNodeIndex[replica][partition>>shift]
-				partitionToLastMove[partition] = b.replicaToPartitionToLastMove[replica][partition>>shift]
-			}
-			b.replicaToPartitionToNodeIndex[replica] = partitionToNodeIndex
-			b.replicaToPartitionToLastMove[replica] = partitionToLastMove
-		}
-		b.partitionBitCount = partitionBitCount
+		b.growPartitionBitCount(partitionBitCount)
 		return true
 	}
 	// Consider: Shrinking the partitionToNodeIndex slices doesn't happen
@@ -778,3 +1430,23 @@ func (b *Builder) resizeIfNeeded() bool {
 	// sense.
 	return false
 }
+
+// growPartitionBitCount splits each partition into as many as the partition
+// bit count given calls for, each keeping the assignments of the original.
+func (b *Builder) growPartitionBitCount(partitionBitCount uint16) {
+	replicaCount := len(b.replicaToPartitionToNodeIndex)
+	partitionCount := 1 << partitionBitCount
+	shift := partitionBitCount - b.partitionBitCount
+	for replica := 0; replica < replicaCount; replica++ {
+		partitionToNodeIndex := make([]int32, partitionCount)
+		partitionToLastMove := make([]uint16, partitionCount)
+		for partition := 0; partition < partitionCount; partition++ {
+			partitionToNodeIndex[partition] = b.replicaToPartitionToNodeIndex[replica][partition>>shift]
+			partitionToLastMove[partition] = b.replicaToPartitionToLastMove[replica][partition>>shift]
+		}
+		b.replicaToPartitionToNodeIndex[replica] = partitionToNodeIndex
+		b.replicaToPartitionToLastMove[replica] = partitionToLastMove
+	}
+	b.growPartitionModes(shift)
+	b.partitionBitCount = partitionBitCount
+}
@@ -0,0 +1,341 @@
+package ring
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// BuilderHTTPHandlerConfig represents the set of values for configuring a
+// BuilderHTTPHandler.
+type BuilderHTTPHandlerConfig struct {
+	// LogDebug sets the func to use for debug messages. Defaults not logging
+	// debug messages.
+	LogDebug LogFunc
+	// Authorize, if set, will be called for every request; if it returns
+	// false the request will be rejected with http.StatusUnauthorized. This
+	// is the hook for whatever authentication scheme is in use, such as
+	// checking a bearer token or the verified client certificate. Defaults to
+	// allowing all requests, so be careful where the handler is exposed.
+	Authorize func(req *http.Request) bool
+	// BuilderChanged, if set, will be called after any request that modifies
+	// the Builder, such as to persist it with PersistRingOrBuilder; if it
+	// returns an error the request will respond with
+	// http.StatusInternalServerError.
+	BuilderChanged func(b *Builder) error
+	// RingChanged, if set, will be called after any request that generates a
+	// new Ring, such as to persist and distribute it; if it returns an error
+	// the request will respond with http.StatusInternalServerError.
+	RingChanged func(r Ring) error
+}
+
+// BuilderHTTPHandler is an http.Handler exposing Builder operations as a JSON
+// API, so clusters can be administered remotely. The routes are:
+//
+//	GET    /nodes       lists the nodes as []BuilderHTTPNode
+//	POST   /nodes       adds a node from a BuilderHTTPNodeUpdate
+//	GET    /nodes/<id>  returns a single BuilderHTTPNode
+//	PUT    /nodes/<id>  updates a node from a BuilderHTTPNodeUpdate
+//	DELETE /nodes/<id>  removes a node
+//	POST   /ring        rebalances and generates a new Ring, returning Stats
+//	GET    /ring        downloads the latest Ring as persisted by Ring.Persist
+//	GET    /stats       returns the Stats of the latest Ring
+//
+// POST /ring responds with http.StatusConflict, rather than generating a new
+// Ring, if the Builder's strict dispersion is not met; see
+// Builder.SetStrictDispersion.
+//
+// The handler serializes all access to the Builder, so the Builder should not
+// be used elsewhere while the handler is in use.
+type BuilderHTTPHandler struct {
+	logDebug       LogFunc
+	authorize      func(req *http.Request) bool
+	builderChanged func(b *Builder) error
+	ringChanged    func(r Ring) error
+	lock           sync.Mutex
+	builder        *Builder
+	ring           Ring
+}
+
+// NewBuilderHTTPHandler creates a BuilderHTTPHandler for the Builder.
+func NewBuilderHTTPHandler(b *Builder, c *BuilderHTTPHandlerConfig) *BuilderHTTPHandler {
+	cfg := &BuilderHTTPHandlerConfig{}
+	if c != nil {
+		*cfg = *c
+	}
+	h := &BuilderHTTPHandler{
+		logDebug:       cfg.LogDebug,
+		authorize:      cfg.Authorize,
+		builderChanged: cfg.BuilderChanged,
+		ringChanged:    cfg.RingChanged,
+		builder:        b,
+	}
+	if h.logDebug == nil {
+		h.logDebug = nilLogFunc
+	}
+	return h
+}
+
+// BuilderHTTPNode is the JSON representation of a Node. The ID is encoded as
+// a string since many JSON users cannot represent a full uint64.
+type BuilderHTTPNode struct {
+	ID          uint64   `json:"id,string"`
+	Active      bool     `json:"active"`
+	Capacity    uint64   `json:"capacity"`
+	Tiers       []string `json:"tiers"`
+	Addresses   []string `json:"addresses"`
+	Meta        string   `json:"meta"`
+	Config      []byte   `json:"config"`
+	NetworkZone string   `json:"network_zone"`
+}
+
+func newBuilderHTTPNode(n Node) *BuilderHTTPNode {
+	return &BuilderHTTPNode{
+		ID:          n.ID(),
+		Active:      n.Active(),
+		Capacity:    n.Capacity(),
+		Tiers:       n.Tiers(),
+		Addresses:   n.Addresses(),
+		Meta:        n.Meta(),
+		Config:      n.Config(),
+		NetworkZone: n.NetworkZone(),
+	}
+}
+
+// BuilderHTTPNodeUpdate is the JSON request body for adding or updating a
+// node; fields left out (nil) are left unchanged, or given their defaults
+// when adding a node (active with a capacity of 1, as with the CLI).
+type BuilderHTTPNodeUpdate struct {
+	Active      *bool    `json:"active"`
+	Capacity    *uint64  `json:"capacity"`
+	Tiers       []string `json:"tiers"`
+	Addresses   []string `json:"addresses"`
+	Meta        *string  `json:"meta"`
+	Config      []byte   `json:"config"`
+	NetworkZone *string  `json:"network_zone"`
+}
+
+// apply returns an error, leaving the node unchanged, if the capacity given
+// would overflow the Builder's total capacity.
+func (u *BuilderHTTPNodeUpdate) apply(n BuilderNode) error {
+	if u.Capacity != nil {
+		if err := n.SetCapacity(*u.Capacity); err != nil {
+			return err
+		}
+	}
+	if u.Active != nil {
+		n.SetActive(*u.Active)
+	}
+	if u.Tiers != nil {
+		n.ReplaceTiers(u.Tiers)
+	}
+	if u.Addresses != nil {
+		n.ReplaceAddresses(u.Addresses)
+	}
+	if u.Meta != nil {
+		n.SetMeta(*u.Meta)
+	}
+	if u.NetworkZone != nil {
+		n.SetNetworkZone(*u.NetworkZone)
+	}
+	if u.Config != nil {
+		n.SetConfig(u.Config)
+	}
+	return nil
+}
+
+func (h *BuilderHTTPHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if h.authorize != nil && !h.authorize(req) {
+		h.logDebug("BuilderHTTPHandler: unauthorized %s %s from %s\n", req.Method, req.URL.Path, req.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	switch {
+	case len(parts) == 1 && parts[0] == "nodes":
+		switch req.Method {
+		case "GET":
+			h.listNodes(w)
+		case "POST":
+			h.addNode(w, req)
+		default:
+			methodNotAllowed(w, "GET, POST")
+		}
+	case len(parts) == 2 && parts[0] == "nodes":
+		nodeID, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid node id %q", parts[1]), http.StatusBadRequest)
+			return
+		}
+		n := h.builder.Node(nodeID)
+		if n == nil {
+			http.NotFound(w, req)
+			return
+		}
+		switch req.Method {
+		case "GET":
+			writeJSON(w, http.StatusOK, newBuilderHTTPNode(n))
+		case "PUT":
+			h.updateNode(w, req, n)
+		case "DELETE":
+			h.builder.RemoveNode(nodeID)
+			if !h.changed(w) {
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			methodNotAllowed(w, "GET, PUT, DELETE")
+		}
+	case len(parts) == 1 && parts[0] == "ring":
+		switch req.Method {
+		case "GET":
+			h.downloadRing(w)
+		case "POST":
+			h.rebalance(w)
+		default:
+			methodNotAllowed(w, "GET, POST")
+		}
+	case len(parts) == 1 && parts[0] == "stats":
+		if req.Method != "GET" {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		if h.ring == nil {
+			http.Error(w, "no ring has been generated yet", http.StatusConflict)
+			return
+		}
+		writeJSON(w, http.StatusOK, h.ring.Stats())
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (h *BuilderHTTPHandler) listNodes(w http.ResponseWriter) {
+	nodes := h.builder.Nodes()
+	rv := make([]*BuilderHTTPNode, len(nodes))
+	for i, n := range nodes {
+		rv[i] = newBuilderHTTPNode(n)
+	}
+	writeJSON(w, http.StatusOK, rv)
+}
+
+func (h *BuilderHTTPHandler) addNode(w http.ResponseWriter, req *http.Request) {
+	u := &BuilderHTTPNodeUpdate{}
+	if err := json.NewDecoder(req.Body).Decode(u); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n, err := h.builder.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err = u.apply(n); err != nil {
+		h.builder.RemoveNode(n.ID())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.changed(w) {
+		return
+	}
+	writeJSON(w, http.StatusCreated, newBuilderHTTPNode(n))
+}
+
+func (h *BuilderHTTPHandler) updateNode(w http.ResponseWriter, req *http.Request, n BuilderNode) {
+	u := &BuilderHTTPNodeUpdate{}
+	if err := json.NewDecoder(req.Body).Decode(u); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := u.apply(n); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.changed(w) {
+		return
+	}
+	writeJSON(w, http.StatusOK, newBuilderHTTPNode(n))
+}
+
+func (h *BuilderHTTPHandler) rebalance(w http.ResponseWriter) {
+	active := false
+	for _, n := range h.builder.Nodes() {
+		if n.Active() {
+			active = true
+			break
+		}
+	}
+	if !active {
+		http.Error(w, "no active nodes", http.StatusConflict)
+		return
+	}
+	r, strictErr := h.builder.StrictRing()
+	// Generating a Ring updates the Builder's move records and version.
+	if !h.changed(w) {
+		return
+	}
+	if strictErr != nil {
+		http.Error(w, strictErr.Error(), http.StatusConflict)
+		return
+	}
+	h.ring = r
+	if h.ringChanged != nil {
+		if err := h.ringChanged(h.ring); err != nil {
+			h.logDebug("BuilderHTTPHandler: RingChanged: %s\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, h.ring.Stats())
+}
+
+func (h *BuilderHTTPHandler) downloadRing(w http.ResponseWriter) {
+	if h.ring == nil {
+		http.Error(w, "no ring has been generated yet", http.StatusConflict)
+		return
+	}
+	buf := &bytes.Buffer{}
+	if err := h.ring.Persist(buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Write(buf.Bytes())
+}
+
+// changed calls builderChanged, if set, and returns false if it failed and an
+// error response was written.
+func (h *BuilderHTTPHandler) changed(w http.ResponseWriter) bool {
+	if h.builderChanged == nil {
+		return true
+	}
+	if err := h.builderChanged(h.builder); err != nil {
+		h.logDebug("BuilderHTTPHandler: BuilderChanged: %s\n", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	byts, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(byts)
+}
@@ -0,0 +1,110 @@
+package ring
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBuilderHTTPHandler(t *testing.T) {
+	b := NewBuilder(64)
+	changes := 0
+	var lastRing Ring
+	h := NewBuilderHTTPHandler(b, &BuilderHTTPHandlerConfig{
+		Authorize:      func(req *http.Request) bool { return req.Header.Get("Authorization") == "Bearer secret" },
+		BuilderChanged: func(b *Builder) error { changes++; return nil },
+		RingChanged:    func(r Ring) error { lastRing = r; return nil },
+	})
+	do := func(method string, path string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	req, _ := http.NewRequest("GET", "/nodes", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("%d != %d", w.Code, http.StatusUnauthorized)
+	}
+	if w = do("POST", "/ring", ""); w.Code != http.StatusConflict {
+		t.Fatalf("%d != %d", w.Code, http.StatusConflict)
+	}
+	w = do("POST", "/nodes", `{"capacity": 2, "tiers": ["server1"], "addresses": ["127.0.0.1:1234"], "meta": "A"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("%d != %d %s", w.Code, http.StatusCreated, w.Body.String())
+	}
+	n := &BuilderHTTPNode{}
+	if err := json.Unmarshal(w.Body.Bytes(), n); err != nil {
+		t.Fatal(err)
+	}
+	if n.ID == 0 || !n.Active || n.Capacity != 2 || n.Meta != "A" || n.Tiers[0] != "server1" || n.Addresses[0] != "127.0.0.1:1234" {
+		t.Fatalf("%#v", n)
+	}
+	w = do("PUT", "/nodes/"+jsonID(n.ID), `{"capacity": 5}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%d != %d %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if b.Node(n.ID).Capacity() != 5 || b.Node(n.ID).Meta() != "A" {
+		t.Fatalf("%d %q", b.Node(n.ID).Capacity(), b.Node(n.ID).Meta())
+	}
+	if w = do("GET", "/nodes/12345", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("%d != %d", w.Code, http.StatusNotFound)
+	}
+	w = do("GET", "/nodes", "")
+	var nodes []*BuilderHTTPNode
+	if err := json.Unmarshal(w.Body.Bytes(), &nodes); err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || nodes[0].ID != n.ID {
+		t.Fatalf("%#v", nodes)
+	}
+	if w = do("GET", "/ring", ""); w.Code != http.StatusConflict {
+		t.Fatalf("%d != %d", w.Code, http.StatusConflict)
+	}
+	if w = do("POST", "/ring", ""); w.Code != http.StatusOK {
+		t.Fatalf("%d != %d %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if lastRing == nil {
+		t.Fatal("RingChanged not called")
+	}
+	w = do("GET", "/ring", "")
+	r, err := LoadRing(bytes.NewBuffer(w.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Version() != lastRing.Version() {
+		t.Fatalf("%d != %d", r.Version(), lastRing.Version())
+	}
+	s := &Stats{}
+	w = do("GET", "/stats", "")
+	if err := json.Unmarshal(w.Body.Bytes(), s); err != nil {
+		t.Fatal(err)
+	}
+	if s.ActiveNodeCount != 1 {
+		t.Fatalf("%d != 1", s.ActiveNodeCount)
+	}
+	if w = do("DELETE", "/nodes/"+jsonID(n.ID), ""); w.Code != http.StatusNoContent {
+		t.Fatalf("%d != %d", w.Code, http.StatusNoContent)
+	}
+	if len(b.Nodes()) != 0 {
+		t.Fatalf("%d != 0", len(b.Nodes()))
+	}
+	if changes != 4 {
+		t.Fatalf("%d != 4", changes)
+	}
+}
+
+func jsonID(id uint64) string {
+	byts, _ := json.Marshal(&struct {
+		ID uint64 `json:"id,string"`
+	}{id})
+	return strings.Split(string(byts), `"`)[3]
+}
@@ -0,0 +1,137 @@
+package ring
+
+import "fmt"
+
+// BuilderMergeConfig represents the set of values for configuring a
+// Builder.Merge.
+type BuilderMergeConfig struct {
+	// KeepIDs indicates the imported nodes should keep their IDs; the merge
+	// fails if any ID is already in use or does not fit within the Builder's
+	// ID bits. By default, imported nodes are given new IDs; the mapping is
+	// available with BuilderMerge.NodeIDs.
+	KeepIDs bool
+	// RemapTiers, if set, will be given the tiers of each imported node and
+	// should return the tiers to use; for example, to add a tier level
+	// naming the original cluster or to rename zones that clash.
+	RemapTiers func(tiers []string) []string
+	// Steps indicates over how many steps the imported nodes' capacities are
+	// raised to their full values; see BuilderMerge.Step. Defaults to 1,
+	// meaning the nodes are imported at full capacity.
+	Steps int
+}
+
+// BuilderMerge tracks a merge of another Builder's nodes into a Builder, as
+// returned by Builder.Merge.
+type BuilderMerge struct {
+	builder    *Builder
+	steps      int
+	step       int
+	nodeIDs    map[uint64]uint64
+	capacities map[uint64]uint64
+}
+
+// Merge imports the nodes of the other Builder into this Builder, such as
+// when consolidating two clusters. The partition assignments of the other
+// Builder cannot be carried over, as the merged ring has a single assignment
+// per partition replica; instead the imported nodes are treated as new
+// capacity and take on partitions as the Builder rebalances.
+//
+// Each rebalance is already limited by the move wait and by only moving some
+// replicas of any partition at once. To spread the merge out further, set
+// BuilderMergeConfig.Steps: the imported nodes start with a fraction of their
+// capacity and BuilderMerge.Step raises it, so each Ring generated between
+// steps moves only a share of the data.
+//
+// Note that the BuilderMerge progress is not persisted with the Builder; the
+// imported nodes' reduced capacities are, so a merge interrupted by a restart
+// can be finished by setting the capacities directly.
+func (b *Builder) Merge(other *Builder, c *BuilderMergeConfig) (*BuilderMerge, error) {
+	cfg := &BuilderMergeConfig{}
+	if c != nil {
+		*cfg = *c
+	}
+	if cfg.Steps < 1 {
+		cfg.Steps = 1
+	}
+	if cfg.KeepIDs {
+		mask := uint64(1)<<uint64(b.idBits) - 1
+		for _, on := range other.nodes {
+			if on.id&^mask != 0 {
+				return nil, fmt.Errorf("node ID %d does not fit within %d ID bits", on.id, b.idBits)
+			}
+			if b.Node(on.id) != nil {
+				return nil, fmt.Errorf("node ID %d already in use", on.id)
+			}
+		}
+	}
+	// Checking the full capacities upfront means the steps cannot fail.
+	if _, err := sumCapacity(append(append([]*node{}, b.nodes...), other.nodes...)); err != nil {
+		return nil, err
+	}
+	m := &BuilderMerge{
+		builder:    b,
+		steps:      cfg.Steps,
+		step:       1,
+		nodeIDs:    make(map[uint64]uint64, len(other.nodes)),
+		capacities: make(map[uint64]uint64, len(other.nodes)),
+	}
+	for _, on := range other.nodes {
+		tiers := on.Tiers()
+		if cfg.RemapTiers != nil {
+			tiers = cfg.RemapTiers(tiers)
+		}
+		var config []byte
+		if on.config != nil {
+			config = make([]byte, len(on.config))
+			copy(config, on.config)
+		}
+		n, err := b.AddNode(!on.inactive, m.stepCapacity(on.capacity), tiers, on.addresses, on.meta, config)
+		if err != nil {
+			return nil, err
+		}
+		n.SetNetworkZone(on.networkZone)
+		if cfg.KeepIDs {
+			n.(*node).id = on.id
+		}
+		m.nodeIDs[on.id] = n.ID()
+		m.capacities[n.ID()] = on.capacity
+	}
+	return m, nil
+}
+
+func (m *BuilderMerge) stepCapacity(capacity uint64) uint64 {
+	return scaleCapacity(capacity, uint64(m.step), uint64(m.steps))
+}
+
+// NodeIDs returns the mapping from the other Builder's node IDs to the IDs of
+// the imported nodes.
+func (m *BuilderMerge) NodeIDs() map[uint64]uint64 {
+	ids := make(map[uint64]uint64, len(m.nodeIDs))
+	for k, v := range m.nodeIDs {
+		ids[k] = v
+	}
+	return ids
+}
+
+// Done returns true once the imported nodes are at full capacity.
+func (m *BuilderMerge) Done() bool {
+	return m.step >= m.steps
+}
+
+// Step raises the capacity of the imported nodes by one step, returning true
+// if this was the final step. Steps would usually be taken once the Ring
+// generated after the previous step has been put in place and the data
+// movement it caused has completed, no sooner than the move wait. Imported
+// nodes that have since been removed are skipped.
+func (m *BuilderMerge) Step() bool {
+	if m.Done() {
+		return true
+	}
+	m.step++
+	for id, capacity := range m.capacities {
+		if n := m.builder.Node(id); n != nil {
+			n.SetCapacity(m.stepCapacity(capacity))
+		}
+	}
+	return m.Done()
+}
@@ -0,0 +1,56 @@
+package ring
+
+import "testing"
+
+func TestBuilderMerge(t *testing.T) {
+	b := NewBuilder(64)
+	for i := 0; i < 2; i++ {
+		if _, err := b.AddNode(true, 4, []string{"server", "zone1"}, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := NewBuilder(64)
+	on, err := other.AddNode(true, 4, []string{"server", "zone1"}, []string{"10.0.0.1:1"}, "other", []byte("cfg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.Merge(other, &BuilderMergeConfig{KeepIDs: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.Merge(other, &BuilderMergeConfig{KeepIDs: true}); err == nil {
+		t.Fatal("expected ID conflict error")
+	}
+	b = NewBuilder(64)
+	for i := 0; i < 2; i++ {
+		if _, err = b.AddNode(true, 4, []string{"server", "zone1"}, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := b.Merge(other, &BuilderMergeConfig{
+		Steps:      4,
+		RemapTiers: func(tiers []string) []string { return append(tiers, "other-cluster") },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := m.NodeIDs()
+	n := b.Node(ids[on.ID()])
+	if n == nil || n.Meta() != "other" || n.Address(0) != "10.0.0.1:1" || string(n.Config()) != "cfg" || n.Tier(2) != "other-cluster" {
+		t.Fatalf("%#v", n)
+	}
+	for step := uint64(1); step <= 4; step++ {
+		if n.Capacity() != step {
+			t.Fatalf("%d != %d", n.Capacity(), step)
+		}
+		if m.Step() != (step >= 3) {
+			t.Fatalf("step %d", step)
+		}
+	}
+	if !m.Done() || n.Capacity() != 4 {
+		t.Fatalf("%v %d", m.Done(), n.Capacity())
+	}
+	r := b.Ring()
+	if r.NodeCount() != 3 {
+		t.Fatalf("%d != 3", r.NodeCount())
+	}
+}
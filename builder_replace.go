@@ -0,0 +1,48 @@
+package ring
+
+import "fmt"
+
+// ReplaceNode transfers all the partition replica assignments of the old node
+// to the new node and then removes the old node; for example, when a failed
+// server's drive is restored into new hardware with a new address. The new
+// node must already have been added, usually with AddNode, and must not have
+// any assignments of its own yet.
+//
+// The assignments are transferred wholesale, keeping their move wait state,
+// so no rebalancing or data movement beyond the physical restore is needed.
+// The new node would usually be given the same capacity and tiers as the old
+// node; otherwise the next rebalance will adjust to the differences as with
+// any other node change.
+func (b *Builder) ReplaceNode(oldNodeID uint64, newNodeID uint64) error {
+	if oldNodeID == newNodeID {
+		return fmt.Errorf("node %d cannot replace itself", oldNodeID)
+	}
+	oldNodeIndex := int32(-1)
+	newNodeIndex := int32(-1)
+	for i, n := range b.nodes {
+		switch n.id {
+		case oldNodeID:
+			oldNodeIndex = int32(i)
+		case newNodeID:
+			newNodeIndex = int32(i)
+		}
+	}
+	if oldNodeIndex < 0 {
+		return fmt.Errorf("no node with id %d", oldNodeID)
+	}
+	if newNodeIndex < 0 {
+		return fmt.Errorf("no node with id %d", newNodeID)
+	}
+	if b.assignedNodeIndexes()[newNodeIndex] {
+		return fmt.Errorf("node %d already has partition replicas assigned", newNodeID)
+	}
+	for _, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+		for partition, nodeIndex := range partitionToNodeIndex {
+			if nodeIndex == oldNodeIndex {
+				partitionToNodeIndex[partition] = newNodeIndex
+			}
+		}
+	}
+	b.RemoveNode(oldNodeID)
+	return nil
+}
@@ -0,0 +1,53 @@
+package ring
+
+import "testing"
+
+func TestBuilderReplaceNode(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetReplicaCount(2)
+	// Capped so the partition count cannot change between the rings.
+	b.SetMaxPartitionBitCount(4)
+	for i := 0; i < 3; i++ {
+		if _, err := b.AddNode(true, 1, []string{"server"}, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := b.Ring()
+	old := b.Nodes()[1]
+	n, err := b.AddNode(true, 1, []string{"server"}, []string{"10.0.0.9:1"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.ReplaceNode(old.ID(), n.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if b.Node(old.ID()) != nil {
+		t.Fatal("old node still present")
+	}
+	r2 := b.Ring()
+	if r2.Version() == r.Version() {
+		t.Fatal("version did not change")
+	}
+	for p := Partition(0); p < Partition(1)<<r.PartitionBitCount(); p++ {
+		nodes := r.ResponsibleNodes(p)
+		nodes2 := r2.ResponsibleNodes(p)
+		for i := range nodes {
+			want := nodes[i].ID()
+			if want == old.ID() {
+				want = n.ID()
+			}
+			if nodes2[i].ID() != want {
+				t.Fatalf("partition %d replica %d: %d != %d", p, i, nodes2[i].ID(), want)
+			}
+		}
+	}
+	if err = b.ReplaceNode(n.ID(), b.Nodes()[0].ID()); err == nil {
+		t.Fatal("expected error replacing with an assigned node")
+	}
+	if err = b.ReplaceNode(n.ID(), n.ID()); err == nil {
+		t.Fatal("expected error replacing a node with itself")
+	}
+	if err = b.ReplaceNode(old.ID(), n.ID()); err == nil {
+		t.Fatal("expected error for unknown node")
+	}
+}
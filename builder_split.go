@@ -0,0 +1,80 @@
+package ring
+
+import "fmt"
+
+// Split divides the Builder's nodes into two new Builders, such as when
+// splitting a cluster along tenant or region lines; the first Builder gets
+// the nodes for which inFirst returns true and the second gets the rest. This
+// Builder is left unchanged.
+//
+// The new Builders keep the settings and node IDs of this Builder, and keep
+// each partition replica assigned to its current node wherever that node is
+// in the same new Builder. Replicas whose node went to the other Builder are
+// left unassigned, to be assigned on the next rebalance, so only the data for
+// those replicas needs to move.
+func (b *Builder) Split(inFirst func(n Node) bool) (*Builder, *Builder, error) {
+	var nodeIndexToFirst []bool
+	firstActive, secondActive := false, false
+	for _, n := range b.nodes {
+		first := inFirst(n)
+		nodeIndexToFirst = append(nodeIndexToFirst, first)
+		if !n.inactive {
+			if first {
+				firstActive = true
+			} else {
+				secondActive = true
+			}
+		}
+	}
+	if !firstActive || !secondActive {
+		return nil, nil, fmt.Errorf("each side of a split must have at least one active node")
+	}
+	first, err := b.splitCopy(nodeIndexToFirst, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	second, err := b.splitCopy(nodeIndexToFirst, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return first, second, nil
+}
+
+// splitCopy returns a copy of the Builder with just the nodes whose
+// nodeIndexToFirst value matches first. The copy is made by way of the
+// persisted form, so it keeps every persisted setting, with those for the
+// nodes of the other side dropped.
+func (b *Builder) splitCopy(nodeIndexToFirst []bool, first bool) (*Builder, error) {
+	s, err := b.deepCopy()
+	if err != nil {
+		return nil, err
+	}
+	s.dirty = true
+	s.generation = 0
+	oldToNewIndex := make([]int32, len(s.nodes))
+	kept := s.nodes[:0]
+	for i, n := range s.nodes {
+		if nodeIndexToFirst[i] != first {
+			oldToNewIndex[i] = -1
+			delete(s.nodeCapacityReserves, n.id)
+			delete(s.nodeDrains, n.id)
+			s.CancelCapacitySchedule(n.id)
+			continue
+		}
+		oldToNewIndex[i] = int32(len(kept))
+		kept = append(kept, n)
+	}
+	for i := len(kept); i < len(s.nodes); i++ {
+		s.nodes[i] = nil
+	}
+	s.nodes = kept
+	for _, partitionToNodeIndex := range s.replicaToPartitionToNodeIndex {
+		for partition, nodeIndex := range partitionToNodeIndex {
+			if nodeIndex >= 0 {
+				partitionToNodeIndex[partition] = oldToNewIndex[nodeIndex]
+			}
+		}
+	}
+	s.minimizeTiers()
+	return s, nil
+}
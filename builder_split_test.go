@@ -0,0 +1,129 @@
+package ring
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBuilderSplit(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetReplicaCount(2)
+	for _, region := range []string{"r1", "r1", "r2", "r2"} {
+		if _, err := b.AddNode(true, 1, []string{"", region}, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := b.Ring()
+	inR1 := func(n Node) bool { return n.Tier(1) == "r1" }
+	if _, _, err := b.Split(func(n Node) bool { return true }); err == nil {
+		t.Fatal("expected error with an empty side")
+	}
+	b1, b2, err := b.Split(inR1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Nodes()) != 4 || len(b1.Nodes()) != 2 || len(b2.Nodes()) != 2 {
+		t.Fatalf("%d %d %d", len(b.Nodes()), len(b1.Nodes()), len(b2.Nodes()))
+	}
+	if b1.ReplicaCount() != 2 || b1.Nodes()[0].ID() != b.Nodes()[0].ID() || b2.Nodes()[0].Tier(1) != "r2" {
+		t.Fatalf("%d %d %q", b1.ReplicaCount(), b1.Nodes()[0].ID(), b2.Nodes()[0].Tier(1))
+	}
+	kept := 0
+	for _, sb := range []*Builder{b1, b2} {
+		sr := sb.Ring()
+		for p := Partition(0); p < 1<<r.PartitionBitCount(); p++ {
+			before := r.ResponsibleNodes(p)
+			after := sr.ResponsibleNodes(p >> (r.PartitionBitCount() - sr.PartitionBitCount()))
+			for replica, n := range after {
+				if n == nil || sr.Node(n.ID()) == nil {
+					t.Fatalf("partition %d replica %d unassigned", p, replica)
+				}
+				if before[replica].ID() == n.ID() {
+					kept++
+				}
+			}
+		}
+	}
+	// Every original assignment lives on in one of the two builders.
+	if kept < 2<<r.PartitionBitCount() {
+		t.Fatalf("%d < %d", kept, 2<<r.PartitionBitCount())
+	}
+}
+
+func TestBuilderSplitSettings(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetReplicaCount(2)
+	var ids []uint64
+	for _, region := range []string{"r1", "r1", "r2", "r2"} {
+		n, err := b.AddNode(true, 100, []string{"", region}, nil, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, n.ID())
+	}
+	b.Ring()
+	b.SetMaxMovePercentage(5)
+	if err := b.SetCapacityReserve(10); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []uint64{ids[0], ids[2]} {
+		if err := b.SetNodeCapacityReserve(id, 20); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.SetNodeDraining(id, true); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.ScheduleCapacity(CapacitySchedule{NodeID: id, From: 100, To: 200, Start: time.Unix(1, 0), Duration: time.Hour}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tieBroken := false
+	b.SetTieBreaker(func(nodes NodeSlice) { tieBroken = true })
+	b.recordMoves(time.Now(), 7)
+	history := b.MoveHistory()
+	b1, b2, err := b.Split(func(n Node) bool { return n.Tier(1) == "r1" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, sb := range []*Builder{b1, b2} {
+		id, otherID := ids[2*i], ids[2-2*i]
+		if sb.MaxMovePercentage() != 5 || sb.CapacityReserve() != 10 {
+			t.Fatal(i, sb.MaxMovePercentage(), sb.CapacityReserve())
+		}
+		if percentage, ok := sb.NodeCapacityReserve(id); !ok || percentage != 20 {
+			t.Fatal(i, percentage, ok)
+		}
+		if _, ok := sb.nodeCapacityReserves[otherID]; ok {
+			t.Fatal(i, "kept the reserve of a node of the other side")
+		}
+		if !sb.NodeDraining(id) || len(sb.nodeDrains) != 1 {
+			t.Fatal(i, sb.nodeDrains)
+		}
+		if schedules := sb.CapacitySchedules(); len(schedules) != 1 || schedules[0].NodeID != id || schedules[0].To != 200 {
+			t.Fatal(i, schedules)
+		}
+		if !reflect.DeepEqual(sb.MoveHistory(), history) {
+			t.Fatal(i, sb.MoveHistory(), history)
+		}
+		if sb.tieBreaker == nil || sb.Generation() != 0 {
+			t.Fatal(i, sb.Generation())
+		}
+	}
+	b1.tieBreaker(nil)
+	if !tieBroken {
+		t.Fatal("tie breaker not kept")
+	}
+	// The split builders persist and load with their settings.
+	buf := bytes.NewBuffer(nil)
+	if err = b1.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	if b1, err = LoadBuilder(buf); err != nil {
+		t.Fatal(err)
+	}
+	if b1.MaxMovePercentage() != 5 || !b1.NodeDraining(ids[0]) || len(b1.Nodes()) != 2 {
+		t.Fatal(b1.MaxMovePercentage(), b1.NodeDraining(ids[0]), len(b1.Nodes()))
+	}
+}
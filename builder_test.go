@@ -2,7 +2,15 @@ package ring
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"math"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 )
 
@@ -50,10 +58,225 @@ func TestBuilderPersistence(t *testing.T) {
 	helperTestBuilderPersistence(t, []byte("Config"))
 }
 
+func TestLoadBuilderChecksum(t *testing.T) {
+	b := NewBuilder(8)
+	if _, err := b.AddNode(true, 1, nil, nil, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	b.Ring()
+	var buf bytes.Buffer
+	if err := b.Persist(&buf); err != nil {
+		t.Fatal(err)
+	}
+	byts := buf.Bytes()
+	// The gzip trailer is the CRC-32 and then the length.
+	byts[len(byts)-8] ^= 0xff
+	if _, err := LoadBuilder(bytes.NewReader(byts)); err != gzip.ErrChecksum {
+		t.Fatal(err)
+	}
+	byts[len(byts)-8] ^= 0xff
+	if _, err := LoadBuilder(bytes.NewReader(byts[:len(byts)-4])); err == nil {
+		t.Fatal("expected error loading a truncated builder")
+	}
+	if _, err := LoadBuilder(bytes.NewReader(byts)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// corruptPersisted returns the gzipped byts with the int32 offset bytes past
+// the end of the marker replaced by value.
+func corruptPersisted(t *testing.T, byts []byte, marker string, offset int, value int32) []byte {
+	gr, err := gzip.NewReader(bytes.NewReader(byts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadAll(gr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.Index(raw, []byte(marker))
+	if i < 0 {
+		t.Fatalf("no %q in the persisted data", marker)
+	}
+	binary.BigEndian.PutUint32(raw[i+len(marker)+offset:], uint32(value))
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write(raw)
+	gw.Close()
+	return buf.Bytes()
+}
+
+func TestLoadBuilderCorrupt(t *testing.T) {
+	b := NewBuilder(8)
+	if _, err := b.AddNode(true, 1, nil, nil, "Meta", nil); err != nil {
+		t.Fatal(err)
+	}
+	b.Ring()
+	var buf bytes.Buffer
+	if err := b.Persist(&buf); err != nil {
+		t.Fatal(err)
+	}
+	// After the meta come the config and network zone lengths, the partition
+	// bit count, the replica count, and the first replica's partition count.
+	for _, c := range []struct {
+		offset int
+		value  int32
+	}{
+		{-8, -1},
+		{-8, math.MaxInt32},
+		{0, -1},
+		{0, math.MaxInt32},
+		{10, -1},
+		{10, math.MaxInt32},
+		{14, -1},
+		{14, 3},
+		{14, math.MaxInt32},
+	} {
+		_, err := LoadBuilder(bytes.NewReader(corruptPersisted(t, buf.Bytes(), "Meta", c.offset, c.value)))
+		if err == nil {
+			t.Fatalf("%d at %d loaded", c.value, c.offset)
+		}
+		if c.value == math.MaxInt32 && c.offset <= 0 && err != io.ErrUnexpectedEOF {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadBuilderVersion1(t *testing.T) {
+	// testdata/builder_v1.builder was persisted by the first release, along
+	// with testdata/ring_v1.ring from its Ring.
+	f, err := os.Open("testdata/builder_v1.builder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := LoadBuilder(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b.Config()) != "cluster config" || b.ReplicaCount() != 3 || b.Generation() != 0 {
+		t.Fatal(string(b.Config()), b.ReplicaCount(), b.Generation())
+	}
+	if b.DispersionPointsAllowed() != 255 || b.StrictDispersion() != -1 {
+		t.Fatal(b.DispersionPointsAllowed(), b.StrictDispersion())
+	}
+	nodes := b.Nodes()
+	if len(nodes) != 4 {
+		t.Fatal(len(nodes))
+	}
+	for i, n := range nodes {
+		if n.Capacity() != uint64(100*(i+1)) || n.Active() != (i != 3) || n.Tier(1) == "" || n.Address(0) == "" || n.NetworkZone() != "" {
+			t.Fatalf("%d %d %v %v %v %q", i, n.Capacity(), n.Active(), n.Tiers(), n.Addresses(), n.NetworkZone())
+		}
+	}
+	f, err = os.Open("testdata/ring_v1.ring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := LoadRing(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2 := b.Ring()
+	if r2.Version() != r.Version() {
+		t.Fatal(r2.Version(), r.Version())
+	}
+	if r2.PartitionBitCount() != r.PartitionBitCount() {
+		t.Fatal(r2.PartitionBitCount(), r.PartitionBitCount())
+	}
+	for partition := Partition(0); partition < 1<<r.PartitionBitCount(); partition++ {
+		var ids, ids2 []uint64
+		for _, n := range r.ResponsibleNodes(partition) {
+			ids = append(ids, n.ID())
+		}
+		for _, n := range r2.ResponsibleNodes(partition) {
+			ids2 = append(ids2, n.ID())
+		}
+		if len(ids) != 3 || !reflect.DeepEqual(ids2, ids) {
+			t.Fatal(partition, ids2, ids)
+		}
+	}
+	// Persisting migrates it to the current format.
+	var buf bytes.Buffer
+	if err = b.Persist(&buf); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := LoadBuilder(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b2.Generation() != 1 || len(b2.Nodes()) != 4 || b2.Nodes()[3].Capacity() != 400 || b2.StrictDispersion() != -1 {
+		t.Fatal(b2.Generation(), len(b2.Nodes()), b2.StrictDispersion())
+	}
+}
+
+func TestBuilderPersistConflict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "builderconflict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "test.builder")
+	b := NewBuilder(8)
+	if err = PersistRingOrBuilder(nil, b, filename); err != nil {
+		t.Fatal(err)
+	}
+	if b.Generation() != 1 {
+		t.Fatal(b.Generation())
+	}
+	_, b1, err := RingOrBuilder(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, b2, err := RingOrBuilder(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b1.Generation() != 1 || b2.Generation() != 1 {
+		t.Fatal(b1.Generation(), b2.Generation())
+	}
+	b1.SetReplicaCount(2)
+	if err = PersistRingOrBuilder(nil, b1, filename); err != nil {
+		t.Fatal(err)
+	}
+	// A second persist of the same Builder is not a conflict.
+	if err = PersistRingOrBuilder(nil, b1, filename); err != nil {
+		t.Fatal(err)
+	}
+	b2.SetReplicaCount(3)
+	err = PersistRingOrBuilder(nil, b2, filename)
+	if cerr, ok := err.(*BuilderConflictError); !ok || cerr.Generation != 1 || cerr.OnDisk != 3 {
+		t.Fatalf("%#v", err)
+	}
+	_, b3, err := RingOrBuilder(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b3.ReplicaCount() != 2 {
+		t.Fatal(b3.ReplicaCount())
+	}
+	if err = ForcePersistRingOrBuilder(nil, b2, filename); err != nil {
+		t.Fatal(err)
+	}
+	if _, b3, err = RingOrBuilder(filename); err != nil {
+		t.Fatal(err)
+	}
+	if b3.ReplicaCount() != 3 || b3.Generation() != 4 {
+		t.Fatal(b3.ReplicaCount(), b3.Generation())
+	}
+	if err = PersistRingOrBuilder(nil, b1, filename); err == nil {
+		t.Fatal("expected conflict with the forced persist")
+	}
+}
+
 func helperTestBuilderPersistence(t *testing.T, config []byte) {
 	b := NewBuilder(8)
 	b.SetReplicaCount(3)
 	b.SetConfig(config)
+	b.SetAddressRoles([]string{"replication", "client"})
+	b.SetDispersionPointsAllowed(3)
+	b.SetMovesPerPartition(2)
 	_, err := b.AddNode(true, 1, []string{"server1", "zone1"}, []string{"1.2.3.4:56789"}, "Meta One", nil)
 	if err != nil {
 		t.Fatal(err)
@@ -62,10 +285,11 @@ func helperTestBuilderPersistence(t *testing.T, config []byte) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = b.AddNode(false, 0, []string{"server3", "zone1"}, []string{"1.2.3.6:56789"}, "Meta Three", []byte("Config"))
+	n, err := b.AddNode(false, 0, []string{"server3", "zone1"}, []string{"1.2.3.6:56789"}, "Meta Three", []byte("Config"))
 	if err != nil {
 		t.Fatal(err)
 	}
+	n.Deactivate(InactiveKeepAsLastResort)
 	b.Ring()
 	buf := bytes.NewBuffer(make([]byte, 0, 65536))
 	err = b.Persist(buf)
@@ -95,6 +319,9 @@ func helperTestBuilderPersistence(t *testing.T, config []byte) {
 		if b2.nodes[i].capacity != b.nodes[i].capacity {
 			t.Fatalf("%v != %v", b2.nodes[i].capacity, b.nodes[i].capacity)
 		}
+		if b2.nodes[i].inactivePolicy != b.nodes[i].inactivePolicy {
+			t.Fatalf("%v != %v", b2.nodes[i].inactivePolicy, b.nodes[i].inactivePolicy)
+		}
 		if len(b2.nodes[i].tierIndexes) != len(b.nodes[i].tierIndexes) {
 			t.Fatalf("%v != %v", len(b2.nodes[i].tierIndexes), len(b.nodes[i].tierIndexes))
 		}
@@ -156,6 +383,20 @@ func helperTestBuilderPersistence(t *testing.T, config []byte) {
 	if b2.moveWait != b.moveWait {
 		t.Fatalf("%v != %v", b2.moveWait, b.moveWait)
 	}
+	if b2.dispersionPointsAllowed != b.dispersionPointsAllowed {
+		t.Fatalf("%v != %v", b2.dispersionPointsAllowed, b.dispersionPointsAllowed)
+	}
+	if b2.movesPerPartition != b.movesPerPartition {
+		t.Fatalf("%v != %v", b2.movesPerPartition, b.movesPerPartition)
+	}
+	if len(b2.addressRoles) != len(b.addressRoles) {
+		t.Fatalf("%v != %v", len(b2.addressRoles), len(b.addressRoles))
+	}
+	for i := 0; i < len(b2.addressRoles); i++ {
+		if b2.addressRoles[i] != b.addressRoles[i] {
+			t.Fatalf("%v != %v", b2.addressRoles[i], b.addressRoles[i])
+		}
+	}
 }
 
 func TestBuilderLoadGarbage(t *testing.T) {
@@ -193,8 +434,8 @@ func TestBuilderAddRemoveNodes(t *testing.T) {
 	if len(n) != 1 {
 		t.Fatalf("Ring had %d nodes instead of 1", len(n))
 	}
-	pc := uint32(1) << r.PartitionBitCount()
-	for p := uint32(0); p < pc; p++ {
+	pc := Partition(1) << r.PartitionBitCount()
+	for p := Partition(0); p < pc; p++ {
 		n = r.ResponsibleNodes(p)
 		if len(n) != 3 {
 			t.Fatalf("Supposed to get 3 replicas, got %d", len(n))
@@ -391,7 +632,7 @@ func TestBuilderResizeIfNeeded(t *testing.T) {
 		t.Fatalf("Expected the max partition bit count to be saved as 6; instead it was %d", pbc)
 	}
 	for i := 4; i < 14; i++ {
-		_, err = b.AddNode(true, uint32(i), nil, nil, "", []byte("Config"))
+		_, err = b.AddNode(true, uint64(i), nil, nil, "", []byte("Config"))
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -742,3 +983,173 @@ func TestVersionChangesWithNodeConfigChange(t *testing.T) {
 		t.Fatal("")
 	}
 }
+
+func TestBuilderPretendElapsed(t *testing.T) {
+	b := NewBuilder(64)
+	if _, err := b.AddNode(true, 1, nil, nil, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	b.Ring()
+	lastMoves := b.replicaToPartitionToLastMove[0]
+	lastMoves[0] = 0
+	b.PretendElapsed(10)
+	if lastMoves[0] != 10 {
+		t.Fatal(lastMoves[0])
+	}
+	// Records at or near the max must saturate, not wrap around.
+	lastMoves[0] = math.MaxUint16 - 5
+	b.PretendElapsed(10)
+	if lastMoves[0] != math.MaxUint16 {
+		t.Fatal(lastMoves[0])
+	}
+	b.PretendElapsed(math.MaxUint16)
+	if lastMoves[0] != math.MaxUint16 {
+		t.Fatal(lastMoves[0])
+	}
+	lastMoves[0] = 1
+	b.PretendElapsed(math.MaxUint16 - 1)
+	if lastMoves[0] != math.MaxUint16 {
+		t.Fatal(lastMoves[0])
+	}
+}
+
+func TestBuilderGC(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetReplicaCount(2)
+	nA, err := b.AddNode(true, 1, []string{"server1"}, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.AddNode(true, 1, []string{"server2"}, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nC, err := b.AddNode(true, 1, []string{"server3"}, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Ring()
+	b.PretendElapsed(math.MaxUint16)
+	nA.SetActive(false)
+	b.Ring()
+	s := b.Stats()
+	if s.NodeCount != 3 || s.InactiveNodeCount != 1 || s.DepartedNodeCount != 1 || s.TierValueCount != 3 || s.UnusedTierValueCount != 0 {
+		t.Fatalf("%#v", s)
+	}
+	// The departed node's partitions were just reassigned, so it should be
+	// retained.
+	if n := b.GC(b.MoveWait()); n != 0 {
+		t.Fatalf("%d != 0", n)
+	}
+	b.PretendElapsed(b.MoveWait())
+	if n := b.GC(b.MoveWait()); n != 1 {
+		t.Fatalf("%d != 1", n)
+	}
+	if b.Node(nA.ID()) != nil {
+		t.Fatal("departed node was not removed")
+	}
+	if b.Node(nC.ID()).Tier(0) != "server3" {
+		t.Fatalf("%q != server3", b.Node(nC.ID()).Tier(0))
+	}
+	s = b.Stats()
+	if s.NodeCount != 2 || s.DepartedNodeCount != 0 || s.TierValueCount != 2 {
+		t.Fatalf("%#v", s)
+	}
+	r := b.Ring()
+	for p := Partition(0); p < 1<<r.PartitionBitCount(); p++ {
+		for _, n := range r.ResponsibleNodes(p) {
+			if n.ID() == nA.ID() {
+				t.Fatalf("partition %d still assigned to removed node", p)
+			}
+		}
+	}
+}
+
+func TestBuilderLastRebalanceReport(t *testing.T) {
+	b := NewBuilder(64)
+	if b.LastRebalanceReport() != nil {
+		t.Fatal("expected no report before Ring")
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := b.AddNode(true, 1, nil, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Ring()
+	rr := b.LastRebalanceReport()
+	if rr.UnassignedMoves == 0 || !rr.WithinPointsAllowed {
+		t.Fatalf("%#v", rr)
+	}
+	// New nodes right after the first rebalance cannot take on replicas
+	// until the move wait has passed.
+	for i := 0; i < 2; i++ {
+		if _, err := b.AddNode(true, 1, nil, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Ring()
+	rr = b.LastRebalanceReport()
+	if rr.WaitBlocked == 0 || rr.WithinPointsAllowed {
+		t.Fatalf("%#v", rr)
+	}
+	b.PretendElapsed(math.MaxUint16)
+	b.Ring()
+	rr = b.LastRebalanceReport()
+	if rr.OverweightMoves == 0 || rr.Passes == 0 || !rr.WithinPointsAllowed {
+		t.Fatalf("%#v", rr)
+	}
+}
+
+func TestBuilderDeactivatePolicies(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetReplicaCount(2)
+	b.SetMaxPartitionBitCount(4)
+	for i := 0; i < 4; i++ {
+		if _, err := b.AddNode(true, 1, []string{fmt.Sprintf("server%d", i)}, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Ring()
+	nodes := b.Nodes()
+	assigned := func(nodeIndex int32) (int, int) {
+		count, last := 0, 0
+		for replica, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+			for _, ni := range partitionToNodeIndex {
+				if ni == nodeIndex {
+					count++
+					if replica == len(b.replicaToPartitionToNodeIndex)-1 {
+						last++
+					}
+				}
+			}
+		}
+		return count, last
+	}
+	// Reassigned right away, before any Ring is generated.
+	nodes[0].(BuilderNode).Deactivate(InactiveReassignImmediately)
+	if count, _ := assigned(0); count != 0 {
+		t.Fatal(count)
+	}
+	// Kept, but moved to the last replica positions.
+	before, _ := assigned(1)
+	nodes[1].(BuilderNode).Deactivate(InactiveKeepAsLastResort)
+	if nodes[1].(BuilderNode).InactivePolicy() != InactiveKeepAsLastResort {
+		t.Fatal(nodes[1].(BuilderNode).InactivePolicy())
+	}
+	b.Ring()
+	if count, last := assigned(1); count != before || last != count {
+		t.Fatalf("%d %d %d", before, count, last)
+	}
+	// The default policy reassigns on the next rebalance.
+	nodes[1].(BuilderNode).SetActive(false)
+	if nodes[1].(BuilderNode).InactivePolicy() != InactiveReassignOnRebalance {
+		t.Fatal(nodes[1].(BuilderNode).InactivePolicy())
+	}
+	if count, _ := assigned(1); count != before {
+		t.Fatalf("%d != %d", count, before)
+	}
+	b.Ring()
+	if count, _ := assigned(1); count != 0 {
+		t.Fatal(count)
+	}
+}
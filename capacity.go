@@ -0,0 +1,55 @@
+package ring
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// sumCapacity returns the sum of the capacities of the nodes, active or
+// not, or an error should the sum overflow; Builders keep this sum within 64
+// bits so the accounting below can be done with exact integer math.
+func sumCapacity(nodes []*node) (uint64, error) {
+	var total uint64
+	for _, n := range nodes {
+		var carry uint64
+		total, carry = bits.Add64(total, n.capacity, 0)
+		if carry != 0 {
+			return 0, fmt.Errorf("total capacity of the nodes overflows 64 bits")
+		}
+	}
+	return total, nil
+}
+
+// desiredAssignments returns the share of assignmentCount a node of the
+// capacity given should have of the total capacity, as the exact quotient and
+// remainder of capacity*assignmentCount/totalCapacity; capacity must not
+// exceed totalCapacity.
+func desiredAssignments(capacity uint64, totalCapacity uint64, assignmentCount uint64) (uint64, uint64) {
+	if totalCapacity == 0 {
+		return 0, 0
+	}
+	hi, lo := bits.Mul64(capacity, assignmentCount)
+	return bits.Div64(hi, lo, totalCapacity)
+}
+
+// roundedDesiredAssignments is desiredAssignments rounded to the nearest
+// whole assignment; 0 if there is no totalCapacity, such as when every node
+// is draining.
+func roundedDesiredAssignments(capacity uint64, totalCapacity uint64, assignmentCount uint64) uint64 {
+	if totalCapacity == 0 {
+		return 0
+	}
+	quo, rem := desiredAssignments(capacity, totalCapacity, assignmentCount)
+	if rem >= totalCapacity-rem {
+		quo++
+	}
+	return quo
+}
+
+// scaleCapacity returns capacity*numerator/denominator, rounded down, without
+// overflowing; numerator must not exceed denominator.
+func scaleCapacity(capacity uint64, numerator uint64, denominator uint64) uint64 {
+	hi, lo := bits.Mul64(capacity, numerator)
+	quo, _ := bits.Div64(hi, lo, denominator)
+	return quo
+}
@@ -0,0 +1,181 @@
+package ring
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"sort"
+)
+
+// CapacityReserve is the percentage of each node's capacity held back from
+// balancing unless the node has its own reserve; see SetCapacityReserve.
+func (b *Builder) CapacityReserve() byte {
+	return b.capacityReserve
+}
+
+// SetCapacityReserve sets the percentage of each node's capacity to hold back
+// as headroom, for handoff data and the temporary imbalance while failed
+// nodes are replaced, so the rebalancer balances the nodes by the rest, their
+// usable capacity; for example, a reserve of 10 targets 90% of the stated
+// capacities. Nodes may have their own reserves instead; see
+// SetNodeCapacityReserve. As the same reserve for every node leaves their
+// proportions alone, it is the differing reserves that move replicas. The
+// percentage must be below 100; the default is 0.
+func (b *Builder) SetCapacityReserve(percentage byte) error {
+	if percentage >= 100 {
+		return fmt.Errorf("capacity reserve %d%% must be less than 100%%", percentage)
+	}
+	if percentage != b.capacityReserve {
+		b.capacityReserve = percentage
+		b.dirty = true
+	}
+	return nil
+}
+
+// NodeCapacityReserve returns the node's own capacity reserve percentage and
+// true, or false if the node uses the Builder's CapacityReserve.
+func (b *Builder) NodeCapacityReserve(nodeID uint64) (byte, bool) {
+	percentage, ok := b.nodeCapacityReserves[nodeID]
+	return percentage, ok
+}
+
+// SetNodeCapacityReserve sets the percentage of the node's capacity to hold
+// back as headroom, in place of the Builder's CapacityReserve, such as for
+// nodes that also take handoffs for others; -1 returns the node to the
+// Builder's reserve. The percentage must be below 100.
+func (b *Builder) SetNodeCapacityReserve(nodeID uint64, percentage int) error {
+	if b.Node(nodeID) == nil {
+		return fmt.Errorf("no node with id %d", nodeID)
+	}
+	if percentage < -1 || percentage >= 100 {
+		return fmt.Errorf("capacity reserve %d%% must be from 0 to 99, or -1 to clear", percentage)
+	}
+	if percentage == -1 {
+		if _, ok := b.nodeCapacityReserves[nodeID]; ok {
+			delete(b.nodeCapacityReserves, nodeID)
+			b.dirty = true
+		}
+		return nil
+	}
+	if b.nodeCapacityReserves == nil {
+		b.nodeCapacityReserves = make(map[uint64]byte)
+	}
+	if previous, ok := b.nodeCapacityReserves[nodeID]; !ok || previous != byte(percentage) {
+		b.nodeCapacityReserves[nodeID] = byte(percentage)
+		b.dirty = true
+	}
+	return nil
+}
+
+// usableCapacity returns the node's capacity less its reserve, which is what
+// it is balanced by; draining nodes have none. Nodes not of a Builder, such
+// as those of rings loaded from files, have no reserve.
+func (n *node) usableCapacity() uint64 {
+	if n.builder != nil && n.builder.NodeDraining(n.id) {
+		return 0
+	}
+	return n.unreservedCapacity()
+}
+
+// unreservedCapacity returns the node's capacity less its reserve.
+func (n *node) unreservedCapacity() uint64 {
+	if n.builder == nil {
+		return n.capacity
+	}
+	reserve, ok := n.builder.nodeCapacityReserves[n.id]
+	if !ok {
+		reserve = n.builder.capacityReserve
+	}
+	if reserve == 0 {
+		return n.capacity
+	}
+	hi, lo := bits.Mul64(n.capacity, uint64(100-reserve))
+	quo, _ := bits.Div64(hi, lo, 100)
+	return quo
+}
+
+// usableCapacity returns the capacity the ring's node at the index was
+// balanced by; rings record these when made, so their stats do not depend on
+// the Builder's later changes.
+func (r *ring) usableCapacity(nodeIndex int) uint64 {
+	if r.usableCapacities == nil {
+		return r.nodes[nodeIndex].capacity
+	}
+	return r.usableCapacities[nodeIndex]
+}
+
+func (r *ring) writeUsableCapacities(w io.Writer) error {
+	for nodeIndex := range r.nodes {
+		if err := binary.Write(w, binary.BigEndian, r.usableCapacity(nodeIndex)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readUsableCapacities(r io.Reader, nodeCount int) ([]uint64, error) {
+	usableCapacities := make([]uint64, nodeCount)
+	if err := binary.Read(r, binary.BigEndian, usableCapacities); err != nil {
+		return nil, err
+	}
+	return usableCapacities, nil
+}
+
+func (b *Builder) writeCapacityReserves(w io.Writer) error {
+	if err := binary.Write(w, binary.BigEndian, b.capacityReserve); err != nil {
+		return err
+	}
+	nodeIDs := make([]uint64, 0, len(b.nodeCapacityReserves))
+	for nodeID := range b.nodeCapacityReserves {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Slice(nodeIDs, func(i, j int) bool { return nodeIDs[i] < nodeIDs[j] })
+	if err := binary.Write(w, binary.BigEndian, int32(len(nodeIDs))); err != nil {
+		return err
+	}
+	for _, nodeID := range nodeIDs {
+		if err := binary.Write(w, binary.BigEndian, nodeID); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.BigEndian, b.nodeCapacityReserves[nodeID]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Builder) readCapacityReserves(r io.Reader) error {
+	if err := binary.Read(r, binary.BigEndian, &b.capacityReserve); err != nil {
+		return err
+	}
+	if b.capacityReserve >= 100 {
+		return fmt.Errorf("invalid capacity reserve %d", b.capacityReserve)
+	}
+	var count int32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return err
+	}
+	if count < 0 {
+		return fmt.Errorf("invalid node capacity reserve count %d", count)
+	}
+	b.nodeCapacityReserves = nil
+	if count > 0 {
+		b.nodeCapacityReserves = make(map[uint64]byte, count)
+	}
+	for i := int32(0); i < count; i++ {
+		var nodeID uint64
+		var percentage byte
+		if err := binary.Read(r, binary.BigEndian, &nodeID); err != nil {
+			return err
+		}
+		if err := binary.Read(r, binary.BigEndian, &percentage); err != nil {
+			return err
+		}
+		if percentage >= 100 {
+			return fmt.Errorf("invalid capacity reserve %d for node %d", percentage, nodeID)
+		}
+		b.nodeCapacityReserves[nodeID] = percentage
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package ring
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBuilderCapacityReserve(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetMaxPartitionBitCount(8)
+	b.SetMoveWait(0)
+	var ids []uint64
+	for i := 0; i < 2; i++ {
+		n, err := b.AddNode(true, 100, nil, nil, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, n.ID())
+	}
+	if err := b.SetCapacityReserve(100); err == nil {
+		t.Fatal("expected error")
+	}
+	// The same reserve for all nodes keeps their proportions.
+	if err := b.SetCapacityReserve(10); err != nil {
+		t.Fatal(err)
+	}
+	r := b.Ring()
+	s := r.Stats()
+	if s.NodeStats[0].AssignedCount != s.NodeStats[1].AssignedCount {
+		t.Fatalf("%#v %#v", s.NodeStats[0], s.NodeStats[1])
+	}
+	if bs := b.Stats(); bs.ReservedCapacity != 20 {
+		t.Fatal(bs.ReservedCapacity)
+	}
+	// A node with a larger reserve of its own is balanced by less: 50 usable
+	// against 90.
+	if err := b.SetNodeCapacityReserve(ids[1], 50); err != nil {
+		t.Fatal(err)
+	}
+	r = b.Ring()
+	s = r.Stats()
+	if got, want := float64(s.NodeStats[1].AssignedCount)/float64(s.NodeStats[0].AssignedCount), 50.0/90.0; got < want-0.05 || got > want+0.05 {
+		t.Fatal(got, want)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := b.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := LoadBuilder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if percentage, ok := b2.NodeCapacityReserve(ids[1]); !ok || percentage != 50 || b2.CapacityReserve() != 10 {
+		t.Fatal(percentage, ok, b2.CapacityReserve())
+	}
+	if _, ok := b2.NodeCapacityReserve(ids[0]); ok {
+		t.Fatal("node 0 has its own reserve")
+	}
+	if err = b2.SetNodeCapacityReserve(ids[1], -1); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b2.NodeCapacityReserve(ids[1]); ok {
+		t.Fatal("reserve not cleared")
+	}
+	b2.RemoveNode(ids[1])
+	if err = b2.SetNodeCapacityReserve(ids[1], 5); err == nil {
+		t.Fatal("expected error for a removed node")
+	}
+}
+
+func TestRingUsableCapacities(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetMaxPartitionBitCount(8)
+	b.SetMoveWait(0)
+	var ids []uint64
+	for i := 0; i < 2; i++ {
+		n, err := b.AddNode(true, 100, nil, nil, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, n.ID())
+	}
+	if err := b.SetNodeCapacityReserve(ids[1], 50); err != nil {
+		t.Fatal(err)
+	}
+	r := b.Ring()
+	before := r.Stats()
+	if before.NodeStats[1].DesiredCount >= before.NodeStats[0].DesiredCount {
+		t.Fatalf("%#v %#v", before.NodeStats[0], before.NodeStats[1])
+	}
+	// The ring keeps the usable capacities it was made with.
+	if err := b.SetNodeCapacityReserve(ids[1], -1); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetNodeDraining(ids[0], true); err != nil {
+		t.Fatal(err)
+	}
+	if s := r.Stats(); s.NodeStats[0].DesiredCount != before.NodeStats[0].DesiredCount || s.NodeStats[1].DesiredCount != before.NodeStats[1].DesiredCount {
+		t.Fatalf("%#v %#v", s.NodeStats[0], s.NodeStats[1])
+	}
+	// And so does its persisted form.
+	buf := bytes.NewBuffer(nil)
+	if err := r.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	r2, err := LoadRing(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := r2.Stats(); s.NodeStats[0].DesiredCount != before.NodeStats[0].DesiredCount || s.NodeStats[1].DesiredCount != before.NodeStats[1].DesiredCount {
+		t.Fatalf("%#v %#v", s.NodeStats[0], s.NodeStats[1])
+	}
+}
@@ -0,0 +1,155 @@
+package ring
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// CapacitySchedule ramps a node's capacity from one value to another over a
+// period, such as filling a new node gradually or draining an old one; see
+// Builder.ScheduleCapacity.
+type CapacitySchedule struct {
+	NodeID uint64
+	// From is the capacity at Start and To the capacity once Duration has
+	// passed; in between, the capacity changes linearly.
+	From     uint64
+	To       uint64
+	Start    time.Time
+	Duration time.Duration
+}
+
+// capacityAt returns the scheduled capacity at the time given.
+func (s *CapacitySchedule) capacityAt(now time.Time) uint64 {
+	elapsed := now.Sub(s.Start)
+	if elapsed <= 0 {
+		return s.From
+	}
+	if elapsed >= s.Duration {
+		return s.To
+	}
+	if s.To >= s.From {
+		return s.From + scaleCapacity(s.To-s.From, uint64(elapsed), uint64(s.Duration))
+	}
+	return s.From - scaleCapacity(s.From-s.To, uint64(elapsed), uint64(s.Duration))
+}
+
+// ScheduleCapacity stores the schedule in the Builder, replacing any other
+// schedule for the same node. The schedule is not applied until
+// ApplyCapacitySchedules is called, which a RebalanceScheduler does before
+// each pass, so a ramp proceeds one pass at a time without anyone having to
+// change the capacity by hand each step.
+func (b *Builder) ScheduleCapacity(s CapacitySchedule) error {
+	if b.Node(s.NodeID) == nil {
+		return fmt.Errorf("no node %d", s.NodeID)
+	}
+	if s.Duration < 0 {
+		return fmt.Errorf("invalid duration %s", s.Duration)
+	}
+	b.CancelCapacitySchedule(s.NodeID)
+	b.capacitySchedules = append(b.capacitySchedules, &s)
+	sort.Slice(b.capacitySchedules, func(i, j int) bool { return b.capacitySchedules[i].NodeID < b.capacitySchedules[j].NodeID })
+	return nil
+}
+
+// CancelCapacitySchedule removes the node's schedule, if any, leaving the node
+// at whatever capacity it has reached.
+func (b *Builder) CancelCapacitySchedule(nodeID uint64) {
+	for i, s := range b.capacitySchedules {
+		if s.NodeID == nodeID {
+			b.capacitySchedules = append(b.capacitySchedules[:i], b.capacitySchedules[i+1:]...)
+			return
+		}
+	}
+}
+
+// CapacitySchedules returns copies of the schedules not yet completed, in
+// node ID order.
+func (b *Builder) CapacitySchedules() []CapacitySchedule {
+	schedules := make([]CapacitySchedule, len(b.capacitySchedules))
+	for i, s := range b.capacitySchedules {
+		schedules[i] = *s
+	}
+	return schedules
+}
+
+// ApplyCapacitySchedules sets the capacity of each node with a schedule to
+// its scheduled capacity at the time given, returning how many nodes
+// changed. Schedules that have completed, or whose nodes have been removed,
+// are dropped once applied. Should setting a capacity fail, as with an
+// overflow of the total capacity, the schedule is kept and the error
+// returned after the other schedules are applied.
+func (b *Builder) ApplyCapacitySchedules(now time.Time) (int, error) {
+	changed := 0
+	var firstErr error
+	kept := b.capacitySchedules[:0]
+	for _, s := range b.capacitySchedules {
+		n := b.Node(s.NodeID)
+		if n == nil {
+			continue
+		}
+		capacity := s.capacityAt(now)
+		if capacity != n.Capacity() {
+			if err := n.SetCapacity(capacity); err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("capacity schedule of node %d: %s", s.NodeID, err)
+				}
+				kept = append(kept, s)
+				continue
+			}
+			changed++
+		}
+		if now.Sub(s.Start) < s.Duration {
+			kept = append(kept, s)
+		}
+	}
+	for i := len(kept); i < len(b.capacitySchedules); i++ {
+		b.capacitySchedules[i] = nil
+	}
+	b.capacitySchedules = kept
+	return changed, firstErr
+}
+
+func (b *Builder) writeCapacitySchedules(w io.Writer) error {
+	if len(b.capacitySchedules) > math.MaxInt32 {
+		return fmt.Errorf("%d capacity schedules is too large; max is %d", len(b.capacitySchedules), math.MaxInt32)
+	}
+	if err := binary.Write(w, binary.BigEndian, int32(len(b.capacitySchedules))); err != nil {
+		return err
+	}
+	for _, s := range b.capacitySchedules {
+		for _, v := range []interface{}{s.NodeID, s.From, s.To, s.Start.UnixNano(), int64(s.Duration)} {
+			if err := binary.Write(w, binary.BigEndian, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *Builder) readCapacitySchedules(r io.Reader) error {
+	var count int32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return err
+	}
+	if count < 0 {
+		return fmt.Errorf("invalid capacity schedule count %d", count)
+	}
+	b.capacitySchedules = nil
+	for i := int32(0); i < count; i++ {
+		s := &CapacitySchedule{}
+		var start, duration int64
+		for _, v := range []interface{}{&s.NodeID, &s.From, &s.To, &start, &duration} {
+			if err := binary.Read(r, binary.BigEndian, v); err != nil {
+				return err
+			}
+		}
+		s.Start = time.Unix(0, start)
+		s.Duration = time.Duration(duration)
+		b.capacitySchedules = append(b.capacitySchedules, s)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package ring
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestCapacitySchedule(t *testing.T) {
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := NewBuilder(64)
+	n, err := b.AddNode(true, 100, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.ScheduleCapacity(CapacitySchedule{NodeID: n.ID() + 1, To: 1}); err == nil {
+		t.Fatal("schedule for an unknown node accepted")
+	}
+	if err = b.ScheduleCapacity(CapacitySchedule{NodeID: n.ID(), From: 25, To: 100, Start: start, Duration: 4 * 24 * time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		at       time.Duration
+		capacity uint64
+		changed  int
+	}{
+		{-time.Hour, 25, 1},
+		{0, 25, 0},
+		{24 * time.Hour, 43, 1},
+		{48 * time.Hour, 62, 1},
+		{48 * time.Hour, 62, 0},
+	} {
+		changed, err := b.ApplyCapacitySchedules(start.Add(tc.at))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != tc.changed || n.Capacity() != tc.capacity {
+			t.Fatal(tc.at, changed, n.Capacity())
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err = b.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := LoadBuilder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := b2.CapacitySchedules(); len(s) != 1 || s[0].NodeID != n.ID() || s[0].From != 25 || s[0].To != 100 || !s[0].Start.Equal(start) || s[0].Duration != 4*24*time.Hour {
+		t.Fatal(s)
+	}
+	// Completing the ramp drops the schedule.
+	if _, err = b.ApplyCapacitySchedules(start.Add(5 * 24 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if n.Capacity() != 100 || len(b.CapacitySchedules()) != 0 {
+		t.Fatal(n.Capacity(), b.CapacitySchedules())
+	}
+	// A draining ramp.
+	if err = b.ScheduleCapacity(CapacitySchedule{NodeID: n.ID(), From: 100, To: 0, Start: start, Duration: 4 * time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.ApplyCapacitySchedules(start.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if n.Capacity() != 75 {
+		t.Fatal(n.Capacity())
+	}
+	b.CancelCapacitySchedule(n.ID())
+	if _, err = b.ApplyCapacitySchedules(start.Add(2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if n.Capacity() != 75 {
+		t.Fatal(n.Capacity())
+	}
+}
+
+func TestRebalanceSchedulerAppliesCapacitySchedules(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := NewBuilder(64)
+	b.now = func() time.Time { return now }
+	if _, err := b.AddNode(true, 100, nil, nil, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	n, err := b.AddNode(true, 10, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.ScheduleCapacity(CapacitySchedule{NodeID: n.ID(), From: 10, To: 100, Start: now, Duration: 2 * time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	s := NewRebalanceScheduler(b, nil)
+	now = now.Add(time.Hour)
+	if err = s.Pass(); err != nil {
+		t.Fatal(err)
+	}
+	if n.Capacity() != 55 {
+		t.Fatal(n.Capacity())
+	}
+	now = now.Add(time.Hour)
+	if err = s.Pass(); err != nil {
+		t.Fatal(err)
+	}
+	if n.Capacity() != 100 || len(b.CapacitySchedules()) != 0 {
+		t.Fatal(n.Capacity(), b.CapacitySchedules())
+	}
+}
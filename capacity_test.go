@@ -0,0 +1,69 @@
+package ring
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDesiredAssignments(t *testing.T) {
+	// Float math would see these capacities as equal; 1<<60 and 1<<60+1 are
+	// the same float64.
+	total := uint64(1<<60) + uint64(1<<60+1)
+	quo, rem := desiredAssignments(1<<60+1, total, 1<<60)
+	if quo != 1<<59 || rem != 1<<59 {
+		t.Fatalf("%d %d", quo, rem)
+	}
+	if v := roundedDesiredAssignments(1<<60+1, total, 1<<60); v != 1<<59 {
+		t.Fatal(v)
+	}
+	if v := roundedDesiredAssignments(math.MaxUint64, math.MaxUint64, 3); v != 3 {
+		t.Fatal(v)
+	}
+	if v := roundedDesiredAssignments(1, 3, 1); v != 0 {
+		t.Fatal(v)
+	}
+	if v := roundedDesiredAssignments(2, 3, 1); v != 1 {
+		t.Fatal(v)
+	}
+	if quo, rem = desiredAssignments(1, 0, 1); quo != 0 || rem != 0 {
+		t.Fatalf("%d %d", quo, rem)
+	}
+	if v := roundedDesiredAssignments(0, 0, 5); v != 0 {
+		t.Fatal(v)
+	}
+	if v := scaleCapacity(math.MaxUint64, 3, 4); v != math.MaxUint64/4*3+2 {
+		t.Fatal(v)
+	}
+}
+
+func TestBuilderCapacityOverflow(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetMaxPartitionBitCount(4)
+	n, err := b.AddNode(true, math.MaxUint64-1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n2, err := b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.AddNode(true, 1, nil, nil, "", nil); err == nil {
+		t.Fatal("expected overflow error")
+	}
+	if err = n2.SetCapacity(2); err == nil {
+		t.Fatal("expected overflow error")
+	}
+	if n2.Capacity() != 1 {
+		t.Fatal(n2.Capacity())
+	}
+	if err = n.SetCapacity(math.MaxUint64 - 1); err != nil {
+		t.Fatal(err)
+	}
+	s := b.Ring().Stats()
+	if s.ActiveCapacity != math.MaxUint64 {
+		t.Fatal(s.ActiveCapacity)
+	}
+	if s.NodeStats[0].AssignedCount != s.PartitionCount*s.ReplicaCount {
+		t.Fatalf("%d != %d", s.NodeStats[0].AssignedCount, s.PartitionCount*s.ReplicaCount)
+	}
+}
@@ -0,0 +1,290 @@
+package ring
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CHECKSUM_EXCHANGE_MSG_TYPE is the default message type used by the
+// ChecksumExchanger.
+const CHECKSUM_EXCHANGE_MSG_TYPE = 0x2a9e5c81d3f7b046
+
+// checksumMsgLength is the wire length of a checksum message: ring version,
+// sender node ID, partition, and checksum.
+const checksumMsgLength = 8 + 8 + 4 + 8
+
+// ChecksumExchangerConfig represents the set of values for configuring a
+// ChecksumExchanger.
+type ChecksumExchangerConfig struct {
+	// LogDebug sets the func to use for debug messages. Defaults not logging
+	// debug messages.
+	LogDebug LogFunc
+	// MsgType is the message type to use for checksum messages. Defaults to
+	// CHECKSUM_EXCHANGE_MSG_TYPE.
+	MsgType uint64
+	// Interval indicates how many seconds to wait between passes. Defaults to
+	// 60 seconds.
+	Interval int
+	// MsgTimeout indicates how many milliseconds to wait when queueing
+	// checksum messages for delivery. Defaults to 1000 milliseconds.
+	MsgTimeout int
+	// Checksum returns the content checksum of the partition as stored
+	// locally; how the checksum is computed is entirely up to the
+	// application, but all nodes must compute it the same way. This must be
+	// set.
+	Checksum func(partition Partition) uint64
+	// OutOfSync will be called when a replica peer reports a checksum
+	// different from the local checksum for a partition. It will be called
+	// from the MsgRing's receiving goroutine, so any significant work should
+	// be done elsewhere.
+	OutOfSync func(e *PartitionOutOfSync)
+}
+
+func resolveChecksumExchangerConfig(c *ChecksumExchangerConfig) *ChecksumExchangerConfig {
+	cfg := &ChecksumExchangerConfig{}
+	if c != nil {
+		*cfg = *c
+	}
+	if cfg.MsgType == 0 {
+		cfg.MsgType = CHECKSUM_EXCHANGE_MSG_TYPE
+	}
+	if cfg.Interval < 1 {
+		cfg.Interval = 60
+	}
+	if cfg.MsgTimeout < 1 {
+		cfg.MsgTimeout = 1000
+	}
+	return cfg
+}
+
+// PartitionOutOfSync describes a partition whose local checksum did not match
+// the checksum reported by another replica.
+type PartitionOutOfSync struct {
+	RingVersion    int64
+	Partition      Partition
+	NodeID         uint64
+	LocalChecksum  uint64
+	RemoteChecksum uint64
+}
+
+// ChecksumExchanger is a standard anti-entropy helper; on a schedule, it sends
+// the checksum of each partition the local node is responsible for to the
+// other replicas of that partition, and it compares checksums received from
+// those replicas with the local ones, reporting any mismatches.
+//
+// Like all MsgRing messaging, checksum messages may be dropped; a missed
+// exchange will simply be retried on the next pass.
+type ChecksumExchanger struct {
+	msgRing     MsgRing
+	logDebug    LogFunc
+	msgType     uint64
+	interval    time.Duration
+	msgTimeout  time.Duration
+	checksum    func(partition Partition) uint64
+	outOfSync   func(e *PartitionOutOfSync)
+	controlLock sync.Mutex
+	controlChan chan struct{}
+
+	passes            int32
+	sends             int32
+	receives          int32
+	ringVersionSkips  int32
+	notResponsibles   int32
+	outOfSyncs        int32
+	receiveReadErrors int32
+}
+
+// NewChecksumExchanger creates a ChecksumExchanger that will use the MsgRing
+// for its messaging; call Start to begin exchanging checksums.
+func NewChecksumExchanger(msgRing MsgRing, c *ChecksumExchangerConfig) *ChecksumExchanger {
+	cfg := resolveChecksumExchangerConfig(c)
+	x := &ChecksumExchanger{
+		msgRing:    msgRing,
+		logDebug:   cfg.LogDebug,
+		msgType:    cfg.MsgType,
+		interval:   time.Duration(cfg.Interval) * time.Second,
+		msgTimeout: time.Duration(cfg.MsgTimeout) * time.Millisecond,
+		checksum:   cfg.Checksum,
+		outOfSync:  cfg.OutOfSync,
+	}
+	if x.logDebug == nil {
+		x.logDebug = nilLogFunc
+	}
+	msgRing.SetMsgHandler(x.msgType, x.handle)
+	return x
+}
+
+// Start launches the background passes; it does nothing if already started.
+func (x *ChecksumExchanger) Start() {
+	x.controlLock.Lock()
+	if x.controlChan == nil {
+		x.controlChan = make(chan struct{})
+		go x.run(x.controlChan)
+	}
+	x.controlLock.Unlock()
+}
+
+// Stop ends the background passes; it does nothing if not started. Incoming
+// checksum messages will still be compared.
+func (x *ChecksumExchanger) Stop() {
+	x.controlLock.Lock()
+	if x.controlChan != nil {
+		close(x.controlChan)
+		x.controlChan = nil
+	}
+	x.controlLock.Unlock()
+}
+
+func (x *ChecksumExchanger) run(controlChan chan struct{}) {
+	for {
+		x.Pass()
+		select {
+		case <-controlChan:
+			return
+		case <-time.After(x.interval):
+		}
+	}
+}
+
+// Pass sends the checksums for all partitions the local node is responsible
+// for once; it is called automatically on a schedule after Start, but may be
+// called directly to force an immediate exchange.
+func (x *ChecksumExchanger) Pass() {
+	atomic.AddInt32(&x.passes, 1)
+	r := x.msgRing.Ring()
+	if r == nil {
+		x.logDebug("checksum exchange: no ring\n")
+		return
+	}
+	localNode := r.LocalNode()
+	if localNode == nil {
+		x.logDebug("checksum exchange: no local node\n")
+		return
+	}
+	partitionCount := Partition(1) << r.PartitionBitCount()
+	for partition := Partition(0); partition < partitionCount; partition++ {
+		if !r.Responsible(partition) {
+			continue
+		}
+		atomic.AddInt32(&x.sends, 1)
+		x.msgRing.MsgToOtherReplicas(&checksumMsg{
+			msgType:     x.msgType,
+			ringVersion: r.Version(),
+			nodeID:      localNode.ID(),
+			partition:   partition,
+			checksum:    x.checksum(partition),
+		}, partition, x.msgTimeout)
+	}
+}
+
+func (x *ChecksumExchanger) handle(reader io.Reader, desiredBytesToRead uint64) (uint64, error) {
+	atomic.AddInt32(&x.receives, 1)
+	if desiredBytesToRead != checksumMsgLength {
+		atomic.AddInt32(&x.receiveReadErrors, 1)
+		n, err := io.CopyN(ioutil.Discard, reader, int64(desiredBytesToRead))
+		return uint64(n), err
+	}
+	var buf [checksumMsgLength]byte
+	n, err := io.ReadFull(reader, buf[:])
+	if err != nil {
+		atomic.AddInt32(&x.receiveReadErrors, 1)
+		return uint64(n), err
+	}
+	m := &checksumMsg{}
+	m.unmarshal(buf[:])
+	r := x.msgRing.Ring()
+	if r == nil || r.Version() != m.ringVersion {
+		atomic.AddInt32(&x.ringVersionSkips, 1)
+		return uint64(n), nil
+	}
+	if m.partition >= Partition(1)<<r.PartitionBitCount() || !r.Responsible(m.partition) {
+		atomic.AddInt32(&x.notResponsibles, 1)
+		return uint64(n), nil
+	}
+	local := x.checksum(m.partition)
+	if local != m.checksum {
+		atomic.AddInt32(&x.outOfSyncs, 1)
+		if x.outOfSync != nil {
+			x.outOfSync(&PartitionOutOfSync{
+				RingVersion:    m.ringVersion,
+				Partition:      m.partition,
+				NodeID:         m.nodeID,
+				LocalChecksum:  local,
+				RemoteChecksum: m.checksum,
+			})
+		}
+	}
+	return uint64(n), nil
+}
+
+// ChecksumExchangerStats gives an overview of the ChecksumExchanger activity.
+type ChecksumExchangerStats struct {
+	Passes            int32
+	Sends             int32
+	Receives          int32
+	RingVersionSkips  int32
+	NotResponsibles   int32
+	OutOfSyncs        int32
+	ReceiveReadErrors int32
+}
+
+// Stats returns the current stat counters and resets those counters.
+func (x *ChecksumExchanger) Stats() *ChecksumExchangerStats {
+	s := &ChecksumExchangerStats{
+		Passes:            atomic.LoadInt32(&x.passes),
+		Sends:             atomic.LoadInt32(&x.sends),
+		Receives:          atomic.LoadInt32(&x.receives),
+		RingVersionSkips:  atomic.LoadInt32(&x.ringVersionSkips),
+		NotResponsibles:   atomic.LoadInt32(&x.notResponsibles),
+		OutOfSyncs:        atomic.LoadInt32(&x.outOfSyncs),
+		ReceiveReadErrors: atomic.LoadInt32(&x.receiveReadErrors),
+	}
+	atomic.AddInt32(&x.passes, -s.Passes)
+	atomic.AddInt32(&x.sends, -s.Sends)
+	atomic.AddInt32(&x.receives, -s.Receives)
+	atomic.AddInt32(&x.ringVersionSkips, -s.RingVersionSkips)
+	atomic.AddInt32(&x.notResponsibles, -s.NotResponsibles)
+	atomic.AddInt32(&x.outOfSyncs, -s.OutOfSyncs)
+	atomic.AddInt32(&x.receiveReadErrors, -s.ReceiveReadErrors)
+	return s
+}
+
+type checksumMsg struct {
+	msgType     uint64
+	ringVersion int64
+	nodeID      uint64
+	partition   Partition
+	checksum    uint64
+}
+
+func (m *checksumMsg) MsgType() uint64 {
+	return m.msgType
+}
+
+func (m *checksumMsg) MsgLength() uint64 {
+	return checksumMsgLength
+}
+
+func (m *checksumMsg) WriteContent(w io.Writer) (uint64, error) {
+	var buf [checksumMsgLength]byte
+	binary.BigEndian.PutUint64(buf[0:], uint64(m.ringVersion))
+	binary.BigEndian.PutUint64(buf[8:], m.nodeID)
+	binary.BigEndian.PutUint32(buf[16:], uint32(m.partition))
+	binary.BigEndian.PutUint64(buf[20:], m.checksum)
+	n, err := w.Write(buf[:])
+	return uint64(n), err
+}
+
+func (m *checksumMsg) Free() {
+}
+
+func (m *checksumMsg) unmarshal(buf []byte) {
+	m.ringVersion = int64(binary.BigEndian.Uint64(buf[0:]))
+	m.nodeID = binary.BigEndian.Uint64(buf[8:])
+	m.partition = Partition(binary.BigEndian.Uint32(buf[16:]))
+	m.checksum = binary.BigEndian.Uint64(buf[20:])
+}
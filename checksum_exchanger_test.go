@@ -0,0 +1,148 @@
+package ring
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testMsgRingSent struct {
+	nodeID    uint64
+	partition Partition
+	msgType   uint64
+	content   []byte
+}
+
+// testMsgRing is a MsgRing that just records the messages sent to it.
+type testMsgRing struct {
+	ring         Ring
+	handlersLock sync.RWMutex
+	handlers     map[uint64]MsgUnmarshaller
+	sentLock     sync.Mutex
+	sent         []*testMsgRingSent
+}
+
+func newTestMsgRing(r Ring) *testMsgRing {
+	return &testMsgRing{ring: r, handlers: make(map[uint64]MsgUnmarshaller)}
+}
+
+func (m *testMsgRing) Ring() Ring {
+	return m.ring
+}
+
+func (m *testMsgRing) MaxMsgLength() uint64 {
+	return 1 << 20
+}
+
+func (m *testMsgRing) SetMsgHandler(msgType uint64, handler MsgUnmarshaller) {
+	m.handlersLock.Lock()
+	m.handlers[msgType] = handler
+	m.handlersLock.Unlock()
+}
+
+func (m *testMsgRing) record(msg Msg, nodeID uint64, partition Partition) {
+	buf := &bytes.Buffer{}
+	msg.WriteContent(buf)
+	m.sentLock.Lock()
+	m.sent = append(m.sent, &testMsgRingSent{nodeID: nodeID, partition: partition, msgType: msg.MsgType(), content: buf.Bytes()})
+	m.sentLock.Unlock()
+}
+
+func (m *testMsgRing) MsgToNode(msg Msg, nodeID uint64, timeout time.Duration) {
+	m.record(msg, nodeID, 0)
+	msg.Free()
+}
+
+func (m *testMsgRing) MsgToOtherReplicas(msg Msg, partition Partition, timeout time.Duration) {
+	m.record(msg, 0, partition)
+	msg.Free()
+}
+
+// deliver hands the recorded messages of one testMsgRing to the handlers of
+// another.
+func (m *testMsgRing) deliver(to *testMsgRing) error {
+	m.sentLock.Lock()
+	sent := m.sent
+	m.sent = nil
+	m.sentLock.Unlock()
+	for _, s := range sent {
+		to.handlersLock.RLock()
+		handler := to.handlers[s.msgType]
+		to.handlersLock.RUnlock()
+		if handler == nil {
+			continue
+		}
+		if _, err := handler(bytes.NewBuffer(s.content), uint64(len(s.content))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestChecksumExchanger(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetReplicaCount(2)
+	nA, err := b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nB, err := b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rA := b.Ring()
+	rA.SetLocalNode(nA.ID())
+	rB := b.Ring()
+	rB.SetLocalNode(nB.ID())
+	if rA.Version() != rB.Version() {
+		t.Fatal(rA.Version(), rB.Version())
+	}
+	mrA := newTestMsgRing(rA)
+	mrB := newTestMsgRing(rB)
+	xA := NewChecksumExchanger(mrA, &ChecksumExchangerConfig{
+		Checksum: func(partition Partition) uint64 { return uint64(partition) },
+	})
+	var outOfSyncs []*PartitionOutOfSync
+	xB := NewChecksumExchanger(mrB, &ChecksumExchangerConfig{
+		Checksum: func(partition Partition) uint64 {
+			if partition == 1 {
+				return 100
+			}
+			return uint64(partition)
+		},
+		OutOfSync: func(e *PartitionOutOfSync) { outOfSyncs = append(outOfSyncs, e) },
+	})
+	xA.Pass()
+	partitionCount := 1 << rA.PartitionBitCount()
+	if len(mrA.sent) != partitionCount {
+		t.Fatalf("%d != %d", len(mrA.sent), partitionCount)
+	}
+	if err = mrA.deliver(mrB); err != nil {
+		t.Fatal(err)
+	}
+	if len(outOfSyncs) != 1 {
+		t.Fatalf("%d != 1", len(outOfSyncs))
+	}
+	e := outOfSyncs[0]
+	if e.Partition != 1 || e.NodeID != nA.ID() || e.LocalChecksum != 100 || e.RemoteChecksum != 1 || e.RingVersion != rA.Version() {
+		t.Fatalf("%#v", e)
+	}
+	s := xB.Stats()
+	if s.Receives != int32(partitionCount) || s.OutOfSyncs != 1 {
+		t.Fatalf("%#v", s)
+	}
+	// Messages for a different ring version should be ignored.
+	mrB.ring = &ring{version: rB.Version() + 1}
+	xA.Pass()
+	if err = mrA.deliver(mrB); err != nil {
+		t.Fatal(err)
+	}
+	if len(outOfSyncs) != 1 {
+		t.Fatalf("%d != 1", len(outOfSyncs))
+	}
+	s = xB.Stats()
+	if s.RingVersionSkips != int32(partitionCount) {
+		t.Fatalf("%#v", s)
+	}
+}
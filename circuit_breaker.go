@@ -0,0 +1,162 @@
+package ring
+
+import (
+	"sync"
+	"time"
+)
+
+// CircuitBreakerState is the state of the circuit breaker TCPMsgRing keeps for
+// each destination address.
+type CircuitBreakerState int
+
+const (
+	// CircuitClosed is the normal state; messages are queued and connections
+	// attempted as usual.
+	CircuitClosed CircuitBreakerState = iota
+	// CircuitOpen indicates too many consecutive connection failures have
+	// occurred; messages are dropped immediately and no connections are
+	// attempted until the cool-down period has elapsed.
+	CircuitOpen
+	// CircuitHalfOpen indicates the cool-down period has elapsed and a probe
+	// connection is being attempted; success will close the circuit and
+	// failure will open it again.
+	CircuitHalfOpen
+)
+
+func (s CircuitBreakerState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+type circuitBreaker struct {
+	state    CircuitBreakerState
+	failures int
+	openedAt time.Time
+}
+
+// circuitBreakers tracks a circuitBreaker per address. The methods take the
+// current time as a parameter to ease testing.
+type circuitBreakers struct {
+	threshold   int
+	cooldown    time.Duration
+	stateChange func(addr string, from CircuitBreakerState, to CircuitBreakerState)
+	lock        sync.Mutex
+	breakers    map[string]*circuitBreaker
+}
+
+func newCircuitBreakers(threshold int, cooldown time.Duration, stateChange func(addr string, from CircuitBreakerState, to CircuitBreakerState)) *circuitBreakers {
+	return &circuitBreakers{
+		threshold:   threshold,
+		cooldown:    cooldown,
+		stateChange: stateChange,
+		breakers:    make(map[string]*circuitBreaker),
+	}
+}
+
+// transition must be called with cbs.lock held; the func returned calls the
+// stateChange func, if the state changed, and must be called once cbs.lock is
+// released, so the stateChange func may send messages or check states.
+func (cbs *circuitBreakers) transition(addr string, cb *circuitBreaker, to CircuitBreakerState, now time.Time) func() {
+	from := cb.state
+	cb.state = to
+	if to == CircuitOpen {
+		cb.openedAt = now
+	}
+	if from == to || cbs.stateChange == nil {
+		return func() {}
+	}
+	return func() { cbs.stateChange(addr, from, to) }
+}
+
+// allow returns false if messages to the address should be dropped
+// immediately.
+func (cbs *circuitBreakers) allow(addr string, now time.Time) bool {
+	cbs.lock.Lock()
+	defer cbs.lock.Unlock()
+	cb := cbs.breakers[addr]
+	if cb == nil || cb.state != CircuitOpen {
+		return true
+	}
+	return now.Sub(cb.openedAt) >= cbs.cooldown
+}
+
+// probeWait returns how long to wait before a connection attempt may be made
+// to the address; if it returns 0 and the circuit was open it will have
+// transitioned to half-open.
+func (cbs *circuitBreakers) probeWait(addr string, now time.Time) time.Duration {
+	cbs.lock.Lock()
+	cb := cbs.breakers[addr]
+	if cb == nil || cb.state != CircuitOpen {
+		cbs.lock.Unlock()
+		return 0
+	}
+	if wait := cbs.cooldown - now.Sub(cb.openedAt); wait > 0 {
+		cbs.lock.Unlock()
+		return wait
+	}
+	notify := cbs.transition(addr, cb, CircuitHalfOpen, now)
+	cbs.lock.Unlock()
+	notify()
+	return 0
+}
+
+// failure records a connection failure to the address, returning true if
+// this opened the circuit.
+func (cbs *circuitBreakers) failure(addr string, now time.Time) bool {
+	cbs.lock.Lock()
+	cb := cbs.breakers[addr]
+	if cb == nil {
+		cb = &circuitBreaker{}
+		cbs.breakers[addr] = cb
+	}
+	cb.failures++
+	if cb.state == CircuitHalfOpen || (cb.state == CircuitClosed && cb.failures >= cbs.threshold) {
+		notify := cbs.transition(addr, cb, CircuitOpen, now)
+		cbs.lock.Unlock()
+		notify()
+		return true
+	}
+	cbs.lock.Unlock()
+	return false
+}
+
+// success records a successful connection to the address, closing its
+// circuit.
+func (cbs *circuitBreakers) success(addr string, now time.Time) {
+	cbs.lock.Lock()
+	cb := cbs.breakers[addr]
+	if cb == nil {
+		cbs.lock.Unlock()
+		return
+	}
+	notify := cbs.transition(addr, cb, CircuitClosed, now)
+	delete(cbs.breakers, addr)
+	cbs.lock.Unlock()
+	notify()
+}
+
+// state returns the current state of the address' circuit.
+func (cbs *circuitBreakers) state(addr string) CircuitBreakerState {
+	cbs.lock.Lock()
+	defer cbs.lock.Unlock()
+	cb := cbs.breakers[addr]
+	if cb == nil {
+		return CircuitClosed
+	}
+	return cb.state
+}
+
+// forget drops any tracking for the address, such as when it is no longer in
+// the ring.
+func (cbs *circuitBreakers) forget(addr string) {
+	cbs.lock.Lock()
+	delete(cbs.breakers, addr)
+	cbs.lock.Unlock()
+}
@@ -0,0 +1,113 @@
+package ring
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakers(t *testing.T) {
+	type change struct {
+		from CircuitBreakerState
+		to   CircuitBreakerState
+	}
+	var changes []change
+	var cbs *circuitBreakers
+	cbs = newCircuitBreakers(3, 10*time.Second, func(addr string, from CircuitBreakerState, to CircuitBreakerState) {
+		if addr != "a" {
+			t.Fatalf("%s != a", addr)
+		}
+		// The breakers are not locked while the callback runs.
+		if state := cbs.state(addr); state != to {
+			t.Fatalf("%s != %s", state, to)
+		}
+		changes = append(changes, change{from, to})
+	})
+	now := time.Now()
+	if !cbs.allow("a", now) {
+		t.Fatal("should allow unknown address")
+	}
+	if cbs.failure("a", now) || cbs.failure("a", now) {
+		t.Fatal("should not open before threshold")
+	}
+	if cbs.state("a") != CircuitClosed {
+		t.Fatalf("%s != %s", cbs.state("a"), CircuitClosed)
+	}
+	if !cbs.failure("a", now) {
+		t.Fatal("should open at threshold")
+	}
+	if cbs.allow("a", now.Add(time.Second)) {
+		t.Fatal("should not allow while open")
+	}
+	if wait := cbs.probeWait("a", now.Add(time.Second)); wait != 9*time.Second {
+		t.Fatalf("%s != 9s", wait)
+	}
+	if !cbs.allow("a", now.Add(10*time.Second)) {
+		t.Fatal("should allow after cooldown")
+	}
+	if wait := cbs.probeWait("a", now.Add(10*time.Second)); wait != 0 {
+		t.Fatalf("%s != 0", wait)
+	}
+	if cbs.state("a") != CircuitHalfOpen {
+		t.Fatalf("%s != %s", cbs.state("a"), CircuitHalfOpen)
+	}
+	// A single failure while half-open reopens the circuit.
+	if !cbs.failure("a", now.Add(11*time.Second)) {
+		t.Fatal("should reopen from half-open")
+	}
+	if cbs.allow("a", now.Add(20*time.Second)) {
+		t.Fatal("cooldown should restart when reopened")
+	}
+	cbs.probeWait("a", now.Add(21*time.Second))
+	cbs.success("a", now.Add(21*time.Second))
+	if cbs.state("a") != CircuitClosed {
+		t.Fatalf("%s != %s", cbs.state("a"), CircuitClosed)
+	}
+	expected := []change{
+		{CircuitClosed, CircuitOpen},
+		{CircuitOpen, CircuitHalfOpen},
+		{CircuitHalfOpen, CircuitOpen},
+		{CircuitOpen, CircuitHalfOpen},
+		{CircuitHalfOpen, CircuitClosed},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("%v != %v", changes, expected)
+	}
+	for i, c := range changes {
+		if c != expected[i] {
+			t.Fatalf("%d: %v != %v", i, c, expected[i])
+		}
+	}
+	// Failures are consecutive; success resets the count.
+	cbs.failure("a", now)
+	cbs.failure("a", now)
+	cbs.success("a", now)
+	if cbs.failure("a", now) {
+		t.Fatal("success should reset failure count")
+	}
+}
+
+func TestCircuitBreakerProbeWaitStop(t *testing.T) {
+	msgring, _ := NewTCPMsgRing(&TCPMsgRingConfig{CircuitBreakerThreshold: 1, CircuitBreakerCooldown: 60})
+	defer msgring.Shutdown()
+	addr := "127.0.0.2:1"
+	msgChan, _ := msgring.msgChanForAddr(addr)
+	msgring.circuitBreakers.failure(addr, time.Now())
+	done := make(chan struct{})
+	go func() {
+		msgring.connection(addr, nil, msgChan, true, false)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	// Draining the address stops the connection routine rather than leaving
+	// it waiting out the cooldown.
+	msgring.drain(addr, msgChan)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("connection still waiting on the open circuit breaker")
+	}
+	if dials := atomic.LoadInt32(&msgring.dials); dials != 0 {
+		t.Fatal(dials)
+	}
+}
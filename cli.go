@@ -1,6 +1,7 @@
 package ring
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -97,6 +98,54 @@ func CLI(args []string, output io.Writer, ansiColor bool) error {
 			return err
 		}
 		return PersistRingOrBuilder(r, b, args[1])
+	case "replace":
+		if r != nil {
+			return fmt.Errorf("cannot replace a node in a ring; use with a builder instead")
+		}
+		if err = CLIReplace(b, args[3:], output); err != nil {
+			return err
+		}
+		return PersistRingOrBuilder(r, b, args[1])
+	case "correlate", "uncorrelate":
+		if r != nil {
+			return fmt.Errorf("cannot %s tiers in a ring; use with a builder instead", args[2])
+		}
+		if err = CLICorrelate(b, args[3:], args[2] == "uncorrelate", output); err != nil {
+			return err
+		}
+		return PersistRingOrBuilder(r, b, args[1])
+	case "affinity", "unaffinity":
+		if r != nil {
+			return fmt.Errorf("cannot %s partitions in a ring; use with a builder instead", args[2])
+		}
+		if err = CLIAffinity(b, args[3:], args[2] == "unaffinity", output); err != nil {
+			return err
+		}
+		return PersistRingOrBuilder(r, b, args[1])
+	case "partition-mode":
+		if r != nil {
+			return fmt.Errorf("cannot set partition modes in a ring; use with a builder instead")
+		}
+		if err = CLIPartitionMode(b, args[3:], output); err != nil {
+			return err
+		}
+		return PersistRingOrBuilder(r, b, args[1])
+	case "schedule-capacity", "unschedule-capacity":
+		if r != nil {
+			return fmt.Errorf("cannot schedule capacities in a ring; use with a builder instead")
+		}
+		if err = CLIScheduleCapacity(b, args[3:], args[2] == "unschedule-capacity", output); err != nil {
+			return err
+		}
+		return PersistRingOrBuilder(r, b, args[1])
+	case "region-targets":
+		if r != nil {
+			return fmt.Errorf("cannot set region targets in a ring; use with a builder instead")
+		}
+		if err = CLIRegionTargets(b, args[3:], output); err != nil {
+			return err
+		}
+		return PersistRingOrBuilder(r, b, args[1])
 	case "ring":
 		if b == nil {
 			return fmt.Errorf("only valid for builder files")
@@ -110,6 +159,20 @@ func CLI(args []string, output io.Writer, ansiColor bool) error {
 			return err
 		}
 		return PersistRingOrBuilder(r, b, args[1])
+	case "gc":
+		if b == nil {
+			return fmt.Errorf("only valid for builder files")
+		}
+		if err = CLIGC(b, args[3:], output); err != nil {
+			return err
+		}
+		return PersistRingOrBuilder(r, b, args[1])
+	case "tokens":
+		return CLITokens(r, b, args[3:], output)
+	case "diagnose":
+		return CLIDiagnose(r, b, args[3:], output)
+	case "health":
+		return CLIHealth(r, b, args[3:], output)
 	case "config":
 		if changed, err := CLIConfig(r, b, args[3:], output); err != nil {
 			return err
@@ -216,12 +279,69 @@ maximum bits for partition numbers, which limits the memory size of the ring
 but also limits the balancing ability. 23 allows for 8388608 partitions which,
 with a 3 replica ring, would use about 100M of memory.
 
+partition-bits=<value>
+: The <value> is a number from 1 to 31 that, if set, fixes the number of
+partitions at 2**<value>, as with a Swift partition power, instead of letting
+the partition count grow as needed for balance; it overrides
+max-partition-bits.
+
 move-wait=<value>
 : The <value> is a positive number that defaults to 60 and indicates the number
 of minutes to wait before reassigning a given replica of a partition. This is
 to give time for actual data to rebalance in the system before changing where
 it is assigned again.
 
+dispersion-points-allowed=<value>
+: The <value> is a number from 0 to 255 that defaults to 255 and indicates the
+number of percentage points overweight a node may become to keep the replicas
+of a partition in distinct tiers. For example, 3 accepts up to 3%% imbalance to
+keep zone dispersion perfect, beyond which balance is favored instead. 255
+places no limit, always favoring dispersion.
+
+strict-dispersion=<value>
+: The <value> defaults to -1, meaning off, and otherwise indicates the "ring"
+command should fail, listing the partitions involved, rather than write a ring
+whose replicas are not dispersed enough: 0 requires the replicas of each
+partition be on distinct nodes, 1 also distinct tier level 0 values, 2 distinct
+tier level 1 values, and so on.
+
+moves-per-partition=<value>
+: The <value> is a number from 0 to 255 that defaults to 0 and indicates how
+many replicas of any one partition may be reassigned within the move-wait.
+Lower values minimize data movement; higher values reach balance in fewer
+rebalances. 0 means fewer than half the replicas, but at least 1.
+
+max-move-percentage=<value>
+: The <value> is a number from 0 to 100 that defaults to 0 and indicates the
+most partition replicas, as a percentage of all of them, the "ring" command may
+reassign at once, so large changes roll out over several rings, giving the
+data time to move in between. At least one replica may always move. 0 means no
+limit.
+
+capacity-reserve=<value>
+: The <value> is a number from 0 to 99 that defaults to 0 and indicates the
+percentage of each node's capacity to hold back as headroom, for handoff data
+and imbalance during failures; nodes are balanced by the rest. Nodes may set
+their own reserve with reserve=<value>.
+
+rebalance-trigger=<always|never|threshold>
+: Indicates when the "ring" command rebalances: "always", the default; "never",
+just writing the current assignments, though replicas not yet assigned at all
+are still assigned; or "threshold", only when a node is more over or under
+weight than rebalance-threshold allows or when replicas are still assigned to
+deactivated nodes.
+
+rebalance-threshold=<value>
+: The <value> is a number from 0 to 255 that defaults to 0 and indicates the
+percentage points over or under weight a node may be before rebalancing with
+rebalance-trigger=threshold. 0 means to use the points-allowed.
+
+placement=<balanced|dispersed>
+: Indicates how replicas are placed: "balanced", the default, separates
+replicas of a partition only onto nodes wanting more replicas; "dispersed"
+makes the replicas as unique as the nodes allow, distinct nodes first and then
+distinct values at each tier level, even at some cost to balance.
+
 config=<value>
 : The <value> is the string to be stored as the global config value.
 
@@ -235,6 +355,12 @@ number of bits to use for node IDs in the ring. Perhaps a strange setting, but
 limiting the bits may required or useful in applications that store or transmit
 node IDs.
 
+address-roles=<value>
+: The <value> is a comma separated list of names for the node address indexes;
+for example, address-roles=replication,client would name address0 the
+replication address and address1 the client address. Users of the ring can
+then look up addresses by role rather than by index.
+
 
 # %[1]s <builder-file> add [<name>=<value>] ...
 
@@ -243,9 +369,26 @@ Adds a new node to the builder. Available attributes:
 active=<true|false>
 : Nodes are active by default; this attribute can change that status.
 
+deactivate=<rebalance|immediately|keep>
+: Marks the node inactive, choosing what happens to its assigned partitions:
+"rebalance" reassigns them on the next rebalance, as with active=false;
+"immediately" reassigns them right away; "keep" leaves them assigned to the
+node, as the last replicas of their partitions, until the node is reactivated.
+
 capacity=<value>
-: The <value> is a decimal number from 0 to 4294967295 and indicates how much
-of the ring to assign to the node relative to other nodes.
+: The <value> is a decimal number from 0 to 18446744073709551615 and indicates
+how much of the ring to assign to the node relative to other nodes. The total
+capacity of all nodes may not exceed that maximum either.
+
+reserve=<value>
+: The <value> is a number from 0 to 99 indicating the percentage of the node's
+capacity to hold back as headroom, in place of the builder's capacity-reserve;
+-1 returns the node to the builder's capacity-reserve.
+
+drain=<true|false>
+: Marks the node as draining, or not; a draining node stays active but is
+balanced as if its capacity were 0, so its partitions move off it gradually
+over the following rebalances. The info command shows the progress.
 
 tierX=<value>
 : Sets the value for the tier level specified by X. For example:
@@ -263,6 +406,11 @@ meta=[value]
 can be used for notes about the node if desired, such as the model or serial
 number.
 
+zone=[value]
+: The [value] names the network the node is reached over, such as a datacenter
+or cloud region; transports may use different settings for links between zones
+than for links within a zone. It does not affect assignments.
+
 config=<value>
 : The <value> is the string to be stored in the node's config field.
 
@@ -279,6 +427,85 @@ record of the node having existed, but permanent removal from the record may be
 desired.
 
 
+# %[1]s <builder-file> replace old=<value> new=<value>
+
+Transfers all the partition assignments of the old node to the new node and
+then removes the old node, such as when a failed server's drive is restored
+into new hardware. The new node must already have been added, usually with the
+same capacity and tiers as the old node, and must not yet have any assignments.
+No rebalance or data movement is needed beyond the physical restore.
+
+
+# %[1]s <builder-file> correlate <level> <value> <value> ...
+
+Declares that the tier values at the level share a failure domain even though
+they are distinct values, such as two racks fed by the same PDU. Rebalancing
+treats correlated values as one when dispersing replicas. Correlating a value
+that is already correlated merges the correlations. Example:
+
+%[1]s my.builder correlate 1 rack1 rack2
+
+
+# %[1]s <builder-file> uncorrelate <level> <value>
+
+Removes the tier value at the level from any correlation.
+
+
+# %[1]s <builder-file> affinity <name> colocate|spread <partition> ...
+
+Declares, or replaces, the named group of partitions, such as all the
+partitions of one tenant. Rebalancing tries to keep the replicas of a colocate
+group on the same nodes and to spread the replicas of a spread group over as
+many nodes as possible, by swapping them with replicas of other partitions
+where doing so does not hurt balance or dispersion. Example:
+
+%[1]s my.builder affinity tenant1 spread 12 57 300
+
+
+# %[1]s <builder-file> unaffinity <name>
+
+Removes the named partition affinity group.
+
+
+# %[1]s <builder-file> partition-mode read-write|read-only|quiesced <partition> ...
+
+Sets the mode of the partitions in the rings generated from now on, such as to
+stop writes to partitions being migrated; read-only partitions allow just
+reads and quiesced partitions allow neither. The storage layers enforce the
+mode, as given by the ring. Example:
+
+%[1]s my.builder partition-mode read-only 12 57
+
+
+# %[1]s <builder-file> schedule-capacity id=<value> from=<value> to=<value> over=<duration>
+
+Ramps the node's capacity from one value to the other over the duration,
+starting now, such as to fill a new node or drain an old one gradually. The
+values may be capacities or percentages of the node's current capacity, and
+the duration is as 90m, 12h, or 7d. The capacity is brought up to date by the
+"ring" command and by rebalance scheduler passes. Example:
+
+%[1]s my.builder schedule-capacity id=42 from=25%% to=100%% over=7d
+
+
+# %[1]s <builder-file> unschedule-capacity id=<value>
+
+Cancels the node's capacity schedule, leaving the capacity it has reached.
+
+
+# %[1]s <builder-file> region-targets <level> <region>=<count> ...
+
+Sets how many replicas of every partition to place in each region, the regions
+being the tier values at the <level> given, such as for geo-redundant
+deployments with regions of different capacity. The counts may total fewer
+than the replicas, the rest being placed anywhere. Rebalancing meets the
+targets before balancing; the "ring" command reports partitions falling
+short, such as for lack of active nodes in a region. Use "off" instead of the
+level to clear the targets. Example:
+
+%[1]s my.builder region-targets 2 east=2 west=1
+
+
 # %[1]s <builder-file> node [filter] ... set [<name>=<value>] ...
 
 Updates existing node attributes. The filters are the same as for the generic
@@ -294,7 +521,9 @@ Updates existing node attributes. The filters are the same as for the generic
 
 Writes a new ring file based on the information contained in the builder. This
 may take a while if rebalancing ring assignments are needed. The ring file name
-will be the base name of the builder file plus a .ring extension.
+will be the base name of the builder file plus a .ring extension. With
+strict-dispersion set, no ring file is written if the replicas are not
+dispersed enough, though the builder file is still updated.
 
 
 # %[1]s <builder-file> pretend-elapsed <minutes>
@@ -304,6 +533,77 @@ to work around the protections that restrict reassigning data quicker than the
 move-wait limit.
 
 
+# %[1]s <builder-file> gc [retention-minutes]
+
+Removes departed nodes, those that are inactive and no longer have any
+partition replicas assigned, and any tier values no longer in use. No nodes will
+be removed if any partition replica has been reassigned within the
+[retention-minutes], which defaults to the move-wait, as recently departed nodes
+may still hold data being moved.
+
+
+# %[1]s <ring-file> tokens [address-index]
+
+Outputs the ring's layout as a JSON token map, each partition being a token
+range in the manner of Cassandra's Murmur3Partitioner, for use with
+Dynamo-family tooling. Node endpoints use the address at [address-index], which
+defaults to 0.
+
+
+# %[1]s <ring-file> diagnose local=<id> [<name>=<value>] ...
+
+Attempts a connection and TCPMsgRing handshake with every other node in the
+ring, as the local node given, and reports each node's reachability, connect
+time, TLS status, handshake round trip time, estimated clock skew, and whether
+its protocol version matches. The local node must be one the other nodes know. Available options:
+
+address-index=<value>
+: The index of the node addresses to connect to. Defaults to 0.
+
+address-role=<value>
+: The name of the address role to connect to, instead of an address-index.
+
+timeout=<seconds>
+: How long to wait for the whole diagnosis. Defaults to 10 seconds.
+
+tls=<true|false>
+: Whether to connect with TLS. Defaults to false.
+
+cert-file=<path>, key-file=<path>, ca-file=<path>
+: The TLS client certificate, its key, and the certificate authority to verify
+nodes with.
+
+skip-verify=<true|false>
+: Whether to skip verifying the nodes' TLS certificates. Defaults to false.
+
+
+# %[1]s <ring-file> health [<name>=<value>] ...
+
+Scores the ring's health from 0 to 100, combining its balance, the dispersion
+of its replicas, its unassigned replicas, and its replicas still on inactive
+nodes, and judges whether it is safe to publish, failing if not so pipelines
+can gate on it. Available options:
+
+max-imbalance=<value>
+: The percentage points over or under weight any node may be. Defaults to 5.
+
+dispersion=<value>
+: The dispersion required, as with strict-dispersion: 0, the default, for
+replicas on distinct nodes, 1 also distinct tier level 0 values, and so on; -1
+disables the check.
+
+max-undispersed=<value>
+: The percentage of partitions that may fall short of the dispersion. Defaults
+to 0.
+
+max-unassigned=<value>
+: The number of partition replicas that may be unassigned. Defaults to 0.
+
+max-inactive-exposure=<value>
+: The percentage of partition replicas that may be on inactive nodes. Defaults
+to 0.
+
+
 # %[1]s <file> config [value]
 
 Displays or sets the global config in the provided ring or builder file.
@@ -342,6 +642,8 @@ func CLIInfo(r Ring, b *Builder, output io.Writer) error {
 			[]string{brimtext.ThousandsSepU(s.ActiveCapacity, ","), "Active Capacity"},
 			[]string{brimtext.ThousandsSepU(s.InactiveCapacity, ","), "Inactive Capacity"},
 			[]string{brimtext.ThousandsSep(int64(len(r.Tiers())), ","), "Tier Levels"},
+			[]string{brimtext.ThousandsSep(int64(s.UnassignedCount), ","), "Unassigned Replicas"},
+			[]string{brimtext.ThousandsSep(int64(len(r.PartitionModes())), ","), "Restricted Partitions"},
 			[]string{fmt.Sprintf("%.02f%%", s.MaxUnderNodePercentage), fmt.Sprintf("Worst Underweight Node (ID %d)", s.MaxUnderNodeID)},
 			[]string{fmt.Sprintf("%.02f%%", s.MaxOverNodePercentage), fmt.Sprintf("Worst Overweight Node (ID %d)", s.MaxOverNodeID)},
 			[]string{"Version", fmt.Sprintf("%d   %s", r.Version(), time.Unix(0, r.Version()).Format("2006-01-02 15:04:05.000"))},
@@ -351,30 +653,52 @@ func CLIInfo(r Ring, b *Builder, output io.Writer) error {
 		fmt.Fprint(output, brimtext.Align(report, reportOpts))
 	}
 	if b != nil {
+		bs := b.Stats()
 		var activeNodes int64
-		var activeCapacity int64
+		var activeCapacity uint64
 		var inactiveNodes int64
-		var inactiveCapacity int64
+		var inactiveCapacity uint64
 		for _, n := range b.Nodes() {
 			if n.Active() {
 				activeNodes++
-				activeCapacity += int64(n.Capacity())
+				activeCapacity += n.Capacity()
 			} else {
 				inactiveNodes++
-				inactiveCapacity += int64(n.Capacity())
+				inactiveCapacity += n.Capacity()
 			}
 		}
 		report := [][]string{
 			[]string{brimtext.ThousandsSep(activeNodes, ","), "Active Nodes"},
 			[]string{brimtext.ThousandsSep(inactiveNodes, ","), "Inactive Nodes"},
-			[]string{brimtext.ThousandsSep(activeCapacity, ","), "Active Capacity"},
-			[]string{brimtext.ThousandsSep(inactiveCapacity, ","), "Inactive Capacity"},
+			[]string{brimtext.ThousandsSepU(activeCapacity, ","), "Active Capacity"},
+			[]string{brimtext.ThousandsSepU(inactiveCapacity, ","), "Inactive Capacity"},
 			[]string{brimtext.ThousandsSep(int64(b.ReplicaCount()), ","), "Replicas"},
 			[]string{brimtext.ThousandsSep(int64(len(b.Tiers())), ","), "Tier Levels"},
 			[]string{brimtext.ThousandsSep(int64(b.PointsAllowed()), ","), "Points Allowed"},
 			[]string{brimtext.ThousandsSep(int64(b.MaxPartitionBitCount()), ","), "Max Partition Bits"},
 			[]string{brimtext.ThousandsSep(int64(b.MoveWait()), ","), "Move Wait"},
+			[]string{brimtext.ThousandsSep(int64(b.DispersionPointsAllowed()), ","), "Dispersion Points Allowed"},
+			[]string{fmt.Sprintf("%d", b.StrictDispersion()), "Strict Dispersion"},
+			[]string{brimtext.ThousandsSep(int64(len(b.PartitionModes())), ","), "Restricted Partitions"},
+			[]string{cliRegionTargets(b), "Region Targets"},
+			[]string{brimtext.ThousandsSep(int64(len(b.CapacitySchedules())), ","), "Capacity Schedules"},
+			[]string{brimtext.ThousandsSep(int64(bs.RegionTargetShortfalls), ","), "Region Target Shortfalls"},
+			[]string{cliDispersionViolations(bs.DispersionViolations), "Dispersion Violations"},
+			[]string{brimtext.ThousandsSep(int64(b.MovesPerPartition()), ","), "Moves Per Partition"},
+			[]string{brimtext.ThousandsSep(int64(b.MaxMovePercentage()), ","), "Max Move Percentage"},
+			[]string{brimtext.ThousandsSep(int64(b.CapacityReserve()), ","), "Capacity Reserve"},
+			[]string{brimtext.ThousandsSepU(bs.ReservedCapacity, ","), "Reserved Capacity"},
+			[]string{cliDrains(bs.Drains), "Draining Nodes"},
+			[]string{b.RebalanceTrigger().String(), "Rebalance Trigger"},
+			[]string{brimtext.ThousandsSep(int64(b.RebalanceThreshold()), ","), "Rebalance Threshold"},
+			[]string{b.PlacementMode().String(), "Placement Mode"},
+			[]string{b.KeyHasher(), "Key Hasher"},
 			[]string{brimtext.ThousandsSep(int64(b.IDBits()), ","), "ID Bits"},
+			[]string{strings.Join(b.AddressRoles(), ","), "Address Roles"},
+			[]string{brimtext.ThousandsSep(int64(bs.DepartedNodeCount), ","), "Departed Nodes (GC)"},
+			[]string{brimtext.ThousandsSep(int64(bs.UnusedTierValueCount), ","), "Unused Tier Values (GC)"},
+			[]string{fmt.Sprintf("%s (%.02f%%)", brimtext.ThousandsSep(int64(bs.MovesLastDay), ","), bs.ChurnLastDay), "Moves Last Day"},
+			[]string{fmt.Sprintf("%s (%.02f%%)", brimtext.ThousandsSep(int64(bs.MovesLastWeek), ","), bs.ChurnLastWeek), "Moves Last Week"},
 		}
 		reportOpts := brimtext.NewDefaultAlignOptions()
 		reportOpts.Alignments = []brimtext.Alignment{brimtext.Right, brimtext.Left}
@@ -529,6 +853,13 @@ OUT:
 		})
 	}
 	fmt.Fprint(output, brimtext.Align(report, reportOpts))
+	if b != nil {
+		for level, groups := range b.TierCorrelations() {
+			for _, group := range groups {
+				fmt.Fprintf(output, "Level %d correlated: %s\n", level, strings.Join(qStrings(group), " "))
+			}
+		}
+	}
 	return nil
 }
 
@@ -548,8 +879,11 @@ func CLIPartition(r Ring, b *Builder, args []string, output io.Writer) error {
 	if err != nil {
 		return err
 	}
+	if mode := r.PartitionMode(Partition(p)); mode != PartitionReadWrite {
+		fmt.Fprintf(output, "Partition %d is %s\n\n", p, mode)
+	}
 	first := true
-	for _, n := range r.ResponsibleNodes(uint32(p)) {
+	for _, n := range r.ResponsibleNodes(Partition(p)) {
 		if first {
 			first = false
 		} else {
@@ -569,8 +903,18 @@ func CLICreate(filename string, args []string, output io.Writer) error {
 	replicaCount := 3
 	pointsAllowed := 1
 	maxPartitionBitCount := 23
+	partitionBitCount := 0
 	moveWait := 60
+	dispersionPointsAllowed := 255
+	strictDispersion := -1
+	movesPerPartition := 0
+	maxMovePercentage := 0
+	capacityReserve := 0
+	rebalanceTrigger := RebalanceAlways
+	placementMode := PlacementBalanced
+	rebalanceThreshold := 0
 	idBits := 64
+	var addressRoles []string
 	var config []byte
 	var err error
 	for _, arg := range args {
@@ -610,6 +954,13 @@ func CLICreate(filename string, args []string, output io.Writer) error {
 			} else if maxPartitionBitCount > 64 {
 				maxPartitionBitCount = 64
 			}
+		case "partition-bits":
+			if partitionBitCount, err = strconv.Atoi(sarg[1]); err != nil {
+				return err
+			}
+			if partitionBitCount < 1 || partitionBitCount > 31 {
+				return fmt.Errorf("partition-bits must be from 1 to 31")
+			}
 		case "move-wait":
 			if moveWait, err = strconv.Atoi(sarg[1]); err != nil {
 				return err
@@ -619,6 +970,73 @@ func CLICreate(filename string, args []string, output io.Writer) error {
 			} else if moveWait > math.MaxUint16 {
 				moveWait = math.MaxUint16
 			}
+		case "dispersion-points-allowed":
+			if dispersionPointsAllowed, err = strconv.Atoi(sarg[1]); err != nil {
+				return err
+			}
+			if dispersionPointsAllowed < 0 {
+				dispersionPointsAllowed = 0
+			} else if dispersionPointsAllowed > 255 {
+				dispersionPointsAllowed = 255
+			}
+		case "strict-dispersion":
+			if strictDispersion, err = strconv.Atoi(sarg[1]); err != nil {
+				return err
+			}
+		case "moves-per-partition":
+			if movesPerPartition, err = strconv.Atoi(sarg[1]); err != nil {
+				return err
+			}
+			if movesPerPartition < 0 {
+				movesPerPartition = 0
+			} else if movesPerPartition > 255 {
+				movesPerPartition = 255
+			}
+		case "max-move-percentage":
+			if maxMovePercentage, err = strconv.Atoi(sarg[1]); err != nil {
+				return err
+			}
+			if maxMovePercentage < 0 {
+				maxMovePercentage = 0
+			} else if maxMovePercentage > 100 {
+				maxMovePercentage = 100
+			}
+		case "capacity-reserve":
+			if capacityReserve, err = strconv.Atoi(sarg[1]); err != nil {
+				return err
+			}
+			if capacityReserve < 0 || capacityReserve > 99 {
+				return fmt.Errorf("capacity-reserve must be in the range 0-99; %d was given", capacityReserve)
+			}
+		case "rebalance-trigger":
+			switch sarg[1] {
+			case "always":
+				rebalanceTrigger = RebalanceAlways
+			case "never":
+				rebalanceTrigger = RebalanceNever
+			case "threshold":
+				rebalanceTrigger = RebalanceOverThreshold
+			default:
+				return fmt.Errorf(`invalid expression %#v; use "always", "never", or "threshold" for the value of rebalance-trigger`, arg)
+			}
+		case "placement":
+			switch sarg[1] {
+			case "balanced":
+				placementMode = PlacementBalanced
+			case "dispersed":
+				placementMode = PlacementDispersed
+			default:
+				return fmt.Errorf(`invalid expression %#v; use "balanced" or "dispersed" for the value of placement`, arg)
+			}
+		case "rebalance-threshold":
+			if rebalanceThreshold, err = strconv.Atoi(sarg[1]); err != nil {
+				return err
+			}
+			if rebalanceThreshold < 0 {
+				rebalanceThreshold = 0
+			} else if rebalanceThreshold > 255 {
+				rebalanceThreshold = 255
+			}
 		case "config":
 			if sarg[1] == "" {
 				config = nil
@@ -637,6 +1055,8 @@ func CLICreate(filename string, args []string, output io.Writer) error {
 			if idBits < 1 || idBits > 64 {
 				return fmt.Errorf("id-bits must be in the range 1-64; %d was given", idBits)
 			}
+		case "address-roles":
+			addressRoles = strings.Split(sarg[1], ",")
 		default:
 			return fmt.Errorf("Invalid arg: %q in create cmd", arg)
 		}
@@ -657,6 +1077,20 @@ func CLICreate(filename string, args []string, output io.Writer) error {
 	b.SetPointsAllowed(byte(pointsAllowed))
 	b.SetMaxPartitionBitCount(uint16(maxPartitionBitCount))
 	b.SetMoveWait(uint16(moveWait))
+	b.SetDispersionPointsAllowed(byte(dispersionPointsAllowed))
+	b.SetStrictDispersion(strictDispersion)
+	b.SetMovesPerPartition(byte(movesPerPartition))
+	b.SetMaxMovePercentage(byte(maxMovePercentage))
+	b.SetCapacityReserve(byte(capacityReserve))
+	b.SetRebalanceTrigger(rebalanceTrigger)
+	b.SetRebalanceThreshold(byte(rebalanceThreshold))
+	b.SetPlacementMode(placementMode)
+	b.SetAddressRoles(addressRoles)
+	if partitionBitCount > 0 {
+		if err = b.SetPartitionBits(uint16(partitionBitCount)); err != nil {
+			return err
+		}
+	}
 	if err = b.Persist(f); err != nil {
 		return err
 	}
@@ -673,11 +1107,15 @@ func CLICreate(filename string, args []string, output io.Writer) error {
 // Normally the results from RingOrBuilder.
 func CLIAddOrSet(b *Builder, args []string, n BuilderNode, output io.Writer) error {
 	active := true
-	capacity := uint32(1)
+	inactivePolicy := InactiveReassignOnRebalance
+	capacity := uint64(1)
 	var tiers []string
 	var addresses []string
 	var config []byte
 	meta := ""
+	zone := ""
+	reserve := -1
+	drain := false
 	for _, arg := range args {
 		sarg := strings.SplitN(arg, "=", 2)
 		if len(sarg) != 2 {
@@ -699,26 +1137,70 @@ func CLIAddOrSet(b *Builder, args []string, n BuilderNode, output io.Writer) err
 			if n != nil {
 				n.SetActive(active)
 			}
+		case "deactivate":
+			switch sarg[1] {
+			case "rebalance":
+				inactivePolicy = InactiveReassignOnRebalance
+			case "immediately":
+				inactivePolicy = InactiveReassignImmediately
+			case "keep":
+				inactivePolicy = InactiveKeepAsLastResort
+			default:
+				return fmt.Errorf(`invalid expression %#v; use "rebalance", "immediately", or "keep" for the value of deactivate`, arg)
+			}
+			active = false
+			if n != nil {
+				n.Deactivate(inactivePolicy)
+			}
 		case "capacity":
-			c, err := strconv.Atoi(sarg[1])
+			c, err := strconv.ParseUint(sarg[1], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid expression %#v; %s", arg, err)
+			}
+			capacity = c
+			if n != nil {
+				if err = n.SetCapacity(capacity); err != nil {
+					return fmt.Errorf("invalid expression %#v; %s", arg, err)
+				}
+			}
+		case "reserve":
+			r, err := strconv.Atoi(sarg[1])
 			if err != nil {
 				return fmt.Errorf("invalid expression %#v; %s", arg, err)
 			}
-			if c < 0 {
-				return fmt.Errorf("invalid expression %#v; min is 0", arg)
+			if r < -1 || r > 99 {
+				return fmt.Errorf("invalid expression %#v; use 0 to 99, or -1 to clear", arg)
 			}
-			if c > math.MaxUint32 {
-				return fmt.Errorf("invalid expression %#v; max is %d", arg, math.MaxUint32)
+			reserve = r
+			if n != nil {
+				if err = b.SetNodeCapacityReserve(n.ID(), reserve); err != nil {
+					return fmt.Errorf("invalid expression %#v; %s", arg, err)
+				}
+			}
+		case "drain":
+			switch sarg[1] {
+			case "true":
+				drain = true
+			case "false":
+				drain = false
+			default:
+				return fmt.Errorf(`invalid expression %#v; use "true" or "false" for the value of drain`, arg)
 			}
-			capacity = uint32(c)
 			if n != nil {
-				n.SetCapacity(capacity)
+				if err := b.SetNodeDraining(n.ID(), drain); err != nil {
+					return fmt.Errorf("invalid expression %#v; %s", arg, err)
+				}
 			}
 		case "meta":
 			meta = sarg[1]
 			if n != nil {
 				n.SetMeta(meta)
 			}
+		case "zone":
+			zone = sarg[1]
+			if n != nil {
+				n.SetNetworkZone(zone)
+			}
 		case "config":
 			if sarg[1] == "" {
 				config = nil
@@ -780,6 +1262,20 @@ func CLIAddOrSet(b *Builder, args []string, n BuilderNode, output io.Writer) err
 		if err != nil {
 			return err
 		}
+		if !active {
+			n.Deactivate(inactivePolicy)
+		}
+		n.SetNetworkZone(zone)
+		if reserve >= 0 {
+			if err = b.SetNodeCapacityReserve(n.ID(), reserve); err != nil {
+				return err
+			}
+		}
+		if drain {
+			if err = b.SetNodeDraining(n.ID(), true); err != nil {
+				return err
+			}
+		}
 		output.Write([]byte(CLINodeReport(n)))
 	}
 	return nil
@@ -802,16 +1298,276 @@ func CLIRemove(b *Builder, args []string, output io.Writer) error {
 	return nil
 }
 
+// CLIReplace transfers a node's assignments to another node in the builder;
+// see the output of CLIHelp for detailed information.
+func CLIReplace(b *Builder, args []string, output io.Writer) error {
+	var oldID, newID uint64
+	var oldSet, newSet bool
+	for _, arg := range args {
+		sarg := strings.SplitN(arg, "=", 2)
+		if len(sarg) != 2 || (sarg[0] != "old" && sarg[0] != "new") {
+			return fmt.Errorf("must specify nodes with old=<value> new=<value>")
+		}
+		id, err := strconv.ParseUint(sarg[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid id %#v", sarg[1])
+		}
+		if sarg[0] == "old" {
+			oldID, oldSet = id, true
+		} else {
+			newID, newSet = id, true
+		}
+	}
+	if !oldSet || !newSet {
+		return fmt.Errorf("must specify nodes with old=<value> new=<value>")
+	}
+	return b.ReplaceNode(oldID, newID)
+}
+
+// CLICorrelate declares or, with uncorrelate, removes tier correlations in the
+// builder; see the output of CLIHelp for detailed information.
+func CLICorrelate(b *Builder, args []string, uncorrelate bool, output io.Writer) error {
+	if uncorrelate && len(args) != 2 {
+		return fmt.Errorf("syntax: <level> <value>")
+	}
+	if !uncorrelate && len(args) < 3 {
+		return fmt.Errorf("syntax: <level> <value> <value> ...")
+	}
+	level, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("could not parse %#v: %s", args[0], err.Error())
+	}
+	if uncorrelate {
+		b.UncorrelateTier(level, args[1])
+		return nil
+	}
+	return b.CorrelateTiers(level, args[1:])
+}
+
+// CLIAffinity declares or, with unaffinity, removes partition affinity groups
+// in the builder; see the output of CLIHelp for detailed information.
+func CLIAffinity(b *Builder, args []string, unaffinity bool, output io.Writer) error {
+	if unaffinity {
+		if len(args) != 1 {
+			return fmt.Errorf("syntax: <name>")
+		}
+		b.RemoveAffinityGroup(args[0])
+		return nil
+	}
+	if len(args) < 3 || (args[1] != "colocate" && args[1] != "spread") {
+		return fmt.Errorf("syntax: <name> colocate|spread <partition> ...")
+	}
+	partitions := make([]Partition, len(args)-2)
+	for i, arg := range args[2:] {
+		partition, err := strconv.ParseUint(arg, 10, 32)
+		if err != nil {
+			return fmt.Errorf("could not parse %#v: %s", arg, err.Error())
+		}
+		partitions[i] = Partition(partition)
+	}
+	return b.SetAffinityGroup(args[0], partitions, args[1] == "colocate")
+}
+
+// CLIPartitionMode sets the mode of partitions in the builder; see the output
+// of CLIHelp for detailed information.
+func CLIPartitionMode(b *Builder, args []string, output io.Writer) error {
+	if len(args) < 2 {
+		return fmt.Errorf("syntax: read-write|read-only|quiesced <partition> ...")
+	}
+	var mode PartitionMode
+	switch args[0] {
+	case "read-write":
+		mode = PartitionReadWrite
+	case "read-only":
+		mode = PartitionReadOnly
+	case "quiesced":
+		mode = PartitionQuiesced
+	default:
+		return fmt.Errorf("unknown partition mode %#v; use read-write, read-only, or quiesced", args[0])
+	}
+	for _, arg := range args[1:] {
+		partition, err := strconv.ParseUint(arg, 10, 32)
+		if err != nil {
+			return fmt.Errorf("could not parse %#v: %s", arg, err.Error())
+		}
+		if err = b.SetPartitionMode(Partition(partition), mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CLIScheduleCapacity schedules or, with unschedule, cancels a node's
+// capacity ramp in the builder; see the output of CLIHelp for detailed
+// information.
+func CLIScheduleCapacity(b *Builder, args []string, unschedule bool, output io.Writer) error {
+	values := map[string]string{}
+	for _, arg := range args {
+		sarg := strings.SplitN(arg, "=", 2)
+		if len(sarg) != 2 {
+			return fmt.Errorf("invalid argument %#v; use <name>=<value>", arg)
+		}
+		values[sarg[0]] = sarg[1]
+	}
+	id, err := strconv.ParseUint(values["id"], 10, 64)
+	if err != nil {
+		return fmt.Errorf("must specify node with id=<value>")
+	}
+	n := b.Node(id)
+	if n == nil {
+		return fmt.Errorf("no node %d", id)
+	}
+	if unschedule {
+		b.CancelCapacitySchedule(id)
+		return nil
+	}
+	s := CapacitySchedule{NodeID: id, Start: time.Now()}
+	if s.From, err = cliScheduledCapacity(n, values["from"]); err != nil {
+		return err
+	}
+	if s.To, err = cliScheduledCapacity(n, values["to"]); err != nil {
+		return err
+	}
+	over := values["over"]
+	if strings.HasSuffix(over, "d") {
+		var days int
+		if days, err = strconv.Atoi(strings.TrimSuffix(over, "d")); err == nil {
+			s.Duration = time.Duration(days) * 24 * time.Hour
+		}
+	} else {
+		s.Duration, err = time.ParseDuration(over)
+	}
+	if err != nil || over == "" {
+		return fmt.Errorf("invalid duration %#v; use over=<duration> such as 90m, 12h, or 7d", over)
+	}
+	return b.ScheduleCapacity(s)
+}
+
+// cliScheduledCapacity parses a capacity or a percentage of the node's
+// current capacity.
+func cliScheduledCapacity(n BuilderNode, value string) (uint64, error) {
+	if strings.HasSuffix(value, "%") {
+		percent, err := strconv.ParseUint(strings.TrimSuffix(value, "%"), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("could not parse %#v: %s", value, err.Error())
+		}
+		if percent > 100 {
+			return 0, fmt.Errorf("%#v is over 100%%; use a capacity instead", value)
+		}
+		return scaleCapacity(n.Capacity(), percent, 100), nil
+	}
+	capacity, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse %#v: %s", value, err.Error())
+	}
+	return capacity, nil
+}
+
+// CLIRegionTargets sets or clears the region targets of the builder; see the
+// output of CLIHelp for detailed information.
+func CLIRegionTargets(b *Builder, args []string, output io.Writer) error {
+	if len(args) == 1 && args[0] == "off" {
+		return b.SetRegionTargets(0, nil)
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("syntax: <level> <region>=<count> ... or off")
+	}
+	level, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("could not parse %#v: %s", args[0], err.Error())
+	}
+	targets := make(map[string]int, len(args)-1)
+	for _, arg := range args[1:] {
+		sarg := strings.SplitN(arg, "=", 2)
+		if len(sarg) != 2 {
+			return fmt.Errorf(`invalid region target %#v; use <region>=<count>`, arg)
+		}
+		count, err := strconv.Atoi(sarg[1])
+		if err != nil {
+			return fmt.Errorf("could not parse %#v: %s", arg, err.Error())
+		}
+		targets[sarg[0]] = count
+	}
+	return b.SetRegionTargets(level, targets)
+}
+
+// cliRegionTargets formats the region targets for the report, such as
+// "level 2: east=2,west=1".
+func cliRegionTargets(b *Builder) string {
+	level, targets := b.RegionTargets()
+	if len(targets) == 0 {
+		return "off"
+	}
+	regions := make([]string, 0, len(targets))
+	for region := range targets {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	for i, region := range regions {
+		regions[i] = fmt.Sprintf("%s=%d", region, targets[region])
+	}
+	return fmt.Sprintf("level %d: %s", level, strings.Join(regions, ","))
+}
+
+// cliDispersionViolations gives the BuilderStats.DispersionViolations as the
+// node count followed by each tier level's, such as "node 0, tier0 3".
+func cliDispersionViolations(violations []int) string {
+	parts := make([]string, len(violations))
+	for i, count := range violations {
+		if i == 0 {
+			parts[i] = fmt.Sprintf("node %d", count)
+		} else {
+			parts[i] = fmt.Sprintf("tier%d %d", i-1, count)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func cliDrains(drains []*NodeDrain) string {
+	initial := 0
+	remaining := 0
+	for _, d := range drains {
+		initial += d.Initial
+		remaining += d.Remaining
+	}
+	if initial == 0 || remaining > initial {
+		return fmt.Sprintf("%d", len(drains))
+	}
+	return fmt.Sprintf("%d (%.02f%% moved)", len(drains), float64(initial-remaining)*100/float64(initial))
+}
+
 // CLIRing writes a new ring file based on the builder; see the output of
 // CLIHelp for detailed information.
 //
 // Provide either the ring or the builder, but not both; set the other to nil.
 // Normally the results from RingOrBuilder.
 func CLIRing(b *Builder, filename string, output io.Writer) error {
-	r := b.Ring()
+	if _, err := b.ApplyCapacitySchedules(time.Now()); err != nil {
+		return err
+	}
+	r, strictErr := b.StrictRing()
 	if err := PersistRingOrBuilder(nil, b, filename); err != nil {
 		return err
 	}
+	if rr := b.LastRebalanceReport(); rr != nil && !rr.WithinPointsAllowed {
+		fmt.Fprintf(output, "Ring is outside the %d%% points allowed: max under %.02f%%, max over %.02f%%", b.PointsAllowed(), rr.MaxUnderNodePercentage, rr.MaxOverNodePercentage)
+		if rr.WaitBlocked > 0 {
+			fmt.Fprintf(output, "; %d replica moves waiting on move-wait", rr.WaitBlocked)
+		}
+		if rr.Skipped {
+			fmt.Fprintf(output, "; rebalance skipped by rebalance-trigger")
+		}
+		if rr.PartitionBitCountCapped {
+			fmt.Fprintf(output, "; partition bits at max-partition-bits")
+		}
+		fmt.Fprintln(output)
+	}
+	if rr := b.LastRebalanceReport(); rr != nil && rr.RegionTargetShortfalls > 0 {
+		fmt.Fprintf(output, "%d partitions fall short of the region targets\n", rr.RegionTargetShortfalls)
+	}
+	if strictErr != nil {
+		return strictErr
+	}
 	return PersistRingOrBuilder(r, nil, strings.TrimSuffix(filename, ".builder")+".ring")
 }
 
@@ -838,6 +1594,209 @@ func CLIPretendElapsed(b *Builder, args []string, output io.Writer) error {
 	return nil
 }
 
+// CLIGC removes departed nodes and unused tier values from the builder; see
+// the output of CLIHelp for detailed information.
+func CLIGC(b *Builder, args []string, output io.Writer) error {
+	retention := int(b.MoveWait())
+	if len(args) > 1 {
+		return fmt.Errorf("syntax: [retention-minutes]")
+	}
+	if len(args) == 1 {
+		var err error
+		if retention, err = strconv.Atoi(args[0]); err != nil {
+			return fmt.Errorf("could not parse %#v: %s", args[0], err.Error())
+		}
+		if retention < 0 || retention > math.MaxUint16 {
+			return fmt.Errorf("retention must be in the range 0-%d; %d was given", math.MaxUint16, retention)
+		}
+	}
+	fmt.Fprintf(output, "%d departed nodes removed\n", b.GC(uint16(retention)))
+	return nil
+}
+
+// CLITokens outputs the ring's layout as a JSON token map; see the output of
+// CLIHelp for detailed information.
+//
+// Provide either the ring or the builder, but not both; set the other to nil.
+// Normally the results from RingOrBuilder.
+func CLITokens(r Ring, b *Builder, args []string, output io.Writer) error {
+	if b != nil {
+		return fmt.Errorf("cannot use tokens command with a builder; generate a ring and use it on that")
+	}
+	addressIndex := 0
+	if len(args) > 1 {
+		return fmt.Errorf("syntax: [address-index]")
+	}
+	if len(args) == 1 {
+		var err error
+		if addressIndex, err = strconv.Atoi(args[0]); err != nil {
+			return fmt.Errorf("could not parse %#v: %s", args[0], err.Error())
+		}
+	}
+	return ExportTokenMap(output, r, addressIndex)
+}
+
+// CLIDiagnose checks the connectivity to every other node in the ring; see the
+// output of CLIHelp for detailed information.
+//
+// Provide either the ring or the builder, but not both; set the other to nil.
+// Normally the results from RingOrBuilder.
+func CLIDiagnose(r Ring, b *Builder, args []string, output io.Writer) error {
+	if b != nil {
+		return fmt.Errorf("cannot use diagnose command with a builder; generate a ring and use it on that")
+	}
+	cfg := &TCPMsgRingConfig{}
+	var localID uint64
+	timeout := 10
+	for _, arg := range args {
+		sarg := strings.SplitN(arg, "=", 2)
+		if len(sarg) != 2 {
+			return fmt.Errorf(`invalid expression %#v; needs "="`, arg)
+		}
+		var err error
+		switch sarg[0] {
+		case "local":
+			if localID, err = strconv.ParseUint(sarg[1], 10, 64); err != nil {
+				return fmt.Errorf("invalid id %#v", sarg[1])
+			}
+		case "address-index":
+			if cfg.AddressIndex, err = strconv.Atoi(sarg[1]); err != nil {
+				return fmt.Errorf("could not parse %#v: %s", sarg[1], err.Error())
+			}
+		case "address-role":
+			cfg.AddressRole = sarg[1]
+		case "timeout":
+			if timeout, err = strconv.Atoi(sarg[1]); err != nil {
+				return fmt.Errorf("could not parse %#v: %s", sarg[1], err.Error())
+			}
+			if timeout < 1 {
+				return fmt.Errorf("timeout must be at least 1 second")
+			}
+		case "tls", "skip-verify":
+			var v bool
+			if v, err = strconv.ParseBool(sarg[1]); err != nil {
+				return fmt.Errorf("could not parse %#v: %s", sarg[1], err.Error())
+			}
+			if sarg[0] == "tls" {
+				cfg.UseTLS = v
+			} else {
+				cfg.SkipVerify = v
+			}
+		case "cert-file":
+			cfg.CertFile = sarg[1]
+		case "key-file":
+			cfg.KeyFile = sarg[1]
+		case "ca-file":
+			cfg.CAFile = sarg[1]
+		default:
+			return fmt.Errorf("unknown option %#v", sarg[0])
+		}
+	}
+	if localID == 0 {
+		return fmt.Errorf("must specify the local node with local=<id>")
+	}
+	if r.Node(localID) == nil {
+		return fmt.Errorf("no node with id %d", localID)
+	}
+	r.SetLocalNode(localID)
+	msgRing, err := NewTCPMsgRing(cfg)
+	if err != nil {
+		return err
+	}
+	msgRing.SetRing(r)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	diagnoses := msgRing.Diagnose(ctx)
+	cancel()
+	msgRing.Shutdown()
+	report := [][]string{
+		[]string{"Node", "Address", "Connect", "TLS", "RTT", "Skew", "Version", "Result"},
+	}
+	reportOpts := brimtext.NewDefaultAlignOptions()
+	reportOpts.Alignments = []brimtext.Alignment{brimtext.Right, brimtext.Left, brimtext.Right, brimtext.Left, brimtext.Right, brimtext.Right, brimtext.Left, brimtext.Left}
+	problems := 0
+	for _, d := range diagnoses {
+		row := []string{fmt.Sprintf("%d", d.NodeID), d.Addr, "-", "-", "-", "-", "-", "ok"}
+		if d.Reachable {
+			row[2] = d.ConnectTime.String()
+		}
+		if !d.TLS {
+			row[3] = "off"
+		} else if d.TLSVersion != 0 {
+			row[3] = tlsVersionName(d.TLSVersion)
+		}
+		if d.Handshaked {
+			row[4] = d.RTT.String()
+			row[5] = d.ClockSkew.String()
+		}
+		if d.VersionMatch {
+			row[6] = "match"
+		} else if d.RemoteVersion != "" {
+			row[6] = fmt.Sprintf("%q", d.RemoteVersion)
+		}
+		if d.Err != nil {
+			row[7] = d.Err.Error()
+			problems++
+		}
+		report = append(report, row)
+	}
+	fmt.Fprint(output, brimtext.Align(report, reportOpts))
+	fmt.Fprintf(output, "%d of %d nodes ok\n", len(diagnoses)-problems, len(diagnoses))
+	return nil
+}
+
+// CLIHealth outputs the ring's health report, returning an error if the ring
+// is not safe to publish; see the output of CLIHelp for detailed information.
+//
+// Provide either the ring or the builder, but not both; set the other to nil.
+// Normally the results from RingOrBuilder.
+func CLIHealth(r Ring, b *Builder, args []string, output io.Writer) error {
+	if b != nil {
+		return fmt.Errorf("cannot use health command with a builder; generate a ring and use it on that")
+	}
+	cfg := &RingHealthConfig{}
+	for _, arg := range args {
+		sarg := strings.SplitN(arg, "=", 2)
+		if len(sarg) != 2 {
+			return fmt.Errorf(`invalid expression %#v; needs "="`, arg)
+		}
+		var v *int
+		switch sarg[0] {
+		case "max-imbalance":
+			v = &cfg.MaxImbalance
+		case "dispersion":
+			v = &cfg.Dispersion
+		case "max-undispersed":
+			v = &cfg.MaxUndispersed
+		case "max-unassigned":
+			v = &cfg.MaxUnassigned
+		case "max-inactive-exposure":
+			v = &cfg.MaxInactiveExposure
+		default:
+			return fmt.Errorf("unknown option %#v", sarg[0])
+		}
+		var err error
+		if *v, err = strconv.Atoi(sarg[1]); err != nil {
+			return fmt.Errorf("could not parse %#v: %s", sarg[1], err.Error())
+		}
+	}
+	h := RingHealth(r, cfg)
+	report := [][]string{
+		[]string{fmt.Sprintf("%.02f", h.Score), "Score"},
+		[]string{fmt.Sprintf("%.02f%%", h.Imbalance), "Imbalance"},
+		[]string{fmt.Sprintf("%s (%.02f%%)", brimtext.ThousandsSep(int64(h.UndispersedPartitions), ","), h.UndispersedPercentage), "Undispersed Partitions"},
+		[]string{brimtext.ThousandsSep(int64(h.UnassignedReplicas), ","), "Unassigned Replicas"},
+		[]string{fmt.Sprintf("%s (%.02f%%)", brimtext.ThousandsSep(int64(h.InactiveReplicas), ","), h.InactivePercentage), "Replicas On Inactive Nodes"},
+	}
+	reportOpts := brimtext.NewDefaultAlignOptions()
+	reportOpts.Alignments = []brimtext.Alignment{brimtext.Right, brimtext.Left}
+	fmt.Fprint(output, brimtext.Align(report, reportOpts))
+	if !h.Safe {
+		return fmt.Errorf("not safe to publish: %s", strings.Join(h.Problems, "; "))
+	}
+	fmt.Fprintf(output, "safe to publish\n")
+	return nil
+}
+
 // CLIConfig displays or sets the top-level config in the ring or builder; see
 // the output of CLIHelp for detailed information.
 //
@@ -904,6 +1863,7 @@ func CLINodeReport(n Node) string {
 		[]string{"Tiers:", strings.Join(qStrings(n.Tiers()), "\n")},
 		[]string{"Addresses:", strings.Join(qStrings(n.Addresses()), "\n")},
 		[]string{"Meta:", fmt.Sprintf("%q", n.Meta())},
+		[]string{"Network Zone:", fmt.Sprintf("%q", n.NetworkZone())},
 		[]string{"Config:", fmt.Sprintf("%q", string(n.Config()))},
 	}
 	return brimtext.Align(report, nil)
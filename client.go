@@ -0,0 +1,160 @@
+package ring
+
+import (
+	"sync"
+	"time"
+)
+
+// ClientConfig represents the set of values for configuring a Client.
+type ClientConfig struct {
+	// Ring is the Ring to use; it may be changed later with Client.SetRing.
+	Ring Ring
+	// MsgRing, if set, will be used for its Ring instead of the Ring above,
+	// so the Client always uses the MsgRing's latest ring.
+	MsgRing MsgRing
+	// Hash, if set, will be used to hash keys instead of the Ring's
+	// KeyHasher; see Ring.PartitionForKey.
+	Hash KeyHasher
+	// FailureTimeout indicates how many seconds a node is considered failed
+	// after a call to Client.Failed. Defaults to 30 seconds.
+	FailureTimeout int
+}
+
+func resolveClientConfig(c *ClientConfig) *ClientConfig {
+	cfg := &ClientConfig{}
+	if c != nil {
+		*cfg = *c
+	}
+	if cfg.FailureTimeout < 1 {
+		cfg.FailureTimeout = 30
+	}
+	return cfg
+}
+
+// Client is the thin layer front-end proxies and similar need over a Ring:
+// mapping keys to the nodes responsible for them, while steering away from
+// nodes that have recently failed requests.
+//
+// A quick example:
+//
+//	c := ring.NewClient(&ring.ClientConfig{MsgRing: msgRing})
+//	for _, n := range c.ForKey(key) {
+//		if err := get(n, key); err != nil {
+//			c.Failed(n.ID())
+//			continue
+//		}
+//		c.Succeeded(n.ID())
+//		break
+//	}
+type Client struct {
+	msgRing        MsgRing
+	hash           KeyHasher
+	failureTimeout time.Duration
+	lock           sync.RWMutex
+	ring           Ring
+	failures       map[uint64]time.Time
+	now            func() time.Time
+}
+
+// NewClient creates a Client based on the configuration given.
+func NewClient(c *ClientConfig) *Client {
+	cfg := resolveClientConfig(c)
+	return &Client{
+		msgRing:        cfg.MsgRing,
+		hash:           cfg.Hash,
+		failureTimeout: time.Duration(cfg.FailureTimeout) * time.Second,
+		ring:           cfg.Ring,
+		failures:       make(map[uint64]time.Time),
+		now:            time.Now,
+	}
+}
+
+// Ring returns the Ring in use, which may be nil if no Ring is yet
+// available.
+func (c *Client) Ring() Ring {
+	if c.msgRing != nil {
+		return c.msgRing.Ring()
+	}
+	c.lock.RLock()
+	r := c.ring
+	c.lock.RUnlock()
+	return r
+}
+
+// SetRing changes the Ring in use; it has no effect if the Client was
+// configured with a MsgRing.
+func (c *Client) SetRing(r Ring) {
+	c.lock.Lock()
+	c.ring = r
+	c.lock.Unlock()
+}
+
+// Partition returns the partition for the key in the Ring given.
+func (c *Client) Partition(r Ring, key []byte) Partition {
+	if c.hash == nil {
+		return r.PartitionForKey(key)
+	}
+	return PartitionFromKey(c.hash(key), r.PartitionBitCount())
+}
+
+// ForKey returns the candidate nodes for the key in order of preference: the
+// responsible nodes in replica order, except that nodes that have failed
+// within the failure timeout are moved to the end, so they are only tried
+// once the others have been. It returns nil if no Ring is yet available.
+func (c *Client) ForKey(key []byte) NodeSlice {
+	r := c.Ring()
+	if r == nil {
+		return nil
+	}
+	nodes := r.ResponsibleNodes(c.Partition(r, key))
+	candidates := make(NodeSlice, 0, len(nodes))
+	var failed NodeSlice
+	now := c.now()
+	c.lock.RLock()
+	for _, n := range nodes {
+		if at, ok := c.failures[n.ID()]; ok && now.Sub(at) < c.failureTimeout {
+			failed = append(failed, n)
+		} else {
+			candidates = append(candidates, n)
+		}
+	}
+	c.lock.RUnlock()
+	return append(candidates, failed...)
+}
+
+// Failed records a failed request to the node, so ForKey will prefer other
+// nodes until the failure timeout has passed.
+func (c *Client) Failed(nodeID uint64) {
+	c.lock.Lock()
+	c.failures[nodeID] = c.now()
+	c.lock.Unlock()
+}
+
+// Succeeded records a successful request to the node, clearing any recorded
+// failure.
+func (c *Client) Succeeded(nodeID uint64) {
+	c.lock.RLock()
+	_, ok := c.failures[nodeID]
+	c.lock.RUnlock()
+	if ok {
+		c.lock.Lock()
+		delete(c.failures, nodeID)
+		c.lock.Unlock()
+	}
+}
+
+// FailedNodes returns the IDs of the nodes currently considered failed.
+func (c *Client) FailedNodes() []uint64 {
+	var ids []uint64
+	now := c.now()
+	c.lock.Lock()
+	for id, at := range c.failures {
+		if now.Sub(at) < c.failureTimeout {
+			ids = append(ids, id)
+		} else {
+			delete(c.failures, id)
+		}
+	}
+	c.lock.Unlock()
+	return ids
+}
@@ -0,0 +1,54 @@
+package ring
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClientForKey(t *testing.T) {
+	c := NewClient(nil)
+	if nodes := c.ForKey([]byte("key")); nodes != nil {
+		t.Fatalf("%v", nodes)
+	}
+	b := NewBuilder(64)
+	b.SetReplicaCount(3)
+	for i := 0; i < 4; i++ {
+		if _, err := b.AddNode(true, 1, nil, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := b.Ring()
+	c.SetRing(r)
+	key := []byte("key")
+	expected := r.ResponsibleNodes(c.Partition(r, key))
+	nodes := c.ForKey(key)
+	if len(nodes) != 3 {
+		t.Fatalf("%d != 3", len(nodes))
+	}
+	for i, n := range nodes {
+		if n.ID() != expected[i].ID() {
+			t.Fatalf("%d: %d != %d", i, n.ID(), expected[i].ID())
+		}
+	}
+	c.Failed(expected[0].ID())
+	nodes = c.ForKey(key)
+	if nodes[0].ID() != expected[1].ID() || nodes[2].ID() != expected[0].ID() {
+		t.Fatalf("%v", nodes)
+	}
+	if ids := c.FailedNodes(); len(ids) != 1 || ids[0] != expected[0].ID() {
+		t.Fatalf("%v", ids)
+	}
+	c.now = func() time.Time { return time.Now().Add(time.Minute) }
+	if nodes = c.ForKey(key); nodes[0].ID() != expected[0].ID() {
+		t.Fatalf("%v", nodes)
+	}
+	if ids := c.FailedNodes(); len(ids) != 0 {
+		t.Fatalf("%v", ids)
+	}
+	c.now = time.Now
+	c.Failed(expected[1].ID())
+	c.Succeeded(expected[1].ID())
+	if nodes = c.ForKey(key); nodes[1].ID() != expected[1].ID() {
+		t.Fatalf("%v", nodes)
+	}
+}
@@ -0,0 +1,30 @@
+package ring
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// clockSkew estimates how far ahead of the local clock a peer's clock is,
+// given when the local time was sent and the peer's time received during a
+// handshake and the peer's time in nanoseconds. The two ends send their times
+// at about the same moment, so the peer's time is compared to the midpoint of
+// the exchange, which cancels out symmetric network delay.
+func clockSkew(sent time.Time, received time.Time, remoteUnixNano int64) time.Duration {
+	midpoint := sent.Add(received.Sub(sent) / 2)
+	return time.Unix(0, remoteUnixNano).Sub(midpoint)
+}
+
+// observeClockSkew records the clock skew estimated for the peer at the
+// address, reporting it if it exceeds the ClockSkewThreshold.
+func (t *TCPMsgRing) observeClockSkew(addr string, skew time.Duration) {
+	t.peerCache.setClockSkew(addr, skew)
+	if skew <= t.clockSkewThreshold && skew >= -t.clockSkewThreshold {
+		return
+	}
+	atomic.AddInt32(&t.clockSkews, 1)
+	t.logDebug("handshake: %s clock skew %s\n", addr, skew)
+	if t.clockSkewed != nil {
+		t.clockSkewed(addr, skew)
+	}
+}
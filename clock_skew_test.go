@@ -0,0 +1,50 @@
+package ring
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClockSkew(t *testing.T) {
+	sent := time.Unix(1000, 0)
+	received := sent.Add(100 * time.Millisecond)
+	if skew := clockSkew(sent, received, sent.Add(50*time.Millisecond).UnixNano()); skew != 0 {
+		t.Fatal(skew)
+	}
+	if skew := clockSkew(sent, received, sent.Add(2*time.Second).UnixNano()); skew != 1950*time.Millisecond {
+		t.Fatal(skew)
+	}
+	if skew := clockSkew(sent, received, sent.Add(-time.Second).UnixNano()); skew != -1050*time.Millisecond {
+		t.Fatal(skew)
+	}
+}
+
+func TestTCPMsgRingObserveClockSkew(t *testing.T) {
+	var skewedAddr string
+	var skewed time.Duration
+	msgring, _ := NewTCPMsgRing(&TCPMsgRingConfig{
+		ClockSkewThreshold: 500,
+		ClockSkewed: func(addr string, skew time.Duration) {
+			skewedAddr = addr
+			skewed = skew
+		},
+	})
+	msgring.peerCache.record("127.0.0.1:9999", 1, string(TCP_MSG_RING_VERSION), time.Now())
+	msgring.observeClockSkew("127.0.0.1:9999", 400*time.Millisecond)
+	if skewedAddr != "" {
+		t.Fatal(skewedAddr)
+	}
+	if peer, _ := msgring.Peer("127.0.0.1:9999"); peer.ClockSkew != 400*time.Millisecond {
+		t.Fatal(peer.ClockSkew)
+	}
+	msgring.observeClockSkew("127.0.0.1:9999", -600*time.Millisecond)
+	if skewedAddr != "127.0.0.1:9999" || skewed != -600*time.Millisecond {
+		t.Fatal(skewedAddr, skewed)
+	}
+	if peer, _ := msgring.Peer("127.0.0.1:9999"); peer.ClockSkew != -600*time.Millisecond {
+		t.Fatal(peer.ClockSkew)
+	}
+	if stats := msgring.Stats(false); stats.ClockSkews != 1 {
+		t.Fatal(stats.ClockSkews)
+	}
+}
@@ -0,0 +1,287 @@
+package ring
+
+import (
+	"expvar"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DebugHTTPHandlerConfig represents the set of values for configuring a
+// DebugHTTPHandler. Each of Ring, Builder, MsgRing, and FlapDamper is
+// optional; the handler exposes whichever are given.
+type DebugHTTPHandlerConfig struct {
+	// Authorize, if set, will be called for every request; if it returns
+	// false the request will be rejected with http.StatusUnauthorized.
+	// Defaults to allowing all requests, so be careful where the handler is
+	// exposed, as with net/http/pprof.
+	Authorize func(req *http.Request) bool
+	// Ring, if set, returns the current Ring, or nil if there is none yet.
+	// Defaults to the MsgRing's Ring, if the MsgRing is set.
+	Ring func() Ring
+	// Builder, if set, will be inspected while holding the BuilderLocker, if
+	// set; anything else using the Builder should hold it too.
+	Builder       *Builder
+	BuilderLocker sync.Locker
+	// MsgRing, if set, will have its peers and recent message errors
+	// exposed. Its Stats are not, as reading them resets the counters for
+	// whatever else is collecting them.
+	MsgRing *TCPMsgRing
+	// FlapDamper, if set, will have its nodes' scores exposed, showing which
+	// nodes it holds inactive for flapping; as with the MsgRing, its Stats
+	// are not.
+	FlapDamper *FlapDamper
+}
+
+// DebugHTTPHandler is a read-only http.Handler for inspecting a process's
+// ring state in production, in the manner of net/http/pprof; mount it into an
+// existing mux, such as with
+//
+//	mux.Handle("/debug/ring/", http.StripPrefix("/debug/ring", h))
+//
+// The routes all respond with JSON:
+//
+//	GET /         all of the below in one document, as DebugInfo
+//	GET /ring     the Ring's version, layout, and Stats, as DebugRing
+//	GET /nodes    the Ring's nodes as []BuilderHTTPNode
+//	GET /builder  the Builder's settings and stats, as DebugBuilder
+//	GET /peers    the MsgRing's peers, as []DebugPeer
+//	GET /errors   the MsgRing's recent message errors, as []DebugMsgError
+//	GET /flaps    the FlapDamper's node scores, as []FlapScore
+//
+// The same document as GET / is available as an expvar.Var with Expvar.
+type DebugHTTPHandler struct {
+	authorize     func(req *http.Request) bool
+	ring          func() Ring
+	builder       *Builder
+	builderLocker sync.Locker
+	msgRing       *TCPMsgRing
+	flapDamper    *FlapDamper
+}
+
+// NewDebugHTTPHandler creates a DebugHTTPHandler based on the configuration
+// given.
+func NewDebugHTTPHandler(c *DebugHTTPHandlerConfig) *DebugHTTPHandler {
+	cfg := &DebugHTTPHandlerConfig{}
+	if c != nil {
+		*cfg = *c
+	}
+	if cfg.Ring == nil && cfg.MsgRing != nil {
+		cfg.Ring = cfg.MsgRing.Ring
+	}
+	return &DebugHTTPHandler{
+		authorize:     cfg.Authorize,
+		ring:          cfg.Ring,
+		builder:       cfg.Builder,
+		builderLocker: cfg.BuilderLocker,
+		msgRing:       cfg.MsgRing,
+		flapDamper:    cfg.FlapDamper,
+	}
+}
+
+// DebugInfo is the JSON response to GET / of a DebugHTTPHandler; the
+// sections not configured are left out.
+type DebugInfo struct {
+	Ring    *DebugRing         `json:"ring,omitempty"`
+	Nodes   []*BuilderHTTPNode `json:"nodes,omitempty"`
+	Builder *DebugBuilder      `json:"builder,omitempty"`
+	Peers   []*DebugPeer       `json:"peers,omitempty"`
+	Errors  []*DebugMsgError   `json:"errors,omitempty"`
+	Flaps   []*FlapScore       `json:"flaps,omitempty"`
+}
+
+// DebugRing describes a Ring; see DebugHTTPHandler.
+type DebugRing struct {
+	Version           int64  `json:"version,string"`
+	PartitionBitCount uint16 `json:"partition_bit_count"`
+	ReplicaCount      int    `json:"replica_count"`
+	// LocalNodeID is the ID of the Ring's LocalNode, 0 if none.
+	LocalNodeID uint64 `json:"local_node_id,string"`
+	Stats       *Stats `json:"stats"`
+}
+
+// DebugBuilder describes a Builder; see DebugHTTPHandler.
+type DebugBuilder struct {
+	Generation          uint64           `json:"generation,string"`
+	ReplicaCount        int              `json:"replica_count"`
+	PointsAllowed       byte             `json:"points_allowed"`
+	MoveWait            uint16           `json:"move_wait"`
+	MaxMovePercentage   byte             `json:"max_move_percentage"`
+	RebalanceTrigger    string           `json:"rebalance_trigger"`
+	Stats               *BuilderStats    `json:"stats"`
+	LastRebalanceReport *RebalanceReport `json:"last_rebalance_report,omitempty"`
+}
+
+// DebugPeer describes a TCPMsgRing peer; see DebugHTTPHandler.
+type DebugPeer struct {
+	PeerInfo
+	Queued         int    `json:"queued"`
+	Connected      bool   `json:"connected"`
+	CircuitBreaker string `json:"circuit_breaker"`
+	Ready          bool   `json:"ready"`
+	// Latency is the peer's smoothed round trip time, 0 if not yet known.
+	Latency time.Duration `json:"latency"`
+}
+
+// DebugMsgError is a message to or from a peer that failed, as traced when
+// TCPMsgRingConfig.MsgTraceSize is set; see DebugHTTPHandler.
+type DebugMsgError struct {
+	Time    time.Time `json:"time"`
+	Addr    string    `json:"addr"`
+	Sent    bool      `json:"sent"`
+	MsgType uint64    `json:"msg_type,string"`
+	Length  uint64    `json:"length"`
+	Error   string    `json:"error"`
+}
+
+func (h *DebugHTTPHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if h.authorize != nil && !h.authorize(req) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if req.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	var v interface{}
+	switch strings.Trim(req.URL.Path, "/") {
+	case "":
+		v = h.Info()
+	case "ring":
+		v = h.debugRing()
+	case "nodes":
+		v = h.debugNodes()
+	case "builder":
+		v = h.debugBuilder()
+	case "peers":
+		v = h.debugPeers()
+	case "errors":
+		v = h.debugMsgErrors()
+	case "flaps":
+		v = h.debugFlaps()
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+// Info returns the document GET / responds with.
+func (h *DebugHTTPHandler) Info() *DebugInfo {
+	return &DebugInfo{
+		Ring:    h.debugRing(),
+		Nodes:   h.debugNodes(),
+		Builder: h.debugBuilder(),
+		Peers:   h.debugPeers(),
+		Errors:  h.debugMsgErrors(),
+		Flaps:   h.debugFlaps(),
+	}
+}
+
+// Expvar returns an expvar.Var giving the document GET / responds with, such
+// as for expvar.Publish("ring", h.Expvar()).
+func (h *DebugHTTPHandler) Expvar() expvar.Var {
+	return expvar.Func(func() interface{} { return h.Info() })
+}
+
+func (h *DebugHTTPHandler) currentRing() Ring {
+	if h.ring == nil {
+		return nil
+	}
+	return h.ring()
+}
+
+func (h *DebugHTTPHandler) debugRing() *DebugRing {
+	r := h.currentRing()
+	if r == nil {
+		return nil
+	}
+	d := &DebugRing{
+		Version:           r.Version(),
+		PartitionBitCount: r.PartitionBitCount(),
+		ReplicaCount:      r.ReplicaCount(),
+		Stats:             r.Stats(),
+	}
+	if n := r.LocalNode(); n != nil {
+		d.LocalNodeID = n.ID()
+	}
+	return d
+}
+
+func (h *DebugHTTPHandler) debugNodes() []*BuilderHTTPNode {
+	r := h.currentRing()
+	if r == nil {
+		return nil
+	}
+	nodes := r.Nodes()
+	rv := make([]*BuilderHTTPNode, len(nodes))
+	for i, n := range nodes {
+		rv[i] = newBuilderHTTPNode(n)
+	}
+	return rv
+}
+
+func (h *DebugHTTPHandler) debugBuilder() *DebugBuilder {
+	if h.builder == nil {
+		return nil
+	}
+	if h.builderLocker != nil {
+		h.builderLocker.Lock()
+		defer h.builderLocker.Unlock()
+	}
+	return &DebugBuilder{
+		Generation:          h.builder.Generation(),
+		ReplicaCount:        h.builder.ReplicaCount(),
+		PointsAllowed:       h.builder.PointsAllowed(),
+		MoveWait:            h.builder.MoveWait(),
+		MaxMovePercentage:   h.builder.MaxMovePercentage(),
+		RebalanceTrigger:    h.builder.RebalanceTrigger().String(),
+		Stats:               h.builder.Stats(),
+		LastRebalanceReport: h.builder.LastRebalanceReport(),
+	}
+}
+
+func (h *DebugHTTPHandler) debugPeers() []*DebugPeer {
+	if h.msgRing == nil {
+		return nil
+	}
+	peers := h.msgRing.Peers()
+	rv := make([]*DebugPeer, len(peers))
+	for i, p := range peers {
+		s := h.msgRing.SendState(p.Addr)
+		rv[i] = &DebugPeer{
+			PeerInfo:       p,
+			Queued:         s.Queued,
+			Connected:      s.Connected,
+			CircuitBreaker: s.CircuitBreaker.String(),
+			Ready:          s.Ready,
+		}
+		rv[i].Latency, _ = h.msgRing.Latency(p.Addr)
+	}
+	return rv
+}
+
+func (h *DebugHTTPHandler) debugMsgErrors() []*DebugMsgError {
+	if h.msgRing == nil || h.msgRing.msgTraces == nil {
+		return nil
+	}
+	var rv []*DebugMsgError
+	for _, addr := range h.msgRing.msgTraces.addrs() {
+		for _, e := range h.msgRing.msgTraces.get(addr) {
+			if e.Err != nil {
+				rv = append(rv, &DebugMsgError{Time: e.Time, Addr: e.Addr, Sent: e.Sent, MsgType: e.MsgType, Length: e.Length, Error: e.Err.Error()})
+			}
+		}
+	}
+	sort.SliceStable(rv, func(i, j int) bool { return rv[i].Time.Before(rv[j].Time) })
+	return rv
+}
+
+func (h *DebugHTTPHandler) debugFlaps() []*FlapScore {
+	if h.flapDamper == nil {
+		return nil
+	}
+	return h.flapDamper.Scores(time.Now())
+}
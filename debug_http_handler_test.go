@@ -0,0 +1,96 @@
+package ring
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDebugHTTPHandler(t *testing.T) {
+	b := NewBuilder(64)
+	n, err := b.AddNode(true, 1, nil, []string{"127.0.0.1:1"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := b.Ring()
+	r.SetLocalNode(n.ID())
+	msgRing, err := NewTCPMsgRing(&TCPMsgRingConfig{MsgTraceSize: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgRing.SetRing(r)
+	msgRing.peerCache.record("127.0.0.2:1", 2, string(TCP_MSG_RING_VERSION), time.Now())
+	msgRing.ObserveLatency("127.0.0.2:1", 3*time.Millisecond)
+	msgRing.msgTraces.add("127.0.0.2:1", true, 1, 10, time.Millisecond, nil)
+	msgRing.msgTraces.add("127.0.0.2:1", false, 1, 10, time.Millisecond, errors.New("handler failed"))
+	flapDamper := NewFlapDamper(b, nil)
+	if _, err = flapDamper.Report(n.ID(), true, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	h := NewDebugHTTPHandler(&DebugHTTPHandlerConfig{
+		Builder:       b,
+		BuilderLocker: &sync.Mutex{},
+		MsgRing:       msgRing,
+		FlapDamper:    flapDamper,
+	})
+	get := func(path string, v interface{}) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code == http.StatusOK && v != nil {
+			if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code
+	}
+	info := &DebugInfo{}
+	if code := get("/", info); code != http.StatusOK {
+		t.Fatal(code)
+	}
+	if info.Ring == nil || info.Ring.Version != r.Version() || info.Ring.LocalNodeID != n.ID() || info.Ring.Stats.ActiveNodeCount != 1 {
+		t.Fatalf("%#v", info.Ring)
+	}
+	if len(info.Nodes) != 1 || info.Nodes[0].ID != n.ID() {
+		t.Fatalf("%#v", info.Nodes)
+	}
+	if info.Builder == nil || info.Builder.Stats.NodeCount != 1 || info.Builder.LastRebalanceReport == nil {
+		t.Fatalf("%#v", info.Builder)
+	}
+	if len(info.Peers) != 1 || info.Peers[0].NodeID != 2 || info.Peers[0].CircuitBreaker != "closed" || info.Peers[0].Latency != 3*time.Millisecond {
+		t.Fatalf("%#v", info.Peers)
+	}
+	if len(info.Errors) != 1 || info.Errors[0].Error != "handler failed" || info.Errors[0].Sent {
+		t.Fatalf("%#v", info.Errors)
+	}
+	if len(info.Flaps) != 1 || info.Flaps[0].NodeID != n.ID() || !info.Flaps[0].Up || info.Flaps[0].Suppressed {
+		t.Fatalf("%#v", info.Flaps)
+	}
+	var peers []*DebugPeer
+	if code := get("/peers", &peers); code != http.StatusOK || len(peers) != 1 {
+		t.Fatal(code, peers)
+	}
+	if code := get("/nope", nil); code != http.StatusNotFound {
+		t.Fatal(code)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatal(w.Code)
+	}
+	var v expvar.Var = h.Expvar()
+	if s := v.String(); !strings.Contains(s, `"peers"`) {
+		t.Fatal(s)
+	}
+	// Without anything configured, there is nothing to show.
+	w = httptest.NewRecorder()
+	NewDebugHTTPHandler(nil).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "{}" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,147 @@
+package ring
+
+import "fmt"
+
+// DecommissionPolicy controls how Builder.Decommission retires a node.
+type DecommissionPolicy struct {
+	// MovesPerPass is the move budget for each rebalance pass, bounding the
+	// data movement of each new ring as with Builder.RingWithMoveBudget; 0
+	// does each pass as an unbudgeted Builder.Ring.
+	MovesPerPass int
+	// MaxPasses is the most rebalance passes to make; 0 makes passes until
+	// the node is drained or a pass moves nothing off it.
+	MaxPasses int
+	// KeepNode leaves the drained node in the Builder, still marked
+	// draining, rather than removing it with Builder.RemoveNode.
+	KeepNode bool
+	// Progress, if set, will be called after each pass.
+	Progress func(p *DecommissionProgress)
+}
+
+// DecommissionProgress describes a rebalance pass made by
+// Builder.Decommission.
+type DecommissionProgress struct {
+	NodeID uint64
+	Pass   int
+	// Transfers is the plan of data to copy for the pass: each partition
+	// replica moved off the node, with the node it moved to.
+	Transfers []*RebalanceEvent
+	// Remaining is how many partition replicas the node still holds.
+	Remaining int
+	// Ring is the ring made by the pass, to be distributed once its
+	// Transfers are done and before the next pass's are started.
+	Ring Ring
+}
+
+// DecommissionReport is the outcome of Builder.Decommission.
+type DecommissionReport struct {
+	NodeID    uint64
+	Passes    int
+	Moves     int
+	Remaining int
+	// Removed is true if the node was drained and removed from the Builder.
+	Removed bool
+	// Ring is the ring made by the last pass, or after the removal; nil if
+	// no pass was made.
+	Ring Ring
+}
+
+// Decommission retires the node from the Builder, sequencing what is
+// otherwise done by hand: it marks the node as draining (see
+// SetNodeDraining), so its replicas keep being served as they move, then
+// makes rebalance passes until the node holds no partition replicas,
+// reporting each pass's transfers to the policy's Progress, and finally
+// removes the node.
+//
+// Replicas are only moved as the MoveWait and MovesPerPartition allow, so a
+// pass may move nothing off the node; Decommission then stops, returning an
+// error along with the report, and may be called again once more time has
+// elapsed. Decommission also stops when the policy's MaxPasses are made.
+// Neither case clears the node's draining mark.
+func (b *Builder) Decommission(nodeID uint64, policy *DecommissionPolicy) (*DecommissionReport, error) {
+	p := &DecommissionPolicy{}
+	if policy != nil {
+		*p = *policy
+	}
+	var n *node
+	for _, bn := range b.nodes {
+		if bn.id == nodeID {
+			n = bn
+			break
+		}
+	}
+	if n == nil {
+		return nil, fmt.Errorf("no node with id %d", nodeID)
+	}
+	if n.inactive {
+		return nil, fmt.Errorf("node %d is inactive; decommissioning needs it active to serve its replicas while they move", nodeID)
+	}
+	if err := b.SetNodeDraining(nodeID, true); err != nil {
+		return nil, err
+	}
+	report := &DecommissionReport{NodeID: nodeID, Remaining: b.nodeAssignments(nodeID)}
+	listener := b.rebalanceListener
+	defer func() {
+		b.rebalanceListener = listener
+	}()
+	for report.Remaining > 0 {
+		if p.MaxPasses > 0 && report.Passes >= p.MaxPasses {
+			return report, fmt.Errorf("node %d still holds %d partition replicas after %d passes", nodeID, report.Remaining, report.Passes)
+		}
+		progress := &DecommissionProgress{NodeID: nodeID, Pass: report.Passes + 1}
+		b.rebalanceListener = func(e *RebalanceEvent) {
+			if e.FromNodeID == nodeID {
+				progress.Transfers = append(progress.Transfers, e)
+			}
+			if listener != nil {
+				listener(e)
+			}
+		}
+		if p.MovesPerPass > 0 {
+			progress.Ring = b.RingWithMoveBudget(p.MovesPerPass)
+		} else {
+			progress.Ring = b.Ring()
+		}
+		progress.Remaining = b.nodeAssignments(nodeID)
+		report.Passes++
+		report.Moves += len(progress.Transfers)
+		report.Remaining = progress.Remaining
+		report.Ring = progress.Ring
+		if p.Progress != nil {
+			p.Progress(progress)
+		}
+		if len(progress.Transfers) == 0 && report.Remaining > 0 {
+			return report, fmt.Errorf("node %d still holds %d partition replicas that could not yet be moved; see MoveWait", nodeID, report.Remaining)
+		}
+	}
+	if !p.KeepNode {
+		b.RemoveNode(nodeID)
+		report.Removed = true
+		report.Ring = b.Ring()
+	}
+	return report, nil
+}
+
+// nodeAssignments returns how many partition replicas are assigned to the
+// node.
+func (b *Builder) nodeAssignments(nodeID uint64) int {
+	nodeIndex := int32(-1)
+	for i, n := range b.nodes {
+		if n.id == nodeID {
+			nodeIndex = int32(i)
+			break
+		}
+	}
+	if nodeIndex < 0 {
+		return 0
+	}
+	count := 0
+	for _, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+		for _, ni := range partitionToNodeIndex {
+			if ni == nodeIndex {
+				count++
+			}
+		}
+	}
+	return count
+}
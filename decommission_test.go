@@ -0,0 +1,53 @@
+package ring
+
+import "testing"
+
+func TestBuilderDecommission(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetMaxPartitionBitCount(6)
+	b.SetMoveWait(0)
+	b.SetReplicaCount(2)
+	var ids []uint64
+	for i := 0; i < 4; i++ {
+		n, err := b.AddNode(true, 1, nil, nil, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, n.ID())
+	}
+	b.Ring()
+	held := b.nodeAssignments(ids[1])
+	var passes []*DecommissionProgress
+	report, err := b.Decommission(ids[1], &DecommissionPolicy{MovesPerPass: 5, Progress: func(p *DecommissionProgress) {
+		for _, e := range p.Transfers {
+			if e.FromNodeID != ids[1] || e.ToNodeID == ids[1] {
+				t.Fatalf("%#v", e)
+			}
+		}
+		passes = append(passes, p)
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Removed || report.Remaining != 0 || report.Moves < held || report.Passes != len(passes) || report.Passes < 2 {
+		t.Fatalf("%#v", report)
+	}
+	for _, p := range passes {
+		if len(p.Transfers) > 5 {
+			t.Fatal(p.Pass, len(p.Transfers))
+		}
+	}
+	if b.Node(ids[1]) != nil || report.Ring.Node(ids[1]) != nil {
+		t.Fatal("node not removed")
+	}
+	if _, err = b.Decommission(ids[1], nil); err == nil {
+		t.Fatal("expected error for a removed node")
+	}
+	// With a move wait the drain stalls once the movable replicas are moved.
+	b.SetMoveWait(60)
+	b.Ring()
+	report, err = b.Decommission(ids[2], &DecommissionPolicy{KeepNode: true})
+	if err == nil || report.Removed || b.Node(ids[2]) == nil || !b.NodeDraining(ids[2]) {
+		t.Fatalf("%#v %v", report, err)
+	}
+}
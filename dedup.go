@@ -0,0 +1,48 @@
+package ring
+
+import (
+	"sync"
+	"time"
+)
+
+type dedupKey struct {
+	msgType uint64
+	msgID   uint64
+}
+
+// dedupCache remembers message IDs received within a time window. The methods
+// take the current time as a parameter to ease testing.
+type dedupCache struct {
+	window    time.Duration
+	lock      sync.Mutex
+	received  map[dedupKey]time.Time
+	lastPrune time.Time
+}
+
+func newDedupCache(window time.Duration) *dedupCache {
+	return &dedupCache{window: window, received: make(map[dedupKey]time.Time)}
+}
+
+// seen returns true if the message was recorded within the window.
+func (d *dedupCache) seen(msgType uint64, msgID uint64, now time.Time) bool {
+	d.lock.Lock()
+	at, ok := d.received[dedupKey{msgType, msgID}]
+	d.lock.Unlock()
+	return ok && now.Sub(at) < d.window
+}
+
+// record notes the message as received, pruning expired entries at most once
+// per window.
+func (d *dedupCache) record(msgType uint64, msgID uint64, now time.Time) {
+	d.lock.Lock()
+	d.received[dedupKey{msgType, msgID}] = now
+	if now.Sub(d.lastPrune) >= d.window {
+		for key, at := range d.received {
+			if now.Sub(at) >= d.window {
+				delete(d.received, key)
+			}
+		}
+		d.lastPrune = now
+	}
+	d.lock.Unlock()
+}
@@ -0,0 +1,28 @@
+package ring
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDedupCache(t *testing.T) {
+	d := newDedupCache(time.Minute)
+	now := time.Now()
+	if d.seen(1, 100, now) {
+		t.Fatal("should not have been seen")
+	}
+	d.record(1, 100, now)
+	if !d.seen(1, 100, now.Add(time.Second)) {
+		t.Fatal("should have been seen")
+	}
+	if d.seen(2, 100, now.Add(time.Second)) {
+		t.Fatal("other message types should not be affected")
+	}
+	if d.seen(1, 100, now.Add(time.Minute)) {
+		t.Fatal("should have expired")
+	}
+	d.record(1, 101, now.Add(2*time.Minute))
+	if len(d.received) != 1 {
+		t.Fatalf("%d != 1", len(d.received))
+	}
+}
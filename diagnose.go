@@ -0,0 +1,157 @@
+package ring
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// NodeDiagnosis is what TCPMsgRing.Diagnose found when connecting to a node.
+type NodeDiagnosis struct {
+	NodeID uint64
+	Addr   string
+	// Reachable is true if a TCP connection to the Addr was established,
+	// taking ConnectTime.
+	Reachable   bool
+	ConnectTime time.Duration
+	// TLS is true if TLS is in use; once the TLS handshake completes, taking
+	// TLSHandshakeTime, the negotiated TLSVersion and TLSCipherSuite are set.
+	TLS              bool
+	TLSHandshakeTime time.Duration
+	TLSVersion       uint16
+	TLSCipherSuite   uint16
+	// Handshaked is true if the TCPMsgRing handshake completed with the node
+	// answering as itself. The handshake is a single exchange of protocol
+	// versions and node IDs, so RTT, how long it took, serves as a ping.
+	Handshaked bool
+	RTT        time.Duration
+	// RemoteVersion is the protocol version the node sent, if known, and
+	// VersionMatch is true if it is the local protocol version.
+	RemoteVersion string
+	VersionMatch  bool
+	// ClockSkew is how far ahead of the local clock the node's clock was
+	// estimated to be during the handshake; negative if behind.
+	ClockSkew time.Duration
+	// Err is the error that stopped the diagnosis, if any.
+	Err error
+}
+
+// Diagnose attempts a connection and handshake with every node in the ring,
+// other than the local node, concurrently, and reports what was found; it is
+// a one-shot cluster connectivity check. The connections are separate from
+// those used for messages, circuit breakers and chaos settings are ignored,
+// and each is closed once diagnosed. Canceling the ctx abandons any
+// diagnoses still in progress, reporting the ctx's error for them.
+func (t *TCPMsgRing) Diagnose(ctx context.Context) []*NodeDiagnosis {
+	ring, addressIndex := t.ringAndAddressIndex()
+	if ring == nil {
+		return nil
+	}
+	var localID uint64
+	if localNode := ring.LocalNode(); localNode != nil {
+		localID = localNode.ID()
+	}
+	var diagnoses []*NodeDiagnosis
+	for _, node := range ring.Nodes() {
+		if node.ID() != localID {
+			diagnoses = append(diagnoses, &NodeDiagnosis{NodeID: node.ID(), Addr: node.Address(addressIndex)})
+		}
+	}
+	wg := &sync.WaitGroup{}
+	wg.Add(len(diagnoses))
+	for _, d := range diagnoses {
+		go func(d *NodeDiagnosis) {
+			t.diagnose(ctx, d)
+			wg.Done()
+		}(d)
+	}
+	wg.Wait()
+	return diagnoses
+}
+
+func (t *TCPMsgRing) diagnose(ctx context.Context, d *NodeDiagnosis) {
+	if d.Addr == "" {
+		d.Err = fmt.Errorf("node %d has no address to use", d.NodeID)
+		return
+	}
+	dialer := &net.Dialer{Timeout: t.connectTimeoutFor(d.Addr)}
+	start := time.Now()
+	baseConn, err := dialer.DialContext(ctx, "tcp", d.Addr)
+	if err != nil {
+		d.Err = err
+		return
+	}
+	d.ConnectTime = time.Since(start)
+	d.Reachable = true
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		baseConn.Close()
+	}()
+	netConn := baseConn
+	if t.useTLS {
+		d.TLS = true
+		start = time.Now()
+		tlsConn, err := t.tlsClient(ctx, baseConn, d.Addr)
+		if err != nil {
+			d.Err = diagnoseErr(ctx, err)
+			return
+		}
+		d.TLSHandshakeTime = time.Since(start)
+		state := tlsConn.ConnectionState()
+		d.TLSVersion = state.Version
+		d.TLSCipherSuite = state.CipherSuite
+		netConn = tlsConn
+	}
+	start = time.Now()
+	addr, _, err := t.handshake(netConn)
+	if err != nil {
+		if v, ok := err.(protocolVersionError); ok {
+			d.RemoteVersion = string(v)
+		}
+		d.Err = diagnoseErr(ctx, err)
+		return
+	}
+	d.RTT = time.Since(start)
+	d.RemoteVersion = string(TCP_MSG_RING_VERSION)
+	d.VersionMatch = true
+	if addr != d.Addr {
+		d.Err = fmt.Errorf("answered as the node with address %s", addr)
+		return
+	}
+	d.Handshaked = true
+	if peer, ok := t.Peer(d.Addr); ok {
+		d.ClockSkew = peer.ClockSkew
+	}
+	t.latencies.observe(d.Addr, d.RTT)
+}
+
+// diagnoseErr returns the ctx's error if it is why the connection was closed,
+// otherwise the err given.
+func diagnoseErr(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
@@ -0,0 +1,91 @@
+package ring
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakePeer accepts one connection and answers the handshake with the version
+// and node ID given.
+func fakePeer(t *testing.T, version []byte, nodeID uint64) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// The version, node ID, and a handshake block of no feature flags, no
+		// time, and no max message length.
+		buf := make([]byte, len(version)+8+2+handshakeBlockLength)
+		copy(buf, version)
+		binary.BigEndian.PutUint64(buf[len(version):], nodeID)
+		binary.BigEndian.PutUint16(buf[len(version)+8:], handshakeBlockLength)
+		conn.Write(buf)
+		conn.Read(make([]byte, len(TCP_MSG_RING_VERSION)+8+2+handshakeBlockLength))
+	}()
+	return ln.Addr().String()
+}
+
+func TestTCPMsgRingDiagnose(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := ln.Addr().String()
+	ln.Close()
+	b := NewBuilder(64)
+	nA, err := b.AddNode(true, 1, nil, []string{"127.0.0.1:9999"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nB, err := b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nC, err := b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nD, err := b.AddNode(true, 1, nil, []string{closedAddr}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nB.SetAddress(0, fakePeer(t, TCP_MSG_RING_VERSION, nB.ID()))
+	nC.SetAddress(0, fakePeer(t, []byte("TCPMSGRINGv99999"), nC.ID()))
+	r := b.Ring()
+	r.SetLocalNode(nA.ID())
+	msgring, _ := NewTCPMsgRing(&TCPMsgRingConfig{WithinMessageTimeout: 2})
+	msgring.SetRing(r)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	diagnoses := msgring.Diagnose(ctx)
+	if len(diagnoses) != 3 {
+		t.Fatal(len(diagnoses))
+	}
+	for _, d := range diagnoses {
+		switch d.NodeID {
+		case nB.ID():
+			if d.Err != nil || !d.Reachable || !d.Handshaked || !d.VersionMatch || d.TLS {
+				t.Fatalf("%#v", d)
+			}
+		case nC.ID():
+			if d.Err == nil || !d.Reachable || d.Handshaked || d.VersionMatch || d.RemoteVersion != "TCPMSGRINGv99999" {
+				t.Fatalf("%#v", d)
+			}
+		case nD.ID():
+			if d.Err == nil || d.Reachable || d.Handshaked {
+				t.Fatalf("%#v", d)
+			}
+		default:
+			t.Fatal(d.NodeID)
+		}
+	}
+}
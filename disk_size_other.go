@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd
+
+package ring
+
+import "fmt"
+
+// DiskSize returns the total size in bytes of the file system holding the
+// path; it is not supported on this platform.
+func DiskSize(path string) (uint64, error) {
+	return 0, fmt.Errorf("disk size of %s: not supported on this platform", path)
+}
@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd
+
+package ring
+
+import "syscall"
+
+// DiskSize returns the total size in bytes of the file system holding the
+// path.
+func DiskSize(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Blocks) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,127 @@
+package ring
+
+// DryRunReport describes how a Builder's assignments stand against changed
+// placement constraints; see Builder.DryRun.
+type DryRunReport struct {
+	// DispersionViolations are the partitions whose current replicas do not
+	// meet the changed strict dispersion, in ascending order; see
+	// Builder.SetStrictDispersion.
+	DispersionViolations []Partition
+	// RegionTargetShortfalls are the partitions whose current replicas do
+	// not meet the changed region targets, in ascending order; see
+	// Builder.SetRegionTargets.
+	RegionTargetShortfalls []Partition
+	// MinMoves is the fewest partition replica moves that could satisfy the
+	// changed constraints: each partition needs at least as many moves as it
+	// has replicas sharing a node or tier beyond the first, and at least as
+	// many as it has replicas missing from regions short of their targets.
+	// The constraints may be impossible to satisfy at all, such as with too
+	// few nodes, in which case the rebalance will leave violations.
+	MinMoves int
+	// Moves is how many partition replicas the next rebalance would move
+	// with the changed constraints, and Rebalance the report of that
+	// rebalance; the move wait and any move limits may keep the rebalance
+	// from moving everything that needs moving.
+	Moves     int
+	Rebalance *RebalanceReport
+	// RemainingDispersionViolations and RemainingRegionTargetShortfalls are
+	// how many partitions would still violate the changed constraints after
+	// that rebalance.
+	RemainingDispersionViolations   int
+	RemainingRegionTargetShortfalls int
+}
+
+// DryRun reports the effect of changing the Builder's placement constraints,
+// such as its strict dispersion, tier correlations, or region targets,
+// without changing the Builder. The change func is given a copy of the
+// Builder to make the changes to, and the report describes that copy's
+// existing assignments and what rebalancing it would do; an error from the
+// change func is returned as is. As with Ring, the Builder must have an active
+// node.
+func (b *Builder) DryRun(change func(b *Builder) error) (*DryRunReport, error) {
+	c, err := b.deepCopy()
+	if err != nil {
+		return nil, err
+	}
+	if err = change(c); err != nil {
+		return nil, err
+	}
+	report := &DryRunReport{}
+	report.DispersionViolations, report.RegionTargetShortfalls, report.MinMoves = c.constraintViolations()
+	bits := c.partitionBitCount
+	before := make([][]int32, len(c.replicaToPartitionToNodeIndex))
+	for replica, partitionToNodeIndex := range c.replicaToPartitionToNodeIndex {
+		before[replica] = make([]int32, len(partitionToNodeIndex))
+		copy(before[replica], partitionToNodeIndex)
+	}
+	c.Ring()
+	report.Rebalance = c.LastRebalanceReport()
+	// The ring may have grown, splitting partitions without moving them.
+	shift := c.partitionBitCount - bits
+	for replica, partitionToNodeIndex := range c.replicaToPartitionToNodeIndex {
+		if replica >= len(before) {
+			break
+		}
+		for partition, nodeIndex := range partitionToNodeIndex {
+			if previous := before[replica][partition>>shift]; previous >= 0 && previous != nodeIndex {
+				report.Moves++
+			}
+		}
+	}
+	dispersion, region, _ := c.constraintViolations()
+	report.RemainingDispersionViolations = len(dispersion)
+	report.RemainingRegionTargetShortfalls = len(region)
+	return report, nil
+}
+
+// constraintViolations returns the partitions not meeting the strict
+// dispersion and those not meeting the region targets, and the fewest moves
+// that could satisfy both; see DryRunReport.
+func (b *Builder) constraintViolations() (dispersion []Partition, region []Partition, minMoves int) {
+	rb := newRebalancer(b)
+	tier := b.strictDispersion - 1
+	if tier > rb.maxTier {
+		tier = rb.maxTier
+	}
+	seen := make(map[interface{}]bool, rb.maxReplica+1)
+	for partition := 0; partition <= rb.maxPartition; partition++ {
+		dispersionMoves := 0
+		if b.strictDispersion >= 0 {
+			for key := range seen {
+				delete(seen, key)
+			}
+			for replica := 0; replica <= rb.maxReplica; replica++ {
+				nodeIndex := b.replicaToPartitionToNodeIndex[replica][partition]
+				if nodeIndex < 0 {
+					continue
+				}
+				var key interface{} = nodeIndex
+				if tier >= 0 {
+					key = rb.tierToNodeIndexToTierSep[tier][nodeIndex]
+				}
+				if seen[key] {
+					dispersionMoves++
+				}
+				seen[key] = true
+			}
+			if dispersionMoves > 0 {
+				dispersion = append(dispersion, Partition(partition))
+			}
+		}
+		regionMoves := 0
+		if rb.nodeIndexToRegion != nil && rb.regionShort(partition, -1) {
+			region = append(region, Partition(partition))
+			for i, target := range rb.regionTargets {
+				if rb.regionNeeded[i] {
+					regionMoves += target - rb.regionCounts[i]
+				}
+			}
+		}
+		if regionMoves > dispersionMoves {
+			minMoves += regionMoves
+		} else {
+			minMoves += dispersionMoves
+		}
+	}
+	return dispersion, region, minMoves
+}
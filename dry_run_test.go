@@ -0,0 +1,66 @@
+package ring
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestBuilderDryRun(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetReplicaCount(2)
+	for i := 0; i < 6; i++ {
+		if _, err := b.AddNode(true, 1, []string{fmt.Sprintf("server%d", i), fmt.Sprintf("zone%d", i%3)}, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Ring()
+	b.PretendElapsed(b.MoveWait() + 1)
+	before := make([][]int32, len(b.replicaToPartitionToNodeIndex))
+	for replica, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+		before[replica] = append([]int32(nil), partitionToNodeIndex...)
+	}
+	report, err := b.DryRun(func(c *Builder) error {
+		c.SetStrictDispersion(2)
+		return c.CorrelateTiers(1, []string{"zone0", "zone1"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.DispersionViolations) == 0 || report.MinMoves != len(report.DispersionViolations) || report.RegionTargetShortfalls != nil {
+		t.Fatalf("%#v", report)
+	}
+	// Every partition would need a replica in zone2, far more than its
+	// share, so violations remain.
+	if report.Moves == 0 || report.Rebalance == nil || report.RemainingDispersionViolations == 0 {
+		t.Fatalf("%#v", report)
+	}
+	// The Builder itself is left as it was, including its Generation, which
+	// PersistRingOrBuilder uses to detect conflicts.
+	if b.Generation() != 0 || b.StrictDispersion() != -1 || len(b.TierCorrelations()) != 0 || !reflect.DeepEqual(b.replicaToPartitionToNodeIndex, before) {
+		t.Fatal("dry run changed the builder")
+	}
+	report, err = b.DryRun(func(c *Builder) error {
+		return c.SetRegionTargets(1, map[string]int{"zone2": 1})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.RegionTargetShortfalls) == 0 || report.MinMoves != len(report.RegionTargetShortfalls) || report.DispersionViolations != nil || report.RemainingRegionTargetShortfalls != 0 {
+		t.Fatalf("%#v", report)
+	}
+	// A DryRun copy keeps the Generation, so a copy that was then persisted
+	// would not claim a persist the Builder never made.
+	c, err := b.deepCopy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Generation() != b.Generation() {
+		t.Fatalf("%d != %d", c.Generation(), b.Generation())
+	}
+	errBad := errors.New("bad change")
+	if _, err = b.DryRun(func(c *Builder) error { return errBad }); err != errBad {
+		t.Fatal(err)
+	}
+}
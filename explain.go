@@ -0,0 +1,183 @@
+package ring
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+)
+
+// Explanation describes why a partition replica is assigned where it is, as
+// returned by Builder.Explain.
+type Explanation struct {
+	Partition Partition
+	Replica   int
+	// NodeID is the node currently assigned; it will be 0 if the replica is
+	// not yet assigned.
+	NodeID     uint64
+	NodeActive bool
+	// NodeCapacity and TotalCapacity are the usable capacity of the node and
+	// of all active nodes, after any capacity reserves (see
+	// Builder.SetCapacityReserve) and with draining nodes counting as none;
+	// together they give the share of partition replicas the node desires,
+	// NodeDesired, compared with NodeAssigned, the replicas it currently has.
+	NodeCapacity  uint64
+	TotalCapacity uint64
+	NodeDesired   int
+	NodeAssigned  int
+	// MinutesSinceMove is how long ago this replica was last reassigned,
+	// math.MaxUint16 meaning never or long ago. A replica that moved within
+	// the MoveWait will not be moved again yet.
+	MinutesSinceMove uint16
+	MoveWait         uint16
+	// MovementsLeft is the number of replicas of the partition that may
+	// still be moved in a rebalance; a partition may only have some of its
+	// replicas in motion at once.
+	MovementsLeft int
+	// SameNodeReplica is another replica of the partition assigned to the
+	// same node, or -1 if there is none.
+	SameNodeReplica int
+	// SharedTierLevel is the lowest tier level from which the node has the
+	// same tier values as the node of another replica of the partition,
+	// meaning the replicas are not separated at that level and above; it is
+	// -1 if the replicas are separated at every level.
+	SharedTierLevel int
+	// AlternativeNodeID is the node the rebalancer would choose if this
+	// replica were to be reassigned now, 0 if there is none, and
+	// AlternativeDesire is how many more replicas that node desires.
+	AlternativeNodeID uint64
+	AlternativeDesire int
+	// Reasons gives human readable sentences summarizing the above.
+	Reasons []string
+}
+
+func (e *Explanation) String() string {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "partition %d replica %d", e.Partition, e.Replica)
+	if e.NodeID != 0 {
+		fmt.Fprintf(buf, " is assigned to node %d", e.NodeID)
+	}
+	buf.WriteString(":\n")
+	for _, reason := range e.Reasons {
+		fmt.Fprintf(buf, "  %s\n", reason)
+	}
+	return buf.String()
+}
+
+// Explain describes why the partition replica is assigned to its current
+// node, based on the Builder's current state: the node's capacity and how
+// many replicas it desires versus has, the move wait and movement budget
+// restrictions, the tier separation from the other replicas, and the node the
+// rebalancer would choose instead. This helps answer "why did my partition
+// end up on that node" questions after surprising rebalances.
+//
+// Note that the Builder does not keep a history of past rebalances, so the
+// explanation is of why the assignment stands now, which, with the
+// MinutesSinceMove, is usually enough to work out why it was made.
+func (b *Builder) Explain(partition Partition, replica int) (*Explanation, error) {
+	if replica < 0 || replica >= len(b.replicaToPartitionToNodeIndex) {
+		return nil, fmt.Errorf("replica %d out of range; replica count is %d", replica, len(b.replicaToPartitionToNodeIndex))
+	}
+	if int(partition) >= len(b.replicaToPartitionToNodeIndex[replica]) {
+		return nil, fmt.Errorf("partition %d out of range; partition count is %d", partition, len(b.replicaToPartitionToNodeIndex[replica]))
+	}
+	e := &Explanation{
+		Partition:        partition,
+		Replica:          replica,
+		MinutesSinceMove: b.replicaToPartitionToLastMove[replica][partition],
+		MoveWait:         b.moveWait,
+	}
+	nodeIndex := b.replicaToPartitionToNodeIndex[replica][partition]
+	if nodeIndex < 0 {
+		e.Reasons = append(e.Reasons, "The replica is not yet assigned; it will be on the next rebalance, when a Ring is next generated.")
+		return e, nil
+	}
+	n := b.nodes[nodeIndex]
+	e.NodeID = n.id
+	e.NodeActive = !n.inactive
+	e.NodeCapacity = n.usableCapacity()
+	for _, other := range b.nodes {
+		if !other.inactive {
+			e.TotalCapacity += other.usableCapacity()
+		}
+	}
+	assignmentCount := len(b.replicaToPartitionToNodeIndex) * len(b.replicaToPartitionToNodeIndex[0])
+	for _, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+		for _, ni := range partitionToNodeIndex {
+			if ni == nodeIndex {
+				e.NodeAssigned++
+			}
+		}
+	}
+	if e.NodeActive && e.TotalCapacity > 0 {
+		e.NodeDesired = int(roundedDesiredAssignments(e.NodeCapacity, e.TotalCapacity, uint64(assignmentCount)))
+	}
+	if !e.NodeActive {
+		e.Reasons = append(e.Reasons, "The node is inactive; the replica will be reassigned on the next rebalance.")
+	} else {
+		if b.NodeDraining(n.id) {
+			e.Reasons = append(e.Reasons, fmt.Sprintf("The node is draining, so desires none of the %d partition replicas and has %d; its replicas move off as the move wait allows.", assignmentCount, e.NodeAssigned))
+		} else if e.NodeCapacity != n.capacity {
+			e.Reasons = append(e.Reasons, fmt.Sprintf("The node has capacity %d, %d usable after its reserve, of the total usable active capacity %d, so desires %d of the %d partition replicas and has %d.", n.capacity, e.NodeCapacity, e.TotalCapacity, e.NodeDesired, assignmentCount, e.NodeAssigned))
+		} else {
+			e.Reasons = append(e.Reasons, fmt.Sprintf("The node has capacity %d of the total active capacity %d, so desires %d of the %d partition replicas and has %d.", n.capacity, e.TotalCapacity, e.NodeDesired, assignmentCount, e.NodeAssigned))
+		}
+		if e.NodeAssigned > e.NodeDesired {
+			e.Reasons = append(e.Reasons, fmt.Sprintf("The node is overweight by %d, so its replicas are candidates to move to underweight nodes.", e.NodeAssigned-e.NodeDesired))
+		}
+	}
+	if e.MinutesSinceMove == math.MaxUint16 {
+		e.Reasons = append(e.Reasons, "The replica has not been reassigned recently.")
+	} else if e.MinutesSinceMove < b.moveWait {
+		e.Reasons = append(e.Reasons, fmt.Sprintf("The replica was reassigned %d minutes ago, within the move wait of %d minutes, so it will not be moved again yet.", e.MinutesSinceMove, b.moveWait))
+	} else {
+		e.Reasons = append(e.Reasons, fmt.Sprintf("The replica was reassigned %d minutes ago.", e.MinutesSinceMove))
+	}
+	rb := newRebalancer(b)
+	e.MovementsLeft = int(rb.partitionToMovementsLeft[partition])
+	if e.MovementsLeft < 1 {
+		e.Reasons = append(e.Reasons, "The partition has other replicas still within the move wait, so none of its replicas will be moved yet.")
+	}
+	e.SameNodeReplica = -1
+	e.SharedTierLevel = -1
+	for otherReplica, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+		otherIndex := partitionToNodeIndex[partition]
+		if otherReplica == replica || otherIndex < 0 {
+			continue
+		}
+		if otherIndex == nodeIndex {
+			e.SameNodeReplica = otherReplica
+			e.Reasons = append(e.Reasons, fmt.Sprintf("Replica %d is on the same node; there were not enough nodes with desire to separate them.", otherReplica))
+			continue
+		}
+		for level := 0; level < len(b.tiers); level++ {
+			if rb.tierToNodeIndexToTierSep[level][otherIndex] == rb.tierToNodeIndexToTierSep[level][nodeIndex] {
+				if e.SharedTierLevel == -1 || level < e.SharedTierLevel {
+					e.SharedTierLevel = level
+				}
+				e.Reasons = append(e.Reasons, fmt.Sprintf("Replica %d shares tier level %d and above with this replica; no better separated node was available with enough desire.", otherReplica, level))
+				break
+			}
+		}
+	}
+	for i := len(rb.usedNodeIndexes) - 1; i >= 0; i-- {
+		rb.usedNodeIndexes[i] = -1
+	}
+	rb.clearUsed()
+	rb.markUsed(int(partition))
+	rb.markRegions(int(partition), replica)
+	if rb.regionLimited {
+		e.Reasons = append(e.Reasons, "Without this replica the partition would fall short of its region targets, so an alternative node is sought in the regions short of replicas first.")
+	}
+	if alt := rb.bestNodeIndex(); alt >= 0 {
+		e.AlternativeNodeID = b.nodes[alt].id
+		e.AlternativeDesire = int(rb.nodeIndexToDesire[alt])
+		if e.AlternativeDesire < 1 {
+			e.Reasons = append(e.Reasons, fmt.Sprintf("The best alternative node, %d, does not desire any more replicas, so there is no reason to move this one.", e.AlternativeNodeID))
+		} else {
+			e.Reasons = append(e.Reasons, fmt.Sprintf("The best alternative node, %d, desires %d more replicas.", e.AlternativeNodeID, e.AlternativeDesire))
+		}
+	} else {
+		e.Reasons = append(e.Reasons, "There is no alternative node that is not already used by this partition.")
+	}
+	return e, nil
+}
@@ -0,0 +1,64 @@
+package ring
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuilderExplain(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetReplicaCount(2)
+	if _, err := b.Explain(0, 2); err == nil {
+		t.Fatal("expected replica range error")
+	}
+	e, err := b.Explain(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.NodeID != 0 {
+		t.Fatalf("%d != 0", e.NodeID)
+	}
+	nA, err := b.AddNode(true, 1, []string{"server1", "zone1"}, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nB, err := b.AddNode(true, 3, []string{"server2", "zone1"}, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := b.Ring()
+	e, err = b.Explain(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.NodeID != r.ResponsibleNodes(0)[0].ID() {
+		t.Fatalf("%d != %d", e.NodeID, r.ResponsibleNodes(0)[0].ID())
+	}
+	if e.TotalCapacity != 4 || !e.NodeActive {
+		t.Fatalf("%#v", e)
+	}
+	if e.MinutesSinceMove >= e.MoveWait {
+		t.Fatalf("%d >= %d", e.MinutesSinceMove, e.MoveWait)
+	}
+	// With only two nodes in one zone, the replicas share the zone level.
+	if e.SameNodeReplica == -1 && e.SharedTierLevel != 1 {
+		t.Fatalf("%d != 1", e.SharedTierLevel)
+	}
+	if !strings.Contains(e.String(), "move wait") {
+		t.Fatal(e.String())
+	}
+	nA.SetActive(false)
+	for p := Partition(0); p < 1<<r.PartitionBitCount(); p++ {
+		if e, err = b.Explain(p, 0); err != nil {
+			t.Fatal(err)
+		}
+		if e.NodeID == nA.ID() {
+			if e.NodeActive {
+				t.Fatal("node should be inactive")
+			}
+			if e.AlternativeNodeID != nB.ID() && e.AlternativeNodeID != 0 {
+				t.Fatalf("%d != %d", e.AlternativeNodeID, nB.ID())
+			}
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package ring
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FlapDamperConfig represents the set of values for configuring a
+// FlapDamper. The penalties work as with BGP route flap damping: each change
+// in a node's reported health adds the Penalty to its score, which decays
+// by half every HalfLife; a node whose score passes the SuppressThreshold is
+// held inactive until its score decays below the ReuseThreshold.
+type FlapDamperConfig struct {
+	// LogDebug sets the func to use for debug messages. Defaults not logging
+	// debug messages.
+	LogDebug LogFunc
+	// Locker, if set, will be held while the FlapDamper uses the Builder;
+	// anything else using the Builder should hold it too.
+	Locker sync.Locker
+	// Penalty indicates how much each flap, a change between up and down,
+	// adds to a node's score. Defaults to 1000.
+	Penalty int
+	// HalfLife indicates how many seconds it takes a node's score to decay
+	// by half. Defaults to 900 seconds.
+	HalfLife int
+	// SuppressThreshold is the score above which a node is suppressed.
+	// Defaults to 2000, so the third flap in quick succession suppresses.
+	SuppressThreshold int
+	// ReuseThreshold is the score below which a suppressed node is released,
+	// taking on its last reported health. Defaults to 750.
+	ReuseThreshold int
+	// MaxPenalty caps a node's score, bounding how long a node that keeps
+	// flapping stays suppressed once it settles. Defaults to 4 times the
+	// SuppressThreshold, about 35 minutes of decay with the other defaults.
+	MaxPenalty int
+}
+
+func resolveFlapDamperConfig(c *FlapDamperConfig) *FlapDamperConfig {
+	cfg := &FlapDamperConfig{}
+	if c != nil {
+		*cfg = *c
+	}
+	if cfg.LogDebug == nil {
+		cfg.LogDebug = nilLogFunc
+	}
+	if cfg.Penalty < 1 {
+		cfg.Penalty = 1000
+	}
+	if cfg.HalfLife < 1 {
+		cfg.HalfLife = 900
+	}
+	if cfg.SuppressThreshold < 1 {
+		cfg.SuppressThreshold = 2000
+	}
+	if cfg.ReuseThreshold < 1 {
+		cfg.ReuseThreshold = 750
+	}
+	if cfg.ReuseThreshold >= cfg.SuppressThreshold {
+		cfg.ReuseThreshold = cfg.SuppressThreshold / 2
+	}
+	if cfg.MaxPenalty < cfg.SuppressThreshold {
+		cfg.MaxPenalty = cfg.SuppressThreshold * 4
+	}
+	return cfg
+}
+
+// FlapScore is a node's standing with a FlapDamper.
+type FlapScore struct {
+	NodeID uint64 `json:"node_id,string"`
+	// Up is the node's last reported health.
+	Up bool `json:"up"`
+	// Penalty is the node's score, decayed to the time asked.
+	Penalty float64 `json:"penalty"`
+	// Flaps counts the changes in the node's reported health.
+	Flaps int `json:"flaps"`
+	// Suppressed is true if the node is held inactive for flapping.
+	Suppressed bool `json:"suppressed"`
+}
+
+type flapState struct {
+	up         bool
+	penalty    float64
+	updated    time.Time
+	flaps      int
+	suppressed bool
+}
+
+// FlapDamper sits between failure detection and a Builder, applying the
+// health reported for nodes by activating and deactivating them, but damping
+// nodes that bounce: rather than each bounce deactivating and reactivating a
+// node, and so each churning data with a rebalance, a node that flaps too
+// often is held inactive until it has been stable for a while.
+type FlapDamper struct {
+	builder           *Builder
+	logDebug          LogFunc
+	locker            sync.Locker
+	penalty           float64
+	halfLife          time.Duration
+	suppressThreshold float64
+	reuseThreshold    float64
+	maxPenalty        float64
+	lock              sync.Mutex
+	states            map[uint64]*flapState
+	flaps             int32
+	suppressions      int32
+	releases          int32
+}
+
+// NewFlapDamper creates a FlapDamper applying health to the Builder's nodes.
+func NewFlapDamper(b *Builder, c *FlapDamperConfig) *FlapDamper {
+	cfg := resolveFlapDamperConfig(c)
+	return &FlapDamper{
+		builder:           b,
+		logDebug:          cfg.LogDebug,
+		locker:            cfg.Locker,
+		penalty:           float64(cfg.Penalty),
+		halfLife:          time.Duration(cfg.HalfLife) * time.Second,
+		suppressThreshold: float64(cfg.SuppressThreshold),
+		reuseThreshold:    float64(cfg.ReuseThreshold),
+		maxPenalty:        float64(cfg.MaxPenalty),
+		states:            make(map[uint64]*flapState),
+	}
+}
+
+// decay brings the state's penalty forward to the time given.
+func (d *FlapDamper) decay(s *flapState, now time.Time) {
+	if elapsed := now.Sub(s.updated); elapsed > 0 {
+		s.penalty *= math.Pow(0.5, float64(elapsed)/float64(d.halfLife))
+		s.updated = now
+	}
+}
+
+// Report records the node's health as observed at the time given and
+// applies it to the Builder, activating the node if up and deactivating it
+// if down, unless the node is suppressed for flapping; it returns true if
+// the Builder changed, so a new ring should be made. The first report for a
+// node is not counted as a flap.
+func (d *FlapDamper) Report(nodeID uint64, up bool, now time.Time) (bool, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	s := d.states[nodeID]
+	if s == nil {
+		s = &flapState{up: up, updated: now}
+		d.states[nodeID] = s
+	} else {
+		d.decay(s, now)
+		if s.up != up {
+			s.up = up
+			s.flaps++
+			atomic.AddInt32(&d.flaps, 1)
+			s.penalty = math.Min(s.penalty+d.penalty, d.maxPenalty)
+		}
+	}
+	if !s.suppressed && s.penalty > d.suppressThreshold {
+		s.suppressed = true
+		atomic.AddInt32(&d.suppressions, 1)
+		d.logDebug("FlapDamper: suppressing node %d with penalty %.0f\n", nodeID, s.penalty)
+	} else if s.suppressed && s.penalty < d.reuseThreshold {
+		s.suppressed = false
+		atomic.AddInt32(&d.releases, 1)
+		d.logDebug("FlapDamper: releasing node %d with penalty %.0f\n", nodeID, s.penalty)
+	}
+	return d.apply(nodeID, s.up && !s.suppressed)
+}
+
+// Update releases the suppressed nodes whose scores have decayed below the
+// ReuseThreshold by the time given, applying their last reported health; it
+// returns true if the Builder changed. Call it periodically, as nodes that
+// have settled may not be reported on again.
+func (d *FlapDamper) Update(now time.Time) (bool, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	changed := false
+	for nodeID, s := range d.states {
+		if !s.suppressed {
+			continue
+		}
+		d.decay(s, now)
+		if s.penalty >= d.reuseThreshold {
+			continue
+		}
+		s.suppressed = false
+		atomic.AddInt32(&d.releases, 1)
+		d.logDebug("FlapDamper: releasing node %d with penalty %.0f\n", nodeID, s.penalty)
+		nodeChanged, err := d.apply(nodeID, s.up)
+		if err != nil {
+			return changed, err
+		}
+		changed = changed || nodeChanged
+	}
+	return changed, nil
+}
+
+// apply makes the node active or not, returning true if that changed it.
+func (d *FlapDamper) apply(nodeID uint64, active bool) (bool, error) {
+	if d.locker != nil {
+		d.locker.Lock()
+		defer d.locker.Unlock()
+	}
+	n := d.builder.Node(nodeID)
+	if n == nil {
+		return false, fmt.Errorf("no node with id %d", nodeID)
+	}
+	if n.Active() == active {
+		return false, nil
+	}
+	n.SetActive(active)
+	return true, nil
+}
+
+// Forget drops what is known of the node, such as once it is removed from
+// the Builder.
+func (d *FlapDamper) Forget(nodeID uint64) {
+	d.lock.Lock()
+	delete(d.states, nodeID)
+	d.lock.Unlock()
+}
+
+// Scores returns the standing of each node reported on, decayed to the time
+// given, in ascending order of node ID.
+func (d *FlapDamper) Scores(now time.Time) []*FlapScore {
+	d.lock.Lock()
+	scores := make([]*FlapScore, 0, len(d.states))
+	for nodeID, s := range d.states {
+		d.decay(s, now)
+		scores = append(scores, &FlapScore{NodeID: nodeID, Up: s.up, Penalty: s.penalty, Flaps: s.flaps, Suppressed: s.suppressed})
+	}
+	d.lock.Unlock()
+	sort.Slice(scores, func(i, j int) bool { return scores[i].NodeID < scores[j].NodeID })
+	return scores
+}
+
+// FlapDamperStats are the stat counters of a FlapDamper, along with the nodes
+// it currently holds inactive; see FlapDamper.Stats.
+type FlapDamperStats struct {
+	// Flaps counts the changes in the nodes' reported health.
+	Flaps int32
+	// Suppressions counts the nodes suppressed for flapping, and Releases
+	// those released once their scores decayed.
+	Suppressions int32
+	Releases     int32
+	// Suppressed lists the IDs of the nodes held inactive for flapping, in
+	// ascending order; it is the current state rather than a counter.
+	Suppressed []uint64
+}
+
+// Stats returns the current stat counters and resets those counters. Use
+// Scores for each node's penalty.
+func (d *FlapDamper) Stats() *FlapDamperStats {
+	stats := &FlapDamperStats{
+		Flaps:        atomic.LoadInt32(&d.flaps),
+		Suppressions: atomic.LoadInt32(&d.suppressions),
+		Releases:     atomic.LoadInt32(&d.releases),
+	}
+	atomic.AddInt32(&d.flaps, -stats.Flaps)
+	atomic.AddInt32(&d.suppressions, -stats.Suppressions)
+	atomic.AddInt32(&d.releases, -stats.Releases)
+	d.lock.Lock()
+	for nodeID, s := range d.states {
+		if s.suppressed {
+			stats.Suppressed = append(stats.Suppressed, nodeID)
+		}
+	}
+	d.lock.Unlock()
+	sort.Slice(stats.Suppressed, func(i, j int) bool { return stats.Suppressed[i] < stats.Suppressed[j] })
+	return stats
+}
@@ -0,0 +1,70 @@
+package ring
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFlapDamper(t *testing.T) {
+	b := NewBuilder(64)
+	n, err := b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewFlapDamper(b, nil)
+	now := time.Now()
+	report := func(up bool, expectChanged bool, expectActive bool) {
+		now = now.Add(time.Second)
+		changed, err := d.Report(n.ID(), up, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != expectChanged || n.Active() != expectActive {
+			t.Fatalf("%v %v %#v", changed, n.Active(), d.Scores(now)[0])
+		}
+	}
+	report(true, false, true)
+	report(false, true, false)
+	report(true, true, true)
+	// The third flap in quick succession suppresses the node, holding it
+	// inactive however it is reported.
+	report(false, true, false)
+	report(true, false, false)
+	scores := d.Scores(now)
+	if len(scores) != 1 || scores[0].NodeID != n.ID() || !scores[0].Up || !scores[0].Suppressed || scores[0].Flaps != 4 || scores[0].Penalty < 3900 {
+		t.Fatalf("%#v", scores[0])
+	}
+	if stats := d.Stats(); stats.Flaps != 4 || stats.Suppressions != 1 || stats.Releases != 0 || len(stats.Suppressed) != 1 || stats.Suppressed[0] != n.ID() {
+		t.Fatalf("%#v", stats)
+	}
+	if changed, err := d.Update(now.Add(15 * time.Minute)); changed || err != nil {
+		t.Fatal(changed, err)
+	}
+	if changed, err := d.Update(now.Add(time.Hour)); !changed || err != nil {
+		t.Fatal(changed, err)
+	}
+	if !n.Active() {
+		t.Fatal("released node should take on its last reported health")
+	}
+	if stats := d.Stats(); stats.Flaps != 0 || stats.Suppressions != 0 || stats.Releases != 1 || len(stats.Suppressed) != 0 {
+		t.Fatalf("%#v", stats)
+	}
+	now = now.Add(time.Hour)
+	if scores = d.Scores(now); scores[0].Suppressed || scores[0].Penalty > 750 {
+		t.Fatalf("%#v", scores[0])
+	}
+	// Penalties are capped, bounding how long a settled node is held.
+	for i := 0; i < 20; i++ {
+		report(i%2 == 1, i == 0, false)
+	}
+	if scores = d.Scores(now); scores[0].Penalty > 8000 {
+		t.Fatalf("%#v", scores[0])
+	}
+	if _, err = d.Report(n.ID()+1, true, now); err == nil {
+		t.Fatal("expected error for unknown node")
+	}
+	d.Forget(n.ID() + 1)
+	if scores = d.Scores(now); len(scores) != 1 {
+		t.Fatal(len(scores))
+	}
+}
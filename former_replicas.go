@@ -0,0 +1,58 @@
+package ring
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// MsgToFormerReplicas queues the message for delivery to the nodes that were
+// responsible for the partition under the previous ring with the version
+// given, other than the local node; this enables "pull from the previous
+// owner" replication right after a ring change. The partition is of the
+// current ring; should the partition bit count have changed, the message is
+// sent to the former replicas of all the previous partitions covering it. The
+// timeout should be considered for queueing, not for actual delivery.
+//
+// Only the rings SetRing replaced most recently are retained; see
+// TCPMsgRingConfig.RetainedRings. If the version is not retained, the message
+// is discarded.
+//
+// When the msg has actually been sent or has been discarded due to delivery
+// errors or delays, msg.Free() will be called.
+func (t *TCPMsgRing) MsgToFormerReplicas(msg Msg, ringVersion int64, partition Partition, timeout time.Duration) {
+	atomic.AddInt32(&t.msgToFormerReplicas, 1)
+	ring := t.Ring()
+	former, addressIndex := t.formerRing(ringVersion)
+	if ring == nil || former == nil {
+		atomic.AddInt32(&t.msgToFormerReplicasNoRings, 1)
+		msg.Free()
+		return
+	}
+	var localID uint64
+	if localNode := ring.LocalNode(); localNode != nil {
+		localID = localNode.ID()
+	}
+	var addrs []string
+	seen := make(map[uint64]bool)
+	first, last := previousPartitions(ring.PartitionBitCount(), former.PartitionBitCount(), partition)
+	for p := first; ; p++ {
+		for _, node := range former.ResponsibleNodes(p) {
+			if node.ID() != localID && !seen[node.ID()] {
+				seen[node.ID()] = true
+				addrs = append(addrs, node.Address(addressIndex))
+			}
+		}
+		if p == last {
+			break
+		}
+	}
+	if len(addrs) == 0 {
+		msg.Free()
+		return
+	}
+	mmsg := &multiMsg{msg: msg, freerChan: make(chan struct{}, len(addrs))}
+	for _, addr := range addrs {
+		go t.msgToAddr(mmsg, addr, timeout)
+	}
+	go mmsg.freer(len(addrs))
+}
@@ -0,0 +1,116 @@
+package ring
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+// ErrFrameAborted is returned by FrameReader.Read after FrameReader.Abort.
+var ErrFrameAborted = errors.New("frame aborted by handler")
+
+// FrameHandler handles an incoming message given as a FrameReader; see
+// TCPMsgRing.SetFrameMsgHandler.
+type FrameHandler func(frame *FrameReader) error
+
+// FrameReader is an io.Reader over the content of a single incoming message
+// that knows how much of the content there is and how much has been read, so
+// a handler can make decisions as it goes, such as skipping a message it does
+// not want or that is larger than it is willing to buffer.
+type FrameReader struct {
+	reader   io.Reader
+	length   uint64
+	consumed uint64
+	aborted  bool
+	progress func(consumed uint64, length uint64)
+}
+
+func newFrameReader(reader io.Reader, length uint64) *FrameReader {
+	return &FrameReader{reader: reader, length: length}
+}
+
+// Read reads from the message content, returning io.EOF at its end and
+// ErrFrameAborted once Abort has been called.
+func (f *FrameReader) Read(p []byte) (int, error) {
+	if f.aborted {
+		return 0, ErrFrameAborted
+	}
+	remaining := f.length - f.consumed
+	if remaining == 0 {
+		return 0, io.EOF
+	}
+	if uint64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := f.reader.Read(p)
+	if n > 0 {
+		f.consumed += uint64(n)
+		if f.progress != nil {
+			f.progress(f.consumed, f.length)
+		}
+	}
+	return n, err
+}
+
+// Length returns the total length of the message content.
+func (f *FrameReader) Length() uint64 {
+	return f.length
+}
+
+// Consumed returns how many bytes of the message content have been read.
+func (f *FrameReader) Consumed() uint64 {
+	return f.consumed
+}
+
+// Remaining returns how many bytes of the message content are yet to be read.
+func (f *FrameReader) Remaining() uint64 {
+	return f.length - f.consumed
+}
+
+// Abort indicates the handler wants none of the remaining message content;
+// once the handler returns, the remainder will be read and discarded so the
+// connection can carry on with the next message. Further Reads return
+// ErrFrameAborted.
+func (f *FrameReader) Abort() {
+	f.aborted = true
+}
+
+// Aborted returns true if Abort has been called.
+func (f *FrameReader) Aborted() bool {
+	return f.aborted
+}
+
+// SetProgress sets a func to be called after each Read that consumes content,
+// with the bytes consumed so far and the total length; nil clears it.
+func (f *FrameReader) SetProgress(progress func(consumed uint64, length uint64)) {
+	f.progress = progress
+}
+
+// discard reads the remainder of the message content, without reporting
+// progress.
+func (f *FrameReader) discard() error {
+	n, err := io.CopyN(ioutil.Discard, f.reader, int64(f.length-f.consumed))
+	f.consumed += uint64(n)
+	return err
+}
+
+// SetFrameMsgHandler is like SetMsgHandler, but the handler is given a
+// FrameReader rather than having to track the message length itself. If the
+// handler returns nil without reading all the content, or calls Abort, the
+// rest of the content is discarded rather than the connection being dropped;
+// aborted messages are counted as MsgAborts. An error returned by the handler
+// drops the connection, as with SetMsgHandler.
+func (t *TCPMsgRing) SetFrameMsgHandler(msgType uint64, handler FrameHandler) {
+	t.SetMsgHandler(msgType, func(reader io.Reader, length uint64) (uint64, error) {
+		frame := newFrameReader(reader, length)
+		if err := handler(frame); err != nil {
+			return frame.consumed, err
+		}
+		if frame.aborted {
+			atomic.AddInt32(&t.msgAborts, 1)
+		}
+		err := frame.discard()
+		return frame.consumed, err
+	})
+}
@@ -0,0 +1,75 @@
+package ring
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestFrameReader(t *testing.T) {
+	f := newFrameReader(bytes.NewReader([]byte("0123456789next")), 10)
+	var progress []uint64
+	f.SetProgress(func(consumed uint64, length uint64) {
+		if length != 10 {
+			t.Fatal(length)
+		}
+		progress = append(progress, consumed)
+	})
+	buf := make([]byte, 4)
+	for i := 0; i < 2; i++ {
+		if _, err := io.ReadFull(f, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if f.Consumed() != 8 || f.Remaining() != 2 || len(progress) != 2 || progress[1] != 8 {
+		t.Fatal(f.Consumed(), f.Remaining(), progress)
+	}
+	// Reads stop at the end of the message content.
+	b, err := ioutil.ReadAll(f)
+	if err != nil || string(b) != "89" {
+		t.Fatal(string(b), err)
+	}
+	f = newFrameReader(bytes.NewReader([]byte("0123456789")), 10)
+	f.Abort()
+	if _, err = f.Read(buf); err != ErrFrameAborted || !f.Aborted() {
+		t.Fatal(err)
+	}
+}
+
+func TestTCPMsgRingSetFrameMsgHandler(t *testing.T) {
+	msgring, _ := NewTCPMsgRing(nil)
+	var lengths []uint64
+	msgring.SetFrameMsgHandler(1, func(f *FrameReader) error {
+		lengths = append(lengths, f.Length())
+		if f.Length() > 4 {
+			f.Abort()
+			return nil
+		}
+		_, err := io.ReadFull(f, make([]byte, f.Length()))
+		return err
+	})
+	handler := msgring.MsgHandler(1)
+	reader := bytes.NewReader([]byte("too long!abcd"))
+	if consumed, err := handler(reader, 9); consumed != 9 || err != nil {
+		t.Fatal(consumed, err)
+	}
+	if consumed, err := handler(reader, 4); consumed != 4 || err != nil {
+		t.Fatal(consumed, err)
+	}
+	if len(lengths) != 2 || lengths[0] != 9 || lengths[1] != 4 {
+		t.Fatal(lengths)
+	}
+	if s := msgring.Stats(false); s.MsgAborts != 1 {
+		t.Fatal(s.MsgAborts)
+	}
+	// Handler errors are passed along as with any other handler.
+	errFailed := errors.New("failed")
+	msgring.SetFrameMsgHandler(2, func(f *FrameReader) error {
+		return errFailed
+	})
+	if consumed, err := msgring.MsgHandler(2)(bytes.NewReader([]byte("abcd")), 4); consumed != 0 || err != errFailed {
+		t.Fatal(consumed, err)
+	}
+}
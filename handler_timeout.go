@@ -0,0 +1,36 @@
+package ring
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// watchHandler starts the timer for a handler of the message type, if the
+// type has a HandlerTimeouts entry, returning the timer to stop once the
+// handler returns, or nil if the type is not timed.
+func (t *TCPMsgRing) watchHandler(addr string, msgType uint64, netConn net.Conn, resetChan chan struct{}) *time.Timer {
+	timeout := t.handlerTimeouts[msgType]
+	if timeout <= 0 {
+		return nil
+	}
+	start := time.Now()
+	return time.AfterFunc(timeout, func() {
+		elapsed := time.Since(start)
+		atomic.AddInt32(&t.msgHandlerTimeouts, 1)
+		t.logDebug("handler %x for %s has run for %s\n", msgType, addr, elapsed)
+		if t.handlerTimedOut != nil {
+			t.handlerTimedOut(addr, msgType, elapsed)
+		}
+		if !t.handlerTimeoutDisconnect {
+			return
+		}
+		netConn.Close()
+		if resetChan != nil {
+			select {
+			case resetChan <- struct{}{}:
+			default:
+			}
+		}
+	})
+}
@@ -0,0 +1,55 @@
+package ring
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestTCPMsgRingHandlerTimeout(t *testing.T) {
+	timedOut := make(chan uint64, 1)
+	msgring, _ := NewTCPMsgRing(&TCPMsgRingConfig{
+		HandlerTimeouts:          map[uint64]int{1: 10},
+		HandlerTimeoutDisconnect: true,
+		HandlerTimedOut: func(addr string, msgType uint64, elapsed time.Duration) {
+			if addr != "127.0.0.2:1" || elapsed < 10*time.Millisecond {
+				t.Errorf("%q %s", addr, elapsed)
+			}
+			timedOut <- msgType
+		},
+	})
+	msgring.SetMsgHandler(1, func(reader io.Reader, size uint64) (uint64, error) {
+		time.Sleep(50 * time.Millisecond)
+		return test_stringmarshaller(reader, size)
+	})
+	conn := new(testConn)
+	m := newTestMsg()
+	if err := msgring.writeMsg("127.0.0.2:1", newTimeoutWriter(conn, 16*1024, time.Second), m); err != nil {
+		t.Fatal(err)
+	}
+	conn.readBuf.Write(conn.writeBuf.Bytes())
+	reader := newTimeoutReader(conn, 16*1024, time.Second)
+	resetChan := make(chan struct{}, 1)
+	if err := msgring.readMsg("127.0.0.2:1", reader, resetChan); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msgType := <-timedOut:
+		if msgType != 1 {
+			t.Fatal(msgType)
+		}
+	default:
+		t.Fatal("handler did not time out")
+	}
+	select {
+	case <-resetChan:
+	default:
+		t.Fatal("connection was not reset")
+	}
+	if timer := msgring.watchHandler("127.0.0.2:1", 2, conn, resetChan); timer != nil {
+		t.Fatal("message type 2 should not be timed")
+	}
+	if s := msgring.Stats(false); s.MsgHandlerTimeouts != 1 {
+		t.Fatal(s.MsgHandlerTimeouts)
+	}
+}
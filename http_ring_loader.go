@@ -0,0 +1,177 @@
+package ring
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPRingLoaderConfig represents the set of values for configuring an
+// HTTPRingLoader.
+type HTTPRingLoaderConfig struct {
+	// LogDebug sets the func to use for debug messages. Defaults not logging
+	// debug messages.
+	LogDebug LogFunc
+	// URL is the location of the ring object, as persisted by Ring.Persist.
+	// For S3, GCS, and similar object stores, this would usually be a public
+	// or pre-signed URL. This must be set.
+	URL string
+	// Interval indicates how many seconds to wait between polls. Defaults to
+	// 60 seconds.
+	Interval int
+	// Client is the http.Client to use. Defaults to a client with a 60 second
+	// timeout.
+	Client *http.Client
+	// ChecksumHeader, if set, names a response header that must hold the hex
+	// encoded SHA-256 checksum of the ring object; for example, with S3 the
+	// checksum could be stored as user metadata and this set to
+	// "X-Amz-Meta-Sha256". Rings without a matching checksum are rejected.
+	ChecksumHeader string
+	// Verify, if set, will be called with each newly downloaded ring object
+	// and the response headers; any error returned rejects the ring. This is
+	// the hook for signature verification.
+	Verify func(data []byte, header http.Header) error
+	// RingChanged will be called with each new Ring loaded. This must be set.
+	RingChanged func(r Ring)
+}
+
+func resolveHTTPRingLoaderConfig(c *HTTPRingLoaderConfig) *HTTPRingLoaderConfig {
+	cfg := &HTTPRingLoaderConfig{}
+	if c != nil {
+		*cfg = *c
+	}
+	if cfg.Interval < 1 {
+		cfg.Interval = 60
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 60 * time.Second}
+	}
+	return cfg
+}
+
+// HTTPRingLoader polls a URL for a ring object, delivering each new Ring to a
+// callback. It uses ETag and If-None-Match so an unchanged ring is not
+// downloaded again, which suits consumers such as serverless functions that
+// cannot run a full coordination service client.
+type HTTPRingLoader struct {
+	logDebug       LogFunc
+	url            string
+	interval       time.Duration
+	client         *http.Client
+	checksumHeader string
+	verify         func(data []byte, header http.Header) error
+	ringChanged    func(r Ring)
+	pollLock       sync.Mutex
+	etag           string
+	version        int64
+	controlLock    sync.Mutex
+	controlChan    chan struct{}
+}
+
+// NewHTTPRingLoader creates an HTTPRingLoader; call Start to begin polling or
+// Poll to check once.
+func NewHTTPRingLoader(c *HTTPRingLoaderConfig) *HTTPRingLoader {
+	cfg := resolveHTTPRingLoaderConfig(c)
+	l := &HTTPRingLoader{
+		logDebug:       cfg.LogDebug,
+		url:            cfg.URL,
+		interval:       time.Duration(cfg.Interval) * time.Second,
+		client:         cfg.Client,
+		checksumHeader: cfg.ChecksumHeader,
+		verify:         cfg.Verify,
+		ringChanged:    cfg.RingChanged,
+	}
+	if l.logDebug == nil {
+		l.logDebug = nilLogFunc
+	}
+	return l
+}
+
+// Start launches the background polling; it does nothing if already started.
+func (l *HTTPRingLoader) Start() {
+	l.controlLock.Lock()
+	if l.controlChan == nil {
+		l.controlChan = make(chan struct{})
+		go l.run(l.controlChan)
+	}
+	l.controlLock.Unlock()
+}
+
+// Stop ends the background polling; it does nothing if not started.
+func (l *HTTPRingLoader) Stop() {
+	l.controlLock.Lock()
+	if l.controlChan != nil {
+		close(l.controlChan)
+		l.controlChan = nil
+	}
+	l.controlLock.Unlock()
+}
+
+func (l *HTTPRingLoader) run(controlChan chan struct{}) {
+	for {
+		if _, err := l.Poll(); err != nil {
+			l.logDebug("HTTPRingLoader: %s: %s\n", l.url, err)
+		}
+		select {
+		case <-controlChan:
+			return
+		case <-time.After(l.interval):
+		}
+	}
+}
+
+// Poll checks the URL once, returning true if a new Ring was delivered.
+func (l *HTTPRingLoader) Poll() (bool, error) {
+	l.pollLock.Lock()
+	defer l.pollLock.Unlock()
+	req, err := http.NewRequest("GET", l.url, nil)
+	if err != nil {
+		return false, err
+	}
+	if l.etag != "" {
+		req.Header.Set("If-None-Match", l.etag)
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	if l.checksumHeader != "" {
+		sum := sha256.Sum256(data)
+		if expected := strings.ToLower(resp.Header.Get(l.checksumHeader)); hex.EncodeToString(sum[:]) != expected {
+			return false, fmt.Errorf("ring checksum %x did not match %s %q", sum, l.checksumHeader, expected)
+		}
+	}
+	if l.verify != nil {
+		if err = l.verify(data, resp.Header); err != nil {
+			return false, err
+		}
+	}
+	r, err := LoadRing(bytes.NewBuffer(data))
+	if err != nil {
+		return false, err
+	}
+	l.etag = resp.Header.Get("ETag")
+	if r.Version() == l.version {
+		return false, nil
+	}
+	l.version = r.Version()
+	l.ringChanged(r)
+	return true, nil
+}
@@ -0,0 +1,66 @@
+package ring
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPRingLoader(t *testing.T) {
+	b := NewBuilder(64)
+	b.AddNode(true, 1, nil, nil, "", nil)
+	buf := &bytes.Buffer{}
+	if err := b.Ring().Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	sum := sha256.Sum256(data)
+	checksum := hex.EncodeToString(sum[:])
+	gets := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gets++
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("X-Amz-Meta-Sha256", checksum)
+		w.Write(data)
+	}))
+	defer server.Close()
+	var rings []Ring
+	l := NewHTTPRingLoader(&HTTPRingLoaderConfig{
+		URL:            server.URL,
+		ChecksumHeader: "X-Amz-Meta-Sha256",
+		RingChanged:    func(r Ring) { rings = append(rings, r) },
+	})
+	changed, err := l.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed || len(rings) != 1 {
+		t.Fatalf("%v %d", changed, len(rings))
+	}
+	changed, err = l.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed || len(rings) != 1 || gets != 2 {
+		t.Fatalf("%v %d %d", changed, len(rings), gets)
+	}
+	checksum = "bad"
+	l = NewHTTPRingLoader(&HTTPRingLoaderConfig{
+		URL:            server.URL,
+		ChecksumHeader: "X-Amz-Meta-Sha256",
+		RingChanged:    func(r Ring) { rings = append(rings, r) },
+	})
+	if _, err = l.Poll(); err == nil {
+		t.Fatal("expected checksum error")
+	}
+	if len(rings) != 1 {
+		t.Fatalf("%d != 1", len(rings))
+	}
+}
@@ -0,0 +1,105 @@
+package ring
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// IdlePolicy sets how a TCPMsgRing handles connections with no messages
+// going either way; see TCPMsgRingConfig.InboundIdlePolicy and
+// OutboundIdlePolicy. Outbound connections to peers messaged only now and
+// then might be closed when idle to free their file descriptors, for example,
+// while inbound connections are kept open indefinitely with keepalives so
+// peers need not redial.
+type IdlePolicy struct {
+	// Timeout indicates how many seconds a connection may be idle before it
+	// is closed; 0 keeps idle connections open indefinitely. An outbound
+	// connection closed for being idle is not redialed until there is
+	// another message to send.
+	Timeout int
+	// KeepAlive indicates how many seconds apart TCP keepalives are sent,
+	// detecting peers gone away while the connection is idle; 0 keeps the
+	// operating system's default and -1 disables keepalives.
+	KeepAlive int
+	// Notify, if set, will be called whenever a connection is closed for
+	// being idle, with the remote address and whether the connection was
+	// inbound.
+	Notify func(addr string, inbound bool)
+}
+
+func resolveIdlePolicy(p *IdlePolicy) *IdlePolicy {
+	rv := &IdlePolicy{}
+	if p != nil {
+		*rv = *p
+	}
+	if rv.Timeout < 0 {
+		rv.Timeout = 0
+	}
+	if rv.KeepAlive < -1 {
+		rv.KeepAlive = -1
+	}
+	return rv
+}
+
+// keepAlivePeriod returns the KeepAlive as a net.Dialer.KeepAlive value:
+// zero for the default and negative to disable.
+func (p *IdlePolicy) keepAlivePeriod() time.Duration {
+	if p.KeepAlive < 0 {
+		return -1
+	}
+	return time.Duration(p.KeepAlive) * time.Second
+}
+
+// keepAliveListener applies the inbound keepalive period to each accepted
+// connection.
+type keepAliveListener struct {
+	*net.TCPListener
+	period time.Duration
+}
+
+func (l *keepAliveListener) Accept() (net.Conn, error) {
+	netConn, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	if l.period < 0 {
+		netConn.SetKeepAlive(false)
+	} else if l.period > 0 {
+		netConn.SetKeepAlive(true)
+		netConn.SetKeepAlivePeriod(l.period)
+	}
+	return netConn, nil
+}
+
+// idleConn tracks when a connection last read or wrote anything.
+type idleConn struct {
+	net.Conn
+	last int64
+}
+
+func newIdleConn(netConn net.Conn) *idleConn {
+	return &idleConn{Conn: netConn, last: time.Now().UnixNano()}
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(&c.last, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		atomic.StoreInt64(&c.last, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// idle returns how long it has been since the connection last read or wrote
+// anything.
+func (c *idleConn) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.last)))
+}
@@ -0,0 +1,102 @@
+package ring
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestResolveIdlePolicy(t *testing.T) {
+	p := resolveIdlePolicy(nil)
+	if p.Timeout != 0 || p.keepAlivePeriod() != 0 {
+		t.Fatal(p.Timeout, p.keepAlivePeriod())
+	}
+	p = resolveIdlePolicy(&IdlePolicy{Timeout: -5, KeepAlive: -5})
+	if p.Timeout != 0 || p.keepAlivePeriod() >= 0 {
+		t.Fatal(p.Timeout, p.keepAlivePeriod())
+	}
+	if p = resolveIdlePolicy(&IdlePolicy{KeepAlive: 30}); p.keepAlivePeriod() != 30*time.Second {
+		t.Fatal(p.keepAlivePeriod())
+	}
+}
+
+func TestIdleConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	c := newIdleConn(a)
+	c.last = time.Now().Add(-time.Minute).UnixNano()
+	if c.idle() < time.Minute {
+		t.Fatal(c.idle())
+	}
+	go io.Copy(ioutil.Discard, b)
+	if _, err := c.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if c.idle() > time.Second {
+		t.Fatal(c.idle())
+	}
+	c.Close()
+}
+
+func TestTCPMsgRingOutboundIdlePolicy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrB := ln.Addr().String()
+	ln.Close()
+	b := NewBuilder(64)
+	nA, _ := b.AddNode(true, 1, nil, []string{"127.0.0.1:1"}, "", nil)
+	nB, _ := b.AddNode(true, 1, nil, []string{addrB}, "", nil)
+	rA := b.Ring()
+	rA.SetLocalNode(nA.ID())
+	rB := b.Ring()
+	rB.SetLocalNode(nB.ID())
+	idled := make(chan string, 2)
+	msgringA, _ := NewTCPMsgRing(&TCPMsgRingConfig{OutboundIdlePolicy: &IdlePolicy{Timeout: 1, Notify: func(addr string, inbound bool) {
+		if !inbound {
+			idled <- addr
+		}
+	}}})
+	defer msgringA.Shutdown()
+	msgringA.SetRing(rA)
+	msgringB, _ := NewTCPMsgRing(nil)
+	defer msgringB.Shutdown()
+	msgringB.SetRing(rB)
+	received := make(chan struct{}, 2)
+	msgringB.SetMsgHandler(1, func(reader io.Reader, size uint64) (uint64, error) {
+		n, err := io.CopyN(ioutil.Discard, reader, int64(size))
+		received <- struct{}{}
+		return uint64(n), err
+	})
+	go msgringB.Listen()
+	for i := 0; msgringB.ListenAddr() == ""; i++ {
+		if i == 100 {
+			t.Fatal("never listened")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 2; i++ {
+		msgringA.msgToAddr(newTestMsg(), addrB, time.Second)
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatal(i, "message not received")
+		}
+		// The connection is closed once idle, and redialed for the next
+		// message.
+		select {
+		case addr := <-idled:
+			if addr != addrB {
+				t.Fatal(addr)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal(i, "connection not closed when idle")
+		}
+	}
+	if s := msgringA.Stats(false); s.IdleCloses != 2 || s.Dials != 2 {
+		t.Fatalf("%#v", s)
+	}
+}
@@ -0,0 +1,393 @@
+package ring
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// InventoryHost is one host of an inventory, the sort of list of servers
+// usually kept in a spreadsheet; see ParseInventoryCSV, ParseInventoryYAML,
+// and DiffInventory.
+//
+// Each of the host's devices becomes a node of the Builder, with the host's
+// IP as its address and the tiers hostname, rack, and zone, lowest first. The
+// node's meta identifies the device, as "hostname/dN" with N counting from 0,
+// so later inventories can be reconciled against the Builder.
+type InventoryHost struct {
+	Hostname string
+	IP       string
+	Zone     string
+	Rack     string
+	// Weight is the capacity of each of the host's devices. Defaults to 1.
+	Weight uint64
+	// Devices is how many devices the host has. Defaults to 1.
+	Devices int
+}
+
+// inventoryDeviceMeta returns the meta identifying the host's device.
+func inventoryDeviceMeta(hostname string, device int) string {
+	return fmt.Sprintf("%s/d%d", hostname, device)
+}
+
+func (h *InventoryHost) tiers() []string {
+	return []string{h.Hostname, h.Rack, h.Zone}
+}
+
+// set sets the field for the inventory column or key given; unknown names are
+// ignored, so inventories may carry other information.
+func (h *InventoryHost) set(name string, value string) error {
+	value = strings.TrimSpace(value)
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "hostname", "host":
+		h.Hostname = value
+	case "ip", "address":
+		h.IP = value
+	case "zone":
+		h.Zone = value
+	case "rack":
+		h.Rack = value
+	case "weight", "capacity":
+		if value == "" {
+			return nil
+		}
+		w, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid weight %q", value)
+		}
+		h.Weight = w
+	case "devices", "dev_count", "devs":
+		if value == "" {
+			return nil
+		}
+		d, err := strconv.Atoi(value)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid device count %q", value)
+		}
+		h.Devices = d
+	}
+	return nil
+}
+
+// resolveInventoryHosts applies the defaults and checks the hosts are usable.
+func resolveInventoryHosts(hosts []*InventoryHost) error {
+	seen := make(map[string]bool, len(hosts))
+	for _, h := range hosts {
+		if h.Hostname == "" {
+			return fmt.Errorf("inventory host with ip %q has no hostname", h.IP)
+		}
+		if strings.Contains(h.Hostname, "/") {
+			return fmt.Errorf("inventory hostname %q contains a /", h.Hostname)
+		}
+		if seen[h.Hostname] {
+			return fmt.Errorf("inventory host %q listed more than once", h.Hostname)
+		}
+		seen[h.Hostname] = true
+		if h.Weight == 0 {
+			h.Weight = 1
+		}
+		if h.Devices == 0 {
+			h.Devices = 1
+		}
+	}
+	return nil
+}
+
+// ParseInventoryCSV reads an inventory of hosts as CSV, such as exported from
+// a spreadsheet. The first record must name the columns: hostname, ip, zone,
+// rack, weight, and devices (or dev_count), in any order and case; other
+// columns are ignored.
+func ParseInventoryCSV(r io.Reader) ([]*InventoryHost, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	cr.Comment = '#'
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var hosts []*InventoryHost
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		h := &InventoryHost{}
+		for i, value := range record {
+			if i >= len(header) {
+				break
+			}
+			if err = h.set(header[i], value); err != nil {
+				line, _ := cr.FieldPos(i)
+				return nil, fmt.Errorf("line %d: %s", line, err)
+			}
+		}
+		hosts = append(hosts, h)
+	}
+	if err = resolveInventoryHosts(hosts); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+// ParseInventoryYAML reads an inventory of hosts as YAML, a sequence of
+// mappings with the same keys as the ParseInventoryCSV columns, such as:
+//
+//   - hostname: store1
+//     ip: 10.0.0.1
+//     zone: z1
+//     rack: r1
+//     weight: 100
+//     devices: 12
+//
+// Only this flat form is understood, with optionally quoted scalar values and
+// # comments; it is not a general YAML parser.
+func ParseInventoryYAML(r io.Reader) ([]*InventoryHost, error) {
+	var hosts []*InventoryHost
+	var h *InventoryHost
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := stripInventoryYAMLComment(scanner.Text())
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		if trimmed == "-" || strings.HasPrefix(trimmed, "- ") {
+			h = &InventoryHost{}
+			hosts = append(hosts, h)
+			trimmed = strings.TrimSpace(trimmed[1:])
+			if trimmed == "" {
+				continue
+			}
+		} else if h == nil || line[0] != ' ' && line[0] != '\t' {
+			return nil, fmt.Errorf("line %d: expected a sequence of mappings", lineNumber)
+		}
+		colon := strings.Index(trimmed, ":")
+		if colon < 0 {
+			return nil, fmt.Errorf("line %d: expected key: value", lineNumber)
+		}
+		if err := h.set(trimmed[:colon], unquoteInventoryYAML(strings.TrimSpace(trimmed[colon+1:]))); err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNumber, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := resolveInventoryHosts(hosts); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+// stripInventoryYAMLComment removes any # comment outside quotes.
+func stripInventoryYAMLComment(line string) string {
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func unquoteInventoryYAML(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// InventoryChangeKind indicates what an InventoryChange does.
+type InventoryChangeKind int
+
+const (
+	// InventoryAddNode adds a node for a device not yet in the Builder.
+	InventoryAddNode InventoryChangeKind = iota
+	// InventoryUpdateNode updates a device's node to match the inventory,
+	// reactivating it if it had been deactivated.
+	InventoryUpdateNode
+	// InventoryDeactivateNode deactivates the node of a device no longer in
+	// the inventory. Nodes are deactivated rather than removed, as with
+	// RemoveNode's advice; remove them once drained if desired.
+	InventoryDeactivateNode
+)
+
+func (k InventoryChangeKind) String() string {
+	switch k {
+	case InventoryAddNode:
+		return "add"
+	case InventoryUpdateNode:
+		return "update"
+	case InventoryDeactivateNode:
+		return "deactivate"
+	}
+	return fmt.Sprintf("InventoryChangeKind(%d)", int(k))
+}
+
+// InventoryChange is one change of an InventoryDiff.
+type InventoryChange struct {
+	Kind InventoryChangeKind
+	// Meta identifies the device, as described for InventoryHost.
+	Meta string
+	// NodeID is the device's node, 0 for InventoryAddNode.
+	NodeID uint64
+	// Host is the inventory host of the device, nil for
+	// InventoryDeactivateNode.
+	Host *InventoryHost
+	// Details describes what an InventoryUpdateNode changes, such as
+	// "capacity 100 -> 200".
+	Details []string
+}
+
+func (c *InventoryChange) String() string {
+	s := c.Kind.String() + " " + c.Meta
+	if c.NodeID != 0 {
+		s += fmt.Sprintf(" (%016x)", c.NodeID)
+	}
+	if len(c.Details) > 0 {
+		s += ": " + strings.Join(c.Details, ", ")
+	}
+	return s
+}
+
+// InventoryDiff is the set of changes that reconcile a Builder with an
+// inventory; see DiffInventory.
+type InventoryDiff struct {
+	Changes []*InventoryChange
+}
+
+// DiffInventory compares the Builder's nodes with the inventory's devices,
+// matching them by the meta described for InventoryHost, and returns the
+// changes that would reconcile the Builder with the inventory. Nodes whose
+// meta does not name a device, such as those added by other means, are left
+// alone. The Builder is not changed; see InventoryDiff.Apply.
+func DiffInventory(b *Builder, hosts []*InventoryHost) (*InventoryDiff, error) {
+	if err := resolveInventoryHosts(hosts); err != nil {
+		return nil, err
+	}
+	metaToNode := make(map[string]BuilderNode)
+	for _, n := range b.Nodes() {
+		metaToNode[n.Meta()] = n.(BuilderNode)
+	}
+	wanted := make(map[string]bool)
+	d := &InventoryDiff{}
+	for _, h := range hosts {
+		for device := 0; device < h.Devices; device++ {
+			meta := inventoryDeviceMeta(h.Hostname, device)
+			wanted[meta] = true
+			n := metaToNode[meta]
+			if n == nil {
+				d.Changes = append(d.Changes, &InventoryChange{Kind: InventoryAddNode, Meta: meta, Host: h})
+				continue
+			}
+			if details := inventoryNodeDetails(n, h); len(details) > 0 {
+				d.Changes = append(d.Changes, &InventoryChange{Kind: InventoryUpdateNode, Meta: meta, NodeID: n.ID(), Host: h, Details: details})
+			}
+		}
+	}
+	for _, n := range b.Nodes() {
+		meta := n.Meta()
+		if wanted[meta] || !n.Active() || !isInventoryDeviceMeta(meta, n.Tier(0)) {
+			continue
+		}
+		d.Changes = append(d.Changes, &InventoryChange{Kind: InventoryDeactivateNode, Meta: meta, NodeID: n.ID()})
+	}
+	return d, nil
+}
+
+// isInventoryDeviceMeta returns true if the meta names a device of the host.
+func isInventoryDeviceMeta(meta string, hostname string) bool {
+	if hostname == "" || !strings.HasPrefix(meta, hostname+"/d") {
+		return false
+	}
+	device, err := strconv.Atoi(meta[len(hostname)+2:])
+	return err == nil && device >= 0 && inventoryDeviceMeta(hostname, device) == meta
+}
+
+// inventoryNodeDetails returns how the node differs from the host's devices.
+func inventoryNodeDetails(n BuilderNode, h *InventoryHost) []string {
+	var details []string
+	if !n.Active() {
+		details = append(details, "reactivate")
+	}
+	if n.Capacity() != h.Weight {
+		details = append(details, fmt.Sprintf("capacity %d -> %d", n.Capacity(), h.Weight))
+	}
+	if n.Address(0) != h.IP || len(n.Addresses()) > 1 {
+		details = append(details, fmt.Sprintf("address %q -> %q", n.Address(0), h.IP))
+	}
+	tiers := h.tiers()
+	for level, value := range tiers {
+		if n.Tier(level) != value {
+			details = append(details, fmt.Sprintf("tier %d %q -> %q", level, n.Tier(level), value))
+		}
+	}
+	for level := len(tiers); level < len(n.Tiers()); level++ {
+		if n.Tier(level) != "" {
+			details = append(details, fmt.Sprintf("tier %d %q -> %q", level, n.Tier(level), ""))
+		}
+	}
+	return details
+}
+
+// Apply makes the changes to the Builder, stopping at the first that fails;
+// the changes before it remain applied. As with any node changes, the new
+// layout takes effect with the next rebalance.
+func (d *InventoryDiff) Apply(b *Builder) error {
+	for _, c := range d.Changes {
+		if c.Kind == InventoryAddNode {
+			if _, err := b.AddNode(true, c.Host.Weight, c.Host.tiers(), []string{c.Host.IP}, c.Meta, nil); err != nil {
+				return fmt.Errorf("%s: %s", c, err)
+			}
+			continue
+		}
+		n := b.Node(c.NodeID)
+		if n == nil {
+			return fmt.Errorf("%s: no node with id %d", c, c.NodeID)
+		}
+		if c.Kind == InventoryDeactivateNode {
+			n.SetActive(false)
+			continue
+		}
+		if err := n.SetCapacity(c.Host.Weight); err != nil {
+			return fmt.Errorf("%s: %s", c, err)
+		}
+		if !n.Active() {
+			n.SetActive(true)
+		}
+		n.ReplaceAddresses([]string{c.Host.IP})
+		n.ReplaceTiers(c.Host.tiers())
+	}
+	return nil
+}
+
+// ImportInventory adds the inventory's devices to the Builder, reconciling
+// any already there; it is DiffInventory followed by InventoryDiff.Apply.
+func ImportInventory(b *Builder, hosts []*InventoryHost) (*InventoryDiff, error) {
+	d, err := DiffInventory(b, hosts)
+	if err != nil {
+		return nil, err
+	}
+	return d, d.Apply(b)
+}
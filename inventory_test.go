@@ -0,0 +1,140 @@
+package ring
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseInventoryCSV(t *testing.T) {
+	hosts, err := ParseInventoryCSV(strings.NewReader(`Hostname,IP,Zone,Rack,Weight,dev_count,owner
+# decommissioned hosts are removed from the list
+store1,10.0.0.1,z1,r1,100,2,ops
+store2, 10.0.0.2,z2,r1,,,ops
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 2 {
+		t.Fatal(len(hosts))
+	}
+	if !reflect.DeepEqual(hosts[0], &InventoryHost{Hostname: "store1", IP: "10.0.0.1", Zone: "z1", Rack: "r1", Weight: 100, Devices: 2}) {
+		t.Fatalf("%#v", hosts[0])
+	}
+	if !reflect.DeepEqual(hosts[1], &InventoryHost{Hostname: "store2", IP: "10.0.0.2", Zone: "z2", Rack: "r1", Weight: 1, Devices: 1}) {
+		t.Fatalf("%#v", hosts[1])
+	}
+	if _, err = ParseInventoryCSV(strings.NewReader("hostname,weight\nstore1,lots\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatal(err)
+	}
+	if _, err = ParseInventoryCSV(strings.NewReader("hostname\nstore1\nstore1\n")); err == nil {
+		t.Fatal("duplicate host accepted")
+	}
+}
+
+func TestParseInventoryYAML(t *testing.T) {
+	hosts, err := ParseInventoryYAML(strings.NewReader(`---
+# storage hosts
+- hostname: store1
+  ip: 10.0.0.1
+  zone: "z1"
+  rack: r1 # row 3
+  weight: 100
+  devices: 2
+-
+  hostname: 'store2'
+  ip: 10.0.0.2
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 2 {
+		t.Fatal(len(hosts))
+	}
+	if !reflect.DeepEqual(hosts[0], &InventoryHost{Hostname: "store1", IP: "10.0.0.1", Zone: "z1", Rack: "r1", Weight: 100, Devices: 2}) {
+		t.Fatalf("%#v", hosts[0])
+	}
+	if !reflect.DeepEqual(hosts[1], &InventoryHost{Hostname: "store2", IP: "10.0.0.2", Weight: 1, Devices: 1}) {
+		t.Fatalf("%#v", hosts[1])
+	}
+	if _, err = ParseInventoryYAML(strings.NewReader("hostname: store1\n")); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Fatal(err)
+	}
+}
+
+func TestInventoryDiff(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetReplicaCount(2)
+	manual, err := b.AddNode(true, 1, []string{"manual"}, []string{"10.9.9.9"}, "hand added", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := []*InventoryHost{
+		{Hostname: "store1", IP: "10.0.0.1", Zone: "z1", Rack: "r1", Weight: 100, Devices: 2},
+		{Hostname: "store2", IP: "10.0.0.2", Zone: "z2", Rack: "r2", Weight: 100, Devices: 2},
+	}
+	d, err := ImportInventory(b, hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Changes) != 4 {
+		t.Fatal(d.Changes)
+	}
+	nodes := b.Nodes()
+	if len(nodes) != 5 {
+		t.Fatal(len(nodes))
+	}
+	n := nodes[4]
+	if n.Meta() != "store2/d1" || n.Capacity() != 100 || n.Address(0) != "10.0.0.2" || !reflect.DeepEqual(n.Tiers(), []string{"store2", "r2", "z2"}) {
+		t.Fatalf("%s %d %s %v", n.Meta(), n.Capacity(), n.Address(0), n.Tiers())
+	}
+	b.Ring()
+	// Reconciling with the same inventory changes nothing.
+	if d, err = DiffInventory(b, hosts); err != nil || len(d.Changes) != 0 {
+		t.Fatal(err, d.Changes)
+	}
+	// store1 loses a device and moves rack, store2 is decommissioned, and
+	// store3 is new.
+	hosts = []*InventoryHost{
+		{Hostname: "store1", IP: "10.0.0.1", Zone: "z1", Rack: "r3", Weight: 200, Devices: 1},
+		{Hostname: "store3", IP: "10.0.0.3", Zone: "z2", Rack: "r2", Weight: 100, Devices: 1},
+	}
+	if d, err = DiffInventory(b, hosts); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range d.Changes {
+		got = append(got, c.Kind.String()+" "+c.Meta)
+	}
+	want := []string{"update store1/d0", "add store3/d0", "deactivate store1/d1", "deactivate store2/d0", "deactivate store2/d1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatal(got)
+	}
+	if details := d.Changes[0].Details; !reflect.DeepEqual(details, []string{"capacity 100 -> 200", `tier 1 "r1" -> "r3"`}) {
+		t.Fatal(details)
+	}
+	if err = d.Apply(b); err != nil {
+		t.Fatal(err)
+	}
+	if n = b.Node(nodes[1].ID()); n.Capacity() != 200 || n.Tier(1) != "r3" {
+		t.Fatal(n.Capacity(), n.Tier(1))
+	}
+	if b.Node(nodes[2].ID()).Active() || b.Node(nodes[3].ID()).Active() || !b.Node(manual.ID()).Active() {
+		t.Fatal("wrong nodes deactivated")
+	}
+	b.Ring()
+	// Bringing a device back reactivates its node.
+	hosts = append(hosts, &InventoryHost{Hostname: "store2", IP: "10.0.0.2", Zone: "z2", Rack: "r2", Weight: 100})
+	if d, err = DiffInventory(b, hosts); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Changes) != 1 || d.Changes[0].Kind != InventoryUpdateNode || d.Changes[0].NodeID != nodes[3].ID() || d.Changes[0].Details[0] != "reactivate" {
+		t.Fatal(d.Changes)
+	}
+	if err = d.Apply(b); err != nil {
+		t.Fatal(err)
+	}
+	if !b.Node(nodes[3].ID()).Active() {
+		t.Fatal("node not reactivated")
+	}
+}
@@ -0,0 +1,216 @@
+package k8s
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gholt/ring"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount/"
+
+// Client is a minimal Kubernetes API client covering just what is needed to
+// list pods for a ring and publish rings as ConfigMaps. It implements
+// PodSource.
+//
+// The service account will need permission to list pods and update
+// ConfigMaps in the namespace, and to get nodes cluster wide for the topology
+// labels.
+type Client struct {
+	baseURL       string
+	token         string
+	namespace     string
+	labelSelector string
+	httpClient    *http.Client
+}
+
+// NewClient creates a Client for the API server at baseURL, authenticating
+// with the bearer token if it is not empty; the pods listed will be those in
+// the namespace that match the label selector, such as "app=mystore".
+func NewClient(baseURL string, token string, namespace string, labelSelector string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{
+		baseURL:       strings.TrimRight(baseURL, "/"),
+		token:         token,
+		namespace:     namespace,
+		labelSelector: labelSelector,
+		httpClient:    httpClient,
+	}
+}
+
+// NewInClusterClient creates a Client using the pod's service account and the
+// API server environment variables Kubernetes provides; if namespace is empty,
+// the pod's own namespace is used.
+func NewInClusterClient(namespace string, labelSelector string) (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set")
+	}
+	token, err := ioutil.ReadFile(serviceAccountDir + "token")
+	if err != nil {
+		return nil, err
+	}
+	caCert, err := ioutil.ReadFile(serviceAccountDir + "ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no certificates found in %sca.crt", serviceAccountDir)
+	}
+	if namespace == "" {
+		byts, err := ioutil.ReadFile(serviceAccountDir + "namespace")
+		if err != nil {
+			return nil, err
+		}
+		namespace = strings.TrimSpace(string(byts))
+	}
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	return NewClient("https://"+net.JoinHostPort(host, port), strings.TrimSpace(string(token)), namespace, labelSelector, httpClient), nil
+}
+
+func (c *Client) do(method string, path string, body interface{}, result interface{}) (int, error) {
+	var rd io.Reader
+	if body != nil {
+		byts, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		rd = bytes.NewBuffer(byts)
+	}
+	req, err := http.NewRequest(method, c.baseURL+path, rd)
+	if err != nil {
+		return 0, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return resp.StatusCode, fmt.Errorf("%s %s: %s %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	if result != nil {
+		return resp.StatusCode, json.NewDecoder(resp.Body).Decode(result)
+	}
+	return resp.StatusCode, nil
+}
+
+type objectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+}
+
+type podList struct {
+	Items []struct {
+		Metadata objectMeta `json:"metadata"`
+		Spec     struct {
+			NodeName string `json:"nodeName"`
+		} `json:"spec"`
+		Status struct {
+			Phase string `json:"phase"`
+			PodIP string `json:"podIP"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+type k8sNode struct {
+	Metadata objectMeta `json:"metadata"`
+}
+
+// Pods returns the running pods matching the Client's label selector, along
+// with the labels of the Kubernetes nodes they are on.
+func (c *Client) Pods() ([]*Pod, error) {
+	list := &podList{}
+	path := "/api/v1/namespaces/" + url.PathEscape(c.namespace) + "/pods"
+	if c.labelSelector != "" {
+		path += "?labelSelector=" + url.QueryEscape(c.labelSelector)
+	}
+	if _, err := c.do("GET", path, nil, list); err != nil {
+		return nil, err
+	}
+	nodeLabels := make(map[string]map[string]string)
+	var pods []*Pod
+	for _, item := range list.Items {
+		// Pending pods have no IP or node yet; Succeeded or Failed pods are
+		// gone as far as the ring is concerned.
+		if item.Status.Phase != "Running" {
+			continue
+		}
+		labels, ok := nodeLabels[item.Spec.NodeName]
+		if !ok && item.Spec.NodeName != "" {
+			n := &k8sNode{}
+			if _, err := c.do("GET", "/api/v1/nodes/"+url.PathEscape(item.Spec.NodeName), nil, n); err != nil {
+				return nil, err
+			}
+			labels = n.Metadata.Labels
+			nodeLabels[item.Spec.NodeName] = labels
+		}
+		pods = append(pods, &Pod{
+			Name:        item.Metadata.Name,
+			IP:          item.Status.PodIP,
+			NodeName:    item.Spec.NodeName,
+			Labels:      item.Metadata.Labels,
+			Annotations: item.Metadata.Annotations,
+			NodeLabels:  labels,
+		})
+	}
+	return pods, nil
+}
+
+type configMap struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   objectMeta        `json:"metadata"`
+	BinaryData map[string][]byte `json:"binaryData"`
+}
+
+// PublishRing returns a func, usable as Config.RingChanged, that stores each
+// Ring given, as persisted by Ring.Persist, under the "ring" key of the
+// named ConfigMap's binaryData, creating the ConfigMap if needed. Pods can
+// then mount the ConfigMap and watch the file for new rings. Note that
+// ConfigMaps are limited to about 1M, which limits the partition bits and
+// node count of the ring.
+func (c *Client) PublishRing(name string) func(r ring.Ring) error {
+	return func(r ring.Ring) error {
+		buf := &bytes.Buffer{}
+		if err := r.Persist(buf); err != nil {
+			return err
+		}
+		cm := &configMap{
+			APIVersion: "v1",
+			Kind:       "ConfigMap",
+			Metadata:   objectMeta{Name: name, Namespace: c.namespace},
+			BinaryData: map[string][]byte{"ring": buf.Bytes()},
+		}
+		path := "/api/v1/namespaces/" + url.PathEscape(c.namespace) + "/configmaps"
+		status, err := c.do("PUT", path+"/"+url.PathEscape(name), cm, nil)
+		if status == http.StatusNotFound {
+			_, err = c.do("POST", path, cm, nil)
+		}
+		return err
+	}
+}
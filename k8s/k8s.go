@@ -0,0 +1,248 @@
+// Package k8s contains tools for managing a ring.Builder from the pods running
+// in a Kubernetes cluster and publishing the resulting rings back into the
+// cluster.
+//
+// The pods to track are chosen with a label selector, usually the same
+// selector a StatefulSet or Service uses. Each pod becomes a node in the
+// Builder, identified by the pod name stored as the node's Meta; with a
+// StatefulSet the pod names are stable, so a restarted or rescheduled pod
+// keeps its node and therefore its partition assignments. Node tiers come
+// from the pod's Kubernetes node name and that node's topology labels, node
+// capacity comes from a pod annotation, and the node address is the pod IP
+// with the configured port.
+//
+// Pods that disappear have their nodes marked inactive rather than removed,
+// as is recommended for Builder use in general; they will be reactivated if
+// the pod returns.
+//
+// Only the Go standard library is used; the Client talks directly to the
+// Kubernetes API with the pod's service account, polling rather than
+// watching, which is plenty for the rate at which ring membership changes.
+package k8s
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gholt/ring"
+)
+
+// Pod is the information about a Kubernetes pod needed to derive a ring node.
+type Pod struct {
+	Name        string
+	IP          string
+	NodeName    string
+	Labels      map[string]string
+	Annotations map[string]string
+	// NodeLabels are the labels of the Kubernetes node the pod is scheduled
+	// on; these hold the topology information.
+	NodeLabels map[string]string
+}
+
+// PodSource provides the current set of pods that should be in the ring.
+type PodSource interface {
+	Pods() ([]*Pod, error)
+}
+
+// Config represents the set of values for configuring the reconciliation of
+// pods into a ring.Builder.
+type Config struct {
+	// LogDebug sets the func to use for debug messages. Defaults not logging
+	// debug messages.
+	LogDebug ring.LogFunc
+	// Interval indicates how many seconds to wait between passes when using
+	// Controller.Run. Defaults to 30 seconds.
+	Interval int
+	// Port is used with the pod IP for the node's address0. Defaults to 0,
+	// meaning nodes will not be given addresses.
+	Port int
+	// TierNodeLabels lists the Kubernetes node labels to use as tier levels
+	// 1 and above; tier level 0 is always the Kubernetes node name. Defaults
+	// to topology.kubernetes.io/zone and topology.kubernetes.io/region.
+	TierNodeLabels []string
+	// CapacityAnnotation names the pod annotation giving the node's capacity.
+	// Defaults to ring.gholt.github.com/capacity.
+	CapacityAnnotation string
+	// DefaultCapacity is used when a pod has no capacity annotation. Defaults
+	// to 1.
+	DefaultCapacity uint64
+	// BuilderChanged, if set, will be called after a pass that changed the
+	// Builder, such as to persist it.
+	BuilderChanged func(b *ring.Builder) error
+	// RingChanged, if set, will be called with the new Ring after a pass
+	// that changed the Builder, such as Client.PublishRing. It will not be
+	// called if there are no active nodes.
+	RingChanged func(r ring.Ring) error
+}
+
+func resolveConfig(c *Config) *Config {
+	cfg := &Config{}
+	if c != nil {
+		*cfg = *c
+	}
+	if cfg.Interval < 1 {
+		cfg.Interval = 30
+	}
+	if cfg.TierNodeLabels == nil {
+		cfg.TierNodeLabels = []string{"topology.kubernetes.io/zone", "topology.kubernetes.io/region"}
+	}
+	if cfg.CapacityAnnotation == "" {
+		cfg.CapacityAnnotation = "ring.gholt.github.com/capacity"
+	}
+	if cfg.DefaultCapacity == 0 {
+		cfg.DefaultCapacity = 1
+	}
+	return cfg
+}
+
+// Reconcile updates the Builder's nodes to match the pods, returning true if
+// anything changed. Nodes are matched to pods by the pod name stored as the
+// node's Meta; nodes with no matching pod are marked inactive.
+func Reconcile(b *ring.Builder, pods []*Pod, c *Config) (bool, error) {
+	cfg := resolveConfig(c)
+	byName := make(map[string]ring.BuilderNode)
+	for _, n := range b.Nodes() {
+		byName[n.Meta()] = n.(ring.BuilderNode)
+	}
+	changed := false
+	seen := make(map[string]bool, len(pods))
+	for _, pod := range pods {
+		seen[pod.Name] = true
+		capacity := cfg.DefaultCapacity
+		if v, ok := pod.Annotations[cfg.CapacityAnnotation]; ok {
+			c, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return changed, fmt.Errorf("pod %s: invalid capacity annotation %q: %s", pod.Name, v, err)
+			}
+			capacity = c
+		}
+		tiers := make([]string, 1+len(cfg.TierNodeLabels))
+		tiers[0] = pod.NodeName
+		for i, label := range cfg.TierNodeLabels {
+			tiers[i+1] = pod.NodeLabels[label]
+		}
+		var addresses []string
+		if cfg.Port > 0 && pod.IP != "" {
+			addresses = []string{fmt.Sprintf("%s:%d", pod.IP, cfg.Port)}
+		}
+		n := byName[pod.Name]
+		if n == nil {
+			added, err := b.AddNode(true, capacity, tiers, addresses, pod.Name, nil)
+			if err != nil {
+				return changed, err
+			}
+			cfg.logDebug("k8s: added node %d for pod %s\n", added.ID(), pod.Name)
+			changed = true
+			continue
+		}
+		if !n.Active() {
+			n.SetActive(true)
+			changed = true
+		}
+		if n.Capacity() != capacity {
+			if err := n.SetCapacity(capacity); err != nil {
+				return changed, fmt.Errorf("pod %s: %s", pod.Name, err)
+			}
+			changed = true
+		}
+		if !equalStrings(n.Tiers(), tiers) {
+			n.ReplaceTiers(tiers)
+			changed = true
+		}
+		if addresses != nil && !equalStrings(n.Addresses(), addresses) {
+			n.ReplaceAddresses(addresses)
+			changed = true
+		}
+	}
+	for name, n := range byName {
+		if !seen[name] && n.Active() {
+			cfg.logDebug("k8s: deactivated node %d for missing pod %s\n", n.ID(), name)
+			n.SetActive(false)
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+func (cfg *Config) logDebug(format string, v ...interface{}) {
+	if cfg.LogDebug != nil {
+		cfg.LogDebug(format, v...)
+	}
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, v := range a {
+		if b[i] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Controller keeps a ring.Builder in sync with the pods from a PodSource.
+type Controller struct {
+	builder *ring.Builder
+	source  PodSource
+	cfg     *Config
+}
+
+// NewController creates a Controller that will reconcile the Builder with
+// the pods from the PodSource; call Run or Pass to do the work.
+func NewController(b *ring.Builder, source PodSource, c *Config) *Controller {
+	return &Controller{builder: b, source: source, cfg: resolveConfig(c)}
+}
+
+// Pass reconciles the Builder with the current pods once, calling the
+// BuilderChanged and RingChanged funcs if there were changes.
+func (c *Controller) Pass() error {
+	pods, err := c.source.Pods()
+	if err != nil {
+		return err
+	}
+	changed, err := Reconcile(c.builder, pods, c.cfg)
+	if err != nil || !changed {
+		return err
+	}
+	// Generating the Ring updates the Builder too, so do that first.
+	var r ring.Ring
+	var strictErr error
+	for _, n := range c.builder.Nodes() {
+		if n.Active() {
+			r, strictErr = c.builder.StrictRing()
+			break
+		}
+	}
+	if c.cfg.BuilderChanged != nil {
+		if err = c.cfg.BuilderChanged(c.builder); err != nil {
+			return err
+		}
+	}
+	if strictErr != nil {
+		return strictErr
+	}
+	if r != nil && c.cfg.RingChanged != nil {
+		if err = c.cfg.RingChanged(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run calls Pass on the configured Interval until the stop channel is
+// closed; errors are logged with LogDebug and retried on the next pass.
+func (c *Controller) Run(stop chan struct{}) {
+	for {
+		if err := c.Pass(); err != nil {
+			c.cfg.logDebug("k8s: pass: %s\n", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Duration(c.cfg.Interval) * time.Second):
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package k8s
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gholt/ring"
+)
+
+func TestReconcile(t *testing.T) {
+	b := ring.NewBuilder(64)
+	cfg := &Config{Port: 1234}
+	pods := []*Pod{
+		{Name: "store-0", IP: "10.0.0.1", NodeName: "host1", NodeLabels: map[string]string{"topology.kubernetes.io/zone": "z1"}},
+		{Name: "store-1", IP: "10.0.0.2", NodeName: "host2", NodeLabels: map[string]string{"topology.kubernetes.io/zone": "z2"}, Annotations: map[string]string{"ring.gholt.github.com/capacity": "3"}},
+	}
+	changed, err := Reconcile(b, pods, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Fatal("expected change")
+	}
+	nodes := b.Nodes()
+	if len(nodes) != 2 {
+		t.Fatalf("%d != 2", len(nodes))
+	}
+	n := nodes[1]
+	if n.Meta() != "store-1" || n.Capacity() != 3 || n.Address(0) != "10.0.0.2:1234" || n.Tier(0) != "host2" || n.Tier(1) != "z2" {
+		t.Fatalf("%q %d %q %v", n.Meta(), n.Capacity(), n.Address(0), n.Tiers())
+	}
+	changed, err = Reconcile(b, pods, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed {
+		t.Fatal("expected no change")
+	}
+	// A rescheduled pod keeps its node but gets the new address and tiers.
+	id := n.ID()
+	pods = []*Pod{{Name: "store-1", IP: "10.0.0.3", NodeName: "host3"}}
+	if _, err = Reconcile(b, pods, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Nodes()) != 2 {
+		t.Fatalf("%d != 2", len(b.Nodes()))
+	}
+	n = b.Node(id)
+	if n.Address(0) != "10.0.0.3:1234" || n.Tier(0) != "host3" || n.Capacity() != 1 {
+		t.Fatalf("%q %v %d", n.Address(0), n.Tiers(), n.Capacity())
+	}
+	if b.Nodes()[0].Active() {
+		t.Fatal("missing pod's node should be inactive")
+	}
+	pods[0].Annotations = map[string]string{"ring.gholt.github.com/capacity": "lots"}
+	if _, err = Reconcile(b, pods, cfg); err == nil {
+		t.Fatal("expected error for invalid capacity")
+	}
+}
+
+func TestClient(t *testing.T) {
+	var published []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer tok" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case req.Method == "GET" && req.URL.Path == "/api/v1/namespaces/ns/pods":
+			if req.URL.Query().Get("labelSelector") != "app=store" {
+				t.Errorf("labelSelector %q", req.URL.Query().Get("labelSelector"))
+			}
+			w.Write([]byte(`{"items": [
+				{"metadata": {"name": "store-0"}, "spec": {"nodeName": "host1"}, "status": {"phase": "Running", "podIP": "10.0.0.1"}},
+				{"metadata": {"name": "store-1"}, "spec": {}, "status": {"phase": "Pending"}}
+			]}`))
+		case req.Method == "GET" && req.URL.Path == "/api/v1/nodes/host1":
+			w.Write([]byte(`{"metadata": {"name": "host1", "labels": {"topology.kubernetes.io/zone": "z1"}}}`))
+		case req.Method == "PUT" && req.URL.Path == "/api/v1/namespaces/ns/configmaps/ring":
+			w.WriteHeader(http.StatusNotFound)
+		case req.Method == "POST" && req.URL.Path == "/api/v1/namespaces/ns/configmaps":
+			cm := &configMap{}
+			if err := json.NewDecoder(req.Body).Decode(cm); err != nil {
+				t.Error(err)
+			}
+			published = cm.BinaryData["ring"]
+			w.WriteHeader(http.StatusCreated)
+		default:
+			t.Errorf("unexpected %s %s", req.Method, req.URL.Path)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+	c := NewClient(server.URL, "tok", "ns", "app=store", nil)
+	b := ring.NewBuilder(64)
+	ctrl := NewController(b, c, &Config{RingChanged: c.PublishRing("ring")})
+	if err := ctrl.Pass(); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Nodes()) != 1 || b.Nodes()[0].Tier(1) != "z1" {
+		t.Fatalf("%#v", b.Nodes())
+	}
+	r, err := ring.LoadRing(bytes.NewBuffer(published))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.NodeCount() != 1 {
+		t.Fatalf("%d != 1", r.NodeCount())
+	}
+}
@@ -0,0 +1,100 @@
+package ring
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+)
+
+// DefaultKeyHasher is the name of FNV1aKeyHasher, the KeyHasher of rings not
+// given another with Builder.SetKeyHasher.
+const DefaultKeyHasher = "fnv1a"
+
+var keyHashersLock sync.RWMutex
+var keyHashers = map[string]KeyHasher{DefaultKeyHasher: FNV1aKeyHasher}
+
+// RegisterKeyHasher makes the KeyHasher available by name, for
+// Builder.SetKeyHasher and for loading the builders and rings made with it.
+// Rings record the name rather than the hasher, so every process loading a
+// ring made with a hasher other than the default must register the same
+// hasher under the same name first, such as from an init func; loading fails
+// otherwise, rather than silently placing keys differently.
+func RegisterKeyHasher(name string, hasher KeyHasher) {
+	keyHashersLock.Lock()
+	keyHashers[name] = hasher
+	keyHashersLock.Unlock()
+}
+
+// registeredKeyHasher returns the KeyHasher registered under the name, the
+// default for an empty name.
+func registeredKeyHasher(name string) (KeyHasher, error) {
+	if name == "" {
+		name = DefaultKeyHasher
+	}
+	keyHashersLock.RLock()
+	hasher := keyHashers[name]
+	keyHashersLock.RUnlock()
+	if hasher == nil {
+		return nil, fmt.Errorf("no key hasher registered as %q; see RegisterKeyHasher", name)
+	}
+	return hasher, nil
+}
+
+// KeyHasher returns the name of the KeyHasher the Builder's rings hash keys
+// with; see SetKeyHasher.
+func (b *Builder) KeyHasher() string {
+	if b.keyHasher == "" {
+		return DefaultKeyHasher
+	}
+	return b.keyHasher
+}
+
+// SetKeyHasher sets the KeyHasher, by its name given to RegisterKeyHasher,
+// that the Builder's rings hash keys with for Ring.PartitionForKey. The name
+// is persisted with the Builder and its rings. Changing the hasher of a ring
+// in use moves most keys to other partitions, so it is best set when the
+// Builder is created.
+func (b *Builder) SetKeyHasher(name string) error {
+	if _, err := registeredKeyHasher(name); err != nil {
+		return err
+	}
+	if name == DefaultKeyHasher {
+		name = ""
+	}
+	b.keyHasher = name
+	return nil
+}
+
+func writeKeyHasher(w io.Writer, name string) error {
+	if len(name) > math.MaxInt32 {
+		return fmt.Errorf("%d key hasher name length is too large; max is %d", len(name), math.MaxInt32)
+	}
+	if err := binary.Write(w, binary.BigEndian, int32(len(name))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, name)
+	return err
+}
+
+// readKeyHasher reads a key hasher name written by writeKeyHasher, returning
+// an error if no such hasher is registered.
+func readKeyHasher(r io.Reader) (string, KeyHasher, error) {
+	var length int32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", nil, err
+	}
+	if length < 0 || length > 1024 {
+		return "", nil, fmt.Errorf("invalid key hasher name length %d", length)
+	}
+	byts := make([]byte, length)
+	if _, err := io.ReadFull(r, byts); err != nil {
+		return "", nil, err
+	}
+	hasher, err := registeredKeyHasher(string(byts))
+	if err != nil {
+		return "", nil, err
+	}
+	return string(byts), hasher, nil
+}
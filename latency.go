@@ -0,0 +1,105 @@
+package ring
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencies tracks an exponentially weighted moving average of the round trip
+// latency to each address.
+type latencies struct {
+	weight int
+	lock   sync.RWMutex
+	ewmas  map[string]time.Duration
+}
+
+func newLatencies(weight int) *latencies {
+	return &latencies{weight: weight, ewmas: make(map[string]time.Duration)}
+}
+
+func (l *latencies) observe(addr string, rtt time.Duration) {
+	l.lock.Lock()
+	if ewma, ok := l.ewmas[addr]; ok {
+		l.ewmas[addr] = ewma + (rtt-ewma)*time.Duration(l.weight)/100
+	} else {
+		l.ewmas[addr] = rtt
+	}
+	l.lock.Unlock()
+}
+
+func (l *latencies) get(addr string) (time.Duration, bool) {
+	l.lock.RLock()
+	ewma, ok := l.ewmas[addr]
+	l.lock.RUnlock()
+	return ewma, ok
+}
+
+// prune forgets the addresses not in addrs.
+func (l *latencies) prune(addrs map[string]bool) {
+	l.lock.Lock()
+	for addr := range l.ewmas {
+		if !addrs[addr] {
+			delete(l.ewmas, addr)
+		}
+	}
+	l.lock.Unlock()
+}
+
+// ObserveLatency adds a round trip measurement for the address to its moving
+// average; see Latency. The TCPMsgRing measures each connection handshake it
+// makes itself, and applications with request and acknowledgement messages
+// can add their own measurements to keep the averages current.
+func (t *TCPMsgRing) ObserveLatency(addr string, rtt time.Duration) {
+	t.latencies.observe(addr, rtt)
+}
+
+// Latency returns the moving average of the round trip latency measured to
+// the address, and false if there are no measurements yet; see
+// TCPMsgRingConfig.LatencyWeight.
+func (t *TCPMsgRing) Latency(addr string) (time.Duration, bool) {
+	return t.latencies.get(addr)
+}
+
+// SortByLatency orders the nodes, in place, by the measured latency to their
+// addresses, lowest first. The local node is considered to have no latency
+// and nodes without measurements are placed last, otherwise keeping their
+// order; this makes it suitable for choosing which replica to read from, for
+// example, adapting to actual network conditions.
+func (t *TCPMsgRing) SortByLatency(nodes NodeSlice) {
+	ring, addressIndex := t.ringAndAddressIndex()
+	var localID uint64
+	if ring != nil {
+		if localNode := ring.LocalNode(); localNode != nil {
+			localID = localNode.ID()
+		}
+	}
+	measured := make(map[uint64]bool, len(nodes))
+	rtts := make(map[uint64]time.Duration, len(nodes))
+	for _, node := range nodes {
+		if node.ID() == localID {
+			measured[node.ID()] = true
+			continue
+		}
+		rtts[node.ID()], measured[node.ID()] = t.latencies.get(node.Address(addressIndex))
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		a, b := nodes[i].ID(), nodes[j].ID()
+		if measured[a] != measured[b] {
+			return measured[a]
+		}
+		return rtts[a] < rtts[b]
+	})
+}
+
+// ResponsibleNodesByLatency returns the nodes responsible for the partition,
+// as with Ring.ResponsibleNodes, ordered with SortByLatency.
+func (t *TCPMsgRing) ResponsibleNodesByLatency(partition Partition) NodeSlice {
+	ring := t.Ring()
+	if ring == nil {
+		return nil
+	}
+	nodes := ring.ResponsibleNodes(partition)
+	t.SortByLatency(nodes)
+	return nodes
+}
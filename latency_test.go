@@ -0,0 +1,55 @@
+package ring
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencies(t *testing.T) {
+	l := newLatencies(20)
+	if _, ok := l.get("a"); ok {
+		t.Fatal("expected no measurement")
+	}
+	l.observe("a", 100*time.Millisecond)
+	l.observe("a", 200*time.Millisecond)
+	if v, _ := l.get("a"); v != 120*time.Millisecond {
+		t.Fatal(v)
+	}
+	l.observe("b", time.Millisecond)
+	l.prune(map[string]bool{"b": true})
+	if _, ok := l.get("a"); ok {
+		t.Fatal("expected a to be pruned")
+	}
+	if _, ok := l.get("b"); !ok {
+		t.Fatal("expected b to remain")
+	}
+}
+
+func TestTCPMsgRingSortByLatency(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetReplicaCount(4)
+	var ids []uint64
+	for _, addr := range []string{"127.0.0.1:9991", "127.0.0.1:9992", "127.0.0.1:9993", "127.0.0.1:9994"} {
+		n, err := b.AddNode(true, 1, nil, []string{addr}, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, n.ID())
+	}
+	r := b.Ring()
+	r.SetLocalNode(ids[3])
+	msgring, _ := NewTCPMsgRing(nil)
+	msgring.SetRing(r)
+	msgring.ObserveLatency("127.0.0.1:9991", 30*time.Millisecond)
+	msgring.ObserveLatency("127.0.0.1:9993", 10*time.Millisecond)
+	nodes := msgring.ResponsibleNodesByLatency(0)
+	if len(nodes) != 4 {
+		t.Fatal(len(nodes))
+	}
+	// Local first, then by latency, then the unmeasured.
+	for i, id := range []uint64{ids[3], ids[2], ids[0], ids[1]} {
+		if nodes[i].ID() != id {
+			t.Fatalf("%d: %d != %d", i, nodes[i].ID(), id)
+		}
+	}
+}
@@ -45,8 +45,8 @@ func helperTestNewRingBuilder(t *testing.T, zones int32) {
 	b := NewBuilder(64)
 	b.SetReplicaCount(3)
 	nodeID := uint64(0)
-	//capacity := uint32(1)
-	capacity := uint32(100)
+	//capacity := uint64(1)
+	capacity := uint64(100)
 	for zone := int32(0); zone < zones; zone++ {
 		for server := int32(0); server < 50; server++ {
 			for device := int32(0); device < 2; device++ {
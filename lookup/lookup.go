@@ -0,0 +1,528 @@
+// Package lookup is a read-only view of a persisted ring for clients that
+// only need to find which nodes hold a key; it loads files written by
+// Ring.Persist in the ring package and answers partition and responsible node
+// lookups, with no builder, messaging, or network code, so binaries embedding
+// it stay small.
+//
+// Lookups agree with those of the ring package for the same ring file,
+// including the deterministic handoff node substituted for any unassigned
+// replica.
+package lookup
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sync"
+)
+
+// RINGVERSION is the ring file format version this package reads; it matches
+// ring.RINGVERSION.
+const RINGVERSION = "RINGv00000000002"
+
+// ringVersion1 is the ring file format of the ring package's first release,
+// which Load still reads; its node capacities are 32 bit and it lacks network
+// zones, address roles, and partition modes.
+const ringVersion1 = "RINGv00000000001"
+
+// Ring is an immutable ring loaded with Load.
+type Ring struct {
+	version                       int64
+	config                        []byte
+	partitionBitCount             uint16
+	nodes                         []*Node
+	replicaToPartitionToNodeIndex [][]int32
+	addressRoles                  []string
+	partitionModes                map[uint32]PartitionMode
+	keyHasherName                 string
+	keyHasher                     func(key []byte) uint64
+}
+
+// DefaultKeyHasher is the name of the 64 bit FNV-1a hasher, the key hasher of
+// rings not given another; it matches ring.DefaultKeyHasher.
+const DefaultKeyHasher = "fnv1a"
+
+var keyHashersLock sync.RWMutex
+var keyHashers = map[string]func(key []byte) uint64{DefaultKeyHasher: fnv1a}
+
+// RegisterKeyHasher makes the key hasher available by name for loading rings
+// made with it, as with ring.RegisterKeyHasher; the hasher must be the one
+// registered under the name with the ring package. Load fails for a ring
+// whose key hasher is not registered.
+func RegisterKeyHasher(name string, hasher func(key []byte) uint64) {
+	keyHashersLock.Lock()
+	keyHashers[name] = hasher
+	keyHashersLock.Unlock()
+}
+
+// Node is a node of a Ring; its methods match those of ring.Node.
+type Node struct {
+	id          uint64
+	active      bool
+	capacity    uint64
+	tiers       []string
+	addresses   []string
+	meta        string
+	config      []byte
+	networkZone string
+}
+
+// Load reads a Ring persisted by Ring.Persist in the ring package.
+func Load(rd io.Reader) (*Ring, error) {
+	gr, err := gzip.NewReader(rd)
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close() // does not close the underlying reader
+	header := make([]byte, 16)
+	if _, err = io.ReadFull(gr, header); err != nil {
+		return nil, err
+	}
+	v1 := string(header) == ringVersion1
+	if string(header) != RINGVERSION && !v1 {
+		return nil, fmt.Errorf("unknown header %s", string(header))
+	}
+	r := &Ring{}
+	if err = binary.Read(gr, binary.BigEndian, &r.version); err != nil {
+		return nil, err
+	}
+	if r.config, err = readBytes(gr); err != nil {
+		return nil, err
+	}
+	// The local node index is only meaningful to the ring package.
+	var localNodeIndex int32
+	if err = binary.Read(gr, binary.BigEndian, &localNodeIndex); err != nil {
+		return nil, err
+	}
+	if err = binary.Read(gr, binary.BigEndian, &r.partitionBitCount); err != nil {
+		return nil, err
+	}
+	var count int32
+	if err = binary.Read(gr, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+	tiers := make([][]string, count)
+	for level := range tiers {
+		if err = binary.Read(gr, binary.BigEndian, &count); err != nil {
+			return nil, err
+		}
+		tiers[level] = make([]string, count)
+		for i := range tiers[level] {
+			if tiers[level][i], err = readString(gr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err = binary.Read(gr, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+	r.nodes = make([]*Node, count)
+	for i := range r.nodes {
+		n := &Node{}
+		if err = binary.Read(gr, binary.BigEndian, &n.id); err != nil {
+			return nil, err
+		}
+		var inactive byte
+		if err = binary.Read(gr, binary.BigEndian, &inactive); err != nil {
+			return nil, err
+		}
+		n.active = inactive != 1
+		if v1 {
+			var capacity uint32
+			if err = binary.Read(gr, binary.BigEndian, &capacity); err != nil {
+				return nil, err
+			}
+			n.capacity = uint64(capacity)
+		} else if err = binary.Read(gr, binary.BigEndian, &n.capacity); err != nil {
+			return nil, err
+		}
+		if err = binary.Read(gr, binary.BigEndian, &count); err != nil {
+			return nil, err
+		}
+		tierIndexes := make([]int32, count)
+		if err = binary.Read(gr, binary.BigEndian, tierIndexes); err != nil {
+			return nil, err
+		}
+		n.tiers = make([]string, len(tierIndexes))
+		for level, index := range tierIndexes {
+			if index < 0 || level >= len(tiers) || int(index) >= len(tiers[level]) {
+				return nil, fmt.Errorf("node %d has an invalid tier index %d at level %d", n.id, index, level)
+			}
+			if index > 0 {
+				n.tiers[level] = tiers[level][index]
+			}
+		}
+		if err = binary.Read(gr, binary.BigEndian, &count); err != nil {
+			return nil, err
+		}
+		n.addresses = make([]string, count)
+		for j := range n.addresses {
+			if n.addresses[j], err = readString(gr); err != nil {
+				return nil, err
+			}
+		}
+		if n.meta, err = readString(gr); err != nil {
+			return nil, err
+		}
+		if n.config, err = readBytes(gr); err != nil {
+			return nil, err
+		}
+		if !v1 {
+			if n.networkZone, err = readString(gr); err != nil {
+				return nil, err
+			}
+		}
+		r.nodes[i] = n
+	}
+	if err = binary.Read(gr, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+	r.replicaToPartitionToNodeIndex = make([][]int32, count)
+	for replica := range r.replicaToPartitionToNodeIndex {
+		if err = binary.Read(gr, binary.BigEndian, &count); err != nil {
+			return nil, err
+		}
+		if count != 1<<r.partitionBitCount {
+			return nil, fmt.Errorf("replica %d has %d partitions; expected %d", replica, count, 1<<r.partitionBitCount)
+		}
+		partitionToNodeIndex := make([]int32, count)
+		if err = binary.Read(gr, binary.BigEndian, partitionToNodeIndex); err != nil {
+			return nil, err
+		}
+		for _, nodeIndex := range partitionToNodeIndex {
+			if nodeIndex >= int32(len(r.nodes)) {
+				return nil, fmt.Errorf("replica %d assigned to node index %d; only %d nodes", replica, nodeIndex, len(r.nodes))
+			}
+		}
+		r.replicaToPartitionToNodeIndex[replica] = partitionToNodeIndex
+	}
+	if v1 {
+		return r, nil
+	}
+	if err = binary.Read(gr, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+	r.addressRoles = make([]string, count)
+	for i := range r.addressRoles {
+		if r.addressRoles[i], err = readString(gr); err != nil {
+			return nil, err
+		}
+	}
+	if err = binary.Read(gr, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+	if count < 0 {
+		return nil, fmt.Errorf("invalid partition mode count %d", count)
+	}
+	if count > 0 {
+		r.partitionModes = make(map[uint32]PartitionMode, count)
+	}
+	var modeBuf [5]byte
+	for i := int32(0); i < count; i++ {
+		if _, err = io.ReadFull(gr, modeBuf[:]); err != nil {
+			return nil, err
+		}
+		r.partitionModes[binary.BigEndian.Uint32(modeBuf[:])] = PartitionMode(modeBuf[4])
+	}
+	// The usable capacities are only meaningful to the ring package.
+	if _, err = io.CopyN(ioutil.Discard, gr, 8*int64(len(r.nodes))); err != nil {
+		return nil, err
+	}
+	if r.keyHasherName, err = readString(gr); err != nil {
+		return nil, err
+	}
+	name := r.keyHasherName
+	if name == "" {
+		name = DefaultKeyHasher
+	}
+	keyHashersLock.RLock()
+	r.keyHasher = keyHashers[name]
+	keyHashersLock.RUnlock()
+	if r.keyHasher == nil {
+		return nil, fmt.Errorf("no key hasher registered as %q; see RegisterKeyHasher", name)
+	}
+	return r, nil
+}
+
+func readBytes(r io.Reader) ([]byte, error) {
+	var length int32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("invalid length %d", length)
+	}
+	byts := make([]byte, length)
+	if _, err := io.ReadFull(r, byts); err != nil {
+		return nil, err
+	}
+	return byts, nil
+}
+
+func readString(r io.Reader) (string, error) {
+	byts, err := readBytes(r)
+	return string(byts), err
+}
+
+// Version is the time.Now().UnixNano() of when the Ring data was
+// established; see ring.Ring.Version.
+func (r *Ring) Version() int64 {
+	return r.version
+}
+
+// Config returns the raw encoded global configuration.
+func (r *Ring) Config() []byte {
+	return r.config
+}
+
+// PartitionBitCount is the number of bits of a key hash that select a
+// partition; there are 1<<PartitionBitCount partitions.
+func (r *Ring) PartitionBitCount() uint16 {
+	return r.partitionBitCount
+}
+
+// ReplicaCount specifies how many replicas the Ring has.
+func (r *Ring) ReplicaCount() int {
+	return len(r.replicaToPartitionToNodeIndex)
+}
+
+// Partition returns the partition for the 64 bit hash of a key; the top
+// PartitionBitCount bits. See PartitionForKey to hash the key as well.
+func (r *Ring) Partition(keyHash uint64) uint32 {
+	if r.partitionBitCount == 0 {
+		return 0
+	}
+	return uint32(keyHash >> (64 - r.partitionBitCount))
+}
+
+// PartitionForKey returns the partition of the key, hashed with the ring's
+// key hasher; see KeyHasher.
+func (r *Ring) PartitionForKey(key []byte) uint32 {
+	hasher := r.keyHasher
+	if hasher == nil {
+		hasher = fnv1a
+	}
+	return r.Partition(hasher(key))
+}
+
+// KeyHasher returns the name of the key hasher PartitionForKey uses, as
+// recorded in the ring file; see ring.Ring.KeyHasher.
+func (r *Ring) KeyHasher() string {
+	if r.keyHasherName == "" {
+		return DefaultKeyHasher
+	}
+	return r.keyHasherName
+}
+
+// fnv1a is the 64 bit FNV-1a hash, matching ring.FNV1aKeyHasher.
+func fnv1a(key []byte) uint64 {
+	const offset64 = 14695981039346656037
+	const prime64 = 1099511628211
+	hash := uint64(offset64)
+	for _, c := range key {
+		hash ^= uint64(c)
+		hash *= prime64
+	}
+	return hash
+}
+
+// Nodes returns the nodes the Ring references.
+func (r *Ring) Nodes() []*Node {
+	nodes := make([]*Node, len(r.nodes))
+	copy(nodes, r.nodes)
+	return nodes
+}
+
+// Node returns the node identified, or nil if there is no such node.
+func (r *Ring) Node(nodeID uint64) *Node {
+	for _, n := range r.nodes {
+		if n.id == nodeID {
+			return n
+		}
+	}
+	return nil
+}
+
+// AddressRoles returns the names given to the node address indexes.
+func (r *Ring) AddressRoles() []string {
+	roles := make([]string, len(r.addressRoles))
+	copy(roles, r.addressRoles)
+	return roles
+}
+
+// AddressIndex returns the index to use with Node.Address for the named role,
+// or -1 if the role is not known.
+func (r *Ring) AddressIndex(role string) int {
+	for i, v := range r.addressRoles {
+		if v == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// PartitionMode restricts the use of a partition; its values match those of
+// ring.PartitionMode.
+type PartitionMode byte
+
+const (
+	PartitionReadWrite PartitionMode = iota
+	PartitionReadOnly
+	PartitionQuiesced
+)
+
+// Readable returns true if the mode allows reads.
+func (m PartitionMode) Readable() bool {
+	return m == PartitionReadWrite || m == PartitionReadOnly
+}
+
+// Writable returns true if the mode allows writes.
+func (m PartitionMode) Writable() bool {
+	return m == PartitionReadWrite
+}
+
+// PartitionMode returns the mode of the partition; see
+// ring.Ring.PartitionMode.
+func (r *Ring) PartitionMode(partition uint32) PartitionMode {
+	return r.partitionModes[partition]
+}
+
+// ResponsibleNodes returns the nodes responsible for the replicas of the
+// partition, in replica order, exactly as ring.Ring.ResponsibleNodes would.
+//
+// Note that the partition value is not bounds checked; an invalid partition
+// will cause a panic.
+func (r *Ring) ResponsibleNodes(partition uint32) []*Node {
+	unassigned := 0
+	for _, partitionToNodeIndex := range r.replicaToPartitionToNodeIndex {
+		if partitionToNodeIndex[partition] < 0 {
+			unassigned++
+		}
+	}
+	var substitutes []*Node
+	if unassigned > 0 {
+		substitutes = r.handoffNodes(partition, unassigned)
+	}
+	nodes := make([]*Node, 0, len(r.replicaToPartitionToNodeIndex))
+	for _, partitionToNodeIndex := range r.replicaToPartitionToNodeIndex {
+		if nodeIndex := partitionToNodeIndex[partition]; nodeIndex >= 0 {
+			nodes = append(nodes, r.nodes[nodeIndex])
+		} else if len(substitutes) > 0 {
+			nodes = append(nodes, substitutes[0])
+			substitutes = substitutes[1:]
+		}
+	}
+	return nodes
+}
+
+// handoffNodes is ring.Ring.HandoffNodes with ring.HandoffDeterministic; the
+// two must stay in agreement.
+func (r *Ring) handoffNodes(partition uint32, count int) []*Node {
+	responsible := make(map[int32]bool, len(r.replicaToPartitionToNodeIndex))
+	for _, partitionToNodeIndex := range r.replicaToPartitionToNodeIndex {
+		responsible[partitionToNodeIndex[partition]] = true
+	}
+	var nodes []*Node
+	var keys []float64
+	for i, n := range r.nodes {
+		if !n.active || n.capacity == 0 || responsible[int32(i)] {
+			continue
+		}
+		u := float64(mix64(uint64(partition)<<32^n.id^0x9e3779b97f4a7c15)>>11) / (1 << 53)
+		if u == 0 {
+			u = math.SmallestNonzeroFloat64
+		}
+		key := math.Log(u) / float64(n.capacity)
+		j := len(nodes)
+		for j > 0 && keys[j-1] < key {
+			j--
+		}
+		if j >= count {
+			continue
+		}
+		nodes = append(nodes, nil)
+		keys = append(keys, 0)
+		copy(nodes[j+1:], nodes[j:])
+		copy(keys[j+1:], keys[j:])
+		nodes[j] = n
+		keys[j] = key
+		if len(nodes) > count {
+			nodes = nodes[:count]
+			keys = keys[:count]
+		}
+	}
+	return nodes
+}
+
+// mix64 is the splitmix64 finalizer, as used by the ring package.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// ID uniquely identifies the node; it is never zero.
+func (n *Node) ID() uint64 {
+	return n.id
+}
+
+// Active indicates whether the node should be in use.
+func (n *Node) Active() bool {
+	return n.active
+}
+
+// Capacity is the node's share of data relative to the other nodes.
+func (n *Node) Capacity() uint64 {
+	return n.capacity
+}
+
+// Tiers returns the node's tier values at each level.
+func (n *Node) Tiers() []string {
+	tiers := make([]string, len(n.tiers))
+	copy(tiers, n.tiers)
+	return tiers
+}
+
+// Tier returns the node's tier value at the level.
+func (n *Node) Tier(level int) string {
+	if len(n.tiers) <= level {
+		return ""
+	}
+	return n.tiers[level]
+}
+
+// Addresses returns the node's addresses.
+func (n *Node) Addresses() []string {
+	addresses := make([]string, len(n.addresses))
+	copy(addresses, n.addresses)
+	return addresses
+}
+
+// Address returns the node's address at the index, or "" if none.
+func (n *Node) Address(index int) string {
+	if len(n.addresses) <= index {
+		return ""
+	}
+	return n.addresses[index]
+}
+
+// Meta is additional information for the node.
+func (n *Node) Meta() string {
+	return n.meta
+}
+
+// Config contains the raw configuration bytes for the node.
+func (n *Node) Config() []byte {
+	return n.config
+}
+
+// NetworkZone names the network the node is reached over.
+func (n *Node) NetworkZone() string {
+	return n.networkZone
+}
@@ -0,0 +1,180 @@
+package lookup
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/gholt/ring"
+)
+
+func TestLoad(t *testing.T) {
+	if RINGVERSION != ring.RINGVERSION {
+		t.Fatalf("%s != %s", RINGVERSION, ring.RINGVERSION)
+	}
+	b := ring.NewBuilder(64)
+	b.SetReplicaCount(3)
+	b.SetConfig([]byte("config"))
+	b.SetAddressRoles([]string{"client", "replication"})
+	for i := 0; i < 8; i++ {
+		if _, err := b.AddNode(i != 7, uint64(i+1), []string{"server", "zone"}, []string{"1.2.3.4:5", "6.7.8.9:10"}, "meta", []byte("nodeconfig")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Ring()
+	if err := b.SetPartitionMode(1, ring.PartitionReadOnly); err != nil {
+		t.Fatal(err)
+	}
+	r := b.Ring()
+	buf := bytes.NewBuffer(nil)
+	if err := r.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	l, err := Load(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Version() != r.Version() {
+		t.Fatalf("%d != %d", l.Version(), r.Version())
+	}
+	if string(l.Config()) != "config" {
+		t.Fatal(string(l.Config()))
+	}
+	if l.PartitionBitCount() != r.PartitionBitCount() || l.ReplicaCount() != 3 {
+		t.Fatalf("%d %d", l.PartitionBitCount(), l.ReplicaCount())
+	}
+	if len(r.PartitionModes()) == 0 {
+		t.Fatal("no partition modes")
+	}
+	for partition := uint32(0); partition < 1<<r.PartitionBitCount(); partition++ {
+		if want := r.PartitionMode(ring.Partition(partition)); byte(l.PartitionMode(partition)) != byte(want) {
+			t.Fatalf("partition %d: %d != %d", partition, l.PartitionMode(partition), want)
+		}
+	}
+	if l.AddressIndex("replication") != 1 || l.AddressIndex("other") != -1 || len(l.AddressRoles()) != 2 {
+		t.Fatal(l.AddressRoles())
+	}
+	nodes := r.Nodes()
+	if len(l.Nodes()) != len(nodes) {
+		t.Fatalf("%d != %d", len(l.Nodes()), len(nodes))
+	}
+	for i, n := range l.Nodes() {
+		if n.ID() != nodes[i].ID() || n.Active() != nodes[i].Active() || n.Capacity() != nodes[i].Capacity() || n.Tier(1) != "zone" || n.Address(1) != "6.7.8.9:10" || n.Meta() != "meta" || string(n.Config()) != "nodeconfig" {
+			t.Fatalf("%#v", n)
+		}
+		if l.Node(n.ID()) != n {
+			t.Fatal(n.ID())
+		}
+	}
+	if l.Node(0) != nil {
+		t.Fatal(l.Node(0))
+	}
+	for partition := uint32(0); partition < 1<<r.PartitionBitCount(); partition++ {
+		want := r.ResponsibleNodes(ring.Partition(partition))
+		got := l.ResponsibleNodes(partition)
+		if len(got) != len(want) {
+			t.Fatalf("%d != %d", len(got), len(want))
+		}
+		for i := range want {
+			if got[i].ID() != want[i].ID() {
+				t.Fatalf("partition %d replica %d: %d != %d", partition, i, got[i].ID(), want[i].ID())
+			}
+		}
+		// The handoff choice must agree with the ring package's.
+		want = r.HandoffNodes(ring.Partition(partition), 2, ring.HandoffDeterministic)
+		got = l.handoffNodes(partition, 2)
+		if len(got) != len(want) {
+			t.Fatalf("%d != %d", len(got), len(want))
+		}
+		for i := range want {
+			if got[i].ID() != want[i].ID() {
+				t.Fatalf("partition %d handoff %d: %d != %d", partition, i, got[i].ID(), want[i].ID())
+			}
+		}
+	}
+	if p := l.Partition(0xffffffffffffffff); p != 1<<l.PartitionBitCount()-1 {
+		t.Fatal(p)
+	}
+	for _, key := range []string{"", "a", "some/object/name"} {
+		if p := l.PartitionForKey([]byte(key)); ring.Partition(p) != r.PartitionForKey([]byte(key)) {
+			t.Fatalf("%q: %d != %d", key, p, r.PartitionForKey([]byte(key)))
+		}
+	}
+	if l.KeyHasher() != DefaultKeyHasher || DefaultKeyHasher != ring.DefaultKeyHasher {
+		t.Fatal(l.KeyHasher())
+	}
+}
+
+func TestLoadKeyHasher(t *testing.T) {
+	zero := func(key []byte) uint64 { return 0 }
+	ring.RegisterKeyHasher("test-zero", zero)
+	b := ring.NewBuilder(64)
+	if _, err := b.AddNode(true, 1, nil, nil, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetKeyHasher("test-zero"); err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := b.Ring().Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	byts := buf.Bytes()
+	if _, err := Load(bytes.NewReader(byts)); err == nil {
+		t.Fatal("expected error for an unregistered key hasher")
+	}
+	RegisterKeyHasher("test-zero", zero)
+	l, err := Load(bytes.NewReader(byts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := l.PartitionForKey([]byte("a")); p != 0 || l.KeyHasher() != "test-zero" {
+		t.Fatal(p, l.KeyHasher())
+	}
+}
+
+func TestLoadBadHeader(t *testing.T) {
+	b := ring.NewBuilder(64)
+	if _, err := b.AddNode(true, 1, nil, nil, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := b.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(buf); err == nil {
+		t.Fatal("builder file loaded as a ring")
+	}
+}
+
+func TestLoadVersion1(t *testing.T) {
+	// ../testdata/ring_v1.ring was persisted by the ring package's first
+	// release.
+	byts, err := ioutil.ReadFile("../testdata/ring_v1.ring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := Load(bytes.NewReader(byts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr, err := ring.LoadRing(bytes.NewReader(byts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Nodes()) != 4 || r.Nodes()[3].Capacity() != 400 || r.Nodes()[3].Active() {
+		t.Fatalf("%#v", r.Nodes())
+	}
+	for partition := uint32(0); partition < 1<<r.PartitionBitCount(); partition++ {
+		nodes := r.ResponsibleNodes(partition)
+		rnodes := rr.ResponsibleNodes(ring.Partition(partition))
+		if len(nodes) != len(rnodes) {
+			t.Fatal(partition, len(nodes), len(rnodes))
+		}
+		for i, n := range nodes {
+			if n.ID() != rnodes[i].ID() {
+				t.Fatal(partition, i, n.ID(), rnodes[i].ID())
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package ring
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// MaxMovePercentage is the most partition replicas, as a percentage of all
+// the partition replicas, the rebalance of any one Ring call may move; 0
+// means no limit. See SetMaxMovePercentage.
+func (b *Builder) MaxMovePercentage() byte {
+	return b.maxMovePercentage
+}
+
+// SetMaxMovePercentage caps how many partition replicas the rebalance of any
+// one Ring or RingWithMoveBudget call may move, as a percentage of all the
+// partition replicas, so a large capacity change is rolled out over several
+// rings, letting replication catch up in between; at least one replica may
+// always move. Values over 100 are treated as 100, and 0, the default, means
+// no limit. The cap applies on top of the MoveWait, which keeps each replica
+// moved from moving again until that many minutes have passed, and with
+// RingWithMoveBudget the smaller budget applies.
+func (b *Builder) SetMaxMovePercentage(percentage byte) {
+	if percentage > 100 {
+		percentage = 100
+	}
+	b.maxMovePercentage = percentage
+}
+
+// movePercentageBudget returns how many partition replicas are the
+// percentage given of all the Builder's partition replicas, at least 1.
+func (b *Builder) movePercentageBudget(percentage int) int {
+	replicas := len(b.replicaToPartitionToNodeIndex) * len(b.replicaToPartitionToNodeIndex[0])
+	budget := replicas * percentage / 100
+	if budget < 1 {
+		budget = 1
+	}
+	return budget
+}
+
+func (b *Builder) writeMaxMovePercentage(w io.Writer) error {
+	return binary.Write(w, binary.BigEndian, b.maxMovePercentage)
+}
+
+func (b *Builder) readMaxMovePercentage(r io.Reader) error {
+	if err := binary.Read(r, binary.BigEndian, &b.maxMovePercentage); err != nil {
+		return err
+	}
+	if b.maxMovePercentage > 100 {
+		b.maxMovePercentage = 100
+	}
+	return nil
+}
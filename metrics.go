@@ -0,0 +1,201 @@
+package ring
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// builderMetricsBuckets are the upper bounds, in seconds, of the rebalance
+// duration histogram buckets.
+var builderMetricsBuckets = []float64{.001, .01, .1, .5, 1, 5, 10, 30, 60}
+
+// BuilderMetrics collects metrics about the rebalances done by the Builders
+// it is given to with Builder.SetMetrics, for export in the Prometheus text
+// format with WritePrometheus or a MetricsHTTPHandler, so dashboards can
+// correlate ring changes with the replication traffic they cause. It is safe
+// to write the metrics while a Builder is rebalancing.
+type BuilderMetrics struct {
+	lock            sync.Mutex
+	rebalances      uint64
+	skipped         uint64
+	resizes         uint64
+	durationSum     float64
+	durationBuckets []uint64
+	moves           map[RebalanceReason]uint64
+	// The gauges are of the last rebalance.
+	partitionBitCount      uint16
+	maxUnderNodePercentage float64
+	maxOverNodePercentage  float64
+	withinPointsAllowed    bool
+}
+
+// NewBuilderMetrics creates an empty BuilderMetrics.
+func NewBuilderMetrics() *BuilderMetrics {
+	return &BuilderMetrics{
+		durationBuckets: make([]uint64, len(builderMetricsBuckets)),
+		moves:           make(map[RebalanceReason]uint64),
+	}
+}
+
+// SetMetrics sets the BuilderMetrics to record each call to Ring in; nil stops
+// the recording. Metrics are not persisted with the Builder.
+func (b *Builder) SetMetrics(metrics *BuilderMetrics) {
+	b.metrics = metrics
+}
+
+func (m *BuilderMetrics) observe(report *RebalanceReport, partitionBitCount uint16, duration time.Duration) {
+	m.lock.Lock()
+	m.rebalances++
+	if report.Skipped {
+		m.skipped++
+	}
+	if report.Resized {
+		m.resizes++
+	}
+	seconds := duration.Seconds()
+	m.durationSum += seconds
+	for i, bound := range builderMetricsBuckets {
+		if seconds <= bound {
+			m.durationBuckets[i]++
+		}
+	}
+	m.moves[RebalanceUnassigned] += uint64(report.UnassignedMoves)
+	m.moves[RebalanceDeactivated] += uint64(report.DeactivatedMoves)
+	m.moves[RebalanceSameNode] += uint64(report.SameNodeMoves)
+	m.moves[RebalanceSameTier] += uint64(report.SameTierMoves)
+	m.moves[RebalanceOverweight] += uint64(report.OverweightMoves)
+	m.moves[RebalanceAffinity] += uint64(report.AffinityMoves)
+	m.moves[RebalanceRegion] += uint64(report.RegionMoves)
+	m.partitionBitCount = partitionBitCount
+	m.maxUnderNodePercentage = report.MaxUnderNodePercentage
+	m.maxOverNodePercentage = report.MaxOverNodePercentage
+	m.withinPointsAllowed = report.WithinPointsAllowed
+	m.lock.Unlock()
+}
+
+// WritePrometheus writes the metrics in the Prometheus text exposition
+// format, all named with the ring_builder_ prefix.
+func (m *BuilderMetrics) WritePrometheus(w io.Writer) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	bw := bufio.NewWriter(w)
+	metricHeader(bw, "ring_builder_rebalances_total", "counter", "Calls to Builder.Ring, including those whose rebalance was skipped.")
+	fmt.Fprintf(bw, "ring_builder_rebalances_total %d\n", m.rebalances)
+	metricHeader(bw, "ring_builder_rebalances_skipped_total", "counter", "Rebalances skipped because of the rebalance trigger.")
+	fmt.Fprintf(bw, "ring_builder_rebalances_skipped_total %d\n", m.skipped)
+	metricHeader(bw, "ring_builder_resizes_total", "counter", "Rebalances that grew the partition count.")
+	fmt.Fprintf(bw, "ring_builder_resizes_total %d\n", m.resizes)
+	metricHeader(bw, "ring_builder_rebalance_duration_seconds", "histogram", "Time taken by Builder.Ring.")
+	for i, bound := range builderMetricsBuckets {
+		fmt.Fprintf(bw, "ring_builder_rebalance_duration_seconds_bucket{le=\"%g\"} %d\n", bound, m.durationBuckets[i])
+	}
+	fmt.Fprintf(bw, "ring_builder_rebalance_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.rebalances)
+	fmt.Fprintf(bw, "ring_builder_rebalance_duration_seconds_sum %g\n", m.durationSum)
+	fmt.Fprintf(bw, "ring_builder_rebalance_duration_seconds_count %d\n", m.rebalances)
+	metricHeader(bw, "ring_builder_partition_replicas_moved_total", "counter", "Partition replicas assigned by rebalances, by reason.")
+	for _, reason := range []RebalanceReason{RebalanceUnassigned, RebalanceDeactivated, RebalanceSameNode, RebalanceSameTier, RebalanceOverweight, RebalanceAffinity, RebalanceRegion} {
+		fmt.Fprintf(bw, "ring_builder_partition_replicas_moved_total{reason=%q} %d\n", reason.String(), m.moves[reason])
+	}
+	metricHeader(bw, "ring_builder_partition_bit_count", "gauge", "Partition bit count after the last rebalance.")
+	fmt.Fprintf(bw, "ring_builder_partition_bit_count %d\n", m.partitionBitCount)
+	metricHeader(bw, "ring_builder_max_under_node_percentage", "gauge", "Most percentage points any node was underweight after the last rebalance.")
+	fmt.Fprintf(bw, "ring_builder_max_under_node_percentage %g\n", m.maxUnderNodePercentage)
+	metricHeader(bw, "ring_builder_max_over_node_percentage", "gauge", "Most percentage points any node was overweight after the last rebalance.")
+	fmt.Fprintf(bw, "ring_builder_max_over_node_percentage %g\n", m.maxOverNodePercentage)
+	within := 0
+	if m.withinPointsAllowed {
+		within = 1
+	}
+	metricHeader(bw, "ring_builder_within_points_allowed", "gauge", "1 if the last rebalance left every node within the points allowed.")
+	fmt.Fprintf(bw, "ring_builder_within_points_allowed %d\n", within)
+	return bw.Flush()
+}
+
+func metricHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// MetricsHTTPHandlerConfig represents the set of values for configuring a
+// MetricsHTTPHandler. Each of Builder and MsgRing is optional; the handler
+// exports whichever are given.
+type MetricsHTTPHandlerConfig struct {
+	Builder *BuilderMetrics
+	// MsgRing, if set, will have its Totals exported as counters named with
+	// the ring_tcp_msg_ring_ prefix. Reading the Totals resets nothing, so
+	// Stats may still be read by others.
+	MsgRing *TCPMsgRing
+}
+
+// MetricsHTTPHandler is an http.Handler serving the Builder and TCPMsgRing
+// metrics in the Prometheus text exposition format, for a Prometheus server
+// to scrape.
+type MetricsHTTPHandler struct {
+	builder *BuilderMetrics
+	msgRing *TCPMsgRing
+}
+
+// NewMetricsHTTPHandler creates a MetricsHTTPHandler based on the
+// configuration given.
+func NewMetricsHTTPHandler(c *MetricsHTTPHandlerConfig) *MetricsHTTPHandler {
+	cfg := &MetricsHTTPHandlerConfig{}
+	if c != nil {
+		*cfg = *c
+	}
+	return &MetricsHTTPHandler{builder: cfg.Builder, msgRing: cfg.MsgRing}
+}
+
+func (h *MetricsHTTPHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if h.builder != nil {
+		if err := h.builder.WritePrometheus(w); err != nil {
+			return
+		}
+	}
+	if h.msgRing != nil {
+		h.writeMsgRingStats(w)
+	}
+}
+
+// writeMsgRingStats writes the MsgRing's Totals, in TCPMsgRingStats field
+// order.
+func (h *MetricsHTTPHandler) writeMsgRingStats(w io.Writer) {
+	totals := h.msgRing.Totals()
+	st := reflect.TypeOf(TCPMsgRingStats{})
+	bw := bufio.NewWriter(w)
+	for i := 0; i < st.NumField(); i++ {
+		f := st.Field(i)
+		if f.Type.Kind() != reflect.Int32 {
+			continue
+		}
+		name := "ring_tcp_msg_ring_" + snakeCase(f.Name) + "_total"
+		fmt.Fprintf(bw, "# TYPE %s counter\n%s %d\n", name, name, totals[f.Name])
+	}
+	bw.Flush()
+}
+
+// snakeCase converts a Go field name, such as MsgToAddrQueues, to a metric
+// name part, such as msg_to_addr_queues.
+func snakeCase(s string) string {
+	var rv []rune
+	runes := []rune(s)
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+				rv = append(rv, '_')
+			}
+			r = unicode.ToLower(r)
+		}
+		rv = append(rv, r)
+	}
+	return string(rv)
+}
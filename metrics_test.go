@@ -0,0 +1,73 @@
+package ring
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBuilderMetrics(t *testing.T) {
+	m := NewBuilderMetrics()
+	b := NewBuilder(64)
+	b.SetMetrics(m)
+	for i := 0; i < 3; i++ {
+		if _, err := b.AddNode(true, 1, nil, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Ring()
+	var buf bytes.Buffer
+	if err := m.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"ring_builder_rebalances_total 1\n",
+		"ring_builder_resizes_total 1\n",
+		"ring_builder_rebalance_duration_seconds_count 1\n",
+		`ring_builder_partition_replicas_moved_total{reason="unassigned"} `,
+		"ring_builder_within_points_allowed ",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("%q not in %s", want, buf.String())
+		}
+	}
+}
+
+func TestMetricsHTTPHandler(t *testing.T) {
+	msgRing, err := NewTCPMsgRing(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewMetricsHTTPHandler(&MetricsHTTPHandlerConfig{Builder: NewBuilderMetrics(), MsgRing: msgRing})
+	get := func() string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		if w.Code != http.StatusOK {
+			t.Fatal(w.Code)
+		}
+		return w.Body.String()
+	}
+	msgRing.MsgToNode(newTestMsg(), 1, 0)
+	if s := get(); !strings.Contains(s, "ring_builder_rebalances_total 0\n") || !strings.Contains(s, "ring_tcp_msg_ring_msg_to_node_no_rings_total 1\n") {
+		t.Fatal(s)
+	}
+	// The counters accumulate, and reading them leaves the Stats for others.
+	msgRing.MsgToNode(newTestMsg(), 1, 0)
+	if s := get(); !strings.Contains(s, "ring_tcp_msg_ring_msg_to_node_no_rings_total 2\n") {
+		t.Fatal(s)
+	}
+	if s := msgRing.Stats(false); s.MsgToNodeNoRings != 2 {
+		t.Fatal(s.MsgToNodeNoRings)
+	}
+	if s := msgRing.Stats(false); s.MsgToNodeNoRings != 0 {
+		t.Fatal(s.MsgToNodeNoRings)
+	}
+	if s := get(); !strings.Contains(s, "ring_tcp_msg_ring_msg_to_node_no_rings_total 2\n") {
+		t.Fatal(s)
+	}
+	if s := snakeCase("MsgToAddrQueues"); s != "msg_to_addr_queues" {
+		t.Fatal(s)
+	}
+}
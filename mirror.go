@@ -0,0 +1,143 @@
+package ring
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// MirrorConfig describes outbound messages for a TCPMsgRing to copy to a
+// shadow cluster, such as one running a new storage version, so it sees
+// production traffic without taking part in the primary cluster's
+// replication; see TCPMsgRing.SetMirror.
+type MirrorConfig struct {
+	// Ring is the shadow cluster's ring. Messages to a node are copied to
+	// the shadow node with the same ID, if any, and messages to the replicas
+	// of a partition are copied to all the shadow ring's replicas of the
+	// partition, scaled for any difference in partition bit counts.
+	Ring Ring
+	// AddressIndex indicates which of the shadow nodes' addresses to send to.
+	AddressIndex int
+	// MsgTypeFractions maps message types to the fraction of their messages,
+	// from 0 to 1, to copy; messages of other types are not copied.
+	MsgTypeFractions map[uint64]float64
+	// QueueTimeout bounds the wait to queue each copy, separately from the
+	// primary sends, which never wait on the copies. Defaults to 1 second.
+	QueueTimeout time.Duration
+}
+
+type mirror struct {
+	ring         Ring
+	addressIndex int
+	fractions    map[uint64]float64
+	queueTimeout time.Duration
+}
+
+// SetMirror starts copying outbound messages as the config describes,
+// replacing any previous config; nil stops copying. Copies are queued as any
+// other messages, so the shadow nodes have their own connections and queues,
+// and a slow or down shadow cluster only causes copies to be dropped. The
+// message is freed once both its primary sends and its copies are done.
+// Connections to shadow nodes no longer copied to are closed by the next
+// SetRing.
+func (t *TCPMsgRing) SetMirror(cfg *MirrorConfig) {
+	var m *mirror
+	if cfg != nil && cfg.Ring != nil && len(cfg.MsgTypeFractions) > 0 {
+		m = &mirror{
+			ring:         cfg.Ring,
+			addressIndex: cfg.AddressIndex,
+			fractions:    make(map[uint64]float64, len(cfg.MsgTypeFractions)),
+			queueTimeout: cfg.QueueTimeout,
+		}
+		for msgType, fraction := range cfg.MsgTypeFractions {
+			m.fractions[msgType] = fraction
+		}
+		if m.queueTimeout <= 0 {
+			m.queueTimeout = time.Second
+		}
+	}
+	t.mirrorLock.Lock()
+	t.mirror = m
+	t.mirrorLock.Unlock()
+}
+
+// mirrorFor returns the mirror if a message of the type is chosen to be
+// copied, or nil.
+func (t *TCPMsgRing) mirrorFor(msgType uint64) *mirror {
+	t.mirrorLock.RLock()
+	m := t.mirror
+	t.mirrorLock.RUnlock()
+	if m == nil {
+		return nil
+	}
+	fraction := m.fractions[msgType]
+	if fraction <= 0 || (fraction < 1 && rand.Float64() >= fraction) {
+		return nil
+	}
+	return m
+}
+
+// mirrorAddrs returns the shadow addresses, for keeping their connections
+// when the primary ring changes.
+func (t *TCPMsgRing) mirrorAddrs() []string {
+	t.mirrorLock.RLock()
+	m := t.mirror
+	t.mirrorLock.RUnlock()
+	if m == nil {
+		return nil
+	}
+	var addrs []string
+	for _, n := range m.ring.Nodes() {
+		addrs = append(addrs, n.Address(m.addressIndex))
+	}
+	return addrs
+}
+
+// mirrorToNode returns the msg to use for the primary send to the node,
+// having queued a copy to the shadow node with the same ID if the message is
+// chosen to be copied.
+func (t *TCPMsgRing) mirrorToNode(msg Msg, nodeID uint64) Msg {
+	m := t.mirrorFor(msg.MsgType())
+	if m == nil {
+		return msg
+	}
+	n := m.ring.Node(nodeID)
+	if n == nil {
+		return msg
+	}
+	return t.mirrorToAddrs(m, msg, []string{n.Address(m.addressIndex)})
+}
+
+// mirrorToReplicas returns the msg to use for the primary sends to the
+// replicas of the partition, of a ring with the partition bit count given,
+// having queued copies to the shadow ring's replicas if the message is
+// chosen to be copied.
+func (t *TCPMsgRing) mirrorToReplicas(msg Msg, partition Partition, partitionBitCount uint16) Msg {
+	m := t.mirrorFor(msg.MsgType())
+	if m == nil {
+		return msg
+	}
+	if shadowBitCount := m.ring.PartitionBitCount(); shadowBitCount < partitionBitCount {
+		partition >>= partitionBitCount - shadowBitCount
+	} else {
+		partition <<= shadowBitCount - partitionBitCount
+	}
+	var addrs []string
+	for _, n := range m.ring.ResponsibleNodes(partition) {
+		addrs = append(addrs, n.Address(m.addressIndex))
+	}
+	return t.mirrorToAddrs(m, msg, addrs)
+}
+
+func (t *TCPMsgRing) mirrorToAddrs(m *mirror, msg Msg, addrs []string) Msg {
+	if len(addrs) == 0 {
+		return msg
+	}
+	mmsg := &multiMsg{msg: msg, freerChan: make(chan struct{}, len(addrs)+1)}
+	for _, addr := range addrs {
+		atomic.AddInt32(&t.msgMirrors, 1)
+		go t.msgToAddr(mmsg, addr, m.queueTimeout)
+	}
+	go mmsg.freer(len(addrs) + 1)
+	return mmsg
+}
@@ -0,0 +1,81 @@
+package ring
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTCPMsgRingMirror(t *testing.T) {
+	msgring, _ := NewTCPMsgRing(nil)
+	defer msgring.Shutdown()
+	b := NewBuilder(64)
+	b.SetReplicaCount(2)
+	nA, err := b.AddNode(true, 1, nil, []string{"127.0.0.2:1", "127.0.1.2:1"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nB, err := b.AddNode(true, 1, nil, []string{"127.0.0.3:1", "127.0.1.3:1"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := b.Ring()
+	r.SetLocalNode(nA.ID())
+	msgring.SetRing(r)
+	// The shadow cluster is the same nodes at their second addresses. The
+	// channels are created ahead of time so no connections are attempted.
+	primaryChan, _ := msgring.msgChanForAddr("127.0.0.3:1")
+	shadowAChan, _ := msgring.msgChanForAddr("127.0.1.2:1")
+	shadowBChan, _ := msgring.msgChanForAddr("127.0.1.3:1")
+	msgring.SetMirror(&MirrorConfig{Ring: r, AddressIndex: 1, MsgTypeFractions: map[uint64]float64{1: 1}})
+	msgring.SetRing(r)
+	if msgring.lookupMsgChanForAddr("127.0.1.3:1") != shadowBChan {
+		t.Fatal("shadow address should be kept across ring changes")
+	}
+	freed := func(m *TestMsg) bool {
+		select {
+		case <-m.done:
+			return true
+		case <-time.After(10 * time.Millisecond):
+			return false
+		}
+	}
+	m := newTestMsg()
+	msgring.MsgToNode(m, nB.ID(), time.Second)
+	(<-primaryChan).Free()
+	if freed(m) {
+		t.Fatal("message freed before its copy was sent")
+	}
+	(<-shadowBChan).Free()
+	if !freed(m) {
+		t.Fatal("message was not freed")
+	}
+	m = newTestMsg()
+	msgring.MsgToOtherReplicas(m, 0, time.Second)
+	(<-primaryChan).Free()
+	(<-shadowAChan).Free()
+	if freed(m) {
+		t.Fatal("message freed before its copies were sent")
+	}
+	(<-shadowBChan).Free()
+	if !freed(m) {
+		t.Fatal("message was not freed")
+	}
+	if s := msgring.Stats(false); s.MsgMirrors != 3 {
+		t.Fatalf("%d != 3", s.MsgMirrors)
+	}
+	// Only the message types listed are copied.
+	msgring.SetMirror(&MirrorConfig{Ring: r, AddressIndex: 1, MsgTypeFractions: map[uint64]float64{2: 1}})
+	m = newTestMsg()
+	msgring.MsgToNode(m, nB.ID(), time.Second)
+	(<-primaryChan).Free()
+	if !freed(m) || len(shadowBChan) != 0 {
+		t.Fatal("message of another type was copied")
+	}
+	msgring.SetMirror(nil)
+	m = newTestMsg()
+	msgring.MsgToNode(m, nB.ID(), time.Second)
+	(<-primaryChan).Free()
+	if !freed(m) || len(shadowBChan) != 0 {
+		t.Fatal("message copied after mirroring stopped")
+	}
+}
@@ -0,0 +1,121 @@
+package ring
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// moveHistoryHours is how many hours of move counts the Builder keeps.
+const moveHistoryHours = 28 * 24
+
+// MoveHistoryEntry is the number of partition replicas the rebalances within
+// an hour moved from one node to another; see Builder.MoveHistory.
+type MoveHistoryEntry struct {
+	// Hour is the start of the hour.
+	Hour  time.Time
+	Moves int
+}
+
+type moveCount struct {
+	hour  int64
+	moves int64
+}
+
+// MoveHistory returns the number of partition replicas moved by rebalances,
+// for each hour with moves over the last four weeks, oldest first. Together
+// with the assignment count, this shows whether the Builder's settings cause
+// excessive ongoing churn; see also BuilderStats.MovesLastDay and
+// MovesLastWeek. The history is persisted with the Builder.
+func (b *Builder) MoveHistory() []MoveHistoryEntry {
+	entries := make([]MoveHistoryEntry, len(b.moveHistory))
+	for i, c := range b.moveHistory {
+		entries[i] = MoveHistoryEntry{Hour: time.Unix(c.hour*3600, 0), Moves: int(c.moves)}
+	}
+	return entries
+}
+
+// movesSince returns the number of replicas moved within the hours since the
+// time given, including the hour it falls in.
+func (b *Builder) movesSince(since time.Time) int {
+	hour := since.Unix() / 3600
+	moves := 0
+	for _, c := range b.moveHistory {
+		if c.hour >= hour {
+			moves += int(c.moves)
+		}
+	}
+	return moves
+}
+
+// recordMoves adds the moves of a rebalance to the hour of the time given and
+// drops the hours past the history kept.
+func (b *Builder) recordMoves(at time.Time, moves int) {
+	hour := at.Unix() / 3600
+	if moves > 0 {
+		// Should the clock have gone back, the moves go to the latest hour.
+		if n := len(b.moveHistory); n > 0 && b.moveHistory[n-1].hour >= hour {
+			b.moveHistory[n-1].moves += int64(moves)
+		} else {
+			b.moveHistory = append(b.moveHistory, moveCount{hour: hour, moves: int64(moves)})
+		}
+	}
+	expired := 0
+	for expired < len(b.moveHistory) && b.moveHistory[expired].hour <= hour-moveHistoryHours {
+		expired++
+	}
+	if expired > 0 {
+		b.moveHistory = append([]moveCount(nil), b.moveHistory[expired:]...)
+	}
+}
+
+// Moves returns the number of partition replicas the rebalance moved from one
+// node to another; replicas newly assigned, UnassignedMoves, and replica
+// positions swapped for InactiveKeepAsLastResort move no existing data and
+// are not counted.
+func (r *RebalanceReport) Moves() int {
+	return r.DeactivatedMoves + r.SameNodeMoves + r.SameTierMoves + r.OverweightMoves + r.AffinityMoves + r.RegionMoves
+}
+
+func (b *Builder) writeMoveHistory(w io.Writer) error {
+	if len(b.moveHistory) > math.MaxInt32 {
+		return fmt.Errorf("%d move history entries is too large; max is %d", len(b.moveHistory), math.MaxInt32)
+	}
+	if err := binary.Write(w, binary.BigEndian, int32(len(b.moveHistory))); err != nil {
+		return err
+	}
+	for _, c := range b.moveHistory {
+		if err := binary.Write(w, binary.BigEndian, c.hour); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.BigEndian, c.moves); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Builder) readMoveHistory(r io.Reader) error {
+	var count int32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return err
+	}
+	if count < 0 {
+		return fmt.Errorf("invalid move history count %d", count)
+	}
+	b.moveHistory = nil
+	if count > 0 {
+		b.moveHistory = make([]moveCount, count)
+	}
+	for i := range b.moveHistory {
+		if err := binary.Read(r, binary.BigEndian, &b.moveHistory[i].hour); err != nil {
+			return err
+		}
+		if err := binary.Read(r, binary.BigEndian, &b.moveHistory[i].moves); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package ring
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestMoveHistory(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := NewBuilder(64)
+	b.now = func() time.Time { return now }
+	b.SetReplicaCount(3)
+	for i := 0; i < 4; i++ {
+		if _, err := b.AddNode(true, 100, nil, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Ring()
+	// The initial assignments move no data.
+	if len(b.MoveHistory()) != 0 {
+		t.Fatal(b.MoveHistory())
+	}
+	if _, err := b.AddNode(true, 100, nil, nil, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * time.Hour)
+	b.Ring()
+	moves := b.LastRebalanceReport().Moves()
+	if moves == 0 {
+		t.Fatal("no moves for the new node")
+	}
+	history := b.MoveHistory()
+	if len(history) != 1 || history[0].Moves != moves || !history[0].Hour.Equal(now) {
+		t.Fatal(history)
+	}
+	s := b.Stats()
+	if s.MovesLastDay != moves || s.MovesLastWeek != moves || s.ChurnLastDay != float64(moves)*100/float64(s.AssignmentEntries) {
+		t.Fatal(s.MovesLastDay, s.MovesLastWeek, s.ChurnLastDay)
+	}
+	buf := &bytes.Buffer{}
+	if err := b.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := LoadBuilder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if history2 := b2.MoveHistory(); len(history2) != 1 || history2[0] != history[0] {
+		t.Fatal(history2)
+	}
+	now = now.Add(2 * 24 * time.Hour)
+	if s = b.Stats(); s.MovesLastDay != 0 || s.MovesLastWeek != moves {
+		t.Fatal(s.MovesLastDay, s.MovesLastWeek)
+	}
+	now = now.Add(30 * 24 * time.Hour)
+	b.Ring()
+	if len(b.MoveHistory()) != 0 {
+		t.Fatal(b.MoveHistory())
+	}
+}
@@ -64,9 +64,19 @@ type MsgRing interface {
 	//
 	// When the msg has actually been sent or has been discarded due to
 	// delivery errors or delays, msg.Free() will be called.
-	MsgToOtherReplicas(msg Msg, partition uint32, timeout time.Duration)
+	MsgToOtherReplicas(msg Msg, partition Partition, timeout time.Duration)
 }
 
+// MsgSender is the sending part of MsgRing, for code that only sends
+// messages and so can accept a MsgSender rather than a MsgRing; a MsgRing is
+// always a MsgSender. See the ringtest subpackage for fakes.
+type MsgSender interface {
+	MsgToNode(msg Msg, nodeID uint64, timeout time.Duration)
+	MsgToOtherReplicas(msg Msg, partition Partition, timeout time.Duration)
+}
+
+var _ MsgSender = MsgRing(nil)
+
 // Msg is a single message to be sent to another node or nodes.
 type Msg interface {
 	// MsgType is the unique designator for the type of message content (such
@@ -92,6 +102,22 @@ type Msg interface {
 	Free()
 }
 
+// MsgSplitter may be implemented by a Msg that can be delivered as several
+// smaller messages, for peers whose MaxMsgLength is less than the Msg's
+// length; see TCPMsgRingConfig.MaxMsgLength. Messages that cannot be split
+// are dropped for such peers.
+type MsgSplitter interface {
+	// Split returns messages, each with content no longer than maxLength,
+	// that together deliver the content of the Msg, or nil if the Msg cannot
+	// be split that small. The messages returned may share the original Msg's
+	// buffers; the original is not freed until all the messages split from it
+	// have been sent or discarded.
+	//
+	// Note that Split may be called multiple times and may be called
+	// concurrently.
+	Split(maxLength uint64) []Msg
+}
+
 // MsgUnmarshaller will attempt to read desiredBytesToRead from the reader and
 // will return the number of bytes actually read as well as any error that may
 // have occurred. If error is nil then actualBytesRead must equal
@@ -0,0 +1,135 @@
+package ring
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MsgTraceEvent is a message sent to or received from a peer, as kept when
+// TCPMsgRingConfig.MsgTraceSize is set; see TCPMsgRing.MsgTraces.
+type MsgTraceEvent struct {
+	Time time.Time
+	Addr string
+	// Sent is true for a message sent to the peer and false for one received
+	// from it.
+	Sent     bool
+	MsgType  uint64
+	Length   uint64
+	Duration time.Duration
+	// Err is the error writing, reading, or handling the message, if any.
+	Err error
+}
+
+func (e *MsgTraceEvent) String() string {
+	direction := "recv"
+	if e.Sent {
+		direction = "send"
+	}
+	result := "ok"
+	if e.Err != nil {
+		result = e.Err.Error()
+	}
+	return fmt.Sprintf("%s %s %s type=%016x length=%d duration=%s %s", e.Time.Format(time.RFC3339Nano), e.Addr, direction, e.MsgType, e.Length, e.Duration, result)
+}
+
+// msgTraces keeps the last size MsgTraceEvents for each address in a ring
+// buffer, so the cost is fixed no matter how busy a peer is.
+type msgTraces struct {
+	size    int
+	lock    sync.Mutex
+	buffers map[string]*msgTraceBuffer
+}
+
+type msgTraceBuffer struct {
+	events []MsgTraceEvent
+	next   int
+}
+
+func newMsgTraces(size int) *msgTraces {
+	return &msgTraces{size: size, buffers: make(map[string]*msgTraceBuffer)}
+}
+
+func (m *msgTraces) add(addr string, sent bool, msgType uint64, length uint64, duration time.Duration, err error) {
+	m.lock.Lock()
+	b := m.buffers[addr]
+	if b == nil {
+		b = &msgTraceBuffer{events: make([]MsgTraceEvent, 0, m.size)}
+		m.buffers[addr] = b
+	}
+	e := MsgTraceEvent{Time: time.Now(), Addr: addr, Sent: sent, MsgType: msgType, Length: length, Duration: duration, Err: err}
+	if len(b.events) < m.size {
+		b.events = append(b.events, e)
+	} else {
+		b.events[b.next] = e
+		b.next = (b.next + 1) % m.size
+	}
+	m.lock.Unlock()
+}
+
+// get returns the events for the address, oldest first.
+func (m *msgTraces) get(addr string) []MsgTraceEvent {
+	m.lock.Lock()
+	var rv []MsgTraceEvent
+	if b := m.buffers[addr]; b != nil {
+		rv = make([]MsgTraceEvent, 0, len(b.events))
+		rv = append(rv, b.events[b.next:]...)
+		rv = append(rv, b.events[:b.next]...)
+	}
+	m.lock.Unlock()
+	return rv
+}
+
+func (m *msgTraces) addrs() []string {
+	m.lock.Lock()
+	addrs := make([]string, 0, len(m.buffers))
+	for addr := range m.buffers {
+		addrs = append(addrs, addr)
+	}
+	m.lock.Unlock()
+	sort.Strings(addrs)
+	return addrs
+}
+
+// prune forgets the addresses not in addrs.
+func (m *msgTraces) prune(addrs map[string]bool) {
+	m.lock.Lock()
+	for addr := range m.buffers {
+		if !addrs[addr] {
+			delete(m.buffers, addr)
+		}
+	}
+	m.lock.Unlock()
+}
+
+// MsgTraces returns the most recent messages sent to and received from the
+// address, oldest first; see TCPMsgRingConfig.MsgTraceSize. It returns nil if
+// tracing is not enabled.
+func (t *TCPMsgRing) MsgTraces(addr string) []MsgTraceEvent {
+	if t.msgTraces == nil {
+		return nil
+	}
+	return t.msgTraces.get(addr)
+}
+
+// DumpMsgTraces writes the most recent messages sent to and received from
+// every address, one per line, ordered by address and then time; see
+// TCPMsgRingConfig.MsgTraceSize. This is meant for diagnosing transient
+// failures after the fact, such as by calling it with os.Stderr whenever
+// signal.Notify reports a SIGQUIT.
+func (t *TCPMsgRing) DumpMsgTraces(w io.Writer) error {
+	if t.msgTraces == nil {
+		_, err := fmt.Fprintln(w, "message tracing is not enabled")
+		return err
+	}
+	for _, addr := range t.msgTraces.addrs() {
+		for _, e := range t.msgTraces.get(addr) {
+			if _, err := fmt.Fprintln(w, e.String()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
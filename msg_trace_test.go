@@ -0,0 +1,64 @@
+package ring
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMsgTraces(t *testing.T) {
+	m := newMsgTraces(3)
+	for i := uint64(1); i <= 5; i++ {
+		m.add("127.0.0.1:1", i%2 == 0, i, i*10, time.Millisecond, nil)
+	}
+	m.add("127.0.0.2:1", true, 9, 90, time.Millisecond, errors.New("broken pipe"))
+	events := m.get("127.0.0.1:1")
+	if len(events) != 3 || events[0].MsgType != 3 || events[1].MsgType != 4 || events[2].MsgType != 5 {
+		t.Fatalf("%v", events)
+	}
+	if !events[1].Sent || events[2].Sent {
+		t.Fatalf("%v", events)
+	}
+	if addrs := m.addrs(); len(addrs) != 2 || addrs[0] != "127.0.0.1:1" || addrs[1] != "127.0.0.2:1" {
+		t.Fatal(addrs)
+	}
+	m.prune(map[string]bool{"127.0.0.2:1": true})
+	if events = m.get("127.0.0.1:1"); events != nil {
+		t.Fatal(events)
+	}
+	if events = m.get("127.0.0.2:1"); len(events) != 1 || events[0].Err == nil {
+		t.Fatal(events)
+	}
+}
+
+func TestTCPMsgRingMsgTraces(t *testing.T) {
+	msgring, _ := NewTCPMsgRing(&TCPMsgRingConfig{MsgTraceSize: 10})
+	msgring.SetMsgHandler(1, test_stringmarshaller)
+	conn := new(testConn)
+	m := newTestMsg()
+	if err := msgring.writeMsg("127.0.0.2:1", newTimeoutWriter(conn, 16*1024, time.Second), m); err != nil {
+		t.Fatal(err)
+	}
+	conn.readBuf.Write(conn.writeBuf.Bytes())
+	if err := msgring.readMsg("127.0.0.2:1", newTimeoutReader(conn, 16*1024, time.Second), nil); err != nil {
+		t.Fatal(err)
+	}
+	events := msgring.MsgTraces("127.0.0.2:1")
+	if len(events) != 2 || !events[0].Sent || events[1].Sent || events[0].MsgType != 1 || events[1].Length != 7 {
+		t.Fatalf("%v", events)
+	}
+	buf := &bytes.Buffer{}
+	if err := msgring.DumpMsgTraces(buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "127.0.0.2:1 send type=0000000000000001 length=7") || !strings.HasSuffix(lines[1], " ok") {
+		t.Fatal(buf.String())
+	}
+	msgring, _ = NewTCPMsgRing(nil)
+	if events = msgring.MsgTraces("127.0.0.2:1"); events != nil {
+		t.Fatal(events)
+	}
+}
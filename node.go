@@ -24,8 +24,9 @@ type Node interface {
 	// relative to other nodes. It can be in any unit of designation as long as
 	// all nodes use the same designation. Most commonly this is the number of
 	// gigabytes the node can store, but could be based on CPU capacity or
-	// another resource if that makes more sense to balance.
-	Capacity() uint32
+	// another resource if that makes more sense to balance. The total
+	// capacity of all a Builder's nodes must fit within 64 bits.
+	Capacity() uint64
 	// Tiers indicate the layout of the node with respect to other nodes. For
 	// example, the lowest tier, tier 0, might be the server ip (where each
 	// node represents a drive on that server). The next tier, 1, might then be
@@ -46,21 +47,56 @@ type Node interface {
 	Meta() string
 	// Config contains the raw configuration bytes for this node.
 	Config() []byte
+	// NetworkZone names the network the node is reached over, such as a
+	// datacenter or cloud region, so transports can treat links within a
+	// zone differently from links between zones, which are often slower,
+	// metered WAN links; see TCPMsgRingConfig.TransportPolicy. Unlike tiers,
+	// it does not affect assignments. An empty zone is a zone of its own.
+	NetworkZone() string
 }
 
+// InactivePolicy indicates what happens to the partition replicas assigned to
+// a node when it is deactivated; see BuilderNode.Deactivate.
+type InactivePolicy byte
+
+const (
+	// InactiveReassignOnRebalance reassigns the node's replicas to active
+	// nodes on the next rebalance, when a Ring is next generated. This is the
+	// policy used by SetActive(false).
+	InactiveReassignOnRebalance InactivePolicy = iota
+	// InactiveReassignImmediately reassigns the node's replicas to active
+	// nodes at the time of deactivation, so the Builder's assignments, as seen
+	// by Stats, Explain, and the like, reflect the change right away.
+	InactiveReassignImmediately
+	// InactiveKeepAsLastResort leaves the node's replicas assigned, moved to
+	// the last replica positions of their partitions so users of the ring try
+	// the node last, until the node is reactivated or deactivated again with
+	// another policy. This trades reduced redundancy for no data movement,
+	// such as for a node expected back shortly.
+	InactiveKeepAsLastResort
+)
+
 // BuilderNode extends Node to allow for updating attributes. A Ring needs
 // immutable nodes as the assignments are static at that point, but the Builder
 // doesn't have that restriction.
 type BuilderNode interface {
 	Node
 	SetActive(value bool)
-	SetCapacity(value uint32)
+	// Deactivate marks the node inactive with the policy given for its
+	// assigned partition replicas.
+	Deactivate(policy InactivePolicy)
+	// InactivePolicy returns the policy given with the last deactivation.
+	InactivePolicy() InactivePolicy
+	// SetCapacity returns an error, leaving the capacity unchanged, if the
+	// total capacity of the Builder's nodes would overflow 64 bits.
+	SetCapacity(value uint64) error
 	SetTier(level int, value string)
 	ReplaceTiers(tiers []string)
 	SetAddress(index int, value string)
 	ReplaceAddresses(addrs []string)
 	SetMeta(value string)
 	SetConfig(config []byte)
+	SetNetworkZone(zone string)
 }
 
 type node struct {
@@ -68,13 +104,16 @@ type node struct {
 	tierBase *tierBase
 	id       uint64
 	inactive bool
-	capacity uint32
+	// inactivePolicy is only meaningful while inactive.
+	inactivePolicy InactivePolicy
+	capacity       uint64
 	// Here the tier values are represented as indexes to the actual values
 	// stored in tierBase.tiers. This is done for speed during rebalancing.
 	tierIndexes []int32
 	addresses   []string
 	meta        string
 	config      []byte
+	networkZone string
 }
 
 func newNode(b *Builder, tb *tierBase, others []*node) (*node, error) {
@@ -127,7 +166,7 @@ func (n *node) Active() bool {
 	return !n.inactive
 }
 
-func (n *node) Capacity() uint32 {
+func (n *node) Capacity() uint64 {
 	return n.capacity
 }
 
@@ -176,13 +215,30 @@ func (n *node) SetActive(value bool) {
 		n.builder.dirty = true
 	}
 	n.inactive = !value
+	n.inactivePolicy = InactiveReassignOnRebalance
+}
+
+func (n *node) Deactivate(policy InactivePolicy) {
+	n.SetActive(false)
+	n.inactivePolicy = policy
+	if n.builder != nil && policy == InactiveReassignImmediately {
+		n.builder.reassignNow(n)
+	}
+}
+
+func (n *node) InactivePolicy() InactivePolicy {
+	return n.inactivePolicy
 }
 
-func (n *node) SetCapacity(value uint32) {
+func (n *node) SetCapacity(value uint64) error {
 	if n.builder != nil {
+		if err := n.builder.checkCapacity(n, value); err != nil {
+			return err
+		}
 		n.builder.dirty = true
 	}
 	n.capacity = value
+	return nil
 }
 
 func (n *node) SetTier(level int, value string) {
@@ -260,6 +316,38 @@ func (n *node) SetConfig(config []byte) {
 	n.config = config
 }
 
+func (n *node) NetworkZone() string {
+	return n.networkZone
+}
+
+func (n *node) SetNetworkZone(zone string) {
+	if n.builder != nil {
+		n.builder.dirty = true
+	}
+	n.networkZone = zone
+}
+
+// TierDistance returns how far apart two nodes are based on their tier values.
+// Nodes with the same values at every tier level have a distance of 0, nodes
+// differing only at tier 0 (different drives on the same server, for example)
+// have a distance of 1, nodes differing at tier 1 have a distance of 2, and so
+// on. In other words, the distance is one more than the highest tier level at
+// which the nodes differ. Note that an unset tier value is treated as the
+// empty string, so two nodes that both lack a tier level are considered the
+// same at that level.
+func TierDistance(a Node, b Node) int {
+	levels := len(a.Tiers())
+	if bLevels := len(b.Tiers()); bLevels > levels {
+		levels = bLevels
+	}
+	for level := levels - 1; level >= 0; level-- {
+		if a.Tier(level) != b.Tier(level) {
+			return level + 1
+		}
+	}
+	return 0
+}
+
 type NodeSlice []Node
 
 // Filter will return a new NodeSlice with just the nodes that match the
@@ -277,6 +365,7 @@ type NodeSlice []Node
 //      address     Any address of a node.
 //      addressX    A node's specific address index specified by X.
 //      meta        A node's meta attribute.
+//      zone        A node's network zone.
 //
 // For example:
 //
@@ -388,6 +477,16 @@ func (ns NodeSlice) Filter(filters []string) (NodeSlice, error) {
 					return re.MatchString(n.Meta())
 				}
 			}
+		case "zone":
+			if re == nil {
+				matcher = func(n Node) bool {
+					return sfilter[1] == n.NetworkZone()
+				}
+			} else {
+				matcher = func(n Node) bool {
+					return re.MatchString(n.NetworkZone())
+				}
+			}
 		default:
 			if strings.HasPrefix(sfilter[0], "tier") {
 				level, err := strconv.Atoi(sfilter[0][4:])
@@ -0,0 +1,133 @@
+package ring
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// NodeDiscoveryConfig represents the set of values for configuring
+// DiscoverNode.
+type NodeDiscoveryConfig struct {
+	// Paths lists the mount points of the disks whose sizes, summed, give
+	// the node's capacity. Defaults to just "/".
+	Paths []string
+	// CapacityUnit indicates how many bytes make one unit of capacity, so
+	// capacities stay comparable, and within reasonable totals, across the
+	// fleet. Defaults to 1073741824 bytes, giving capacities in GiB.
+	CapacityUnit uint64
+	// Tiers lists where to find the node's tier values, tier 0 first; see
+	// TierHostname, TierEnv, and TierLabelFile. Defaults to TierHostname,
+	// followed by TierEnv("RING_RACK") if that variable is set, so nodes
+	// deployed without a rack just have the hostname tier.
+	Tiers []TierSource
+}
+
+func resolveNodeDiscoveryConfig(c *NodeDiscoveryConfig) *NodeDiscoveryConfig {
+	cfg := &NodeDiscoveryConfig{}
+	if c != nil {
+		*cfg = *c
+	}
+	if len(cfg.Paths) == 0 {
+		cfg.Paths = []string{"/"}
+	}
+	if cfg.CapacityUnit < 1 {
+		cfg.CapacityUnit = 1073741824
+	}
+	if len(cfg.Tiers) == 0 {
+		cfg.Tiers = []TierSource{TierHostname()}
+		if os.Getenv("RING_RACK") != "" {
+			cfg.Tiers = append(cfg.Tiers, TierEnv("RING_RACK"))
+		}
+	}
+	return cfg
+}
+
+// TierSource returns a tier value for the local node; see
+// NodeDiscoveryConfig.Tiers.
+type TierSource func() (string, error)
+
+// DiscoverNode returns the capacity and tiers of the local node, as found on
+// the local system, as the body of a request to add the node with a
+// BuilderHTTPHandler; the caller would add the node's addresses and any
+// other values before sending it. Having every agent discover its values
+// the same way keeps nodes that self-register consistent across the fleet.
+func DiscoverNode(c *NodeDiscoveryConfig) (*BuilderHTTPNodeUpdate, error) {
+	cfg := resolveNodeDiscoveryConfig(c)
+	var total uint64
+	for _, path := range cfg.Paths {
+		size, err := DiskSize(path)
+		if err != nil {
+			return nil, err
+		}
+		total += size
+	}
+	capacity := total / cfg.CapacityUnit
+	if capacity < 1 {
+		return nil, fmt.Errorf("disk size %d is less than one capacity unit of %d bytes", total, cfg.CapacityUnit)
+	}
+	tiers := make([]string, len(cfg.Tiers))
+	for level, source := range cfg.Tiers {
+		value, err := source()
+		if err != nil {
+			return nil, fmt.Errorf("tier %d: %s", level, err)
+		}
+		tiers[level] = value
+	}
+	active := true
+	return &BuilderHTTPNodeUpdate{Active: &active, Capacity: &capacity, Tiers: tiers}, nil
+}
+
+// TierHostname returns a TierSource giving the local hostname, commonly the
+// lowest tier.
+func TierHostname() TierSource {
+	return func() (string, error) {
+		return os.Hostname()
+	}
+}
+
+// TierEnv returns a TierSource giving the value of the environment variable,
+// such as a rack or zone set by the deployment; it is an error for the
+// variable to be unset or empty.
+func TierEnv(name string) TierSource {
+	return func() (string, error) {
+		if value := os.Getenv(name); value != "" {
+			return value, nil
+		}
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+}
+
+// TierLabelFile returns a TierSource giving the value of the label from a
+// file of label="value" lines, the format Kubernetes uses when exposing pod
+// labels as a file through the downward API; it is an error for the label to
+// be missing.
+func TierLabelFile(path string, label string) TierSource {
+	return func() (string, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			parts := strings.SplitN(scanner.Text(), "=", 2)
+			if len(parts) != 2 || strings.TrimSpace(parts[0]) != label {
+				continue
+			}
+			value := strings.TrimSpace(parts[1])
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				value = unquoted
+			}
+			if value != "" {
+				return value, nil
+			}
+		}
+		if err = scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("label %s not found in %s", label, path)
+	}
+}
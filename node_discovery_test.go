@@ -0,0 +1,99 @@
+package ring
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiscoverNode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	labels := filepath.Join(dir, "labels")
+	if err = ioutil.WriteFile(labels, []byte("app=\"storage\"\ntopology.kubernetes.io/zone=\"zone-a\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("RING_TEST_RACK", "rack-1")
+	defer os.Unsetenv("RING_TEST_RACK")
+	u, err := DiscoverNode(&NodeDiscoveryConfig{
+		Paths:        []string{dir},
+		CapacityUnit: 1,
+		Tiers:        []TierSource{TierHostname(), TierEnv("RING_TEST_RACK"), TierLabelFile(labels, "topology.kubernetes.io/zone")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := DiskSize(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Capacity == nil || *u.Capacity != size || size == 0 {
+		t.Fatal(u.Capacity, size)
+	}
+	hostname, _ := os.Hostname()
+	if len(u.Tiers) != 3 || u.Tiers[0] != hostname || u.Tiers[1] != "rack-1" || u.Tiers[2] != "zone-a" {
+		t.Fatal(u.Tiers)
+	}
+	if u.Active == nil || !*u.Active {
+		t.Fatal(u.Active)
+	}
+	n, err := NewBuilder(64).AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = u.apply(n); err != nil {
+		t.Fatal(err)
+	}
+	if n.Capacity() != size || n.Tier(2) != "zone-a" {
+		t.Fatal(n.Capacity(), n.Tiers())
+	}
+}
+
+func TestDiscoverNodeDefaultTiers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rack, hadRack := os.LookupEnv("RING_RACK")
+	defer func() {
+		if hadRack {
+			os.Setenv("RING_RACK", rack)
+		} else {
+			os.Unsetenv("RING_RACK")
+		}
+	}()
+	hostname, _ := os.Hostname()
+	os.Unsetenv("RING_RACK")
+	u, err := DiscoverNode(&NodeDiscoveryConfig{Paths: []string{dir}, CapacityUnit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(u.Tiers) != 1 || u.Tiers[0] != hostname {
+		t.Fatal(u.Tiers)
+	}
+	os.Setenv("RING_RACK", "rack-1")
+	u, err = DiscoverNode(&NodeDiscoveryConfig{Paths: []string{dir}, CapacityUnit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(u.Tiers) != 2 || u.Tiers[0] != hostname || u.Tiers[1] != "rack-1" {
+		t.Fatal(u.Tiers)
+	}
+}
+
+func TestDiscoverNodeErrors(t *testing.T) {
+	if _, err := DiscoverNode(&NodeDiscoveryConfig{Tiers: []TierSource{TierEnv("RING_TEST_UNSET")}}); err == nil {
+		t.Fatal("unset environment variable should error")
+	}
+	if _, err := DiscoverNode(&NodeDiscoveryConfig{CapacityUnit: ^uint64(0)}); err == nil {
+		t.Fatal("disk smaller than a capacity unit should error")
+	}
+	if _, err := TierLabelFile("/nonexistent/labels", "rack")(); err == nil {
+		t.Fatal("missing label file should error")
+	}
+}
@@ -0,0 +1,122 @@
+package ring
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// NodeDrain is the progress of a node being drained; see
+// Builder.SetNodeDraining.
+type NodeDrain struct {
+	NodeID uint64
+	// Initial is how many partition replicas the node held when it was
+	// marked draining, and Remaining how many it holds now.
+	Initial   int
+	Remaining int
+	// Percentage is how much of the Initial has moved off, from 0 to 100.
+	Percentage float64
+}
+
+// NodeDraining returns true if the node is marked draining.
+func (b *Builder) NodeDraining(nodeID uint64) bool {
+	_, ok := b.nodeDrains[nodeID]
+	return ok
+}
+
+// SetNodeDraining marks the node as draining, or not. A draining node is
+// balanced as if its capacity were 0, so the rebalancer moves its partition
+// replicas off it, but it stays active and keeps serving the replicas it
+// still has while they move; the move wait, move budgets, and
+// MaxMovePercentage pace the drain over several calls to Ring, rather than
+// the abrupt reassignment of deactivating the node. Its capacity is kept, so
+// clearing the mark before the drain completes rebalances it back. The
+// progress is given by BuilderStats.Drains; see also Decommission.
+func (b *Builder) SetNodeDraining(nodeID uint64, draining bool) error {
+	if b.Node(nodeID) == nil {
+		return fmt.Errorf("no node with id %d", nodeID)
+	}
+	if _, ok := b.nodeDrains[nodeID]; ok == draining {
+		return nil
+	}
+	if draining {
+		if b.nodeDrains == nil {
+			b.nodeDrains = make(map[uint64]int32)
+		}
+		b.nodeDrains[nodeID] = int32(b.nodeAssignments(nodeID))
+	} else {
+		delete(b.nodeDrains, nodeID)
+	}
+	b.dirty = true
+	return nil
+}
+
+// drains returns the progress of each draining node, in ascending order of
+// node ID.
+func (b *Builder) drains() []*NodeDrain {
+	var drains []*NodeDrain
+	for nodeID, initial := range b.nodeDrains {
+		d := &NodeDrain{NodeID: nodeID, Initial: int(initial), Remaining: b.nodeAssignments(nodeID), Percentage: 100}
+		if d.Initial > 0 {
+			d.Percentage = float64(d.Initial-d.Remaining) * 100 / float64(d.Initial)
+			if d.Percentage < 0 {
+				// The node gained replicas, such as from the partition count
+				// growing, since it was marked.
+				d.Percentage = 0
+			}
+		}
+		drains = append(drains, d)
+	}
+	sort.Slice(drains, func(i, j int) bool { return drains[i].NodeID < drains[j].NodeID })
+	return drains
+}
+
+func (b *Builder) writeNodeDrains(w io.Writer) error {
+	nodeIDs := make([]uint64, 0, len(b.nodeDrains))
+	for nodeID := range b.nodeDrains {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Slice(nodeIDs, func(i, j int) bool { return nodeIDs[i] < nodeIDs[j] })
+	if err := binary.Write(w, binary.BigEndian, int32(len(nodeIDs))); err != nil {
+		return err
+	}
+	for _, nodeID := range nodeIDs {
+		if err := binary.Write(w, binary.BigEndian, nodeID); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.BigEndian, b.nodeDrains[nodeID]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Builder) readNodeDrains(r io.Reader) error {
+	var count int32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return err
+	}
+	if count < 0 {
+		return fmt.Errorf("invalid node drain count %d", count)
+	}
+	b.nodeDrains = nil
+	if count > 0 {
+		b.nodeDrains = make(map[uint64]int32, count)
+	}
+	for i := int32(0); i < count; i++ {
+		var nodeID uint64
+		var initial int32
+		if err := binary.Read(r, binary.BigEndian, &nodeID); err != nil {
+			return err
+		}
+		if err := binary.Read(r, binary.BigEndian, &initial); err != nil {
+			return err
+		}
+		if initial < 0 {
+			return fmt.Errorf("invalid drain initial assignments %d for node %d", initial, nodeID)
+		}
+		b.nodeDrains[nodeID] = initial
+	}
+	return nil
+}
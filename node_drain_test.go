@@ -0,0 +1,115 @@
+package ring
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestBuilderNodeDraining(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetMaxPartitionBitCount(8)
+	b.SetMoveWait(0)
+	b.SetReplicaCount(3)
+	var ids []uint64
+	for i := 0; i < 4; i++ {
+		n, err := b.AddNode(true, 1, nil, nil, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, n.ID())
+	}
+	b.Ring()
+	if err := b.SetNodeDraining(ids[3]+1, true); err == nil {
+		t.Fatal("expected error for unknown node")
+	}
+	initial := b.nodeAssignments(ids[0])
+	if err := b.SetNodeDraining(ids[0], true); err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := b.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	b, err := LoadBuilder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.NodeDraining(ids[0]) || b.NodeDraining(ids[1]) {
+		t.Fatal("draining mark not persisted")
+	}
+	drains := b.Stats().Drains
+	if len(drains) != 1 || drains[0].NodeID != ids[0] || drains[0].Initial != initial || drains[0].Remaining != initial || drains[0].Percentage != 0 {
+		t.Fatalf("%#v", drains)
+	}
+	// The drain is paced by the move budget over several rings, with the
+	// node staying active throughout.
+	b.SetMaxMovePercentage(5)
+	b.Ring()
+	d := b.Stats().Drains[0]
+	if d.Remaining == 0 || d.Remaining >= initial || d.Percentage <= 0 || d.Percentage >= 100 {
+		t.Fatalf("%#v", d)
+	}
+	for i := 0; b.Stats().Drains[0].Remaining > 0; i++ {
+		if i == 100 {
+			t.Fatalf("%#v", b.Stats().Drains[0])
+		}
+		b.Ring()
+	}
+	if !b.Node(ids[0]).Active() || b.Node(ids[0]).Capacity() != 1 || b.Stats().Drains[0].Percentage != 100 {
+		t.Fatalf("%v %d %#v", b.Node(ids[0]).Active(), b.Node(ids[0]).Capacity(), b.Stats().Drains[0])
+	}
+	// Clearing the mark rebalances the node back.
+	if err = b.SetNodeDraining(ids[0], false); err != nil {
+		t.Fatal(err)
+	}
+	b.SetMaxMovePercentage(0)
+	b.Ring()
+	if b.NodeDraining(ids[0]) || b.nodeAssignments(ids[0]) == 0 || len(b.Stats().Drains) != 0 {
+		t.Fatal(b.nodeAssignments(ids[0]))
+	}
+	if err = b.SetNodeDraining(ids[1], true); err != nil {
+		t.Fatal(err)
+	}
+	b.RemoveNode(ids[1])
+	if b.NodeDraining(ids[1]) {
+		t.Fatal("removed node still marked draining")
+	}
+}
+
+func TestBuilderNodeDrainingImbalance(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetMaxPartitionBitCount(8)
+	b.SetMoveWait(0)
+	b.SetReplicaCount(3)
+	var ids []uint64
+	for i := 0; i < 4; i++ {
+		n, err := b.AddNode(true, 1, nil, nil, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, n.ID())
+	}
+	b.Ring()
+	if err := b.SetNodeDraining(ids[0], true); err != nil {
+		t.Fatal(err)
+	}
+	// Paced, so the draining node still holds replicas it no longer desires.
+	b.SetMaxMovePercentage(5)
+	r := b.Ring()
+	if b.Stats().Drains[0].Remaining == 0 {
+		t.Fatal("drain completed in one ring")
+	}
+	s := r.Stats()
+	if math.IsInf(s.MaxOverNodePercentage, 0) || math.IsInf(s.MaxUnderNodePercentage, 0) || s.MaxOverNodeID == ids[0] || s.MaxUnderNodeID == ids[0] {
+		t.Fatalf("%#v", s)
+	}
+	report := b.LastRebalanceReport()
+	if math.IsInf(report.MaxOverNodePercentage, 0) || math.IsInf(report.MaxUnderNodePercentage, 0) {
+		t.Fatalf("%#v", report)
+	}
+	health := RingHealth(r, &RingHealthConfig{MaxImbalance: 100})
+	if math.IsInf(health.Imbalance, 0) || !health.Safe {
+		t.Fatalf("%#v", health)
+	}
+}
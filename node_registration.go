@@ -0,0 +1,252 @@
+package ring
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// NodeAnnouncement is the message a node sends to announce itself to the
+// service owning the Builder, so it can be added to the ring; see
+// NodeRegistrar and AnnounceNode. DiscoverNode can supply the Capacity and
+// Tiers.
+type NodeAnnouncement struct {
+	// ID is the node's ID if it has registered before and still has its
+	// registration, or 0 for a new node; the Builder assigns node IDs.
+	ID          uint64   `json:"id,string"`
+	Addresses   []string `json:"addresses"`
+	Capacity    uint64   `json:"capacity"`
+	Tiers       []string `json:"tiers"`
+	Meta        string   `json:"meta"`
+	NetworkZone string   `json:"network_zone"`
+}
+
+// NodeRegistration is the reply to a NodeAnnouncement.
+type NodeRegistration struct {
+	// ID is the node's ID in the Builder, which the node should keep to know
+	// itself in the rings published, see Ring.SetLocalNode, and to announce
+	// itself with again.
+	ID uint64 `json:"id,string"`
+	// Added is true if the node was added by this announcement, false if it
+	// was already registered.
+	Added bool `json:"added"`
+	// Published is true if a ring with the node has been published because
+	// of this announcement; otherwise the node will be in a later ring.
+	Published bool `json:"published"`
+}
+
+// NodeRejectedError is the error a NodeRegistrar gives for an announcement
+// its Admit func rejected.
+type NodeRejectedError struct {
+	Reason string
+}
+
+func (e *NodeRejectedError) Error() string {
+	return "node rejected: " + e.Reason
+}
+
+// NodeRegistrarConfig represents the set of values for configuring a
+// NodeRegistrar.
+type NodeRegistrarConfig struct {
+	// LogDebug sets the func to use for debug messages. Defaults not logging
+	// debug messages.
+	LogDebug LogFunc
+	// Locker, if set, will be held while the Builder is used; anything else
+	// using the Builder, such as a RebalanceScheduler, should hold it too.
+	Locker sync.Locker
+	// Admit, if set, will be called for each announcement of a node not yet
+	// registered and decides whether the node is added; returning an error
+	// rejects the node with the error as the reason. Defaults to admitting
+	// all nodes, so be careful who can reach the registrar; see also
+	// BuilderHTTPHandlerConfig.Authorize for the same concern.
+	Admit func(a *NodeAnnouncement) error
+	// Persist, if set, will be called with the Builder after each node is
+	// added, such as to save it with PersistRingOrBuilder; if it returns an
+	// error, the node is removed again and the announcement fails.
+	Persist func(b *Builder) error
+	// Scheduler, if set, will be made to run a pass, publishing a ring with
+	// the new nodes, once PassAfter nodes have been added since the last
+	// such pass; see RebalanceScheduler.Pass. Otherwise, new nodes are
+	// published by whatever else makes rings from the Builder.
+	Scheduler *RebalanceScheduler
+	// PassAfter indicates how many nodes to add before running a Scheduler
+	// pass, so a batch of nodes starting together is rebalanced at once.
+	// Defaults to 1, a pass for every node added.
+	PassAfter int
+}
+
+func resolveNodeRegistrarConfig(c *NodeRegistrarConfig) *NodeRegistrarConfig {
+	cfg := &NodeRegistrarConfig{}
+	if c != nil {
+		*cfg = *c
+	}
+	if cfg.LogDebug == nil {
+		cfg.LogDebug = nilLogFunc
+	}
+	if cfg.PassAfter < 1 {
+		cfg.PassAfter = 1
+	}
+	return cfg
+}
+
+// NodeRegistrar is the admin side of node self-registration, closing the
+// loop for elastic clusters: new nodes announce themselves, with AnnounceNode
+// or by sending a NodeAnnouncement to the registrar as an http.Handler, and
+// the registrar decides whether to add each to the Builder and when to
+// publish an updated ring.
+//
+// Announcements are idempotent; a node announcing itself again, such as
+// after a restart or a lost reply, is matched by its ID or, lacking one, by
+// its first address, and just given its registration again.
+type NodeRegistrar struct {
+	logDebug  LogFunc
+	locker    sync.Locker
+	admit     func(a *NodeAnnouncement) error
+	persist   func(b *Builder) error
+	scheduler *RebalanceScheduler
+	passAfter int
+	lock      sync.Mutex
+	builder   *Builder
+	added     int
+}
+
+// NewNodeRegistrar creates a NodeRegistrar adding nodes to the Builder.
+func NewNodeRegistrar(b *Builder, c *NodeRegistrarConfig) *NodeRegistrar {
+	cfg := resolveNodeRegistrarConfig(c)
+	return &NodeRegistrar{
+		logDebug:  cfg.LogDebug,
+		locker:    cfg.Locker,
+		admit:     cfg.Admit,
+		persist:   cfg.Persist,
+		scheduler: cfg.Scheduler,
+		passAfter: cfg.PassAfter,
+		builder:   b,
+	}
+}
+
+// Announce registers the node announced, returning a *NodeRejectedError if
+// the Admit func rejects it.
+func (r *NodeRegistrar) Announce(a *NodeAnnouncement) (*NodeRegistration, error) {
+	if len(a.Addresses) == 0 || a.Addresses[0] == "" {
+		return nil, fmt.Errorf("node announcement has no address")
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.locker != nil {
+		r.locker.Lock()
+	}
+	reg, err := r.register(a)
+	if r.locker != nil {
+		r.locker.Unlock()
+	}
+	if err != nil || !reg.Added || r.scheduler == nil {
+		return reg, err
+	}
+	r.added++
+	if r.added < r.passAfter {
+		return reg, nil
+	}
+	r.added = 0
+	if err = r.scheduler.Pass(); err != nil {
+		// The node is registered; it will be in a later ring.
+		r.logDebug("NodeRegistrar: pass after adding node %016x: %s\n", reg.ID, err)
+		return reg, nil
+	}
+	reg.Published = true
+	return reg, nil
+}
+
+// register adds the node announced, unless already registered; the locker
+// must be held.
+func (r *NodeRegistrar) register(a *NodeAnnouncement) (*NodeRegistration, error) {
+	if a.ID != 0 {
+		if n := r.builder.Node(a.ID); n != nil {
+			return &NodeRegistration{ID: n.ID()}, nil
+		}
+	}
+	for _, n := range r.builder.Nodes() {
+		if n.Address(0) == a.Addresses[0] {
+			return &NodeRegistration{ID: n.ID()}, nil
+		}
+	}
+	if r.admit != nil {
+		if err := r.admit(a); err != nil {
+			r.logDebug("NodeRegistrar: rejected %s: %s\n", a.Addresses[0], err)
+			return nil, &NodeRejectedError{Reason: err.Error()}
+		}
+	}
+	n, err := r.builder.AddNode(true, a.Capacity, a.Tiers, a.Addresses, a.Meta, nil)
+	if err != nil {
+		return nil, err
+	}
+	n.SetNetworkZone(a.NetworkZone)
+	if r.persist != nil {
+		if err = r.persist(r.builder); err != nil {
+			r.builder.RemoveNode(n.ID())
+			return nil, err
+		}
+	}
+	r.logDebug("NodeRegistrar: added %s as %016x\n", a.Addresses[0], n.ID())
+	return &NodeRegistration{ID: n.ID(), Added: true}, nil
+}
+
+// ServeHTTP accepts a NodeAnnouncement as the JSON body of a POST request,
+// replying with the NodeRegistration as JSON; http.StatusCreated if the node
+// was added, http.StatusOK if already registered, or http.StatusForbidden if
+// rejected.
+func (r *NodeRegistrar) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	a := &NodeAnnouncement{}
+	if err := json.NewDecoder(req.Body).Decode(a); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reg, err := r.Announce(a)
+	if err != nil {
+		if _, ok := err.(*NodeRejectedError); ok {
+			http.Error(w, err.Error(), http.StatusForbidden)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	status := http.StatusOK
+	if reg.Added {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, reg)
+}
+
+// AnnounceNode is the node side of self-registration, sending the
+// announcement to the NodeRegistrar served at the URL given. A nil client
+// uses http.DefaultClient.
+func AnnounceNode(client *http.Client, url string, a *NodeAnnouncement) (*NodeRegistration, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	body, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("announce to %s: %s: %s", url, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	reg := &NodeRegistration{}
+	if err = json.NewDecoder(resp.Body).Decode(reg); err != nil {
+		return nil, err
+	}
+	return reg, nil
+}
@@ -0,0 +1,85 @@
+package ring
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNodeRegistrar(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetMaxPartitionBitCount(8)
+	lock := &sync.Mutex{}
+	var published []Ring
+	s := NewRebalanceScheduler(b, &RebalanceSchedulerConfig{
+		Locker:            lock,
+		MaxMovePercentage: 100,
+		Publish: func(r Ring) error {
+			published = append(published, r)
+			return nil
+		},
+	})
+	persists := 0
+	reg := NewNodeRegistrar(b, &NodeRegistrarConfig{
+		Locker: lock,
+		Admit: func(a *NodeAnnouncement) error {
+			if a.Capacity == 0 {
+				return fmt.Errorf("no capacity")
+			}
+			return nil
+		},
+		Persist: func(b *Builder) error {
+			persists++
+			return nil
+		},
+		Scheduler: s,
+		PassAfter: 2,
+	})
+	server := httptest.NewServer(reg)
+	defer server.Close()
+	a := &NodeAnnouncement{Addresses: []string{"127.0.0.1:1"}, Capacity: 1, Tiers: []string{"server1"}, NetworkZone: "east"}
+	r1, err := AnnounceNode(nil, server.URL, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r1.Added || r1.Published || r1.ID == 0 {
+		t.Fatalf("%#v", r1)
+	}
+	n := b.Node(r1.ID)
+	if n == nil || n.Tier(0) != "server1" || n.NetworkZone() != "east" || !n.Active() {
+		t.Fatal(n)
+	}
+	// Announcing again, with or without the ID, is not a new node.
+	r2, err := AnnounceNode(nil, server.URL, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r2.Added || r2.ID != r1.ID {
+		t.Fatalf("%#v", r2)
+	}
+	a.ID = r1.ID
+	if r2, err = AnnounceNode(nil, server.URL, a); err != nil || r2.Added || r2.ID != r1.ID {
+		t.Fatalf("%#v %v", r2, err)
+	}
+	if _, err = AnnounceNode(nil, server.URL, &NodeAnnouncement{Addresses: []string{"127.0.0.1:2"}}); err == nil || !strings.Contains(err.Error(), "no capacity") {
+		t.Fatal(err)
+	}
+	if _, err = AnnounceNode(nil, server.URL, &NodeAnnouncement{Capacity: 1}); err == nil {
+		t.Fatal("announcement without an address should fail")
+	}
+	r3, err := AnnounceNode(nil, server.URL, &NodeAnnouncement{Addresses: []string{"127.0.0.1:3"}, Capacity: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r3.Added || !r3.Published {
+		t.Fatalf("%#v", r3)
+	}
+	if len(b.Nodes()) != 2 || persists != 2 {
+		t.Fatal(len(b.Nodes()), persists)
+	}
+	if len(published) != 1 || len(published[0].Nodes()) != 2 {
+		t.Fatal(published)
+	}
+}
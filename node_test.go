@@ -276,6 +276,49 @@ func TestTierCoalescing(t *testing.T) {
 	}
 }
 
+func TestTierDistance(t *testing.T) {
+	b := &tierBase{}
+	n1, err := newNode(nil, b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n2, err := newNode(nil, b, []*node{n1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := TierDistance(n1, n2); d != 0 {
+		t.Fatalf("%d != 0", d)
+	}
+	n1.ReplaceTiers([]string{"server1", "zone1", "region1"})
+	n2.ReplaceTiers([]string{"server1", "zone1", "region1"})
+	if d := TierDistance(n1, n2); d != 0 {
+		t.Fatalf("%d != 0", d)
+	}
+	n2.SetTier(0, "server2")
+	if d := TierDistance(n1, n2); d != 1 {
+		t.Fatalf("%d != 1", d)
+	}
+	n2.SetTier(1, "zone2")
+	if d := TierDistance(n1, n2); d != 2 {
+		t.Fatalf("%d != 2", d)
+	}
+	n2.SetTier(0, "server1")
+	if d := TierDistance(n1, n2); d != 2 {
+		t.Fatalf("%d != 2", d)
+	}
+	n2.SetTier(2, "region2")
+	if d := TierDistance(n1, n2); d != 3 {
+		t.Fatalf("%d != 3", d)
+	}
+	if d := TierDistance(n2, n1); d != 3 {
+		t.Fatalf("%d != 3", d)
+	}
+	n2.ReplaceTiers([]string{"server1", "zone1", "region1", "planet1"})
+	if d := TierDistance(n1, n2); d != 4 {
+		t.Fatalf("%d != 4", d)
+	}
+}
+
 func TestNodeFilterCommonErrors(t *testing.T) {
 	_, err := NodeSlice{}.Filter([]string{"randomstringwithoutequals"})
 	if err == nil {
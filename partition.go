@@ -0,0 +1,76 @@
+package ring
+
+import "strconv"
+
+// Partition identifies a partition of a Ring. It is a distinct type, rather
+// than a plain uint32, so partitions are not mixed up with the replica and
+// node index values that the same calls take.
+type Partition uint32
+
+// Locator is the part of Ring most users of a ring need: mapping keys to
+// partitions and partitions to the nodes responsible for them. Code needing
+// only that can accept a Locator rather than a Ring, keeping its tests free
+// of Builders; a Ring is always a Locator. See the ringtest subpackage for
+// fakes.
+type Locator interface {
+	PartitionBitCount() uint16
+	PartitionForKey(key []byte) Partition
+	ReplicaCount() int
+	LocalNode() Node
+	Responsible(partition Partition) bool
+	ResponsibleNodes(partition Partition) NodeSlice
+}
+
+var _ Locator = Ring(nil)
+
+// PartitionFromKey returns the partition a key hash belongs to for the
+// partition bit count given; the high bits of the hash are used, as described
+// with Ring.PartitionBitCount.
+func PartitionFromKey(keyHash uint64, partitionBitCount uint16) Partition {
+	if partitionBitCount == 0 {
+		return 0
+	}
+	return Partition(keyHash >> (64 - partitionBitCount))
+}
+
+// KeyHasher hashes a key for placement; the partition is taken from the upper
+// bits of the hash, as described for Ring.PartitionBitCount, so the hash
+// should spread its upper bits well. Every user of a ring must hash keys the
+// same way to agree on their placement; FNV1aKeyHasher is the default
+// throughout this package, and an xxhash or other hasher can be registered
+// with RegisterKeyHasher and given to Builder.SetKeyHasher, which records it
+// in the Builder's rings.
+type KeyHasher func(key []byte) uint64
+
+// FNV1aKeyHasher is the 64 bit FNV-1a KeyHasher, the default.
+func FNV1aKeyHasher(key []byte) uint64 {
+	const offset64 = 14695981039346656037
+	const prime64 = 1099511628211
+	hash := uint64(offset64)
+	for _, c := range key {
+		hash ^= uint64(c)
+		hash *= prime64
+	}
+	return hash
+}
+
+// PartitionCount returns how many partitions there are for the partition bit
+// count given.
+func PartitionCount(partitionBitCount uint16) int {
+	return 1 << partitionBitCount
+}
+
+// Range returns the first and last key hashes, inclusive, that belong to the
+// partition for the partition bit count given.
+func (p Partition) Range(partitionBitCount uint16) (first uint64, last uint64) {
+	if partitionBitCount == 0 {
+		return 0, ^uint64(0)
+	}
+	shift := 64 - partitionBitCount
+	first = uint64(p) << shift
+	return first, first | (^uint64(0) >> partitionBitCount)
+}
+
+func (p Partition) String() string {
+	return strconv.FormatUint(uint64(p), 10)
+}
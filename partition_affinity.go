@@ -0,0 +1,388 @@
+package ring
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// AffinityGroup is a named set of partitions whose replicas should be placed
+// together or apart; see Builder.SetAffinityGroup.
+type AffinityGroup struct {
+	Name string
+	// Partitions are the partitions of the group as numbered with the
+	// PartitionBitCount; as the partition count grows, each partition
+	// covers all the partitions it was split into.
+	PartitionBitCount uint16
+	Partitions        []Partition
+	// Colocate is true if the partitions' replicas should be kept on the
+	// same nodes, false if they should be spread over as many nodes as
+	// possible.
+	Colocate bool
+}
+
+// SetAffinityGroup declares, or replaces, the named group of partitions as
+// numbered by the Builder's current partition bit count, such as all the
+// partitions of one tenant. With colocate, rebalancing tries to keep the
+// replicas of the partitions on the same nodes, limiting how many nodes the
+// tenant depends on; otherwise it tries to spread them over as many nodes as
+// possible, limiting how much of the tenant any one node failure affects.
+//
+// Affinity is honored where possible and never at the cost of balance or
+// dispersion; rebalancing swaps replicas of the group with replicas of other
+// partitions, so node assignment counts are unchanged, and only when the swap
+// does not place replicas of a partition closer together. The swaps are
+// subject to the move wait and the moves per partition like any other
+// moves.
+func (b *Builder) SetAffinityGroup(name string, partitions []Partition, colocate bool) error {
+	if name == "" {
+		return fmt.Errorf("an affinity group needs a name")
+	}
+	partitionCount := Partition(1) << b.partitionBitCount
+	g := &AffinityGroup{Name: name, PartitionBitCount: b.partitionBitCount, Colocate: colocate}
+	seen := make(map[Partition]bool, len(partitions))
+	for _, partition := range partitions {
+		if partition >= partitionCount {
+			return fmt.Errorf("partition %d is out of range; there are %d partitions", partition, partitionCount)
+		}
+		if !seen[partition] {
+			seen[partition] = true
+			g.Partitions = append(g.Partitions, partition)
+		}
+	}
+	sort.Slice(g.Partitions, func(i, j int) bool { return g.Partitions[i] < g.Partitions[j] })
+	b.RemoveAffinityGroup(name)
+	b.affinityGroups = append(b.affinityGroups, g)
+	b.dirty = true
+	return nil
+}
+
+// RemoveAffinityGroup removes the named group, if any; see SetAffinityGroup.
+func (b *Builder) RemoveAffinityGroup(name string) {
+	for i, g := range b.affinityGroups {
+		if g.Name == name {
+			b.affinityGroups = append(b.affinityGroups[:i], b.affinityGroups[i+1:]...)
+			b.dirty = true
+			return
+		}
+	}
+}
+
+// AffinityGroups returns copies of the affinity groups declared; see
+// SetAffinityGroup.
+func (b *Builder) AffinityGroups() []*AffinityGroup {
+	rv := make([]*AffinityGroup, len(b.affinityGroups))
+	for i, g := range b.affinityGroups {
+		c := *g
+		c.Partitions = make([]Partition, len(g.Partitions))
+		copy(c.Partitions, g.Partitions)
+		rv[i] = &c
+	}
+	return rv
+}
+
+// partitionsAt returns the group's partitions as numbered with the partition
+// bit count given.
+func (g *AffinityGroup) partitionsAt(partitionBitCount uint16) []int {
+	var partitions []int
+	if partitionBitCount < g.PartitionBitCount {
+		shift := g.PartitionBitCount - partitionBitCount
+		for _, partition := range g.Partitions {
+			p := int(partition >> shift)
+			if len(partitions) == 0 || partitions[len(partitions)-1] != p {
+				partitions = append(partitions, p)
+			}
+		}
+		return partitions
+	}
+	shift := partitionBitCount - g.PartitionBitCount
+	for _, partition := range g.Partitions {
+		first := int(partition) << shift
+		for p := first; p < first+1<<shift; p++ {
+			partitions = append(partitions, p)
+		}
+	}
+	return partitions
+}
+
+// reassignAffinity swaps replicas to honor the Builder's affinity groups.
+func (rb *rebalancer) reassignAffinity() {
+	for _, g := range rb.builder.affinityGroups {
+		partitions := g.partitionsAt(rb.builder.partitionBitCount)
+		if len(partitions) < 2 {
+			continue
+		}
+		inGroup := make([]bool, rb.maxPartition+1)
+		for _, partition := range partitions {
+			inGroup[partition] = true
+		}
+		var done bool
+		if g.Colocate {
+			done = rb.colocate(partitions, inGroup)
+		} else {
+			done = rb.spread(partitions, inGroup)
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// affinityCounts returns how many replicas of the group each node has.
+func (rb *rebalancer) affinityCounts(partitions []int) []int {
+	nodeIndexToCount := make([]int, len(rb.builder.nodes))
+	for _, partitionToNodeIndex := range rb.builder.replicaToPartitionToNodeIndex {
+		for _, partition := range partitions {
+			if nodeIndex := partitionToNodeIndex[partition]; nodeIndex >= 0 {
+				nodeIndexToCount[nodeIndex]++
+			}
+		}
+	}
+	return nodeIndexToCount
+}
+
+// colocate moves the group's replicas onto the active nodes already holding
+// the most of them, as many nodes as there are replicas. It returns true if
+// the move budget ran out.
+func (rb *rebalancer) colocate(partitions []int, inGroup []bool) bool {
+	nodeIndexToCount := rb.affinityCounts(partitions)
+	var candidates []int32
+	for nodeIndex, n := range rb.builder.nodes {
+		if !n.inactive {
+			candidates = append(candidates, int32(nodeIndex))
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return nodeIndexToCount[candidates[i]] > nodeIndexToCount[candidates[j]]
+	})
+	if len(candidates) > rb.maxReplica+1 {
+		candidates = candidates[:rb.maxReplica+1]
+	}
+	isTarget := make([]bool, len(rb.builder.nodes))
+	for _, nodeIndex := range candidates {
+		isTarget[nodeIndex] = true
+	}
+	for replica := rb.maxReplica; replica >= 0; replica-- {
+		for _, partition := range partitions {
+			fromNodeIndex := rb.builder.replicaToPartitionToNodeIndex[replica][partition]
+			if fromNodeIndex < 0 || isTarget[fromNodeIndex] || !rb.canMove(replica, partition) {
+				continue
+			}
+			for _, toNodeIndex := range candidates {
+				if rb.holds(toNodeIndex, partition) {
+					continue
+				}
+				if swapped, exhausted := rb.affinitySwap(replica, partition, toNodeIndex, inGroup); exhausted {
+					return true
+				} else if swapped {
+					break
+				}
+			}
+		}
+	}
+	return false
+}
+
+// spread moves the group's replicas off the nodes holding more than their
+// share of them onto the active nodes holding the fewest. It returns true if
+// the move budget ran out.
+func (rb *rebalancer) spread(partitions []int, inGroup []bool) bool {
+	nodeIndexToCount := rb.affinityCounts(partitions)
+	var active []int32
+	total := 0
+	for nodeIndex, n := range rb.builder.nodes {
+		if !n.inactive {
+			active = append(active, int32(nodeIndex))
+			total += nodeIndexToCount[nodeIndex]
+		}
+	}
+	if len(active) == 0 {
+		return false
+	}
+	share := (total + len(active) - 1) / len(active)
+	for replica := rb.maxReplica; replica >= 0; replica-- {
+		for _, partition := range partitions {
+			fromNodeIndex := rb.builder.replicaToPartitionToNodeIndex[replica][partition]
+			if fromNodeIndex < 0 || nodeIndexToCount[fromNodeIndex] <= share || !rb.canMove(replica, partition) {
+				continue
+			}
+			sort.SliceStable(active, func(i, j int) bool {
+				return nodeIndexToCount[active[i]] < nodeIndexToCount[active[j]]
+			})
+			for _, toNodeIndex := range active {
+				if nodeIndexToCount[toNodeIndex]+1 >= nodeIndexToCount[fromNodeIndex] {
+					break
+				}
+				if rb.holds(toNodeIndex, partition) {
+					continue
+				}
+				swapped, exhausted := rb.affinitySwap(replica, partition, toNodeIndex, inGroup)
+				if exhausted {
+					return true
+				}
+				if swapped {
+					nodeIndexToCount[fromNodeIndex]--
+					nodeIndexToCount[toNodeIndex]++
+					break
+				}
+			}
+		}
+	}
+	return false
+}
+
+// affinitySwap looks for a replica of a partition outside the group assigned
+// to the node given that can trade places with the group's replica, and makes
+// the trade if found. Trading keeps each node's assignment count the same.
+// exhausted is true if the move budget would not allow the trade.
+func (rb *rebalancer) affinitySwap(replica int, partition int, toNodeIndex int32, inGroup []bool) (swapped bool, exhausted bool) {
+	fromNodeIndex := rb.builder.replicaToPartitionToNodeIndex[replica][partition]
+	if !rb.sameRegion(fromNodeIndex, toNodeIndex) || !rb.inScope(fromNodeIndex) || !rb.inScope(toNodeIndex) || rb.conflicts(partition, replica, toNodeIndex) > rb.conflicts(partition, replica, fromNodeIndex) {
+		return false, false
+	}
+	for otherReplica := rb.maxReplica; otherReplica >= 0; otherReplica-- {
+		partitionToNodeIndex := rb.builder.replicaToPartitionToNodeIndex[otherReplica]
+		for otherPartition := rb.maxPartition; otherPartition >= 0; otherPartition-- {
+			if partitionToNodeIndex[otherPartition] != toNodeIndex || inGroup[otherPartition] || !rb.canMove(otherReplica, otherPartition) || rb.holds(fromNodeIndex, otherPartition) {
+				continue
+			}
+			if rb.conflicts(otherPartition, otherReplica, fromNodeIndex) > rb.conflicts(otherPartition, otherReplica, toNodeIndex) {
+				continue
+			}
+			if rb.budgeted && rb.movesLeft < 2 {
+				rb.report.MoveBudgetExhausted = true
+				return false, true
+			}
+			rb.event(replica, partition, fromNodeIndex, toNodeIndex, RebalanceAffinity)
+			rb.event(otherReplica, otherPartition, toNodeIndex, fromNodeIndex, RebalanceAffinity)
+			rb.builder.replicaToPartitionToNodeIndex[replica][partition] = toNodeIndex
+			partitionToNodeIndex[otherPartition] = fromNodeIndex
+			rb.partitionToMovementsLeft[partition]--
+			rb.partitionToMovementsLeft[otherPartition]--
+			rb.builder.replicaToPartitionToLastMove[replica][partition] = 0
+			rb.builder.replicaToPartitionToLastMove[otherReplica][otherPartition] = 0
+			rb.altered = true
+			rb.movesLeft -= 2
+			rb.report.AffinityMoves += 2
+			return true, false
+		}
+	}
+	return false, false
+}
+
+// canMove returns true if the partition replica may be moved now, according
+// to the move wait and moves per partition.
+func (rb *rebalancer) canMove(replica int, partition int) bool {
+	return rb.partitionToMovementsLeft[partition] > 0 && rb.builder.replicaToPartitionToLastMove[replica][partition] >= rb.builder.moveWait
+}
+
+// holds returns true if the node has any replica of the partition.
+func (rb *rebalancer) holds(nodeIndex int32, partition int) bool {
+	for replica := rb.maxReplica; replica >= 0; replica-- {
+		if rb.builder.replicaToPartitionToNodeIndex[replica][partition] == nodeIndex {
+			return true
+		}
+	}
+	return false
+}
+
+// conflicts returns how many times the node would share a node or tier
+// separation with the partition's other replicas if the replica given were
+// assigned to it; fewer is better dispersion.
+func (rb *rebalancer) conflicts(partition int, replica int, nodeIndex int32) int {
+	count := 0
+	for otherReplica := rb.maxReplica; otherReplica >= 0; otherReplica-- {
+		otherNodeIndex := rb.builder.replicaToPartitionToNodeIndex[otherReplica][partition]
+		if otherReplica == replica || otherNodeIndex < 0 {
+			continue
+		}
+		if otherNodeIndex == nodeIndex {
+			count++
+		}
+		for tier := rb.maxTier; tier >= 0; tier-- {
+			if rb.tierToNodeIndexToTierSep[tier][otherNodeIndex] == rb.tierToNodeIndexToTierSep[tier][nodeIndex] {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func (b *Builder) writeAffinityGroups(w io.Writer) error {
+	if len(b.affinityGroups) > math.MaxInt32 {
+		return fmt.Errorf("%d affinity groups is too large; max is %d", len(b.affinityGroups), math.MaxInt32)
+	}
+	if err := binary.Write(w, binary.BigEndian, int32(len(b.affinityGroups))); err != nil {
+		return err
+	}
+	for _, g := range b.affinityGroups {
+		byts := []byte(g.Name)
+		if len(byts) > math.MaxInt32 {
+			return fmt.Errorf("%d affinity group name length is too large; max is %d", len(byts), math.MaxInt32)
+		}
+		if err := binary.Write(w, binary.BigEndian, int32(len(byts))); err != nil {
+			return err
+		}
+		if _, err := w.Write(byts); err != nil {
+			return err
+		}
+		var colocate byte
+		if g.Colocate {
+			colocate = 1
+		}
+		if err := binary.Write(w, binary.BigEndian, colocate); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.BigEndian, g.PartitionBitCount); err != nil {
+			return err
+		}
+		if len(g.Partitions) > math.MaxInt32 {
+			return fmt.Errorf("%d affinity group partitions is too large; max is %d", len(g.Partitions), math.MaxInt32)
+		}
+		if err := binary.Write(w, binary.BigEndian, int32(len(g.Partitions))); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.BigEndian, g.Partitions); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Builder) readAffinityGroups(r io.Reader) error {
+	var count int32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return err
+	}
+	b.affinityGroups = make([]*AffinityGroup, count)
+	for i := range b.affinityGroups {
+		var length int32
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return err
+		}
+		byts := make([]byte, length)
+		if _, err := io.ReadFull(r, byts); err != nil {
+			return err
+		}
+		g := &AffinityGroup{Name: string(byts)}
+		var colocate byte
+		if err := binary.Read(r, binary.BigEndian, &colocate); err != nil {
+			return err
+		}
+		g.Colocate = colocate != 0
+		if err := binary.Read(r, binary.BigEndian, &g.PartitionBitCount); err != nil {
+			return err
+		}
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return err
+		}
+		g.Partitions = make([]Partition, length)
+		if err := binary.Read(r, binary.BigEndian, g.Partitions); err != nil {
+			return err
+		}
+		b.affinityGroups[i] = g
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package ring
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func affinityNodeCounts(r Ring, partitions []Partition) map[uint64]int {
+	counts := make(map[uint64]int)
+	for _, partition := range partitions {
+		for _, n := range r.ResponsibleNodes(partition) {
+			counts[n.ID()]++
+		}
+	}
+	return counts
+}
+
+func TestPartitionAffinity(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetMaxPartitionBitCount(6)
+	b.SetMoveWait(0)
+	b.SetReplicaCount(3)
+	for i := 0; i < 10; i++ {
+		if _, err := b.AddNode(true, 1, nil, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := b.Ring()
+	if r.PartitionBitCount() != 6 {
+		t.Fatal(r.PartitionBitCount())
+	}
+	// nodeCounts returns the sorted assignment counts of the nodes.
+	nodeCounts := func(r Ring) []int {
+		idToCount := make(map[uint64]int)
+		for partition := Partition(0); partition < 1<<r.PartitionBitCount(); partition++ {
+			for _, n := range r.ResponsibleNodes(partition) {
+				idToCount[n.ID()]++
+			}
+		}
+		var counts []int
+		for _, count := range idToCount {
+			counts = append(counts, count)
+		}
+		sort.Ints(counts)
+		return counts
+	}
+	balanced := nodeCounts(r)
+	partitions := []Partition{1, 7, 20, 33, 45, 60}
+	if err := b.SetAffinityGroup("tenant", partitions, true); err != nil {
+		t.Fatal(err)
+	}
+	r = b.Ring()
+	if rr := b.LastRebalanceReport(); rr.AffinityMoves == 0 {
+		t.Fatalf("%#v", rr)
+	}
+	// Only one replica of a partition moves per rebalance by default, so it
+	// takes a few.
+	for i := 0; len(affinityNodeCounts(r, partitions)) != 3; i++ {
+		if i == 10 {
+			t.Fatalf("%v", affinityNodeCounts(r, partitions))
+		}
+		r = b.Ring()
+	}
+	// Swaps leave the balance alone.
+	if counts := nodeCounts(r); !reflect.DeepEqual(counts, balanced) {
+		t.Fatalf("%v != %v", counts, balanced)
+	}
+	// Now spread the group out again.
+	if err := b.SetAffinityGroup("tenant", partitions, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.AffinityGroups()) != 1 {
+		t.Fatal(len(b.AffinityGroups()))
+	}
+	for i := 0; ; i++ {
+		r = b.Ring()
+		spread := true
+		for _, count := range affinityNodeCounts(r, partitions) {
+			if count > 2 {
+				spread = false
+			}
+		}
+		if spread {
+			break
+		}
+		if i == 10 {
+			t.Fatalf("%v", affinityNodeCounts(r, partitions))
+		}
+	}
+	if counts := nodeCounts(r); !reflect.DeepEqual(counts, balanced) {
+		t.Fatalf("%v != %v", counts, balanced)
+	}
+	// The groups are persisted.
+	buf := bytes.NewBuffer(nil)
+	if err := b.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := LoadBuilder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(b2.AffinityGroups(), b.AffinityGroups()) {
+		t.Fatalf("%#v != %#v", b2.AffinityGroups(), b.AffinityGroups())
+	}
+	b.RemoveAffinityGroup("tenant")
+	if len(b.AffinityGroups()) != 0 {
+		t.Fatal(len(b.AffinityGroups()))
+	}
+	if err := b.SetAffinityGroup("tenant", []Partition{1 << 6}, true); err == nil {
+		t.Fatal("out of range partition accepted")
+	}
+	if err := b.SetAffinityGroup("", partitions, true); err == nil {
+		t.Fatal("empty name accepted")
+	}
+}
+
+func TestAffinityGroupPartitionsAt(t *testing.T) {
+	g := &AffinityGroup{PartitionBitCount: 2, Partitions: []Partition{1, 3}}
+	if p := g.partitionsAt(3); !reflect.DeepEqual(p, []int{2, 3, 6, 7}) {
+		t.Fatal(p)
+	}
+	if p := g.partitionsAt(1); !reflect.DeepEqual(p, []int{0, 1}) {
+		t.Fatal(p)
+	}
+	if p := g.partitionsAt(2); !reflect.DeepEqual(p, []int{1, 3}) {
+		t.Fatal(p)
+	}
+}
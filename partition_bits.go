@@ -0,0 +1,64 @@
+package ring
+
+import "fmt"
+
+// SetPartitionBits fixes the ring at 2**bits partitions, as with Swift's
+// partition power, rather than letting rebalancing double the partition count
+// whenever the nodes cannot be balanced within the points allowed. The
+// partitions are split up to the count right away, without moving any
+// replicas, and MaxPartitionBitCount is set to bits so the count stays put;
+// setting MaxPartitionBitCount higher later lifts the pin.
+//
+// The partition count cannot shrink, so bits below the current partition bit
+// count is an error. It is also an error, leaving the Builder unchanged, if
+// at that size some active node could not be kept within the points allowed
+// of its desired number of partition replicas, just due to the rounding of
+// the replicas to whole numbers; see SetPointsAllowed.
+func (b *Builder) SetPartitionBits(bits uint16) error {
+	if bits < b.partitionBitCount {
+		return fmt.Errorf("cannot shrink from %d to %d partition bits", b.partitionBitCount, bits)
+	}
+	if bits > 31 {
+		return fmt.Errorf("%d partition bits is more than the 31 allowed", bits)
+	}
+	if n, percentage := b.partitionBitsImbalance(bits); n != nil {
+		return fmt.Errorf("at %d partition bits node %d would be %.02f%% off its desired assignments; %d%% allowed", bits, n.id, percentage, b.pointsAllowed)
+	}
+	if bits > b.partitionBitCount {
+		b.growPartitionBitCount(bits)
+		b.dirty = true
+	}
+	b.maxPartitionBitCount = bits
+	return nil
+}
+
+// partitionBitsImbalance returns the first active node that would be further
+// than the points allowed from its desired number of partition replicas at
+// the partition bit count given, and how far as a percentage; the node is nil
+// if there is none. This is the same measure resizeIfNeeded grows by.
+func (b *Builder) partitionBitsImbalance(bits uint16) (*node, float64) {
+	totalCapacity := uint64(0)
+	for _, n := range b.nodes {
+		if !n.inactive {
+			totalCapacity += n.usableCapacity()
+		}
+	}
+	assignments := uint64(len(b.replicaToPartitionToNodeIndex)) << bits
+	pointsAllowed := float64(b.pointsAllowed) * 0.01
+	for _, n := range b.nodes {
+		if n.inactive || n.usableCapacity() == 0 {
+			continue
+		}
+		whole, rem := desiredAssignments(n.usableCapacity(), totalCapacity, assignments)
+		fraction := float64(rem) / float64(totalCapacity)
+		desired := float64(whole) + fraction
+		off := fraction / desired
+		if rem > 0 && (1-fraction)/desired > off {
+			off = (1 - fraction) / desired
+		}
+		if off > pointsAllowed {
+			return n, off * 100
+		}
+	}
+	return nil, 0
+}
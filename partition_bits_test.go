@@ -0,0 +1,36 @@
+package ring
+
+import "testing"
+
+func TestBuilderSetPartitionBits(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetReplicaCount(2)
+	for i := 0; i < 4; i++ {
+		if _, err := b.AddNode(true, 1, nil, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Ring()
+	if err := b.SetPartitionBits(6); err != nil {
+		t.Fatal(err)
+	}
+	if b.partitionBitCount != 6 || b.MaxPartitionBitCount() != 6 {
+		t.Fatal(b.partitionBitCount, b.MaxPartitionBitCount())
+	}
+	// A node that would otherwise grow the ring does not.
+	if _, err := b.AddNode(true, 1, nil, nil, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if r := b.Ring(); r.PartitionBitCount() != 6 {
+		t.Fatal(r.PartitionBitCount())
+	}
+	if err := b.SetPartitionBits(5); err == nil {
+		t.Fatal("partition count shrank")
+	}
+	// Five nodes cannot be kept within 1% of their desired replicas at 128
+	// replicas.
+	b.SetMaxPartitionBitCount(23)
+	if err := b.SetPartitionBits(6); err == nil || b.MaxPartitionBitCount() != 23 {
+		t.Fatal(err, b.MaxPartitionBitCount())
+	}
+}
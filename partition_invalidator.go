@@ -0,0 +1,122 @@
+package ring
+
+import (
+	"sort"
+	"sync"
+)
+
+// ChangedPartitions returns the partitions of the current ring whose set of
+// responsible nodes differs from that under the previous ring, in ascending
+// order; the order of the nodes within the set does not matter. Should the
+// partition bit count have changed, a partition is compared with each of the
+// previous partitions covering it, as with MsgToFormerReplicas.
+func ChangedPartitions(previous Ring, current Ring) []Partition {
+	var changed []Partition
+	var currentIDs, previousIDs []uint64
+	partitionCount := Partition(1) << current.PartitionBitCount()
+	for partition := Partition(0); partition < partitionCount; partition++ {
+		currentIDs = appendSortedNodeIDs(currentIDs[:0], current.ResponsibleNodes(partition))
+		first, last := previousPartitions(current.PartitionBitCount(), previous.PartitionBitCount(), partition)
+		for p := first; ; p++ {
+			previousIDs = appendSortedNodeIDs(previousIDs[:0], previous.ResponsibleNodes(p))
+			if !equalNodeIDs(currentIDs, previousIDs) {
+				changed = append(changed, partition)
+				break
+			}
+			if p == last {
+				break
+			}
+		}
+	}
+	return changed
+}
+
+func appendSortedNodeIDs(ids []uint64, nodes NodeSlice) []uint64 {
+	for _, n := range nodes {
+		ids = append(ids, n.ID())
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func equalNodeIDs(a []uint64, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, id := range a {
+		if b[i] != id {
+			return false
+		}
+	}
+	return true
+}
+
+// PartitionInvalidation tells a PartitionInvalidator's callbacks which cached
+// partitions a ring change made stale.
+type PartitionInvalidation struct {
+	// PreviousRingVersion and RingVersion are the Versions of the rings
+	// compared.
+	PreviousRingVersion int64
+	RingVersion         int64
+	// All is true if the partition bit count changed, so caches keyed by the
+	// previous ring's partitions should be flushed wholesale; Partitions is
+	// then nil.
+	All bool
+	// Partitions are those whose responsible nodes changed, in ascending
+	// order; see ChangedPartitions.
+	Partitions []Partition
+}
+
+// PartitionInvalidator watches ring changes for caches keyed by partition,
+// such as of where data lives or of open handles to replica peers, so they
+// only drop the entries of the partitions a new ring actually moved, rather
+// than being flushed wholesale on every ring version.
+//
+// Give it each new Ring with SetRing, which is usable directly as an
+// HTTPRingLoaderConfig.RingChanged func.
+type PartitionInvalidator struct {
+	setRingLock sync.Mutex
+	lock        sync.Mutex
+	ring        Ring
+	callbacks   []func(inv *PartitionInvalidation)
+}
+
+// NewPartitionInvalidator creates a PartitionInvalidator with no ring yet.
+func NewPartitionInvalidator() *PartitionInvalidator {
+	return &PartitionInvalidator{}
+}
+
+// Register adds the callback, which will be called by SetRing whenever a new
+// ring changes any partition's responsible nodes. Callbacks are called in
+// the order registered, with no locks held, but calls are serialized.
+func (pi *PartitionInvalidator) Register(callback func(inv *PartitionInvalidation)) {
+	pi.lock.Lock()
+	pi.callbacks = append(pi.callbacks, callback)
+	pi.lock.Unlock()
+}
+
+// SetRing compares the Ring with the previous one given, if any, and calls
+// the callbacks with the partitions that changed. The first ring given
+// invalidates nothing, as nothing could have been cached from an earlier
+// ring.
+func (pi *PartitionInvalidator) SetRing(r Ring) {
+	pi.setRingLock.Lock()
+	defer pi.setRingLock.Unlock()
+	pi.lock.Lock()
+	previous := pi.ring
+	pi.ring = r
+	callbacks := pi.callbacks
+	pi.lock.Unlock()
+	if previous == nil || len(callbacks) == 0 {
+		return
+	}
+	inv := &PartitionInvalidation{PreviousRingVersion: previous.Version(), RingVersion: r.Version()}
+	if previous.PartitionBitCount() != r.PartitionBitCount() {
+		inv.All = true
+	} else if inv.Partitions = ChangedPartitions(previous, r); len(inv.Partitions) == 0 {
+		return
+	}
+	for _, callback := range callbacks {
+		callback(inv)
+	}
+}
@@ -0,0 +1,58 @@
+package ring
+
+import (
+	"reflect"
+	"testing"
+)
+
+// newAssignedRing returns a ring of nodes 1 to 3 whose replica to partition
+// to node indexes are as given.
+func newAssignedRing(version int64, bits uint16, replicaToPartitionToNodeIndex [][]int32) *ring {
+	return &ring{
+		version:                       version,
+		localNodeIndex:                -1,
+		partitionBitCount:             bits,
+		nodes:                         []*node{{id: 1}, {id: 2}, {id: 3}},
+		replicaToPartitionToNodeIndex: replicaToPartitionToNodeIndex,
+	}
+}
+
+func TestChangedPartitions(t *testing.T) {
+	previous := newAssignedRing(1, 1, [][]int32{{0, 1}, {1, 2}})
+	for _, c := range []struct {
+		name    string
+		current *ring
+		changed []Partition
+	}{
+		{"same", newAssignedRing(2, 1, [][]int32{{0, 1}, {1, 2}}), nil},
+		// Partition 0 only has its replicas reordered.
+		{"moved", newAssignedRing(2, 1, [][]int32{{1, 1}, {0, 0}}), []Partition{1}},
+		{"split", newAssignedRing(2, 2, [][]int32{{0, 0, 1, 2}, {1, 2, 2, 1}}), []Partition{1}},
+		{"merged", newAssignedRing(2, 0, [][]int32{{0}, {1}}), []Partition{0}},
+	} {
+		if changed := ChangedPartitions(previous, c.current); !reflect.DeepEqual(changed, c.changed) {
+			t.Errorf("%s: %v", c.name, changed)
+		}
+	}
+}
+
+func TestPartitionInvalidator(t *testing.T) {
+	pi := NewPartitionInvalidator()
+	var got []*PartitionInvalidation
+	pi.Register(func(inv *PartitionInvalidation) {
+		got = append(got, inv)
+	})
+	pi.SetRing(newAssignedRing(1, 1, [][]int32{{0, 1}, {1, 2}}))
+	pi.SetRing(newAssignedRing(2, 1, [][]int32{{1, 1}, {0, 2}}))
+	if len(got) != 0 {
+		t.Fatal(got[0])
+	}
+	pi.SetRing(newAssignedRing(3, 1, [][]int32{{1, 1}, {0, 0}}))
+	if len(got) != 1 || !reflect.DeepEqual(got[0], &PartitionInvalidation{PreviousRingVersion: 2, RingVersion: 3, Partitions: []Partition{1}}) {
+		t.Fatal(got)
+	}
+	pi.SetRing(newAssignedRing(4, 2, [][]int32{{1, 1, 1, 1}, {0, 0, 0, 0}}))
+	if len(got) != 2 || !got[1].All || got[1].Partitions != nil {
+		t.Fatal(got[1])
+	}
+}
@@ -0,0 +1,162 @@
+package ring
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// PartitionMode restricts the use of a partition cluster-wide, such as while
+// its data is migrated or during an incident. The mode is carried in the
+// ring, so every node sees the same mode for the same ring version; the
+// storage layers are expected to enforce it. See Builder.SetPartitionMode
+// and Ring.PartitionMode.
+type PartitionMode byte
+
+const (
+	// PartitionReadWrite is the normal mode, allowing reads and writes.
+	PartitionReadWrite PartitionMode = iota
+	// PartitionReadOnly allows reads but not writes.
+	PartitionReadOnly
+	// PartitionQuiesced allows neither reads nor writes.
+	PartitionQuiesced
+)
+
+func (m PartitionMode) String() string {
+	switch m {
+	case PartitionReadWrite:
+		return "read-write"
+	case PartitionReadOnly:
+		return "read-only"
+	case PartitionQuiesced:
+		return "quiesced"
+	}
+	return "unknown"
+}
+
+// Readable returns true if the mode allows reads.
+func (m PartitionMode) Readable() bool {
+	return m == PartitionReadWrite || m == PartitionReadOnly
+}
+
+// Writable returns true if the mode allows writes.
+func (m PartitionMode) Writable() bool {
+	return m == PartitionReadWrite
+}
+
+// SetPartitionMode sets the mode of the partition, as numbered by the
+// Builder's current partition bit count, for the rings generated from now
+// on; PartitionReadWrite clears any restriction. Should the partition count
+// grow, the partitions the partition is split into keep its mode.
+func (b *Builder) SetPartitionMode(partition Partition, mode PartitionMode) error {
+	if partition >= Partition(1)<<b.partitionBitCount {
+		return fmt.Errorf("partition %d is out of range; there are %d partitions", partition, PartitionCount(b.partitionBitCount))
+	}
+	if mode > PartitionQuiesced {
+		return fmt.Errorf("unknown partition mode %d", mode)
+	}
+	if b.partitionModes[partition] == mode {
+		return nil
+	}
+	if mode == PartitionReadWrite {
+		delete(b.partitionModes, partition)
+	} else {
+		if b.partitionModes == nil {
+			b.partitionModes = make(map[Partition]PartitionMode)
+		}
+		b.partitionModes[partition] = mode
+	}
+	b.dirty = true
+	return nil
+}
+
+// PartitionModes returns the partitions with a mode other than
+// PartitionReadWrite; see SetPartitionMode.
+func (b *Builder) PartitionModes() map[Partition]PartitionMode {
+	return copyPartitionModes(b.partitionModes)
+}
+
+// PartitionMode returns the mode of the partition; see
+// Builder.SetPartitionMode.
+func (r *ring) PartitionMode(partition Partition) PartitionMode {
+	return r.partitionModes[partition]
+}
+
+func (r *ring) PartitionModes() map[Partition]PartitionMode {
+	return copyPartitionModes(r.partitionModes)
+}
+
+func copyPartitionModes(modes map[Partition]PartitionMode) map[Partition]PartitionMode {
+	c := make(map[Partition]PartitionMode, len(modes))
+	for partition, mode := range modes {
+		c[partition] = mode
+	}
+	return c
+}
+
+// growPartitionModes renumbers the partition modes for a partition count
+// grown by the shift given, each partition's mode carrying over to the
+// partitions it is split into.
+func (b *Builder) growPartitionModes(shift uint16) {
+	if len(b.partitionModes) == 0 {
+		return
+	}
+	modes := make(map[Partition]PartitionMode, len(b.partitionModes)<<shift)
+	for partition, mode := range b.partitionModes {
+		first := partition << shift
+		for p := first; p < first+Partition(1)<<shift; p++ {
+			modes[p] = mode
+		}
+	}
+	b.partitionModes = modes
+}
+
+// writePartitionModes writes the count of the partition modes and then each
+// partition and mode, in partition order so identical modes persist
+// identically.
+func writePartitionModes(w io.Writer, modes map[Partition]PartitionMode) error {
+	if len(modes) > math.MaxInt32 {
+		return fmt.Errorf("%d partition modes is too large; max is %d", len(modes), math.MaxInt32)
+	}
+	partitions := make([]Partition, 0, len(modes))
+	for partition := range modes {
+		partitions = append(partitions, partition)
+	}
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
+	if err := binary.Write(w, binary.BigEndian, int32(len(partitions))); err != nil {
+		return err
+	}
+	var buf [5]byte
+	for _, partition := range partitions {
+		binary.BigEndian.PutUint32(buf[:], uint32(partition))
+		buf[4] = byte(modes[partition])
+		if _, err := w.Write(buf[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readPartitionModes(r io.Reader) (map[Partition]PartitionMode, error) {
+	var count int32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+	if count < 0 {
+		return nil, fmt.Errorf("invalid partition mode count %d", count)
+	}
+	if count == 0 {
+		return nil, nil
+	}
+	modes := make(map[Partition]PartitionMode, count)
+	var buf [5]byte
+	for i := int32(0); i < count; i++ {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return nil, err
+		}
+		modes[Partition(binary.BigEndian.Uint32(buf[:]))] = PartitionMode(buf[4])
+	}
+	return modes, nil
+}
@@ -0,0 +1,107 @@
+package ring
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPartitionMode(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetMaxPartitionBitCount(4)
+	if _, err := b.AddNode(true, 1, nil, nil, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	r := b.Ring()
+	if err := b.SetPartitionMode(Partition(1)<<r.PartitionBitCount(), PartitionReadOnly); err == nil {
+		t.Fatal("out of range partition should error")
+	}
+	if err := b.SetPartitionMode(0, PartitionReadOnly); err != nil {
+		t.Fatal(err)
+	}
+	r2 := b.Ring()
+	if r2.Version() == r.Version() {
+		t.Fatal("setting a partition mode should make a new ring version")
+	}
+	if mode := r2.PartitionMode(0); mode != PartitionReadOnly || !mode.Readable() || mode.Writable() {
+		t.Fatal(mode)
+	}
+	if mode := r.PartitionMode(0); mode != PartitionReadWrite {
+		t.Fatal(mode)
+	}
+	if err := b.SetPartitionMode(0, PartitionReadWrite); err != nil {
+		t.Fatal(err)
+	}
+	if modes := b.PartitionModes(); len(modes) != 0 {
+		t.Fatal(modes)
+	}
+}
+
+func TestPartitionModeGrow(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetMaxPartitionBitCount(8)
+	b.SetMoveWait(0)
+	if _, err := b.AddNode(true, 1, nil, nil, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	r := b.Ring()
+	bits := r.PartitionBitCount()
+	last := Partition(1)<<bits - 1
+	if err := b.SetPartitionMode(last, PartitionQuiesced); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		if _, err := b.AddNode(true, uint64(i+2), nil, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r = b.Ring()
+	if r.PartitionBitCount() <= bits {
+		t.Fatalf("partition bit count did not grow from %d", bits)
+	}
+	shift := r.PartitionBitCount() - bits
+	for p := Partition(0); p < Partition(1)<<r.PartitionBitCount(); p++ {
+		want := PartitionReadWrite
+		if p>>shift == last {
+			want = PartitionQuiesced
+		}
+		if mode := r.PartitionMode(p); mode != want {
+			t.Fatalf("partition %d: %s != %s", p, mode, want)
+		}
+	}
+}
+
+func TestPartitionModePersist(t *testing.T) {
+	b := NewBuilder(64)
+	if _, err := b.AddNode(true, 1, nil, nil, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	b.Ring()
+	if err := b.SetPartitionMode(1, PartitionQuiesced); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := b.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := LoadBuilder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if modes := b2.PartitionModes(); len(modes) != 1 || modes[1] != PartitionQuiesced {
+		t.Fatal(modes)
+	}
+	buf.Reset()
+	if err = b2.Ring().Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	r, err := LoadRing(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := r.PartitionMode(1); mode != PartitionQuiesced {
+		t.Fatal(mode)
+	}
+	if mode := r.PartitionMode(0); mode != PartitionReadWrite {
+		t.Fatal(mode)
+	}
+}
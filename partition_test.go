@@ -0,0 +1,114 @@
+package ring
+
+import (
+	"bytes"
+	"hash/fnv"
+	"testing"
+)
+
+func TestPartitionFromKey(t *testing.T) {
+	if p := PartitionFromKey(0xf000000000000001, 4); p != 15 {
+		t.Fatal(p)
+	}
+	if p := PartitionFromKey(0x0fffffffffffffff, 4); p != 0 {
+		t.Fatal(p)
+	}
+	if p := PartitionFromKey(0xffffffffffffffff, 0); p != 0 {
+		t.Fatal(p)
+	}
+}
+
+func TestPartitionForKey(t *testing.T) {
+	for _, key := range []string{"", "a", "some/object/name"} {
+		hasher := fnv.New64a()
+		hasher.Write([]byte(key))
+		if h := FNV1aKeyHasher([]byte(key)); h != hasher.Sum64() {
+			t.Fatalf("%q: %x != %x", key, h, hasher.Sum64())
+		}
+	}
+	b := NewBuilder(64)
+	if _, err := b.AddNode(true, 1, nil, nil, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	b.SetMaxPartitionBitCount(8)
+	r := b.Ring()
+	key := []byte("some/object/name")
+	if p := r.PartitionForKey(key); p != PartitionFromKey(FNV1aKeyHasher(key), r.PartitionBitCount()) {
+		t.Fatal(p)
+	}
+	if r.KeyHasher() != DefaultKeyHasher || b.KeyHasher() != DefaultKeyHasher {
+		t.Fatal(r.KeyHasher(), b.KeyHasher())
+	}
+	if err := b.SetKeyHasher("test-max"); err == nil {
+		t.Fatal("expected error for an unregistered key hasher")
+	}
+	RegisterKeyHasher("test-max", func(key []byte) uint64 { return ^uint64(0) })
+	if err := b.SetKeyHasher("test-max"); err != nil {
+		t.Fatal(err)
+	}
+	r = b.Ring()
+	if p := r.PartitionForKey(key); int(p) != PartitionCount(r.PartitionBitCount())-1 || r.KeyHasher() != "test-max" {
+		t.Fatal(p, r.KeyHasher())
+	}
+	// The hasher is carried by name through the persisted builder and ring.
+	var buf bytes.Buffer
+	if err := b.Persist(&buf); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := LoadBuilder(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b2.KeyHasher() != "test-max" || b2.Ring().KeyHasher() != "test-max" {
+		t.Fatal(b2.KeyHasher())
+	}
+	if err = r.Persist(&buf); err != nil {
+		t.Fatal(err)
+	}
+	r2, err := LoadRing(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := r2.PartitionForKey(key); int(p) != PartitionCount(r2.PartitionBitCount())-1 || r2.KeyHasher() != "test-max" {
+		t.Fatal(p, r2.KeyHasher())
+	}
+	// A ring whose hasher is not registered is not loaded, rather than
+	// placing keys differently.
+	r.(*ring).keyHasherName = "test-unregistered"
+	if err = r.Persist(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadRing(&buf); err == nil {
+		t.Fatal("expected error for an unregistered key hasher")
+	}
+	if err = b.SetKeyHasher(DefaultKeyHasher); err != nil {
+		t.Fatal(err)
+	}
+	if r = b.Ring(); r.PartitionForKey(key) != PartitionFromKey(FNV1aKeyHasher(key), r.PartitionBitCount()) {
+		t.Fatal(r.PartitionForKey(key))
+	}
+}
+
+func TestPartitionRange(t *testing.T) {
+	first, last := Partition(3).Range(4)
+	if first != 0x3000000000000000 || last != 0x3fffffffffffffff {
+		t.Fatalf("%x %x", first, last)
+	}
+	for _, keyHash := range []uint64{first, last} {
+		if p := PartitionFromKey(keyHash, 4); p != 3 {
+			t.Fatal(p)
+		}
+	}
+	if first, last = Partition(0).Range(0); first != 0 || last != ^uint64(0) {
+		t.Fatalf("%x %x", first, last)
+	}
+	if v := PartitionCount(4); v != 16 {
+		t.Fatal(v)
+	}
+}
+
+func TestPartitionString(t *testing.T) {
+	if s := Partition(123).String(); s != "123" {
+		t.Fatal(s)
+	}
+}
@@ -0,0 +1,139 @@
+package ring
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sync"
+)
+
+// MaxPartitionTreeDepth is the deepest PartitionTree allowed; at this depth a
+// tree has 65,536 leaves.
+const MaxPartitionTreeDepth = 16
+
+// PartitionTree is a merkle tree over the hash space of a partition, split
+// into 1<<depth sub-ranges as leaves, for finding which parts of a partition
+// differ between replicas without comparing everything; see TreeExchanger.
+//
+// The application fills in the leaves from its data, usually by calling Add
+// with a hash of each item stored, for the leaf LeafFor gives the item's key
+// hash. All replicas must use the same depth and hash their items the same
+// way. A PartitionTree is safe for concurrent use.
+type PartitionTree struct {
+	lock   sync.Mutex
+	depth  int
+	hashes []uint64
+	dirty  bool
+}
+
+// NewPartitionTree returns an empty PartitionTree with 1<<depth leaves; the
+// depth is limited to 0 through MaxPartitionTreeDepth.
+func NewPartitionTree(depth int) *PartitionTree {
+	if depth < 0 {
+		depth = 0
+	}
+	if depth > MaxPartitionTreeDepth {
+		depth = MaxPartitionTreeDepth
+	}
+	return &PartitionTree{depth: depth, hashes: make([]uint64, 1<<uint(depth+1)-1)}
+}
+
+// Depth returns the depth of the tree; the root is level 0 and the leaves are
+// at level Depth.
+func (p *PartitionTree) Depth() int {
+	return p.depth
+}
+
+// LeafCount returns the number of leaves, 1<<Depth.
+func (p *PartitionTree) LeafCount() int {
+	return 1 << uint(p.depth)
+}
+
+// LeafFor returns the leaf for the key hash, as used with a ring of the
+// partition bit count given; the bits of the key hash following those that
+// select the partition select the leaf.
+func (p *PartitionTree) LeafFor(partitionBitCount uint16, keyHash uint64) int {
+	if p.depth == 0 {
+		return 0
+	}
+	return int((keyHash << partitionBitCount) >> uint(64-p.depth))
+}
+
+// treePosition returns the index into PartitionTree.hashes of the node at the
+// level and index.
+func treePosition(level int, index int) int {
+	return 1<<uint(level) - 1 + index
+}
+
+// Add folds the item hash into the leaf's hash. Items may be added in any
+// order and adding the same item hash again removes it, so a leaf can be kept
+// current as items are stored and deleted.
+func (p *PartitionTree) Add(leaf int, itemHash uint64) {
+	p.lock.Lock()
+	p.hashes[treePosition(p.depth, leaf)] ^= itemHash
+	p.dirty = true
+	p.lock.Unlock()
+}
+
+// SetLeaf sets the hash of the leaf, for applications computing leaf hashes
+// themselves.
+func (p *PartitionTree) SetLeaf(leaf int, hash uint64) {
+	p.lock.Lock()
+	p.hashes[treePosition(p.depth, leaf)] = hash
+	p.dirty = true
+	p.lock.Unlock()
+}
+
+// Hash returns the hash of the node at the level, 0 being the root, and the
+// index within that level, 0 through 1<<level-1.
+func (p *PartitionTree) Hash(level int, index int) uint64 {
+	p.lock.Lock()
+	p.update()
+	hash := p.hashes[treePosition(level, index)]
+	p.lock.Unlock()
+	return hash
+}
+
+// Root returns the hash of the whole tree.
+func (p *PartitionTree) Root() uint64 {
+	return p.Hash(0, 0)
+}
+
+// Diff returns the leaves whose hashes differ from those of the other tree,
+// which must have the same depth.
+func (p *PartitionTree) Diff(other *PartitionTree) []int {
+	var leaves []int
+	var walk func(level int, index int)
+	walk = func(level int, index int) {
+		if p.Hash(level, index) == other.Hash(level, index) {
+			return
+		}
+		if level == p.depth {
+			leaves = append(leaves, index)
+			return
+		}
+		walk(level+1, index*2)
+		walk(level+1, index*2+1)
+	}
+	walk(0, 0)
+	return leaves
+}
+
+// update recomputes the hashes above the leaves if any leaf has changed; the
+// caller must hold the lock.
+func (p *PartitionTree) update() {
+	if !p.dirty {
+		return
+	}
+	h := fnv.New64a()
+	var buf [16]byte
+	for level := p.depth - 1; level >= 0; level-- {
+		for index := 0; index < 1<<uint(level); index++ {
+			binary.BigEndian.PutUint64(buf[0:], p.hashes[treePosition(level+1, index*2)])
+			binary.BigEndian.PutUint64(buf[8:], p.hashes[treePosition(level+1, index*2+1)])
+			h.Reset()
+			h.Write(buf[:])
+			p.hashes[treePosition(level, index)] = h.Sum64()
+		}
+	}
+	p.dirty = false
+}
@@ -0,0 +1,38 @@
+package ring
+
+import "testing"
+
+func TestPartitionTree(t *testing.T) {
+	a := NewPartitionTree(4)
+	b := NewPartitionTree(4)
+	if a.LeafCount() != 16 {
+		t.Fatal(a.LeafCount())
+	}
+	if leaf := a.LeafFor(8, 0x00f1<<48); leaf != 15 {
+		t.Fatal(leaf)
+	}
+	if leaf := NewPartitionTree(0).LeafFor(8, 0xffff<<48); leaf != 0 {
+		t.Fatal(leaf)
+	}
+	for leaf := 0; leaf < 16; leaf++ {
+		a.Add(leaf, uint64(leaf+1))
+		b.Add(leaf, uint64(leaf+1))
+	}
+	if a.Root() != b.Root() || len(a.Diff(b)) != 0 {
+		t.Fatal("trees should match")
+	}
+	b.Add(3, 100)
+	b.Add(12, 200)
+	if a.Root() == b.Root() {
+		t.Fatal("trees should differ")
+	}
+	if leaves := a.Diff(b); len(leaves) != 2 || leaves[0] != 3 || leaves[1] != 12 {
+		t.Fatal(leaves)
+	}
+	// Adding the same item hash again removes it.
+	b.Add(3, 100)
+	b.Add(12, 200)
+	if a.Root() != b.Root() {
+		t.Fatal("trees should match again")
+	}
+}
@@ -0,0 +1,220 @@
+package ring
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PeerInfo is what a TCPMsgRing has learned about the peer at an address from
+// its last handshake; see TCPMsgRing.Peer.
+type PeerInfo struct {
+	Addr   string `json:"addr"`
+	NodeID uint64 `json:"node_id,string"`
+	// ProtocolVersion is the TCPMsgRing protocol version the peer spoke,
+	// which indicates the protocol features it supports.
+	ProtocolVersion string    `json:"protocol_version"`
+	LastHandshake   time.Time `json:"last_handshake"`
+	// ClockSkew is how far ahead of the local clock the peer's clock was
+	// estimated to be at the last handshake; negative if behind.
+	ClockSkew time.Duration `json:"clock_skew"`
+	// MaxMsgLength is the longest message content the peer accepts, as it
+	// gave during the handshake; 0 if not yet known.
+	MaxMsgLength uint64 `json:"max_msg_length,string,omitempty"`
+	// Features are the protocol features agreed upon for the last connection
+	// with the peer, such as "compress" and "multiplex", and PeerFeatures
+	// those the peer offered. Features are renegotiated with every
+	// connection, so these follow along as either end is upgraded during a
+	// rolling deploy; TCPMsgRingStats.FeatureChanges counts the handshakes
+	// that agreed upon different features than the peer's previous one.
+	Features     []string `json:"features,omitempty"`
+	PeerFeatures []string `json:"peer_features,omitempty"`
+}
+
+// peerCache remembers the PeerInfo for each address, optionally persisted to
+// a file so the information survives restarts. The file is only rewritten
+// when an address's node ID, protocol version, or MaxMsgLength changes, so a
+// reconnect storm of already known peers causes no disk writes.
+type peerCache struct {
+	file  string
+	lock  sync.RWMutex
+	peers map[string]*PeerInfo
+}
+
+// loadPeerCache returns a peerCache backed by the file, if not empty, loading
+// any PeerInfo previously saved there. A missing file is not an error.
+func loadPeerCache(file string) (*peerCache, error) {
+	p := &peerCache{file: file, peers: make(map[string]*PeerInfo)}
+	if file == "" {
+		return p, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return p, err
+	}
+	var peers []*PeerInfo
+	if err = json.Unmarshal(b, &peers); err != nil {
+		return p, err
+	}
+	for _, peer := range peers {
+		p.peers[peer.Addr] = peer
+	}
+	return p, nil
+}
+
+func (p *peerCache) get(addr string) (PeerInfo, bool) {
+	p.lock.RLock()
+	peer, ok := p.peers[addr]
+	var rv PeerInfo
+	if ok {
+		rv = *peer
+	}
+	p.lock.RUnlock()
+	return rv, ok
+}
+
+func (p *peerCache) all() []PeerInfo {
+	p.lock.RLock()
+	rv := make([]PeerInfo, 0, len(p.peers))
+	for _, peer := range p.peers {
+		rv = append(rv, *peer)
+	}
+	p.lock.RUnlock()
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Addr < rv[j].Addr })
+	return rv
+}
+
+// record notes a handshake with the peer at the address, saving the cache if
+// what is known about the address changed.
+func (p *peerCache) record(addr string, nodeID uint64, protocolVersion string, now time.Time) error {
+	p.lock.Lock()
+	peer := p.peers[addr]
+	if peer != nil && peer.NodeID == nodeID && peer.ProtocolVersion == protocolVersion {
+		peer.LastHandshake = now
+		p.lock.Unlock()
+		return nil
+	}
+	p.peers[addr] = &PeerInfo{Addr: addr, NodeID: nodeID, ProtocolVersion: protocolVersion, LastHandshake: now}
+	err := p.save()
+	p.lock.Unlock()
+	return err
+}
+
+// setMaxMsgLength notes the peer's MaxMsgLength for the address, saving the
+// cache if it changed.
+func (p *peerCache) setMaxMsgLength(addr string, maxMsgLength uint64) error {
+	p.lock.Lock()
+	var err error
+	if peer := p.peers[addr]; peer != nil && peer.MaxMsgLength != maxMsgLength {
+		peer.MaxMsgLength = maxMsgLength
+		err = p.save()
+	}
+	p.lock.Unlock()
+	return err
+}
+
+// maxMsgLength returns the peer's MaxMsgLength for the address, or 0 if not
+// known.
+func (p *peerCache) maxMsgLength(addr string) uint64 {
+	p.lock.RLock()
+	var rv uint64
+	if peer := p.peers[addr]; peer != nil {
+		rv = peer.MaxMsgLength
+	}
+	p.lock.RUnlock()
+	return rv
+}
+
+// setFeatures notes the features agreed upon with, and offered by, the peer at
+// the address, returning true if the agreed features differ from those of
+// the previous handshake; as with setClockSkew, this does not save the cache.
+func (p *peerCache) setFeatures(addr string, features []string, peerFeatures []string) bool {
+	p.lock.Lock()
+	changed := false
+	if peer := p.peers[addr]; peer != nil {
+		changed = peer.Features != nil && !equalStrings(peer.Features, features)
+		peer.Features = features
+		peer.PeerFeatures = peerFeatures
+	}
+	p.lock.Unlock()
+	return changed
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// setClockSkew notes the clock skew measured for the address; as the skew
+// varies with every handshake, this does not save the cache.
+func (p *peerCache) setClockSkew(addr string, skew time.Duration) {
+	p.lock.Lock()
+	if peer := p.peers[addr]; peer != nil {
+		peer.ClockSkew = skew
+	}
+	p.lock.Unlock()
+}
+
+// prune forgets the addresses whose node ID is no longer the one given by
+// addrToNodeID, saving the cache if anything was forgotten.
+func (p *peerCache) prune(addrToNodeID map[string]uint64) error {
+	p.lock.Lock()
+	pruned := false
+	for addr, peer := range p.peers {
+		if addrToNodeID[addr] != peer.NodeID {
+			delete(p.peers, addr)
+			pruned = true
+		}
+	}
+	var err error
+	if pruned {
+		err = p.save()
+	}
+	p.lock.Unlock()
+	return err
+}
+
+// save writes the cache to its file, if any, replacing the file atomically;
+// the caller must hold the lock.
+func (p *peerCache) save() error {
+	if p.file == "" {
+		return nil
+	}
+	peers := make([]*PeerInfo, 0, len(p.peers))
+	for _, peer := range p.peers {
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Addr < peers[j].Addr })
+	b, err := json.MarshalIndent(peers, "", "    ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p.file), filepath.Base(p.file)+".")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), p.file)
+}
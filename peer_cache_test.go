@@ -0,0 +1,90 @@
+package ring
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPeerCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peercache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "peers.json")
+	p, err := loadPeerCache(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if err = p.record("10.0.0.1:1", 1, "v1", now); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.record("10.0.0.2:1", 2, "v1", now); err != nil {
+		t.Fatal(err)
+	}
+	// An unchanged peer does not rewrite the file.
+	os.Remove(file)
+	if err = p.record("10.0.0.1:1", 1, "v1", now.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(file); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if peer, ok := p.get("10.0.0.1:1"); !ok || !peer.LastHandshake.Equal(now.Add(time.Second)) {
+		t.Fatalf("%v %#v", ok, peer)
+	}
+	if err = p.record("10.0.0.1:1", 3, "v1", now); err != nil {
+		t.Fatal(err)
+	}
+	p2, err := loadPeerCache(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peers := p2.all(); len(peers) != 2 || peers[0].NodeID != 3 || peers[1].NodeID != 2 || peers[1].ProtocolVersion != "v1" {
+		t.Fatalf("%#v", peers)
+	}
+	// Addresses gone from the ring, or now another node, are forgotten.
+	if err = p2.prune(map[string]uint64{"10.0.0.1:1": 3, "10.0.0.2:1": 4}); err != nil {
+		t.Fatal(err)
+	}
+	p3, err := loadPeerCache(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peers := p3.all(); len(peers) != 1 || peers[0].Addr != "10.0.0.1:1" {
+		t.Fatalf("%#v", peers)
+	}
+	if err = ioutil.WriteFile(file, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadPeerCache(file); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestPeerCacheFeatures(t *testing.T) {
+	p, _ := loadPeerCache("")
+	if p.setFeatures("10.0.0.1:1", featureNames(featureCompress), nil) {
+		t.Fatal("unknown peer changed")
+	}
+	p.record("10.0.0.1:1", 1, "v1", time.Now())
+	// The first handshake's features are not a change.
+	if p.setFeatures("10.0.0.1:1", featureNames(0), featureNames(featureMultiplex)) {
+		t.Fatal("first features counted as a change")
+	}
+	if p.setFeatures("10.0.0.1:1", featureNames(0), featureNames(featureMultiplex)) {
+		t.Fatal("same features counted as a change")
+	}
+	// The peer was upgraded and multiplexing is now agreed upon.
+	if !p.setFeatures("10.0.0.1:1", featureNames(featureMultiplex), featureNames(featureMultiplex|featureCompress|0x80)) {
+		t.Fatal("new features not counted as a change")
+	}
+	peer, _ := p.get("10.0.0.1:1")
+	if len(peer.Features) != 1 || peer.Features[0] != "multiplex" || len(peer.PeerFeatures) != 2 || peer.PeerFeatures[0] != "compress" {
+		t.Fatalf("%#v", peer)
+	}
+}
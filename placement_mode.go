@@ -0,0 +1,95 @@
+package ring
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// PlacementMode indicates how the rebalancer weighs tier dispersion against
+// balance when separating the replicas of a partition.
+type PlacementMode byte
+
+const (
+	// PlacementBalanced, the default, separates replicas sharing a node or
+	// tier value only onto nodes that want more replicas, so dispersion never
+	// costs balance; replicas stay together when no such node would disperse
+	// them.
+	PlacementBalanced PlacementMode = iota
+	// PlacementDispersed makes the replicas of each partition as unique as
+	// the nodes allow: on distinct nodes first, then distinct values at each
+	// tier level in turn, such as servers, then zones, then regions. Replicas
+	// are separated even onto nodes already at their share, within the
+	// DispersionPointsAllowed, and replicas are not moved off overweight
+	// nodes to places leaving their partitions less dispersed.
+	PlacementDispersed
+)
+
+func (m PlacementMode) String() string {
+	switch m {
+	case PlacementBalanced:
+		return "balanced"
+	case PlacementDispersed:
+		return "dispersed"
+	}
+	return "unknown"
+}
+
+// PlacementMode indicates how the rebalancer weighs tier dispersion against
+// balance; see PlacementMode. The default is PlacementBalanced.
+func (b *Builder) PlacementMode() PlacementMode {
+	return b.placementMode
+}
+
+// SetPlacementMode sets how the rebalancer weighs tier dispersion against
+// balance; see PlacementMode.
+func (b *Builder) SetPlacementMode(mode PlacementMode) {
+	b.placementMode = mode
+}
+
+// dispersion returns how dispersed the replica of the partition would be on
+// the node from the partition's other replicas: -1 if on the same node as
+// another, otherwise one more than the highest tier level at which it differs
+// from all of them, or 0 if it differs only by node.
+func (rb *rebalancer) dispersion(partition int, replica int, nodeIndex int32) int {
+	for replicaB := rb.maxReplica; replicaB >= 0; replicaB-- {
+		if replicaB != replica && rb.builder.replicaToPartitionToNodeIndex[replicaB][partition] == nodeIndex {
+			return -1
+		}
+	}
+TierLoop:
+	for tier := rb.maxTier; tier >= 0; tier-- {
+		tierSep := rb.tierToNodeIndexToTierSep[tier][nodeIndex]
+		for replicaB := rb.maxReplica; replicaB >= 0; replicaB-- {
+			nodeIndexB := rb.builder.replicaToPartitionToNodeIndex[replicaB][partition]
+			if replicaB != replica && nodeIndexB >= 0 && rb.tierToNodeIndexToTierSep[tier][nodeIndexB] == tierSep {
+				continue TierLoop
+			}
+		}
+		return tier + 1
+	}
+	return 0
+}
+
+// keepsDispersion returns false if, with PlacementDispersed, moving the
+// replica of the partition between the nodes would leave it less dispersed.
+func (rb *rebalancer) keepsDispersion(partition int, replica int, fromNodeIndex int32, toNodeIndex int32) bool {
+	if rb.builder.placementMode != PlacementDispersed {
+		return true
+	}
+	return rb.dispersion(partition, replica, toNodeIndex) >= rb.dispersion(partition, replica, fromNodeIndex)
+}
+
+func (b *Builder) writePlacementMode(w io.Writer) error {
+	return binary.Write(w, binary.BigEndian, b.placementMode)
+}
+
+func (b *Builder) readPlacementMode(r io.Reader) error {
+	if err := binary.Read(r, binary.BigEndian, &b.placementMode); err != nil {
+		return err
+	}
+	if b.placementMode > PlacementDispersed {
+		return fmt.Errorf("invalid placement mode %d", b.placementMode)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package ring
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestBuilderPlacementMode(t *testing.T) {
+	violations := func(mode PlacementMode) []int {
+		b := NewBuilder(64)
+		b.SetReplicaCount(3)
+		b.SetMoveWait(0)
+		b.SetPlacementMode(mode)
+		for i := 0; i < 3; i++ {
+			if _, err := b.AddNode(true, 10, []string{fmt.Sprintf("s%d", i), "z1"}, nil, "", nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		b.Ring()
+		// The new zones want only a few replicas each, so balance alone
+		// leaves most partitions entirely in z1.
+		for i, zone := range []string{"z2", "z3"} {
+			if _, err := b.AddNode(true, 1, []string{fmt.Sprintf("s%d", i+3), zone}, nil, "", nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < 3; i++ {
+			b.Ring()
+		}
+		return b.Stats().DispersionViolations
+	}
+	if v := violations(PlacementBalanced); v[2] == 0 {
+		t.Fatal(v)
+	}
+	if v := violations(PlacementDispersed); v[0] != 0 || v[1] != 0 || v[2] != 0 {
+		t.Fatal(v)
+	}
+}
+
+func TestBuilderPlacementModePersist(t *testing.T) {
+	b := NewBuilder(64)
+	if b.PlacementMode() != PlacementBalanced {
+		t.Fatal(b.PlacementMode())
+	}
+	b.SetPlacementMode(PlacementDispersed)
+	buf := bytes.NewBuffer(nil)
+	if err := b.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := LoadBuilder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b2.PlacementMode() != PlacementDispersed {
+		t.Fatal(b2.PlacementMode())
+	}
+}
@@ -0,0 +1,264 @@
+package ring
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ProxyHTTPHandlerConfig represents the set of values for configuring a
+// ProxyHTTPHandler.
+type ProxyHTTPHandlerConfig struct {
+	// LogDebug sets the func to use for debug messages. Defaults not logging
+	// debug messages.
+	LogDebug LogFunc
+	// Client chooses the nodes for each request and tracks failed nodes; it
+	// is required.
+	Client *Client
+	// Key returns the key to hash for the request, or nil if the request is
+	// not sharded and should be served locally. Defaults to ProxyKeyPath.
+	Key func(req *http.Request) []byte
+	// AddressIndex indicates which of the node addresses to proxy to.
+	// AddressIndex defaulting to 0 is fine.
+	AddressIndex int
+	// AddressRole, if set, names the address role to proxy to instead of the
+	// AddressIndex; see Ring.AddressIndex.
+	AddressRole string
+	// Scheme is the URL scheme used to reach the nodes. Defaults to "http".
+	Scheme string
+	// Transport makes the proxied requests. Defaults to
+	// http.DefaultTransport.
+	Transport http.RoundTripper
+	// MaxAttempts limits how many of the candidate nodes are tried for a
+	// request. Defaults to trying them all.
+	MaxAttempts int
+	// RetryBodyBytes is the largest request body, in bytes, that is held in
+	// memory so it can be sent again to another node; requests with larger
+	// bodies, or of unknown length, are only attempted once. Defaults to
+	// 1048576 bytes.
+	RetryBodyBytes int
+}
+
+func resolveProxyHTTPHandlerConfig(c *ProxyHTTPHandlerConfig) *ProxyHTTPHandlerConfig {
+	cfg := &ProxyHTTPHandlerConfig{}
+	if c != nil {
+		*cfg = *c
+	}
+	if cfg.Key == nil {
+		cfg.Key = ProxyKeyPath
+	}
+	if cfg.Scheme == "" {
+		cfg.Scheme = "http"
+	}
+	if cfg.Transport == nil {
+		cfg.Transport = http.DefaultTransport
+	}
+	if cfg.RetryBodyBytes < 1 {
+		cfg.RetryBodyBytes = 1048576
+	}
+	return cfg
+}
+
+// ProxiedHeader marks requests proxied by a ProxyHTTPHandler; see
+// ProxyHTTPHandler.
+const ProxiedHeader = "X-Ring-Proxied"
+
+// ProxyKeyPath is a ProxyHTTPHandlerConfig.Key func sharding requests by
+// their URL path.
+func ProxyKeyPath(req *http.Request) []byte {
+	return []byte(req.URL.Path)
+}
+
+// ProxyKeyHeader returns a ProxyHTTPHandlerConfig.Key func sharding requests
+// by the value of the named header; requests without the header are served
+// locally.
+func ProxyKeyHeader(name string) func(req *http.Request) []byte {
+	return func(req *http.Request) []byte {
+		if v := req.Header.Get(name); v != "" {
+			return []byte(v)
+		}
+		return nil
+	}
+}
+
+// ProxyHTTPHandler is http middleware that turns a ring into a sharding layer
+// for an HTTP service: each request's key is hashed to a partition and the
+// request is served by the next handler if the local node is the first
+// choice for the partition, or otherwise proxied to the first choice node's
+// address. Should that node fail, with a connection error or a 502, 503, or
+// 504 response, the request is retried with the next candidate node, in the
+// order Client.ForKey gives, and the node is marked as failed with the
+// Client.
+//
+// Every node of the service would run the same middleware in front of its
+// handler; the ring, through the Client, must have its LocalNode set so
+// requests are not proxied to the local node itself. Proxied requests are
+// marked with the ProxiedHeader and always served by the receiving node, so a
+// request retried with a later candidate is not proxied yet again.
+type ProxyHTTPHandler struct {
+	next           http.Handler
+	logDebug       LogFunc
+	client         *Client
+	key            func(req *http.Request) []byte
+	addressIndex   int
+	addressRole    string
+	scheme         string
+	transport      http.RoundTripper
+	maxAttempts    int
+	retryBodyBytes int64
+}
+
+// NewProxyHTTPHandler creates a ProxyHTTPHandler in front of the next
+// handler, which serves the requests the local node is responsible for.
+func NewProxyHTTPHandler(next http.Handler, c *ProxyHTTPHandlerConfig) *ProxyHTTPHandler {
+	cfg := resolveProxyHTTPHandlerConfig(c)
+	h := &ProxyHTTPHandler{
+		next:           next,
+		logDebug:       cfg.LogDebug,
+		client:         cfg.Client,
+		key:            cfg.Key,
+		addressIndex:   cfg.AddressIndex,
+		addressRole:    cfg.AddressRole,
+		scheme:         cfg.Scheme,
+		transport:      cfg.Transport,
+		maxAttempts:    cfg.MaxAttempts,
+		retryBodyBytes: int64(cfg.RetryBodyBytes),
+	}
+	if h.logDebug == nil {
+		h.logDebug = nilLogFunc
+	}
+	return h
+}
+
+func (h *ProxyHTTPHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	key := h.key(req)
+	if key == nil || req.Header.Get(ProxiedHeader) != "" {
+		h.next.ServeHTTP(w, req)
+		return
+	}
+	r := h.client.Ring()
+	if r == nil {
+		http.Error(w, "no ring available", http.StatusServiceUnavailable)
+		return
+	}
+	addressIndex := h.addressIndex
+	if h.addressRole != "" {
+		if addressIndex = r.AddressIndex(h.addressRole); addressIndex < 0 {
+			http.Error(w, "unknown address role "+h.addressRole, http.StatusInternalServerError)
+			return
+		}
+	}
+	nodes := h.client.ForKey(key)
+	if h.maxAttempts > 0 && len(nodes) > h.maxAttempts {
+		nodes = nodes[:h.maxAttempts]
+	}
+	if len(nodes) == 0 {
+		http.Error(w, "no nodes responsible", http.StatusServiceUnavailable)
+		return
+	}
+	if localNode := r.LocalNode(); localNode != nil && nodes[0].ID() == localNode.ID() {
+		h.next.ServeHTTP(w, req)
+		return
+	}
+	var body []byte
+	retryable := req.Body == nil || req.ContentLength == 0
+	if !retryable && req.ContentLength > 0 && req.ContentLength <= h.retryBodyBytes {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		retryable = true
+	}
+	if !retryable {
+		nodes = nodes[:1]
+	}
+	var resp *http.Response
+	for i, n := range nodes {
+		if resp != nil {
+			resp.Body.Close()
+			resp = nil
+		}
+		localNode := r.LocalNode()
+		if localNode != nil && n.ID() == localNode.ID() {
+			// The preferred nodes failed; the local node is the next best.
+			if body != nil {
+				req.Body = ioutil.NopCloser(bytes.NewReader(body))
+			}
+			h.next.ServeHTTP(w, req)
+			return
+		}
+		outReq := h.outRequest(req, n.Address(addressIndex), body, retryable)
+		var err error
+		resp, err = h.transport.RoundTrip(outReq)
+		if err == nil && resp.StatusCode != http.StatusBadGateway && resp.StatusCode != http.StatusServiceUnavailable && resp.StatusCode != http.StatusGatewayTimeout {
+			h.client.Succeeded(n.ID())
+			break
+		}
+		h.client.Failed(n.ID())
+		if err != nil {
+			h.logDebug("ProxyHTTPHandler: %s %s: %s\n", n.Address(addressIndex), req.URL.Path, err)
+		} else {
+			h.logDebug("ProxyHTTPHandler: %s %s: %s\n", n.Address(addressIndex), req.URL.Path, resp.Status)
+		}
+		if i == len(nodes)-1 && err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	defer resp.Body.Close()
+	for k, vs := range resp.Header {
+		if isHopByHopHeader(k) {
+			continue
+		}
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// outRequest returns the request to send to the node address.
+func (h *ProxyHTTPHandler) outRequest(req *http.Request, addr string, body []byte, retryable bool) *http.Request {
+	outReq := req.WithContext(req.Context())
+	u := *req.URL
+	u.Scheme = h.scheme
+	u.Host = addr
+	outReq.URL = &u
+	outReq.Host = req.Host
+	outReq.RequestURI = ""
+	outReq.Close = false
+	if retryable && body != nil {
+		outReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+	} else if retryable {
+		outReq.Body = nil
+	}
+	outReq.Header = make(http.Header, len(req.Header)+1)
+	for k, vs := range req.Header {
+		if !isHopByHopHeader(k) {
+			outReq.Header[k] = vs
+		}
+	}
+	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if prior := req.Header.Get("X-Forwarded-For"); prior != "" {
+			clientIP = prior + ", " + clientIP
+		}
+		outReq.Header.Set("X-Forwarded-For", clientIP)
+	}
+	outReq.Header.Set(ProxiedHeader, "1")
+	return outReq
+}
+
+// isHopByHopHeader returns true for the headers that apply only to a single
+// connection and must not be forwarded by proxies.
+func isHopByHopHeader(name string) bool {
+	switch strings.ToLower(name) {
+	case "connection", "keep-alive", "proxy-authenticate", "proxy-authorization", "te", "trailer", "transfer-encoding", "upgrade":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package ring
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProxyHTTPHandler(t *testing.T) {
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			if req.Header.Get(ProxiedHeader) == "" {
+				t.Errorf("request to %s not marked as proxied", name)
+			}
+			w.Header().Set("X-Backend", name)
+			w.Write([]byte(name + " " + req.URL.Path + " " + string(body)))
+		}))
+	}
+	serverB := backend("b")
+	defer serverB.Close()
+	serverC := backend("c")
+	defer serverC.Close()
+	b := NewBuilder(64)
+	b.SetReplicaCount(2)
+	nA, err := b.AddNode(true, 0, nil, []string{"127.0.0.1:1"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nB, err := b.AddNode(true, 1, nil, []string{strings.TrimPrefix(serverB.URL, "http://")}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.AddNode(true, 1, nil, []string{strings.TrimPrefix(serverC.URL, "http://")}, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	r := b.Ring()
+	r.SetLocalNode(nA.ID())
+	client := NewClient(&ClientConfig{Ring: r})
+	local := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("local"))
+	})
+	h := NewProxyHTTPHandler(local, &ProxyHTTPHandlerConfig{Client: client, Key: ProxyKeyHeader("X-Key")})
+	do := func(key string, body string) (string, string) {
+		req := httptest.NewRequest("POST", "/some/path", strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("X-Key", key)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Header().Get("X-Backend"), w.Body.String()
+	}
+	if _, body := do("", ""); body != "local" {
+		t.Fatal(body)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Key", "k")
+	req.Header.Set(ProxiedHeader, "1")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Body.String() != "local" {
+		t.Fatal(w.Body.String())
+	}
+	var keyB string
+	for i := 0; i < 100 && keyB == ""; i++ {
+		key := strings.Repeat("k", i+1)
+		if client.ForKey([]byte(key))[0].ID() == nB.ID() {
+			keyB = key
+		}
+	}
+	if keyB == "" {
+		t.Fatal("no key found for node b")
+	}
+	if backend, body := do(keyB, "hello"); backend != "b" || body != "b /some/path hello" {
+		t.Fatal(backend, body)
+	}
+	serverB.Close()
+	if backend, body := do(keyB, "again"); backend != "c" || body != "c /some/path again" {
+		t.Fatal(backend, body)
+	}
+	if failed := client.FailedNodes(); len(failed) != 1 || failed[0] != nB.ID() {
+		t.Fatal(failed)
+	}
+}
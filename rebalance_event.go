@@ -0,0 +1,102 @@
+package ring
+
+// RebalanceReason indicates why a RebalanceEvent's assignment changed.
+type RebalanceReason byte
+
+const (
+	// RebalanceUnassigned means the replica was not assigned at all, such as
+	// with a new Builder, after adding replicas, or after removing a node.
+	RebalanceUnassigned RebalanceReason = iota
+	// RebalanceDeactivated means the replica was moved off a node
+	// deactivated for reassignment.
+	RebalanceDeactivated
+	// RebalanceKeptAsLastResort means the replica position was swapped with
+	// another replica of the partition to put a node deactivated with
+	// InactiveKeepAsLastResort last; no data needs to move.
+	RebalanceKeptAsLastResort
+	// RebalanceSameNode means the replica was moved off a node already
+	// holding another replica of the partition.
+	RebalanceSameNode
+	// RebalanceSameTier means the replica was moved out of a tier already
+	// holding another replica of the partition.
+	RebalanceSameTier
+	// RebalanceOverweight means the replica was moved off an overweight node.
+	RebalanceOverweight
+	// RebalanceAffinity means the replica was swapped with a replica of
+	// another partition to honor an affinity group; see
+	// Builder.SetAffinityGroup.
+	RebalanceAffinity
+	// RebalanceRegion means the replica was moved to another region to meet
+	// the region targets; see Builder.SetRegionTargets.
+	RebalanceRegion
+)
+
+func (r RebalanceReason) String() string {
+	switch r {
+	case RebalanceUnassigned:
+		return "unassigned"
+	case RebalanceDeactivated:
+		return "deactivated"
+	case RebalanceKeptAsLastResort:
+		return "kept as last resort"
+	case RebalanceSameNode:
+		return "same node"
+	case RebalanceSameTier:
+		return "same tier"
+	case RebalanceOverweight:
+		return "overweight"
+	case RebalanceAffinity:
+		return "affinity"
+	case RebalanceRegion:
+		return "region"
+	}
+	return "unknown"
+}
+
+// RebalanceEvent describes a single assignment change made by a rebalance;
+// see Builder.SetRebalanceListener.
+type RebalanceEvent struct {
+	Partition Partition
+	Replica   int
+	// FromNodeID is the node the replica was assigned to, or 0 if it was
+	// unassigned.
+	FromNodeID uint64
+	// ToNodeID is the node the replica is now assigned to.
+	ToNodeID uint64
+	Reason   RebalanceReason
+}
+
+// SetRebalanceListener sets a func to be called with each assignment change
+// as rebalancing makes it, such as to pre-stage data movement or record
+// fine-grained history; nil stops the calls. The changes made by a call to
+// Ring are not final until Ring returns, and a partition replica may change
+// more than once within one rebalance. The func is called synchronously, so
+// should be quick, and is not persisted with the Builder.
+func (b *Builder) SetRebalanceListener(listener func(e *RebalanceEvent)) {
+	b.rebalanceListener = listener
+}
+
+// RebalanceEventChan returns a func for Builder.SetRebalanceListener that
+// sends each event to the channel; the rebalance will block while the channel
+// is full.
+func RebalanceEventChan(events chan<- *RebalanceEvent) func(e *RebalanceEvent) {
+	return func(e *RebalanceEvent) {
+		events <- e
+	}
+}
+
+// event reports the assignment change to the Builder's rebalance listener, if
+// any.
+func (rb *rebalancer) event(replica int, partition int, fromNodeIndex int32, toNodeIndex int32, reason RebalanceReason) {
+	if rb.builder.rebalanceListener == nil {
+		return
+	}
+	e := &RebalanceEvent{Partition: Partition(partition), Replica: replica, Reason: reason}
+	if fromNodeIndex >= 0 {
+		e.FromNodeID = rb.builder.nodes[fromNodeIndex].id
+	}
+	if toNodeIndex >= 0 {
+		e.ToNodeID = rb.builder.nodes[toNodeIndex].id
+	}
+	rb.builder.rebalanceListener(e)
+}
@@ -0,0 +1,95 @@
+package ring
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRebalanceListener(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetMaxPartitionBitCount(6)
+	b.SetReplicaCount(2)
+	for i := 0; i < 3; i++ {
+		if _, err := b.AddNode(true, 1, nil, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Ring()
+	var events []*RebalanceEvent
+	b.SetRebalanceListener(func(e *RebalanceEvent) {
+		events = append(events, e)
+	})
+	n, err := b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.PretendElapsed(math.MaxUint16)
+	before := b.Ring()
+	if len(events) == 0 {
+		t.Fatal("no events")
+	}
+	for _, e := range events {
+		if e.Reason != RebalanceOverweight || e.ToNodeID != n.ID() || e.FromNodeID == 0 || e.FromNodeID == n.ID() {
+			t.Fatalf("%#v", e)
+		}
+	}
+	// Replaying the events against the previous assignments must give the
+	// new ones.
+	events = nil
+	n.SetActive(false)
+	b.PretendElapsed(math.MaxUint16)
+	after := b.Ring()
+	// The partition count may have grown before the rebalance.
+	shift := after.PartitionBitCount() - before.PartitionBitCount()
+	assignments := make([][]uint64, before.ReplicaCount())
+	for replica := range assignments {
+		assignments[replica] = make([]uint64, 1<<after.PartitionBitCount())
+		for partition := range assignments[replica] {
+			assignments[replica][partition] = before.ResponsibleNodes(Partition(partition) >> shift)[replica].ID()
+		}
+	}
+	deactivated := 0
+	for _, e := range events {
+		if assignments[e.Replica][e.Partition] != e.FromNodeID {
+			t.Fatalf("%#v", e)
+		}
+		assignments[e.Replica][e.Partition] = e.ToNodeID
+		if e.Reason == RebalanceDeactivated {
+			deactivated++
+		}
+	}
+	if deactivated != b.LastRebalanceReport().DeactivatedMoves {
+		t.Fatalf("%d != %d", deactivated, b.LastRebalanceReport().DeactivatedMoves)
+	}
+	for replica := range assignments {
+		for partition := range assignments[replica] {
+			if id := after.ResponsibleNodes(Partition(partition))[replica].ID(); assignments[replica][partition] != id {
+				t.Fatalf("%d %d %d != %d", replica, partition, assignments[replica][partition], id)
+			}
+		}
+	}
+	if RebalanceKeptAsLastResort.String() != "kept as last resort" {
+		t.Fatal(RebalanceKeptAsLastResort.String())
+	}
+}
+
+func TestRebalanceEventChan(t *testing.T) {
+	b := NewBuilder(64)
+	events := make(chan *RebalanceEvent, 2)
+	b.SetRebalanceListener(RebalanceEventChan(events))
+	if _, err := b.AddNode(true, 1, nil, nil, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	b.Ring()
+	close(events)
+	count := 0
+	for e := range events {
+		if e.Reason != RebalanceUnassigned || e.FromNodeID != 0 {
+			t.Fatalf("%#v", e)
+		}
+		count++
+	}
+	if count != 2 {
+		t.Fatal(count)
+	}
+}
@@ -0,0 +1,272 @@
+package ring
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RebalanceSchedulerConfig represents the set of values for configuring a
+// RebalanceScheduler.
+type RebalanceSchedulerConfig struct {
+	// LogDebug sets the func to use for debug messages. Defaults not logging
+	// debug messages.
+	LogDebug LogFunc
+	// Next returns when the pass following the time given should run, such
+	// as RebalanceDailyAt(2, 0) for nightly passes at 2am local time.
+	// Defaults to every Interval.
+	Next func(now time.Time) time.Time
+	// Interval indicates how many seconds to wait between passes when Next
+	// is not set. Defaults to 86400 seconds, one day.
+	Interval int
+	// MaxMovePercentage is the most partition replicas, as a percentage of
+	// all the partition replicas, a single pass may move; see
+	// Builder.RingWithMoveBudget. At least one replica may always move.
+	// Defaults to 2.
+	MaxMovePercentage int
+	// Locker, if set, will be held while a pass uses the Builder; anything
+	// else using the Builder, such as code handling administrative requests,
+	// should hold it too.
+	Locker sync.Locker
+	// Persist, if set, will be called after each pass with the Builder, such
+	// as to save it with PersistRingOrBuilder; a pass changes the Builder
+	// even if the ring stays the same, as move wait time is accounted for.
+	// If it returns an error the new ring is not published.
+	Persist func(b *Builder) error
+	// Publish, if set, will be called with the ring made by a pass, if it
+	// differs from the previous one, to distribute it; such as by persisting
+	// it where an HTTPRingLoader will find it, or by starting a RingRollout.
+	Publish func(r Ring) error
+}
+
+func resolveRebalanceSchedulerConfig(c *RebalanceSchedulerConfig) *RebalanceSchedulerConfig {
+	cfg := &RebalanceSchedulerConfig{}
+	if c != nil {
+		*cfg = *c
+	}
+	if cfg.Interval < 1 {
+		cfg.Interval = 86400
+	}
+	if cfg.Next == nil {
+		interval := time.Duration(cfg.Interval) * time.Second
+		cfg.Next = func(now time.Time) time.Time {
+			return now.Add(interval)
+		}
+	}
+	if cfg.MaxMovePercentage < 1 {
+		cfg.MaxMovePercentage = 2
+	}
+	if cfg.MaxMovePercentage > 100 {
+		cfg.MaxMovePercentage = 100
+	}
+	return cfg
+}
+
+// RebalanceDailyAt returns a func for RebalanceSchedulerConfig.Next that
+// schedules passes every day at the hour and minute given, local time.
+func RebalanceDailyAt(hour int, minute int) func(now time.Time) time.Time {
+	return func(now time.Time) time.Time {
+		next := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, now.Location())
+		for !next.After(now) {
+			next = next.AddDate(0, 0, 1)
+		}
+		return next
+	}
+}
+
+// RebalanceScheduler is an autopilot for keeping a cluster balanced; on a
+// schedule, it rebalances the Builder with a limited move budget, persists
+// the Builder, and publishes the new ring. Large imbalances, such as after
+// adding many nodes, are thus worked off gradually, one bounded step per
+// pass, rather than with one disruptive ring change.
+//
+// The Builder's RebalanceTrigger still applies, so a RebalanceOverThreshold
+// Builder is only rebalanced by a pass when it is out of balance enough.
+// The Builder's capacity schedules are applied before each pass, so nodes
+// are filled or drained gradually; see Builder.ScheduleCapacity.
+type RebalanceScheduler struct {
+	builder           *Builder
+	logDebug          LogFunc
+	next              func(now time.Time) time.Time
+	maxMovePercentage int
+	locker            sync.Locker
+	persist           func(b *Builder) error
+	publish           func(r Ring) error
+	lock              sync.Mutex
+	lastVersion       int64
+	controlLock       sync.Mutex
+	controlChan       chan struct{}
+
+	passes          int32
+	moves           int32
+	budgetExhausted int32
+	persists        int32
+	persistErrors   int32
+	publishes       int32
+	publishErrors   int32
+}
+
+// NewRebalanceScheduler creates a RebalanceScheduler for the Builder; call
+// Start to begin the scheduled passes.
+func NewRebalanceScheduler(b *Builder, c *RebalanceSchedulerConfig) *RebalanceScheduler {
+	cfg := resolveRebalanceSchedulerConfig(c)
+	s := &RebalanceScheduler{
+		builder:           b,
+		logDebug:          cfg.LogDebug,
+		next:              cfg.Next,
+		maxMovePercentage: cfg.MaxMovePercentage,
+		locker:            cfg.Locker,
+		persist:           cfg.Persist,
+		publish:           cfg.Publish,
+		lastVersion:       -1,
+	}
+	if s.logDebug == nil {
+		s.logDebug = nilLogFunc
+	}
+	return s
+}
+
+// Start launches the scheduled passes; it does nothing if already started.
+// The first pass runs at the first scheduled time, not immediately.
+func (s *RebalanceScheduler) Start() {
+	s.controlLock.Lock()
+	if s.controlChan == nil {
+		s.controlChan = make(chan struct{})
+		go s.run(s.controlChan)
+	}
+	s.controlLock.Unlock()
+}
+
+// Stop ends the scheduled passes; it does nothing if not started. A pass in
+// progress will still complete.
+func (s *RebalanceScheduler) Stop() {
+	s.controlLock.Lock()
+	if s.controlChan != nil {
+		close(s.controlChan)
+		s.controlChan = nil
+	}
+	s.controlLock.Unlock()
+}
+
+func (s *RebalanceScheduler) run(controlChan chan struct{}) {
+	for {
+		now := time.Now()
+		wait := s.next(now).Sub(now)
+		if wait < 0 {
+			wait = 0
+		}
+		select {
+		case <-controlChan:
+			return
+		case <-time.After(wait):
+		}
+		if err := s.Pass(); err != nil {
+			s.logDebug("rebalance scheduler: %s\n", err)
+		}
+	}
+}
+
+// Pass applies the Builder's capacity schedules, runs a single budgeted
+// rebalance, persists the Builder, and publishes the ring if it changed; it is called automatically on the schedule after
+// Start, but may be called directly to force a pass. The error returned, if
+// any, is from Persist or Publish, notes the Builder has no active nodes, or
+// is a *DispersionError, in which case the ring is not published; see
+// Builder.SetStrictDispersion.
+func (s *RebalanceScheduler) Pass() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	atomic.AddInt32(&s.passes, 1)
+	if s.locker != nil {
+		s.locker.Lock()
+	}
+	if changed, err := s.builder.ApplyCapacitySchedules(s.builder.clock()); err != nil {
+		s.logDebug("rebalance scheduler: %s\n", err)
+	} else if changed > 0 {
+		s.logDebug("rebalance scheduler: capacity schedules changed %d nodes\n", changed)
+	}
+	active := false
+	for _, n := range s.builder.nodes {
+		if !n.inactive {
+			active = true
+			break
+		}
+	}
+	if !active {
+		if s.locker != nil {
+			s.locker.Unlock()
+		}
+		return fmt.Errorf("no active nodes to rebalance")
+	}
+	budget := s.builder.movePercentageBudget(s.maxMovePercentage)
+	r := s.builder.RingWithMoveBudget(budget)
+	report := s.builder.LastRebalanceReport()
+	strictErr := s.builder.checkStrictDispersion()
+	var err error
+	if s.persist != nil {
+		atomic.AddInt32(&s.persists, 1)
+		if err = s.persist(s.builder); err != nil {
+			atomic.AddInt32(&s.persistErrors, 1)
+		}
+	}
+	if s.locker != nil {
+		s.locker.Unlock()
+	}
+	moves := report.DeactivatedMoves + report.SameNodeMoves + report.SameTierMoves + report.OverweightMoves
+	atomic.AddInt32(&s.moves, int32(moves))
+	if report.MoveBudgetExhausted {
+		atomic.AddInt32(&s.budgetExhausted, 1)
+	}
+	s.logDebug("rebalance scheduler: pass moved %d of %d budgeted replicas; max under %.02f%% max over %.02f%%\n", moves, budget, report.MaxUnderNodePercentage, report.MaxOverNodePercentage)
+	if err != nil {
+		return err
+	}
+	if strictErr != nil {
+		return strictErr
+	}
+	if r.Version() == s.lastVersion {
+		return nil
+	}
+	if s.publish != nil {
+		atomic.AddInt32(&s.publishes, 1)
+		if err = s.publish(r); err != nil {
+			atomic.AddInt32(&s.publishErrors, 1)
+			return err
+		}
+	}
+	s.lastVersion = r.Version()
+	return nil
+}
+
+// RebalanceSchedulerStats are the stat counters of a RebalanceScheduler; see
+// RebalanceScheduler.Stats.
+type RebalanceSchedulerStats struct {
+	Passes          int32
+	Moves           int32
+	BudgetExhausted int32
+	Persists        int32
+	PersistErrors   int32
+	Publishes       int32
+	PublishErrors   int32
+}
+
+// Stats returns the current stat counters and resets those counters.
+func (s *RebalanceScheduler) Stats() *RebalanceSchedulerStats {
+	stats := &RebalanceSchedulerStats{
+		Passes:          atomic.LoadInt32(&s.passes),
+		Moves:           atomic.LoadInt32(&s.moves),
+		BudgetExhausted: atomic.LoadInt32(&s.budgetExhausted),
+		Persists:        atomic.LoadInt32(&s.persists),
+		PersistErrors:   atomic.LoadInt32(&s.persistErrors),
+		Publishes:       atomic.LoadInt32(&s.publishes),
+		PublishErrors:   atomic.LoadInt32(&s.publishErrors),
+	}
+	atomic.AddInt32(&s.passes, -stats.Passes)
+	atomic.AddInt32(&s.moves, -stats.Moves)
+	atomic.AddInt32(&s.budgetExhausted, -stats.BudgetExhausted)
+	atomic.AddInt32(&s.persists, -stats.Persists)
+	atomic.AddInt32(&s.persistErrors, -stats.PersistErrors)
+	atomic.AddInt32(&s.publishes, -stats.Publishes)
+	atomic.AddInt32(&s.publishErrors, -stats.PublishErrors)
+	return stats
+}
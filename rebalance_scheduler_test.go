@@ -0,0 +1,206 @@
+package ring
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBuilderRingWithMoveBudget(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetMaxPartitionBitCount(8)
+	b.SetMoveWait(0)
+	b.SetReplicaCount(3)
+	for i := 0; i < 4; i++ {
+		if _, err := b.AddNode(true, 1, nil, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Ring()
+	for i := 0; i < 4; i++ {
+		if _, err := b.AddNode(true, 1, nil, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.RingWithMoveBudget(3)
+	rr := b.LastRebalanceReport()
+	if !rr.MoveBudgetExhausted {
+		t.Fatalf("%#v", rr)
+	}
+	if moves := rr.SameNodeMoves + rr.SameTierMoves + rr.OverweightMoves; moves != 3 {
+		t.Fatalf("%d != 3", moves)
+	}
+	b.Ring()
+	if rr = b.LastRebalanceReport(); rr.MoveBudgetExhausted || rr.OverweightMoves <= 3 {
+		t.Fatalf("%#v", rr)
+	}
+}
+
+func TestBuilderMaxMovePercentage(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetMaxPartitionBitCount(8)
+	b.SetMoveWait(0)
+	b.SetReplicaCount(3)
+	b.SetMaxMovePercentage(5)
+	for i := 0; i < 4; i++ {
+		if _, err := b.AddNode(true, 1, nil, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Ring()
+	for i := 0; i < 4; i++ {
+		if _, err := b.AddNode(true, 1, nil, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := b.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	b, err := LoadBuilder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.MaxMovePercentage() != 5 {
+		t.Fatal(b.MaxMovePercentage())
+	}
+	budget := b.movePercentageBudget(5)
+	b.Ring()
+	rr := b.LastRebalanceReport()
+	if moves := rr.SameNodeMoves + rr.SameTierMoves + rr.OverweightMoves; !rr.MoveBudgetExhausted || moves != budget {
+		t.Fatalf("%d != %d %#v", moves, budget, rr)
+	}
+	// A smaller explicit budget wins.
+	b.RingWithMoveBudget(1)
+	rr = b.LastRebalanceReport()
+	if moves := rr.SameNodeMoves + rr.SameTierMoves + rr.OverweightMoves; moves != 1 {
+		t.Fatalf("%d != 1", moves)
+	}
+	b.SetMaxMovePercentage(0)
+	b.Ring()
+	if rr = b.LastRebalanceReport(); rr.MoveBudgetExhausted || rr.OverweightMoves <= budget {
+		t.Fatalf("%#v", rr)
+	}
+}
+
+func TestRebalanceScheduler(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetMaxPartitionBitCount(8)
+	b.SetMoveWait(0)
+	for i := 0; i < 4; i++ {
+		if _, err := b.AddNode(true, 1, nil, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var published []Ring
+	persists := 0
+	s := NewRebalanceScheduler(b, &RebalanceSchedulerConfig{
+		MaxMovePercentage: 5,
+		Persist: func(b2 *Builder) error {
+			if b2 != b {
+				t.Fatal("wrong builder")
+			}
+			persists++
+			return nil
+		},
+		Publish: func(r Ring) error {
+			published = append(published, r)
+			return nil
+		},
+	})
+	if err := s.Pass(); err != nil {
+		t.Fatal(err)
+	}
+	if persists != 1 || len(published) != 1 {
+		t.Fatalf("%d %d", persists, len(published))
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := b.AddNode(true, 1, nil, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The imbalance is worked off gradually, never moving more than 5% of
+	// the partition replicas in a pass.
+	for i := 0; ; i++ {
+		if i == 100 {
+			t.Fatalf("%#v", b.LastRebalanceReport())
+		}
+		if err := s.Pass(); err != nil {
+			t.Fatal(err)
+		}
+		rr := b.LastRebalanceReport()
+		budget := (b.ReplicaCount() << b.partitionBitCount) * 5 / 100
+		if budget < 1 {
+			budget = 1
+		}
+		if moves := rr.OverweightMoves + rr.SameNodeMoves + rr.SameTierMoves; moves > budget {
+			t.Fatalf("%d moves %#v", moves, rr)
+		}
+		if !rr.MoveBudgetExhausted && rr.WithinPointsAllowed {
+			break
+		}
+	}
+	stats := s.Stats()
+	if stats.Passes < 3 || stats.BudgetExhausted < 1 || stats.Moves < 1 || stats.Persists != stats.Passes {
+		t.Fatalf("%#v", stats)
+	}
+	if stats.Publishes != int32(len(published)) || len(published) < 3 {
+		t.Fatalf("%d != %d", stats.Publishes, len(published))
+	}
+	// A balanced builder yields no new ring to publish.
+	count := len(published)
+	if err := s.Pass(); err != nil {
+		t.Fatal(err)
+	}
+	if len(published) != count {
+		t.Fatalf("%d != %d", len(published), count)
+	}
+	// Persist errors stop publishing.
+	s.persist = func(b *Builder) error { return fmt.Errorf("disk full") }
+	b.SetConfig([]byte{1})
+	if err := s.Pass(); err == nil || err.Error() != "disk full" {
+		t.Fatal(err)
+	}
+	if len(published) != count {
+		t.Fatalf("%d != %d", len(published), count)
+	}
+}
+
+func TestRebalanceSchedulerStartStop(t *testing.T) {
+	b := NewBuilder(64)
+	if _, err := b.AddNode(true, 1, nil, nil, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	published := make(chan Ring, 10)
+	s := NewRebalanceScheduler(b, &RebalanceSchedulerConfig{
+		Next: func(now time.Time) time.Time {
+			return now.Add(time.Millisecond)
+		},
+		Publish: func(r Ring) error {
+			published <- r
+			return nil
+		},
+	})
+	s.Start()
+	s.Start()
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no ring published")
+	}
+	s.Stop()
+	s.Stop()
+}
+
+func TestRebalanceDailyAt(t *testing.T) {
+	next := RebalanceDailyAt(2, 30)
+	now := time.Date(2016, 3, 4, 1, 0, 0, 0, time.UTC)
+	if n := next(now); !n.Equal(time.Date(2016, 3, 4, 2, 30, 0, 0, time.UTC)) {
+		t.Fatal(n)
+	}
+	now = time.Date(2016, 3, 4, 2, 30, 0, 0, time.UTC)
+	if n := next(now); !n.Equal(time.Date(2016, 3, 5, 2, 30, 0, 0, time.UTC)) {
+		t.Fatal(n)
+	}
+}
@@ -0,0 +1,94 @@
+package ring
+
+// RebalanceTrigger indicates when Builder.Ring rebalances; frequently calling
+// Ring just to distribute the current assignments need not churn them.
+type RebalanceTrigger byte
+
+const (
+	// RebalanceAlways rebalances on every call to Ring.
+	RebalanceAlways RebalanceTrigger = iota
+	// RebalanceNever makes Ring just a snapshot of the current assignments;
+	// only replicas not yet assigned at all, such as with a new Builder or
+	// after adding replicas, are assigned. Call Ring with another trigger
+	// set to rebalance.
+	RebalanceNever
+	// RebalanceOverThreshold rebalances only when a node is more over or
+	// under weight than the Builder's RebalanceThreshold allows, or when
+	// replicas are still assigned to nodes deactivated for reassignment.
+	RebalanceOverThreshold
+)
+
+func (t RebalanceTrigger) String() string {
+	switch t {
+	case RebalanceAlways:
+		return "always"
+	case RebalanceNever:
+		return "never"
+	case RebalanceOverThreshold:
+		return "threshold"
+	}
+	return "unknown"
+}
+
+// rebalanceTriggered returns true if Ring should rebalance, according to the
+// Builder's RebalanceTrigger.
+func (b *Builder) rebalanceTriggered() bool {
+	switch b.rebalanceTrigger {
+	case RebalanceNever:
+		return false
+	case RebalanceOverThreshold:
+		return b.overThreshold()
+	}
+	return true
+}
+
+func (b *Builder) overThreshold() bool {
+	threshold := b.rebalanceThreshold
+	if threshold == 0 {
+		threshold = b.pointsAllowed
+	}
+	var totalCapacity uint64
+	for _, n := range b.nodes {
+		if !n.inactive {
+			totalCapacity += n.usableCapacity()
+		}
+	}
+	nodeIndexToCount := make([]uint64, len(b.nodes))
+	for _, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+		for _, nodeIndex := range partitionToNodeIndex {
+			if nodeIndex < 0 {
+				continue
+			}
+			n := b.nodes[nodeIndex]
+			if n.inactive && n.inactivePolicy != InactiveKeepAsLastResort {
+				return true
+			}
+			nodeIndexToCount[nodeIndex]++
+		}
+	}
+	assignmentCount := uint64(len(b.replicaToPartitionToNodeIndex) * len(b.replicaToPartitionToNodeIndex[0]))
+	for nodeIndex, n := range b.nodes {
+		if n.inactive {
+			continue
+		}
+		whole, rem := desiredAssignments(n.usableCapacity(), totalCapacity, assignmentCount)
+		desired := float64(whole)
+		if rem > 0 {
+			desired += float64(rem) / float64(totalCapacity)
+		}
+		if desired == 0 {
+			if nodeIndexToCount[nodeIndex] > 0 {
+				return true
+			}
+			continue
+		}
+		diff := float64(nodeIndexToCount[nodeIndex]) - desired
+		if diff < 0 {
+			diff = -diff
+		}
+		if 100*diff/desired > float64(threshold) {
+			return true
+		}
+	}
+	return false
+}
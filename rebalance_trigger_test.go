@@ -0,0 +1,60 @@
+package ring
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRebalanceTrigger(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetMaxPartitionBitCount(6)
+	b.SetRebalanceTrigger(RebalanceNever)
+	for i := 0; i < 2; i++ {
+		if _, err := b.AddNode(true, 1, nil, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Unassigned replicas are assigned even when never rebalancing.
+	r := b.Ring()
+	if rr := b.LastRebalanceReport(); !rr.Skipped || rr.UnassignedMoves == 0 {
+		t.Fatalf("%#v", rr)
+	}
+	if _, err := b.AddNode(true, 1, nil, nil, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	b.PretendElapsed(math.MaxUint16)
+	r2 := b.Ring()
+	if rr := b.LastRebalanceReport(); !rr.Skipped || rr.OverweightMoves != 0 {
+		t.Fatalf("%#v", rr)
+	}
+	if r2.PartitionBitCount() != r.PartitionBitCount() {
+		t.Fatalf("%d != %d", r2.PartitionBitCount(), r.PartitionBitCount())
+	}
+	// The new node is 100% underweight, over any threshold.
+	b.SetRebalanceTrigger(RebalanceOverThreshold)
+	b.SetRebalanceThreshold(10)
+	b.Ring()
+	if rr := b.LastRebalanceReport(); rr.Skipped || rr.OverweightMoves == 0 {
+		t.Fatalf("%#v", rr)
+	}
+	// Once within the threshold, rebalancing stops.
+	for i := 0; ; i++ {
+		if i == 5 {
+			t.Fatalf("%#v", b.LastRebalanceReport())
+		}
+		b.PretendElapsed(math.MaxUint16)
+		b.Ring()
+		if b.LastRebalanceReport().Skipped {
+			break
+		}
+	}
+	// Replicas on nodes deactivated for reassignment always trigger.
+	b.Nodes()[0].(BuilderNode).SetActive(false)
+	b.Ring()
+	if rr := b.LastRebalanceReport(); rr.Skipped || rr.DeactivatedMoves == 0 {
+		t.Fatalf("%#v", rr)
+	}
+	if RebalanceOverThreshold.String() != "threshold" {
+		t.Fatal(RebalanceOverThreshold.String())
+	}
+}
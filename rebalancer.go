@@ -11,14 +11,83 @@ type rebalancer struct {
 	maxPartition             int
 	maxTier                  int
 	nodeIndexToDesire        []int32
+	nodeIndexToMinDesire     []int32
 	nodeIndexesByDesire      []int32
+	nodeIndexToTieRank       []int32
 	nodeIndexToUsed          []bool
 	tierToTierSeps           [][]*tierSeparation
 	tierToNodeIndexToTierSep [][]*tierSeparation
+	tierToValueToDomain      [][]int32
 	partitionToMovementsLeft []byte
 	altered                  bool
+	budgeted                 bool
+	movesLeft                int
 	usedNodeIndexes          []int32
 	tierToUsedTierSeps       [][]*tierSeparation
+	report                   *RebalanceReport
+	// The region fields are only set with region targets; see
+	// Builder.SetRegionTargets.
+	regionTargets     []int
+	nodeIndexToRegion []int32
+	regionCounts      []int
+	regionNeeded      []bool
+	regionLimited     bool
+	// nodeIndexInScope is only set for a rebalance limited to a tier scope;
+	// see Builder.RingWithinTier.
+	nodeIndexInScope []bool
+}
+
+// RebalanceReport describes what the last rebalance did and how well balanced
+// the result is; see Builder.LastRebalanceReport. The rebalancer runs a fixed
+// series of phases with no iteration cap; when a ring ends up outside the
+// points allowed it is because of the constraints below, which this report
+// makes visible.
+type RebalanceReport struct {
+	// Passes is the number of passes the overweight reassignment phase made
+	// over the overweight nodes.
+	Passes int
+	// UnassignedMoves, DeactivatedMoves, SameNodeMoves, SameTierMoves, and
+	// OverweightMoves count the partition replicas assigned by each phase:
+	// assigning unassigned replicas, moving replicas off inactive nodes,
+	// separating replicas on the same node, separating replicas in the same
+	// tier, and moving replicas off overweight nodes.
+	UnassignedMoves  int
+	DeactivatedMoves int
+	SameNodeMoves    int
+	SameTierMoves    int
+	OverweightMoves  int
+	// AffinityMoves counts the partition replicas swapped between nodes to
+	// honor the Builder's affinity groups; see Builder.SetAffinityGroup.
+	AffinityMoves int
+	// RegionMoves counts the partition replicas moved between regions to
+	// meet the Builder's region targets, and RegionTargetShortfalls is the
+	// number of partitions still not meeting them after the rebalance; see
+	// Builder.SetRegionTargets.
+	RegionMoves            int
+	RegionTargetShortfalls int
+	// WaitBlocked is the number of partition replicas on overweight nodes
+	// that could not be moved because they, or other replicas of their
+	// partition, moved within the move wait.
+	WaitBlocked int
+	// MoveBudgetExhausted indicates the rebalance stopped early because it
+	// used up the move budget given to Builder.RingWithMoveBudget.
+	MoveBudgetExhausted bool
+	// Skipped indicates the rebalance was skipped because of the Builder's
+	// RebalanceTrigger; only replicas not yet assigned at all were assigned.
+	Skipped bool
+	// Resized indicates the partition count grew, splitting each partition
+	// without moving any replicas, to get within the points allowed.
+	Resized bool
+	// PartitionBitCountCapped indicates the partition bit count is at the
+	// maximum allowed, so the ring could not be made finer grained to get
+	// within the points allowed.
+	PartitionBitCountCapped bool
+	// MaxUnderNodePercentage and MaxOverNodePercentage are the resulting
+	// imbalance, as with Stats, and WithinPointsAllowed indicates whether
+	// both are within the points allowed.
+	MaxUnderNodePercentage float64
+	MaxOverNodePercentage  float64
+	WithinPointsAllowed    bool
 }
 
 type tierSeparation struct {
@@ -28,15 +97,24 @@ type tierSeparation struct {
 }
 
 func newRebalancer(builder *Builder) *rebalancer {
+	return newScopedRebalancer(builder, nil)
+}
+
+// newScopedRebalancer returns a rebalancer that will only move replicas among
+// the nodes within the scope given, or among all nodes if the scope is nil.
+func newScopedRebalancer(builder *Builder, scope *tierScope) *rebalancer {
 	rb := &rebalancer{
 		builder:      builder,
 		maxReplica:   len(builder.replicaToPartitionToNodeIndex) - 1,
 		maxPartition: len(builder.replicaToPartitionToNodeIndex[0]) - 1,
+		report:       &RebalanceReport{},
 	}
+	rb.initScope(scope)
 	rb.initMaxTier()
 	rb.initNodeDesires()
 	rb.initTierInfo()
 	rb.initMovementsLeft()
+	rb.initRegions()
 	rb.usedNodeIndexes = make([]int32, rb.maxReplica+1)
 	rb.tierToUsedTierSeps = make([][]*tierSeparation, rb.maxTier+1)
 	for tier := rb.maxTier; tier >= 0; tier-- {
@@ -50,42 +128,71 @@ func (rb *rebalancer) initMaxTier() {
 }
 
 func (rb *rebalancer) initNodeDesires() {
-	totalCapacity := float64(0)
-	for _, node := range rb.builder.nodes {
-		if !node.inactive {
-			totalCapacity += (float64)(node.capacity)
+	totalCapacity := uint64(0)
+	for nodeIndex, node := range rb.builder.nodes {
+		if !node.inactive && rb.inScope(int32(nodeIndex)) {
+			totalCapacity += node.usableCapacity()
 		}
 	}
 	nodeIndexToPartitionCount := make([]int32, len(rb.builder.nodes))
+	scopePartitionsCount := uint64(0)
 	for _, partitionToNodeIndex := range rb.builder.replicaToPartitionToNodeIndex {
 		for _, nodeIndex := range partitionToNodeIndex {
 			if nodeIndex >= 0 {
 				nodeIndexToPartitionCount[nodeIndex]++
+				if rb.inScope(nodeIndex) {
+					scopePartitionsCount++
+				}
 			}
 		}
 	}
 	rb.nodeIndexToDesire = make([]int32, len(rb.builder.nodes))
-	allPartitionsCount := float64(len(rb.builder.replicaToPartitionToNodeIndex) * len(rb.builder.replicaToPartitionToNodeIndex[0]))
+	// nodeIndexToMinDesire is how low a node's desire may go while still
+	// being chosen for tier dispersion; see Builder.DispersionPointsAllowed.
+	rb.nodeIndexToMinDesire = make([]int32, len(rb.builder.nodes))
+	allPartitionsCount := uint64(len(rb.builder.replicaToPartitionToNodeIndex) * len(rb.builder.replicaToPartitionToNodeIndex[0]))
+	if rb.nodeIndexInScope != nil {
+		// Nodes in scope share only the replicas they already have, so none
+		// need to cross the scope's boundary.
+		allPartitionsCount = scopePartitionsCount
+	}
 	for nodeIndex, node := range rb.builder.nodes {
-		if node.inactive {
+		rb.nodeIndexToMinDesire[nodeIndex] = math.MinInt32
+		if !rb.inScope(int32(nodeIndex)) {
+			// Nodes out of scope neither give nor take replicas.
+			rb.nodeIndexToDesire[nodeIndex] = 0
+			rb.nodeIndexToMinDesire[nodeIndex] = 0
+		} else if node.inactive {
 			rb.nodeIndexToDesire[nodeIndex] = math.MinInt32
 		} else {
-			rb.nodeIndexToDesire[nodeIndex] = int32(float64(node.capacity)/totalCapacity*allPartitionsCount+0.5) - nodeIndexToPartitionCount[nodeIndex]
+			desired := roundedDesiredAssignments(node.usableCapacity(), totalCapacity, allPartitionsCount)
+			rb.nodeIndexToDesire[nodeIndex] = int32(desired) - nodeIndexToPartitionCount[nodeIndex]
+			if rb.builder.dispersionPointsAllowed < 255 {
+				rb.nodeIndexToMinDesire[nodeIndex] = -int32(desired * uint64(rb.builder.dispersionPointsAllowed) / 100)
+			}
 		}
 	}
 	rb.nodeIndexesByDesire = make([]int32, len(rb.builder.nodes))
 	for i := int32(len(rb.builder.nodes) - 1); i >= 0; i-- {
 		rb.nodeIndexesByDesire[i] = i
 	}
-	sort.Sort(&nodeIndexByDesireSorter{
-		nodeIndexes:       rb.nodeIndexesByDesire,
-		nodeIndexToDesire: rb.nodeIndexToDesire,
-	})
+	// nodeIndexToTieRank is only set with a TieBreaker; see
+	// Builder.SetTieBreaker.
+	if order := rb.tieOrder(); order != nil {
+		rb.nodeIndexToTieRank = make([]int32, len(order))
+		for rank, nodeIndex := range order {
+			rb.nodeIndexToTieRank[nodeIndex] = int32(rank)
+		}
+	}
+	rb.sortByDesire(rb.nodeIndexesByDesire)
 	rb.nodeIndexToUsed = make([]bool, len(rb.builder.nodes))
 }
 
 func (rb *rebalancer) initMovementsLeft() {
-	movementsPerPartition := byte(rb.maxReplica / 2)
+	movementsPerPartition := rb.builder.movesPerPartition
+	if movementsPerPartition < 1 {
+		movementsPerPartition = byte(rb.maxReplica / 2)
+	}
 	if movementsPerPartition < 1 {
 		movementsPerPartition = 1
 	}
@@ -101,6 +208,9 @@ func (rb *rebalancer) initMovementsLeft() {
 }
 
 func (rb *rebalancer) initTierInfo() {
+	// Correlated tier values share a failure domain, so they're treated as
+	// one value for dispersion; see Builder.CorrelateTiers.
+	rb.tierToValueToDomain = rb.builder.tierDomains()
 	rb.tierToNodeIndexToTierSep = make([][]*tierSeparation, rb.maxTier+1)
 	rb.tierToTierSeps = make([][]*tierSeparation, rb.maxTier+1)
 	for tier := rb.maxTier; tier >= 0; tier-- {
@@ -116,7 +226,7 @@ func (rb *rebalancer) initTierInfo() {
 				for valueIndex := 0; valueIndex <= rb.maxTier-tier; valueIndex++ {
 					value := int32(0)
 					if valueIndex+tier < len(nodeTierIndexes) {
-						value = nodeTierIndexes[valueIndex+tier]
+						value = rb.tierDomain(valueIndex+tier, nodeTierIndexes[valueIndex+tier])
 					}
 					if tierSep.values[valueIndex] != value {
 						tierSep = nil
@@ -132,7 +242,7 @@ func (rb *rebalancer) initTierInfo() {
 				for valueIndex := 0; valueIndex <= rb.maxTier-tier; valueIndex++ {
 					value := int32(0)
 					if valueIndex+tier < len(nodeTierIndexes) {
-						value = nodeTierIndexes[valueIndex+tier]
+						value = rb.tierDomain(valueIndex+tier, nodeTierIndexes[valueIndex+tier])
 					}
 					tierSep.values[valueIndex] = value
 				}
@@ -145,14 +255,35 @@ func (rb *rebalancer) initTierInfo() {
 	}
 	for tier := rb.maxTier; tier >= 0; tier-- {
 		for _, tierSep := range rb.tierToTierSeps[tier] {
-			sort.Sort(&nodeIndexByDesireSorter{
-				nodeIndexes:       tierSep.nodeIndexesByDesire,
-				nodeIndexToDesire: rb.nodeIndexToDesire,
-			})
+			rb.sortByDesire(tierSep.nodeIndexesByDesire)
+		}
+		if rb.nodeIndexToTieRank != nil {
+			// Tier separations of equal desire are preferred in the order
+			// they are listed, so that follows the tie order too.
+			tierSeps := rb.tierToTierSeps[tier]
+			rank := make(map[*tierSeparation]int32, len(tierSeps))
+			for _, tierSep := range tierSeps {
+				rank[tierSep] = math.MaxInt32
+				for _, nodeIndex := range tierSep.nodeIndexesByDesire {
+					if rb.nodeIndexToTieRank[nodeIndex] < rank[tierSep] {
+						rank[tierSep] = rb.nodeIndexToTieRank[nodeIndex]
+					}
+				}
+			}
+			sort.Slice(tierSeps, func(i, j int) bool { return rank[tierSeps[i]] < rank[tierSeps[j]] })
 		}
 	}
 }
 
+// tierDomain returns the index of the value representing the failure domain
+// of the tier value index at the level.
+func (rb *rebalancer) tierDomain(level int, value int32) int32 {
+	if level < len(rb.tierToValueToDomain) && int(value) < len(rb.tierToValueToDomain[level]) {
+		return rb.tierToValueToDomain[level][value]
+	}
+	return value
+}
+
 func (rb *rebalancer) clearUsed() {
 	for replica := rb.maxReplica; replica >= 0; replica-- {
 		if rb.usedNodeIndexes[replica] != -1 {
@@ -168,6 +299,7 @@ func (rb *rebalancer) clearUsed() {
 			rb.tierToUsedTierSeps[tier][replica] = nil
 		}
 	}
+	rb.regionLimited = false
 }
 
 func (rb *rebalancer) markUsed(partition int) {
@@ -186,7 +318,20 @@ func (rb *rebalancer) markUsed(partition int) {
 	}
 }
 
+// bestNodeIndex returns the best node for another replica of the partition
+// marked used, preferring the regions marked by markRegions, if any.
 func (rb *rebalancer) bestNodeIndex() int32 {
+	if rb.regionLimited {
+		if nodeIndex := rb.bestNodeIndexOf(true); nodeIndex >= 0 {
+			return nodeIndex
+		}
+	}
+	return rb.bestNodeIndexOf(false)
+}
+
+// bestNodeIndexOf is bestNodeIndex, choosing only from the regions marked by
+// markRegions if regionLimited is true.
+func (rb *rebalancer) bestNodeIndexOf(regionLimited bool) int32 {
 	bestNodeIndex := int32(-1)
 	bestDesire := int32(math.MinInt32)
 	var tierSep *tierSeparation
@@ -194,10 +339,26 @@ func (rb *rebalancer) bestNodeIndex() int32 {
 	tierToTierSeps := rb.tierToTierSeps
 	for tier := rb.maxTier; tier >= 0; tier-- {
 		// We will go through all tier separations for a tier to get the best
-		// node at that tier.
+		// node at that tier, skipping nodes already too overweight to take
+		// another replica just for the sake of dispersion.
 		for _, tierSep = range tierToTierSeps[tier] {
 			if !tierSep.used {
 				nodeIndex = tierSep.nodeIndexesByDesire[0]
+				if regionLimited || rb.nodeIndexInScope != nil {
+					nodeIndex = -1
+					for _, candidate := range tierSep.nodeIndexesByDesire {
+						if rb.inScope(candidate) && (!regionLimited || rb.regionAllowed(candidate)) {
+							nodeIndex = candidate
+							break
+						}
+					}
+					if nodeIndex < 0 {
+						continue
+					}
+				}
+				if rb.nodeIndexToDesire[nodeIndex] <= rb.nodeIndexToMinDesire[nodeIndex] {
+					continue
+				}
 				if bestDesire < rb.nodeIndexToDesire[nodeIndex] {
 					bestNodeIndex = nodeIndex
 					bestDesire = rb.nodeIndexToDesire[nodeIndex]
@@ -214,7 +375,7 @@ func (rb *rebalancer) bestNodeIndex() int32 {
 	// take the node with the highest desire that hasn't already been
 	// selected.
 	for _, nodeIndex := range rb.nodeIndexesByDesire {
-		if !rb.nodeIndexToUsed[nodeIndex] {
+		if !rb.nodeIndexToUsed[nodeIndex] && rb.inScope(nodeIndex) && (!regionLimited || rb.regionAllowed(nodeIndex)) {
 			return nodeIndex
 		}
 	}
@@ -309,12 +470,27 @@ func (rb *rebalancer) changeDesire(nodeIndex int32, increment bool) {
 func (rb *rebalancer) rebalance() bool {
 	rb.assignUnassigned()
 	rb.reassignDeactivated()
+	rb.reassignRegionTargets()
 	rb.reassignSameNodeDups()
 	rb.reassignSameTierDups()
 	rb.reassignOverweight()
+	rb.reassignAffinity()
 	return rb.altered
 }
 
+// budgetExhausted returns true, noting it in the report, if a move budget was
+// given and has been used up. Only the optional phases, separating duplicates
+// and relieving overweight nodes, are limited by the budget; unassigned
+// replicas must be assigned for a usable ring and replicas on deactivated
+// nodes are moved regardless, though the latter count against the budget.
+func (rb *rebalancer) budgetExhausted() bool {
+	if rb.budgeted && rb.movesLeft < 1 {
+		rb.report.MoveBudgetExhausted = true
+		return true
+	}
+	return false
+}
+
 // Assign any partitions assigned as -1 (happens with new ring and can happen
 // with a node removed with the Remove() method).
 func (rb *rebalancer) assignUnassigned() {
@@ -326,44 +502,94 @@ func (rb *rebalancer) assignUnassigned() {
 			}
 			rb.clearUsed()
 			rb.markUsed(partition)
+			rb.markRegions(partition, replica)
 			nodeIndex := rb.bestNodeIndex()
 			if nodeIndex < 0 {
 				nodeIndex = rb.nodeIndexesByDesire[0]
 			}
+			rb.event(replica, partition, -1, nodeIndex, RebalanceUnassigned)
 			partitionToNodeIndex[partition] = nodeIndex
 			rb.changeDesire(nodeIndex, false)
 			rb.partitionToMovementsLeft[partition]--
 			rb.builder.replicaToPartitionToLastMove[replica][partition] = 0
 			rb.altered = true
+			rb.report.UnassignedMoves++
 		}
 	}
 }
 
 // We'll reassign any partition replicas assigned to nodes marked inactive
-// (deleted or failed nodes).
+// (deleted or failed nodes), except for those deactivated with
+// InactiveKeepAsLastResort.
 func (rb *rebalancer) reassignDeactivated() {
 	for deletedNodeIndex, deletedNode := range rb.builder.nodes {
-		if !deletedNode.inactive {
+		if !deletedNode.inactive || !rb.inScope(int32(deletedNodeIndex)) {
 			continue
 		}
-		for replica := rb.maxReplica; replica >= 0; replica-- {
-			partitionToNodeIndex := rb.builder.replicaToPartitionToNodeIndex[replica]
-			for partition := rb.maxPartition; partition >= 0; partition-- {
-				if partitionToNodeIndex[partition] != int32(deletedNodeIndex) {
+		if deletedNode.inactivePolicy == InactiveKeepAsLastResort {
+			rb.keepAsLastResort(int32(deletedNodeIndex))
+		} else {
+			rb.reassignDeactivatedNode(int32(deletedNodeIndex))
+		}
+	}
+}
+
+func (rb *rebalancer) reassignDeactivatedNode(deletedNodeIndex int32) {
+	for replica := rb.maxReplica; replica >= 0; replica-- {
+		partitionToNodeIndex := rb.builder.replicaToPartitionToNodeIndex[replica]
+		for partition := rb.maxPartition; partition >= 0; partition-- {
+			if partitionToNodeIndex[partition] != deletedNodeIndex {
+				continue
+			}
+			rb.clearUsed()
+			rb.markUsed(partition)
+			rb.markRegions(partition, replica)
+			nodeIndex := rb.bestNodeIndex()
+			if nodeIndex < 0 {
+				if rb.nodeIndexInScope != nil {
 					continue
 				}
-				rb.clearUsed()
-				rb.markUsed(partition)
-				nodeIndex := rb.bestNodeIndex()
-				if nodeIndex < 0 {
-					nodeIndex = rb.nodeIndexesByDesire[0]
+				nodeIndex = rb.nodeIndexesByDesire[0]
+			}
+			rb.event(replica, partition, deletedNodeIndex, nodeIndex, RebalanceDeactivated)
+			partitionToNodeIndex[partition] = nodeIndex
+			rb.changeDesire(nodeIndex, false)
+			rb.partitionToMovementsLeft[partition]--
+			rb.builder.replicaToPartitionToLastMove[replica][partition] = 0
+			rb.altered = true
+			rb.movesLeft--
+			rb.report.DeactivatedMoves++
+		}
+	}
+}
+
+// keepAsLastResort swaps the replicas assigned to the inactive node into the
+// last replica positions of their partitions, behind the replicas on active
+// nodes, without moving any data.
+func (rb *rebalancer) keepAsLastResort(keptNodeIndex int32) {
+	replicaToPartitionToNodeIndex := rb.builder.replicaToPartitionToNodeIndex
+	replicaToPartitionToLastMove := rb.builder.replicaToPartitionToLastMove
+	for partition := rb.maxPartition; partition >= 0; partition-- {
+		last := rb.maxReplica
+		for replica := 0; replica < last; replica++ {
+			if replicaToPartitionToNodeIndex[replica][partition] != keptNodeIndex {
+				continue
+			}
+			for ; last > replica; last-- {
+				nodeIndex := replicaToPartitionToNodeIndex[last][partition]
+				if nodeIndex < 0 || !rb.builder.nodes[nodeIndex].inactive {
+					break
 				}
-				partitionToNodeIndex[partition] = nodeIndex
-				rb.changeDesire(nodeIndex, false)
-				rb.partitionToMovementsLeft[partition]--
-				rb.builder.replicaToPartitionToLastMove[replica][partition] = 0
-				rb.altered = true
 			}
+			if last == replica {
+				break
+			}
+			rb.event(replica, partition, keptNodeIndex, replicaToPartitionToNodeIndex[last][partition], RebalanceKeptAsLastResort)
+			rb.event(last, partition, replicaToPartitionToNodeIndex[last][partition], keptNodeIndex, RebalanceKeptAsLastResort)
+			replicaToPartitionToNodeIndex[replica][partition], replicaToPartitionToNodeIndex[last][partition] = replicaToPartitionToNodeIndex[last][partition], keptNodeIndex
+			replicaToPartitionToLastMove[replica][partition], replicaToPartitionToLastMove[last][partition] = replicaToPartitionToLastMove[last][partition], replicaToPartitionToLastMove[replica][partition]
+			rb.altered = true
+			last--
 		}
 	}
 }
@@ -386,11 +612,12 @@ DupLoopPartition:
 				continue
 			}
 			for replicaB := replica - 1; replicaB >= 0; replicaB-- {
-				if rb.builder.replicaToPartitionToNodeIndex[replica][partition] == rb.builder.replicaToPartitionToNodeIndex[replicaB][partition] {
+				if rb.builder.replicaToPartitionToNodeIndex[replica][partition] == rb.builder.replicaToPartitionToNodeIndex[replicaB][partition] && rb.inScope(rb.builder.replicaToPartitionToNodeIndex[replica][partition]) {
 					rb.clearUsed()
 					rb.markUsed(partition)
+					rb.markRegions(partition, replica)
 					nodeIndex := rb.bestNodeIndex()
-					if nodeIndex < 0 || rb.nodeIndexToDesire[nodeIndex] < 1 {
+					if nodeIndex < 0 || (rb.nodeIndexToDesire[nodeIndex] < 1 && rb.builder.placementMode != PlacementDispersed) {
 						continue
 					}
 					// No sense reassigning a duplicate to another duplicate.
@@ -399,12 +626,18 @@ DupLoopPartition:
 							continue DupLoopReplica
 						}
 					}
+					if rb.budgetExhausted() {
+						return
+					}
+					rb.event(replica, partition, rb.builder.replicaToPartitionToNodeIndex[replica][partition], nodeIndex, RebalanceSameNode)
 					rb.changeDesire(rb.builder.replicaToPartitionToNodeIndex[replica][partition], true)
 					rb.builder.replicaToPartitionToNodeIndex[replica][partition] = nodeIndex
 					rb.changeDesire(nodeIndex, false)
 					rb.partitionToMovementsLeft[partition]--
 					rb.builder.replicaToPartitionToLastMove[replica][partition] = 0
 					rb.altered = true
+					rb.movesLeft--
+					rb.report.SameNodeMoves++
 					if rb.partitionToMovementsLeft[partition] < 1 {
 						continue DupLoopPartition
 					}
@@ -423,15 +656,16 @@ func (rb *rebalancer) reassignSameTierDups() {
 			}
 		DupTierLoopReplica:
 			for replica := rb.maxReplica; replica > 0; replica-- {
-				if rb.builder.replicaToPartitionToLastMove[replica][partition] < rb.builder.moveWait {
+				if rb.builder.replicaToPartitionToLastMove[replica][partition] < rb.builder.moveWait || !rb.inScope(rb.builder.replicaToPartitionToNodeIndex[replica][partition]) {
 					continue
 				}
 				for replicaB := replica - 1; replicaB >= 0; replicaB-- {
 					if rb.tierToNodeIndexToTierSep[tier][rb.builder.replicaToPartitionToNodeIndex[replica][partition]] == rb.tierToNodeIndexToTierSep[tier][rb.builder.replicaToPartitionToNodeIndex[replicaB][partition]] {
 						rb.clearUsed()
 						rb.markUsed(partition)
+						rb.markRegions(partition, replica)
 						nodeIndex := rb.bestNodeIndex()
-						if nodeIndex < 0 || rb.nodeIndexToDesire[nodeIndex] < 1 {
+						if nodeIndex < 0 || (rb.nodeIndexToDesire[nodeIndex] < 1 && rb.builder.placementMode != PlacementDispersed) {
 							continue
 						}
 						// No sense reassigning a duplicate to another
@@ -441,12 +675,18 @@ func (rb *rebalancer) reassignSameTierDups() {
 								continue DupTierLoopReplica
 							}
 						}
+						if rb.budgetExhausted() {
+							return
+						}
+						rb.event(replica, partition, rb.builder.replicaToPartitionToNodeIndex[replica][partition], nodeIndex, RebalanceSameTier)
 						rb.changeDesire(rb.builder.replicaToPartitionToNodeIndex[replica][partition], true)
 						rb.builder.replicaToPartitionToNodeIndex[replica][partition] = nodeIndex
 						rb.changeDesire(nodeIndex, false)
 						rb.partitionToMovementsLeft[partition]--
 						rb.builder.replicaToPartitionToLastMove[replica][partition] = 0
 						rb.altered = true
+						rb.movesLeft--
+						rb.report.SameTierMoves++
 						if rb.partitionToMovementsLeft[partition] < 1 {
 							continue DupTierLoopPartition
 						}
@@ -475,25 +715,37 @@ OverweightLoop:
 		if visited[overweightNodeIndex] || rb.builder.nodes[overweightNodeIndex].inactive {
 			continue
 		}
+		rb.report.Passes++
 		// First pass to reassign to only underweight nodes.
 		for replica := rb.maxReplica; replica >= 0; replica-- {
 			partitionToNodeIndex := rb.builder.replicaToPartitionToNodeIndex[replica]
 			for partition := rb.maxPartition; partition >= 0; partition-- {
-				if partitionToNodeIndex[partition] != overweightNodeIndex || rb.partitionToMovementsLeft[partition] < 1 || rb.builder.replicaToPartitionToLastMove[replica][partition] < rb.builder.moveWait {
+				if partitionToNodeIndex[partition] != overweightNodeIndex {
+					continue
+				}
+				if rb.partitionToMovementsLeft[partition] < 1 || rb.builder.replicaToPartitionToLastMove[replica][partition] < rb.builder.moveWait {
+					rb.report.WaitBlocked++
 					continue
 				}
 				rb.clearUsed()
 				rb.markUsed(partition)
+				rb.markRegions(partition, replica)
 				nodeIndex := rb.bestNodeIndex()
-				if nodeIndex < 0 || rb.nodeIndexToDesire[nodeIndex] < 1 {
+				if nodeIndex < 0 || rb.nodeIndexToDesire[nodeIndex] < 1 || !rb.keepsDispersion(partition, replica, overweightNodeIndex, nodeIndex) {
 					continue
 				}
+				if rb.budgetExhausted() {
+					return
+				}
+				rb.event(replica, partition, overweightNodeIndex, nodeIndex, RebalanceOverweight)
 				rb.changeDesire(overweightNodeIndex, true)
 				partitionToNodeIndex[partition] = nodeIndex
 				rb.changeDesire(nodeIndex, false)
 				rb.partitionToMovementsLeft[partition]--
 				rb.builder.replicaToPartitionToLastMove[replica][partition] = 0
 				rb.altered = true
+				rb.movesLeft--
+				rb.report.OverweightMoves++
 				if rb.nodeIndexToDesire[overweightNodeIndex] >= 0 {
 					visited[overweightNodeIndex] = true
 					i = len(rb.nodeIndexesByDesire)
@@ -510,16 +762,23 @@ OverweightLoop:
 				}
 				rb.clearUsed()
 				rb.markUsed(partition)
+				rb.markRegions(partition, replica)
 				nodeIndex := rb.bestNodeIndex()
-				if nodeIndex < 0 || rb.nodeIndexToDesire[nodeIndex] <= rb.nodeIndexToDesire[overweightNodeIndex] {
+				if nodeIndex < 0 || rb.nodeIndexToDesire[nodeIndex] <= rb.nodeIndexToDesire[overweightNodeIndex] || !rb.keepsDispersion(partition, replica, overweightNodeIndex, nodeIndex) {
 					continue
 				}
+				if rb.budgetExhausted() {
+					return
+				}
+				rb.event(replica, partition, overweightNodeIndex, nodeIndex, RebalanceOverweight)
 				rb.changeDesire(overweightNodeIndex, true)
 				partitionToNodeIndex[partition] = nodeIndex
 				rb.changeDesire(nodeIndex, false)
 				rb.partitionToMovementsLeft[partition]--
 				rb.builder.replicaToPartitionToLastMove[replica][partition] = 0
 				rb.altered = true
+				rb.movesLeft--
+				rb.report.OverweightMoves++
 				if rb.nodeIndexToDesire[overweightNodeIndex] >= 0 {
 					visited[overweightNodeIndex] = true
 					i = len(rb.nodeIndexesByDesire)
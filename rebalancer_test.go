@@ -304,3 +304,77 @@ func TestRebalancerTier1b(t *testing.T) {
 		}
 	}
 }
+
+func helperDispersionBuilder(dispersionPointsAllowed byte) *Builder {
+	// One node in zone0 and two nodes each in zone1 and zone2, 3 replicas.
+	// Perfect zone dispersion would give the zone0 node a third of all
+	// assignments rather than the fifth its capacity warrants.
+	b := NewBuilder(64)
+	b.SetReplicaCount(3)
+	b.SetDispersionPointsAllowed(dispersionPointsAllowed)
+	for i := 0; i < 5; i++ {
+		b.AddNode(true, 1, []string{fmt.Sprintf("server%d", i), fmt.Sprintf("zone%d", (i+1)/2)}, nil, "", nil)
+	}
+	b.resizeIfNeeded()
+	rb := newRebalancer(b)
+	rb.rebalance()
+	return b
+}
+
+func TestRebalancerDispersionPointsAllowed(t *testing.T) {
+	b := helperDispersionBuilder(255)
+	count := 0
+	for _, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+		for _, nodeIndex := range partitionToNodeIndex {
+			if nodeIndex == 0 {
+				count++
+			}
+		}
+	}
+	if count != len(b.replicaToPartitionToNodeIndex[0]) {
+		t.Fatalf("%v != %v", count, len(b.replicaToPartitionToNodeIndex[0]))
+	}
+	b = helperDispersionBuilder(3)
+	count = 0
+	for _, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+		for _, nodeIndex := range partitionToNodeIndex {
+			if nodeIndex == 0 {
+				count++
+			}
+		}
+	}
+	desired := float64(len(b.replicaToPartitionToNodeIndex)*len(b.replicaToPartitionToNodeIndex[0])) / 5
+	if float64(count) > desired*1.03+1 {
+		t.Fatalf("%v > %v", count, desired*1.03+1)
+	}
+	// Balance may cost zone dispersion, but never node dispersion.
+	for p := 0; p < len(b.replicaToPartitionToNodeIndex[0]); p++ {
+		nodes := make(map[int32]bool)
+		for _, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+			if nodes[partitionToNodeIndex[p]] {
+				t.Fatal(p, partitionToNodeIndex[p])
+			}
+			nodes[partitionToNodeIndex[p]] = true
+		}
+	}
+}
+
+func TestRebalancerMovesPerPartition(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetReplicaCount(5)
+	b.resizeIfNeeded()
+	rb := newRebalancer(b)
+	if rb.partitionToMovementsLeft[0] != 2 {
+		t.Fatal(rb.partitionToMovementsLeft[0])
+	}
+	b.SetMovesPerPartition(1)
+	rb = newRebalancer(b)
+	if rb.partitionToMovementsLeft[0] != 1 {
+		t.Fatal(rb.partitionToMovementsLeft[0])
+	}
+	b.SetMovesPerPartition(5)
+	rb = newRebalancer(b)
+	if rb.partitionToMovementsLeft[0] != 5 {
+		t.Fatal(rb.partitionToMovementsLeft[0])
+	}
+}
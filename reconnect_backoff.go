@@ -0,0 +1,57 @@
+package ring
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// reconnectWait returns how long to wait before the next connection try after
+// the given number of consecutive failures: the ReconnectInterval, doubled
+// for each failure after the first up to the ReconnectMaxInterval, and then
+// shortened by up to the ReconnectJitter percentage.
+func (t *TCPMsgRing) reconnectWait(failures int) time.Duration {
+	wait := t.reconnectInterval
+	for i := 1; i < failures && wait < t.reconnectMaxInterval; i++ {
+		wait *= 2
+	}
+	if t.reconnectMaxInterval > t.reconnectInterval && wait > t.reconnectMaxInterval {
+		wait = t.reconnectMaxInterval
+	}
+	if t.reconnectJitter > 0 {
+		if spread := int64(wait) * int64(t.reconnectJitter) / 100; spread > 0 {
+			wait -= time.Duration(rand.Int63n(spread + 1))
+		}
+	}
+	return wait
+}
+
+// giveUpConnection stops trying to connect to the address after the
+// ReconnectMaxRetries, dropping the messages queued for it; the next message
+// to the address starts over with a new connection routine.
+func (t *TCPMsgRing) giveUpConnection(addr string, msgChan chan Msg) {
+	atomic.AddInt32(&t.dialGiveUps, 1)
+	t.msgChansLock.Lock()
+	if t.msgChans[addr] == msgChan {
+		delete(t.msgChans, addr)
+	}
+	stopChan := t.msgChanStops[msgChan]
+	delete(t.msgChanStops, msgChan)
+	t.msgChansLock.Unlock()
+	if stopChan != nil {
+		close(stopChan)
+	}
+	dropped := 0
+DrainLoop:
+	for {
+		select {
+		case msg := <-msgChan:
+			dropped++
+			msg.Free()
+		default:
+			break DrainLoop
+		}
+	}
+	atomic.AddInt32(&t.dialGiveUpDrops, int32(dropped))
+	t.logDebug("connection: %s gave up after %d tries, dropped %d\n", addr, t.reconnectMaxRetries, dropped)
+}
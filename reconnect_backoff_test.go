@@ -0,0 +1,50 @@
+package ring
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTCPMsgRingReconnectWait(t *testing.T) {
+	msgring, _ := NewTCPMsgRing(&TCPMsgRingConfig{ReconnectInterval: 1, ReconnectMaxInterval: 5})
+	defer msgring.Shutdown()
+	for failures, expected := range []time.Duration{time.Second, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if wait := msgring.reconnectWait(failures); wait != expected {
+			t.Fatalf("%d: %s != %s", failures, wait, expected)
+		}
+	}
+	msgring.reconnectJitter = 50
+	for i := 0; i < 100; i++ {
+		if wait := msgring.reconnectWait(3); wait < 2*time.Second || wait > 4*time.Second {
+			t.Fatal(wait)
+		}
+	}
+	fixed, _ := NewTCPMsgRing(&TCPMsgRingConfig{ReconnectInterval: 3})
+	defer fixed.Shutdown()
+	if wait := fixed.reconnectWait(10); wait != 3*time.Second {
+		t.Fatalf("%s != 3s", wait)
+	}
+}
+
+func TestTCPMsgRingReconnectMaxRetries(t *testing.T) {
+	msgring, _ := NewTCPMsgRing(&TCPMsgRingConfig{ReconnectMaxRetries: 3})
+	defer msgring.Shutdown()
+	msgring.reconnectInterval = time.Millisecond
+	addr := "127.0.0.2:1"
+	msgring.chaosAddrOffs[addr] = true
+	msgChan, _ := msgring.msgChanForAddr(addr)
+	m := newTestMsg()
+	msgChan <- m
+	msgring.connection(addr, nil, msgChan, true, false)
+	select {
+	case <-m.done:
+	default:
+		t.Fatal("dropped message was not freed")
+	}
+	if msgring.lookupMsgChanForAddr(addr) != nil {
+		t.Fatal("gave up address should start over with its next message")
+	}
+	if s := msgring.Stats(false); s.Dials != 3 || s.DialErrors != 3 || s.DialGiveUps != 1 || s.DialGiveUpDrops != 1 {
+		t.Fatalf("%d %d %d %d", s.Dials, s.DialErrors, s.DialGiveUps, s.DialGiveUpDrops)
+	}
+}
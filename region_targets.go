@@ -0,0 +1,273 @@
+package ring
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// SetRegionTargets declares how many replicas of every partition should be
+// placed in each region, the regions being the tier values at the level
+// given; for example, with regions at tier level 2, targets of east=2 and
+// west=1 ask for two replicas of each partition in east and one in west. This
+// suits geo-redundant deployments whose regions differ in capacity, where
+// dispersion alone would spread replicas evenly.
+//
+// The targets may total fewer than the replica count, leaving the other
+// replicas to be placed anywhere, but not more. Empty targets clear the
+// setting.
+//
+// The rebalancer places replicas to meet the targets before balancing, so
+// they are met unless a region lacks active nodes or the move wait holds
+// replicas in place; such partitions are counted by
+// RebalanceReport.RegionTargetShortfalls and BuilderStats, and listed by
+// RegionTargetShortfalls.
+func (b *Builder) SetRegionTargets(level int, targets map[string]int) error {
+	if len(targets) == 0 {
+		if len(b.regionTargets) > 0 {
+			b.regionTargets = nil
+			b.dirty = true
+		}
+		b.regionLevel = 0
+		return nil
+	}
+	if level < 0 {
+		return fmt.Errorf("invalid tier level %d", level)
+	}
+	total := 0
+	for region, count := range targets {
+		if region == "" {
+			return fmt.Errorf("a region target needs a region")
+		}
+		if count < 0 {
+			return fmt.Errorf("invalid replica target %d for region %s", count, region)
+		}
+		total += count
+	}
+	if total > b.ReplicaCount() {
+		return fmt.Errorf("region targets total %d replicas; there are %d", total, b.ReplicaCount())
+	}
+	b.regionLevel = level
+	b.regionTargets = make(map[string]int, len(targets))
+	for region, count := range targets {
+		b.regionTargets[region] = count
+	}
+	b.dirty = true
+	return nil
+}
+
+// RegionTargets returns the tier level and replica targets set with
+// SetRegionTargets; the targets are empty if none are set.
+func (b *Builder) RegionTargets() (level int, targets map[string]int) {
+	targets = make(map[string]int, len(b.regionTargets))
+	for region, count := range b.regionTargets {
+		targets[region] = count
+	}
+	return b.regionLevel, targets
+}
+
+// RegionTargetShortfalls returns the partitions whose current assignments do
+// not meet the region targets, in ascending order; see SetRegionTargets.
+func (b *Builder) RegionTargetShortfalls() []Partition {
+	if len(b.regionTargets) == 0 {
+		return nil
+	}
+	rb := newRebalancer(b)
+	var partitions []Partition
+	for partition := 0; partition <= rb.maxPartition; partition++ {
+		if rb.regionShort(partition, -1) {
+			partitions = append(partitions, Partition(partition))
+		}
+	}
+	return partitions
+}
+
+// initRegions maps the nodes to the regions with targets, in region name
+// order so rebalancing is deterministic.
+func (rb *rebalancer) initRegions() {
+	if len(rb.builder.regionTargets) == 0 {
+		return
+	}
+	regions := make([]string, 0, len(rb.builder.regionTargets))
+	for region := range rb.builder.regionTargets {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	rb.regionTargets = make([]int, len(regions))
+	regionIndexes := make(map[string]int32, len(regions))
+	for i, region := range regions {
+		rb.regionTargets[i] = rb.builder.regionTargets[region]
+		regionIndexes[region] = int32(i)
+	}
+	rb.nodeIndexToRegion = make([]int32, len(rb.builder.nodes))
+	for nodeIndex, n := range rb.builder.nodes {
+		rb.nodeIndexToRegion[nodeIndex] = -1
+		if i, ok := regionIndexes[n.Tier(rb.builder.regionLevel)]; ok {
+			rb.nodeIndexToRegion[nodeIndex] = i
+		}
+	}
+	rb.regionCounts = make([]int, len(regions))
+	rb.regionNeeded = make([]bool, len(regions))
+}
+
+// regionShort counts the partition's replicas in each region, leaving out the
+// replica given, and marks the regions below their targets as needed; it
+// returns true if any region is.
+func (rb *rebalancer) regionShort(partition int, skipReplica int) bool {
+	for region := range rb.regionCounts {
+		rb.regionCounts[region] = 0
+	}
+	for replica := rb.maxReplica; replica >= 0; replica-- {
+		nodeIndex := rb.builder.replicaToPartitionToNodeIndex[replica][partition]
+		if replica == skipReplica || nodeIndex < 0 {
+			continue
+		}
+		if region := rb.nodeIndexToRegion[nodeIndex]; region >= 0 {
+			rb.regionCounts[region]++
+		}
+	}
+	short := false
+	for region, target := range rb.regionTargets {
+		rb.regionNeeded[region] = rb.regionCounts[region] < target
+		if rb.regionNeeded[region] {
+			short = true
+		}
+	}
+	return short
+}
+
+// markRegions limits the choice of bestNodeIndex, for the replica of the
+// partition about to be assigned, to the regions still short of their
+// targets without it. It follows markUsed; clearUsed lifts the limit.
+func (rb *rebalancer) markRegions(partition int, replica int) {
+	if rb.nodeIndexToRegion != nil {
+		rb.regionLimited = rb.regionShort(partition, replica)
+	}
+}
+
+// regionAllowed returns true if the node may be chosen under the limit set by
+// markRegions.
+func (rb *rebalancer) regionAllowed(nodeIndex int32) bool {
+	region := rb.nodeIndexToRegion[nodeIndex]
+	return region >= 0 && rb.regionNeeded[region] && !rb.builder.nodes[nodeIndex].inactive
+}
+
+// sameRegion returns true if the nodes are in the same region as far as the
+// region targets are concerned; always true without targets.
+func (rb *rebalancer) sameRegion(nodeIndexA int32, nodeIndexB int32) bool {
+	return rb.nodeIndexToRegion == nil || rb.nodeIndexToRegion[nodeIndexA] == rb.nodeIndexToRegion[nodeIndexB]
+}
+
+// reassignRegionTargets moves replicas out of regions over their targets, or
+// without targets, into regions short of their targets. Meeting the targets
+// takes precedence over balance, as dispersion does by default.
+func (rb *rebalancer) reassignRegionTargets() {
+	if rb.nodeIndexToRegion == nil {
+		return
+	}
+	for partition := rb.maxPartition; partition >= 0; partition-- {
+		for replica := rb.maxReplica; replica >= 0; replica-- {
+			if !rb.regionShort(partition, -1) {
+				break
+			}
+			fromNodeIndex := rb.builder.replicaToPartitionToNodeIndex[replica][partition]
+			if fromNodeIndex < 0 || !rb.inScope(fromNodeIndex) || !rb.canMove(replica, partition) {
+				continue
+			}
+			if region := rb.nodeIndexToRegion[fromNodeIndex]; region >= 0 && rb.regionCounts[region] <= rb.regionTargets[region] {
+				continue
+			}
+			rb.clearUsed()
+			rb.markUsed(partition)
+			rb.markRegions(partition, replica)
+			nodeIndex := rb.bestNodeIndexOf(true)
+			if nodeIndex < 0 {
+				continue
+			}
+			if rb.budgetExhausted() {
+				return
+			}
+			rb.event(replica, partition, fromNodeIndex, nodeIndex, RebalanceRegion)
+			rb.changeDesire(fromNodeIndex, true)
+			rb.builder.replicaToPartitionToNodeIndex[replica][partition] = nodeIndex
+			rb.changeDesire(nodeIndex, false)
+			rb.partitionToMovementsLeft[partition]--
+			rb.builder.replicaToPartitionToLastMove[replica][partition] = 0
+			rb.altered = true
+			rb.movesLeft--
+			rb.report.RegionMoves++
+		}
+	}
+}
+
+func (b *Builder) writeRegionTargets(w io.Writer) error {
+	if err := binary.Write(w, binary.BigEndian, int32(b.regionLevel)); err != nil {
+		return err
+	}
+	if len(b.regionTargets) > math.MaxInt32 {
+		return fmt.Errorf("%d region targets is too large; max is %d", len(b.regionTargets), math.MaxInt32)
+	}
+	regions := make([]string, 0, len(b.regionTargets))
+	for region := range b.regionTargets {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	if err := binary.Write(w, binary.BigEndian, int32(len(regions))); err != nil {
+		return err
+	}
+	for _, region := range regions {
+		byts := []byte(region)
+		if len(byts) > math.MaxInt32 {
+			return fmt.Errorf("%d region name length is too large; max is %d", len(byts), math.MaxInt32)
+		}
+		if err := binary.Write(w, binary.BigEndian, int32(len(byts))); err != nil {
+			return err
+		}
+		if _, err := w.Write(byts); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.BigEndian, int32(b.regionTargets[region])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Builder) readRegionTargets(r io.Reader) error {
+	var level, count int32
+	if err := binary.Read(r, binary.BigEndian, &level); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return err
+	}
+	if count < 0 {
+		return fmt.Errorf("invalid region target count %d", count)
+	}
+	b.regionLevel = int(level)
+	b.regionTargets = nil
+	if count > 0 {
+		b.regionTargets = make(map[string]int, count)
+	}
+	for i := int32(0); i < count; i++ {
+		var length int32
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return err
+		}
+		if length < 0 {
+			return fmt.Errorf("invalid region name length %d", length)
+		}
+		byts := make([]byte, length)
+		if _, err := io.ReadFull(r, byts); err != nil {
+			return err
+		}
+		var target int32
+		if err := binary.Read(r, binary.BigEndian, &target); err != nil {
+			return err
+		}
+		b.regionTargets[string(byts)] = int(target)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package ring
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func regionTargetsTestBuilder(t *testing.T) *Builder {
+	b := NewBuilder(64)
+	b.SetReplicaCount(3)
+	for i := 0; i < 6; i++ {
+		region := "east"
+		if i >= 4 {
+			region = "west"
+		}
+		if _, err := b.AddNode(true, 100, []string{fmt.Sprintf("server%d", i), region}, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b
+}
+
+func regionCounts(b *Builder, partition int) map[string]int {
+	counts := map[string]int{}
+	for _, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+		counts[b.nodes[partitionToNodeIndex[partition]].Tier(1)]++
+	}
+	return counts
+}
+
+func TestSetRegionTargets(t *testing.T) {
+	b := regionTargetsTestBuilder(t)
+	if err := b.SetRegionTargets(1, map[string]int{"east": 3, "west": 1}); err == nil {
+		t.Fatal("targets over the replica count accepted")
+	}
+	if err := b.SetRegionTargets(-1, map[string]int{"east": 1}); err == nil {
+		t.Fatal("negative level accepted")
+	}
+	if err := b.SetRegionTargets(1, map[string]int{"east": 2, "west": 1}); err != nil {
+		t.Fatal(err)
+	}
+	level, targets := b.RegionTargets()
+	if level != 1 || len(targets) != 2 || targets["east"] != 2 || targets["west"] != 1 {
+		t.Fatal(level, targets)
+	}
+	if err := b.SetRegionTargets(0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, targets = b.RegionTargets(); len(targets) != 0 {
+		t.Fatal(targets)
+	}
+}
+
+func TestRegionTargetsRebalance(t *testing.T) {
+	b := regionTargetsTestBuilder(t)
+	if err := b.SetRegionTargets(1, map[string]int{"east": 2, "west": 1}); err != nil {
+		t.Fatal(err)
+	}
+	b.Ring()
+	if rr := b.LastRebalanceReport(); rr.RegionTargetShortfalls != 0 {
+		t.Fatal(rr.RegionTargetShortfalls, b.RegionTargetShortfalls())
+	}
+	for partition := 0; partition < len(b.replicaToPartitionToNodeIndex[0]); partition++ {
+		if counts := regionCounts(b, partition); counts["east"] != 2 || counts["west"] != 1 {
+			t.Fatal(partition, counts)
+		}
+	}
+	if s := b.Stats(); s.RegionTargetShortfalls != 0 {
+		t.Fatal(s.RegionTargetShortfalls)
+	}
+	// Reversing the targets moves replicas between the regions as the move
+	// wait allows.
+	if err := b.SetRegionTargets(1, map[string]int{"east": 1, "west": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.RegionTargetShortfalls()) == 0 {
+		t.Fatal("no shortfalls after changing the targets")
+	}
+	moves := 0
+	for i := 0; i < 4 && len(b.RegionTargetShortfalls()) > 0; i++ {
+		b.PretendElapsed(b.MoveWait())
+		b.Ring()
+		moves += b.LastRebalanceReport().RegionMoves
+	}
+	if moves == 0 || len(b.RegionTargetShortfalls()) != 0 {
+		t.Fatal(moves, b.RegionTargetShortfalls())
+	}
+	for partition := 0; partition < len(b.replicaToPartitionToNodeIndex[0]); partition++ {
+		if counts := regionCounts(b, partition); counts["east"] != 1 || counts["west"] != 2 {
+			t.Fatal(partition, counts)
+		}
+	}
+}
+
+func TestRegionTargetsShortfall(t *testing.T) {
+	b := regionTargetsTestBuilder(t)
+	if err := b.SetRegionTargets(1, map[string]int{"north": 1}); err != nil {
+		t.Fatal(err)
+	}
+	b.Ring()
+	if rr := b.LastRebalanceReport(); rr.RegionTargetShortfalls != PartitionCount(b.partitionBitCount) {
+		t.Fatal(rr.RegionTargetShortfalls)
+	}
+}
+
+func TestRegionTargetsPersist(t *testing.T) {
+	b := regionTargetsTestBuilder(t)
+	if err := b.SetRegionTargets(1, map[string]int{"east": 2, "west": 1}); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := b.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := LoadBuilder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	level, targets := b2.RegionTargets()
+	if level != 1 || len(targets) != 2 || targets["east"] != 2 || targets["west"] != 1 {
+		t.Fatal(level, targets)
+	}
+}
@@ -13,7 +13,6 @@
 //
 //  import (
 //      "fmt"
-//      "hash/fnv"
 //
 //      "github.com/gholt/ring"
 //  )
@@ -28,19 +27,15 @@
 //      builder.AddNode(true, 1, nil, nil, "NodeB", nil)
 //      builder.AddNode(true, 1, nil, nil, "NodeC", nil)
 //      // This rebalances if necessary and provides a usable Ring instance.
-//      ring := builder.Ring()
-//      // This value indicates how many bits are in use for determining ring
-//      // partitions.
-//      partitionBitCount := ring.PartitionBitCount()
+//      r := builder.Ring()
 //      for _, item := range []string{"First", "Second", "Third"} {
-//          // We're using fnv hashing here, but you can use whatever you like.
-//          // We don't actually recommend fnv, but it's useful for this example.
-//          hasher := fnv.New64a()
-//          hasher.Write([]byte(item))
-//          partition := uint32(hasher.Sum64() >> (64 - partitionBitCount))
+//          // This hashes the item with the ring's KeyHasher, FNV-1a unless
+//          // another is set with builder.SetKeyHasher, and takes the
+//          // partition from the upper bits of the hash.
+//          partition := r.PartitionForKey([]byte(item))
 //          // We can just grab the first node since this example just uses one
 //          // replica. See Builder.SetReplicaCount for more information.
-//          node := ring.ResponsibleNodes(partition)[0]
+//          node := r.ResponsibleNodes(partition)[0]
 //          fmt.Printf("%s is handled by %v\n", item, node.Meta())
 //      }
 //  }
@@ -58,12 +53,37 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"math/rand"
 )
 
 // RINGVERSION is the ring file format version written to and checked for in
 // the ring file header. If the on disk format of the ring changes this version
-// should be incremented.
-const RINGVERSION = "RINGv00000000001"
+// should be incremented, once per release, with LoadRing and the lookup
+// subpackage's reader updated to match and still reading the previous
+// release's files.
+const RINGVERSION = "RINGv00000000002"
+
+// ringVersion1 is the ring file format of the first release, before node
+// capacities became 64 bit and rings gained network zones, address roles,
+// partition modes, and usable capacities. LoadRing reads it, taking each
+// node's capacity as usable; persisting the loaded Ring migrates it to
+// RINGVERSION.
+const ringVersion1 = "RINGv00000000001"
+
+// HandoffMode indicates how Ring.HandoffNodes chooses nodes.
+type HandoffMode int
+
+const (
+	// HandoffDeterministic chooses handoff nodes so that every user of the
+	// same Ring will arrive at the same answer for a given partition, which
+	// is needed when all nodes must agree where handed off data lives. The
+	// choice is still weighted by capacity across partitions.
+	HandoffDeterministic HandoffMode = iota
+	// HandoffWeightedRandom chooses handoff nodes randomly, weighted by
+	// capacity, on every call; this spreads handoff load better when nodes
+	// do not need to agree on the choice.
+	HandoffWeightedRandom
+)
 
 // Ring is the immutable snapshot of data assignments to nodes.
 //
@@ -111,12 +131,18 @@ type Ring interface {
 	// string is always an available value at any level, although it is not
 	// returned from this method.
 	Tiers() [][]string
+	// AddressRoles returns the names given to the node address indexes, as
+	// set with Builder.SetAddressRoles.
+	AddressRoles() []string
+	// AddressIndex returns the index to use with Node.Address for the named
+	// role, or -1 if the role is not known.
+	AddressIndex(role string) int
 	// PartitionBitCount is the number of bits that can be used to determine a
 	// partition number for the current data in the ring. For example, to
 	// convert a uint64 hash value into a partition number you could use
-	// hashValue >> (64 - ring.PartitionBitCount()). The PartitionBitCount also
-	// indicates how many partitions the Ring has; for example, a value of 16
-	// would indicate 2**16 or 65,536 partitions.
+	// PartitionFromKey(hashValue, ring.PartitionBitCount()). The
+	// PartitionBitCount also indicates how many partitions the Ring has; for
+	// example, a value of 16 would indicate 2**16 or 65,536 partitions.
 	PartitionBitCount() uint16
 	// ReplicaCount specifies how many replicas the Ring has.
 	ReplicaCount() int
@@ -128,13 +154,20 @@ type Ring interface {
 	// local node binding is used by things such as MsgRing to know what items
 	// are bound for the local instance or need to be sent to remote ones, etc.
 	SetLocalNode(nodeID uint64)
+	// PartitionForKey returns the partition of the key, hashed with the
+	// ring's KeyHasher; see KeyHasher and PartitionFromKey.
+	PartitionForKey(key []byte) Partition
+	// KeyHasher returns the name of the KeyHasher PartitionForKey uses, as
+	// set with Builder.SetKeyHasher and persisted with the ring, so every
+	// user of the ring places keys the same way.
+	KeyHasher() string
 	// Responsible will return true if LocalNode is set and one of the
 	// partition's replicas is assigned to that local node.
 	//
 	// Note that the partition value is not bounds checked; an invalid
 	// partition will cause a panic. See the documentation for the Ring
 	// interface itself for further discussion.
-	Responsible(partition uint32) bool
+	Responsible(partition Partition) bool
 	// ResponsibleReplica will return the replica index >= 0 if LocalNode is
 	// set and one of the partition's replicas is assigned to that local node;
 	// it will return -1 if LocalNode is not responsible for the partition.
@@ -142,17 +175,70 @@ type Ring interface {
 	// Note that the partition value is not bounds checked; an invalid
 	// partition will cause a panic. See the documentation for the Ring
 	// interface itself for further discussion.
-	ResponsibleReplica(partition uint32) int
+	ResponsibleReplica(partition Partition) int
 	// ResponsibleNodes will return the list of nodes that are responsible for
 	// the replicas of the partition.
 	//
+	// Should any replica of the partition be unassigned, as can happen with
+	// rings built outside of a Builder's rebalancing, a deterministic handoff
+	// node is substituted in its place, as with HandoffNodes; if there are
+	// not enough active nodes for that, the replica is left out and fewer
+	// nodes than the ReplicaCount are returned. UnassignedReplicas reports
+	// this condition.
+	//
+	// Note that the partition value is not bounds checked; an invalid
+	// partition will cause a panic. See the documentation for the Ring
+	// interface itself for further discussion.
+	ResponsibleNodes(partition Partition) NodeSlice
+	// UnassignedReplicas returns the number of replicas of the partition that
+	// are not assigned to any node; see ResponsibleNodes.
+	//
+	// Note that the partition value is not bounds checked; an invalid
+	// partition will cause a panic. See the documentation for the Ring
+	// interface itself for further discussion.
+	UnassignedReplicas(partition Partition) int
+	// PreferredReplicas will return the list of nodes that are responsible
+	// for the replicas of the partition, ordered by preference with the most
+	// preferred node first. The locality func scores each node, lower scores
+	// being preferred; if locality is nil, the TierDistance from the
+	// LocalNode is used as the score, or the replica order is kept if
+	// LocalNode is not set. Nodes with equal scores keep their replica order,
+	// so all users of the same Ring and locality func will arrive at the same
+	// ordering.
+	//
+	// Note that the partition value is not bounds checked; an invalid
+	// partition will cause a panic. See the documentation for the Ring
+	// interface itself for further discussion.
+	PreferredReplicas(partition Partition, locality func(n Node) int) NodeSlice
+	// HandoffNodes returns up to count active nodes, not responsible for the
+	// partition, that can be used to temporarily hold data for the partition
+	// when responsible nodes are unavailable. The nodes are chosen weighted
+	// by capacity according to the HandoffMode and are returned in order of
+	// preference.
+	//
 	// Note that the partition value is not bounds checked; an invalid
 	// partition will cause a panic. See the documentation for the Ring
 	// interface itself for further discussion.
-	ResponsibleNodes(partition uint32) NodeSlice
+	HandoffNodes(partition Partition, count int, mode HandoffMode) NodeSlice
 	// Stats gives information about the ring and its health; the MaxUnder and
 	// MaxOver values specifically indicate how balanced the ring is.
 	Stats() *Stats
+	// PartitionMode returns the mode of the partition, PartitionReadWrite
+	// unless restricted with Builder.SetPartitionMode; storage layers should
+	// check it before serving reads or writes for the partition.
+	//
+	// Note that the partition value is not bounds checked; an invalid
+	// partition will simply give PartitionReadWrite.
+	PartitionMode(partition Partition) PartitionMode
+	// PartitionModes returns the partitions with a mode other than
+	// PartitionReadWrite.
+	PartitionModes() map[Partition]PartitionMode
+	// AssignmentSnapshot returns a copy of the full assignment table, for
+	// tooling computing its own statistics; indexed by replica and then by
+	// partition, each value is the index of the assigned node in the
+	// NodeSlice returned by Nodes, or -1 if the replica is unassigned.
+	// Unlike ResponsibleNodes, no handoff nodes are substituted.
+	AssignmentSnapshot() [][]int32
 	// Persist saves the Ring state to the given Writer for later reloading via
 	// the LoadRing method.
 	Persist(w io.Writer) error
@@ -170,10 +256,23 @@ type ring struct {
 	partitionBitCount             uint16
 	nodes                         []*node
 	replicaToPartitionToNodeIndex [][]int32
+	addressRoles                  []string
+	partitionModes                map[Partition]PartitionMode
+	// usableCapacities are the capacities the nodes were balanced by, after
+	// any reserves or draining, as of the ring's making; nil for rings from
+	// older files.
+	usableCapacities []uint64
+	// keyHasherName is as given to Builder.SetKeyHasher, empty for the
+	// default, and keyHasher is the KeyHasher registered under it.
+	keyHasherName string
+	keyHasher     KeyHasher
+	keyLookup        keyLookupTable
 }
 
 // LoadRing creates a new Ring instance based on the persisted data from the
-// Reader (presumably previously saved with the Ring.Persist method).
+// Reader (presumably previously saved with the Ring.Persist method). The
+// persisted data is versioned and its checksum is verified, so rings can be
+// shipped to clients and a corrupted or truncated copy is an error.
 func LoadRing(rd io.Reader) (Ring, error) {
 	// CONSIDER: This code uses binary.Read which incurs fleeting allocations;
 	// these could be reduced by creating a buffer upfront and using
@@ -188,7 +287,8 @@ func LoadRing(rd io.Reader) (Ring, error) {
 	if err != nil {
 		return nil, err
 	}
-	if string(header) != RINGVERSION {
+	v1 := string(header) == ringVersion1
+	if string(header) != RINGVERSION && !v1 {
 		return nil, fmt.Errorf("unknown header %s", string(header))
 	}
 	r := &ring{}
@@ -196,13 +296,11 @@ func LoadRing(rd io.Reader) (Ring, error) {
 	if err != nil {
 		return nil, err
 	}
-	var configBytes int32
-	err = binary.Read(gr, binary.BigEndian, &configBytes)
+	configBytes, err := readLength(gr, "config length")
 	if err != nil {
 		return nil, err
 	}
-	r.config = make([]byte, configBytes)
-	_, err = io.ReadFull(gr, r.config)
+	r.config, err = readBytes(gr, configBytes)
 	if err != nil {
 		return nil, err
 	}
@@ -214,40 +312,40 @@ func LoadRing(rd io.Reader) (Ring, error) {
 	if err != nil {
 		return nil, err
 	}
-	var vint32 int32
-	err = binary.Read(gr, binary.BigEndian, &vint32)
+	vint32, err := readLength(gr, "number of tiers")
 	if err != nil {
 		return nil, err
 	}
-	r.tiers = make([][]string, vint32)
+	r.tiers = make([][]string, 0, allocLength(vint32))
 	for i := int32(0); i < vint32; i++ {
 		var vvint32 int32
-		err = binary.Read(gr, binary.BigEndian, &vvint32)
+		vvint32, err = readLength(gr, "number of tier positions")
 		if err != nil {
 			return nil, err
 		}
-		r.tiers[i] = make([]string, vvint32)
+		tier := make([]string, 0, allocLength(vvint32))
 		for j := int32(0); j < vvint32; j++ {
 			var vvvint32 int32
-			err = binary.Read(gr, binary.BigEndian, &vvvint32)
+			vvvint32, err = readLength(gr, "name length")
 			if err != nil {
 				return nil, err
 			}
-			byts := make([]byte, vvvint32)
-			_, err = io.ReadFull(gr, byts)
+			var byts []byte
+			byts, err = readBytes(gr, vvvint32)
 			if err != nil {
 				return nil, err
 			}
-			r.tiers[i][j] = string(byts)
+			tier = append(tier, string(byts))
 		}
+		r.tiers = append(r.tiers, tier)
 	}
-	err = binary.Read(gr, binary.BigEndian, &vint32)
+	vint32, err = readLength(gr, "number of nodes")
 	if err != nil {
 		return nil, err
 	}
-	r.nodes = make([]*node, vint32)
+	r.nodes = make([]*node, 0, allocLength(vint32))
 	for i := int32(0); i < vint32; i++ {
-		r.nodes[i] = &node{tierBase: &r.tierBase}
+		r.nodes = append(r.nodes, &node{tierBase: &r.tierBase})
 		err = binary.Read(gr, binary.BigEndian, &r.nodes[i].id)
 		if err != nil {
 			return nil, err
@@ -260,74 +358,142 @@ func LoadRing(rd io.Reader) (Ring, error) {
 		if tf == 1 {
 			r.nodes[i].inactive = true
 		}
-		err = binary.Read(gr, binary.BigEndian, &r.nodes[i].capacity)
-		if err != nil {
-			return nil, err
+		if v1 {
+			var capacity uint32
+			err = binary.Read(gr, binary.BigEndian, &capacity)
+			if err != nil {
+				return nil, err
+			}
+			r.nodes[i].capacity = uint64(capacity)
+		} else {
+			err = binary.Read(gr, binary.BigEndian, &r.nodes[i].capacity)
+			if err != nil {
+				return nil, err
+			}
 		}
 		var vvint32 int32
-		err = binary.Read(gr, binary.BigEndian, &vvint32)
+		vvint32, err = readLength(gr, "number of tier positions")
 		if err != nil {
 			return nil, err
 		}
-		r.nodes[i].tierIndexes = make([]int32, vvint32)
-		for j := int32(0); j < vvint32; j++ {
-			err = binary.Read(gr, binary.BigEndian, &r.nodes[i].tierIndexes[j])
-			if err != nil {
-				return nil, err
-			}
+		r.nodes[i].tierIndexes, err = readInt32s(gr, vvint32)
+		if err != nil {
+			return nil, err
 		}
-		err = binary.Read(gr, binary.BigEndian, &vvint32)
+		vvint32, err = readLength(gr, "number of addresses")
 		if err != nil {
 			return nil, err
 		}
-		r.nodes[i].addresses = make([]string, vvint32)
+		r.nodes[i].addresses = make([]string, 0, allocLength(vvint32))
 		for j := int32(0); j < vvint32; j++ {
 			var vvvint32 int32
-			err = binary.Read(gr, binary.BigEndian, &vvvint32)
+			vvvint32, err = readLength(gr, "address length")
 			if err != nil {
 				return nil, err
 			}
-			byts := make([]byte, vvvint32)
-			_, err = io.ReadFull(gr, byts)
+			var byts []byte
+			byts, err = readBytes(gr, vvvint32)
 			if err != nil {
 				return nil, err
 			}
-			r.nodes[i].addresses[j] = string(byts)
+			r.nodes[i].addresses = append(r.nodes[i].addresses, string(byts))
 		}
-		err = binary.Read(gr, binary.BigEndian, &vvint32)
+		vvint32, err = readLength(gr, "meta length")
 		if err != nil {
 			return nil, err
 		}
-		byts := make([]byte, vvint32)
-		_, err = io.ReadFull(gr, byts)
+		var byts []byte
+		byts, err = readBytes(gr, vvint32)
 		if err != nil {
 			return nil, err
 		}
 		r.nodes[i].meta = string(byts)
 		var cbytes int32
-		err = binary.Read(gr, binary.BigEndian, &cbytes)
+		cbytes, err = readLength(gr, "config length")
+		if err != nil {
+			return nil, err
+		}
+		r.nodes[i].config, err = readBytes(gr, cbytes)
+		if err != nil {
+			return nil, err
+		}
+		if v1 {
+			continue
+		}
+		vvint32, err = readLength(gr, "network zone length")
 		if err != nil {
 			return nil, err
 		}
-		r.nodes[i].config = make([]byte, cbytes)
-		_, err = io.ReadFull(gr, r.nodes[i].config)
+		byts, err = readBytes(gr, vvint32)
 		if err != nil {
 			return nil, err
 		}
+		r.nodes[i].networkZone = string(byts)
+	}
+	if _, err = sumCapacity(r.nodes); err != nil {
+		return nil, err
 	}
-	err = binary.Read(gr, binary.BigEndian, &vint32)
+	vint32, err = readLength(gr, "number of replicas")
 	if err != nil {
 		return nil, err
 	}
-	r.replicaToPartitionToNodeIndex = make([][]int32, vint32)
+	r.replicaToPartitionToNodeIndex = make([][]int32, 0, allocLength(vint32))
 	for i := int32(0); i < vint32; i++ {
 		var vvint32 int32
 		err = binary.Read(gr, binary.BigEndian, &vvint32)
 		if err != nil {
 			return nil, err
 		}
-		r.replicaToPartitionToNodeIndex[i] = make([]int32, vvint32)
-		err = binary.Read(gr, binary.BigEndian, r.replicaToPartitionToNodeIndex[i])
+		if err = checkPartitionCount(vvint32, r.partitionBitCount); err != nil {
+			return nil, err
+		}
+		var partitionToNodeIndex []int32
+		partitionToNodeIndex, err = readInt32s(gr, vvint32)
+		if err != nil {
+			return nil, err
+		}
+		r.replicaToPartitionToNodeIndex = append(r.replicaToPartitionToNodeIndex, partitionToNodeIndex)
+	}
+	if v1 {
+		err = readToGzipEnd(gr)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+	vint32, err = readLength(gr, "number of address roles")
+	if err != nil {
+		return nil, err
+	}
+	r.addressRoles = make([]string, 0, allocLength(vint32))
+	for i := int32(0); i < vint32; i++ {
+		var vvint32 int32
+		vvint32, err = readLength(gr, "address role length")
+		if err != nil {
+			return nil, err
+		}
+		var byts []byte
+		byts, err = readBytes(gr, vvint32)
+		if err != nil {
+			return nil, err
+		}
+		r.addressRoles = append(r.addressRoles, string(byts))
+	}
+	r.partitionModes, err = readPartitionModes(gr)
+	if err != nil {
+		return nil, err
+	}
+	r.usableCapacities, err = readUsableCapacities(gr, len(r.nodes))
+	if err != nil {
+		return nil, err
+	}
+	r.keyHasherName, r.keyHasher, err = readKeyHasher(gr)
+	if err != nil {
+		return nil, err
+	}
+	err = readToGzipEnd(gr)
+	if err != nil {
+		return nil, err
 	}
 	return r, nil
 }
@@ -476,6 +642,18 @@ func (r *ring) Persist(w io.Writer) error {
 		if err != nil {
 			return err
 		}
+		byts = []byte(n.networkZone)
+		if len(byts) > math.MaxInt32 {
+			return fmt.Errorf("%d network zone length is too large; max is %d", len(byts), math.MaxInt32)
+		}
+		err = binary.Write(gw, binary.BigEndian, int32(len(byts)))
+		if err != nil {
+			return err
+		}
+		_, err = gw.Write(byts)
+		if err != nil {
+			return err
+		}
 
 	}
 	if len(r.replicaToPartitionToNodeIndex) > math.MaxInt32 {
@@ -498,7 +676,36 @@ func (r *ring) Persist(w io.Writer) error {
 			return err
 		}
 	}
-	return nil
+	if len(r.addressRoles) > math.MaxInt32 {
+		return fmt.Errorf("%d address roles is too large; max is %d", len(r.addressRoles), math.MaxInt32)
+	}
+	err = binary.Write(gw, binary.BigEndian, int32(len(r.addressRoles)))
+	if err != nil {
+		return err
+	}
+	for _, role := range r.addressRoles {
+		byts := []byte(role)
+		if len(byts) > math.MaxInt32 {
+			return fmt.Errorf("%d address role length is too large; max is %d", len(byts), math.MaxInt32)
+		}
+		err = binary.Write(gw, binary.BigEndian, int32(len(byts)))
+		if err != nil {
+			return err
+		}
+		_, err = gw.Write(byts)
+		if err != nil {
+			return err
+		}
+	}
+	err = writePartitionModes(gw, r.partitionModes)
+	if err != nil {
+		return err
+	}
+	err = r.writeUsableCapacities(gw)
+	if err != nil {
+		return err
+	}
+	return writeKeyHasher(gw, r.keyHasherName)
 }
 
 func (r *ring) Version() int64 {
@@ -509,6 +716,21 @@ func (r *ring) Config() []byte {
 	return r.config
 }
 
+func (r *ring) AddressRoles() []string {
+	rv := make([]string, len(r.addressRoles))
+	copy(rv, r.addressRoles)
+	return rv
+}
+
+func (r *ring) AddressIndex(role string) int {
+	for i, v := range r.addressRoles {
+		if v == role {
+			return i
+		}
+	}
+	return -1
+}
+
 func (r *ring) PartitionBitCount() uint16 {
 	return r.partitionBitCount
 }
@@ -564,7 +786,22 @@ func (r *ring) SetLocalNode(id uint64) {
 	}
 }
 
-func (r *ring) Responsible(partition uint32) bool {
+func (r *ring) PartitionForKey(key []byte) Partition {
+	hasher := r.keyHasher
+	if hasher == nil {
+		hasher = FNV1aKeyHasher
+	}
+	return PartitionFromKey(hasher(key), r.partitionBitCount)
+}
+
+func (r *ring) KeyHasher() string {
+	if r.keyHasherName == "" {
+		return DefaultKeyHasher
+	}
+	return r.keyHasherName
+}
+
+func (r *ring) Responsible(partition Partition) bool {
 	if r.localNodeIndex == -1 {
 		return false
 	}
@@ -576,7 +813,7 @@ func (r *ring) Responsible(partition uint32) bool {
 	return false
 }
 
-func (r *ring) ResponsibleReplica(partition uint32) int {
+func (r *ring) ResponsibleReplica(partition Partition) int {
 	if r.localNodeIndex == -1 {
 		return -1
 	}
@@ -588,10 +825,64 @@ func (r *ring) ResponsibleReplica(partition uint32) int {
 	return -1
 }
 
-func (r *ring) ResponsibleNodes(partition uint32) NodeSlice {
-	nodes := make(NodeSlice, r.ReplicaCount())
+func (r *ring) ResponsibleNodes(partition Partition) NodeSlice {
+	var substitutes NodeSlice
+	if unassigned := r.UnassignedReplicas(partition); unassigned > 0 {
+		substitutes = r.HandoffNodes(partition, unassigned, HandoffDeterministic)
+	}
+	nodes := make(NodeSlice, 0, r.ReplicaCount())
+	for _, partitionToNodeIndex := range r.replicaToPartitionToNodeIndex {
+		nodeIndex := partitionToNodeIndex[partition]
+		if nodeIndex >= 0 {
+			nodes = append(nodes, r.nodes[nodeIndex])
+		} else if len(substitutes) > 0 {
+			nodes = append(nodes, substitutes[0])
+			substitutes = substitutes[1:]
+		}
+	}
+	return nodes
+}
+
+func (r *ring) AssignmentSnapshot() [][]int32 {
+	snapshot := make([][]int32, len(r.replicaToPartitionToNodeIndex))
 	for replica, partitionToNodeIndex := range r.replicaToPartitionToNodeIndex {
-		nodes[replica] = r.nodes[partitionToNodeIndex[partition]]
+		snapshot[replica] = make([]int32, len(partitionToNodeIndex))
+		copy(snapshot[replica], partitionToNodeIndex)
+	}
+	return snapshot
+}
+
+func (r *ring) UnassignedReplicas(partition Partition) int {
+	unassigned := 0
+	for _, partitionToNodeIndex := range r.replicaToPartitionToNodeIndex {
+		if partitionToNodeIndex[partition] < 0 {
+			unassigned++
+		}
+	}
+	return unassigned
+}
+
+func (r *ring) PreferredReplicas(partition Partition, locality func(n Node) int) NodeSlice {
+	nodes := r.ResponsibleNodes(partition)
+	if locality == nil {
+		localNode := r.LocalNode()
+		if localNode == nil {
+			return nodes
+		}
+		locality = func(n Node) int {
+			return TierDistance(localNode, n)
+		}
+	}
+	scores := make([]int, len(nodes))
+	for i, n := range nodes {
+		scores[i] = locality(n)
+	}
+	// Insertion sort is stable and the replica count is small.
+	for i := 1; i < len(nodes); i++ {
+		for j := i; j > 0 && scores[j] < scores[j-1]; j-- {
+			scores[j], scores[j-1] = scores[j-1], scores[j]
+			nodes[j], nodes[j-1] = nodes[j-1], nodes[j]
+		}
 	}
 	return nodes
 }
@@ -612,8 +903,92 @@ type Stats struct {
 	MaxUnderNodeID         uint64
 	// MaxOverNodePercentage is the percentage a node is overweight, or has
 	// more data assigned to it than its capacity would indicate it desires.
+	// Nodes with no usable capacity, such as those draining, are left out of
+	// both maximums.
 	MaxOverNodePercentage float64
 	MaxOverNodeID         uint64
+	// UnassignedCount is the number of partition replicas not assigned to
+	// any node; see Ring.ResponsibleNodes.
+	UnassignedCount int
+	// NodeStats gives the assignment details of every node, in the same
+	// order as Ring.Nodes, so the whole distribution can be monitored
+	// rather than just the extremes above.
+	NodeStats []*NodeStats
+}
+
+// NodeStats gives the partition replica assignment details of a single node;
+// see Stats.
+type NodeStats struct {
+	NodeID   uint64
+	Active   bool
+	Capacity uint64
+	// AssignedCount is the number of partition replicas assigned to the node.
+	AssignedCount int
+	// DesiredCount is the number of partition replicas the node's capacity,
+	// less any capacity reserve of the Builder the ring came from, would
+	// indicate it desires; it is 0 for inactive nodes.
+	DesiredCount float64
+	// Percentage is how overweight (positive) or underweight (negative) the
+	// node is; it is 0 for inactive nodes.
+	Percentage float64
+}
+
+func (r *ring) HandoffNodes(partition Partition, count int, mode HandoffMode) NodeSlice {
+	responsible := make(map[int32]bool, len(r.replicaToPartitionToNodeIndex))
+	for _, partitionToNodeIndex := range r.replicaToPartitionToNodeIndex {
+		responsible[partitionToNodeIndex[partition]] = true
+	}
+	var nodes NodeSlice
+	var keys []float64
+	for i, n := range r.nodes {
+		if n.inactive || n.capacity == 0 || responsible[int32(i)] {
+			continue
+		}
+		// Weighted sampling without replacement: each node's key is u^(1/w)
+		// with u uniform in (0, 1) and w the capacity; the highest keys win.
+		// The deterministic mode derives u from the partition and node ID,
+		// which is rendezvous hashing.
+		var u float64
+		if mode == HandoffWeightedRandom {
+			u = rand.Float64()
+		} else {
+			u = float64(mix64(uint64(partition)<<32^n.id^0x9e3779b97f4a7c15)>>11) / (1 << 53)
+		}
+		if u == 0 {
+			u = math.SmallestNonzeroFloat64
+		}
+		key := math.Log(u) / float64(n.capacity)
+		// Insertion sort, highest key first, keeping only count entries.
+		j := len(nodes)
+		for j > 0 && keys[j-1] < key {
+			j--
+		}
+		if j >= count {
+			continue
+		}
+		nodes = append(nodes, nil)
+		keys = append(keys, 0)
+		copy(nodes[j+1:], nodes[j:])
+		copy(keys[j+1:], keys[j:])
+		nodes[j] = n
+		keys[j] = key
+		if len(nodes) > count {
+			nodes = nodes[:count]
+			keys = keys[:count]
+		}
+	}
+	return nodes
+}
+
+// mix64 is the splitmix64 finalizer; a fast, well distributed, and platform
+// independent hash of a uint64.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
 }
 
 func (r *ring) Stats() *Stats {
@@ -627,24 +1002,56 @@ func (r *ring) Stats() *Stats {
 	nodeIndexToPartitionCount := make([]int, len(r.nodes))
 	for _, partitionToNodeIndex := range r.replicaToPartitionToNodeIndex {
 		for _, nodeIndex := range partitionToNodeIndex {
+			if nodeIndex < 0 {
+				stats.UnassignedCount++
+				continue
+			}
 			nodeIndexToPartitionCount[nodeIndex]++
 		}
 	}
 	for _, n := range r.nodes {
 		if n.inactive {
 			stats.InactiveNodeCount++
-			stats.InactiveCapacity += uint64(n.capacity)
+			stats.InactiveCapacity += n.capacity
 		} else {
 			stats.ActiveNodeCount++
-			stats.ActiveCapacity += uint64(n.capacity)
+			stats.ActiveCapacity += n.capacity
+		}
+	}
+	// Desires are by usable capacity, after any capacity reserves.
+	usableCapacity := uint64(0)
+	for nodeIndex, n := range r.nodes {
+		if !n.inactive {
+			usableCapacity += r.usableCapacity(nodeIndex)
 		}
 	}
+	stats.NodeStats = make([]*NodeStats, len(r.nodes))
 	for nodeIndex, n := range r.nodes {
+		ns := &NodeStats{
+			NodeID:        n.id,
+			Active:        !n.inactive,
+			Capacity:      n.capacity,
+			AssignedCount: nodeIndexToPartitionCount[nodeIndex],
+		}
+		stats.NodeStats[nodeIndex] = ns
 		if n.inactive {
 			continue
 		}
-		desiredPartitionCount := float64(n.capacity) / float64(stats.ActiveCapacity) * float64(stats.PartitionCount) * float64(stats.ReplicaCount)
+		whole, rem := desiredAssignments(r.usableCapacity(nodeIndex), usableCapacity, uint64(stats.PartitionCount)*uint64(stats.ReplicaCount))
+		desiredPartitionCount := float64(whole)
+		if rem > 0 {
+			desiredPartitionCount += float64(rem) / float64(usableCapacity)
+		}
 		actualPartitionCount := float64(nodeIndexToPartitionCount[nodeIndex])
+		ns.DesiredCount = desiredPartitionCount
+		if desiredPartitionCount > 0 {
+			ns.Percentage = 100.0 * (actualPartitionCount - desiredPartitionCount) / desiredPartitionCount
+		}
+		// Nodes with no usable capacity, such as those draining, desire
+		// nothing and are not weighed; the drain stats give their progress.
+		if r.usableCapacity(nodeIndex) == 0 {
+			continue
+		}
 		if desiredPartitionCount > actualPartitionCount {
 			under := 100.0 * (desiredPartitionCount - actualPartitionCount) / desiredPartitionCount
 			if under > stats.MaxUnderNodePercentage {
@@ -0,0 +1,185 @@
+package ring
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// RingHealthConfig represents the set of thresholds a Ring must meet for
+// RingHealth to judge it safe to publish.
+type RingHealthConfig struct {
+	// MaxImbalance indicates how many percentage points over or under weight
+	// any active node may be. Defaults to 5.
+	MaxImbalance int
+	// Dispersion indicates how distinct the replicas of each partition
+	// should be, with the same meaning as the levels of
+	// Builder.SetStrictDispersion: 0, the default, means on distinct nodes,
+	// 1 also distinct tier level 0 values, and so on; -1 disables the check.
+	// Replicas need only be as distinct as the active nodes allow, so a
+	// cluster with fewer nodes or tier values than replicas can still meet
+	// it, as with BuilderStats.DispersionViolations.
+	Dispersion int
+	// MaxUndispersed indicates the percentage of partitions that may fall
+	// short of the Dispersion. Defaults to 0.
+	MaxUndispersed int
+	// MaxUnassigned indicates how many partition replicas may be unassigned;
+	// see Ring.UnassignedReplicas. Defaults to 0.
+	MaxUnassigned int
+	// MaxInactiveExposure indicates the percentage of partition replicas
+	// that may still be assigned to inactive nodes. Defaults to 0.
+	MaxInactiveExposure int
+}
+
+func resolveRingHealthConfig(c *RingHealthConfig) *RingHealthConfig {
+	cfg := &RingHealthConfig{}
+	if c != nil {
+		*cfg = *c
+	}
+	if cfg.MaxImbalance < 1 {
+		cfg.MaxImbalance = 5
+	}
+	if cfg.Dispersion < -1 {
+		cfg.Dispersion = -1
+	}
+	if cfg.MaxUndispersed < 0 {
+		cfg.MaxUndispersed = 0
+	}
+	if cfg.MaxUnassigned < 0 {
+		cfg.MaxUnassigned = 0
+	}
+	if cfg.MaxInactiveExposure < 0 {
+		cfg.MaxInactiveExposure = 0
+	}
+	return cfg
+}
+
+// RingHealthReport is the outcome of RingHealth.
+type RingHealthReport struct {
+	RingVersion int64
+	// Score rates the ring from 0 to 100, 100 being perfectly balanced,
+	// dispersed, and assigned to active nodes only; the four aspects weigh
+	// equally. It is for trending and dashboards; Safe is the verdict.
+	Score float64
+	// Safe is true if the ring meets every threshold of the configuration.
+	Safe bool
+	// Imbalance is the most percentage points any active node is over or
+	// under weight; see Stats.MaxOverNodePercentage.
+	Imbalance float64
+	// UndispersedPartitions is how many partitions fall short of the
+	// configured Dispersion, and UndispersedPercentage that as a percentage
+	// of all partitions.
+	UndispersedPartitions int
+	UndispersedPercentage float64
+	// UnassignedReplicas is how many partition replicas are unassigned.
+	UnassignedReplicas int
+	// InactiveReplicas is how many partition replicas are assigned to
+	// inactive nodes, and InactivePercentage that as a percentage of all
+	// partition replicas.
+	InactiveReplicas   int
+	InactivePercentage float64
+	// Problems describes each threshold not met.
+	Problems []string
+}
+
+// RingHealth scores the Ring and judges whether it is safe to publish,
+// combining its balance, the dispersion of its replicas, its unassigned
+// replicas, and its exposure to inactive nodes; such as for a pipeline rolling
+// out ring changes automatically to gate on. Dispersion is judged from the
+// ring's node tiers alone; the tier correlations of its Builder are not
+// known to the Ring, see Builder.SetStrictDispersion for those.
+func RingHealth(r Ring, c *RingHealthConfig) *RingHealthReport {
+	cfg := resolveRingHealthConfig(c)
+	stats := r.Stats()
+	report := &RingHealthReport{
+		RingVersion:        r.Version(),
+		Imbalance:          math.Max(stats.MaxOverNodePercentage, stats.MaxUnderNodePercentage),
+		UnassignedReplicas: stats.UnassignedCount,
+	}
+	for _, ns := range stats.NodeStats {
+		if !ns.Active {
+			report.InactiveReplicas += ns.AssignedCount
+		}
+	}
+	replicas := stats.PartitionCount * stats.ReplicaCount
+	if replicas > 0 {
+		report.InactivePercentage = float64(report.InactiveReplicas) * 100 / float64(replicas)
+	}
+	if cfg.Dispersion >= 0 {
+		report.UndispersedPartitions = undispersedPartitions(r, cfg.Dispersion)
+		if stats.PartitionCount > 0 {
+			report.UndispersedPercentage = float64(report.UndispersedPartitions) * 100 / float64(stats.PartitionCount)
+		}
+	}
+	var unassignedPercentage float64
+	if replicas > 0 {
+		unassignedPercentage = float64(report.UnassignedReplicas) * 100 / float64(replicas)
+	}
+	report.Score = 100 - healthPenalty(report.Imbalance) - healthPenalty(report.UndispersedPercentage) - healthPenalty(unassignedPercentage) - healthPenalty(report.InactivePercentage)
+	if report.Imbalance > float64(cfg.MaxImbalance) {
+		report.Problems = append(report.Problems, fmt.Sprintf("imbalance of %.02f%% exceeds %d%%", report.Imbalance, cfg.MaxImbalance))
+	}
+	if report.UndispersedPercentage > float64(cfg.MaxUndispersed) {
+		report.Problems = append(report.Problems, fmt.Sprintf("%d partitions (%.02f%%) do not meet dispersion %d; %d%% allowed", report.UndispersedPartitions, report.UndispersedPercentage, cfg.Dispersion, cfg.MaxUndispersed))
+	}
+	if report.UnassignedReplicas > cfg.MaxUnassigned {
+		report.Problems = append(report.Problems, fmt.Sprintf("%d unassigned replicas; %d allowed", report.UnassignedReplicas, cfg.MaxUnassigned))
+	}
+	if report.InactivePercentage > float64(cfg.MaxInactiveExposure) {
+		report.Problems = append(report.Problems, fmt.Sprintf("%d replicas (%.02f%%) on inactive nodes; %d%% allowed", report.InactiveReplicas, report.InactivePercentage, cfg.MaxInactiveExposure))
+	}
+	report.Safe = len(report.Problems) == 0
+	return report
+}
+
+// healthPenalty returns the score lost to an aspect at the percentage given,
+// up to a quarter of the score.
+func healthPenalty(percentage float64) float64 {
+	return 25 * math.Min(percentage, 100) / 100
+}
+
+// undispersedPartitions returns how many partitions have replicas less
+// dispersed than the dispersion level requires and the active nodes allow;
+// see dispersionDomains.undispersed. Replicas standing in for unassigned ones
+// count as ResponsibleNodes gives them.
+func undispersedPartitions(r Ring, dispersion int) int {
+	nodes := r.Nodes()
+	levels := 1
+	for _, n := range nodes {
+		if len(n.Tiers())+1 > levels {
+			levels = len(n.Tiers()) + 1
+		}
+	}
+	d := newDispersionDomains(levels, len(nodes))
+	idToNodeIndex := make(map[uint64]int32, len(nodes))
+	for nodeIndex, n := range nodes {
+		idToNodeIndex[n.ID()] = int32(nodeIndex)
+		available := n.Active() && n.Capacity() > 0
+		d.set(0, nodeIndex, n.ID(), available)
+		for tier := 0; tier < levels-1; tier++ {
+			// Values at a tier level are only distinct if the values at all
+			// the higher levels are too, as the rebalancer separates tiers.
+			values := make([]string, levels-1-tier)
+			for i := range values {
+				values[i] = n.Tier(tier + i)
+			}
+			d.set(tier+1, nodeIndex, strings.Join(values, "\x00"), available)
+		}
+	}
+	count := 0
+	partitionCount := PartitionCount(r.PartitionBitCount())
+	var nodeIndexes []int32
+	for partition := 0; partition < partitionCount; partition++ {
+		nodeIndexes = nodeIndexes[:0]
+		for _, n := range r.ResponsibleNodes(Partition(partition)) {
+			nodeIndexes = append(nodeIndexes, idToNodeIndex[n.ID()])
+		}
+		for level := 0; level <= dispersion; level++ {
+			if d.undispersed(level, nodeIndexes) {
+				count++
+				break
+			}
+		}
+	}
+	return count
+}
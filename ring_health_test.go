@@ -0,0 +1,67 @@
+package ring
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRingHealth(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetMaxPartitionBitCount(8)
+	b.SetReplicaCount(3)
+	var ids []uint64
+	for i := 0; i < 6; i++ {
+		n, err := b.AddNode(true, 1, []string{fmt.Sprintf("server%d", i), fmt.Sprintf("zone%d", i%3)}, nil, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, n.ID())
+	}
+	h := RingHealth(b.Ring(), &RingHealthConfig{Dispersion: 2})
+	if !h.Safe || h.Score < 99 || h.UndispersedPartitions != 0 || h.InactiveReplicas != 0 {
+		t.Fatalf("%#v", h)
+	}
+	// Without rebalancing, a deactivated node keeps its replicas and a new
+	// node gets none.
+	b.SetRebalanceTrigger(RebalanceNever)
+	b.Node(ids[0]).SetActive(false)
+	if _, err := b.AddNode(true, 1, []string{"server6", "zone0"}, nil, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	h = RingHealth(b.Ring(), nil)
+	if h.Safe || len(h.Problems) != 2 || h.Imbalance != 100 || h.InactiveReplicas == 0 {
+		t.Fatalf("%#v", h)
+	}
+	if h.Score >= 75 {
+		t.Fatal(h.Score)
+	}
+	if h = RingHealth(b.Ring(), &RingHealthConfig{MaxImbalance: 100, MaxInactiveExposure: 100}); !h.Safe {
+		t.Fatalf("%#v", h)
+	}
+	// Two nodes in one zone are as dispersed as three replicas can be.
+	b = NewBuilder(64)
+	b.SetMaxPartitionBitCount(8)
+	b.SetReplicaCount(3)
+	for i := 0; i < 2; i++ {
+		if _, err := b.AddNode(true, 1, []string{fmt.Sprintf("server%d", i), "zone0"}, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := b.Ring()
+	if h = RingHealth(r, &RingHealthConfig{Dispersion: 2}); !h.Safe || h.UndispersedPartitions != 0 {
+		t.Fatalf("%#v", h)
+	}
+	// But not with all the replicas of a partition on one of them.
+	b.SetRebalanceTrigger(RebalanceNever)
+	for replica := range b.replicaToPartitionToNodeIndex {
+		b.replicaToPartitionToNodeIndex[replica][0] = 0
+	}
+	r = b.Ring()
+	h = RingHealth(r, &RingHealthConfig{MaxImbalance: 100})
+	if h.Safe || h.UndispersedPartitions != 1 || h.UndispersedPercentage != 100/float64(PartitionCount(r.PartitionBitCount())) {
+		t.Fatalf("%#v", h)
+	}
+	if h = RingHealth(r, &RingHealthConfig{MaxImbalance: 100, Dispersion: -1}); !h.Safe {
+		t.Fatalf("%#v", h)
+	}
+}
@@ -0,0 +1,59 @@
+package ring
+
+// retainedRing is a previous ring kept by TCPMsgRing.SetRing, along with the
+// index to use with Node.Address for that ring.
+type retainedRing struct {
+	ring         Ring
+	addressIndex int
+}
+
+// formerRing returns the retained previous ring with the version given, and
+// the index to use with Node.Address for it, or nil if no such ring is
+// retained.
+func (t *TCPMsgRing) formerRing(version int64) (Ring, int) {
+	t.ringLock.RLock()
+	defer t.ringLock.RUnlock()
+	for _, r := range t.previousRings {
+		if r.ring.Version() == version {
+			return r.ring, r.addressIndex
+		}
+	}
+	return nil, 0
+}
+
+// ringOfVersion returns the current ring, if it has the version given, or
+// else the retained previous ring with the version, and the index to use with
+// Node.Address for it; or nil if there is no such ring.
+func (t *TCPMsgRing) ringOfVersion(version int64) (Ring, int) {
+	ring, addressIndex := t.ringAndAddressIndex()
+	if ring != nil && ring.Version() == version {
+		return ring, addressIndex
+	}
+	return t.formerRing(version)
+}
+
+// RingOfVersion returns the current ring, if it has the version given, or
+// else the previous ring with the version if SetRing has retained it; see
+// TCPMsgRingConfig.RetainedRings. It returns nil if there is no such ring.
+// This lets a message stamped with the ring version it was sent under be
+// handled according to that ring during the window while a new ring
+// propagates, rather than dropped on the version mismatch.
+func (t *TCPMsgRing) RingOfVersion(version int64) Ring {
+	ring, _ := t.ringOfVersion(version)
+	return ring
+}
+
+// RingVersions returns the versions of the current ring, if any, followed by
+// those of the retained previous rings, most recent first.
+func (t *TCPMsgRing) RingVersions() []int64 {
+	t.ringLock.RLock()
+	var versions []int64
+	if t.ring != nil {
+		versions = append(versions, t.ring.Version())
+	}
+	for _, r := range t.previousRings {
+		versions = append(versions, r.ring.Version())
+	}
+	t.ringLock.RUnlock()
+	return versions
+}
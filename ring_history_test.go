@@ -0,0 +1,69 @@
+package ring
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTCPMsgRingRetainedRings(t *testing.T) {
+	msgring, _ := NewTCPMsgRing(&TCPMsgRingConfig{RetainedRings: 2})
+	defer msgring.Shutdown()
+	b := NewBuilder(64)
+	b.SetReplicaCount(2)
+	// Each ring gets a later version from this clock, however coarse the
+	// system clock is.
+	now := time.Now()
+	b.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	nA, err := b.AddNode(true, 1, nil, []string{"127.0.0.2:1"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nB, err := b.AddNode(true, 1, nil, []string{"127.0.0.3:1"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rings []Ring
+	for i := 0; i < 4; i++ {
+		b.SetConfig([]byte{byte(i)})
+		r := b.Ring()
+		r.SetLocalNode(nA.ID())
+		msgring.SetRing(r)
+		rings = append(rings, r)
+		if i == 1 {
+			b.RemoveNode(nB.ID())
+			if _, err = b.AddNode(true, 1, nil, []string{"127.0.0.4:1"}, "", nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	versions := msgring.RingVersions()
+	if len(versions) != 3 || versions[0] != rings[3].Version() || versions[1] != rings[2].Version() || versions[2] != rings[1].Version() {
+		t.Fatal(versions)
+	}
+	if msgring.RingOfVersion(rings[0].Version()) != nil {
+		t.Fatal("oldest ring should no longer be retained")
+	}
+	if msgring.RingOfVersion(rings[1].Version()) != rings[1] {
+		t.Fatal("ring should be retained")
+	}
+	// Created ahead of time so no connections are attempted.
+	formerChan, _ := msgring.msgChanForAddr("127.0.0.3:1")
+	currentChan, _ := msgring.msgChanForAddr("127.0.0.4:1")
+	m := newTestMsg()
+	msgring.MsgToOtherReplicasOfVersion(m, rings[1].Version(), 0, time.Second)
+	(<-formerChan).Free()
+	<-m.done
+	m = newTestMsg()
+	msgring.MsgToOtherReplicasOfVersion(m, rings[3].Version(), 0, time.Second)
+	(<-currentChan).Free()
+	<-m.done
+	m = newTestMsg()
+	msgring.MsgToOtherReplicasOfVersion(m, rings[0].Version(), 0, time.Second)
+	<-m.done
+	if s := msgring.Stats(false); s.MsgToOtherReplicas != 3 || s.MsgToOtherReplicasNoRings != 1 {
+		t.Fatalf("%d %d", s.MsgToOtherReplicas, s.MsgToOtherReplicasNoRings)
+	}
+}
@@ -0,0 +1,132 @@
+package ring
+
+import (
+	"sync"
+	"time"
+)
+
+// Lookup is the answer to which nodes are responsible for a partition, taken
+// from a single Ring so the version, partition, and nodes always belong
+// together. Code that looks up nodes and then stamps messages with a ring
+// version should use a Lookup rather than separate calls, which can each
+// see a different ring should it be replaced in between.
+type Lookup struct {
+	// Version is the version of the Ring the lookup was made with.
+	Version int64
+	// Partition is the partition, as numbered by that Ring.
+	Partition Partition
+	// Nodes are the nodes responsible for the partition, as given by
+	// Ring.ResponsibleNodes.
+	Nodes NodeSlice
+	// LocalReplica is the replica index assigned to the Ring's local node,
+	// or -1 if the local node is not responsible or not set.
+	LocalReplica int
+}
+
+// NewLookup returns the Lookup of the partition in the Ring given. As with
+// Ring.ResponsibleNodes, the partition is not bounds checked.
+func NewLookup(r Ring, partition Partition) *Lookup {
+	return &Lookup{
+		Version:      r.Version(),
+		Partition:    partition,
+		Nodes:        r.ResponsibleNodes(partition),
+		LocalReplica: r.ResponsibleReplica(partition),
+	}
+}
+
+// LookupKey returns the Lookup of the partition the key hash belongs to in the
+// Ring given; the partition is derived from the same Ring's partition bit
+// count.
+func LookupKey(r Ring, keyHash uint64) *Lookup {
+	return NewLookup(r, PartitionFromKey(keyHash, r.PartitionBitCount()))
+}
+
+// Lookup returns the Lookup of the partition in the current ring, or nil if
+// there is no ring yet or the partition is beyond its partition count.
+func (t *TCPMsgRing) Lookup(partition Partition) *Lookup {
+	r := t.Ring()
+	if r == nil || partition >= Partition(1)<<r.PartitionBitCount() {
+		return nil
+	}
+	return NewLookup(r, partition)
+}
+
+// LookupKey returns the Lookup of the partition the key hash belongs to in the
+// current ring, or nil if there is no ring yet.
+func (t *TCPMsgRing) LookupKey(keyHash uint64) *Lookup {
+	r := t.Ring()
+	if r == nil {
+		return nil
+	}
+	return LookupKey(r, keyHash)
+}
+
+// MsgToLookup queues the message for delivery to the nodes of the Lookup
+// other than the local node. It is MsgToOtherReplicasOfVersion with the
+// Lookup's version and partition, so the message goes to the nodes the
+// Lookup named even if the ring has since been replaced, provided that ring
+// is still retained; see TCPMsgRingConfig.RetainedRings.
+//
+// When the msg has actually been sent or has been discarded due to delivery
+// errors or delays, msg.Free() will be called.
+func (t *TCPMsgRing) MsgToLookup(msg Msg, l *Lookup, timeout time.Duration) {
+	t.MsgToOtherReplicasOfVersion(msg, l.Version, l.Partition, timeout)
+}
+
+// AppendKeyNodes appends the nodes responsible for the partition the key hash
+// belongs to in the Ring given, returning the extended slice; the nodes are
+// the same as with r.ResponsibleNodes(PartitionFromKey(keyHash,
+// r.PartitionBitCount())).
+//
+// This is the fast path for the lookup done on every request. For Rings made
+// by a Builder or LoadRing, the partition is the key hash shifted by a
+// precomputed amount, with no branch for a zero partition bit count, and the
+// node indexes of each partition's replicas are read from one contiguous
+// table rather than one table per replica; with a dst of enough capacity,
+// nothing is allocated. The table is built on first use and is as large as
+// the Ring's assignments, partition count times replica count times 4 bytes.
+// Partitions with unassigned replicas take the slower ResponsibleNodes path.
+// See the Lookup benchmarks and testdata/lookup_benchmarks.txt for the
+// baseline this path is held to.
+func AppendKeyNodes(dst NodeSlice, r Ring, keyHash uint64) NodeSlice {
+	if rr, ok := r.(*ring); ok {
+		return rr.appendKeyNodes(dst, keyHash)
+	}
+	return append(dst, r.ResponsibleNodes(PartitionFromKey(keyHash, r.PartitionBitCount()))...)
+}
+
+// keyLookupTable is the ring's assignments laid out for AppendKeyNodes.
+type keyLookupTable struct {
+	once sync.Once
+	// shift is what the key hash is shifted right by to give its partition;
+	// Go defines a shift of 64 as giving 0, the only partition when there
+	// are no partition bits.
+	shift    uint
+	replicas int
+	// nodeIndexes holds the node index of each replica of each partition, in
+	// partition then replica order.
+	nodeIndexes []int32
+}
+
+func (r *ring) appendKeyNodes(dst NodeSlice, keyHash uint64) NodeSlice {
+	t := &r.keyLookup
+	t.once.Do(func() {
+		t.shift = uint(64 - r.partitionBitCount)
+		t.replicas = len(r.replicaToPartitionToNodeIndex)
+		t.nodeIndexes = make([]int32, t.replicas<<r.partitionBitCount)
+		for replica, partitionToNodeIndex := range r.replicaToPartitionToNodeIndex {
+			for partition, nodeIndex := range partitionToNodeIndex {
+				t.nodeIndexes[partition*t.replicas+replica] = nodeIndex
+			}
+		}
+	})
+	partition := int(keyHash >> t.shift)
+	start := len(dst)
+	for _, nodeIndex := range t.nodeIndexes[partition*t.replicas : (partition+1)*t.replicas] {
+		if nodeIndex < 0 {
+			return append(dst[:start], r.ResponsibleNodes(Partition(partition))...)
+		}
+		dst = append(dst, r.nodes[nodeIndex])
+	}
+	return dst
+}
@@ -0,0 +1,146 @@
+package ring
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLookup(t *testing.T) {
+	msgring, _ := NewTCPMsgRing(&TCPMsgRingConfig{RetainedRings: 1})
+	defer msgring.Shutdown()
+	if msgring.Lookup(0) != nil || msgring.LookupKey(0) != nil {
+		t.Fatal("lookup without a ring")
+	}
+	b := NewBuilder(64)
+	b.SetReplicaCount(2)
+	nA, err := b.AddNode(true, 1, nil, []string{"127.0.0.2:1"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nB, err := b.AddNode(true, 1, nil, []string{"127.0.0.3:1"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r1 := b.Ring()
+	r1.SetLocalNode(nA.ID())
+	msgring.SetRing(r1)
+	l := msgring.LookupKey(^uint64(0))
+	if l.Version != r1.Version() || l.Partition != Partition(1)<<r1.PartitionBitCount()-1 || len(l.Nodes) != 2 || l.LocalReplica < 0 {
+		t.Fatal(l)
+	}
+	if msgring.Lookup(Partition(1)<<r1.PartitionBitCount()) != nil {
+		t.Fatal("lookup beyond the partition count")
+	}
+	b.RemoveNode(nB.ID())
+	if _, err = b.AddNode(true, 1, nil, []string{"127.0.0.4:1"}, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	r2 := b.Ring()
+	r2.SetLocalNode(nA.ID())
+	msgring.SetRing(r2)
+	// The message goes to the node of the lookup, not of the current ring.
+	// The channels are created ahead of time so no connections are attempted.
+	formerChan, _ := msgring.msgChanForAddr("127.0.0.3:1")
+	m := newTestMsg()
+	msgring.MsgToLookup(m, l, time.Second)
+	(<-formerChan).Free()
+	<-m.done
+	l2 := NewLookup(r2, l.Partition)
+	if l2.Version != r2.Version() || len(l2.Nodes) != 2 {
+		t.Fatal(l2)
+	}
+	for _, n := range l2.Nodes {
+		if n.ID() == nB.ID() {
+			t.Fatal("removed node in lookup of new ring")
+		}
+	}
+}
+
+// newBenchmarkRing returns a ring of 3 replicas over 60 nodes in 3 zones, with
+// 16 partition bits, so its assignments do not all fit in the faster CPU
+// caches.
+func newBenchmarkRing(tb testing.TB) Ring {
+	b := NewBuilder(64)
+	b.SetReplicaCount(3)
+	b.SetPointsAllowed(0)
+	b.SetMaxPartitionBitCount(16)
+	for i := 0; i < 60; i++ {
+		if _, err := b.AddNode(true, uint64(100+i), []string{fmt.Sprintf("server%d", i), fmt.Sprintf("zone%d", i%3)}, nil, "", nil); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return b.Ring()
+}
+
+func TestAppendKeyNodes(t *testing.T) {
+	r := newBenchmarkRing(t)
+	rr := r.(*ring)
+	// One partition with an unassigned replica takes the slower path.
+	rr.replicaToPartitionToNodeIndex[1][5] = -1
+	shift := 64 - r.PartitionBitCount()
+	var nodes NodeSlice
+	for p := 0; p < PartitionCount(r.PartitionBitCount()); p++ {
+		keyHash := uint64(p)<<shift | uint64(p)
+		nodes = AppendKeyNodes(nodes[:0], r, keyHash)
+		// A Ring other than those of this package takes the general path.
+		other := AppendKeyNodes(nil, struct{ Ring }{r}, keyHash)
+		want := r.ResponsibleNodes(Partition(p))
+		if len(nodes) != len(want) || len(other) != len(want) {
+			t.Fatal(p, nodes, other, want)
+		}
+		for i := range want {
+			if nodes[i] != want[i] || other[i] != want[i] {
+				t.Fatal(p, i, nodes, other, want)
+			}
+		}
+	}
+	if allocs := testing.AllocsPerRun(100, func() { nodes = AppendKeyNodes(nodes[:0], r, 12345) }); allocs != 0 {
+		t.Fatal(allocs)
+	}
+	// A ring without partition bits has just partition 0.
+	n := &node{id: 1}
+	r = &ring{localNodeIndex: -1, nodes: []*node{n}, replicaToPartitionToNodeIndex: [][]int32{{0}}}
+	if nodes = AppendKeyNodes(nil, r, ^uint64(0)); len(nodes) != 1 || nodes[0] != n {
+		t.Fatal(nodes)
+	}
+}
+
+func BenchmarkPartitionFromKey(b *testing.B) {
+	r := newBenchmarkRing(b)
+	var p Partition
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p ^= PartitionFromKey(uint64(i)*0x9e3779b97f4a7c15, r.PartitionBitCount())
+	}
+}
+
+func BenchmarkResponsibleNodes(b *testing.B) {
+	r := newBenchmarkRing(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.ResponsibleNodes(PartitionFromKey(uint64(i)*0x9e3779b97f4a7c15, r.PartitionBitCount()))
+	}
+}
+
+func BenchmarkLookupKey(b *testing.B) {
+	r := newBenchmarkRing(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		LookupKey(r, uint64(i)*0x9e3779b97f4a7c15)
+	}
+}
+
+func BenchmarkAppendKeyNodes(b *testing.B) {
+	r := newBenchmarkRing(b)
+	nodes := make(NodeSlice, 0, r.ReplicaCount())
+	// Build the lookup table before timing.
+	AppendKeyNodes(nodes, r, 0)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		nodes = AppendKeyNodes(nodes[:0], r, uint64(i)*0x9e3779b97f4a7c15)
+	}
+}
@@ -0,0 +1,344 @@
+package ring
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RingPublishEvent is what a RingPublishNotifier reports, to its hooks and as
+// the JSON body of its webhook requests.
+type RingPublishEvent struct {
+	// Kind is RingPublished when a new ring version has been published, and
+	// RingPropagated or RingPropagationFailed once that version has, or has
+	// not, been acknowledged by the nodes, or RingPropagationSuperseded if a
+	// newer version was published before it was.
+	Kind        string `json:"kind"`
+	RingVersion int64  `json:"ring_version,string"`
+	// Acked and Missing are the IDs of the nodes that did and did not
+	// acknowledge the ring version, in ascending order, for the propagation
+	// events.
+	Acked   []string `json:"acked,omitempty"`
+	Missing []string `json:"missing,omitempty"`
+	// Error gives why propagation failed or was superseded.
+	Error string `json:"error,omitempty"`
+}
+
+// The kinds of RingPublishEvent.
+const (
+	RingPublished         = "published"
+	RingPropagated        = "propagated"
+	RingPropagationFailed = "propagation_failed"
+	// RingPropagationSuperseded ends the wait for a ring version to
+	// propagate when a newer version is published; the newer version's
+	// propagation covers the older too, as nodes acknowledge a version once
+	// at it or a later one.
+	RingPropagationSuperseded = "propagation_superseded"
+)
+
+// RingPublishNotifierConfig represents the set of values for configuring a
+// RingPublishNotifier.
+type RingPublishNotifierConfig struct {
+	// LogDebug sets the func to use for debug messages. Defaults not logging
+	// debug messages.
+	LogDebug LogFunc
+	// Barrier, if set, is used to wait for each ring version published to be
+	// acknowledged by the nodes of the ring; see SnapshotBarrier.Propagation.
+	// Otherwise, only RingPublished events are reported.
+	Barrier *SnapshotBarrier
+	// Quorum indicates how many nodes acknowledging a ring version counts as
+	// it being propagated. Defaults to 0, meaning all the ring's active
+	// nodes.
+	Quorum int
+	// PropagationTimeout indicates how many seconds to wait for a ring
+	// version to propagate before reporting RingPropagationFailed. Defaults
+	// to 600 seconds.
+	PropagationTimeout int
+	// Hook, if set, will be called with each event, in order, from the
+	// notifier's own goroutine.
+	Hook func(e *RingPublishEvent)
+	// WebhookURL, if set, will be sent each event as a JSON POST, such as for
+	// a deploy pipeline to gate on a ring being fully propagated. A response
+	// other than 2xx counts as a failure; failures are logged and counted,
+	// not retried.
+	WebhookURL string
+	// Client is the http.Client to use for the webhook. Defaults to a client
+	// with a 10 second timeout.
+	Client *http.Client
+}
+
+func resolveRingPublishNotifierConfig(c *RingPublishNotifierConfig) *RingPublishNotifierConfig {
+	cfg := &RingPublishNotifierConfig{}
+	if c != nil {
+		*cfg = *c
+	}
+	if cfg.LogDebug == nil {
+		cfg.LogDebug = nilLogFunc
+	}
+	if cfg.Quorum < 0 {
+		cfg.Quorum = 0
+	}
+	if cfg.PropagationTimeout < 1 {
+		cfg.PropagationTimeout = 600
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return cfg
+}
+
+// RingPublishNotifier tells administrators and their tooling when a new ring
+// version is published and when it has reached the cluster, through a hook
+// func and a webhook. It is usually set up with Wrap around the Publish func
+// of a RebalanceSchedulerConfig, or called with Notify by whatever else
+// publishes rings.
+//
+// Events are reported one at a time, in order, so a ring version's
+// propagation events always follow its RingPublished event. Should a newer
+// version be published while an older one is still propagating, the wait for
+// the older one ends with a RingPropagationSuperseded event; should several
+// versions be published before the notifier gets to them, only the latest is
+// reported.
+type RingPublishNotifier struct {
+	logDebug           LogFunc
+	barrier            *SnapshotBarrier
+	quorum             int
+	propagationTimeout time.Duration
+	hook               func(e *RingPublishEvent)
+	webhookURL         string
+	client             *http.Client
+	// wakeChan signals run that pending is set.
+	wakeChan chan struct{}
+
+	// lock guards pending, cancelChan, and stopChan. pending is the ring
+	// version yet to be reported, cancelChan is closed to end the wait for
+	// the current version to propagate, and stopChan is nil once stopped.
+	lock       sync.Mutex
+	pending    Ring
+	cancelChan chan struct{}
+	stopChan   chan struct{}
+
+	notifications       int32
+	coalesced           int32
+	propagations        int32
+	propagationFailures int32
+	superseded          int32
+	webhooks            int32
+	webhookErrors       int32
+}
+
+// NewRingPublishNotifier creates a RingPublishNotifier; its goroutine runs
+// until Stop is called.
+func NewRingPublishNotifier(c *RingPublishNotifierConfig) *RingPublishNotifier {
+	cfg := resolveRingPublishNotifierConfig(c)
+	n := &RingPublishNotifier{
+		logDebug:           cfg.LogDebug,
+		barrier:            cfg.Barrier,
+		quorum:             cfg.Quorum,
+		propagationTimeout: time.Duration(cfg.PropagationTimeout) * time.Second,
+		hook:               cfg.Hook,
+		webhookURL:         cfg.WebhookURL,
+		client:             cfg.Client,
+		wakeChan:           make(chan struct{}, 1),
+		stopChan:           make(chan struct{}),
+	}
+	go n.run(n.stopChan)
+	return n
+}
+
+// Notify reports the ring as published, and later whether it propagated. It
+// never blocks, as publishers may call it holding the Builder's lock: it just
+// records the ring for the notifier's goroutine, replacing any version not
+// yet reported and ending the wait for any still propagating. It does nothing
+// once the notifier is stopped.
+func (n *RingPublishNotifier) Notify(r Ring) {
+	n.lock.Lock()
+	if n.stopChan == nil {
+		n.lock.Unlock()
+		return
+	}
+	atomic.AddInt32(&n.notifications, 1)
+	if n.pending != nil {
+		atomic.AddInt32(&n.coalesced, 1)
+	}
+	n.pending = r
+	if n.cancelChan != nil {
+		close(n.cancelChan)
+		n.cancelChan = nil
+	}
+	n.lock.Unlock()
+	select {
+	case n.wakeChan <- struct{}{}:
+	default:
+	}
+}
+
+// Stop ends the notifier's goroutine, abandoning any ring version not yet
+// reported or still propagating; it does nothing if already stopped. An event
+// being reported will still complete.
+func (n *RingPublishNotifier) Stop() {
+	n.lock.Lock()
+	if n.stopChan != nil {
+		close(n.stopChan)
+		n.stopChan = nil
+		if n.cancelChan != nil {
+			close(n.cancelChan)
+			n.cancelChan = nil
+		}
+	}
+	n.lock.Unlock()
+}
+
+// Wrap returns a publish func that calls the one given and then, should it
+// succeed, Notify; such as for RebalanceSchedulerConfig.Publish.
+func (n *RingPublishNotifier) Wrap(publish func(r Ring) error) func(r Ring) error {
+	return func(r Ring) error {
+		if publish != nil {
+			if err := publish(r); err != nil {
+				return err
+			}
+		}
+		n.Notify(r)
+		return nil
+	}
+}
+
+func (n *RingPublishNotifier) run(stopChan chan struct{}) {
+	for {
+		select {
+		case <-stopChan:
+			return
+		case <-n.wakeChan:
+		}
+		n.lock.Lock()
+		r := n.pending
+		n.pending = nil
+		var cancelChan chan struct{}
+		if r != nil && n.barrier != nil && n.stopChan != nil {
+			cancelChan = make(chan struct{})
+			n.cancelChan = cancelChan
+		}
+		n.lock.Unlock()
+		if r == nil {
+			continue
+		}
+		n.report(&RingPublishEvent{Kind: RingPublished, RingVersion: r.Version()})
+		if cancelChan != nil {
+			n.propagate(r, cancelChan)
+		}
+	}
+}
+
+// propagate waits for the ring to propagate, or for cancelChan to close, and
+// reports the outcome.
+func (n *RingPublishNotifier) propagate(r Ring, cancelChan chan struct{}) {
+	result, err := n.barrier.propagation(r, n.quorum, n.propagationTimeout, cancelChan)
+	n.lock.Lock()
+	stopped := n.stopChan == nil
+	var newer Ring
+	if n.cancelChan == cancelChan {
+		n.cancelChan = nil
+	} else {
+		newer = n.pending
+	}
+	n.lock.Unlock()
+	if stopped {
+		return
+	}
+	e := &RingPublishEvent{Kind: RingPropagated, RingVersion: r.Version()}
+	if result != nil {
+		for _, nodeID := range result.Acked {
+			e.Acked = append(e.Acked, fmt.Sprintf("%016x", nodeID))
+		}
+		for _, nodeID := range result.Missing {
+			e.Missing = append(e.Missing, fmt.Sprintf("%016x", nodeID))
+		}
+	}
+	if err != nil && newer != nil {
+		atomic.AddInt32(&n.superseded, 1)
+		e.Kind = RingPropagationSuperseded
+		e.Error = fmt.Sprintf("superseded by ring version %d", newer.Version())
+	} else if err != nil {
+		atomic.AddInt32(&n.propagationFailures, 1)
+		e.Kind = RingPropagationFailed
+		e.Error = err.Error()
+	} else {
+		atomic.AddInt32(&n.propagations, 1)
+	}
+	n.report(e)
+}
+
+func (n *RingPublishNotifier) report(e *RingPublishEvent) {
+	n.logDebug("ring publish notifier: ring version %d %s\n", e.RingVersion, e.Kind)
+	if n.hook != nil {
+		n.hook(e)
+	}
+	if n.webhookURL == "" {
+		return
+	}
+	atomic.AddInt32(&n.webhooks, 1)
+	if err := n.sendWebhook(e); err != nil {
+		atomic.AddInt32(&n.webhookErrors, 1)
+		n.logDebug("ring publish notifier: webhook for ring version %d %s: %s\n", e.RingVersion, e.Kind, err)
+	}
+}
+
+func (n *RingPublishNotifier) sendWebhook(e *RingPublishEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(n.webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// RingPublishNotifierStats are the stat counters of a RingPublishNotifier;
+// see RingPublishNotifier.Stats.
+type RingPublishNotifierStats struct {
+	Notifications int32
+	// Coalesced counts ring versions replaced by newer ones before being
+	// reported.
+	Coalesced           int32
+	Propagations        int32
+	PropagationFailures int32
+	// Superseded counts ring versions whose propagation wait was ended by a
+	// newer version.
+	Superseded    int32
+	Webhooks      int32
+	WebhookErrors int32
+}
+
+// Stats returns the current stat counters and resets those counters.
+func (n *RingPublishNotifier) Stats() *RingPublishNotifierStats {
+	s := &RingPublishNotifierStats{
+		Notifications:       atomic.LoadInt32(&n.notifications),
+		Coalesced:           atomic.LoadInt32(&n.coalesced),
+		Propagations:        atomic.LoadInt32(&n.propagations),
+		PropagationFailures: atomic.LoadInt32(&n.propagationFailures),
+		Superseded:          atomic.LoadInt32(&n.superseded),
+		Webhooks:            atomic.LoadInt32(&n.webhooks),
+		WebhookErrors:       atomic.LoadInt32(&n.webhookErrors),
+	}
+	atomic.AddInt32(&n.notifications, -s.Notifications)
+	atomic.AddInt32(&n.coalesced, -s.Coalesced)
+	atomic.AddInt32(&n.propagations, -s.Propagations)
+	atomic.AddInt32(&n.propagationFailures, -s.PropagationFailures)
+	atomic.AddInt32(&n.superseded, -s.Superseded)
+	atomic.AddInt32(&n.webhooks, -s.Webhooks)
+	atomic.AddInt32(&n.webhookErrors, -s.WebhookErrors)
+	return s
+}
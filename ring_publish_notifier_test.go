@@ -0,0 +1,198 @@
+package ring
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRingPublishNotifier(t *testing.T) {
+	b := NewBuilder(64)
+	var ids []uint64
+	for i := 0; i < 3; i++ {
+		n, err := b.AddNode(true, 1, nil, nil, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, n.ID())
+	}
+	oldRing := b.Ring()
+	b.Node(ids[0]).SetCapacity(2)
+	newRing := b.Ring()
+	if newRing.Version() <= oldRing.Version() {
+		t.Fatal(oldRing.Version(), newRing.Version())
+	}
+	// The last node has yet to switch to the new ring.
+	msgRings := make(map[uint64]*testMsgRing)
+	barriers := make(map[uint64]*SnapshotBarrier)
+	for i, id := range ids {
+		r := b.Ring()
+		if i == 2 {
+			r = oldRing
+		}
+		r.SetLocalNode(id)
+		msgRings[id] = newTestMsgRing(r)
+		barriers[id] = NewSnapshotBarrier(msgRings[id], &SnapshotBarrierConfig{Interval: 10, SwitchTimeout: 1})
+	}
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	go func() {
+		for {
+			select {
+			case <-stopChan:
+				return
+			case <-time.After(time.Millisecond):
+				routeBarrierMsgs(t, msgRings)
+			}
+		}
+	}()
+	webhookChan := make(chan *RingPublishEvent, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		e := &RingPublishEvent{}
+		if err := json.NewDecoder(req.Body).Decode(e); err != nil {
+			t.Error(err)
+		}
+		webhookChan <- e
+	}))
+	defer server.Close()
+	hookChan := make(chan *RingPublishEvent, 10)
+	next := func(c chan *RingPublishEvent) *RingPublishEvent {
+		select {
+		case e := <-c:
+			return e
+		case <-time.After(10 * time.Second):
+			t.Fatal("no event")
+		}
+		return nil
+	}
+	notifier := NewRingPublishNotifier(&RingPublishNotifierConfig{
+		Barrier:            barriers[ids[0]],
+		Quorum:             2,
+		PropagationTimeout: 5,
+		Hook:               func(e *RingPublishEvent) { hookChan <- e },
+		WebhookURL:         server.URL,
+	})
+	defer notifier.Stop()
+	var published Ring
+	publish := notifier.Wrap(func(r Ring) error {
+		published = r
+		return nil
+	})
+	if err := publish(newRing); err != nil {
+		t.Fatal(err)
+	}
+	if published != newRing {
+		t.Fatal("wrapped publish func not called")
+	}
+	if e := next(hookChan); e.Kind != RingPublished || e.RingVersion != newRing.Version() {
+		t.Fatalf("%#v", e)
+	}
+	e := next(hookChan)
+	if e.Kind != RingPropagated || e.RingVersion != newRing.Version() || len(e.Acked) < 2 {
+		t.Fatalf("%#v", e)
+	}
+	if e := next(webhookChan); e.Kind != RingPublished || e.RingVersion != newRing.Version() {
+		t.Fatalf("%#v", e)
+	}
+	if e := next(webhookChan); e.Kind != RingPropagated || len(e.Acked) < 2 {
+		t.Fatalf("%#v", e)
+	}
+	if s := notifier.Stats(); s.Notifications != 1 || s.Propagations != 1 || s.Webhooks != 2 || s.WebhookErrors != 0 {
+		t.Fatalf("%#v", s)
+	}
+	// Requiring all the nodes, the lagging node keeps the ring from
+	// propagating.
+	r, err := barriers[ids[0]].Propagation(newRing, 0, 100*time.Millisecond)
+	if err == nil {
+		t.Fatal("propagated without the lagging node")
+	}
+	if len(r.Acked) != 2 || len(r.Missing) != 1 || r.Missing[0] != ids[2] {
+		t.Fatalf("%#v", r)
+	}
+	// Nodes already past a ring version acknowledge it too.
+	if r, err = barriers[ids[0]].Propagation(oldRing, 0, 5*time.Second); err != nil || len(r.Acked) != 3 {
+		t.Fatal(err, r)
+	}
+	// Requiring all the nodes, the wait for the new ring is ended by a newer
+	// one long before the timeout.
+	b.Node(ids[1]).SetCapacity(2)
+	newerRing := b.Ring()
+	notifier = NewRingPublishNotifier(&RingPublishNotifierConfig{
+		Barrier: barriers[ids[0]],
+		Hook:    func(e *RingPublishEvent) { hookChan <- e },
+	})
+	defer notifier.Stop()
+	notifier.Notify(newRing)
+	if e := next(hookChan); e.Kind != RingPublished || e.RingVersion != newRing.Version() {
+		t.Fatalf("%#v", e)
+	}
+	notifier.Notify(newerRing)
+	if e := next(hookChan); e.Kind != RingPropagationSuperseded || e.RingVersion != newRing.Version() || e.Error == "" {
+		t.Fatalf("%#v", e)
+	}
+	if e := next(hookChan); e.Kind != RingPublished || e.RingVersion != newerRing.Version() {
+		t.Fatalf("%#v", e)
+	}
+	// Stopping abandons the newer ring's wait without an event.
+	notifier.Stop()
+	select {
+	case e := <-hookChan:
+		t.Fatalf("%#v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if s := notifier.Stats(); s.Notifications != 2 || s.Superseded != 1 || s.Propagations != 0 || s.PropagationFailures != 0 {
+		t.Fatalf("%#v", s)
+	}
+}
+
+func TestRingPublishNotifierCoalesce(t *testing.T) {
+	b := NewBuilder(64)
+	n, err := b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rings []Ring
+	for i := 0; i < 3; i++ {
+		n.SetCapacity(uint64(i + 1))
+		rings = append(rings, b.Ring())
+	}
+	gateChan := make(chan struct{})
+	hookChan := make(chan *RingPublishEvent, 10)
+	notifier := NewRingPublishNotifier(&RingPublishNotifierConfig{
+		Hook: func(e *RingPublishEvent) {
+			<-gateChan
+			hookChan <- e
+		},
+	})
+	defer notifier.Stop()
+	// With the hook held up on the first ring, Notify still returns at once
+	// and the rings after it coalesce to the last.
+	notifier.Notify(rings[0])
+	for {
+		notifier.lock.Lock()
+		taken := notifier.pending == nil
+		notifier.lock.Unlock()
+		if taken {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	notifier.Notify(rings[1])
+	notifier.Notify(rings[2])
+	close(gateChan)
+	for _, r := range []Ring{rings[0], rings[2]} {
+		select {
+		case e := <-hookChan:
+			if e.Kind != RingPublished || e.RingVersion != r.Version() {
+				t.Fatalf("%#v", e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+		}
+	}
+	if s := notifier.Stats(); s.Notifications != 3 || s.Coalesced != 1 {
+		t.Fatalf("%#v", s)
+	}
+}
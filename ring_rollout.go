@@ -0,0 +1,351 @@
+package ring
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RingRolloutState indicates the progress of a RingRollout.
+type RingRolloutState int
+
+const (
+	// RingRolloutPending means no nodes have been given the new ring yet.
+	RingRolloutPending RingRolloutState = iota
+	// RingRolloutInProgress means some, but not all, nodes have been given
+	// the new ring.
+	RingRolloutInProgress
+	// RingRolloutComplete means all nodes have been given the new ring.
+	RingRolloutComplete
+	// RingRolloutHalted means the rollout was stopped, either by Halt or by a
+	// failed health check; nodes already given the new ring keep it.
+	RingRolloutHalted
+	// RingRolloutRolledBack means the nodes given the new ring have been
+	// given the old ring again.
+	RingRolloutRolledBack
+)
+
+func (s RingRolloutState) String() string {
+	switch s {
+	case RingRolloutPending:
+		return "pending"
+	case RingRolloutInProgress:
+		return "in progress"
+	case RingRolloutComplete:
+		return "complete"
+	case RingRolloutHalted:
+		return "halted"
+	case RingRolloutRolledBack:
+		return "rolled back"
+	}
+	return fmt.Sprintf("RingRolloutState(%d)", int(s))
+}
+
+// RingRolloutConfig represents the set of values for configuring a
+// RingRollout.
+type RingRolloutConfig struct {
+	// LogDebug sets the func to use for debug messages. Defaults not logging
+	// debug messages.
+	LogDebug LogFunc
+	// Percentage indicates the percentage of nodes to give the new ring in
+	// each step. Defaults to 10.
+	Percentage int
+	// Interval indicates how many seconds Run waits after each step before
+	// checking health and continuing. Defaults to 60 seconds.
+	Interval int
+	// Activate will be called to have the node switch to the ring given;
+	// this is used with the new ring as the rollout progresses and with the
+	// old ring on rollback. How the ring reaches the node is up to the
+	// caller, such as a message sent over a MsgRing that the node answers
+	// with its own SetRing. This must be set.
+	Activate func(nodeID uint64, r Ring) error
+	// Healthy, if set, will be called by Run after each step's interval with
+	// the IDs of the nodes given the new ring so far; returning an error
+	// halts the rollout. This is where error rates and other metrics would
+	// be checked.
+	Healthy func(activated []uint64) error
+	// RollbackOnHalt indicates Run should roll back when the rollout halts
+	// due to an error, rather than leaving the activated nodes on the new
+	// ring.
+	RollbackOnHalt bool
+	// StateChanged, if set, will be called whenever the rollout state
+	// changes, with the error that caused the change, if any. It is called
+	// without the rollout's lock held, so it may call State, Progress, and
+	// the like.
+	StateChanged func(state RingRolloutState, err error)
+}
+
+func resolveRingRolloutConfig(c *RingRolloutConfig) *RingRolloutConfig {
+	cfg := &RingRolloutConfig{}
+	if c != nil {
+		*cfg = *c
+	}
+	if cfg.Percentage < 1 {
+		cfg.Percentage = 10
+	}
+	if cfg.Percentage > 100 {
+		cfg.Percentage = 100
+	}
+	if cfg.Interval < 1 {
+		cfg.Interval = 60
+	}
+	return cfg
+}
+
+// RingRollout gives a new ring to the nodes of a cluster a percentage at a
+// time, rather than all at once, checking the health of the cluster between
+// steps and halting or rolling back if problems are found.
+//
+// The nodes given the new ring are those of both the old and new rings,
+// ordered by node ID so a restarted rollout proceeds in the same order.
+type RingRollout struct {
+	logDebug       LogFunc
+	oldRing        Ring
+	newRing        Ring
+	stepSize       int
+	interval       time.Duration
+	activate       func(nodeID uint64, r Ring) error
+	healthy        func(activated []uint64) error
+	rollbackOnHalt bool
+	stateChanged   func(state RingRolloutState, err error)
+	// activating serializes Step and Rollback, which call activate without
+	// holding lock so State, Progress, and the like are not held up by it.
+	activating sync.Mutex
+	lock       sync.Mutex
+	state      RingRolloutState
+	nodeIDs    []uint64
+	activated  int
+	haltChan   chan struct{}
+}
+
+// NewRingRollout creates a RingRollout from the old ring to the new ring;
+// call Run to perform the whole rollout or Step to control it directly.
+func NewRingRollout(oldRing Ring, newRing Ring, c *RingRolloutConfig) *RingRollout {
+	cfg := resolveRingRolloutConfig(c)
+	o := &RingRollout{
+		logDebug:       cfg.LogDebug,
+		oldRing:        oldRing,
+		newRing:        newRing,
+		interval:       time.Duration(cfg.Interval) * time.Second,
+		activate:       cfg.Activate,
+		healthy:        cfg.Healthy,
+		rollbackOnHalt: cfg.RollbackOnHalt,
+		stateChanged:   cfg.StateChanged,
+		haltChan:       make(chan struct{}),
+	}
+	if o.logDebug == nil {
+		o.logDebug = nilLogFunc
+	}
+	seen := make(map[uint64]bool)
+	for _, r := range []Ring{newRing, oldRing} {
+		if r == nil {
+			continue
+		}
+		for _, n := range r.Nodes() {
+			if !seen[n.ID()] {
+				seen[n.ID()] = true
+				o.nodeIDs = append(o.nodeIDs, n.ID())
+			}
+		}
+	}
+	sort.Slice(o.nodeIDs, func(i, j int) bool { return o.nodeIDs[i] < o.nodeIDs[j] })
+	o.stepSize = (len(o.nodeIDs)*cfg.Percentage + 99) / 100
+	if o.stepSize < 1 {
+		o.stepSize = 1
+	}
+	return o
+}
+
+// State returns the current state of the rollout.
+func (o *RingRollout) State() RingRolloutState {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.state
+}
+
+// Progress returns the number of nodes given the new ring and the total
+// number of nodes in the rollout.
+func (o *RingRollout) Progress() (int, int) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.activated, len(o.nodeIDs)
+}
+
+// Activated returns the IDs of the nodes given the new ring so far.
+func (o *RingRollout) Activated() []uint64 {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return append([]uint64(nil), o.nodeIDs[:o.activated]...)
+}
+
+// must be called with o.lock held; the func returned calls StateChanged and
+// must be called once o.lock is released.
+func (o *RingRollout) setState(state RingRolloutState, err error) func() {
+	if o.state == state {
+		return func() {}
+	}
+	o.state = state
+	if err != nil {
+		o.logDebug("RingRollout: %s: %s\n", state, err)
+	} else {
+		o.logDebug("RingRollout: %s\n", state)
+	}
+	if o.stateChanged == nil {
+		return func() {}
+	}
+	return func() { o.stateChanged(state, err) }
+}
+
+// Step gives the new ring to the next percentage of nodes, returning true
+// once all nodes have it. If Activate fails for a node the rollout halts,
+// with the nodes before it in the step left on the new ring. If the rollout
+// is halted during the step, the step stops early and returns false.
+func (o *RingRollout) Step() (bool, error) {
+	return o.step(true)
+}
+
+// step is Step, but leaves the rollout in progress once all nodes have the
+// new ring unless complete is true, so Run can check health one last time.
+func (o *RingRollout) step(complete bool) (bool, error) {
+	o.activating.Lock()
+	defer o.activating.Unlock()
+	o.lock.Lock()
+	switch o.state {
+	case RingRolloutComplete:
+		o.lock.Unlock()
+		return true, nil
+	case RingRolloutHalted, RingRolloutRolledBack:
+		state := o.state
+		o.lock.Unlock()
+		return false, fmt.Errorf("ring rollout %s", state)
+	}
+	end := o.activated + o.stepSize
+	if end > len(o.nodeIDs) {
+		end = len(o.nodeIDs)
+	}
+	for o.activated < end {
+		if o.state == RingRolloutHalted || o.state == RingRolloutRolledBack {
+			o.lock.Unlock()
+			return false, nil
+		}
+		nodeID := o.nodeIDs[o.activated]
+		o.lock.Unlock()
+		if err := o.activate(nodeID, o.newRing); err != nil {
+			err = fmt.Errorf("activating ring version %d on node %d: %s", o.newRing.Version(), nodeID, err)
+			o.lock.Lock()
+			notify := o.halt(err)
+			o.lock.Unlock()
+			notify()
+			return false, err
+		}
+		o.lock.Lock()
+		o.activated++
+	}
+	done := o.activated == len(o.nodeIDs)
+	var notify func()
+	if done && complete {
+		notify = o.setState(RingRolloutComplete, nil)
+	} else {
+		notify = o.setState(RingRolloutInProgress, nil)
+	}
+	o.lock.Unlock()
+	notify()
+	return done, nil
+}
+
+// Halt stops the rollout, leaving the nodes already given the new ring on it;
+// a Run in progress will return. It does nothing if the rollout is complete.
+func (o *RingRollout) Halt() {
+	o.lock.Lock()
+	notify := o.halt(nil)
+	o.lock.Unlock()
+	notify()
+}
+
+// must be called with o.lock held; see setState for the func returned.
+func (o *RingRollout) halt(err error) func() {
+	if o.state == RingRolloutComplete || o.state == RingRolloutHalted || o.state == RingRolloutRolledBack {
+		return func() {}
+	}
+	close(o.haltChan)
+	return o.setState(RingRolloutHalted, err)
+}
+
+// Rollback gives the old ring back to all nodes given the new ring, halting
+// the rollout if it is still underway. This may be called even once the
+// rollout is complete. If Activate fails for a node, the error is returned
+// and Rollback may be called again to retry.
+func (o *RingRollout) Rollback() error {
+	if o.oldRing == nil {
+		return fmt.Errorf("no old ring to roll back to")
+	}
+	// Halting first stops any Step underway before its next node.
+	o.lock.Lock()
+	notify := o.halt(nil)
+	o.lock.Unlock()
+	notify()
+	o.activating.Lock()
+	defer o.activating.Unlock()
+	o.lock.Lock()
+	for o.activated > 0 {
+		nodeID := o.nodeIDs[o.activated-1]
+		o.lock.Unlock()
+		if err := o.activate(nodeID, o.oldRing); err != nil {
+			return fmt.Errorf("activating ring version %d on node %d: %s", o.oldRing.Version(), nodeID, err)
+		}
+		o.lock.Lock()
+		o.activated--
+	}
+	notify = o.setState(RingRolloutRolledBack, nil)
+	o.lock.Unlock()
+	notify()
+	return nil
+}
+
+// Run performs the rollout, stepping, waiting the configured interval, and
+// checking health until all nodes have the new ring; the health is checked
+// after the last step too, before the rollout is complete. It returns nil
+// once the rollout is complete, or the error that halted it; if Halt is
+// called, Run returns without error. With RollbackOnHalt, a rollout halted
+// by an error is rolled back before Run returns.
+func (o *RingRollout) Run() error {
+	for {
+		select {
+		case <-o.haltChan:
+			return nil
+		default:
+		}
+		done, err := o.step(o.healthy == nil)
+		if err == nil && (!done || o.healthy != nil) {
+			select {
+			case <-o.haltChan:
+				return nil
+			case <-time.After(o.interval):
+			}
+			if o.healthy != nil {
+				err = o.healthy(o.Activated())
+				o.lock.Lock()
+				notify := func() {}
+				if err != nil {
+					notify = o.halt(err)
+				} else if done && o.state == RingRolloutInProgress {
+					notify = o.setState(RingRolloutComplete, nil)
+				}
+				o.lock.Unlock()
+				notify()
+			}
+		}
+		if err != nil {
+			if o.rollbackOnHalt {
+				if rerr := o.Rollback(); rerr != nil {
+					return fmt.Errorf("%s; rollback failed: %s", err, rerr)
+				}
+			}
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package ring
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func newRolloutTestRings(t *testing.T) (Ring, Ring) {
+	b := NewBuilder(64)
+	for i := 0; i < 10; i++ {
+		if _, err := b.AddNode(true, 1, nil, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldRing := b.Ring()
+	b.PretendElapsed(math.MaxUint16)
+	if _, err := b.AddNode(true, 1, nil, nil, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	return oldRing, b.Ring()
+}
+
+func TestRingRolloutStep(t *testing.T) {
+	oldRing, newRing := newRolloutTestRings(t)
+	nodeRing := make(map[uint64]int64)
+	var states []RingRolloutState
+	o := NewRingRollout(oldRing, newRing, &RingRolloutConfig{
+		Percentage: 25,
+		Activate: func(nodeID uint64, r Ring) error {
+			nodeRing[nodeID] = r.Version()
+			return nil
+		},
+		StateChanged: func(state RingRolloutState, err error) { states = append(states, state) },
+	})
+	done, err := o.Step()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done {
+		t.Fatal("should not be done after first step")
+	}
+	if activated, total := o.Progress(); activated != 3 || total != 11 {
+		t.Fatalf("%d %d != 3 11", activated, total)
+	}
+	for !done {
+		if done, err = o.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, n := range newRing.Nodes() {
+		if nodeRing[n.ID()] != newRing.Version() {
+			t.Fatalf("node %d has ring version %d", n.ID(), nodeRing[n.ID()])
+		}
+	}
+	if len(states) != 2 || states[0] != RingRolloutInProgress || states[1] != RingRolloutComplete {
+		t.Fatalf("%v", states)
+	}
+	if err = o.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range newRing.Nodes() {
+		if nodeRing[n.ID()] != oldRing.Version() {
+			t.Fatalf("node %d has ring version %d", n.ID(), nodeRing[n.ID()])
+		}
+	}
+	if o.State() != RingRolloutRolledBack {
+		t.Fatal(o.State())
+	}
+}
+
+func TestRingRolloutRunHealthFailure(t *testing.T) {
+	oldRing, newRing := newRolloutTestRings(t)
+	nodeRing := make(map[uint64]int64)
+	o := NewRingRollout(oldRing, newRing, &RingRolloutConfig{
+		Percentage: 50,
+		Activate: func(nodeID uint64, r Ring) error {
+			nodeRing[nodeID] = r.Version()
+			return nil
+		},
+		Healthy: func(activated []uint64) error {
+			return errors.New("error rate too high")
+		},
+		RollbackOnHalt: true,
+	})
+	o.interval = 0
+	if err := o.Run(); err == nil {
+		t.Fatal("expected health error")
+	}
+	if o.State() != RingRolloutRolledBack {
+		t.Fatal(o.State())
+	}
+	if len(nodeRing) != 6 {
+		t.Fatalf("%d != 6", len(nodeRing))
+	}
+	for id, version := range nodeRing {
+		if version != oldRing.Version() {
+			t.Fatalf("node %d has ring version %d", id, version)
+		}
+	}
+	if _, err := o.Step(); err == nil {
+		t.Fatal("expected error stepping a rolled back rollout")
+	}
+}
+
+func TestRingRolloutCallbacksUnlocked(t *testing.T) {
+	oldRing, newRing := newRolloutTestRings(t)
+	var o *RingRollout
+	var progress []int
+	o = NewRingRollout(oldRing, newRing, &RingRolloutConfig{
+		Percentage: 50,
+		Activate: func(nodeID uint64, r Ring) error {
+			// Neither the state nor the progress is locked while activating.
+			o.State()
+			activated, _ := o.Progress()
+			progress = append(progress, activated)
+			return nil
+		},
+		StateChanged: func(state RingRolloutState, err error) {
+			if o.State() != state {
+				t.Errorf("%s != %s", o.State(), state)
+			}
+		},
+	})
+	o.interval = 0
+	if err := o.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if o.State() != RingRolloutComplete || len(progress) != 11 || progress[10] != 10 {
+		t.Fatal(o.State(), progress)
+	}
+	if err := o.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRingRolloutRunFinalHealthFailure(t *testing.T) {
+	oldRing, newRing := newRolloutTestRings(t)
+	nodeRing := make(map[uint64]int64)
+	o := NewRingRollout(oldRing, newRing, &RingRolloutConfig{
+		Percentage: 50,
+		Activate: func(nodeID uint64, r Ring) error {
+			nodeRing[nodeID] = r.Version()
+			return nil
+		},
+		// Only the last step, giving all the nodes the new ring, is bad.
+		Healthy: func(activated []uint64) error {
+			if len(activated) == 11 {
+				return errors.New("error rate too high")
+			}
+			return nil
+		},
+		RollbackOnHalt: true,
+	})
+	o.interval = 0
+	if err := o.Run(); err == nil {
+		t.Fatal("expected health error")
+	}
+	if o.State() != RingRolloutRolledBack {
+		t.Fatal(o.State())
+	}
+	for id, version := range nodeRing {
+		if version != oldRing.Version() {
+			t.Fatalf("node %d has ring version %d", id, version)
+		}
+	}
+}
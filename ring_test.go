@@ -2,6 +2,10 @@ package ring
 
 import (
 	"bytes"
+	"compress/gzip"
+	"io"
+	"math"
+	"reflect"
 	"testing"
 )
 
@@ -138,9 +142,176 @@ func TestRingResponsibleIDs(t *testing.T) {
 	}
 }
 
+func TestRingPreferredReplicas(t *testing.T) {
+	tb := &tierBase{tiers: [][]string{[]string{"", "server1", "server2", "server3"}, []string{"", "zone1", "zone2"}}}
+	r := &ring{
+		tierBase:       *tb,
+		localNodeIndex: -1,
+		nodes: []*node{
+			&node{id: 10, tierIndexes: []int32{1, 1}},
+			&node{id: 11, tierIndexes: []int32{2, 2}},
+			&node{id: 12, tierIndexes: []int32{3, 1}},
+			&node{id: 13, tierIndexes: []int32{1, 1}},
+		},
+		replicaToPartitionToNodeIndex: [][]int32{
+			[]int32{1, 0},
+			[]int32{2, 1},
+			[]int32{3, 2},
+		},
+	}
+	for _, n := range r.nodes {
+		n.tierBase = &r.tierBase
+	}
+	v := r.PreferredReplicas(0, nil)
+	if len(v) != 3 || v[0].ID() != 11 || v[1].ID() != 12 || v[2].ID() != 13 {
+		t.Fatalf("PreferredReplicas(0, nil) gave %v instead of [11 12 13]", v)
+	}
+	r.SetLocalNode(10)
+	v = r.PreferredReplicas(0, nil)
+	if len(v) != 3 || v[0].ID() != 13 || v[1].ID() != 12 || v[2].ID() != 11 {
+		t.Fatalf("PreferredReplicas(0, nil) gave %v instead of [13 12 11]", v)
+	}
+	v = r.PreferredReplicas(1, nil)
+	if len(v) != 3 || v[0].ID() != 10 || v[1].ID() != 12 || v[2].ID() != 11 {
+		t.Fatalf("PreferredReplicas(1, nil) gave %v instead of [10 12 11]", v)
+	}
+	v = r.PreferredReplicas(1, func(n Node) int {
+		if n.ID() == 11 {
+			return 0
+		}
+		return 1
+	})
+	if len(v) != 3 || v[0].ID() != 11 || v[1].ID() != 10 || v[2].ID() != 12 {
+		t.Fatalf("PreferredReplicas(1, func) gave %v instead of [11 10 12]", v)
+	}
+}
+
+func TestRingHandoffNodes(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetReplicaCount(2)
+	for i := 0; i < 6; i++ {
+		capacity := uint64(1)
+		if i == 0 {
+			capacity = 4
+		}
+		if _, err := b.AddNode(true, capacity, nil, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inactive, err := b.AddNode(false, 100, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r Ring = b.Ring()
+	partitionCount := Partition(1) << r.PartitionBitCount()
+	for p := Partition(0); p < partitionCount; p++ {
+		handoffs := r.HandoffNodes(p, 3, HandoffDeterministic)
+		if len(handoffs) != 3 {
+			t.Fatalf("%d != 3", len(handoffs))
+		}
+		again := r.HandoffNodes(p, 3, HandoffDeterministic)
+		for i, n := range handoffs {
+			if n.ID() != again[i].ID() {
+				t.Fatalf("partition %d: deterministic handoffs differed: %d != %d", p, n.ID(), again[i].ID())
+			}
+			if n.ID() == inactive.ID() {
+				t.Fatalf("partition %d: inactive node chosen", p)
+			}
+			for _, rn := range r.ResponsibleNodes(p) {
+				if n.ID() == rn.ID() {
+					t.Fatalf("partition %d: responsible node %d chosen", p, n.ID())
+				}
+			}
+		}
+		if len(r.HandoffNodes(p, 10, HandoffWeightedRandom)) != 4 {
+			t.Fatalf("%d != 4", len(r.HandoffNodes(p, 10, HandoffWeightedRandom)))
+		}
+	}
+	// Node ID 2 has 9 of the 12 capacity available for handoffs, so should be
+	// the first choice about 75% of the time in either mode.
+	r = &ring{
+		partitionBitCount: 10,
+		nodes: []*node{
+			&node{id: 1, capacity: 1},
+			&node{id: 2, capacity: 9},
+			&node{id: 3, capacity: 1},
+			&node{id: 4, capacity: 1},
+			&node{id: 5, capacity: 1},
+		},
+		replicaToPartitionToNodeIndex: [][]int32{make([]int32, 1024)},
+	}
+	deterministicFirsts := 0
+	randomFirsts := 0
+	for p := Partition(0); p < 1024; p++ {
+		if r.HandoffNodes(p, 1, HandoffDeterministic)[0].ID() == 2 {
+			deterministicFirsts++
+		}
+		if r.HandoffNodes(0, 1, HandoffWeightedRandom)[0].ID() == 2 {
+			randomFirsts++
+		}
+	}
+	if deterministicFirsts < 650 || deterministicFirsts > 890 {
+		t.Fatalf("deterministic mode chose the heavy node first %d of 1024 times", deterministicFirsts)
+	}
+	if randomFirsts < 650 || randomFirsts > 890 {
+		t.Fatalf("random mode chose the heavy node first %d of 1024 times", randomFirsts)
+	}
+}
+
+func TestLoadRingChecksum(t *testing.T) {
+	b := NewBuilder(64)
+	b.AddNode(true, 1, nil, []string{"1.2.3.4:56789"}, "", nil)
+	var buf bytes.Buffer
+	if err := b.Ring().Persist(&buf); err != nil {
+		t.Fatal(err)
+	}
+	byts := buf.Bytes()
+	byts[len(byts)-8] ^= 0xff
+	if _, err := LoadRing(bytes.NewReader(byts)); err != gzip.ErrChecksum {
+		t.Fatal(err)
+	}
+	byts[len(byts)-8] ^= 0xff
+	if _, err := LoadRing(bytes.NewReader(byts)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadRingCorrupt(t *testing.T) {
+	b := NewBuilder(64)
+	b.AddNode(true, 1, nil, []string{"1.2.3.4:56789"}, "Meta", nil)
+	var buf bytes.Buffer
+	if err := b.Ring().Persist(&buf); err != nil {
+		t.Fatal(err)
+	}
+	// After the meta come the config and network zone lengths, the replica
+	// count, and the first replica's partition count.
+	for _, c := range []struct {
+		offset int
+		value  int32
+	}{
+		{-8, -1},
+		{-8, math.MaxInt32},
+		{0, -1},
+		{0, math.MaxInt32},
+		{8, -1},
+		{12, -1},
+		{12, 3},
+		{12, math.MaxInt32},
+	} {
+		_, err := LoadRing(bytes.NewReader(corruptPersisted(t, buf.Bytes(), "Meta", c.offset, c.value)))
+		if err == nil {
+			t.Fatalf("%d at %d loaded", c.value, c.offset)
+		}
+		if c.value == math.MaxInt32 && c.offset <= 0 && err != io.ErrUnexpectedEOF {
+			t.Fatal(err)
+		}
+	}
+}
+
 func TestRingPersistence(t *testing.T) {
 	b := NewBuilder(64)
 	b.SetReplicaCount(3)
+	b.SetAddressRoles([]string{"replication", "client"})
 	b.AddNode(true, 1, []string{"server1", "zone1"}, []string{"1.2.3.4:56789"}, "Meta One", []byte("Config"))
 	b.AddNode(true, 1, []string{"server2", "zone1"}, []string{"1.2.3.5:56789", "1.2.3.5:9876"}, "Meta Four", []byte("Config"))
 	b.AddNode(false, 0, []string{"server3", "zone1"}, []string{"1.2.3.6:56789"}, "Meta Three", []byte("Config"))
@@ -210,6 +381,12 @@ func TestRingPersistence(t *testing.T) {
 			}
 		}
 	}
+	if r2.AddressIndex("client") != 1 {
+		t.Fatalf("%v != 1", r2.AddressIndex("client"))
+	}
+	if r2.AddressIndex("admin") != -1 {
+		t.Fatalf("%v != -1", r2.AddressIndex("admin"))
+	}
 }
 
 func TestRingStats(t *testing.T) {
@@ -259,4 +436,85 @@ func TestRingStats(t *testing.T) {
 	if s.MaxOverNodePercentage != v {
 		t.Fatalf("RingStats gave MaxOverNodePercentage of %v instead of %v", s.MaxOverNodePercentage, v)
 	}
+	if len(s.NodeStats) != 6 {
+		t.Fatalf("RingStats gave %d NodeStats instead of 6", len(s.NodeStats))
+	}
+	ns := s.NodeStats[0]
+	if ns.NodeID != 0 || !ns.Active || ns.Capacity != 100 || ns.AssignedCount != 3 || ns.DesiredCount != d || ns.Percentage != v {
+		t.Fatalf("RingStats gave NodeStats[0] of %#v", ns)
+	}
+	ns = s.NodeStats[4]
+	if ns.AssignedCount != 2 || ns.Percentage >= 0 {
+		t.Fatalf("RingStats gave NodeStats[4] of %#v", ns)
+	}
+	ns = s.NodeStats[5]
+	if ns.Active || ns.AssignedCount != 0 || ns.DesiredCount != 0 || ns.Percentage != 0 {
+		t.Fatalf("RingStats gave NodeStats[5] of %#v", ns)
+	}
+}
+
+func TestRingUnassignedReplicas(t *testing.T) {
+	r := &ring{
+		localNodeIndex:    -1,
+		partitionBitCount: 1,
+		nodes:             []*node{&node{id: 1, capacity: 1}, &node{id: 2, capacity: 1}, &node{id: 3, capacity: 1}},
+		replicaToPartitionToNodeIndex: [][]int32{
+			[]int32{0, -1},
+			[]int32{-1, -1},
+		},
+	}
+	if v := r.UnassignedReplicas(0); v != 1 {
+		t.Fatal(v)
+	}
+	// The unassigned replica is substituted with a handoff node.
+	nodes := r.ResponsibleNodes(0)
+	if len(nodes) != 2 || nodes[0].ID() != 1 || nodes[1].ID() == 1 {
+		t.Fatal(nodes)
+	}
+	again := r.ResponsibleNodes(0)
+	if again[1].ID() != nodes[1].ID() {
+		t.Fatalf("%d != %d", again[1].ID(), nodes[1].ID())
+	}
+	if v := r.UnassignedReplicas(1); v != 2 {
+		t.Fatal(v)
+	}
+	if nodes = r.ResponsibleNodes(1); len(nodes) != 2 || nodes[0].ID() == nodes[1].ID() {
+		t.Fatal(nodes)
+	}
+	// With no nodes to substitute, the replicas are left out.
+	r.nodes[1].inactive = true
+	r.nodes[2].inactive = true
+	if nodes = r.ResponsibleNodes(0); len(nodes) != 1 || nodes[0].ID() != 1 {
+		t.Fatal(nodes)
+	}
+	if nodes = r.ResponsibleNodes(1); len(nodes) != 1 {
+		t.Fatal(nodes)
+	}
+	if s := r.Stats(); s.UnassignedCount != 3 {
+		t.Fatal(s.UnassignedCount)
+	}
+}
+
+func TestRingAssignmentSnapshot(t *testing.T) {
+	r := &ring{
+		localNodeIndex:    -1,
+		partitionBitCount: 1,
+		nodes:             []*node{&node{id: 1, capacity: 1}, &node{id: 2, capacity: 1}},
+		replicaToPartitionToNodeIndex: [][]int32{
+			[]int32{0, 1},
+			[]int32{1, -1},
+		},
+	}
+	s := r.AssignmentSnapshot()
+	if !reflect.DeepEqual(s, [][]int32{[]int32{0, 1}, []int32{1, -1}}) {
+		t.Fatal(s)
+	}
+	if id := r.Nodes()[s[0][1]].ID(); id != 2 {
+		t.Fatal(id)
+	}
+	// The snapshot is a copy.
+	s[0][0] = 1
+	if r.replicaToPartitionToNodeIndex[0][0] != 0 {
+		t.Fatal(r.replicaToPartitionToNodeIndex[0][0])
+	}
 }
@@ -0,0 +1,144 @@
+package ring
+
+// RingChange describes a new ring set on a TCPMsgRing, for its RingWatchers.
+type RingChange struct {
+	// Previous is the ring replaced, nil for the first ring set, and
+	// PreviousRingVersion its Version, or 0.
+	Previous            Ring
+	PreviousRingVersion int64
+	Ring                Ring
+	RingVersion         int64
+	// Gained are the partitions of the new ring the local node is now
+	// responsible for but was not, wholly, under the previous ring, such as
+	// to fetch data for; Lost are the partitions of the previous ring it was
+	// responsible for but no longer wholly is, such as to hand data off
+	// from; see CompareRings. The local node is that of the new ring; with
+	// none, both are empty.
+	Gained []Partition
+	Lost   []Partition
+}
+
+// RingWatcher is told of each new ring set on a TCPMsgRing; see
+// TCPMsgRing.AddRingWatcher.
+type RingWatcher interface {
+	RingChanged(c *RingChange)
+}
+
+// RingWatcherFunc adapts a func to a RingWatcher.
+type RingWatcherFunc func(c *RingChange)
+
+// RingChanged calls f(c).
+func (f RingWatcherFunc) RingChanged(c *RingChange) {
+	f(c)
+}
+
+// AddRingWatcher registers the watcher to be told by SetRing of each ring
+// version set, with the partitions the local node gained and lost, so
+// services can start handoffs and fetches without diffing rings themselves.
+// Watchers are called in the order added, after the new ring is in use and
+// with no locks held, but calls are serialized and in the order the rings
+// were set; watchers must not call SetRing themselves. Setting a ring of the
+// same version as the current one tells the watchers nothing. The func
+// returned unregisters the watcher.
+func (t *TCPMsgRing) AddRingWatcher(w RingWatcher) func() {
+	entry := &ringWatcherEntry{watcher: w}
+	t.ringWatchersLock.Lock()
+	t.ringWatchers = append(t.ringWatchers, entry)
+	t.ringWatchersLock.Unlock()
+	return func() {
+		t.ringWatchersLock.Lock()
+		for i, e := range t.ringWatchers {
+			if e == entry {
+				t.ringWatchers = append(t.ringWatchers[:i:i], t.ringWatchers[i+1:]...)
+				break
+			}
+		}
+		t.ringWatchersLock.Unlock()
+	}
+}
+
+// ringWatcherEntry gives each registration an identity, as RingWatchers
+// such as RingWatcherFuncs may not be comparable.
+type ringWatcherEntry struct {
+	watcher RingWatcher
+}
+
+// notifyRingWatchers tells the watchers of the ring change; it must be
+// called with setRingLock held, to keep the calls in order.
+func (t *TCPMsgRing) notifyRingWatchers(previous Ring, current Ring) {
+	t.ringWatchersLock.Lock()
+	watchers := t.ringWatchers
+	t.ringWatchersLock.Unlock()
+	if len(watchers) == 0 {
+		return
+	}
+	c := &RingChange{Ring: current, RingVersion: current.Version()}
+	if previous != nil {
+		c.Previous = previous
+		c.PreviousRingVersion = previous.Version()
+	}
+	if localNode := current.LocalNode(); localNode != nil {
+		c.Gained, c.Lost = CompareRings(previous, current, localNode.ID())
+	}
+	for _, e := range watchers {
+		e.watcher.RingChanged(c)
+	}
+}
+
+// CompareRings returns the partitions whose responsibility changed for the
+// node between the previous and current rings, as a replication service
+// needs after a rebalance: gained are the partitions of the current ring the
+// node is responsible for but was not wholly under the previous ring, to
+// fetch data for, and lost are the partitions of the previous ring it was
+// responsible for but no longer wholly is, to hand data off from. Both are
+// in ascending order. Should the partition bit count have changed,
+// partitions are compared with those of the other ring covering them, as
+// with MsgToFormerReplicas, so a split or merge alone changes nothing. A nil
+// previous ring has no partitions, so all the node's are gained.
+//
+// Unlike ChangedPartitions, replicas moving between other nodes do not
+// matter here.
+func CompareRings(previous Ring, current Ring, nodeID uint64) (gained []Partition, lost []Partition) {
+	gained = partitionsNotWhollyHeld(current, previous, nodeID)
+	if previous != nil {
+		lost = partitionsNotWhollyHeld(previous, current, nodeID)
+	}
+	return gained, lost
+}
+
+// partitionsNotWhollyHeld returns the partitions of ring a the node is
+// responsible for where it is not responsible for all the partitions of ring
+// b covering them; b may be nil.
+func partitionsNotWhollyHeld(a Ring, b Ring, nodeID uint64) []Partition {
+	var partitions []Partition
+	partitionCount := Partition(1) << a.PartitionBitCount()
+	for partition := Partition(0); partition < partitionCount; partition++ {
+		if !nodeResponsible(a, partition, nodeID) {
+			continue
+		}
+		if b == nil {
+			partitions = append(partitions, partition)
+			continue
+		}
+		first, last := previousPartitions(a.PartitionBitCount(), b.PartitionBitCount(), partition)
+		for p := first; ; p++ {
+			if !nodeResponsible(b, p, nodeID) {
+				partitions = append(partitions, partition)
+				break
+			}
+			if p == last {
+				break
+			}
+		}
+	}
+	return partitions
+}
+
+func nodeResponsible(r Ring, partition Partition, nodeID uint64) bool {
+	for _, n := range r.ResponsibleNodes(partition) {
+		if n.ID() == nodeID {
+			return true
+		}
+	}
+	return false
+}
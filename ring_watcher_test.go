@@ -0,0 +1,130 @@
+package ring
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTCPMsgRingRingWatcher(t *testing.T) {
+	msgring, _ := NewTCPMsgRing(nil)
+	defer msgring.Shutdown()
+	b := NewBuilder(64)
+	b.SetMaxPartitionBitCount(4)
+	b.SetMoveWait(0)
+	var nodes []BuilderNode
+	for i := 0; i < 3; i++ {
+		n, err := b.AddNode(true, 1, nil, []string{"127.0.0.2:1"}, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, n)
+	}
+	var changes []*RingChange
+	remove := msgring.AddRingWatcher(RingWatcherFunc(func(c *RingChange) {
+		changes = append(changes, c)
+	}))
+	r1 := b.Ring()
+	r1.SetLocalNode(nodes[0].ID())
+	msgring.SetRing(r1)
+	if len(changes) != 1 {
+		t.Fatal(len(changes))
+	}
+	c := changes[0]
+	if c.Previous != nil || c.PreviousRingVersion != 0 || c.Ring != r1 || c.RingVersion != r1.Version() || len(c.Lost) != 0 {
+		t.Fatalf("%#v", c)
+	}
+	partitionCount := Partition(1) << r1.PartitionBitCount()
+	var expected []Partition
+	for p := Partition(0); p < partitionCount; p++ {
+		if r1.Responsible(p) {
+			expected = append(expected, p)
+		}
+	}
+	if len(expected) == 0 || !equalPartitions(c.Gained, expected) {
+		t.Fatalf("%v != %v", c.Gained, expected)
+	}
+	// The same ring version again tells the watchers nothing.
+	msgring.SetRing(r1)
+	if len(changes) != 1 {
+		t.Fatal(len(changes))
+	}
+	if _, err := b.AddNode(true, 1, nil, []string{"127.0.0.3:1"}, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := nodes[1].SetCapacity(3); err != nil {
+		t.Fatal(err)
+	}
+	r2 := b.Ring()
+	r2.SetLocalNode(nodes[0].ID())
+	if r2.PartitionBitCount() != r1.PartitionBitCount() {
+		t.Fatalf("%d != %d", r2.PartitionBitCount(), r1.PartitionBitCount())
+	}
+	msgring.SetRing(r2)
+	if len(changes) != 2 {
+		t.Fatal(len(changes))
+	}
+	c = changes[1]
+	if c.Previous != r1 || c.PreviousRingVersion != r1.Version() || c.RingVersion != r2.Version() {
+		t.Fatalf("%#v", c)
+	}
+	var gained, lost []Partition
+	for p := Partition(0); p < partitionCount; p++ {
+		if r2.Responsible(p) && !r1.Responsible(p) {
+			gained = append(gained, p)
+		}
+		if r1.Responsible(p) && !r2.Responsible(p) {
+			lost = append(lost, p)
+		}
+	}
+	if len(lost) == 0 || !equalPartitions(c.Gained, gained) || !equalPartitions(c.Lost, lost) {
+		t.Fatalf("%v != %v or %v != %v", c.Gained, gained, c.Lost, lost)
+	}
+	remove()
+	r3 := b.Ring()
+	r3.SetLocalNode(nodes[0].ID())
+	msgring.SetRing(r3)
+	if len(changes) != 2 {
+		t.Fatal(len(changes))
+	}
+}
+
+func TestCompareRings(t *testing.T) {
+	previous := newAssignedRing(1, 1, [][]int32{{0, 1}, {1, 2}})
+	for _, c := range []struct {
+		name    string
+		current *ring
+		nodeID  uint64
+		gained  []Partition
+		lost    []Partition
+	}{
+		{"same", newAssignedRing(2, 1, [][]int32{{0, 1}, {1, 2}}), 1, nil, nil},
+		{"moved", newAssignedRing(2, 1, [][]int32{{1, 0}, {2, 2}}), 1, []Partition{1}, []Partition{0}},
+		{"moved away", newAssignedRing(2, 1, [][]int32{{1, 0}, {2, 2}}), 2, nil, []Partition{1}},
+		// Splitting partitions leaves the data where it was.
+		{"split", newAssignedRing(2, 2, [][]int32{{0, 0, 1, 2}, {1, 2, 2, 1}}), 1, nil, nil},
+		{"split moved", newAssignedRing(2, 2, [][]int32{{0, 0, 1, 2}, {1, 2, 2, 1}}), 3, []Partition{1}, nil},
+		{"merged", newAssignedRing(2, 0, [][]int32{{0}, {1}}), 1, []Partition{0}, nil},
+		{"merged away", newAssignedRing(2, 0, [][]int32{{0}, {1}}), 3, nil, []Partition{1}},
+		{"unknown node", newAssignedRing(2, 1, [][]int32{{1, 0}, {2, 2}}), 9, nil, nil},
+	} {
+		gained, lost := CompareRings(previous, c.current, c.nodeID)
+		if !reflect.DeepEqual(gained, c.gained) || !reflect.DeepEqual(lost, c.lost) {
+			t.Errorf("%s: %v %v", c.name, gained, lost)
+		}
+	}
+	if gained, lost := CompareRings(nil, previous, 2); !reflect.DeepEqual(gained, []Partition{0, 1}) || lost != nil {
+		t.Errorf("first ring: %v %v", gained, lost)
+	}
+}
+
+func equalPartitions(a []Partition, b []Partition) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, p := range a {
+		if b[i] != p {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,447 @@
+// Package ringtest provides fakes of the ring package's interfaces for unit
+// tests of code built on rings, so those tests need neither Builders nor
+// sockets: FakeRing answers with scripted responsible nodes and FakeMsgRing
+// records the messages sent rather than sending them.
+package ringtest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gholt/ring"
+)
+
+// FakeNode is a ring.Node with its attributes given by its fields.
+type FakeNode struct {
+	NodeID        uint64
+	Inactive      bool
+	NodeCapacity  uint64
+	NodeTiers     []string
+	NodeAddresses []string
+	NodeMeta      string
+	NodeConfig    []byte
+	Zone          string
+}
+
+func (n *FakeNode) ID() uint64 {
+	return n.NodeID
+}
+
+func (n *FakeNode) Active() bool {
+	return !n.Inactive
+}
+
+func (n *FakeNode) Capacity() uint64 {
+	return n.NodeCapacity
+}
+
+func (n *FakeNode) Tiers() []string {
+	return n.NodeTiers
+}
+
+func (n *FakeNode) Tier(level int) string {
+	if level < 0 || level >= len(n.NodeTiers) {
+		return ""
+	}
+	return n.NodeTiers[level]
+}
+
+func (n *FakeNode) Addresses() []string {
+	return n.NodeAddresses
+}
+
+func (n *FakeNode) Address(index int) string {
+	if index < 0 || index >= len(n.NodeAddresses) {
+		return ""
+	}
+	return n.NodeAddresses[index]
+}
+
+func (n *FakeNode) Meta() string {
+	return n.NodeMeta
+}
+
+func (n *FakeNode) Config() []byte {
+	return n.NodeConfig
+}
+
+func (n *FakeNode) NetworkZone() string {
+	return n.Zone
+}
+
+// FakeRing is a ring.Ring answering from its fields rather than from
+// assignments made by a Builder. Set the fields before use; only the local
+// node, set with SetLocalNode, may be changed while the FakeRing is in use.
+//
+// The nodes responsible for a partition are those ResponsibleFunc returns,
+// if it is set, or else those in Assignments; a partition with neither has
+// no responsible nodes.
+type FakeRing struct {
+	RingVersion     int64
+	RingConfig      []byte
+	RingNodes       ring.NodeSlice
+	Roles           []string
+	Bits            uint16
+	Replicas        int
+	Assignments     map[ring.Partition]ring.NodeSlice
+	ResponsibleFunc func(partition ring.Partition) ring.NodeSlice
+	Modes           map[ring.Partition]ring.PartitionMode
+	// Hasher, if set, hashes keys for PartitionForKey, and HasherName is
+	// what KeyHasher returns; they default to ring.FNV1aKeyHasher and
+	// ring.DefaultKeyHasher.
+	Hasher     ring.KeyHasher
+	HasherName string
+	lock       sync.RWMutex
+	local      ring.Node
+}
+
+var _ ring.Ring = &FakeRing{}
+
+func (r *FakeRing) Version() int64 {
+	return r.RingVersion
+}
+
+func (r *FakeRing) Config() []byte {
+	return r.RingConfig
+}
+
+func (r *FakeRing) Node(nodeID uint64) ring.Node {
+	for _, n := range r.RingNodes {
+		if n.ID() == nodeID {
+			return n
+		}
+	}
+	return nil
+}
+
+func (r *FakeRing) Nodes() ring.NodeSlice {
+	return append(ring.NodeSlice(nil), r.RingNodes...)
+}
+
+func (r *FakeRing) NodeCount() int {
+	return len(r.RingNodes)
+}
+
+func (r *FakeRing) Tiers() [][]string {
+	var tiers [][]string
+	for _, n := range r.RingNodes {
+	NEXT_LEVEL:
+		for level, value := range n.Tiers() {
+			for len(tiers) <= level {
+				tiers = append(tiers, nil)
+			}
+			if value == "" {
+				continue
+			}
+			for _, v := range tiers[level] {
+				if v == value {
+					continue NEXT_LEVEL
+				}
+			}
+			tiers[level] = append(tiers[level], value)
+		}
+	}
+	return tiers
+}
+
+func (r *FakeRing) AddressRoles() []string {
+	return append([]string(nil), r.Roles...)
+}
+
+func (r *FakeRing) AddressIndex(role string) int {
+	for i, name := range r.Roles {
+		if name == role {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r *FakeRing) PartitionBitCount() uint16 {
+	return r.Bits
+}
+
+func (r *FakeRing) ReplicaCount() int {
+	return r.Replicas
+}
+
+func (r *FakeRing) LocalNode() ring.Node {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.local
+}
+
+// SetLocalNode sets the local node to the node in RingNodes with the ID, or
+// to nil if there is none.
+func (r *FakeRing) SetLocalNode(nodeID uint64) {
+	n := r.Node(nodeID)
+	r.lock.Lock()
+	r.local = n
+	r.lock.Unlock()
+}
+
+func (r *FakeRing) PartitionForKey(key []byte) ring.Partition {
+	hasher := r.Hasher
+	if hasher == nil {
+		hasher = ring.FNV1aKeyHasher
+	}
+	return ring.PartitionFromKey(hasher(key), r.Bits)
+}
+
+func (r *FakeRing) KeyHasher() string {
+	if r.HasherName == "" {
+		return ring.DefaultKeyHasher
+	}
+	return r.HasherName
+}
+
+func (r *FakeRing) Responsible(partition ring.Partition) bool {
+	return r.ResponsibleReplica(partition) >= 0
+}
+
+func (r *FakeRing) ResponsibleReplica(partition ring.Partition) int {
+	local := r.LocalNode()
+	if local == nil {
+		return -1
+	}
+	for replica, n := range r.ResponsibleNodes(partition) {
+		if n.ID() == local.ID() {
+			return replica
+		}
+	}
+	return -1
+}
+
+func (r *FakeRing) ResponsibleNodes(partition ring.Partition) ring.NodeSlice {
+	if r.ResponsibleFunc != nil {
+		return r.ResponsibleFunc(partition)
+	}
+	return append(ring.NodeSlice(nil), r.Assignments[partition]...)
+}
+
+// UnassignedReplicas returns how many fewer nodes than ReplicaCount are
+// responsible for the partition.
+func (r *FakeRing) UnassignedReplicas(partition ring.Partition) int {
+	if unassigned := r.Replicas - len(r.ResponsibleNodes(partition)); unassigned > 0 {
+		return unassigned
+	}
+	return 0
+}
+
+// PreferredReplicas orders the responsible nodes by the locality func, if
+// given, or else keeps their order.
+func (r *FakeRing) PreferredReplicas(partition ring.Partition, locality func(n ring.Node) int) ring.NodeSlice {
+	nodes := r.ResponsibleNodes(partition)
+	if locality != nil {
+		sort.SliceStable(nodes, func(i, j int) bool { return locality(nodes[i]) < locality(nodes[j]) })
+	}
+	return nodes
+}
+
+// HandoffNodes returns the first count active nodes of RingNodes that are not
+// responsible for the partition, whatever the mode.
+func (r *FakeRing) HandoffNodes(partition ring.Partition, count int, mode ring.HandoffMode) ring.NodeSlice {
+	responsible := map[uint64]bool{}
+	for _, n := range r.ResponsibleNodes(partition) {
+		responsible[n.ID()] = true
+	}
+	var nodes ring.NodeSlice
+	for _, n := range r.RingNodes {
+		if len(nodes) >= count {
+			break
+		}
+		if n.Active() && !responsible[n.ID()] {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// Stats gives just the counts and capacities; the balance values are left
+// zero.
+func (r *FakeRing) Stats() *ring.Stats {
+	s := &ring.Stats{
+		ReplicaCount:      r.Replicas,
+		PartitionBitCount: r.Bits,
+		PartitionCount:    ring.PartitionCount(r.Bits),
+	}
+	for _, n := range r.RingNodes {
+		if n.Active() {
+			s.ActiveNodeCount++
+			s.ActiveCapacity += n.Capacity()
+		} else {
+			s.InactiveNodeCount++
+			s.InactiveCapacity += n.Capacity()
+		}
+	}
+	return s
+}
+
+func (r *FakeRing) PartitionMode(partition ring.Partition) ring.PartitionMode {
+	return r.Modes[partition]
+}
+
+func (r *FakeRing) PartitionModes() map[ring.Partition]ring.PartitionMode {
+	modes := make(map[ring.Partition]ring.PartitionMode, len(r.Modes))
+	for partition, mode := range r.Modes {
+		if mode != ring.PartitionReadWrite {
+			modes[partition] = mode
+		}
+	}
+	return modes
+}
+
+// AssignmentSnapshot builds the table from ResponsibleNodes for every
+// partition; a responsible node missing from RingNodes is given as -1.
+func (r *FakeRing) AssignmentSnapshot() [][]int32 {
+	indexes := make(map[uint64]int32, len(r.RingNodes))
+	for i, n := range r.RingNodes {
+		indexes[n.ID()] = int32(i)
+	}
+	partitionCount := ring.PartitionCount(r.Bits)
+	snapshot := make([][]int32, r.Replicas)
+	for replica := range snapshot {
+		snapshot[replica] = make([]int32, partitionCount)
+		for partition := range snapshot[replica] {
+			snapshot[replica][partition] = -1
+		}
+	}
+	for partition := 0; partition < partitionCount; partition++ {
+		for replica, n := range r.ResponsibleNodes(ring.Partition(partition)) {
+			if replica >= r.Replicas {
+				break
+			}
+			if i, ok := indexes[n.ID()]; ok {
+				snapshot[replica][partition] = i
+			}
+		}
+	}
+	return snapshot
+}
+
+// Persist always fails; a FakeRing cannot be loaded with ring.LoadRing.
+func (r *FakeRing) Persist(w io.Writer) error {
+	return errors.New("a FakeRing cannot be persisted")
+}
+
+// SentMsg is a message a FakeMsgRing was given to send.
+type SentMsg struct {
+	MsgType uint64
+	// Content is what the message's WriteContent wrote.
+	Content []byte
+	// NodeIDs are the nodes the message was for: the node given to MsgToNode
+	// or, for MsgToOtherReplicas, the responsible nodes other than the local
+	// node, as the FakeMsgRing's Ring had them when the message was sent.
+	NodeIDs []uint64
+	// ToOtherReplicas is true if the message was given to MsgToOtherReplicas,
+	// for the Partition.
+	ToOtherReplicas bool
+	Partition       ring.Partition
+	Timeout         time.Duration
+}
+
+// FakeMsgRing is a ring.MsgRing that records the messages given to it
+// instead of sending them; messages are freed once recorded, as a real
+// MsgRing frees them once sent. Incoming messages can be simulated with
+// Deliver.
+type FakeMsgRing struct {
+	// CurrentRing is what Ring returns; it may be nil, as if no ring is
+	// available yet, in which case MsgToOtherReplicas records no nodes.
+	CurrentRing ring.Ring
+	// MaxLength is what MaxMsgLength returns; 0 means no limit.
+	MaxLength uint64
+	lock      sync.Mutex
+	handlers  map[uint64]ring.MsgUnmarshaller
+	sent      []*SentMsg
+}
+
+var _ ring.MsgRing = &FakeMsgRing{}
+
+func (m *FakeMsgRing) Ring() ring.Ring {
+	return m.CurrentRing
+}
+
+func (m *FakeMsgRing) MaxMsgLength() uint64 {
+	if m.MaxLength == 0 {
+		return ^uint64(0)
+	}
+	return m.MaxLength
+}
+
+func (m *FakeMsgRing) SetMsgHandler(msgType uint64, handler ring.MsgUnmarshaller) {
+	m.lock.Lock()
+	if m.handlers == nil {
+		m.handlers = make(map[uint64]ring.MsgUnmarshaller)
+	}
+	m.handlers[msgType] = handler
+	m.lock.Unlock()
+}
+
+func (m *FakeMsgRing) MsgToNode(msg ring.Msg, nodeID uint64, timeout time.Duration) {
+	m.record(msg, &SentMsg{NodeIDs: []uint64{nodeID}, Timeout: timeout})
+}
+
+func (m *FakeMsgRing) MsgToOtherReplicas(msg ring.Msg, partition ring.Partition, timeout time.Duration) {
+	s := &SentMsg{ToOtherReplicas: true, Partition: partition, Timeout: timeout}
+	if r := m.CurrentRing; r != nil {
+		var localID uint64
+		if local := r.LocalNode(); local != nil {
+			localID = local.ID()
+		}
+		for _, n := range r.ResponsibleNodes(partition) {
+			if n.ID() != localID {
+				s.NodeIDs = append(s.NodeIDs, n.ID())
+			}
+		}
+	}
+	m.record(msg, s)
+}
+
+func (m *FakeMsgRing) record(msg ring.Msg, s *SentMsg) {
+	s.MsgType = msg.MsgType()
+	buf := &bytes.Buffer{}
+	msg.WriteContent(buf)
+	s.Content = buf.Bytes()
+	msg.Free()
+	m.lock.Lock()
+	m.sent = append(m.sent, s)
+	m.lock.Unlock()
+}
+
+// Sent returns the messages recorded so far, in the order given.
+func (m *FakeMsgRing) Sent() []*SentMsg {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]*SentMsg(nil), m.sent...)
+}
+
+// Reset forgets the messages recorded so far.
+func (m *FakeMsgRing) Reset() {
+	m.lock.Lock()
+	m.sent = nil
+	m.lock.Unlock()
+}
+
+// Deliver simulates an incoming message, giving the content to the handler
+// set for the message type; it returns the handler's error or an error if no
+// handler is set or the handler did not read all the content.
+func (m *FakeMsgRing) Deliver(msgType uint64, content []byte) error {
+	m.lock.Lock()
+	handler := m.handlers[msgType]
+	m.lock.Unlock()
+	if handler == nil {
+		return errors.New("no handler for the message type")
+	}
+	n, err := handler(bytes.NewReader(content), uint64(len(content)))
+	if err != nil {
+		return err
+	}
+	if n != uint64(len(content)) {
+		return errors.New("handler did not read all the content")
+	}
+	return nil
+}
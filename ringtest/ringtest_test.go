@@ -0,0 +1,125 @@
+package ringtest
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/gholt/ring"
+)
+
+type testMsg struct {
+	msgType uint64
+	content string
+	freed   bool
+}
+
+func (m *testMsg) MsgType() uint64 {
+	return m.msgType
+}
+
+func (m *testMsg) MsgLength() uint64 {
+	return uint64(len(m.content))
+}
+
+func (m *testMsg) WriteContent(w io.Writer) (uint64, error) {
+	n, err := io.WriteString(w, m.content)
+	return uint64(n), err
+}
+
+func (m *testMsg) Free() {
+	m.freed = true
+}
+
+func testFakeRing() *FakeRing {
+	n1 := &FakeNode{NodeID: 1, NodeCapacity: 100, NodeTiers: []string{"s1", "z1"}}
+	n2 := &FakeNode{NodeID: 2, NodeCapacity: 100, NodeTiers: []string{"s2", "z1"}}
+	n3 := &FakeNode{NodeID: 3, NodeCapacity: 100, NodeTiers: []string{"s3", "z2"}}
+	n4 := &FakeNode{NodeID: 4, NodeCapacity: 50, Inactive: true}
+	return &FakeRing{
+		RingNodes: ring.NodeSlice{n1, n2, n3, n4},
+		Bits:      1,
+		Replicas:  2,
+		Assignments: map[ring.Partition]ring.NodeSlice{
+			0: {n1, n2},
+			1: {n2, n3},
+		},
+	}
+}
+
+func TestFakeRing(t *testing.T) {
+	r := testFakeRing()
+	var l ring.Locator = r
+	if l.Responsible(0) {
+		t.Fatal("responsible without a local node")
+	}
+	r.SetLocalNode(3)
+	if l.LocalNode().ID() != 3 {
+		t.Fatal(l.LocalNode())
+	}
+	if l.Responsible(0) || !l.Responsible(1) || r.ResponsibleReplica(1) != 1 {
+		t.Fatal(r.ResponsibleReplica(0), r.ResponsibleReplica(1))
+	}
+	handoffs := r.HandoffNodes(0, 5, ring.HandoffDeterministic)
+	if len(handoffs) != 1 || handoffs[0].ID() != 3 {
+		t.Fatal(handoffs)
+	}
+	snapshot := r.AssignmentSnapshot()
+	if snapshot[0][0] != 0 || snapshot[1][0] != 1 || snapshot[0][1] != 1 || snapshot[1][1] != 2 {
+		t.Fatal(snapshot)
+	}
+	if tiers := r.Tiers(); len(tiers) != 2 || len(tiers[0]) != 3 || len(tiers[1]) != 2 {
+		t.Fatal(tiers)
+	}
+	s := r.Stats()
+	if s.ActiveNodeCount != 3 || s.InactiveNodeCount != 1 || s.ActiveCapacity != 300 || s.PartitionCount != 2 {
+		t.Fatal(s)
+	}
+	r.ResponsibleFunc = func(partition ring.Partition) ring.NodeSlice {
+		return r.RingNodes[2:3]
+	}
+	if !r.Responsible(0) || r.UnassignedReplicas(0) != 1 {
+		t.Fatal(r.ResponsibleNodes(0))
+	}
+}
+
+func TestFakeMsgRing(t *testing.T) {
+	r := testFakeRing()
+	r.SetLocalNode(2)
+	m := &FakeMsgRing{CurrentRing: r}
+	var s ring.MsgSender = m
+	msg1 := &testMsg{msgType: 7, content: "one"}
+	s.MsgToNode(msg1, 3, time.Second)
+	msg2 := &testMsg{msgType: 8, content: "two"}
+	s.MsgToOtherReplicas(msg2, 1, time.Second)
+	if !msg1.freed || !msg2.freed {
+		t.Fatal(msg1.freed, msg2.freed)
+	}
+	sent := m.Sent()
+	if len(sent) != 2 {
+		t.Fatal(len(sent))
+	}
+	if sent[0].MsgType != 7 || string(sent[0].Content) != "one" || len(sent[0].NodeIDs) != 1 || sent[0].NodeIDs[0] != 3 || sent[0].ToOtherReplicas {
+		t.Fatal(sent[0])
+	}
+	if sent[1].MsgType != 8 || !sent[1].ToOtherReplicas || sent[1].Partition != 1 || len(sent[1].NodeIDs) != 1 || sent[1].NodeIDs[0] != 3 {
+		t.Fatal(sent[1])
+	}
+	m.Reset()
+	if len(m.Sent()) != 0 {
+		t.Fatal(m.Sent())
+	}
+	var got string
+	m.SetMsgHandler(7, func(reader io.Reader, desiredBytesToRead uint64) (uint64, error) {
+		b, err := ioutil.ReadAll(io.LimitReader(reader, int64(desiredBytesToRead)))
+		got = string(b)
+		return uint64(len(b)), err
+	})
+	if err := m.Deliver(7, []byte("hello")); err != nil || got != "hello" {
+		t.Fatal(err, got)
+	}
+	if err := m.Deliver(8, []byte("hello")); err == nil {
+		t.Fatal("delivered without a handler")
+	}
+}
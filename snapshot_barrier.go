@@ -0,0 +1,466 @@
+package ring
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SNAPSHOT_BARRIER_MSG_TYPE is the default message type used by the
+// SnapshotBarrier.
+const SNAPSHOT_BARRIER_MSG_TYPE = 0x5d38a1e06bf9c427
+
+// barrierMsgLength is the wire length of a barrier message: kind, barrier ID,
+// ring version, and sender node ID.
+const barrierMsgLength = 1 + 8 + 8 + 8
+
+const (
+	barrierRequest byte = iota + 1
+	barrierAck
+	// propagationRequest is a barrierRequest acknowledged without draining;
+	// see SnapshotBarrier.Propagation.
+	propagationRequest
+)
+
+// SnapshotBarrierConfig represents the set of values for configuring a
+// SnapshotBarrier.
+type SnapshotBarrierConfig struct {
+	// LogDebug sets the func to use for debug messages. Defaults not logging
+	// debug messages.
+	LogDebug LogFunc
+	// MsgType is the message type to use for barrier messages. Defaults to
+	// SNAPSHOT_BARRIER_MSG_TYPE.
+	MsgType uint64
+	// MsgTimeout indicates how many milliseconds to wait when queueing
+	// barrier messages for delivery. Defaults to 1000 milliseconds.
+	MsgTimeout int
+	// Interval indicates how many milliseconds to wait between resending
+	// requests to nodes that have not acknowledged a barrier, as messages may
+	// be dropped, and between checks of the local ring version while waiting
+	// to switch to a barrier's version. Defaults to 1000 milliseconds.
+	Interval int
+	// SwitchTimeout indicates how many seconds a node waits to switch to the
+	// ring version of a barrier it is asked to join before giving up on it.
+	// Defaults to 60 seconds.
+	SwitchTimeout int
+	// Drain will be called once the local node has switched to the ring
+	// version of a barrier, or a later one, and should return once all
+	// traffic based on earlier ring versions has completed, such as requests
+	// in flight and data being handed off; the node acknowledges the barrier
+	// once it returns without error. It is called from its own goroutine and
+	// may block. Defaults to returning immediately.
+	Drain func(ringVersion int64) error
+}
+
+func resolveSnapshotBarrierConfig(c *SnapshotBarrierConfig) *SnapshotBarrierConfig {
+	cfg := &SnapshotBarrierConfig{}
+	if c != nil {
+		*cfg = *c
+	}
+	if cfg.MsgType == 0 {
+		cfg.MsgType = SNAPSHOT_BARRIER_MSG_TYPE
+	}
+	if cfg.MsgTimeout < 1 {
+		cfg.MsgTimeout = 1000
+	}
+	if cfg.Interval < 1 {
+		cfg.Interval = 1000
+	}
+	if cfg.SwitchTimeout < 1 {
+		cfg.SwitchTimeout = 60
+	}
+	return cfg
+}
+
+// BarrierResult is the outcome of SnapshotBarrier.Barrier.
+type BarrierResult struct {
+	RingVersion int64
+	// Acked are the IDs of the nodes that acknowledged the barrier and
+	// Missing those that did not, each in ascending order.
+	Acked   []uint64
+	Missing []uint64
+}
+
+// SnapshotBarrier coordinates a cluster-wide barrier at a ring version: once
+// Barrier returns without error, every active node of the ring has switched
+// to that ring version, or a later one, and has drained the traffic based on
+// earlier versions, so backup and migration tooling can take a consistent
+// snapshot of where all the data lives.
+//
+// Every node runs a SnapshotBarrier over its MsgRing to take part; any of
+// them may coordinate a barrier by calling Barrier. As with all MsgRing
+// messaging, messages may be dropped, so requests are resent to the nodes
+// that have not yet acknowledged until the barrier's timeout.
+type SnapshotBarrier struct {
+	msgRing       MsgRing
+	logDebug      LogFunc
+	msgType       uint64
+	msgTimeout    time.Duration
+	interval      time.Duration
+	switchTimeout time.Duration
+	drain         func(ringVersion int64) error
+	lock          sync.Mutex
+	pending       map[uint64]*pendingBarrier
+	joined        map[uint64]*joinedBarrier
+
+	barriers          int32
+	propagations      int32
+	barrierTimeouts   int32
+	requests          int32
+	acks              int32
+	joins             int32
+	switchTimeouts    int32
+	drainErrors       int32
+	receiveReadErrors int32
+}
+
+type pendingBarrier struct {
+	ringVersion int64
+	waiting     map[uint64]bool
+	// needed is how many acknowledgements complete the barrier.
+	needed   int
+	acked    int
+	doneChan chan struct{}
+}
+
+type joinedBarrier struct {
+	coordinatorID uint64
+	acked         bool
+	at            time.Time
+}
+
+// NewSnapshotBarrier creates a SnapshotBarrier that will use the MsgRing for
+// its messaging; it takes part in barriers coordinated by other nodes as soon
+// as it is created.
+func NewSnapshotBarrier(msgRing MsgRing, c *SnapshotBarrierConfig) *SnapshotBarrier {
+	cfg := resolveSnapshotBarrierConfig(c)
+	sb := &SnapshotBarrier{
+		msgRing:       msgRing,
+		logDebug:      cfg.LogDebug,
+		msgType:       cfg.MsgType,
+		msgTimeout:    time.Duration(cfg.MsgTimeout) * time.Millisecond,
+		interval:      time.Duration(cfg.Interval) * time.Millisecond,
+		switchTimeout: time.Duration(cfg.SwitchTimeout) * time.Second,
+		drain:         cfg.Drain,
+		pending:       make(map[uint64]*pendingBarrier),
+		joined:        make(map[uint64]*joinedBarrier),
+	}
+	if sb.logDebug == nil {
+		sb.logDebug = nilLogFunc
+	}
+	msgRing.SetMsgHandler(sb.msgType, sb.handle)
+	return sb
+}
+
+// Barrier coordinates a barrier at the ring version given, which must be the
+// version of the local node's current ring, waiting up to the timeout for all
+// the ring's active nodes, including the local node, to acknowledge it. If
+// any do not, the result lists them and an error is returned.
+func (sb *SnapshotBarrier) Barrier(ringVersion int64, timeout time.Duration) (*BarrierResult, error) {
+	atomic.AddInt32(&sb.barriers, 1)
+	r := sb.msgRing.Ring()
+	if r == nil || r.Version() != ringVersion {
+		return nil, fmt.Errorf("barrier at ring version %d: not the local ring version", ringVersion)
+	}
+	result, err := sb.coordinate(barrierRequest, r, 0, timeout, nil)
+	if err != nil {
+		return result, fmt.Errorf("barrier at ring version %d: %s", ringVersion, err)
+	}
+	return result, nil
+}
+
+// Propagation waits up to the timeout for the active nodes of the ring given
+// to acknowledge they have switched to its version, or a later one, without
+// the draining of a Barrier; such as for a publisher to learn when a new ring
+// has reached the cluster, see RingPublishNotifier. Unlike Barrier, the ring
+// need not be the local node's, though the local node must be in the MsgRing's
+// ring to receive the acknowledgements. Should quorum be more than 0, the
+// wait ends once that many nodes have acknowledged; otherwise all must. If the
+// wait ends short of that, the result lists the nodes that did not
+// acknowledge and an error is returned.
+func (sb *SnapshotBarrier) Propagation(r Ring, quorum int, timeout time.Duration) (*BarrierResult, error) {
+	return sb.propagation(r, quorum, timeout, nil)
+}
+
+// propagation is Propagation, also ending the wait should cancelChan close.
+func (sb *SnapshotBarrier) propagation(r Ring, quorum int, timeout time.Duration, cancelChan chan struct{}) (*BarrierResult, error) {
+	atomic.AddInt32(&sb.propagations, 1)
+	result, err := sb.coordinate(propagationRequest, r, quorum, timeout, cancelChan)
+	if err != nil {
+		return result, fmt.Errorf("propagation of ring version %d: %s", r.Version(), err)
+	}
+	return result, nil
+}
+
+// coordinate sends the request for the ring's version to its active nodes
+// until quorum of them, or all if quorum is 0, acknowledge, the timeout
+// passes, or cancelChan, if not nil, closes.
+func (sb *SnapshotBarrier) coordinate(kind byte, r Ring, quorum int, timeout time.Duration, cancelChan chan struct{}) (*BarrierResult, error) {
+	ringVersion := r.Version()
+	localRing := sb.msgRing.Ring()
+	if localRing == nil || localRing.LocalNode() == nil {
+		return nil, fmt.Errorf("no local node")
+	}
+	localNode := localRing.LocalNode()
+	p := &pendingBarrier{ringVersion: ringVersion, waiting: make(map[uint64]bool), doneChan: make(chan struct{})}
+	result := &BarrierResult{RingVersion: ringVersion}
+	for _, n := range r.Nodes() {
+		if n.Active() {
+			p.waiting[n.ID()] = true
+		}
+	}
+	p.needed = len(p.waiting)
+	if quorum > 0 && quorum < p.needed {
+		p.needed = quorum
+	}
+	if p.needed == 0 {
+		return result, nil
+	}
+	all := make([]uint64, 0, len(p.waiting))
+	for nodeID := range p.waiting {
+		all = append(all, nodeID)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	barrierID := uint64(rand.Int63())<<1 | 1
+	sb.lock.Lock()
+	sb.pending[barrierID] = p
+	sb.lock.Unlock()
+	sb.logDebug("snapshot barrier: %016x at ring version %d for %d nodes\n", barrierID, ringVersion, len(all))
+	deadline := time.After(timeout)
+	for timedOut := false; !timedOut; {
+		sb.lock.Lock()
+		var waiting []uint64
+		for _, nodeID := range all {
+			if p.waiting[nodeID] {
+				waiting = append(waiting, nodeID)
+			}
+		}
+		sb.lock.Unlock()
+		for _, nodeID := range waiting {
+			atomic.AddInt32(&sb.requests, 1)
+			m := &barrierMsg{msgType: sb.msgType, kind: kind, barrierID: barrierID, ringVersion: ringVersion, nodeID: localNode.ID()}
+			if nodeID == localNode.ID() {
+				sb.join(m)
+			} else {
+				sb.msgRing.MsgToNode(m, nodeID, sb.msgTimeout)
+			}
+		}
+		select {
+		case <-p.doneChan:
+			timedOut = true
+		case <-deadline:
+			timedOut = true
+		case <-cancelChan:
+			timedOut = true
+		case <-time.After(sb.interval):
+		}
+	}
+	sb.lock.Lock()
+	delete(sb.pending, barrierID)
+	for _, nodeID := range all {
+		if p.waiting[nodeID] {
+			result.Missing = append(result.Missing, nodeID)
+		} else {
+			result.Acked = append(result.Acked, nodeID)
+		}
+	}
+	sb.lock.Unlock()
+	if len(result.Acked) < p.needed {
+		atomic.AddInt32(&sb.barrierTimeouts, 1)
+		return result, fmt.Errorf("%d of %d nodes did not acknowledge", len(result.Missing), len(all))
+	}
+	return result, nil
+}
+
+func (sb *SnapshotBarrier) handle(reader io.Reader, desiredBytesToRead uint64) (uint64, error) {
+	if desiredBytesToRead != barrierMsgLength {
+		atomic.AddInt32(&sb.receiveReadErrors, 1)
+		n, err := io.CopyN(ioutil.Discard, reader, int64(desiredBytesToRead))
+		return uint64(n), err
+	}
+	var buf [barrierMsgLength]byte
+	n, err := io.ReadFull(reader, buf[:])
+	if err != nil {
+		atomic.AddInt32(&sb.receiveReadErrors, 1)
+		return uint64(n), err
+	}
+	m := &barrierMsg{msgType: sb.msgType}
+	m.unmarshal(buf[:])
+	switch m.kind {
+	case barrierRequest, propagationRequest:
+		sb.join(m)
+	case barrierAck:
+		sb.ack(m.barrierID, m.nodeID)
+	default:
+		atomic.AddInt32(&sb.receiveReadErrors, 1)
+	}
+	return uint64(n), nil
+}
+
+// ack records the node's acknowledgement of the barrier coordinated locally.
+func (sb *SnapshotBarrier) ack(barrierID uint64, nodeID uint64) {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	p := sb.pending[barrierID]
+	if p == nil || !p.waiting[nodeID] {
+		return
+	}
+	atomic.AddInt32(&sb.acks, 1)
+	delete(p.waiting, nodeID)
+	p.acked++
+	if p.acked == p.needed {
+		close(p.doneChan)
+	}
+}
+
+// join has the local node take part in the barrier requested, acknowledging
+// it right away if already done; otherwise the waiting and draining happens
+// in the background, and a request repeated meanwhile is ignored.
+func (sb *SnapshotBarrier) join(m *barrierMsg) {
+	now := time.Now()
+	sb.lock.Lock()
+	for barrierID, j := range sb.joined {
+		if now.Sub(j.at) > sb.switchTimeout*2 {
+			delete(sb.joined, barrierID)
+		}
+	}
+	j := sb.joined[m.barrierID]
+	if j == nil {
+		j = &joinedBarrier{coordinatorID: m.nodeID, at: now}
+		sb.joined[m.barrierID] = j
+		sb.lock.Unlock()
+		atomic.AddInt32(&sb.joins, 1)
+		go sb.participate(m.barrierID, m.ringVersion, m.kind == barrierRequest, j)
+		return
+	}
+	acked := j.acked
+	sb.lock.Unlock()
+	if acked {
+		sb.sendAck(m.barrierID, m.ringVersion, j.coordinatorID)
+	}
+}
+
+// participate waits for the local ring to reach the barrier's ring version,
+// drains if asked to, and acknowledges the barrier.
+func (sb *SnapshotBarrier) participate(barrierID uint64, ringVersion int64, drain bool, j *joinedBarrier) {
+	deadline := time.Now().Add(sb.switchTimeout)
+	for {
+		if r := sb.msgRing.Ring(); r != nil && r.Version() >= ringVersion {
+			break
+		}
+		if time.Now().After(deadline) {
+			atomic.AddInt32(&sb.switchTimeouts, 1)
+			sb.logDebug("snapshot barrier: %016x: gave up waiting for ring version %d\n", barrierID, ringVersion)
+			return
+		}
+		time.Sleep(sb.interval)
+	}
+	if drain && sb.drain != nil {
+		if err := sb.drain(ringVersion); err != nil {
+			atomic.AddInt32(&sb.drainErrors, 1)
+			sb.logDebug("snapshot barrier: %016x: drain: %s\n", barrierID, err)
+			// Forgetting the barrier lets a resent request try again.
+			sb.lock.Lock()
+			delete(sb.joined, barrierID)
+			sb.lock.Unlock()
+			return
+		}
+	}
+	sb.lock.Lock()
+	j.acked = true
+	sb.lock.Unlock()
+	sb.sendAck(barrierID, ringVersion, j.coordinatorID)
+}
+
+func (sb *SnapshotBarrier) sendAck(barrierID uint64, ringVersion int64, coordinatorID uint64) {
+	r := sb.msgRing.Ring()
+	if r == nil || r.LocalNode() == nil {
+		return
+	}
+	localID := r.LocalNode().ID()
+	if coordinatorID == localID {
+		sb.ack(barrierID, localID)
+		return
+	}
+	sb.msgRing.MsgToNode(&barrierMsg{msgType: sb.msgType, kind: barrierAck, barrierID: barrierID, ringVersion: ringVersion, nodeID: localID}, coordinatorID, sb.msgTimeout)
+}
+
+// SnapshotBarrierStats gives an overview of the SnapshotBarrier activity.
+type SnapshotBarrierStats struct {
+	Barriers          int32
+	Propagations      int32
+	BarrierTimeouts   int32
+	Requests          int32
+	Acks              int32
+	Joins             int32
+	SwitchTimeouts    int32
+	DrainErrors       int32
+	ReceiveReadErrors int32
+}
+
+// Stats returns the current stat counters and resets those counters.
+func (sb *SnapshotBarrier) Stats() *SnapshotBarrierStats {
+	s := &SnapshotBarrierStats{
+		Barriers:          atomic.LoadInt32(&sb.barriers),
+		Propagations:      atomic.LoadInt32(&sb.propagations),
+		BarrierTimeouts:   atomic.LoadInt32(&sb.barrierTimeouts),
+		Requests:          atomic.LoadInt32(&sb.requests),
+		Acks:              atomic.LoadInt32(&sb.acks),
+		Joins:             atomic.LoadInt32(&sb.joins),
+		SwitchTimeouts:    atomic.LoadInt32(&sb.switchTimeouts),
+		DrainErrors:       atomic.LoadInt32(&sb.drainErrors),
+		ReceiveReadErrors: atomic.LoadInt32(&sb.receiveReadErrors),
+	}
+	atomic.AddInt32(&sb.barriers, -s.Barriers)
+	atomic.AddInt32(&sb.propagations, -s.Propagations)
+	atomic.AddInt32(&sb.barrierTimeouts, -s.BarrierTimeouts)
+	atomic.AddInt32(&sb.requests, -s.Requests)
+	atomic.AddInt32(&sb.acks, -s.Acks)
+	atomic.AddInt32(&sb.joins, -s.Joins)
+	atomic.AddInt32(&sb.switchTimeouts, -s.SwitchTimeouts)
+	atomic.AddInt32(&sb.drainErrors, -s.DrainErrors)
+	atomic.AddInt32(&sb.receiveReadErrors, -s.ReceiveReadErrors)
+	return s
+}
+
+type barrierMsg struct {
+	msgType     uint64
+	kind        byte
+	barrierID   uint64
+	ringVersion int64
+	nodeID      uint64
+}
+
+func (m *barrierMsg) MsgType() uint64 {
+	return m.msgType
+}
+
+func (m *barrierMsg) MsgLength() uint64 {
+	return barrierMsgLength
+}
+
+func (m *barrierMsg) WriteContent(w io.Writer) (uint64, error) {
+	var buf [barrierMsgLength]byte
+	buf[0] = m.kind
+	binary.BigEndian.PutUint64(buf[1:], m.barrierID)
+	binary.BigEndian.PutUint64(buf[9:], uint64(m.ringVersion))
+	binary.BigEndian.PutUint64(buf[17:], m.nodeID)
+	n, err := w.Write(buf[:])
+	return uint64(n), err
+}
+
+func (m *barrierMsg) Free() {
+}
+
+func (m *barrierMsg) unmarshal(buf []byte) {
+	m.kind = buf[0]
+	m.barrierID = binary.BigEndian.Uint64(buf[1:])
+	m.ringVersion = int64(binary.BigEndian.Uint64(buf[9:]))
+	m.nodeID = binary.BigEndian.Uint64(buf[17:])
+}
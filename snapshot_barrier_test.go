@@ -0,0 +1,151 @@
+package ring
+
+import (
+	"bytes"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// routeBarrierMsgs hands each recorded message of the msg rings to the
+// handlers of the msg ring of the node it was sent to.
+func routeBarrierMsgs(t *testing.T, msgRings map[uint64]*testMsgRing) {
+	for _, from := range msgRings {
+		from.sentLock.Lock()
+		sent := from.sent
+		from.sent = nil
+		from.sentLock.Unlock()
+		for _, s := range sent {
+			to := msgRings[s.nodeID]
+			if to == nil {
+				continue
+			}
+			to.handlersLock.RLock()
+			handler := to.handlers[s.msgType]
+			to.handlersLock.RUnlock()
+			if _, err := handler(bytes.NewBuffer(s.content), uint64(len(s.content))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestSnapshotBarrier(t *testing.T) {
+	b := NewBuilder(64)
+	var ids []uint64
+	for i := 0; i < 3; i++ {
+		n, err := b.AddNode(true, 1, nil, nil, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, n.ID())
+	}
+	msgRings := make(map[uint64]*testMsgRing)
+	barriers := make(map[uint64]*SnapshotBarrier)
+	var drains int32
+	var failDrain int32
+	for _, id := range ids {
+		r := b.Ring()
+		r.SetLocalNode(id)
+		msgRings[id] = newTestMsgRing(r)
+		drainID := id
+		barriers[id] = NewSnapshotBarrier(msgRings[id], &SnapshotBarrierConfig{
+			Interval: 10,
+			Drain: func(ringVersion int64) error {
+				if drainID == ids[2] && atomic.LoadInt32(&failDrain) != 0 {
+					return errors.New("still draining")
+				}
+				atomic.AddInt32(&drains, 1)
+				return nil
+			},
+		})
+	}
+	version := msgRings[ids[0]].Ring().Version()
+	barrier := func(timeout time.Duration) (*BarrierResult, error) {
+		type outcome struct {
+			result *BarrierResult
+			err    error
+		}
+		outcomeChan := make(chan outcome, 1)
+		go func() {
+			result, err := barriers[ids[0]].Barrier(version, timeout)
+			outcomeChan <- outcome{result, err}
+		}()
+		for {
+			select {
+			case o := <-outcomeChan:
+				routeBarrierMsgs(t, msgRings)
+				return o.result, o.err
+			case <-time.After(time.Millisecond):
+				routeBarrierMsgs(t, msgRings)
+			}
+		}
+	}
+	result, err := barrier(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RingVersion != version || len(result.Acked) != 3 || len(result.Missing) != 0 {
+		t.Fatalf("%#v", result)
+	}
+	if d := atomic.LoadInt32(&drains); d != 3 {
+		t.Fatal(d)
+	}
+	if s := barriers[ids[0]].Stats(); s.Barriers != 1 || s.Acks != 3 || s.BarrierTimeouts != 0 {
+		t.Fatalf("%#v", s)
+	}
+	// A node that cannot drain keeps the barrier from completing.
+	atomic.StoreInt32(&failDrain, 1)
+	result, err = barrier(100 * time.Millisecond)
+	if err == nil {
+		t.Fatal("barrier completed without a drained node")
+	}
+	if len(result.Acked) != 2 || len(result.Missing) != 1 || result.Missing[0] != ids[2] {
+		t.Fatalf("%#v", result)
+	}
+	if s := barriers[ids[2]].Stats(); s.DrainErrors == 0 {
+		t.Fatalf("%#v", s)
+	}
+	// A barrier can only be coordinated at the local ring version.
+	if _, err = barriers[ids[0]].Barrier(version+1, time.Second); err == nil {
+		t.Fatal("barrier at another ring version accepted")
+	}
+}
+
+func TestSnapshotBarrierWaitsForRingVersion(t *testing.T) {
+	b := NewBuilder(64)
+	n, err := b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := b.Ring()
+	r.SetLocalNode(n.ID())
+	mr := newTestMsgRing(r)
+	sb := NewSnapshotBarrier(mr, &SnapshotBarrierConfig{Interval: 10, SwitchTimeout: 1})
+	// A request for a version the node has not switched to goes unanswered.
+	sb.join(&barrierMsg{kind: barrierRequest, barrierID: 1, ringVersion: r.Version() + 1, nodeID: n.ID() + 1})
+	// A request for the current version is acknowledged to the coordinator.
+	sb.join(&barrierMsg{kind: barrierRequest, barrierID: 2, ringVersion: r.Version(), nodeID: n.ID() + 1})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mr.sentLock.Lock()
+		sent := len(mr.sent)
+		mr.sentLock.Unlock()
+		if sent > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no ack sent")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	m := &barrierMsg{}
+	m.unmarshal(mr.sent[0].content)
+	if len(mr.sent) != 1 || mr.sent[0].nodeID != n.ID()+1 || m.kind != barrierAck || m.barrierID != 2 || m.nodeID != n.ID() {
+		t.Fatalf("%#v %#v", mr.sent[0], m)
+	}
+	if s := sb.Stats(); s.Joins != 2 || s.SwitchTimeouts != 0 {
+		t.Fatalf("%#v", s)
+	}
+}
@@ -0,0 +1,399 @@
+package ring
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// STREAM_TRANSFER_MSG_TYPE is the default message type used by the
+// StreamTransfer.
+const STREAM_TRANSFER_MSG_TYPE = 0x6f1c0b7e94a25d33
+
+// streamChunkHeaderLength is the wire length of a chunk header: stream ID,
+// sender node ID, sequence number, and flags.
+const streamChunkHeaderLength = 8 + 8 + 4 + 1
+
+const (
+	streamChunkFlagLast  = 1
+	streamChunkFlagAbort = 2
+)
+
+// ErrStreamChunkMissing is returned when reading an IncomingStream after a
+// chunk of the stream was lost in transit.
+var ErrStreamChunkMissing = errors.New("stream chunk missing")
+
+// ErrStreamAborted is returned when reading an IncomingStream whose sender
+// aborted the transfer, usually due to an error reading its source.
+var ErrStreamAborted = errors.New("stream aborted by sender")
+
+// ErrStreamTimedOut is returned when reading an IncomingStream that received
+// no chunks within the configured StreamTimeout.
+var ErrStreamTimedOut = errors.New("stream timed out")
+
+// StreamTransferConfig represents the set of values for configuring a
+// StreamTransfer.
+type StreamTransferConfig struct {
+	// MsgType is the message type to use for stream chunk messages. Defaults
+	// to STREAM_TRANSFER_MSG_TYPE.
+	MsgType uint64
+	// ChunkSize indicates the maximum number of content bytes per chunk
+	// message. Defaults to 65,536 bytes.
+	ChunkSize int
+	// MsgTimeout indicates how many milliseconds to wait when queueing each
+	// chunk for delivery. Defaults to 5000 milliseconds.
+	MsgTimeout int
+	// BytesPerSecond throttles outgoing streams to the rate given; 0 means
+	// no throttling.
+	BytesPerSecond int
+	// BufferedChunks indicates how many received chunks may be buffered per
+	// incoming stream waiting to be read by the handler; if the handler falls
+	// further behind the stream will fail. Defaults to 64.
+	BufferedChunks int
+	// StreamTimeout indicates how many seconds an incoming stream may go
+	// without receiving a chunk before being failed. Defaults to 60 seconds.
+	StreamTimeout int
+}
+
+func resolveStreamTransferConfig(c *StreamTransferConfig) *StreamTransferConfig {
+	cfg := &StreamTransferConfig{}
+	if c != nil {
+		*cfg = *c
+	}
+	if cfg.MsgType == 0 {
+		cfg.MsgType = STREAM_TRANSFER_MSG_TYPE
+	}
+	if cfg.ChunkSize < 1 {
+		cfg.ChunkSize = 65536
+	}
+	if cfg.MsgTimeout < 1 {
+		cfg.MsgTimeout = 5000
+	}
+	if cfg.BytesPerSecond < 0 {
+		cfg.BytesPerSecond = 0
+	}
+	if cfg.BufferedChunks < 1 {
+		cfg.BufferedChunks = 64
+	}
+	if cfg.StreamTimeout < 1 {
+		cfg.StreamTimeout = 60
+	}
+	return cfg
+}
+
+// StreamTransfer sends arbitrary io.Reader content, such as a partition
+// tarball, to other nodes as a sequence of framed chunk messages and
+// reassembles such streams on the receiving side.
+//
+// Like all MsgRing messaging, chunks may be dropped; the receiver will detect
+// the missing chunk and the IncomingStream reads will fail with
+// ErrStreamChunkMissing. Applications should acknowledge completed transfers
+// themselves and resend as needed.
+type StreamTransfer struct {
+	msgRing        MsgRing
+	msgType        uint64
+	chunkSize      int
+	msgTimeout     time.Duration
+	bytesPerSecond int
+	bufferedChunks int
+	streamTimeout  time.Duration
+	handler        func(s *IncomingStream)
+	idSource       *rand.Rand
+	idLock         sync.Mutex
+	streamsLock    sync.Mutex
+	streams        map[streamKey]*IncomingStream
+
+	chunksSent     int32
+	chunksReceived int32
+	streamsStarted int32
+	streamsFailed  int32
+}
+
+type streamKey struct {
+	nodeID   uint64
+	streamID uint64
+}
+
+// NewStreamTransfer creates a StreamTransfer that will use the MsgRing for
+// its messaging. The handler will be called, in its own goroutine, for each
+// new IncomingStream; it may be nil if this StreamTransfer will only be used
+// to send.
+func NewStreamTransfer(msgRing MsgRing, c *StreamTransferConfig, handler func(s *IncomingStream)) *StreamTransfer {
+	cfg := resolveStreamTransferConfig(c)
+	st := &StreamTransfer{
+		msgRing:        msgRing,
+		msgType:        cfg.MsgType,
+		chunkSize:      cfg.ChunkSize,
+		msgTimeout:     time.Duration(cfg.MsgTimeout) * time.Millisecond,
+		bytesPerSecond: cfg.BytesPerSecond,
+		bufferedChunks: cfg.BufferedChunks,
+		streamTimeout:  time.Duration(cfg.StreamTimeout) * time.Second,
+		handler:        handler,
+		idSource:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		streams:        make(map[streamKey]*IncomingStream),
+	}
+	msgRing.SetMsgHandler(st.msgType, st.handle)
+	return st
+}
+
+// Send streams the content of the reader to the node, returning once the
+// reader has been exhausted and all chunks have been handed off by the
+// MsgRing. The progress func, if not nil, will be called after each chunk
+// with the total number of content bytes handed off so far.
+func (st *StreamTransfer) Send(nodeID uint64, reader io.Reader, progress func(sent uint64)) error {
+	r := st.msgRing.Ring()
+	if r == nil {
+		return errors.New("no ring")
+	}
+	localNode := r.LocalNode()
+	if localNode == nil {
+		return errors.New("no local node")
+	}
+	st.idLock.Lock()
+	streamID := uint64(st.idSource.Int63())
+	st.idLock.Unlock()
+	start := time.Now()
+	var sent uint64
+	buf := make([]byte, st.chunkSize)
+	for sequence := uint32(0); ; sequence++ {
+		n, err := io.ReadFull(reader, buf)
+		var flags byte
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			flags = streamChunkFlagLast
+		} else if err != nil {
+			flags = streamChunkFlagAbort
+			n = 0
+		}
+		msg := &streamChunkMsg{
+			msgType:   st.msgType,
+			streamID:  streamID,
+			nodeID:    localNode.ID(),
+			sequence:  sequence,
+			flags:     flags,
+			content:   buf[:n],
+			freedChan: make(chan struct{}),
+		}
+		st.msgRing.MsgToNode(msg, nodeID, st.msgTimeout)
+		// Waiting for the msg to be freed keeps chunks in order and the
+		// buffer safe to reuse.
+		<-msg.freedChan
+		atomic.AddInt32(&st.chunksSent, 1)
+		if flags&streamChunkFlagAbort != 0 {
+			return err
+		}
+		sent += uint64(n)
+		if progress != nil {
+			progress(sent)
+		}
+		if flags&streamChunkFlagLast != 0 {
+			return nil
+		}
+		if st.bytesPerSecond > 0 {
+			expected := time.Duration(sent) * time.Second / time.Duration(st.bytesPerSecond)
+			if elapsed := time.Since(start); elapsed < expected {
+				time.Sleep(expected - elapsed)
+			}
+		}
+	}
+}
+
+func (st *StreamTransfer) handle(reader io.Reader, desiredBytesToRead uint64) (uint64, error) {
+	if desiredBytesToRead < streamChunkHeaderLength {
+		n, err := io.CopyN(ioutil.Discard, reader, int64(desiredBytesToRead))
+		return uint64(n), err
+	}
+	var header [streamChunkHeaderLength]byte
+	n, err := io.ReadFull(reader, header[:])
+	if err != nil {
+		return uint64(n), err
+	}
+	content := make([]byte, desiredBytesToRead-streamChunkHeaderLength)
+	n2, err := io.ReadFull(reader, content)
+	if err != nil {
+		return uint64(n + n2), err
+	}
+	atomic.AddInt32(&st.chunksReceived, 1)
+	key := streamKey{
+		streamID: binary.BigEndian.Uint64(header[0:]),
+		nodeID:   binary.BigEndian.Uint64(header[8:]),
+	}
+	sequence := binary.BigEndian.Uint32(header[16:])
+	flags := header[20]
+	now := time.Now()
+	st.streamsLock.Lock()
+	s := st.streams[key]
+	if s == nil {
+		if sequence != 0 {
+			// Either the first chunk was lost or the stream already failed;
+			// either way there's nothing to do with the remaining chunks.
+			st.streamsLock.Unlock()
+			return uint64(n + n2), nil
+		}
+		s = &IncomingStream{
+			StreamID:  key.streamID,
+			NodeID:    key.nodeID,
+			chunkChan: make(chan []byte, st.bufferedChunks),
+			errChan:   make(chan error, 1),
+		}
+		// The timer fails the stream even if no more chunks arrive at all,
+		// such as when the sender dies, so its reader is not left waiting.
+		s.timer = time.AfterFunc(st.streamTimeout, func() { st.expire(key, s) })
+		st.streams[key] = s
+		atomic.AddInt32(&st.streamsStarted, 1)
+		if st.handler != nil {
+			go st.handler(s)
+		}
+	}
+	s.lastChunk = now
+	var failure error
+	if sequence != s.nextSequence {
+		failure = ErrStreamChunkMissing
+	} else if flags&streamChunkFlagAbort != 0 {
+		failure = ErrStreamAborted
+	} else {
+		s.nextSequence++
+		if len(content) > 0 {
+			select {
+			case s.chunkChan <- content:
+			default:
+				failure = errors.New("stream handler fell too far behind")
+			}
+		}
+	}
+	if failure != nil {
+		delete(st.streams, key)
+		s.timer.Stop()
+		atomic.AddInt32(&st.streamsFailed, 1)
+		s.fail(failure)
+	} else if flags&streamChunkFlagLast != 0 {
+		delete(st.streams, key)
+		s.timer.Stop()
+		close(s.chunkChan)
+	}
+	st.streamsLock.Unlock()
+	return uint64(n + n2), nil
+}
+
+// expire is called by the stream's timer and fails the stream if it has gone
+// the StreamTimeout without a chunk, otherwise waiting out the rest of the
+// timeout since its last chunk.
+func (st *StreamTransfer) expire(key streamKey, s *IncomingStream) {
+	st.streamsLock.Lock()
+	if st.streams[key] == s {
+		if idle := time.Since(s.lastChunk); idle < st.streamTimeout {
+			s.timer.Reset(st.streamTimeout - idle)
+		} else {
+			delete(st.streams, key)
+			atomic.AddInt32(&st.streamsFailed, 1)
+			s.fail(ErrStreamTimedOut)
+		}
+	}
+	st.streamsLock.Unlock()
+}
+
+// StreamTransferStats gives an overview of the StreamTransfer activity.
+type StreamTransferStats struct {
+	ChunksSent     int32
+	ChunksReceived int32
+	StreamsStarted int32
+	StreamsFailed  int32
+}
+
+// Stats returns the current stat counters and resets those counters.
+func (st *StreamTransfer) Stats() *StreamTransferStats {
+	s := &StreamTransferStats{
+		ChunksSent:     atomic.LoadInt32(&st.chunksSent),
+		ChunksReceived: atomic.LoadInt32(&st.chunksReceived),
+		StreamsStarted: atomic.LoadInt32(&st.streamsStarted),
+		StreamsFailed:  atomic.LoadInt32(&st.streamsFailed),
+	}
+	atomic.AddInt32(&st.chunksSent, -s.ChunksSent)
+	atomic.AddInt32(&st.chunksReceived, -s.ChunksReceived)
+	atomic.AddInt32(&st.streamsStarted, -s.StreamsStarted)
+	atomic.AddInt32(&st.streamsFailed, -s.StreamsFailed)
+	return s
+}
+
+// IncomingStream is a stream being received from another node; read it until
+// io.EOF to obtain the full content, or until another error indicating the
+// stream failed.
+type IncomingStream struct {
+	// StreamID identifies the stream; it is unique per sending node.
+	StreamID uint64
+	// NodeID is the ID of the sending node.
+	NodeID       uint64
+	chunkChan    chan []byte
+	errChan      chan error
+	current      []byte
+	err          error
+	nextSequence uint32
+	lastChunk    time.Time
+	timer        *time.Timer
+}
+
+func (s *IncomingStream) fail(err error) {
+	s.errChan <- err
+	close(s.chunkChan)
+}
+
+func (s *IncomingStream) Read(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	for len(s.current) == 0 {
+		var ok bool
+		s.current, ok = <-s.chunkChan
+		if !ok {
+			select {
+			case s.err = <-s.errChan:
+			default:
+				s.err = io.EOF
+			}
+			return 0, s.err
+		}
+	}
+	n := copy(p, s.current)
+	s.current = s.current[n:]
+	return n, nil
+}
+
+type streamChunkMsg struct {
+	msgType   uint64
+	streamID  uint64
+	nodeID    uint64
+	sequence  uint32
+	flags     byte
+	content   []byte
+	freedChan chan struct{}
+}
+
+func (m *streamChunkMsg) MsgType() uint64 {
+	return m.msgType
+}
+
+func (m *streamChunkMsg) MsgLength() uint64 {
+	return streamChunkHeaderLength + uint64(len(m.content))
+}
+
+func (m *streamChunkMsg) WriteContent(w io.Writer) (uint64, error) {
+	var header [streamChunkHeaderLength]byte
+	binary.BigEndian.PutUint64(header[0:], m.streamID)
+	binary.BigEndian.PutUint64(header[8:], m.nodeID)
+	binary.BigEndian.PutUint32(header[16:], m.sequence)
+	header[20] = m.flags
+	n, err := w.Write(header[:])
+	if err != nil {
+		return uint64(n), err
+	}
+	n2, err := w.Write(m.content)
+	return uint64(n + n2), err
+}
+
+func (m *streamChunkMsg) Free() {
+	close(m.freedChan)
+}
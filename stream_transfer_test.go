@@ -0,0 +1,122 @@
+package ring
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func newStreamTransferTestRings(t *testing.T) (*testMsgRing, *testMsgRing, Node, Node) {
+	b := NewBuilder(64)
+	nA, err := b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nB, err := b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rA := b.Ring()
+	rA.SetLocalNode(nA.ID())
+	rB := b.Ring()
+	rB.SetLocalNode(nB.ID())
+	return newTestMsgRing(rA), newTestMsgRing(rB), nA, nB
+}
+
+func TestStreamTransfer(t *testing.T) {
+	mrA, mrB, nA, nB := newStreamTransferTestRings(t)
+	cfg := &StreamTransferConfig{ChunkSize: 1000, BufferedChunks: 1000}
+	stA := NewStreamTransfer(mrA, cfg, nil)
+	streamChan := make(chan *IncomingStream, 1)
+	NewStreamTransfer(mrB, cfg, func(s *IncomingStream) { streamChan <- s })
+	content := make([]byte, 123456)
+	rand.New(rand.NewSource(1)).Read(content)
+	var progressed uint64
+	if err := stA.Send(nB.ID(), bytes.NewBuffer(content), func(sent uint64) { progressed = sent }); err != nil {
+		t.Fatal(err)
+	}
+	if progressed != uint64(len(content)) {
+		t.Fatalf("%d != %d", progressed, len(content))
+	}
+	if len(mrA.sent) != 124 {
+		t.Fatalf("%d != 124", len(mrA.sent))
+	}
+	if mrA.sent[0].nodeID != nB.ID() {
+		t.Fatalf("%d != %d", mrA.sent[0].nodeID, nB.ID())
+	}
+	if err := mrA.deliver(mrB); err != nil {
+		t.Fatal(err)
+	}
+	s := <-streamChan
+	if s.NodeID != nA.ID() {
+		t.Fatalf("%d != %d", s.NodeID, nA.ID())
+	}
+	received, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, content) {
+		t.Fatal("received content did not match sent content")
+	}
+}
+
+func TestStreamTransferChunkMissing(t *testing.T) {
+	mrA, mrB, _, nB := newStreamTransferTestRings(t)
+	cfg := &StreamTransferConfig{ChunkSize: 1000, BufferedChunks: 1000}
+	stA := NewStreamTransfer(mrA, cfg, nil)
+	streamChan := make(chan *IncomingStream, 1)
+	stB := NewStreamTransfer(mrB, cfg, func(s *IncomingStream) { streamChan <- s })
+	if err := stA.Send(nB.ID(), bytes.NewBuffer(make([]byte, 5500)), nil); err != nil {
+		t.Fatal(err)
+	}
+	mrA.sent = append(mrA.sent[:2], mrA.sent[3:]...)
+	if err := mrA.deliver(mrB); err != nil {
+		t.Fatal(err)
+	}
+	s := <-streamChan
+	if _, err := ioutil.ReadAll(s); err != ErrStreamChunkMissing {
+		t.Fatalf("%v != %v", err, ErrStreamChunkMissing)
+	}
+	st := stB.Stats()
+	if st.StreamsStarted != 1 || st.StreamsFailed != 1 {
+		t.Fatalf("%#v", st)
+	}
+}
+
+func TestStreamTransferTimeout(t *testing.T) {
+	mrA, mrB, _, nB := newStreamTransferTestRings(t)
+	cfg := &StreamTransferConfig{ChunkSize: 1000, BufferedChunks: 1000}
+	stA := NewStreamTransfer(mrA, cfg, nil)
+	streamChan := make(chan *IncomingStream, 1)
+	stB := NewStreamTransfer(mrB, cfg, func(s *IncomingStream) { streamChan <- s })
+	stB.streamTimeout = 50 * time.Millisecond
+	if err := stA.Send(nB.ID(), bytes.NewBuffer(make([]byte, 5500)), nil); err != nil {
+		t.Fatal(err)
+	}
+	// The sender stops partway with nothing else arriving, so only the
+	// timeout can end the read.
+	mrA.sent = mrA.sent[:2]
+	if err := mrA.deliver(mrB); err != nil {
+		t.Fatal(err)
+	}
+	s := <-streamChan
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := ioutil.ReadAll(s)
+		errChan <- err
+	}()
+	select {
+	case err := <-errChan:
+		if err != ErrStreamTimedOut {
+			t.Fatalf("%v != %v", err, ErrStreamTimedOut)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read of stalled stream did not time out")
+	}
+	st := stB.Stats()
+	if st.StreamsStarted != 1 || st.StreamsFailed != 1 {
+		t.Fatalf("%#v", st)
+	}
+}
@@ -0,0 +1,210 @@
+package ring
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// DispersionError is returned by Builder.StrictRing when the replicas of some
+// partitions are not dispersed as required by the Builder's strict
+// dispersion; see Builder.SetStrictDispersion.
+type DispersionError struct {
+	// Levels is the Builder.StrictDispersion setting that was violated.
+	Levels int
+	// Partitions are those whose replicas are not dispersed, in ascending
+	// order.
+	Partitions []Partition
+}
+
+func (e *DispersionError) Error() string {
+	const max = 10
+	partitions := make([]string, 0, max+1)
+	for i, partition := range e.Partitions {
+		if i == max {
+			partitions = append(partitions, "...")
+			break
+		}
+		partitions = append(partitions, fmt.Sprintf("%d", partition))
+	}
+	return fmt.Sprintf("%d partitions do not meet strict dispersion %d: %s", len(e.Partitions), e.Levels, strings.Join(partitions, ", "))
+}
+
+// StrictDispersion is the dispersion the replicas of every partition must
+// have for StrictRing to give a ring; see SetStrictDispersion.
+func (b *Builder) StrictDispersion() int {
+	return b.strictDispersion
+}
+
+// SetStrictDispersion sets the dispersion the replicas of every partition
+// must have for StrictRing to give a ring, rather than an error listing the
+// partitions that fall short. The rebalancer always tries to disperse
+// replicas, but normally places them together, even on the same node, when it
+// cannot do otherwise, such as with too few nodes or too many moves waiting
+// on the move wait; safety-critical deployments may prefer to fail instead.
+//
+// The levels value -1, the default, disables strict dispersion. A levels
+// value of 0 requires the replicas of a partition to be on distinct nodes; 1
+// additionally requires distinct values at tier level 0; 2 distinct values
+// at tier level 1, with values at a level only distinct if the values at all
+// the higher levels are too; and so on. Correlated tier values count as the
+// same value; see CorrelateTiers.
+func (b *Builder) SetStrictDispersion(levels int) {
+	if levels < -1 {
+		levels = -1
+	}
+	b.strictDispersion = levels
+}
+
+// StrictRing is Ring, but returns a *DispersionError instead of a ring if
+// the Builder's strict dispersion is not met; see SetStrictDispersion. The
+// rebalance still happens, so the Builder should be persisted either way.
+func (b *Builder) StrictRing() (Ring, error) {
+	r := b.Ring()
+	if err := b.checkStrictDispersion(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// checkStrictDispersion returns a *DispersionError if the current assignments
+// do not meet the strict dispersion.
+func (b *Builder) checkStrictDispersion() error {
+	if b.strictDispersion < 0 {
+		return nil
+	}
+	rb := newRebalancer(b)
+	tier := b.strictDispersion - 1
+	if tier > rb.maxTier {
+		// There is no such tier level, so all nodes share its one value.
+		tier = rb.maxTier
+	}
+	var partitions []Partition
+	for partition := 0; partition <= rb.maxPartition; partition++ {
+	ReplicaLoop:
+		for replica := rb.maxReplica; replica > 0; replica-- {
+			nodeIndex := b.replicaToPartitionToNodeIndex[replica][partition]
+			if nodeIndex < 0 {
+				continue
+			}
+			for replicaB := replica - 1; replicaB >= 0; replicaB-- {
+				nodeIndexB := b.replicaToPartitionToNodeIndex[replicaB][partition]
+				if nodeIndexB < 0 {
+					continue
+				}
+				if nodeIndex == nodeIndexB || (tier >= 0 && rb.tierToNodeIndexToTierSep[tier][nodeIndex] == rb.tierToNodeIndexToTierSep[tier][nodeIndexB]) {
+					partitions = append(partitions, Partition(partition))
+					break ReplicaLoop
+				}
+			}
+		}
+	}
+	if len(partitions) > 0 {
+		return &DispersionError{Levels: b.strictDispersion, Partitions: partitions}
+	}
+	return nil
+}
+
+func (b *Builder) writeStrictDispersion(w io.Writer) error {
+	return binary.Write(w, binary.BigEndian, int32(b.strictDispersion))
+}
+
+func (b *Builder) readStrictDispersion(r io.Reader) error {
+	var levels int32
+	if err := binary.Read(r, binary.BigEndian, &levels); err != nil {
+		return err
+	}
+	b.strictDispersion = int(levels)
+	return nil
+}
+
+// dispersionViolations returns the BuilderStats.DispersionViolations.
+func (b *Builder) dispersionViolations() []int {
+	rb := newRebalancer(b)
+	d := newDispersionDomains(rb.maxTier+1, len(b.nodes))
+	for nodeIndex, n := range b.nodes {
+		available := !n.inactive && n.usableCapacity() > 0
+		d.set(0, nodeIndex, nodeIndex, available)
+		for tier := 0; tier < rb.maxTier; tier++ {
+			d.set(tier+1, nodeIndex, rb.tierToNodeIndexToTierSep[tier][nodeIndex], available)
+		}
+	}
+	violations := make([]int, rb.maxTier+1)
+	nodeIndexes := make([]int32, 0, rb.maxReplica+1)
+	for partition := 0; partition <= rb.maxPartition; partition++ {
+		nodeIndexes = nodeIndexes[:0]
+		for replica := rb.maxReplica; replica >= 0; replica-- {
+			if nodeIndex := b.replicaToPartitionToNodeIndex[replica][partition]; nodeIndex >= 0 {
+				nodeIndexes = append(nodeIndexes, nodeIndex)
+			}
+		}
+		for level := range violations {
+			if d.undispersed(level, nodeIndexes) {
+				violations[level]++
+			}
+		}
+	}
+	return violations
+}
+
+// dispersionDomains holds the failure domain of each node at each dispersion
+// level, level 0 being the node itself and level tier+1 the tier level, and
+// how many domains at each level have nodes able to take replicas.
+type dispersionDomains struct {
+	levelToNodeIndexToDomain [][]int
+	levelToAvailable         []int
+	levelToKeyToDomain       []map[interface{}]int
+	levelToDomainAvailable   [][]bool
+	seen                     map[int]bool
+}
+
+func newDispersionDomains(levels int, nodeCount int) *dispersionDomains {
+	d := &dispersionDomains{
+		levelToNodeIndexToDomain: make([][]int, levels),
+		levelToAvailable:         make([]int, levels),
+		levelToKeyToDomain:       make([]map[interface{}]int, levels),
+		levelToDomainAvailable:   make([][]bool, levels),
+		seen:                     make(map[int]bool),
+	}
+	for level := 0; level < levels; level++ {
+		d.levelToNodeIndexToDomain[level] = make([]int, nodeCount)
+		d.levelToKeyToDomain[level] = make(map[interface{}]int)
+	}
+	return d
+}
+
+// set puts the node in the domain identified by the key at the level; nodes
+// with equal keys share the domain. Available indicates whether the node can
+// take replicas.
+func (d *dispersionDomains) set(level int, nodeIndex int, key interface{}, available bool) {
+	domain, ok := d.levelToKeyToDomain[level][key]
+	if !ok {
+		domain = len(d.levelToDomainAvailable[level])
+		d.levelToKeyToDomain[level][key] = domain
+		d.levelToDomainAvailable[level] = append(d.levelToDomainAvailable[level], false)
+	}
+	d.levelToNodeIndexToDomain[level][nodeIndex] = domain
+	if available && !d.levelToDomainAvailable[level][domain] {
+		d.levelToDomainAvailable[level][domain] = true
+		d.levelToAvailable[level]++
+	}
+}
+
+// undispersed returns true if the replicas on the nodes given are in fewer
+// distinct domains at the level than they could be: fewer than there are
+// replicas and fewer than there are domains available, so a cluster with
+// fewer nodes or tier values than replicas can still be dispersed enough.
+func (d *dispersionDomains) undispersed(level int, nodeIndexes []int32) bool {
+	if level >= len(d.levelToNodeIndexToDomain) {
+		// There is no such level, so all nodes share its one domain.
+		return false
+	}
+	for key := range d.seen {
+		delete(d.seen, key)
+	}
+	for _, nodeIndex := range nodeIndexes {
+		d.seen[d.levelToNodeIndexToDomain[level][nodeIndex]] = true
+	}
+	return len(d.seen) < len(nodeIndexes) && len(d.seen) < d.levelToAvailable[level]
+}
@@ -0,0 +1,88 @@
+package ring
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestBuilderStrictDispersion(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetReplicaCount(3)
+	if b.StrictDispersion() != -1 {
+		t.Fatal(b.StrictDispersion())
+	}
+	for i, zone := range []string{"z1", "z1", "z2"} {
+		if _, err := b.AddNode(true, 1, []string{fmt.Sprintf("s%d", i), zone}, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := b.StrictRing(); err != nil {
+		t.Fatal(err)
+	}
+	// Three nodes give three distinct nodes per partition.
+	b.SetStrictDispersion(0)
+	if _, err := b.StrictRing(); err != nil {
+		t.Fatal(err)
+	}
+	// Each node is its own server.
+	b.SetStrictDispersion(1)
+	if _, err := b.StrictRing(); err != nil {
+		t.Fatal(err)
+	}
+	// Just two zones for three replicas.
+	b.SetStrictDispersion(2)
+	r, err := b.StrictRing()
+	if r != nil {
+		t.Fatal("expected no ring")
+	}
+	derr, ok := err.(*DispersionError)
+	if !ok || derr.Levels != 2 || len(derr.Partitions) != 1<<b.partitionBitCount {
+		t.Fatalf("%#v", err)
+	}
+	// No tier level 2 at all.
+	b.SetStrictDispersion(3)
+	if _, err = b.StrictRing(); err == nil {
+		t.Fatal("expected error")
+	}
+	buf := bytes.NewBuffer(nil)
+	if err = b.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := LoadBuilder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b2.StrictDispersion() != 3 {
+		t.Fatal(b2.StrictDispersion())
+	}
+}
+
+func TestDispersionErrorString(t *testing.T) {
+	err := &DispersionError{Levels: 0, Partitions: []Partition{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}}
+	if s := err.Error(); s != "11 partitions do not meet strict dispersion 0: 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, ..." {
+		t.Fatal(s)
+	}
+}
+
+func TestBuilderStatsDispersionViolations(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetReplicaCount(3)
+	for i, zone := range []string{"z1", "z1", "z2"} {
+		if _, err := b.AddNode(true, 1, []string{fmt.Sprintf("s%d", i), zone}, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Ring()
+	// Two zones for three replicas is as dispersed as possible.
+	if v := b.Stats().DispersionViolations; len(v) != 3 || v[0] != 0 || v[1] != 0 || v[2] != 0 {
+		t.Fatal(v)
+	}
+	// Put two replicas of partition 0 on node 0 and the other in zone z1.
+	b.replicaToPartitionToNodeIndex[0][0] = 0
+	b.replicaToPartitionToNodeIndex[1][0] = 0
+	b.replicaToPartitionToNodeIndex[2][0] = 1
+	if v := b.Stats().DispersionViolations; v[0] != 1 || v[1] != 1 || v[2] != 1 {
+		t.Fatal(v)
+	}
+}
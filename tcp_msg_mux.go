@@ -0,0 +1,381 @@
+package ring
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// On a multiplexed connection, each message is a stream of chunks, each chunk
+// being a 4 byte stream ID, a 4 byte content length, and that much content.
+// The content of a stream is the usual message type and length, 8 bytes each,
+// followed by the message content; the first chunk of a stream always holds
+// at least the message type and length, and the stream ends once all the
+// message content has been sent, after which its stream ID may be reused.
+// Chunks of different streams may be interleaved in any order.
+const (
+	muxChunkHeaderLength  = 8
+	muxStreamHeaderLength = 16
+	// muxMaxChunkLength caps the chunks a reader accepts, whatever the
+	// writer's chunk size.
+	muxMaxChunkLength = 16 * 1024 * 1024
+	// muxStreamBufferedChunks is how many chunks a reader queues for a
+	// stream's handler before waiting for it to catch up.
+	muxStreamBufferedChunks = 4
+	// muxStreamStallTimeout is how long a reader waits for a stream's handler
+	// to catch up before resetting the stream, rather than holding up the
+	// connection's other streams any longer.
+	muxStreamStallTimeout = time.Second
+)
+
+var errMuxAborted = errors.New("multiplexed connection closed")
+
+var errMuxStreamReset = errors.New("multiplexed stream reset; handler too slow")
+
+type muxChunk struct {
+	streamID uint32
+	data     []byte
+	// doneChan gives the result of writing the chunk; once received, data
+	// may be reused.
+	doneChan chan error
+}
+
+type muxStreamDone struct {
+	msg   Msg
+	start time.Time
+	err   error
+}
+
+// writeMuxMsgs is writeMsgs for a multiplexed connection; it writes up to
+// multiplexStreams messages at once, each from its own goroutine, the chunks
+// going out in the order they become ready.
+func (t *TCPMsgRing) writeMuxMsgs(addr string, writer *timeoutWriter, chunkSize int, msgChan chan Msg, stopChan chan struct{}) {
+	if chunkSize < muxStreamHeaderLength {
+		chunkSize = muxStreamHeaderLength
+	}
+	if chunkSize > muxMaxChunkLength {
+		chunkSize = muxMaxChunkLength
+	}
+	chunkChan := make(chan *muxChunk)
+	streamDoneChan := make(chan *muxStreamDone, t.multiplexStreams)
+	failChan := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	defer func() {
+		close(failChan)
+		wg.Wait()
+		for {
+			select {
+			case d := <-streamDoneChan:
+				d.msg.Free()
+			default:
+				return
+			}
+		}
+	}()
+	var nextStreamID uint32
+	active := 0
+	stopping := false
+	header := make([]byte, muxChunkHeaderLength)
+	for {
+		readyMsgChan := msgChan
+		if stopping || active >= t.multiplexStreams {
+			readyMsgChan = nil
+		}
+		select {
+		case <-stopChan:
+			// Let the writer finish any messages in progress.
+			stopping = true
+			stopChan = nil
+		case msg := <-readyMsgChan:
+			active++
+			wg.Add(1)
+			go func(streamID uint32) {
+				start := time.Now()
+				err := writeMuxStream(streamID, msg, chunkSize, chunkChan, failChan)
+				streamDoneChan <- &muxStreamDone{msg: msg, start: start, err: err}
+				wg.Done()
+			}(nextStreamID)
+			nextStreamID++
+		case c := <-chunkChan:
+			binary.BigEndian.PutUint32(header, c.streamID)
+			binary.BigEndian.PutUint32(header[4:], uint32(len(c.data)))
+			_, err := writer.Write(header)
+			if err == nil {
+				_, err = writer.Write(c.data)
+			}
+			if err == nil {
+				err = writer.Flush()
+			}
+			c.doneChan <- err
+		case d := <-streamDoneChan:
+			active--
+			if t.frameSent != nil {
+				t.frameSent(addr, d.msg.MsgType(), d.msg.MsgLength(), time.Since(d.start), d.err)
+			}
+			if t.msgTraces != nil {
+				t.msgTraces.add(addr, true, d.msg.MsgType(), d.msg.MsgLength(), time.Since(d.start), d.err)
+			}
+			d.msg.Free()
+			if d.err != nil {
+				atomic.AddInt32(&t.msgWriteErrors, 1)
+				t.logDebug("writeMsg: %s\n", d.err)
+				return
+			}
+			atomic.AddInt32(&t.msgWrites, 1)
+		}
+		if stopping && active == 0 {
+			return
+		}
+	}
+}
+
+// writeMuxStream writes the message as the stream given, returning once all
+// its chunks are written.
+func writeMuxStream(streamID uint32, msg Msg, chunkSize int, chunkChan chan *muxChunk, failChan chan struct{}) error {
+	w := &muxStreamWriter{
+		chunk:     &muxChunk{streamID: streamID, data: make([]byte, muxStreamHeaderLength, chunkSize), doneChan: make(chan error, 1)},
+		chunkChan: chunkChan,
+		failChan:  failChan,
+		remaining: msg.MsgLength(),
+	}
+	binary.BigEndian.PutUint64(w.chunk.data, msg.MsgType())
+	binary.BigEndian.PutUint64(w.chunk.data[8:], msg.MsgLength())
+	length, err := msg.WriteContent(w)
+	if err != nil {
+		return err
+	}
+	if length != msg.MsgLength() || w.remaining != 0 {
+		return fmt.Errorf("incorrect message length sent: %d != %d", length, msg.MsgLength())
+	}
+	return w.flush()
+}
+
+// muxStreamWriter buffers a stream's content into chunks for the connection
+// writer.
+type muxStreamWriter struct {
+	chunk     *muxChunk
+	chunkChan chan *muxChunk
+	failChan  chan struct{}
+	remaining uint64
+}
+
+func (w *muxStreamWriter) Write(p []byte) (int, error) {
+	if uint64(len(p)) > w.remaining {
+		return 0, fmt.Errorf("message content exceeds its length by %d bytes", uint64(len(p))-w.remaining)
+	}
+	written := 0
+	for len(p) > 0 {
+		if len(w.chunk.data) == cap(w.chunk.data) {
+			if err := w.flush(); err != nil {
+				return written, err
+			}
+		}
+		n := cap(w.chunk.data) - len(w.chunk.data)
+		if n > len(p) {
+			n = len(p)
+		}
+		w.chunk.data = append(w.chunk.data, p[:n]...)
+		p = p[n:]
+		written += n
+		w.remaining -= uint64(n)
+	}
+	return written, nil
+}
+
+// flush hands any buffered content to the connection writer and waits for it
+// to be written.
+func (w *muxStreamWriter) flush() error {
+	if len(w.chunk.data) == 0 {
+		return nil
+	}
+	select {
+	case w.chunkChan <- w.chunk:
+	case <-w.failChan:
+		return errMuxAborted
+	}
+	var err error
+	select {
+	case err = <-w.chunk.doneChan:
+	case <-w.failChan:
+		return errMuxAborted
+	}
+	w.chunk.data = w.chunk.data[:0]
+	return err
+}
+
+// readMuxMsgs is readMsgs for a multiplexed connection; it reads the chunks
+// and hands each stream's content to its handler, each handler running in
+// its own goroutine.
+func (t *TCPMsgRing) readMuxMsgs(addr string, readerControlChan chan struct{}, reader *timeoutReader, resetChan chan struct{}) {
+	streams := make(map[uint32]*muxStreamReader)
+	abortChan := make(chan struct{})
+	defer close(abortChan)
+	header := make([]byte, muxChunkHeaderLength)
+	for {
+		select {
+		case <-readerControlChan:
+			return
+		default:
+		}
+		timeout := reader.Timeout
+		// Wait forever for the next chunk or for closed/eof error.
+		reader.Timeout = 0
+		b, err := reader.ReadByte()
+		reader.Timeout = timeout
+		if err == nil {
+			header[0] = b
+			_, err = io.ReadFull(reader, header[1:])
+		}
+		var data []byte
+		if err == nil {
+			length := binary.BigEndian.Uint32(header[4:])
+			if length > muxMaxChunkLength {
+				err = fmt.Errorf("chunk of %d bytes exceeds the max of %d", length, muxMaxChunkLength)
+			} else {
+				data = make([]byte, length)
+				_, err = io.ReadFull(reader, data)
+			}
+		}
+		if err == nil {
+			err = t.readMuxChunk(addr, streams, binary.BigEndian.Uint32(header), data, reader.conn, resetChan, abortChan)
+		}
+		if err != nil {
+			atomic.AddInt32(&t.msgReadErrors, 1)
+			t.logDebug("readMsg: %s\n", err)
+			return
+		}
+	}
+}
+
+// readMuxChunk hands the chunk's content to its stream, starting the stream's
+// handler for the first chunk of a stream.
+func (t *TCPMsgRing) readMuxChunk(addr string, streams map[uint32]*muxStreamReader, streamID uint32, data []byte, conn net.Conn, resetChan chan struct{}, abortChan chan struct{}) error {
+	s := streams[streamID]
+	if s == nil {
+		if len(data) < muxStreamHeaderLength {
+			return fmt.Errorf("stream %d started with %d bytes; need %d", streamID, len(data), muxStreamHeaderLength)
+		}
+		msgType := binary.BigEndian.Uint64(data)
+		length := binary.BigEndian.Uint64(data[8:])
+		handler := t.MsgHandler(msgType)
+		if handler == nil {
+			return fmt.Errorf("no handler for %x", msgType)
+		}
+		if length > t.maxMsgLength {
+			return fmt.Errorf("message %x of %d bytes exceeds the max of %d", msgType, length, t.maxMsgLength)
+		}
+		data = data[muxStreamHeaderLength:]
+		s = &muxStreamReader{
+			remaining: length,
+			dataChan:  make(chan []byte, muxStreamBufferedChunks),
+			abortChan: abortChan,
+			resetChan: make(chan struct{}),
+		}
+		streams[streamID] = s
+		go t.handleMuxStream(addr, msgType, length, handler, s, conn, resetChan)
+	}
+	if uint64(len(data)) > s.remaining {
+		return fmt.Errorf("stream %d exceeds its message length by %d bytes", streamID, uint64(len(data))-s.remaining)
+	}
+	s.remaining -= uint64(len(data))
+	if len(data) > 0 && !s.reset {
+		select {
+		case s.dataChan <- data:
+		default:
+			timer := time.NewTimer(t.muxStallTimeout)
+			select {
+			case s.dataChan <- data:
+			case <-timer.C:
+				// The rest of the stream is discarded as it arrives.
+				s.reset = true
+				close(s.resetChan)
+				atomic.AddInt32(&t.msgStreamResets, 1)
+				t.logDebug("readMsg: %s: stream %d reset; handler too slow\n", addr, streamID)
+			}
+			timer.Stop()
+		}
+	}
+	if s.remaining == 0 {
+		if !s.reset {
+			close(s.dataChan)
+		}
+		delete(streams, streamID)
+	}
+	return nil
+}
+
+// handleMuxStream runs the handler for a stream; should the handler fail, the
+// connection is closed, as a failed message on an unmultiplexed connection
+// would do.
+func (t *TCPMsgRing) handleMuxStream(addr string, msgType uint64, length uint64, handler MsgUnmarshaller, s *muxStreamReader, conn net.Conn, resetChan chan struct{}) {
+	start := time.Now()
+	timer := t.watchHandler(addr, msgType, conn, resetChan)
+	consumed, err := handler(s, length)
+	if timer != nil {
+		timer.Stop()
+	}
+	if consumed != length {
+		if err == nil {
+			err = fmt.Errorf("handler %x did not read %d bytes; only read %d", msgType, length, consumed)
+		}
+	}
+	if t.frameReceived != nil {
+		t.frameReceived(addr, msgType, length, time.Since(start), err)
+	}
+	if t.msgTraces != nil {
+		t.msgTraces.add(addr, false, msgType, length, time.Since(start), err)
+	}
+	if err != nil {
+		atomic.AddInt32(&t.msgReadErrors, 1)
+		t.logDebug("readMsg: %s\n", err)
+		// A reset stream's message is lost, but the connection is fine.
+		select {
+		case <-s.resetChan:
+		default:
+			conn.Close()
+		}
+	} else {
+		atomic.AddInt32(&t.msgReads, 1)
+	}
+	// Discard whatever the handler left so the connection reader is not
+	// stuck waiting on this stream.
+	io.Copy(ioutil.Discard, s)
+}
+
+// muxStreamReader is the io.Reader a stream's handler reads the message
+// content from.
+type muxStreamReader struct {
+	// remaining and reset are only used by the connection reader, which
+	// closes resetChan when resetting the stream.
+	remaining uint64
+	reset     bool
+	dataChan  chan []byte
+	abortChan chan struct{}
+	resetChan chan struct{}
+	data      []byte
+}
+
+func (s *muxStreamReader) Read(p []byte) (int, error) {
+	for len(s.data) == 0 {
+		var ok bool
+		select {
+		case s.data, ok = <-s.dataChan:
+			if !ok {
+				return 0, io.EOF
+			}
+		case <-s.abortChan:
+			return 0, errMuxAborted
+		case <-s.resetChan:
+			return 0, errMuxStreamReset
+		}
+	}
+	n := copy(p, s.data)
+	s.data = s.data[n:]
+	return n, nil
+}
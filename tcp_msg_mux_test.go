@@ -0,0 +1,183 @@
+package ring
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testBytesMsg struct {
+	msgType uint64
+	content []byte
+}
+
+func (m *testBytesMsg) MsgType() uint64 {
+	return m.msgType
+}
+
+func (m *testBytesMsg) MsgLength() uint64 {
+	return uint64(len(m.content))
+}
+
+func (m *testBytesMsg) WriteContent(w io.Writer) (uint64, error) {
+	n, err := w.Write(m.content)
+	return uint64(n), err
+}
+
+func (m *testBytesMsg) Free() {
+}
+
+func TestTCPMsgRingMultiplex(t *testing.T) {
+	msgring, _ := NewTCPMsgRing(&TCPMsgRingConfig{MultiplexStreams: 4})
+	var lock sync.Mutex
+	var order []uint64
+	received := make(map[uint64][]byte)
+	doneChan := make(chan struct{}, 3)
+	handler := func(reader io.Reader, size uint64) (uint64, error) {
+		content, err := ioutil.ReadAll(io.LimitReader(reader, int64(size)))
+		lock.Lock()
+		if len(content) > 0 {
+			order = append(order, uint64(content[0]))
+			received[uint64(content[0])] = content
+		} else {
+			order = append(order, 0)
+			received[0] = content
+		}
+		lock.Unlock()
+		doneChan <- struct{}{}
+		return uint64(len(content)), err
+	}
+	msgring.SetMsgHandler(1, handler)
+	connW, connR := net.Pipe()
+	defer connW.Close()
+	defer connR.Close()
+	large := &testBytesMsg{msgType: 1, content: bytes.Repeat([]byte{1}, 1024*1024)}
+	small := &testBytesMsg{msgType: 1, content: bytes.Repeat([]byte{2}, 100)}
+	empty := &testBytesMsg{msgType: 1}
+	msgChan := make(chan Msg, 3)
+	msgChan <- large
+	msgChan <- small
+	msgChan <- empty
+	stopChan := make(chan struct{})
+	writerDone := make(chan struct{})
+	go func() {
+		msgring.writeMuxMsgs("127.0.0.2:1", newTimeoutWriter(connW, 1024, time.Second), 1024, msgChan, stopChan)
+		close(writerDone)
+	}()
+	go msgring.readMuxMsgs("127.0.0.2:1", make(chan struct{}), newTimeoutReader(connR, 1024, time.Second), nil)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-doneChan:
+		case <-time.After(10 * time.Second):
+			t.Fatal("messages not received")
+		}
+	}
+	close(stopChan)
+	<-writerDone
+	lock.Lock()
+	defer lock.Unlock()
+	// The large message was started first but must not have held up the
+	// others.
+	if len(order) != 3 || order[2] != 1 {
+		t.Fatal(order)
+	}
+	if !bytes.Equal(received[1], large.content) || !bytes.Equal(received[2], small.content) || len(received[0]) != 0 {
+		t.Fatal(len(received[1]), len(received[2]), len(received[0]))
+	}
+	if s := msgring.Stats(false); s.MsgWrites != 3 || s.MsgReads != 3 || s.MsgWriteErrors != 0 || s.MsgReadErrors != 0 {
+		t.Fatalf("%#v", s)
+	}
+}
+
+func TestTCPMsgRingMultiplexSlowStream(t *testing.T) {
+	msgring, _ := NewTCPMsgRing(&TCPMsgRingConfig{MultiplexStreams: 4})
+	msgring.muxStallTimeout = 50 * time.Millisecond
+	releaseChan := make(chan struct{})
+	slowErrChan := make(chan error, 1)
+	msgring.SetMsgHandler(1, func(reader io.Reader, size uint64) (uint64, error) {
+		<-releaseChan
+		n, err := io.Copy(ioutil.Discard, io.LimitReader(reader, int64(size)))
+		slowErrChan <- err
+		return uint64(n), err
+	})
+	fastChan := make(chan []byte, 1)
+	msgring.SetMsgHandler(2, func(reader io.Reader, size uint64) (uint64, error) {
+		content, err := ioutil.ReadAll(io.LimitReader(reader, int64(size)))
+		fastChan <- content
+		return uint64(len(content)), err
+	})
+	connW, connR := net.Pipe()
+	defer connW.Close()
+	defer connR.Close()
+	msgChan := make(chan Msg, 2)
+	msgChan <- &testBytesMsg{msgType: 1, content: bytes.Repeat([]byte{1}, 64*1024)}
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	go msgring.writeMuxMsgs("127.0.0.2:1", newTimeoutWriter(connW, 1024, time.Second), 1024, msgChan, stopChan)
+	go msgring.readMuxMsgs("127.0.0.2:1", make(chan struct{}), newTimeoutReader(connR, 1024, time.Second), nil)
+	// The stalled handler's stream is reset rather than holding up the
+	// other streams.
+	for start := time.Now(); atomic.LoadInt32(&msgring.msgStreamResets) == 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("slow stream not reset")
+		}
+	}
+	msgChan <- &testBytesMsg{msgType: 2, content: bytes.Repeat([]byte{2}, 100)}
+	select {
+	case content := <-fastChan:
+		if len(content) != 100 {
+			t.Fatal(len(content))
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("held up by the slow stream")
+	}
+	close(releaseChan)
+	select {
+	case err := <-slowErrChan:
+		if err != errMuxStreamReset {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("slow handler not done")
+	}
+	if s := msgring.Stats(false); s.MsgStreamResets != 1 {
+		t.Fatalf("%#v", s)
+	}
+}
+
+func TestTCPMsgRingMultiplexBadLength(t *testing.T) {
+	msgring, _ := NewTCPMsgRing(&TCPMsgRingConfig{MultiplexStreams: 2})
+	connW, connR := net.Pipe()
+	defer connW.Close()
+	defer connR.Close()
+	go io.Copy(ioutil.Discard, connR)
+	msgChan := make(chan Msg, 1)
+	// Claims 7 bytes but writes 100.
+	msgChan <- &lengthLieMsg{&testBytesMsg{msgType: 1, content: bytes.Repeat([]byte{2}, 100)}}
+	writerDone := make(chan struct{})
+	go func() {
+		msgring.writeMuxMsgs("127.0.0.2:1", newTimeoutWriter(connW, 1024, time.Second), 1024, msgChan, make(chan struct{}))
+		close(writerDone)
+	}()
+	select {
+	case <-writerDone:
+	case <-time.After(10 * time.Second):
+		t.Fatal("writer did not stop")
+	}
+	if s := msgring.Stats(false); s.MsgWriteErrors != 1 {
+		t.Fatalf("%#v", s)
+	}
+}
+
+type lengthLieMsg struct {
+	Msg
+}
+
+func (m *lengthLieMsg) MsgLength() uint64 {
+	return 7
+}
@@ -2,6 +2,7 @@ package ring
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/binary"
@@ -13,6 +14,7 @@ import (
 	"math"
 	"net"
 	"os"
+	"reflect"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -37,6 +39,11 @@ type TCPMsgRingConfig struct {
 	// AddressIndex set the index to use with Node.Address(index) to lookup a
 	// Node's TCP address.
 	AddressIndex int
+	// AddressRole, if set, names the address role to use to lookup a Node's
+	// TCP address; it is resolved to an index with Ring.AddressIndex each
+	// time the ring is set. If the ring does not know the role, AddressIndex
+	// is used instead.
+	AddressRole string
 	// BufferedMessagesPerAddress indicates how many outgoing Msg instances can
 	// be buffered before dropping additional ones. Defaults to 8.
 	BufferedMessagesPerAddress int
@@ -46,20 +53,200 @@ type TCPMsgRingConfig struct {
 	// ReconnectInterval indicates how many seconds to wait between connection
 	// tries. Defaults to 10 seconds.
 	ReconnectInterval int
+	// ReconnectMaxInterval, if greater than ReconnectInterval, makes the wait
+	// between connection tries to an address double after each consecutive
+	// failure, up to this many seconds, so a peer that is down is not dialed
+	// as often as one that just blipped. Defaults to 0, a fixed interval.
+	ReconnectMaxInterval int
+	// ReconnectJitter is the percentage, up to 100, by which each wait
+	// between connection tries is randomly shortened, so many nodes do not
+	// all dial a returning peer at once. Defaults to 0, no jitter.
+	ReconnectJitter int
+	// ReconnectMaxRetries, if set, is how many consecutive connection tries
+	// to an address fail before giving up on it: the messages queued for it
+	// are dropped rather than held behind further tries, and the next
+	// message to it starts trying again. Defaults to 0, trying until the
+	// address leaves the ring.
+	ReconnectMaxRetries int
 	// ChunkSize indicates how many bytes to attempt to read at once with each
-	// network read. Defaults to 16,384 bytes.
+	// network read, and to buffer before each network write. Defaults to
+	// 16,384 bytes.
 	ChunkSize int
+	// ReadChunkSize and WriteChunkSize, if set, override ChunkSize for just
+	// network reads or writes.
+	ReadChunkSize  int
+	WriteChunkSize int
+	// ChunkSizes, if set, will be called for each connection to choose its
+	// read and write chunk sizes, returning values less than 1 to keep the
+	// sizes above. The inbound parameter indicates whether the connection was
+	// accepted by Listen rather than dialed. For example, peers exchanging
+	// just small control messages might be given small buffers, while peers
+	// exchanging bulk data are given large ones.
+	ChunkSizes func(addr string, inbound bool) (readChunkSize int, writeChunkSize int)
 	// WithinMessageTimeout indicates how many seconds before giving up on
 	// reading data within a message. Defaults to 5 seconds.
 	WithinMessageTimeout int
+	// TierAffinity, if true, will have MsgToOtherReplicas queue messages to
+	// the replicas closest to the local node first, based on TierDistance;
+	// for example, replicas on the same rack would be queued before those in
+	// a remote region. Replicas at the same distance are still queued
+	// concurrently. Defaults to false, queueing to all replicas concurrently.
+	TierAffinity bool
+	// CircuitBreakerThreshold indicates how many consecutive connection
+	// failures to an address will open its circuit breaker; while open,
+	// messages to that address are dropped immediately and no connections
+	// are attempted. Defaults to 0, disabling circuit breakers.
+	CircuitBreakerThreshold int
+	// CircuitBreakerCooldown indicates how many seconds an open circuit
+	// breaker waits before allowing a probe connection attempt. Defaults to
+	// 30 seconds.
+	CircuitBreakerCooldown int
+	// CircuitBreakerStateChange, if set, will be called whenever the circuit
+	// breaker for an address changes state. It is called without the circuit
+	// breakers locked, so it may send messages or check breaker states.
+	CircuitBreakerStateChange func(addr string, from CircuitBreakerState, to CircuitBreakerState)
+	// MaxInFlightPerAddress, if set, limits how many messages may be waiting
+	// to be queued for any one address at a time; messages beyond that are
+	// dropped immediately instead of each holding a goroutine for up to its
+	// timeout, so a burst to one struggling peer cannot tie up the goroutine
+	// budget. This applies to MsgToNode, MsgToOtherReplicas, and any other
+	// sends. Defaults to 0, no limit.
+	MaxInFlightPerAddress int
+	// DedupWindow indicates how many seconds message IDs are remembered for
+	// handlers set with SetDedupMsgHandler. Defaults to 60 seconds.
+	DedupWindow int
+	// DrainTimeout indicates how many seconds to allow messages already
+	// queued for an address to be sent once SetRing removes the address;
+	// new messages are not queued for it and, once the queue is empty or the
+	// time is up, the connection is closed. Defaults to 10 seconds.
+	DrainTimeout int
+	// ConnectionDrained, if set, will be called when the draining of an
+	// address removed by SetRing completes, with the number of queued
+	// messages that had to be dropped because the DrainTimeout elapsed.
+	ConnectionDrained func(addr string, dropped int)
+	// InboundIdlePolicy and OutboundIdlePolicy set how idle connections are
+	// handled, for connections accepted from peers and those dialed to them;
+	// see IdlePolicy. Defaults to keeping idle connections open
+	// indefinitely, with the default TCP keepalives.
+	InboundIdlePolicy  *IdlePolicy
+	OutboundIdlePolicy *IdlePolicy
+	// FrameSent, if set, will be called after each message is written to a
+	// connection, with the remote address, the message type and content
+	// length, how long the write took, and any error. This is a low level
+	// hook for custom accounting, debugging, or mirroring traffic; it is
+	// called from the connection's writer, so it should return quickly.
+	FrameSent func(addr string, msgType uint64, length uint64, duration time.Duration, err error)
+	// FrameReceived, if set, will be called after each message is read from
+	// a connection and given to its handler, with the remote address, the
+	// message type and content length, how long the read and handling took,
+	// and any error. It is called from the connection's reader, so it should
+	// return quickly.
+	FrameReceived func(addr string, msgType uint64, length uint64, duration time.Duration, err error)
 	// UseTLS enables use of TLS for server and client comms
-	UseTLS         bool
-	MutualTLS      bool
+	UseTLS    bool
+	MutualTLS bool
+	// ClientAuth sets the client certificate policy for inbound connections,
+	// independently of the certificate used for outbound connections; see
+	// TLSClientAuth. Defaults to following MutualTLS.
+	ClientAuth     TLSClientAuth
 	SkipVerify     bool
 	CustomCertPool bool
 	CertFile       string
 	KeyFile        string
 	CAFile         string
+	// TLSConfig, if set along with UseTLS, is used in place of CertFile,
+	// KeyFile, CAFile, SNICerts, and CertReloadInterval, such as for
+	// certificates kept in memory rather than files: its Certificates (or
+	// GetCertificate) are served to clients and presented to servers, its
+	// ClientCAs verify client certificates, and its RootCAs verify servers,
+	// whose certificates must name the host of their ring addresses. The
+	// client certificate policy is still set by ClientAuth and MutualTLS.
+	// The config is cloned, so changes after NewTCPMsgRing have no effect;
+	// its GetCertificate and GetClientCertificate may be used for rotation.
+	TLSConfig *tls.Config
+	// SNICerts lists additional certificates to serve when the server name
+	// the client requests (SNI) matches one of their names; CertFile and
+	// KeyFile remain the default certificate and the client certificate.
+	SNICerts []TLSCertFiles
+	// CertReloadInterval, if set, indicates how many seconds to wait between
+	// checks of the certificate files for changes; changed files are
+	// reloaded without interrupting Listen, for certificate rotation. See
+	// also TCPMsgRing.ReloadCertificates.
+	CertReloadInterval int
+	// PeerCacheFile, if set, names a file in which to keep what is learned
+	// about peers from handshakes, so the information is available right
+	// after a restart; see TCPMsgRing.Peer. The file is created as needed.
+	PeerCacheFile string
+	// LatencyWeight indicates the percentage weight each new round trip
+	// measurement is given in the moving average of an address's latency;
+	// see TCPMsgRing.Latency. Defaults to 20 percent.
+	LatencyWeight int
+	// RetainedRings indicates how many previous rings SetRing keeps, for use
+	// with RingOfVersion, MsgToOtherReplicasOfVersion, and
+	// MsgToFormerReplicas. Defaults to 1.
+	RetainedRings int
+	// TransportPolicy, if set, will be called with the network zones of the
+	// local node and of a peer node to get the TransportPolicy for
+	// connections with the peer, or nil for the settings above; see
+	// Node.NetworkZone and CrossZoneTransportPolicy.
+	TransportPolicy func(localZone string, remoteZone string) *TransportPolicy
+	// ClockSkewThreshold indicates how many milliseconds a peer's clock may
+	// differ from the local clock, as estimated during each handshake, before
+	// the peer is reported via ClockSkewed and the ClockSkews stat. Defaults
+	// to 1000 milliseconds.
+	ClockSkewThreshold int
+	// ClockSkewed, if set, will be called after a handshake with a peer whose
+	// clock skew exceeds the ClockSkewThreshold, with the peer's address and
+	// how far ahead of the local clock its clock is; negative if behind.
+	ClockSkewed func(addr string, skew time.Duration)
+	// MsgTraceSize, if set, indicates how many of the most recent messages
+	// sent to and received from each address to keep in memory, with their
+	// types, sizes, durations, and errors; see TCPMsgRing.MsgTraces and
+	// TCPMsgRing.DumpMsgTraces. Defaults to 0, keeping none.
+	MsgTraceSize int
+	// HandlerTimeouts maps message types to how many milliseconds their
+	// handlers may run for a message before being reported via
+	// HandlerTimedOut and the MsgHandlerTimeouts stat. Message types not listed
+	// are not timed. A handler that runs too long holds up all further
+	// messages from the connection, so this catches stuck handlers.
+	HandlerTimeouts map[uint64]int
+	// HandlerTimeoutDisconnect, if true, will also close the connection of a
+	// handler that exceeds its HandlerTimeouts entry, so the peer is
+	// reconnected rather than wedged behind the stuck handler. The handler
+	// itself is not stopped, though any further reads it does will fail.
+	HandlerTimeoutDisconnect bool
+	// HandlerTimedOut, if set, will be called when a handler exceeds its
+	// HandlerTimeouts entry, with the remote address, the message type, and
+	// how long the handler had run; it is called while the handler is still
+	// running.
+	HandlerTimedOut func(addr string, msgType uint64, elapsed time.Duration)
+	// MaxMsgLength, if set, indicates the maximum number of bytes the content
+	// of a message may contain to be accepted from peers; each end gives its
+	// limit during the handshake, and messages to a peer longer than its
+	// limit are split, if they implement MsgSplitter, or dropped before being
+	// sent, counted by the MsgToAddrSplits and MsgToAddrLengthDrops stats.
+	// A peer sending a longer message anyway is disconnected. Defaults to 0,
+	// no limit.
+	MaxMsgLength uint64
+	// MultiplexStreams, if greater than 1, indicates how many messages may be
+	// written to a connection at once, their content interleaved in chunks
+	// of up to the write chunk size, each chunk tagged with its message's
+	// stream ID, so a large message no longer holds up the small ones queued
+	// behind it. A connection is multiplexed only if both ends set this, as
+	// agreed during the handshake; otherwise messages are written one after
+	// another. Note that the handlers for messages from a multiplexed
+	// connection may run concurrently. A handler falling so far behind that
+	// its stream's buffered chunks stay full for a second has its stream
+	// reset, so it cannot hold up the connection's other streams: its reads
+	// fail and the rest of its message is discarded, counted by the
+	// MsgStreamResets stat. Defaults to 0, not multiplexing.
+	MultiplexStreams int
+}
+
+// TLSCertFiles names the files of a certificate and its key.
+type TLSCertFiles struct {
+	CertFile string
+	KeyFile  string
 }
 
 func resolveTCPMsgRingConfig(c *TCPMsgRingConfig) *TCPMsgRingConfig {
@@ -72,6 +259,12 @@ func resolveTCPMsgRingConfig(c *TCPMsgRingConfig) *TCPMsgRingConfig {
 	}
 	// LogDebug set as nil is fine and shortcircuits any debug code.
 	// AddressIndex defaulting to 0 is fine.
+	if cfg.ClockSkewThreshold < 1 {
+		cfg.ClockSkewThreshold = 1000
+	}
+	if cfg.ClientAuth == TLSClientAuthDefault && !cfg.MutualTLS {
+		cfg.ClientAuth = TLSClientAuthNone
+	}
 	if cfg.BufferedMessagesPerAddress < 1 {
 		cfg.BufferedMessagesPerAddress = 8
 	}
@@ -81,12 +274,60 @@ func resolveTCPMsgRingConfig(c *TCPMsgRingConfig) *TCPMsgRingConfig {
 	if cfg.ReconnectInterval < 1 {
 		cfg.ReconnectInterval = 10
 	}
+	if cfg.ReconnectMaxInterval < 0 {
+		cfg.ReconnectMaxInterval = 0
+	}
+	if cfg.ReconnectJitter < 0 {
+		cfg.ReconnectJitter = 0
+	}
+	if cfg.ReconnectJitter > 100 {
+		cfg.ReconnectJitter = 100
+	}
+	if cfg.ReconnectMaxRetries < 0 {
+		cfg.ReconnectMaxRetries = 0
+	}
 	if cfg.ChunkSize < 1 {
 		cfg.ChunkSize = 16384
 	}
+	if cfg.ReadChunkSize < 1 {
+		cfg.ReadChunkSize = cfg.ChunkSize
+	}
+	if cfg.WriteChunkSize < 1 {
+		cfg.WriteChunkSize = cfg.ChunkSize
+	}
 	if cfg.WithinMessageTimeout < 1 {
 		cfg.WithinMessageTimeout = 5
 	}
+	if cfg.CircuitBreakerThreshold < 0 {
+		cfg.CircuitBreakerThreshold = 0
+	}
+	if cfg.CircuitBreakerCooldown < 1 {
+		cfg.CircuitBreakerCooldown = 30
+	}
+	if cfg.MaxInFlightPerAddress < 0 {
+		cfg.MaxInFlightPerAddress = 0
+	}
+	if cfg.DedupWindow < 1 {
+		cfg.DedupWindow = 60
+	}
+	if cfg.DrainTimeout < 1 {
+		cfg.DrainTimeout = 10
+	}
+	if cfg.LatencyWeight < 1 {
+		cfg.LatencyWeight = 20
+	}
+	if cfg.LatencyWeight > 100 {
+		cfg.LatencyWeight = 100
+	}
+	if cfg.RetainedRings < 1 {
+		cfg.RetainedRings = 1
+	}
+	if cfg.MaxMsgLength == 0 {
+		cfg.MaxMsgLength = math.MaxUint64
+	}
+	if cfg.MultiplexStreams < 2 {
+		cfg.MultiplexStreams = 0
+	}
 	return cfg
 }
 
@@ -95,41 +336,109 @@ type TCPMsgRing struct {
 	logDebug                   LogFunc
 	logDebugOn                 bool
 	controlChan                chan struct{}
+	listenerLock               sync.Mutex
+	listener                   *net.TCPListener
 	ringLock                   sync.RWMutex
 	ring                       Ring
 	addressIndex               int
+	addressRole                string
+	ringAddressIndex           int
+	retainedRings              int
+	previousRings              []retainedRing
+	setRingLock                sync.Mutex
+	ringWatchersLock           sync.Mutex
+	ringWatchers               []*ringWatcherEntry
+	mirrorLock                 sync.RWMutex
+	mirror                     *mirror
 	msgHandlersLock            sync.RWMutex
 	msgHandlers                map[uint64]MsgUnmarshaller
 	bufferedMessagesPerAddress int
 	msgChansLock               sync.RWMutex
 	msgChans                   map[string]chan Msg
+	msgChanStops               map[chan Msg]chan struct{}
 	connectTimeout             time.Duration
 	reconnectInterval          time.Duration
-	chunkSize                  int
+	reconnectMaxInterval       time.Duration
+	reconnectJitter            int
+	reconnectMaxRetries        int
+	readChunkSize              int
+	writeChunkSize             int
+	chunkSizes                 func(addr string, inbound bool) (int, int)
+	transportPolicy            func(localZone string, remoteZone string) *TransportPolicy
+	clockSkewThreshold         time.Duration
+	clockSkewed                func(addr string, skew time.Duration)
 	withinMessageTimeout       time.Duration
+	tierAffinity               bool
+	circuitBreakers            *circuitBreakers
+	dedupCache                 *dedupCache
+	maxInFlightPerAddress      int32
+	inFlightLock               sync.RWMutex
+	inFlight                   map[string]*int32
+	connectedLock              sync.RWMutex
+	connected                  map[string]int
+	frameSent                  func(addr string, msgType uint64, length uint64, duration time.Duration, err error)
+	frameReceived              func(addr string, msgType uint64, length uint64, duration time.Duration, err error)
+	msgTraces                  *msgTraces
+	handlerTimeouts            map[uint64]time.Duration
+	handlerTimeoutDisconnect   bool
+	handlerTimedOut            func(addr string, msgType uint64, elapsed time.Duration)
+	multiplexStreams           int
+	muxStallTimeout            time.Duration
+	maxMsgLength               uint64
+	drainTimeout               time.Duration
+	connectionDrained          func(addr string, dropped int)
+	inboundIdlePolicy          *IdlePolicy
+	outboundIdlePolicy         *IdlePolicy
+	peerCache                  *peerCache
+	latencies                  *latencies
 
-	ringChanges               int32
-	ringChangeCloses          int32
-	msgToNodes                int32
-	msgToNodeNoRings          int32
-	msgToNodeNoNodes          int32
-	msgToOtherReplicas        int32
-	msgToOtherReplicasNoRings int32
-	listenErrors              int32
-	incomingConnections       int32
-	dials                     int32
-	dialErrors                int32
-	outgoingConnections       int32
-	msgChanCreations          int32
-	msgToAddrs                int32
-	msgToAddrQueues           int32
-	msgToAddrTimeoutDrops     int32
-	msgToAddrShutdownDrops    int32
-	msgReads                  int32
-	msgReadErrors             int32
-	msgWrites                 int32
-	msgWriteErrors            int32
-	statsLock                 sync.Mutex
+	ringChanges                int32
+	ringChangeCloses           int32
+	ringChangeDrainDrops       int32
+	msgToNodes                 int32
+	msgToNodeNoRings           int32
+	msgToNodeNoNodes           int32
+	msgToOtherReplicas         int32
+	msgToOtherReplicasNoRings  int32
+	msgToFormerReplicas        int32
+	msgToFormerReplicasNoRings int32
+	listenErrors               int32
+	incomingConnections        int32
+	dials                      int32
+	dialErrors                 int32
+	dialGiveUps                int32
+	dialGiveUpDrops            int32
+	outgoingConnections        int32
+	idleCloses                 int32
+	multiplexedConnections     int32
+	compressedConnections      int32
+	featureChanges             int32
+	msgChanCreations           int32
+	msgToAddrs                 int32
+	msgToAddrQueues            int32
+	msgToAddrTimeoutDrops      int32
+	msgToAddrShutdownDrops     int32
+	msgToAddrCircuitDrops      int32
+	msgToAddrInFlightDrops     int32
+	msgToAddrLengthDrops       int32
+	msgToAddrSplits            int32
+	msgMirrors                 int32
+	circuitBreakerOpens        int32
+	clockSkews                 int32
+	msgReads                   int32
+	msgReadErrors              int32
+	msgDedupDrops              int32
+	msgAborts                  int32
+	msgHandlerTimeouts         int32
+	msgStreamResets            int32
+	msgWrites                  int32
+	msgWriteErrors             int32
+	statsLock                  sync.Mutex
+	// unreported holds the counts taken by Totals since the last Stats, and
+	// totals the counts since creation by TCPMsgRingStats field name; both
+	// are guarded by statsLock.
+	unreported *TCPMsgRingStats
+	totals     map[string]int64
 
 	chaosAddrOffsLock        sync.RWMutex
 	chaosAddrOffs            map[string]bool
@@ -138,19 +447,27 @@ type TCPMsgRing struct {
 
 	useTLS             bool
 	mutualTLS          bool
+	clientAuth         TLSClientAuth
 	certFile           string
 	keyFile            string
 	caFile             string
 	insecureSkipVerify bool
 	serverTLSConfig    *tls.Config
+	tlsConfig          *tls.Config
+	sniCertFiles       []TLSCertFiles
+	certReloadInterval time.Duration
+	certModTimes       string
+	serverCertsLock    sync.RWMutex
+	serverCert         *tls.Certificate
+	sniCerts           []*tls.Certificate
 	clientCertLock     sync.RWMutex
 	clientCert         tls.Certificate
 	clientCAPool       *x509.CertPool
 }
 
-func newServerTLSConfig(certFile, keyFile, caFile string, insecureSkipVerify, mutualTLS bool) (*tls.Config, error) {
+func newServerTLSConfig(caFile string, insecureSkipVerify bool, clientAuth tls.ClientAuthType) (*tls.Config, error) {
 	tlsConf := &tls.Config{}
-	if mutualTLS {
+	if clientAuth != tls.NoClientCert {
 		caCert, err := ioutil.ReadFile(caFile)
 		if err != nil {
 			return nil, fmt.Errorf("Unable to load ca cert %s: %s", caFile, err.Error())
@@ -160,16 +477,10 @@ func newServerTLSConfig(certFile, keyFile, caFile string, insecureSkipVerify, mu
 			return nil, fmt.Errorf("Unable to append cert %s to pool.", caFile)
 		}
 		tlsConf = &tls.Config{
-			ClientAuth: tls.RequireAndVerifyClientCert,
+			ClientAuth: clientAuth,
 			ClientCAs:  clientCertPool,
 		}
-		tlsConf.BuildNameToCertificate()
-	}
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		return nil, err
 	}
-	tlsConf.Certificates = []tls.Certificate{cert}
 	tlsConf.InsecureSkipVerify = insecureSkipVerify
 	return tlsConf, nil
 }
@@ -200,21 +511,53 @@ func NewTCPMsgRing(c *TCPMsgRingConfig) (*TCPMsgRing, error) {
 		logDebugOn:                 cfg.LogDebug != nil,
 		controlChan:                make(chan struct{}),
 		addressIndex:               cfg.AddressIndex,
+		addressRole:                cfg.AddressRole,
+		ringAddressIndex:           cfg.AddressIndex,
+		retainedRings:              cfg.RetainedRings,
 		msgHandlers:                make(map[uint64]MsgUnmarshaller),
 		bufferedMessagesPerAddress: cfg.BufferedMessagesPerAddress,
 		msgChans:                   make(map[string]chan Msg),
+		msgChanStops:               make(map[chan Msg]chan struct{}),
 		connectTimeout:             time.Duration(cfg.ConnectTimeout) * time.Second,
 		reconnectInterval:          time.Duration(cfg.ReconnectInterval) * time.Second,
-		chunkSize:                  cfg.ChunkSize,
+		reconnectMaxInterval:       time.Duration(cfg.ReconnectMaxInterval) * time.Second,
+		reconnectJitter:            cfg.ReconnectJitter,
+		reconnectMaxRetries:        cfg.ReconnectMaxRetries,
+		readChunkSize:              cfg.ReadChunkSize,
+		writeChunkSize:             cfg.WriteChunkSize,
+		chunkSizes:                 cfg.ChunkSizes,
+		transportPolicy:            cfg.TransportPolicy,
+		clockSkewThreshold:         time.Duration(cfg.ClockSkewThreshold) * time.Millisecond,
+		clockSkewed:                cfg.ClockSkewed,
 		withinMessageTimeout:       time.Duration(cfg.WithinMessageTimeout) * time.Second,
+		tierAffinity:               cfg.TierAffinity,
+		dedupCache:                 newDedupCache(time.Duration(cfg.DedupWindow) * time.Second),
+		maxInFlightPerAddress:      int32(cfg.MaxInFlightPerAddress),
+		inFlight:                   make(map[string]*int32),
+		connected:                  make(map[string]int),
+		frameSent:                  cfg.FrameSent,
+		frameReceived:              cfg.FrameReceived,
+		handlerTimeoutDisconnect:   cfg.HandlerTimeoutDisconnect,
+		handlerTimedOut:            cfg.HandlerTimedOut,
+		multiplexStreams:           cfg.MultiplexStreams,
+		muxStallTimeout:            muxStreamStallTimeout,
+		maxMsgLength:               cfg.MaxMsgLength,
+		drainTimeout:               time.Duration(cfg.DrainTimeout) * time.Second,
+		connectionDrained:          cfg.ConnectionDrained,
+		inboundIdlePolicy:          resolveIdlePolicy(cfg.InboundIdlePolicy),
+		outboundIdlePolicy:         resolveIdlePolicy(cfg.OutboundIdlePolicy),
 		chaosAddrOffs:              make(map[string]bool),
 		chaosAddrDisconnects:       make(map[string]bool),
 		useTLS:                     cfg.UseTLS,
 		mutualTLS:                  cfg.MutualTLS,
+		clientAuth:                 cfg.ClientAuth,
 		certFile:                   cfg.CertFile,
 		keyFile:                    cfg.KeyFile,
 		caFile:                     cfg.CAFile,
 		insecureSkipVerify:         cfg.SkipVerify,
+		sniCertFiles:               cfg.SNICerts,
+		certReloadInterval:         time.Duration(cfg.CertReloadInterval) * time.Second,
+		latencies:                  newLatencies(cfg.LatencyWeight),
 	}
 	if t.logCritical == nil {
 		t.logCritical = nilLogFunc
@@ -222,20 +565,144 @@ func NewTCPMsgRing(c *TCPMsgRingConfig) (*TCPMsgRing, error) {
 	if t.logDebug == nil {
 		t.logDebug = nilLogFunc
 	}
-	if t.useTLS {
-		var err error
-		t.serverTLSConfig, err = newServerTLSConfig(t.certFile, t.keyFile, t.caFile, t.insecureSkipVerify, t.mutualTLS)
+	var err error
+	if t.peerCache, err = loadPeerCache(cfg.PeerCacheFile); err != nil {
+		// The cache is only an optimization; start over without it.
+		t.logDebug("NewTCPMsgRing: peer cache %s: %s\n", cfg.PeerCacheFile, err)
+		t.peerCache.peers = make(map[string]*PeerInfo)
+	}
+	if len(cfg.HandlerTimeouts) > 0 {
+		t.handlerTimeouts = make(map[uint64]time.Duration, len(cfg.HandlerTimeouts))
+		for msgType, timeout := range cfg.HandlerTimeouts {
+			if timeout > 0 {
+				t.handlerTimeouts[msgType] = time.Duration(timeout) * time.Millisecond
+			}
+		}
+	}
+	if cfg.MsgTraceSize > 0 {
+		t.msgTraces = newMsgTraces(cfg.MsgTraceSize)
+	}
+	if cfg.CircuitBreakerThreshold > 0 {
+		t.circuitBreakers = newCircuitBreakers(cfg.CircuitBreakerThreshold, time.Duration(cfg.CircuitBreakerCooldown)*time.Second, cfg.CircuitBreakerStateChange)
+	}
+	if t.useTLS && cfg.TLSConfig != nil {
+		t.tlsConfig = cfg.TLSConfig.Clone()
+		t.serverTLSConfig = cfg.TLSConfig.Clone()
+		t.serverTLSConfig.ClientAuth = t.clientAuth.tlsClientAuthType()
+		t.serverTLSConfig.InsecureSkipVerify = t.insecureSkipVerify
+	} else if t.useTLS {
+		t.serverTLSConfig, err = newServerTLSConfig(t.caFile, t.insecureSkipVerify, t.clientAuth.tlsClientAuthType())
 		if err != nil {
 			return nil, err
 		}
-		t.clientCert, t.clientCAPool, err = newClientCertAndPool(t.certFile, t.keyFile, t.caFile)
-		if err != nil {
+		t.serverTLSConfig.GetCertificate = t.getCertificate
+		t.certModTimes = t.certFileModTimes()
+		if err = t.ReloadCertificates(); err != nil {
 			return nil, err
 		}
+		if t.certReloadInterval > 0 {
+			go t.certReloader()
+		}
 	}
 	return t, nil
 }
 
+// ReloadCertificates loads the TLS certificates from their files again, for
+// use with new connections; existing connections are unaffected. If any
+// certificate fails to load, none are changed. With a TLSConfig given in
+// the TCPMsgRingConfig there are no files, and nothing is done.
+func (t *TCPMsgRing) ReloadCertificates() error {
+	if t.tlsConfig != nil {
+		return nil
+	}
+	serverCert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+	if err != nil {
+		return err
+	}
+	sniCerts := make([]*tls.Certificate, len(t.sniCertFiles))
+	for i, files := range t.sniCertFiles {
+		cert, err := tls.LoadX509KeyPair(files.CertFile, files.KeyFile)
+		if err != nil {
+			return err
+		}
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+		sniCerts[i] = &cert
+	}
+	clientCert, clientCAPool, err := newClientCertAndPool(t.certFile, t.keyFile, t.caFile)
+	if err != nil {
+		return err
+	}
+	t.serverCertsLock.Lock()
+	t.serverCert = &serverCert
+	t.sniCerts = sniCerts
+	t.serverCertsLock.Unlock()
+	t.clientCertLock.Lock()
+	t.clientCert = clientCert
+	t.clientCAPool = clientCAPool
+	t.clientCertLock.Unlock()
+	return nil
+}
+
+// getCertificate returns the first SNI certificate valid for the requested
+// server name, or the default certificate.
+func (t *TCPMsgRing) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	t.serverCertsLock.RLock()
+	defer t.serverCertsLock.RUnlock()
+	if hello.ServerName != "" {
+		for _, cert := range t.sniCerts {
+			if cert.Leaf.VerifyHostname(hello.ServerName) == nil {
+				return cert, nil
+			}
+		}
+	}
+	return t.serverCert, nil
+}
+
+// certFileModTimes returns a summary of the modification times of the
+// certificate files, for detecting changes.
+func (t *TCPMsgRing) certFileModTimes() string {
+	buf := &bytes.Buffer{}
+	files := []string{t.certFile, t.keyFile, t.caFile}
+	for _, f := range t.sniCertFiles {
+		files = append(files, f.CertFile, f.KeyFile)
+	}
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		if fi, err := os.Stat(file); err == nil {
+			fmt.Fprintf(buf, "%d ", fi.ModTime().UnixNano())
+		} else {
+			buf.WriteString("- ")
+		}
+	}
+	return buf.String()
+}
+
+func (t *TCPMsgRing) certReloader() {
+	for {
+		select {
+		case <-t.controlChan:
+			return
+		case <-time.After(t.certReloadInterval):
+		}
+		modTimes := t.certFileModTimes()
+		if modTimes == t.certModTimes {
+			continue
+		}
+		if err := t.ReloadCertificates(); err != nil {
+			// Files are often replaced one at a time, so the next check will
+			// try again.
+			t.logCritical("reloading certificates: %s\n", err)
+			continue
+		}
+		t.certModTimes = modTimes
+		t.logDebug("reloaded certificates\n")
+	}
+}
+
 // Ring returns the ring information used to determine messaging endpoints;
 // note that this method may return nil if no ring information is yet
 // available.
@@ -246,32 +713,126 @@ func (t *TCPMsgRing) Ring() Ring {
 	return r
 }
 
+// ringAndAddressIndex returns the current ring and the index to use with
+// Node.Address for that ring.
+func (t *TCPMsgRing) ringAndAddressIndex() (Ring, int) {
+	t.ringLock.RLock()
+	r := t.ring
+	addressIndex := t.ringAddressIndex
+	t.ringLock.RUnlock()
+	return r, addressIndex
+}
+
 // SetRing sets the ring whose information used to determine messaging
-// endpoints.
+// endpoints, and then tells any RingWatchers of the change.
 func (t *TCPMsgRing) SetRing(ring Ring) {
+	t.setRingLock.Lock()
+	defer t.setRingLock.Unlock()
 	atomic.AddInt32(&t.ringChanges, 1)
+	addressIndex := t.addressIndex
+	if t.addressRole != "" {
+		if i := ring.AddressIndex(t.addressRole); i >= 0 {
+			addressIndex = i
+		} else {
+			t.logDebug("SetRing: unknown address role %q; using address index %d\n", t.addressRole, addressIndex)
+		}
+	}
 	t.ringLock.Lock()
+	previous := t.ring
+	if t.ring != nil && t.ring.Version() != ring.Version() {
+		t.previousRings = append([]retainedRing{{ring: t.ring, addressIndex: t.ringAddressIndex}}, t.previousRings...)
+		if len(t.previousRings) > t.retainedRings {
+			t.previousRings = t.previousRings[:t.retainedRings]
+		}
+	}
 	t.ring = ring
+	t.ringAddressIndex = addressIndex
 	t.ringLock.Unlock()
 	addrs := make(map[string]bool)
+	addrToNodeID := make(map[string]uint64)
 	for _, n := range ring.Nodes() {
-		addrs[n.Address(t.addressIndex)] = true
+		addrs[n.Address(addressIndex)] = true
+		addrToNodeID[n.Address(addressIndex)] = n.ID()
+	}
+	for _, addr := range t.mirrorAddrs() {
+		addrs[addr] = true
+	}
+	if err := t.peerCache.prune(addrToNodeID); err != nil {
+		t.logDebug("SetRing: peer cache: %s\n", err)
+	}
+	t.latencies.prune(addrs)
+	if t.msgTraces != nil {
+		t.msgTraces.prune(addrs)
 	}
 	t.msgChansLock.Lock()
 	for addr, msgChan := range t.msgChans {
 		if !addrs[addr] {
 			atomic.AddInt32(&t.ringChangeCloses, 1)
-			close(msgChan)
 			delete(t.msgChans, addr)
+			go t.drain(addr, msgChan)
+			if t.circuitBreakers != nil {
+				t.circuitBreakers.forget(addr)
+			}
 		}
 	}
 	t.msgChansLock.Unlock()
+	t.inFlightLock.Lock()
+	for addr := range t.inFlight {
+		if !addrs[addr] {
+			delete(t.inFlight, addr)
+		}
+	}
+	t.inFlightLock.Unlock()
+	if previous == nil || previous.Version() != ring.Version() {
+		t.notifyRingWatchers(previous, ring)
+	}
+}
+
+// drain waits for the messages queued on the msgChan of an address removed
+// from the ring to be sent, up to the drainTimeout, and then stops the
+// connection for the address, freeing any messages left.
+//
+// The msgChan is never closed, as a msgToAddr call may have looked it up
+// before SetRing removed it and still be trying to queue a message.
+func (t *TCPMsgRing) drain(addr string, msgChan chan Msg) {
+	deadline := time.Now().Add(t.drainTimeout)
+	for len(msgChan) > 0 && time.Now().Before(deadline) {
+		select {
+		case <-t.controlChan:
+			deadline = time.Now()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	t.msgChansLock.Lock()
+	stopChan := t.msgChanStops[msgChan]
+	delete(t.msgChanStops, msgChan)
+	t.msgChansLock.Unlock()
+	if stopChan != nil {
+		close(stopChan)
+	}
+	dropped := 0
+DrainLoop:
+	for {
+		select {
+		case msg := <-msgChan:
+			dropped++
+			msg.Free()
+		default:
+			break DrainLoop
+		}
+	}
+	atomic.AddInt32(&t.ringChangeDrainDrops, int32(dropped))
+	t.logDebug("drain: %s dropped %d\n", addr, dropped)
+	if t.connectionDrained != nil {
+		t.connectionDrained(addr, dropped)
+	}
 }
 
 // MaxMsgLength indicates the maximum number of bytes the content of a message
-// may contain to be handled by this TCPMsgRing.
+// may contain to be handled by this TCPMsgRing; see
+// TCPMsgRingConfig.MaxMsgLength and PeerInfo.MaxMsgLength.
 func (t *TCPMsgRing) MaxMsgLength() uint64 {
-	return math.MaxUint64
+	return t.maxMsgLength
 }
 
 // MsgHandler returns the handler for the given message type, if there is any
@@ -292,26 +853,105 @@ func (t *TCPMsgRing) SetMsgHandler(msgType uint64, handler MsgUnmarshaller) {
 	t.msgHandlersLock.Unlock()
 }
 
+// SetDedupMsgHandler is like SetMsgHandler, but for message types whose
+// content begins with a unique 8 byte big endian message ID; a message whose
+// ID was already handled successfully within the DedupWindow is discarded
+// rather than given to the handler again. This lets senders retry messages
+// after transient failures without handlers seeing them twice. The handler
+// is still given the full content, ID included.
+func (t *TCPMsgRing) SetDedupMsgHandler(msgType uint64, handler MsgUnmarshaller) {
+	t.SetMsgHandler(msgType, func(reader io.Reader, length uint64) (uint64, error) {
+		if length < 8 {
+			return handler(reader, length)
+		}
+		idBytes := make([]byte, 8)
+		if _, err := io.ReadFull(reader, idBytes); err != nil {
+			return 0, err
+		}
+		msgID := binary.BigEndian.Uint64(idBytes)
+		if t.dedupCache.seen(msgType, msgID, time.Now()) {
+			atomic.AddInt32(&t.msgDedupDrops, 1)
+			n, err := io.CopyN(ioutil.Discard, reader, int64(length-8))
+			return 8 + uint64(n), err
+		}
+		consumed, err := handler(io.MultiReader(bytes.NewReader(idBytes), reader), length)
+		if err == nil && consumed == length {
+			t.dedupCache.record(msgType, msgID, time.Now())
+		}
+		return consumed, err
+	})
+}
+
 // MsgToNode queues the message for delivery to the indicated node; the timeout
 // should be considered for queueing, not for actual delivery.
 //
 // When the msg has actually been sent or has been discarded due to delivery
 // errors or delays, msg.Free() will be called.
 func (t *TCPMsgRing) MsgToNode(msg Msg, nodeID uint64, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	t.MsgToNodeErr(ctx, msg, nodeID)
+	cancel()
+}
+
+// Errors returned by MsgToNodeErr for messages it could not queue.
+var (
+	ErrNoRing          = errors.New("no ring")
+	ErrUnknownNode     = errors.New("node not in ring")
+	ErrCircuitOpen     = errors.New("circuit breaker open for node")
+	ErrTooManyInFlight = errors.New("too many messages in flight to node")
+	ErrMsgTooLong      = errors.New("message exceeds node's max message length")
+	ErrShutdown        = errors.New("msg ring shut down")
+)
+
+// MsgPartlyQueuedError is returned by MsgToNodeErr when a message split into
+// parts for the peer's MaxMsgLength could only have some of its parts queued;
+// see MsgSplitter. The parts queued are still sent, so the caller should
+// resend only the rest, if the message allows, rather than the whole message.
+type MsgPartlyQueuedError struct {
+	// Queued is how many of the Parts were queued, the first ones in the
+	// order Split returned them.
+	Queued int
+	Parts  int
+	// Err is why the next part was not queued.
+	Err error
+}
+
+func (e *MsgPartlyQueuedError) Error() string {
+	return fmt.Sprintf("queued %d of %d message parts: %s", e.Queued, e.Parts, e.Err)
+}
+
+func (e *MsgPartlyQueuedError) Unwrap() error {
+	return e.Err
+}
+
+// MsgToNodeErr is MsgToNode, but returns an error if the message could not be
+// queued, with the ctx bounding the wait for room in the queue rather than a
+// timeout. The error is one of the Err values above, ctx.Err() if the ctx is
+// done first, or a MsgPartlyQueuedError wrapping either for a message split
+// for the node and only partly queued; a caller may use it to hold onto the
+// content elsewhere, such as spooling to disk, until the node is reachable
+// again. The ctx should have a deadline, as a node that is down may not drain
+// its queue for some time.
+//
+// A nil error means the message was queued, not that it was delivered; as
+// with MsgToNode, msg.Free() will be called once it has been sent or has been
+// discarded, and is called before returning an error other than a
+// MsgPartlyQueuedError, whose queued parts are still to be sent.
+func (t *TCPMsgRing) MsgToNodeErr(ctx context.Context, msg Msg, nodeID uint64) error {
 	atomic.AddInt32(&t.msgToNodes, 1)
-	ring := t.Ring()
+	ring, addressIndex := t.ringAndAddressIndex()
 	if ring == nil {
 		atomic.AddInt32(&t.msgToNodeNoRings, 1)
 		msg.Free()
-		return
+		return ErrNoRing
 	}
 	node := ring.Node(nodeID)
 	if node == nil {
 		atomic.AddInt32(&t.msgToNodeNoNodes, 1)
 		msg.Free()
-		return
+		return ErrUnknownNode
 	}
-	t.msgToAddr(msg, node.Address(t.addressIndex), timeout)
+	return t.msgToAddrContext(ctx, t.mirrorToNode(msg, nodeID), node.Address(addressIndex))
 }
 
 // MsgToNode queues the message for delivery to all other replicas of a
@@ -323,40 +963,133 @@ func (t *TCPMsgRing) MsgToNode(msg Msg, nodeID uint64, timeout time.Duration) {
 //
 // When the msg has actually been sent or has been discarded due to delivery
 // errors or delays, msg.Free() will be called.
-func (t *TCPMsgRing) MsgToOtherReplicas(msg Msg, partition uint32, timeout time.Duration) {
+func (t *TCPMsgRing) MsgToOtherReplicas(msg Msg, partition Partition, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	t.MsgToOtherReplicasErr(ctx, msg, partition)
+	cancel()
+}
+
+// MsgToOtherReplicasErr is MsgToOtherReplicas, but returns an error if the
+// message could not be queued to any of the other replicas, with the ctx
+// bounding the wait for room in their queues rather than a timeout; see
+// MsgToNodeErr. With TierAffinity, each tier distance gets the time the ctx
+// had left at the call, as with the timeout of MsgToOtherReplicas, so slow
+// near replicas do not use up the wait of farther ones; canceling the ctx
+// still stops them all. The error is ErrNoRing, or the error of one of the
+// replicas.
+// A nil error means the message was queued to at least one replica, or that
+// there were no other replicas to send to.
+func (t *TCPMsgRing) MsgToOtherReplicasErr(ctx context.Context, msg Msg, partition Partition) error {
 	atomic.AddInt32(&t.msgToOtherReplicas, 1)
-	ring := t.Ring()
+	ring, addressIndex := t.ringAndAddressIndex()
 	if ring == nil {
+		atomic.AddInt32(&t.msgToOtherReplicasNoRings, 1)
+		msg.Free()
+		return ErrNoRing
+	}
+	return t.msgToOtherReplicasOf(ctx, ring, addressIndex, msg, partition)
+}
+
+// MsgToOtherReplicasOfVersion is MsgToOtherReplicas using the ring with the
+// version given, which may be the current ring or a retained previous ring;
+// see RingOfVersion. This keeps messages stamped with the ring version they
+// were sent under routed correctly while a new ring propagates. If there is
+// no ring with the version, or the partition is beyond that ring's partition
+// count, the message is discarded and counted as a MsgToOtherReplicasNoRings.
+func (t *TCPMsgRing) MsgToOtherReplicasOfVersion(msg Msg, ringVersion int64, partition Partition, timeout time.Duration) {
+	atomic.AddInt32(&t.msgToOtherReplicas, 1)
+	ring, addressIndex := t.ringOfVersion(ringVersion)
+	if ring == nil || partition >= Partition(1)<<ring.PartitionBitCount() {
 		atomic.AddInt32(&t.msgToOtherReplicasNoRings, 1)
 		msg.Free()
 		return
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	t.msgToOtherReplicasOf(ctx, ring, addressIndex, msg, partition)
+	cancel()
+}
+
+func (t *TCPMsgRing) msgToOtherReplicasOf(ctx context.Context, ring Ring, addressIndex int, msg Msg, partition Partition) error {
+	msg = t.mirrorToReplicas(msg, partition, ring.PartitionBitCount())
 	nodes := ring.ResponsibleNodes(partition)
 	mmsg := &multiMsg{msg: msg, freerChan: make(chan struct{}, len(nodes))}
-	toAddrChan := make(chan struct{}, len(nodes))
-	toAddr := func(addr string) {
-		t.msgToAddr(mmsg, addr, timeout)
-		toAddrChan <- struct{}{}
+	toAddrChan := make(chan error, len(nodes))
+	toAddr := func(ctx context.Context, addr string) {
+		toAddrChan <- t.msgToAddrContext(ctx, mmsg, addr)
 	}
+	localNode := ring.LocalNode()
 	var localID uint64
-	if localNode := ring.LocalNode(); localNode != nil {
+	if localNode != nil {
 		localID = localNode.ID()
 	}
+	// Without tier affinity all the nodes are at distance 0 and therefore
+	// queued concurrently.
+	distances := make([]int, len(nodes))
+	maxDistance := 0
+	if t.tierAffinity && localNode != nil {
+		for i, node := range nodes {
+			distances[i] = TierDistance(localNode, node)
+			if distances[i] > maxDistance {
+				maxDistance = distances[i]
+			}
+		}
+	}
+	var timeout time.Duration
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		timeout = time.Until(deadline)
+	}
 	toAddrs := 0
-	for _, node := range nodes {
-		if node.ID() != localID {
-			go toAddr(node.Address(t.addressIndex))
-			toAddrs++
+	queuedAny := false
+	var err error
+	for distance := 0; distance <= maxDistance; distance++ {
+		distanceCtx, cancel := ctx, context.CancelFunc(func() {})
+		if hasDeadline && distance > 0 {
+			distanceCtx, cancel = distanceContext(ctx, timeout)
+		}
+		started := 0
+		for i, node := range nodes {
+			if distances[i] == distance && node.ID() != localID {
+				go toAddr(distanceCtx, node.Address(addressIndex))
+				started++
+			}
+		}
+		for i := 0; i < started; i++ {
+			if toAddrErr := <-toAddrChan; toAddrErr != nil {
+				err = toAddrErr
+			} else {
+				queuedAny = true
+			}
 		}
+		cancel()
+		toAddrs += started
 	}
 	if toAddrs == 0 {
 		msg.Free()
-		return
-	}
-	for i := 0; i < toAddrs; i++ {
-		<-toAddrChan
+		return nil
 	}
 	go mmsg.freer(toAddrs)
+	if queuedAny {
+		return nil
+	}
+	return err
+}
+
+// distanceContext returns a context for queueing to the replicas of a tier
+// distance, with its own timeout rather than the ctx's deadline, which the
+// nearer replicas may have used up; it is still canceled along with the ctx.
+func distanceContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	distanceCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	go func() {
+		select {
+		case <-ctx.Done():
+			if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				cancel()
+			}
+		case <-distanceCtx.Done():
+		}
+	}()
+	return distanceCtx, cancel
 }
 
 func verifyClientAddrMatch(c *tls.Conn) error {
@@ -375,27 +1108,42 @@ func verifyClientAddrMatch(c *tls.Conn) error {
 // messages from those connections; this function will not return until
 // t.Shutdown() is called.
 func (t *TCPMsgRing) Listen() {
+	t.ListenContext(context.Background())
+}
+
+// ListenContext is Listen, but also stops listening once the ctx is done,
+// returning ctx.Err(); connections already accepted are unaffected, and
+// messages keep being sent. This allows a node to stop taking connections,
+// such as while draining it, without a Shutdown. It returns nil after a
+// Shutdown.
+func (t *TCPMsgRing) ListenContext(ctx context.Context) error {
 	var err error
 OuterLoop:
 	for {
 		if err != nil {
 			atomic.AddInt32(&t.listenErrors, 1)
 			t.logCritical("listen: %s\n", err)
-			time.Sleep(time.Second)
+			if !t.sleepUnlessDone(ctx, time.Second) {
+				break
+			}
 		}
 		select {
 		case <-t.controlChan:
 			break OuterLoop
+		case <-ctx.Done():
+			break OuterLoop
 		default:
 		}
-		ring := t.Ring()
+		ring, addressIndex := t.ringAndAddressIndex()
 		if ring == nil {
-			time.Sleep(time.Second)
+			if !t.sleepUnlessDone(ctx, time.Second) {
+				break
+			}
 			continue
 		}
 		node := ring.LocalNode()
 		var tcpAddr *net.TCPAddr
-		tcpAddr, err = net.ResolveTCPAddr("tcp", node.Address(t.addressIndex))
+		tcpAddr, err = net.ResolveTCPAddr("tcp", node.Address(addressIndex))
 		if err != nil {
 			continue
 		}
@@ -404,42 +1152,63 @@ OuterLoop:
 		if err != nil {
 			continue
 		}
-		for {
+		if !t.setListener(server) {
+			// Shutdown was called while listening was being set up.
+			server.Close()
+			break
+		}
+		var listener net.Listener = &keepAliveListener{TCPListener: server, period: t.inboundIdlePolicy.keepAlivePeriod()}
+		if t.useTLS {
+			listener = tls.NewListener(listener, t.serverTLSConfig)
+		}
+		acceptDone := make(chan struct{})
+		go func(server *net.TCPListener) {
 			select {
-			case <-t.controlChan:
-				break OuterLoop
-			default:
+			case <-ctx.Done():
+				server.Close()
+			case <-acceptDone:
 			}
-			// Deadline to force checking t.controlChan once a second.
-			server.SetDeadline(time.Now().Add(time.Second))
+		}(server)
+		for {
 			var netConn net.Conn
-			if t.useTLS {
-				l := tls.NewListener(server, t.serverTLSConfig)
-				netConn, err = l.Accept()
-				if err == nil {
-					if t.mutualTLS {
-						err = verifyClientAddrMatch(netConn.(*tls.Conn))
-						if err != nil {
-							t.logCritical("Client address != any cert names")
-						}
-					}
+			netConn, err = listener.Accept()
+			if err != nil {
+				close(acceptDone)
+				t.setListener(nil)
+				select {
+				case <-t.controlChan:
+					// Shutdown closed the listener.
+					break OuterLoop
+				case <-ctx.Done():
+					server.Close()
+					break OuterLoop
+				default:
 				}
-			} else {
-				netConn, err = server.AcceptTCP()
+				if errors.Is(err, net.ErrClosed) {
+					err = nil
+				} else {
+					server.Close()
+				}
+				continue OuterLoop
 			}
-			if err != nil {
-				if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+			if t.useTLS && t.clientAuth == TLSClientAuthDefault {
+				if err = verifyClientAddrMatch(netConn.(*tls.Conn)); err != nil {
+					t.logCritical("Client address != any cert names")
+					netConn.Close()
+					err = nil
 					continue
 				}
-				server.Close()
-				continue OuterLoop
 			}
 			atomic.AddInt32(&t.incomingConnections, 1)
 			go func(netConn net.Conn) {
-				if addr, err := t.handshake(netConn); err != nil {
+				if addr, features, err := t.handshake(netConn); err != nil {
 					t.logDebug("listen: %s %s\n", addr, err)
 					netConn.Close()
 					return
+				} else if err = t.verifyClientIdentity(netConn, addr); err != nil {
+					t.logCritical("listen: %s %s\n", addr, err)
+					netConn.Close()
+					return
 				} else {
 					t.chaosAddrOffsLock.RLock()
 					if t.chaosAddrOffs[addr] {
@@ -455,18 +1224,69 @@ OuterLoop:
 					// connection has terminated it won't be reestablished
 					// since there is already another connection running that
 					// will redial.
-					go t.connection(addr, netConn, msgChan, created)
+					go t.connection(addr, t.policyConn(netConn, addr, features&featureCompress != 0), msgChan, created, features&featureMultiplex != 0)
 				}
 			}(netConn)
 		}
 	}
+	select {
+	case <-t.controlChan:
+		return nil
+	default:
+	}
+	return ctx.Err()
 }
 
 // Shutdown will signal the shutdown of all connections, listeners, etc.
 // related to the TCPMsgRing; once Shutdown you must create a new TCPMsgRing to
 // restart operations.
 func (t *TCPMsgRing) Shutdown() {
+	t.listenerLock.Lock()
 	close(t.controlChan)
+	if t.listener != nil {
+		t.listener.Close()
+	}
+	t.listenerLock.Unlock()
+}
+
+// setListener records the listener Listen is accepting connections with, or
+// nil once it is not, returning false if Shutdown has already been called.
+func (t *TCPMsgRing) setListener(listener *net.TCPListener) bool {
+	t.listenerLock.Lock()
+	defer t.listenerLock.Unlock()
+	select {
+	case <-t.controlChan:
+		t.listener = nil
+		return false
+	default:
+	}
+	t.listener = listener
+	return true
+}
+
+// ListenAddr returns the address Listen is currently accepting connections
+// on, or an empty string if it is not, such as while waiting for a ring with
+// a local node, after a listen error, or after Shutdown.
+func (t *TCPMsgRing) ListenAddr() string {
+	t.listenerLock.Lock()
+	defer t.listenerLock.Unlock()
+	if t.listener == nil {
+		return ""
+	}
+	return t.listener.Addr().String()
+}
+
+// sleepUnlessDone waits for the duration, returning false early if
+// Shutdown is called or the ctx is done.
+func (t *TCPMsgRing) sleepUnlessDone(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-t.controlChan:
+		return false
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
 }
 
 // msgChanForAddr returns the channel for the address as well as a bool
@@ -488,10 +1308,30 @@ func (t *TCPMsgRing) msgChanForAddr(addr string) (chan Msg, bool) {
 	atomic.AddInt32(&t.msgChanCreations, 1)
 	msgChan = make(chan Msg, t.bufferedMessagesPerAddress)
 	t.msgChans[addr] = msgChan
+	t.msgChanStops[msgChan] = make(chan struct{})
 	t.msgChansLock.Unlock()
 	return msgChan, true
 }
 
+// inFlightForAddr returns the counter of messages waiting to be queued for the
+// address.
+func (t *TCPMsgRing) inFlightForAddr(addr string) *int32 {
+	t.inFlightLock.RLock()
+	inFlight := t.inFlight[addr]
+	t.inFlightLock.RUnlock()
+	if inFlight != nil {
+		return inFlight
+	}
+	t.inFlightLock.Lock()
+	inFlight = t.inFlight[addr]
+	if inFlight == nil {
+		inFlight = new(int32)
+		t.inFlight[addr] = inFlight
+	}
+	t.inFlightLock.Unlock()
+	return inFlight
+}
+
 // lookupMsgChanForAddr returns the channel for the address or nil if there is
 // none.
 func (t *TCPMsgRing) lookupMsgChanForAddr(addr string) chan Msg {
@@ -502,46 +1342,219 @@ func (t *TCPMsgRing) lookupMsgChanForAddr(addr string) chan Msg {
 }
 
 func (t *TCPMsgRing) msgToAddr(msg Msg, addr string, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	t.msgToAddrContext(ctx, msg, addr)
+	cancel()
+}
+
+// msgToAddrContext queues the message for the address, waiting for room in
+// the queue until the ctx is done, and returns why the message was dropped if
+// it was.
+func (t *TCPMsgRing) msgToAddrContext(ctx context.Context, msg Msg, addr string) error {
 	atomic.AddInt32(&t.msgToAddrs, 1)
+	if maxMsgLength := t.peerCache.maxMsgLength(addr); maxMsgLength > 0 && msg.MsgLength() > maxMsgLength {
+		return t.msgToAddrTooLong(ctx, msg, addr, maxMsgLength)
+	}
+	if t.circuitBreakers != nil && !t.circuitBreakers.allow(addr, time.Now()) {
+		atomic.AddInt32(&t.msgToAddrCircuitDrops, 1)
+		msg.Free()
+		return ErrCircuitOpen
+	}
+	if t.maxInFlightPerAddress > 0 {
+		inFlight := t.inFlightForAddr(addr)
+		if atomic.AddInt32(inFlight, 1) > t.maxInFlightPerAddress {
+			atomic.AddInt32(inFlight, -1)
+			atomic.AddInt32(&t.msgToAddrInFlightDrops, 1)
+			msg.Free()
+			return ErrTooManyInFlight
+		}
+		defer atomic.AddInt32(inFlight, -1)
+	}
 	msgChan, created := t.msgChanForAddr(addr)
 	if created {
-		go t.connection(addr, nil, msgChan, true)
+		go t.connection(addr, nil, msgChan, true, false)
+	}
+	// Queue right away if there is room, as select would otherwise pick at
+	// random between the send and an already done ctx.
+	select {
+	case msgChan <- msg:
+		atomic.AddInt32(&t.msgToAddrQueues, 1)
+		return nil
+	default:
 	}
-	timer := time.NewTimer(timeout)
 	select {
 	case <-t.controlChan:
 		atomic.AddInt32(&t.msgToAddrShutdownDrops, 1)
-		timer.Stop()
 		msg.Free()
+		return ErrShutdown
 	case msgChan <- msg:
 		atomic.AddInt32(&t.msgToAddrQueues, 1)
-		timer.Stop()
-	case <-timer.C:
+		return nil
+	case <-ctx.Done():
 		atomic.AddInt32(&t.msgToAddrTimeoutDrops, 1)
 		msg.Free()
+		return ctx.Err()
+	}
+}
+
+// msgToAddrTooLong handles a message longer than the peer at the address
+// accepts, sending the parts if it is a MsgSplitter that can be split small
+// enough, and otherwise dropping it. Queueing stops at the first part that
+// cannot be queued, discarding the rest; the error is that part's if it was
+// the first, and otherwise a MsgPartlyQueuedError.
+func (t *TCPMsgRing) msgToAddrTooLong(ctx context.Context, msg Msg, addr string, maxMsgLength uint64) error {
+	splitter, ok := msg.(MsgSplitter)
+	if m, isMulti := msg.(*multiMsg); isMulti {
+		splitter, ok = m.msg.(MsgSplitter)
+	}
+	var parts []Msg
+	if ok {
+		parts = splitter.Split(maxMsgLength)
+	}
+	for _, part := range parts {
+		if part.MsgLength() > maxMsgLength {
+			for _, part := range parts {
+				part.Free()
+			}
+			parts = nil
+			break
+		}
+	}
+	if len(parts) == 0 {
+		atomic.AddInt32(&t.msgToAddrLengthDrops, 1)
+		t.logDebug("msgToAddr: %s message %x of %d bytes exceeds the peer's max of %d\n", addr, msg.MsgType(), msg.MsgLength(), maxMsgLength)
+		msg.Free()
+		return ErrMsgTooLong
+	}
+	atomic.AddInt32(&t.msgToAddrSplits, 1)
+	// The parts may share the original's buffers, so it is only freed once
+	// they have all been sent or discarded.
+	remaining := int32(len(parts))
+	for i, part := range parts {
+		if err := t.msgToAddrContext(ctx, &splitPartMsg{Msg: part, original: msg, remaining: &remaining}, addr); err != nil {
+			for _, part := range parts[i+1:] {
+				(&splitPartMsg{Msg: part, original: msg, remaining: &remaining}).Free()
+			}
+			if i == 0 {
+				return err
+			}
+			return &MsgPartlyQueuedError{Queued: i, Parts: len(parts), Err: err}
+		}
+	}
+	return nil
+}
+
+// splitPartMsg is a part of a split Msg that frees the original Msg once the
+// last of the parts is freed.
+type splitPartMsg struct {
+	Msg
+	original  Msg
+	remaining *int32
+}
+
+func (m *splitPartMsg) Free() {
+	m.Msg.Free()
+	if atomic.AddInt32(m.remaining, -1) == 0 {
+		m.original.Free()
 	}
-	// TODO: Uncertain the code block above is better than that below.
-	//       Seems reasonable to Stop a timer if it won't be used; but
-	//       perhaps that's more expensive than just letting it fire.
-	//	select {
-	//	case <-t.controlChan:
-	//		msg.Free()
-	//	case msgChan <- msg:
-	//	case <-time.After(timeout):
-	//		msg.Free()
-	//	}
 }
 
-var TCP_MSG_RING_VERSION = []byte("TCPMSGRINGv00001")
+var TCP_MSG_RING_VERSION = []byte("TCPMSGRINGv00002")
 
-func (t *TCPMsgRing) handshake(netConn net.Conn) (string, error) {
+// Feature flags exchanged during the handshake; see handshakeBlock. New
+// transport features get new flags, and any values they need new fields
+// appended to the handshakeBlock, rather than a new protocol version; flags
+// and fields a peer does not know are ignored, so peers with different
+// feature sets still connect during a rolling deploy, using the features
+// both support, and pick up new features when they reconnect after both are
+// upgraded. Peers of the first release, speaking TCPMSGRINGv00001 with no
+// handshakeBlock, cannot connect to these; that release's nodes are upgraded
+// together.
+const (
+	featureCompress byte = 1 << iota
+	featureMultiplex
+)
+
+// featureNames returns the names of the known feature flags set; never nil.
+func featureNames(features byte) []string {
+	names := make([]string, 0, 2)
+	if features&featureCompress != 0 {
+		names = append(names, "compress")
+	}
+	if features&featureMultiplex != 0 {
+		names = append(names, "multiplex")
+	}
+	return names
+}
+
+// handshakeBlock is what each end gives after the protocol versions and node
+// IDs: its feature flags, its wall clock time, to estimate the clock skew
+// between the two, and its MaxMsgLength. It is sent prefixed with its 16 bit
+// length so fields can be appended without a new protocol version; a shorter
+// block from a peer lacking later fields leaves them zero, meaning not known,
+// and the bytes of fields not known locally are skipped.
+type handshakeBlock struct {
+	features     byte
+	clock        int64
+	maxMsgLength uint64
+}
+
+// handshakeBlockLength is the encoded length of a handshakeBlock, without its
+// length prefix.
+const handshakeBlockLength = 17
+
+func (h *handshakeBlock) encode() []byte {
+	buf := make([]byte, 2+handshakeBlockLength)
+	binary.BigEndian.PutUint16(buf, handshakeBlockLength)
+	buf[2] = h.features
+	binary.BigEndian.PutUint64(buf[3:], uint64(h.clock))
+	binary.BigEndian.PutUint64(buf[11:], h.maxMsgLength)
+	return buf
+}
+
+// readHandshakeBlock reads a length prefixed handshakeBlock, as written by
+// encode, from a peer possibly knowing more or fewer fields.
+func readHandshakeBlock(r io.Reader) (*handshakeBlock, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	h := &handshakeBlock{}
+	if len(buf) >= 1 {
+		h.features = buf[0]
+	}
+	if len(buf) >= 9 {
+		h.clock = int64(binary.BigEndian.Uint64(buf[1:]))
+	}
+	if len(buf) >= 17 {
+		h.maxMsgLength = binary.BigEndian.Uint64(buf[9:])
+	}
+	return h, nil
+}
+
+// protocolVersionError is the handshake error for a peer speaking a different
+// protocol version; the value is the version the peer sent.
+type protocolVersionError string
+
+func (e protocolVersionError) Error() string {
+	return "invalid remote protocol version: " + string(e)
+}
+
+// handshake exchanges protocol versions, node IDs, feature flags, and clock
+// readings with the peer, returning the peer's address and the features
+// agreed upon for the connection.
+func (t *TCPMsgRing) handshake(netConn net.Conn) (string, byte, error) {
 	addr := netConn.RemoteAddr().String()
 	var localID uint64
 	if localNode := t.Ring().LocalNode(); localNode != nil {
 		localID = localNode.ID()
 	}
 	if localID == 0 {
-		return addr, errors.New("no local ring id")
+		return addr, 0, errors.New("no local ring id")
 	}
 	errchan := make(chan error)
 	go func() {
@@ -568,35 +1581,88 @@ func (t *TCPMsgRing) handshake(netConn net.Conn) (string, error) {
 	_, err := io.ReadFull(netConn, buf)
 	netConn.SetReadDeadline(time.Time{})
 	if err != nil {
-		return addr, err
+		return addr, 0, err
 	}
 	if !bytes.Equal(buf, TCP_MSG_RING_VERSION) {
-		return addr, fmt.Errorf("invalid remote protocol version: %s", string(buf))
+		return addr, 0, protocolVersionError(buf)
 	}
 	buf = make([]byte, 8)
 	netConn.SetReadDeadline(time.Now().Add(t.withinMessageTimeout))
 	_, err = io.ReadFull(netConn, buf)
 	netConn.SetReadDeadline(time.Time{})
 	if err != nil {
-		return addr, err
+		return addr, 0, err
 	}
 	remoteID := binary.BigEndian.Uint64(buf)
 	if remoteID == 0 {
-		return addr, fmt.Errorf("no remote ring id")
+		return addr, 0, fmt.Errorf("no remote ring id")
 	}
-	remoteNode := t.Ring().Node(remoteID)
+	ring, addressIndex := t.ringAndAddressIndex()
+	remoteNode := ring.Node(remoteID)
 	if remoteNode == nil {
-		return addr, fmt.Errorf("unknown remote ring id %d %x", remoteID, remoteID)
+		return addr, 0, fmt.Errorf("unknown remote ring id %d %x", remoteID, remoteID)
 	}
-	if remoteNode.Address(t.addressIndex) == "" {
-		return addr, fmt.Errorf("unknown address %d for remote ring id %d %x", t.addressIndex, remoteID, remoteID)
+	if remoteNode.Address(addressIndex) == "" {
+		return addr, 0, fmt.Errorf("unknown address %d for remote ring id %d %x", addressIndex, remoteID, remoteID)
 	} else {
-		addr = remoteNode.Address(t.addressIndex)
+		addr = remoteNode.Address(addressIndex)
 	}
 	if err := <-errchan; err != nil {
-		return addr, err
+		return addr, 0, err
+	}
+	// Each end then gives its handshakeBlock. The connection is compressed
+	// if either end's TransportPolicy for the other asks for compression,
+	// and multiplexed if both ends would multiplex.
+	local := &handshakeBlock{maxMsgLength: t.maxMsgLength}
+	if p := t.transportPolicyFor(addr); p != nil && p.Compress {
+		local.features |= featureCompress
 	}
-	return addr, nil
+	if t.multiplexStreams > 1 {
+		local.features |= featureMultiplex
+	}
+	sent := time.Now()
+	local.clock = sent.UnixNano()
+	netConn.SetWriteDeadline(time.Now().Add(t.withinMessageTimeout))
+	_, err = netConn.Write(local.encode())
+	netConn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		return addr, 0, err
+	}
+	netConn.SetReadDeadline(time.Now().Add(t.withinMessageTimeout))
+	remote, err := readHandshakeBlock(netConn)
+	netConn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return addr, 0, err
+	}
+	features := (local.features|remote.features)&featureCompress | local.features&remote.features&featureMultiplex
+	if err := t.peerCache.record(addr, remoteID, string(TCP_MSG_RING_VERSION), time.Now()); err != nil {
+		t.logDebug("handshake: peer cache: %s\n", err)
+	}
+	if err := t.peerCache.setMaxMsgLength(addr, remote.maxMsgLength); err != nil {
+		t.logDebug("handshake: peer cache: %s\n", err)
+	}
+	if t.peerCache.setFeatures(addr, featureNames(features), featureNames(remote.features)) {
+		atomic.AddInt32(&t.featureChanges, 1)
+		t.logDebug("handshake: %s features now %v\n", addr, featureNames(features))
+	}
+	if remote.clock != 0 {
+		t.observeClockSkew(addr, clockSkew(sent, time.Now(), remote.clock))
+	}
+	return addr, features, nil
+}
+
+// Peer returns what was learned about the peer at the address from its last
+// handshake, including from before a restart if the PeerCacheFile is set.
+// Knowing a peer's node ID and protocol version before connecting lets
+// callers, for example, choose which messages to send it.
+func (t *TCPMsgRing) Peer(addr string) (PeerInfo, bool) {
+	return t.peerCache.get(addr)
+}
+
+// Peers returns what was learned about all peers, ordered by address; see
+// Peer.
+func (t *TCPMsgRing) Peers() []PeerInfo {
+	return t.peerCache.all()
 }
 
 func (t *TCPMsgRing) newClientTLSConfig(addr string) *tls.Config {
@@ -604,6 +1670,11 @@ func (t *TCPMsgRing) newClientTLSConfig(addr string) *tls.Config {
 		return &tls.Config{ServerName: "", InsecureSkipVerify: true}
 	}
 	serverName, _, _ := net.SplitHostPort(addr)
+	if t.tlsConfig != nil {
+		tlsConf := t.tlsConfig.Clone()
+		tlsConf.ServerName = serverName
+		return tlsConf
+	}
 	t.clientCertLock.RLock()
 	tlsConf := &tls.Config{
 		Certificates: []tls.Certificate{t.clientCert},
@@ -615,12 +1686,71 @@ func (t *TCPMsgRing) newClientTLSConfig(addr string) *tls.Config {
 	return tlsConf
 }
 
-func (t *TCPMsgRing) connection(addr string, netConn net.Conn, msgChan chan Msg, dialOk bool) {
+// tlsClient starts TLS on the connection and completes the TLS handshake, so
+// the timing of the TCPMsgRing handshake that follows is just its own round
+// trip. The ctx may end the TLS handshake early.
+func (t *TCPMsgRing) tlsClient(ctx context.Context, baseConn net.Conn, addr string) (*tls.Conn, error) {
+	tlsConn := tls.Client(baseConn, t.newClientTLSConfig(addr))
+	tlsConn.SetDeadline(time.Now().Add(t.withinMessageTimeout))
+	err := tlsConn.HandshakeContext(ctx)
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, err
+}
+
+// connectionChunkSizes returns the read and write chunk sizes to use for a
+// connection; see TCPMsgRingConfig.ChunkSizes.
+func (t *TCPMsgRing) connectionChunkSizes(addr string, inbound bool) (int, int) {
+	readChunkSize, writeChunkSize := t.readChunkSize, t.writeChunkSize
+	if t.chunkSizes != nil {
+		r, w := t.chunkSizes(addr, inbound)
+		if r > 0 {
+			readChunkSize = r
+		}
+		if w > 0 {
+			writeChunkSize = w
+		}
+	}
+	return readChunkSize, writeChunkSize
+}
+
+// connection runs the reader and writer for the connection given, if any,
+// redialing the address when it is lost if dialOk; multiplex indicates
+// whether the connection given was agreed to be multiplexed.
+func (t *TCPMsgRing) connection(addr string, netConn net.Conn, msgChan chan Msg, dialOk bool, multiplex bool) {
+	t.msgChansLock.RLock()
+	stopChan := t.msgChanStops[msgChan]
+	t.msgChansLock.RUnlock()
+	if stopChan == nil {
+		// Already drained.
+		if netConn != nil {
+			netConn.Close()
+		}
+		return
+	}
+	inbound := netConn != nil
+	failures := 0
+	// Dials and TLS handshakes in progress are abandoned on Shutdown or
+	// once the address is drained, rather than running out their timeouts.
+	dialCtx, cancelDial := context.WithCancel(context.Background())
+	defer cancelDial()
+	go func() {
+		select {
+		case <-t.controlChan:
+		case <-stopChan:
+		case <-dialCtx.Done():
+		}
+		cancelDial()
+	}()
+	// probeTimer waits out an open circuit breaker; it is made on first use
+	// and is stopped or drained whenever a wait ends.
+	var probeTimer *time.Timer
 OuterLoop:
 	for {
 		select {
 		case <-t.controlChan:
 			break OuterLoop
+		case <-stopChan:
+			break OuterLoop
 		default:
 			if msgChan != t.lookupMsgChanForAddr(addr) {
 				// If the channel for this addr has changed or is no longer
@@ -633,6 +1763,26 @@ OuterLoop:
 			if !dialOk {
 				break OuterLoop
 			}
+			inbound = false
+			if t.circuitBreakers != nil {
+				if wait := t.circuitBreakers.probeWait(addr, time.Now()); wait > 0 {
+					if probeTimer == nil {
+						probeTimer = time.NewTimer(wait)
+					} else {
+						probeTimer.Reset(wait)
+					}
+					select {
+					case <-t.controlChan:
+						probeTimer.Stop()
+						break OuterLoop
+					case <-stopChan:
+						probeTimer.Stop()
+						break OuterLoop
+					case <-probeTimer.C:
+					}
+					continue OuterLoop
+				}
+			}
 			atomic.AddInt32(&t.dials, 1)
 			t.chaosAddrOffsLock.RLock()
 			if t.chaosAddrOffs[addr] {
@@ -641,14 +1791,22 @@ OuterLoop:
 			} else {
 				t.chaosAddrOffsLock.RUnlock()
 				var baseConn net.Conn
-				baseConn, err = net.DialTimeout("tcp", addr, t.connectTimeout)
+				dialer := &net.Dialer{Timeout: t.connectTimeoutFor(addr), KeepAlive: t.outboundIdlePolicy.keepAlivePeriod()}
+				baseConn, err = dialer.DialContext(dialCtx, "tcp", addr)
 				if err == nil {
+					netConn = baseConn
 					if t.useTLS {
-						netConn = tls.Client(baseConn, t.newClientTLSConfig(addr))
-					} else {
-						netConn = baseConn
+						netConn, err = t.tlsClient(dialCtx, baseConn, addr)
+					}
+					if err == nil {
+						start := time.Now()
+						var features byte
+						if _, features, err = t.handshake(netConn); err == nil {
+							t.latencies.observe(addr, time.Since(start))
+							netConn = t.policyConn(netConn, addr, features&featureCompress != 0)
+							multiplex = features&featureMultiplex != 0
+						}
 					}
-					_, err = t.handshake(netConn)
 				}
 			}
 			if err != nil {
@@ -658,10 +1816,30 @@ OuterLoop:
 					netConn = nil
 				}
 				t.logDebug("connection: %s %s\n", addr, err)
-				time.Sleep(t.reconnectInterval)
+				failures++
+				opened := t.circuitBreakers != nil && t.circuitBreakers.failure(addr, time.Now())
+				if opened {
+					atomic.AddInt32(&t.circuitBreakerOpens, 1)
+				}
+				if t.reconnectMaxRetries > 0 && failures >= t.reconnectMaxRetries {
+					t.giveUpConnection(addr, msgChan)
+					break OuterLoop
+				}
+				if opened {
+					continue OuterLoop
+				}
+				select {
+				case <-t.controlChan:
+				case <-stopChan:
+				case <-time.After(t.reconnectWait(failures)):
+				}
 				continue OuterLoop
 			}
+			failures = 0
 			atomic.AddInt32(&t.outgoingConnections, 1)
+			if t.circuitBreakers != nil {
+				t.circuitBreakers.success(addr, time.Now())
+			}
 		}
 		t.chaosAddrDisconnectsLock.RLock()
 		if t.chaosAddrDisconnects[addr] {
@@ -672,29 +1850,132 @@ OuterLoop:
 			}(netConn)
 		}
 		t.chaosAddrDisconnectsLock.RUnlock()
+		t.setConnected(addr, 1)
+		idlePolicy := t.outboundIdlePolicy
+		if inbound {
+			idlePolicy = t.inboundIdlePolicy
+		}
+		var idleTimeout time.Duration
+		var idleConnection *idleConn
+		var idleTimer *time.Timer
+		var idleTimerChan <-chan time.Time
+		if idlePolicy.Timeout > 0 {
+			idleTimeout = time.Duration(idlePolicy.Timeout) * time.Second
+			idleConnection = newIdleConn(netConn)
+			netConn = idleConnection
+			idleTimer = time.NewTimer(idleTimeout)
+			idleTimerChan = idleTimer.C
+		}
+		readChunkSize, writeChunkSize := t.connectionChunkSizes(addr, inbound)
+		withinMessageTimeout := t.withinMessageTimeoutFor(addr)
 		readerReturnChan := make(chan struct{}, 1)
 		readerControlChan := make(chan struct{})
-		go func() {
-			t.readMsgs(readerControlChan, newTimeoutReader(netConn, t.chunkSize, t.withinMessageTimeout))
+		resetChan := make(chan struct{}, 1)
+		if multiplex {
+			atomic.AddInt32(&t.multiplexedConnections, 1)
+		}
+		go func(netConn net.Conn, multiplex bool) {
+			reader := newTimeoutReader(netConn, readChunkSize, withinMessageTimeout)
+			if multiplex {
+				t.readMuxMsgs(addr, readerControlChan, reader, resetChan)
+			} else {
+				t.readMsgs(addr, readerControlChan, reader, resetChan)
+			}
 			readerReturnChan <- struct{}{}
-		}()
+		}(netConn, multiplex)
 		writerReturnChan := make(chan struct{}, 1)
-		go func() {
-			t.writeMsgs(newTimeoutWriter(netConn, t.chunkSize, t.withinMessageTimeout), msgChan)
+		// With an idle timeout the writer gets its own stop channel, so an
+		// idle close can stop it before it takes another message.
+		writerStopChan := stopChan
+		var idleStopChan chan struct{}
+		if idleTimer != nil {
+			writerStopChan = make(chan struct{})
+			idleStopChan = make(chan struct{})
+			go func(writerStopChan chan struct{}, idleStopChan chan struct{}) {
+				select {
+				case <-stopChan:
+				case <-idleStopChan:
+				}
+				close(writerStopChan)
+			}(writerStopChan, idleStopChan)
+		}
+		go func(netConn net.Conn, multiplex bool) {
+			writer := newTimeoutWriter(netConn, writeChunkSize, withinMessageTimeout)
+			if multiplex {
+				t.writeMuxMsgs(addr, writer, writeChunkSize, msgChan, writerStopChan)
+			} else {
+				t.writeMsgs(addr, writer, msgChan, writerStopChan)
+			}
 			writerReturnChan <- struct{}{}
-		}()
-		select {
-		case <-t.controlChan:
-		case <-readerReturnChan:
-		case <-writerReturnChan:
+		}(netConn, multiplex)
+		idled := false
+	WaitLoop:
+		for {
+			select {
+			case <-t.controlChan:
+			case <-stopChan:
+				// Let the writer finish any message in progress.
+				<-writerReturnChan
+			case <-readerReturnChan:
+			case <-writerReturnChan:
+			case <-resetChan:
+			case <-idleTimerChan:
+				if idle := idleConnection.idle(); idle < idleTimeout {
+					idleTimer.Reset(idleTimeout - idle)
+					continue WaitLoop
+				}
+				idled = true
+			}
+			break
+		}
+		if idleTimer != nil {
+			idleTimer.Stop()
+			close(idleStopChan)
+			if idled {
+				<-writerReturnChan
+			}
 		}
 		close(readerControlChan)
 		netConn.Close()
 		netConn = nil
+		multiplex = false
+		t.setConnected(addr, -1)
+		if idled {
+			atomic.AddInt32(&t.idleCloses, 1)
+			t.logDebug("connection: %s closed after %s idle\n", addr, idleTimeout)
+			if idlePolicy.Notify != nil {
+				idlePolicy.Notify(addr, inbound)
+			}
+			if !dialOk {
+				break
+			}
+			// Rather than redialing right away, wait until there is
+			// something to send.
+			select {
+			case <-t.controlChan:
+				break OuterLoop
+			case <-stopChan:
+				break OuterLoop
+			case msg := <-msgChan:
+				go t.requeue(msgChan, stopChan, msg)
+			}
+		}
+	}
+}
+
+// requeue puts the message back on the msgChan, freeing it instead if the
+// connection is stopped first.
+func (t *TCPMsgRing) requeue(msgChan chan Msg, stopChan chan struct{}, msg Msg) {
+	select {
+	case msgChan <- msg:
+	case <-t.controlChan:
+		msg.Free()
+	case <-stopChan:
+		msg.Free()
 	}
 }
 
-func (t *TCPMsgRing) readMsgs(readerControlChan chan struct{}, reader *timeoutReader) {
+func (t *TCPMsgRing) readMsgs(addr string, readerControlChan chan struct{}, reader *timeoutReader, resetChan chan struct{}) {
 OuterLoop:
 	for {
 		select {
@@ -702,7 +1983,7 @@ OuterLoop:
 			break OuterLoop
 		default:
 		}
-		if err := t.readMsg(reader); err != nil {
+		if err := t.readMsg(addr, reader, resetChan); err != nil {
 			atomic.AddInt32(&t.msgReadErrors, 1)
 			t.logDebug("readMsg: %s\n", err)
 			break
@@ -711,7 +1992,7 @@ OuterLoop:
 	}
 }
 
-func (t *TCPMsgRing) readMsg(reader *timeoutReader) error {
+func (t *TCPMsgRing) readMsg(addr string, reader *timeoutReader, resetChan chan struct{}) error {
 	var msgType uint64
 	timeout := reader.Timeout
 	// Wait forever for the first byte or for closed/eof error.
@@ -721,6 +2002,7 @@ func (t *TCPMsgRing) readMsg(reader *timeoutReader) error {
 	if err != nil {
 		return err
 	}
+	start := time.Now()
 	msgType = uint64(b)
 	for i := 1; i < 8; i++ {
 		b, err = reader.ReadByte()
@@ -746,26 +2028,45 @@ func (t *TCPMsgRing) readMsg(reader *timeoutReader) error {
 		length <<= 8
 		length |= uint64(b)
 	}
-	// CONSIDER: The reader has a timeout that would trigger on actual reads
-	// the handler does, but if the handler goes off in an infinite loop and
-	// does not attempt any reads, the timeout would have no effect. However,
-	// using time.After or something similar for every message is probably
-	// overly expensive, so bad handler code may be an acceptable risk here.
+	if length > t.maxMsgLength {
+		return fmt.Errorf("message %x of %d bytes exceeds the max of %d", msgType, length, t.maxMsgLength)
+	}
+	// The reader has a timeout that would trigger on actual reads the
+	// handler does, but if the handler goes off in an infinite loop and does
+	// not attempt any reads, the timeout would have no effect; the
+	// HandlerTimeouts cover that, for just the message types configured, as a
+	// timer for every message is probably overly expensive.
+	timer := t.watchHandler(addr, msgType, reader.conn, resetChan)
 	consumed, err := handler(reader, length)
+	if timer != nil {
+		timer.Stop()
+	}
 	if consumed != length {
 		if err == nil {
 			err = fmt.Errorf("handler %x did not read %d bytes; only read %d", msgType, length, consumed)
 		}
 	}
+	if t.frameReceived != nil {
+		t.frameReceived(addr, msgType, length, time.Since(start), err)
+	}
+	if t.msgTraces != nil {
+		t.msgTraces.add(addr, false, msgType, length, time.Since(start), err)
+	}
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (t *TCPMsgRing) writeMsgs(writer *timeoutWriter, msgChan chan Msg) {
-	for msg := range msgChan {
-		if err := t.writeMsg(writer, msg); err != nil {
+func (t *TCPMsgRing) writeMsgs(addr string, writer *timeoutWriter, msgChan chan Msg, stopChan chan struct{}) {
+	for {
+		var msg Msg
+		select {
+		case <-stopChan:
+			return
+		case msg = <-msgChan:
+		}
+		if err := t.writeMsg(addr, writer, msg); err != nil {
 			atomic.AddInt32(&t.msgWriteErrors, 1)
 			t.logDebug("writeMsg: %s\n", err)
 			msg.Free()
@@ -776,7 +2077,22 @@ func (t *TCPMsgRing) writeMsgs(writer *timeoutWriter, msgChan chan Msg) {
 	}
 }
 
-func (t *TCPMsgRing) writeMsg(writer *timeoutWriter, msg Msg) error {
+func (t *TCPMsgRing) writeMsg(addr string, writer *timeoutWriter, msg Msg) error {
+	if t.frameSent == nil && t.msgTraces == nil {
+		return t.writeFrame(writer, msg)
+	}
+	start := time.Now()
+	err := t.writeFrame(writer, msg)
+	if t.frameSent != nil {
+		t.frameSent(addr, msg.MsgType(), msg.MsgLength(), time.Since(start), err)
+	}
+	if t.msgTraces != nil {
+		t.msgTraces.add(addr, true, msg.MsgType(), msg.MsgLength(), time.Since(start), err)
+	}
+	return err
+}
+
+func (t *TCPMsgRing) writeFrame(writer *timeoutWriter, msg Msg) error {
 	b := make([]byte, 8)
 	binary.BigEndian.PutUint64(b, msg.MsgType())
 	if _, err := writer.Write(b); err != nil {
@@ -825,28 +2141,51 @@ func (m *multiMsg) freer(count int) {
 }
 
 type TCPMsgRingStats struct {
-	Shutdown                  bool
-	RingChanges               int32
-	RingChangeCloses          int32
-	MsgToNodes                int32
-	MsgToNodeNoRings          int32
-	MsgToNodeNoNodes          int32
-	MsgToOtherReplicas        int32
-	MsgToOtherReplicasNoRings int32
-	ListenErrors              int32
-	IncomingConnections       int32
-	Dials                     int32
-	DialErrors                int32
-	OutgoingConnections       int32
-	MsgChanCreations          int32
-	MsgToAddrs                int32
-	MsgToAddrQueues           int32
-	MsgToAddrTimeoutDrops     int32
-	MsgToAddrShutdownDrops    int32
-	MsgReads                  int32
-	MsgReadErrors             int32
-	MsgWrites                 int32
-	MsgWriteErrors            int32
+	Shutdown bool
+	// ListenAddr is the address Listen is accepting connections on, if any;
+	// see TCPMsgRing.ListenAddr.
+	ListenAddr                 string
+	RingChanges                int32
+	RingChangeCloses           int32
+	RingChangeDrainDrops       int32
+	MsgToNodes                 int32
+	MsgToNodeNoRings           int32
+	MsgToNodeNoNodes           int32
+	MsgToOtherReplicas         int32
+	MsgToOtherReplicasNoRings  int32
+	MsgToFormerReplicas        int32
+	MsgToFormerReplicasNoRings int32
+	ListenErrors               int32
+	IncomingConnections        int32
+	Dials                      int32
+	DialErrors                 int32
+	DialGiveUps                int32
+	DialGiveUpDrops            int32
+	OutgoingConnections        int32
+	IdleCloses                 int32
+	MultiplexedConnections     int32
+	CompressedConnections      int32
+	FeatureChanges             int32
+	MsgChanCreations           int32
+	MsgToAddrs                 int32
+	MsgToAddrQueues            int32
+	MsgToAddrTimeoutDrops      int32
+	MsgToAddrShutdownDrops     int32
+	MsgToAddrCircuitDrops      int32
+	MsgToAddrInFlightDrops     int32
+	MsgToAddrLengthDrops       int32
+	MsgToAddrSplits            int32
+	MsgMirrors                 int32
+	CircuitBreakerOpens        int32
+	ClockSkews                 int32
+	MsgReads                   int32
+	MsgReadErrors              int32
+	MsgDedupDrops              int32
+	MsgAborts                  int32
+	MsgHandlerTimeouts         int32
+	MsgStreamResets            int32
+	MsgWrites                  int32
+	MsgWriteErrors             int32
 }
 
 // Stats returns the current stat counters and resets those counters. In other
@@ -864,59 +2203,161 @@ func (t *TCPMsgRing) Stats(debug bool) *TCPMsgRingStats {
 	default:
 	}
 	t.statsLock.Lock()
+	s := t.takeStats()
+	if t.unreported != nil {
+		addStatCounters(s, t.unreported)
+		t.unreported = nil
+	}
+	t.statsLock.Unlock()
+	s.Shutdown = shutdown
+	s.ListenAddr = t.ListenAddr()
+	return s
+}
+
+// Totals returns the stat counters accumulated since the TCPMsgRing was
+// created, keyed by their TCPMsgRingStats field names, without resetting
+// anything; unlike Stats, it may be read by any number of callers, such as a
+// metrics exporter alongside a stats logger.
+func (t *TCPMsgRing) Totals() map[string]int64 {
+	t.statsLock.Lock()
+	s := t.takeStats()
+	if t.unreported == nil {
+		t.unreported = s
+	} else {
+		addStatCounters(t.unreported, s)
+	}
+	totals := make(map[string]int64, len(t.totals))
+	for name, value := range t.totals {
+		totals[name] = value
+	}
+	t.statsLock.Unlock()
+	return totals
+}
+
+// takeStats returns the stat counters, resetting them, and adds them to the
+// totals; statsLock must be held.
+func (t *TCPMsgRing) takeStats() *TCPMsgRingStats {
 	s := &TCPMsgRingStats{
-		Shutdown:                  shutdown,
-		RingChanges:               atomic.LoadInt32(&t.ringChanges),
-		RingChangeCloses:          atomic.LoadInt32(&t.ringChangeCloses),
-		MsgToNodes:                atomic.LoadInt32(&t.msgToNodes),
-		MsgToNodeNoRings:          atomic.LoadInt32(&t.msgToNodeNoRings),
-		MsgToNodeNoNodes:          atomic.LoadInt32(&t.msgToNodeNoNodes),
-		MsgToOtherReplicas:        atomic.LoadInt32(&t.msgToOtherReplicas),
-		MsgToOtherReplicasNoRings: atomic.LoadInt32(&t.msgToOtherReplicasNoRings),
-		ListenErrors:              atomic.LoadInt32(&t.listenErrors),
-		IncomingConnections:       atomic.LoadInt32(&t.incomingConnections),
-		Dials:                     atomic.LoadInt32(&t.dials),
-		DialErrors:                atomic.LoadInt32(&t.dialErrors),
-		OutgoingConnections:       atomic.LoadInt32(&t.outgoingConnections),
-		MsgChanCreations:          atomic.LoadInt32(&t.msgChanCreations),
-		MsgToAddrs:                atomic.LoadInt32(&t.msgToAddrs),
-		MsgToAddrQueues:           atomic.LoadInt32(&t.msgToAddrQueues),
-		MsgToAddrTimeoutDrops:     atomic.LoadInt32(&t.msgToAddrTimeoutDrops),
-		MsgToAddrShutdownDrops:    atomic.LoadInt32(&t.msgToAddrShutdownDrops),
-		MsgReads:                  atomic.LoadInt32(&t.msgReads),
-		MsgReadErrors:             atomic.LoadInt32(&t.msgReadErrors),
-		MsgWrites:                 atomic.LoadInt32(&t.msgWrites),
-		MsgWriteErrors:            atomic.LoadInt32(&t.msgWriteErrors),
+		RingChanges:                atomic.LoadInt32(&t.ringChanges),
+		RingChangeCloses:           atomic.LoadInt32(&t.ringChangeCloses),
+		RingChangeDrainDrops:       atomic.LoadInt32(&t.ringChangeDrainDrops),
+		MsgToNodes:                 atomic.LoadInt32(&t.msgToNodes),
+		MsgToNodeNoRings:           atomic.LoadInt32(&t.msgToNodeNoRings),
+		MsgToNodeNoNodes:           atomic.LoadInt32(&t.msgToNodeNoNodes),
+		MsgToOtherReplicas:         atomic.LoadInt32(&t.msgToOtherReplicas),
+		MsgToOtherReplicasNoRings:  atomic.LoadInt32(&t.msgToOtherReplicasNoRings),
+		MsgToFormerReplicas:        atomic.LoadInt32(&t.msgToFormerReplicas),
+		MsgToFormerReplicasNoRings: atomic.LoadInt32(&t.msgToFormerReplicasNoRings),
+		ListenErrors:               atomic.LoadInt32(&t.listenErrors),
+		IncomingConnections:        atomic.LoadInt32(&t.incomingConnections),
+		Dials:                      atomic.LoadInt32(&t.dials),
+		DialErrors:                 atomic.LoadInt32(&t.dialErrors),
+		DialGiveUps:                atomic.LoadInt32(&t.dialGiveUps),
+		DialGiveUpDrops:            atomic.LoadInt32(&t.dialGiveUpDrops),
+		OutgoingConnections:        atomic.LoadInt32(&t.outgoingConnections),
+		IdleCloses:                 atomic.LoadInt32(&t.idleCloses),
+		MultiplexedConnections:     atomic.LoadInt32(&t.multiplexedConnections),
+		CompressedConnections:      atomic.LoadInt32(&t.compressedConnections),
+		FeatureChanges:             atomic.LoadInt32(&t.featureChanges),
+		MsgChanCreations:           atomic.LoadInt32(&t.msgChanCreations),
+		MsgToAddrs:                 atomic.LoadInt32(&t.msgToAddrs),
+		MsgToAddrQueues:            atomic.LoadInt32(&t.msgToAddrQueues),
+		MsgToAddrTimeoutDrops:      atomic.LoadInt32(&t.msgToAddrTimeoutDrops),
+		MsgToAddrShutdownDrops:     atomic.LoadInt32(&t.msgToAddrShutdownDrops),
+		MsgToAddrCircuitDrops:      atomic.LoadInt32(&t.msgToAddrCircuitDrops),
+		MsgToAddrInFlightDrops:     atomic.LoadInt32(&t.msgToAddrInFlightDrops),
+		MsgToAddrLengthDrops:       atomic.LoadInt32(&t.msgToAddrLengthDrops),
+		MsgToAddrSplits:            atomic.LoadInt32(&t.msgToAddrSplits),
+		MsgMirrors:                 atomic.LoadInt32(&t.msgMirrors),
+		CircuitBreakerOpens:        atomic.LoadInt32(&t.circuitBreakerOpens),
+		ClockSkews:                 atomic.LoadInt32(&t.clockSkews),
+		MsgReads:                   atomic.LoadInt32(&t.msgReads),
+		MsgReadErrors:              atomic.LoadInt32(&t.msgReadErrors),
+		MsgDedupDrops:              atomic.LoadInt32(&t.msgDedupDrops),
+		MsgAborts:                  atomic.LoadInt32(&t.msgAborts),
+		MsgHandlerTimeouts:         atomic.LoadInt32(&t.msgHandlerTimeouts),
+		MsgStreamResets:            atomic.LoadInt32(&t.msgStreamResets),
+		MsgWrites:                  atomic.LoadInt32(&t.msgWrites),
+		MsgWriteErrors:             atomic.LoadInt32(&t.msgWriteErrors),
 	}
 	atomic.AddInt32(&t.ringChanges, -s.RingChanges)
 	atomic.AddInt32(&t.ringChangeCloses, -s.RingChangeCloses)
+	atomic.AddInt32(&t.ringChangeDrainDrops, -s.RingChangeDrainDrops)
 	atomic.AddInt32(&t.msgToNodes, -s.MsgToNodes)
 	atomic.AddInt32(&t.msgToNodeNoRings, -s.MsgToNodeNoRings)
 	atomic.AddInt32(&t.msgToNodeNoNodes, -s.MsgToNodeNoNodes)
 	atomic.AddInt32(&t.msgToOtherReplicas, -s.MsgToOtherReplicas)
 	atomic.AddInt32(&t.msgToOtherReplicasNoRings, -s.MsgToOtherReplicasNoRings)
+	atomic.AddInt32(&t.msgToFormerReplicas, -s.MsgToFormerReplicas)
+	atomic.AddInt32(&t.msgToFormerReplicasNoRings, -s.MsgToFormerReplicasNoRings)
 	atomic.AddInt32(&t.listenErrors, -s.ListenErrors)
 	atomic.AddInt32(&t.incomingConnections, -s.IncomingConnections)
 	atomic.AddInt32(&t.dials, -s.Dials)
 	atomic.AddInt32(&t.dialErrors, -s.DialErrors)
+	atomic.AddInt32(&t.dialGiveUps, -s.DialGiveUps)
+	atomic.AddInt32(&t.dialGiveUpDrops, -s.DialGiveUpDrops)
 	atomic.AddInt32(&t.outgoingConnections, -s.OutgoingConnections)
+	atomic.AddInt32(&t.idleCloses, -s.IdleCloses)
+	atomic.AddInt32(&t.multiplexedConnections, -s.MultiplexedConnections)
+	atomic.AddInt32(&t.compressedConnections, -s.CompressedConnections)
+	atomic.AddInt32(&t.featureChanges, -s.FeatureChanges)
 	atomic.AddInt32(&t.msgChanCreations, -s.MsgChanCreations)
 	atomic.AddInt32(&t.msgToAddrs, -s.MsgToAddrs)
 	atomic.AddInt32(&t.msgToAddrQueues, -s.MsgToAddrQueues)
 	atomic.AddInt32(&t.msgToAddrTimeoutDrops, -s.MsgToAddrTimeoutDrops)
 	atomic.AddInt32(&t.msgToAddrShutdownDrops, -s.MsgToAddrShutdownDrops)
+	atomic.AddInt32(&t.msgToAddrCircuitDrops, -s.MsgToAddrCircuitDrops)
+	atomic.AddInt32(&t.msgToAddrInFlightDrops, -s.MsgToAddrInFlightDrops)
+	atomic.AddInt32(&t.msgToAddrLengthDrops, -s.MsgToAddrLengthDrops)
+	atomic.AddInt32(&t.msgToAddrSplits, -s.MsgToAddrSplits)
+	atomic.AddInt32(&t.msgMirrors, -s.MsgMirrors)
+	atomic.AddInt32(&t.circuitBreakerOpens, -s.CircuitBreakerOpens)
+	atomic.AddInt32(&t.clockSkews, -s.ClockSkews)
 	atomic.AddInt32(&t.msgReads, -s.MsgReads)
 	atomic.AddInt32(&t.msgReadErrors, -s.MsgReadErrors)
+	atomic.AddInt32(&t.msgDedupDrops, -s.MsgDedupDrops)
+	atomic.AddInt32(&t.msgAborts, -s.MsgAborts)
+	atomic.AddInt32(&t.msgHandlerTimeouts, -s.MsgHandlerTimeouts)
+	atomic.AddInt32(&t.msgStreamResets, -s.MsgStreamResets)
 	atomic.AddInt32(&t.msgWrites, -s.MsgWrites)
 	atomic.AddInt32(&t.msgWriteErrors, -s.MsgWriteErrors)
-	t.statsLock.Unlock()
+	if t.totals == nil {
+		t.totals = make(map[string]int64)
+	}
+	v := reflect.ValueOf(s).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).Kind() == reflect.Int32 {
+			t.totals[v.Type().Field(i).Name] += v.Field(i).Int()
+		}
+	}
 	return s
 }
 
+// addStatCounters adds the counters of src to those of dst.
+func addStatCounters(dst *TCPMsgRingStats, src *TCPMsgRingStats) {
+	d := reflect.ValueOf(dst).Elem()
+	s := reflect.ValueOf(src).Elem()
+	for i := 0; i < d.NumField(); i++ {
+		if d.Field(i).Kind() == reflect.Int32 {
+			d.Field(i).SetInt(d.Field(i).Int() + s.Field(i).Int())
+		}
+	}
+}
+
 func (s *TCPMsgRingStats) String() string {
 	return fmt.Sprintf("%#v", s)
 }
 
+// CircuitBreakerState returns the current state of the circuit breaker for
+// the address; it will always be CircuitClosed if circuit breakers are not
+// enabled.
+func (t *TCPMsgRing) CircuitBreakerState(addr string) CircuitBreakerState {
+	if t.circuitBreakers == nil {
+		return CircuitClosed
+	}
+	return t.circuitBreakers.state(addr)
+}
+
 // SetChaosAddrOff will disable all outgoing connections to addr and
 // immediately close any incoming connections from addr.
 func (t *TCPMsgRing) SetChaosAddrOff(addr string, off bool) {
@@ -2,9 +2,23 @@ package ring
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
 	"errors"
 	"io"
+	"io/ioutil"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -70,6 +84,10 @@ func (m *TestMsg) Done() {
 	m.done <- struct{}{}
 }
 
+func (m *TestMsg) Free() {
+	m.done <- struct{}{}
+}
+
 // Following mock stuff borrowed from golang.org/src/net/http/serve_test.go
 type dummyAddr string
 
@@ -168,6 +186,369 @@ func Test_TCPMsgRingSetRing(t *testing.T) {
 	}
 }
 
+func TestTCPMsgRingAddressRole(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetAddressRoles([]string{"client", "replication"})
+	nA, err := b.AddNode(true, 1, nil, []string{"127.0.0.1:9999", "127.0.0.1:9998"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := b.Ring()
+	r.SetLocalNode(nA.ID())
+	msgring, _ := NewTCPMsgRing(&TCPMsgRingConfig{AddressRole: "replication"})
+	msgring.SetRing(r)
+	if _, i := msgring.ringAndAddressIndex(); i != 1 {
+		t.Fatalf("%d != 1", i)
+	}
+	msgring, _ = NewTCPMsgRing(&TCPMsgRingConfig{AddressRole: "admin", AddressIndex: 0})
+	msgring.SetRing(r)
+	if _, i := msgring.ringAndAddressIndex(); i != 0 {
+		t.Fatalf("%d != 0", i)
+	}
+}
+
+func TestTCPMsgRingChunkSizes(t *testing.T) {
+	msgring, _ := NewTCPMsgRing(&TCPMsgRingConfig{ChunkSize: 1000, WriteChunkSize: 2000})
+	if r, w := msgring.connectionChunkSizes("127.0.0.1:9999", true); r != 1000 || w != 2000 {
+		t.Fatalf("%d %d", r, w)
+	}
+	msgring, _ = NewTCPMsgRing(&TCPMsgRingConfig{
+		ChunkSizes: func(addr string, inbound bool) (int, int) {
+			if inbound {
+				return 512, 0
+			}
+			return 0, 1 << 20
+		},
+	})
+	if r, w := msgring.connectionChunkSizes("127.0.0.1:9999", true); r != 512 || w != 16384 {
+		t.Fatalf("%d %d", r, w)
+	}
+	if r, w := msgring.connectionChunkSizes("127.0.0.1:9999", false); r != 16384 || w != 1<<20 {
+		t.Fatalf("%d %d", r, w)
+	}
+}
+
+func TestTCPMsgRingDrain(t *testing.T) {
+	drained := make(chan int, 2)
+	msgring, _ := NewTCPMsgRing(&TCPMsgRingConfig{
+		DrainTimeout:      1,
+		ConnectionDrained: func(addr string, dropped int) { drained <- dropped },
+	})
+	defer msgring.Shutdown()
+	r, _, _, err := newTestRing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgring.SetRing(r)
+	// One queue is left to time out and one is emptied, as a writer would.
+	stuckChan, _ := msgring.msgChanForAddr("127.0.0.2:1")
+	movingChan, _ := msgring.msgChanForAddr("127.0.0.3:1")
+	stuck := []*TestMsg{newTestMsg(), newTestMsg()}
+	for _, m := range stuck {
+		stuckChan <- m
+	}
+	movingChan <- newTestMsg()
+	msgring.SetRing(r)
+	if msgring.lookupMsgChanForAddr("127.0.0.2:1") != nil {
+		t.Fatal("removed address should not accept new messages")
+	}
+	(<-movingChan).Free()
+	counts := []int{<-drained, <-drained}
+	if counts[0]+counts[1] != 2 || (counts[0] != 0 && counts[1] != 0) {
+		t.Fatalf("%v", counts)
+	}
+	for _, m := range stuck {
+		select {
+		case <-m.done:
+		default:
+			t.Fatal("dropped message was not freed")
+		}
+	}
+	if s := msgring.Stats(false); s.RingChangeCloses != 2 || s.RingChangeDrainDrops != 2 {
+		t.Fatalf("%d %d", s.RingChangeCloses, s.RingChangeDrainDrops)
+	}
+}
+
+func TestTCPMsgRingMsgToFormerReplicas(t *testing.T) {
+	msgring, _ := NewTCPMsgRing(nil)
+	defer msgring.Shutdown()
+	b := NewBuilder(64)
+	b.SetReplicaCount(2)
+	// Ring versions come from the Builder's clock; this one advances with
+	// each call, so r2's version is later than r1's however coarse the
+	// system clock is, with no need to retry until they differ.
+	now := time.Now()
+	b.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	nA, err := b.AddNode(true, 1, nil, []string{"127.0.0.2:1"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nB, err := b.AddNode(true, 1, nil, []string{"127.0.0.3:1"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r1 := b.Ring()
+	r1.SetLocalNode(nA.ID())
+	msgring.SetRing(r1)
+	b.RemoveNode(nB.ID())
+	if _, err = b.AddNode(true, 1, nil, []string{"127.0.0.4:1"}, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	r2 := b.Ring()
+	if r2.Version() <= r1.Version() {
+		t.Fatal(r1.Version(), r2.Version())
+	}
+	r2.SetLocalNode(nA.ID())
+	msgring.SetRing(r2)
+	// Created ahead of time so no connections are attempted.
+	formerChan, _ := msgring.msgChanForAddr("127.0.0.3:1")
+	currentChan, _ := msgring.msgChanForAddr("127.0.0.4:1")
+	m := newTestMsg()
+	msgring.MsgToFormerReplicas(m, r1.Version(), 0, time.Second)
+	(<-formerChan).Free()
+	<-m.done
+	if len(currentChan) != 0 {
+		t.Fatal("message should only go to the former replicas")
+	}
+	m = newTestMsg()
+	msgring.MsgToFormerReplicas(m, r2.Version(), 0, time.Second)
+	<-m.done
+	if s := msgring.Stats(false); s.MsgToFormerReplicas != 2 || s.MsgToFormerReplicasNoRings != 1 {
+		t.Fatalf("%d %d", s.MsgToFormerReplicas, s.MsgToFormerReplicasNoRings)
+	}
+}
+
+func TestTCPMsgRingMaxInFlightPerAddress(t *testing.T) {
+	msgring, _ := NewTCPMsgRing(&TCPMsgRingConfig{BufferedMessagesPerAddress: 1, MaxInFlightPerAddress: 2})
+	defer msgring.Shutdown()
+	addr := "127.0.0.2:1"
+	msgChan, _ := msgring.msgChanForAddr(addr)
+	msgChan <- newTestMsg()
+	for i := 0; i < 2; i++ {
+		go msgring.msgToAddr(newTestMsg(), addr, time.Second)
+	}
+	for atomic.LoadInt32(msgring.inFlightForAddr(addr)) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	m := newTestMsg()
+	start := time.Now()
+	msgring.msgToAddr(m, addr, time.Second)
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatal("message beyond the limit should be dropped immediately")
+	}
+	select {
+	case <-m.done:
+	default:
+		t.Fatal("dropped message was not freed")
+	}
+	if s := msgring.Stats(false); s.MsgToAddrInFlightDrops != 1 {
+		t.Fatalf("%d != 1", s.MsgToAddrInFlightDrops)
+	}
+}
+
+func TestTCPMsgRingMsgToNodeErr(t *testing.T) {
+	msgring, _ := NewTCPMsgRing(&TCPMsgRingConfig{BufferedMessagesPerAddress: 1})
+	defer msgring.Shutdown()
+	m := newTestMsg()
+	if err := msgring.MsgToNodeErr(context.Background(), m, 1); err != ErrNoRing {
+		t.Fatal(err)
+	}
+	<-m.done
+	b := NewBuilder(64)
+	n, err := b.AddNode(true, 1, nil, []string{"127.0.0.2:1"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgring.SetRing(b.Ring())
+	m = newTestMsg()
+	if err = msgring.MsgToNodeErr(context.Background(), m, n.ID()+1); err != ErrUnknownNode {
+		t.Fatal(err)
+	}
+	<-m.done
+	// With no connection draining the queue, the first message fills it.
+	msgring.msgChanForAddr("127.0.0.2:1")
+	if err = msgring.MsgToNodeErr(context.Background(), newTestMsg(), n.ID()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	m = newTestMsg()
+	if err = msgring.MsgToNodeErr(ctx, m, n.ID()); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	<-m.done
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err = msgring.MsgToNodeErr(ctx, newTestMsg(), n.ID()); err != context.Canceled {
+		t.Fatal(err)
+	}
+	if s := msgring.Stats(false); s.MsgToNodes != 5 || s.MsgToNodeNoRings != 1 || s.MsgToNodeNoNodes != 1 || s.MsgToAddrQueues != 1 || s.MsgToAddrTimeoutDrops != 2 {
+		t.Fatalf("%#v", s)
+	}
+}
+
+func TestTCPMsgRingMsgToOtherReplicasErr(t *testing.T) {
+	msgring, _ := NewTCPMsgRing(&TCPMsgRingConfig{BufferedMessagesPerAddress: 1})
+	defer msgring.Shutdown()
+	m := newTestMsg()
+	if err := msgring.MsgToOtherReplicasErr(context.Background(), m, 0); err != ErrNoRing {
+		t.Fatal(err)
+	}
+	<-m.done
+	b := NewBuilder(64)
+	b.SetReplicaCount(2)
+	nA, err := b.AddNode(true, 1, nil, []string{"127.0.0.2:1"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.AddNode(true, 1, nil, []string{"127.0.0.3:1"}, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	r := b.Ring()
+	r.SetLocalNode(nA.ID())
+	msgring.SetRing(r)
+	// With no connection draining the queue, the first message fills it.
+	msgChan, _ := msgring.msgChanForAddr("127.0.0.3:1")
+	if err = msgring.MsgToOtherReplicasErr(context.Background(), newTestMsg(), 0); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	m = newTestMsg()
+	if err = msgring.MsgToOtherReplicasErr(ctx, m, 0); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	<-m.done
+	(<-msgChan).Free()
+}
+
+func TestTCPMsgRingMsgToOtherReplicasErrTierAffinity(t *testing.T) {
+	msgring, _ := NewTCPMsgRing(&TCPMsgRingConfig{BufferedMessagesPerAddress: 1, TierAffinity: true})
+	defer msgring.Shutdown()
+	b := NewBuilder(64)
+	b.SetReplicaCount(3)
+	nA, err := b.AddNode(true, 1, []string{"a", "r1"}, []string{"127.0.0.2:1"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.AddNode(true, 1, []string{"b", "r1"}, []string{"127.0.0.3:1"}, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.AddNode(true, 1, []string{"c", "r2"}, []string{"127.0.0.4:1"}, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	r := b.Ring()
+	r.SetLocalNode(nA.ID())
+	msgring.SetRing(r)
+	// Both queues are full; the near one stays that way, using up the whole
+	// timeout, and the far one frees up after it, which is still within the
+	// far replica's own timeout.
+	nearChan, _ := msgring.msgChanForAddr("127.0.0.3:1")
+	farChan, _ := msgring.msgChanForAddr("127.0.0.4:1")
+	nearChan <- newTestMsg()
+	farChan <- newTestMsg()
+	timeout := 200 * time.Millisecond
+	go func() {
+		time.Sleep(timeout + timeout/2)
+		(<-farChan).Free()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err = msgring.MsgToOtherReplicasErr(ctx, newTestMsg(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if s := msgring.Stats(false); s.MsgToAddrQueues != 1 || s.MsgToAddrTimeoutDrops != 1 {
+		t.Fatalf("%#v", s)
+	}
+	(<-nearChan).Free()
+	(<-farChan).Free()
+	// Canceling the ctx still stops the farther replicas.
+	nearChan <- newTestMsg()
+	farChan <- newTestMsg()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	time.AfterFunc(timeout, cancel)
+	start := time.Now()
+	if err = msgring.MsgToOtherReplicasErr(ctx, newTestMsg(), 0); err != context.Canceled {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatal(elapsed)
+	}
+	(<-nearChan).Free()
+	(<-farChan).Free()
+}
+
+func TestTCPMsgRingSetDedupMsgHandler(t *testing.T) {
+	msgring, _ := NewTCPMsgRing(nil)
+	var handled []string
+	msgring.SetDedupMsgHandler(1, func(reader io.Reader, length uint64) (uint64, error) {
+		content := make([]byte, length)
+		n, err := io.ReadFull(reader, content)
+		handled = append(handled, string(content[8:]))
+		return uint64(n), err
+	})
+	conn := new(testConn)
+	for _, id := range []uint64{7, 7, 8} {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, 1)
+		conn.readBuf.Write(b)
+		binary.BigEndian.PutUint64(b, 10)
+		conn.readBuf.Write(b)
+		binary.BigEndian.PutUint64(b, id)
+		conn.readBuf.Write(b)
+		conn.readBuf.WriteString("hi")
+	}
+	reader := newTimeoutReader(conn, 16*1024, time.Second)
+	for i := 0; i < 3; i++ {
+		if err := msgring.readMsg("127.0.0.2:1", reader, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(handled) != 2 {
+		t.Fatalf("%v", handled)
+	}
+	if s := msgring.Stats(false); s.MsgDedupDrops != 1 {
+		t.Fatalf("%d != 1", s.MsgDedupDrops)
+	}
+}
+
+func TestTCPMsgRingFrameHooks(t *testing.T) {
+	var sent, received []uint64
+	msgring, _ := NewTCPMsgRing(&TCPMsgRingConfig{
+		FrameSent: func(addr string, msgType uint64, length uint64, duration time.Duration, err error) {
+			if addr != "127.0.0.2:1" || err != nil {
+				t.Errorf("%q %v", addr, err)
+			}
+			sent = append(sent, msgType, length)
+		},
+		FrameReceived: func(addr string, msgType uint64, length uint64, duration time.Duration, err error) {
+			if addr != "127.0.0.2:1" || err != nil {
+				t.Errorf("%q %v", addr, err)
+			}
+			received = append(received, msgType, length)
+		},
+	})
+	msgring.SetMsgHandler(1, test_stringmarshaller)
+	conn := new(testConn)
+	m := newTestMsg()
+	if err := msgring.writeMsg("127.0.0.2:1", newTimeoutWriter(conn, 16*1024, time.Second), m); err != nil {
+		t.Fatal(err)
+	}
+	conn.readBuf.Write(conn.writeBuf.Bytes())
+	if err := msgring.readMsg("127.0.0.2:1", newTimeoutReader(conn, 16*1024, time.Second), nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 2 || sent[0] != 1 || sent[1] != 7 {
+		t.Fatalf("%v", sent)
+	}
+	if len(received) != 2 || received[0] != 1 || received[1] != 7 {
+		t.Fatalf("%v", received)
+	}
+}
+
 func test_stringmarshaller(reader io.Reader, size uint64) (uint64, error) {
 	buf := make([]byte, size)
 	c, err := reader.Read(buf)
@@ -249,3 +630,292 @@ func Test_MsgToOtherReplicas(t *testing.T) {
 	}
 }
 */
+
+func writeTestCert(t *testing.T, dir string, name string, serial int64, dnsNames []string) TLSCertFiles {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := TLSCertFiles{CertFile: filepath.Join(dir, name+".crt"), KeyFile: filepath.Join(dir, name+".key")}
+	if err = ioutil.WriteFile(files.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(files.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestTCPMsgRingSNICerts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ringtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	def := writeTestCert(t, dir, "default", 1, []string{"default.example.com"})
+	sni := writeTestCert(t, dir, "other", 2, []string{"other.example.com"})
+	msgRing, err := NewTCPMsgRing(&TCPMsgRingConfig{UseTLS: true, CertFile: def.CertFile, KeyFile: def.KeyFile, SNICerts: []TLSCertFiles{sni}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer msgRing.Shutdown()
+	serial := func(serverName string) int64 {
+		cert, err := msgRing.serverTLSConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.SerialNumber.Int64()
+	}
+	if s := serial("other.example.com"); s != 2 {
+		t.Fatalf("%d != 2", s)
+	}
+	if s := serial(""); s != 1 {
+		t.Fatalf("%d != 1", s)
+	}
+	writeTestCert(t, dir, "default", 3, []string{"default.example.com"})
+	if s := serial(""); s != 1 {
+		t.Fatalf("%d != 1", s)
+	}
+	if err = msgRing.ReloadCertificates(); err != nil {
+		t.Fatal(err)
+	}
+	if s := serial("unknown.example.com"); s != 3 {
+		t.Fatalf("%d != 3", s)
+	}
+	if err = ioutil.WriteFile(sni.KeyFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = msgRing.ReloadCertificates(); err == nil {
+		t.Fatal("expected error reloading a bad key")
+	}
+	if s := serial("other.example.com"); s != 2 {
+		t.Fatalf("%d != 2", s)
+	}
+}
+
+func TestTCPMsgRingListenShutdown(t *testing.T) {
+	b := NewBuilder(64)
+	n, err := b.AddNode(true, 1, nil, []string{"127.0.0.1:0"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := b.Ring()
+	r.SetLocalNode(n.ID())
+	msgring, _ := NewTCPMsgRing(nil)
+	msgring.SetRing(r)
+	listenReturned := make(chan struct{})
+	go func() {
+		msgring.Listen()
+		close(listenReturned)
+	}()
+	for i := 0; msgring.ListenAddr() == ""; i++ {
+		if i == 100 {
+			t.Fatal("never listened")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := msgring.Stats(false); s.ListenAddr != msgring.ListenAddr() {
+		t.Fatal(s.ListenAddr)
+	}
+	start := time.Now()
+	msgring.Shutdown()
+	select {
+	case <-listenReturned:
+	case <-time.After(time.Second):
+		t.Fatal("Listen did not return")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatal(elapsed)
+	}
+	if addr := msgring.ListenAddr(); addr != "" {
+		t.Fatal(addr)
+	}
+}
+
+func TestTCPMsgRingListenContext(t *testing.T) {
+	b := NewBuilder(64)
+	n, err := b.AddNode(true, 1, nil, []string{"127.0.0.1:0"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := b.Ring()
+	r.SetLocalNode(n.ID())
+	msgring, _ := NewTCPMsgRing(nil)
+	defer msgring.Shutdown()
+	msgring.SetRing(r)
+	ctx, cancel := context.WithCancel(context.Background())
+	listenReturned := make(chan error, 1)
+	go func() {
+		listenReturned <- msgring.ListenContext(ctx)
+	}()
+	for i := 0; msgring.ListenAddr() == ""; i++ {
+		if i == 100 {
+			t.Fatal("never listened")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	addr := msgring.ListenAddr()
+	cancel()
+	select {
+	case err = <-listenReturned:
+		if err != context.Canceled {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ListenContext did not return")
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Fatal("still accepting connections")
+	}
+	select {
+	case <-msgring.controlChan:
+		t.Fatal("ListenContext should not shut down the msg ring")
+	default:
+	}
+}
+
+type testSplitMsg struct {
+	testBytesMsg
+	freed chan struct{}
+}
+
+func (m *testSplitMsg) Split(maxLength uint64) []Msg {
+	var parts []Msg
+	for content := m.content; len(content) > 0; {
+		n := len(content)
+		if uint64(n) > maxLength {
+			n = int(maxLength)
+		}
+		parts = append(parts, &testBytesMsg{msgType: m.msgType, content: content[:n]})
+		content = content[n:]
+	}
+	return parts
+}
+
+func (m *testSplitMsg) Free() {
+	close(m.freed)
+}
+
+func TestTCPMsgRingPeerMaxMsgLength(t *testing.T) {
+	msgring, _ := NewTCPMsgRing(&TCPMsgRingConfig{BufferedMessagesPerAddress: 8})
+	defer msgring.Shutdown()
+	addr := "127.0.0.2:1"
+	msgring.peerCache.record(addr, 1, string(TCP_MSG_RING_VERSION), time.Now())
+	if err := msgring.peerCache.setMaxMsgLength(addr, 10); err != nil {
+		t.Fatal(err)
+	}
+	msgChan, _ := msgring.msgChanForAddr(addr)
+	// A message that can be split is sent in parts; as the parts share its
+	// content, it is only freed once they all are.
+	m := &testSplitMsg{testBytesMsg: testBytesMsg{msgType: 1, content: bytes.Repeat([]byte{1}, 25)}, freed: make(chan struct{})}
+	msgring.msgToAddr(m, addr, time.Second)
+	if len(msgChan) != 3 {
+		t.Fatal(len(msgChan))
+	}
+	for i, length := range []uint64{10, 10, 5} {
+		select {
+		case <-m.freed:
+			t.Fatal("split message freed before its parts", i)
+		default:
+		}
+		part := <-msgChan
+		if part.MsgLength() != length {
+			t.Fatal(i, part.MsgLength())
+		}
+		var buf bytes.Buffer
+		if _, err := part.WriteContent(&buf); err != nil || !bytes.Equal(buf.Bytes(), bytes.Repeat([]byte{1}, int(length))) {
+			t.Fatal(i, err, buf.Bytes())
+		}
+		part.Free()
+	}
+	select {
+	case <-m.freed:
+	default:
+		t.Fatal("split message was not freed")
+	}
+	// Other messages too long are dropped.
+	tm := newTestMsg()
+	msgring.peerCache.setMaxMsgLength(addr, 5)
+	msgring.msgToAddr(tm, addr, time.Second)
+	select {
+	case <-tm.done:
+	default:
+		t.Fatal("dropped message was not freed")
+	}
+	if len(msgChan) != 0 {
+		t.Fatal(len(msgChan))
+	}
+	if s := msgring.Stats(false); s.MsgToAddrSplits != 1 || s.MsgToAddrLengthDrops != 1 {
+		t.Fatalf("%#v", s)
+	}
+}
+
+func TestTCPMsgRingSplitPartlyQueued(t *testing.T) {
+	msgring, _ := NewTCPMsgRing(&TCPMsgRingConfig{BufferedMessagesPerAddress: 2})
+	defer msgring.Shutdown()
+	addr := "127.0.0.2:1"
+	msgring.peerCache.record(addr, 1, string(TCP_MSG_RING_VERSION), time.Now())
+	if err := msgring.peerCache.setMaxMsgLength(addr, 10); err != nil {
+		t.Fatal(err)
+	}
+	msgChan, _ := msgring.msgChanForAddr(addr)
+	// Only two of the three parts fit in the queue; the third is discarded
+	// rather than the whole message reported as not sent.
+	m := &testSplitMsg{testBytesMsg: testBytesMsg{msgType: 1, content: bytes.Repeat([]byte{1}, 25)}, freed: make(chan struct{})}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := msgring.msgToAddrContext(ctx, m, addr)
+	perr, ok := err.(*MsgPartlyQueuedError)
+	if !ok || perr.Queued != 2 || perr.Parts != 3 || perr.Err != context.DeadlineExceeded || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal(err)
+	}
+	if len(msgChan) != 2 {
+		t.Fatal(len(msgChan))
+	}
+	(<-msgChan).Free()
+	select {
+	case <-m.freed:
+		t.Fatal("split message freed before its queued parts")
+	default:
+	}
+	(<-msgChan).Free()
+	select {
+	case <-m.freed:
+	default:
+		t.Fatal("split message was not freed")
+	}
+	// With no part queued, the error is the first part's.
+	msgChan <- newTestMsg()
+	msgChan <- newTestMsg()
+	m = &testSplitMsg{testBytesMsg: testBytesMsg{msgType: 1, content: bytes.Repeat([]byte{1}, 25)}, freed: make(chan struct{})}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err = msgring.msgToAddrContext(ctx, m, addr); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	select {
+	case <-m.freed:
+	default:
+		t.Fatal("unsent split message was not freed")
+	}
+}
@@ -0,0 +1,82 @@
+package ring
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// TieBreaker orders the nodes a Builder's rebalancer would otherwise consider
+// equally good candidates, those with the same desire for more partitions; see
+// Builder.SetTieBreaker. It is given all the Builder's nodes in node index
+// order and should rearrange them in place; among nodes of equal desire, the
+// rebalancer prefers those placed earlier.
+type TieBreaker func(nodes NodeSlice)
+
+// RandomTieBreaker returns a TieBreaker that shuffles the nodes with the
+// source given; with rand.NewSource(seed), each seed gives one reproducible
+// placement outcome, so a simulation can explore several outcomes of the same
+// changes and a test can pin the one it needs.
+func RandomTieBreaker(source rand.Source) TieBreaker {
+	rnd := rand.New(source)
+	return func(nodes NodeSlice) {
+		rnd.Shuffle(len(nodes), func(i, j int) { nodes[i], nodes[j] = nodes[j], nodes[i] })
+	}
+}
+
+// SetTieBreaker sets how the rebalancer breaks ties between nodes of equal
+// desire, each time it rebalances; nil restores the default, which prefers
+// nodes by their order in the Builder. Like SetRebalanceListener, the
+// TieBreaker is not persisted with the Builder.
+func (b *Builder) SetTieBreaker(tieBreaker TieBreaker) {
+	b.tieBreaker = tieBreaker
+}
+
+// tieOrder returns the node indexes in the order the Builder's TieBreaker
+// gives, or nil if there is no TieBreaker or it did not return exactly the
+// Builder's nodes.
+func (rb *rebalancer) tieOrder() []int32 {
+	if rb.builder.tieBreaker == nil {
+		return nil
+	}
+	nodes := make(NodeSlice, len(rb.builder.nodes))
+	nodeToIndex := make(map[*node]int32, len(rb.builder.nodes))
+	for i, n := range rb.builder.nodes {
+		nodes[i] = n
+		nodeToIndex[n] = int32(i)
+	}
+	rb.builder.tieBreaker(nodes)
+	if len(nodes) != len(rb.builder.nodes) {
+		return nil
+	}
+	order := make([]int32, 0, len(nodes))
+	for _, n := range nodes {
+		bn, ok := n.(*node)
+		if !ok {
+			return nil
+		}
+		nodeIndex, ok := nodeToIndex[bn]
+		if !ok {
+			return nil
+		}
+		delete(nodeToIndex, bn)
+		order = append(order, nodeIndex)
+	}
+	return order
+}
+
+// sortByDesire sorts the node indexes by desire, most desirous first; with a
+// tie order, nodes of equal desire are kept in that order.
+func (rb *rebalancer) sortByDesire(nodeIndexes []int32) {
+	sorter := &nodeIndexByDesireSorter{
+		nodeIndexes:       nodeIndexes,
+		nodeIndexToDesire: rb.nodeIndexToDesire,
+	}
+	if rb.nodeIndexToTieRank == nil {
+		sort.Sort(sorter)
+		return
+	}
+	sort.Slice(nodeIndexes, func(i, j int) bool {
+		return rb.nodeIndexToTieRank[nodeIndexes[i]] < rb.nodeIndexToTieRank[nodeIndexes[j]]
+	})
+	sort.Stable(sorter)
+}
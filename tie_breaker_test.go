@@ -0,0 +1,56 @@
+package ring
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func newTieBreakerBuilder(t *testing.T, tieBreaker TieBreaker) *Builder {
+	b := NewBuilder(64)
+	b.nodeIDSource = rand.NewSource(1)
+	b.SetReplicaCount(3)
+	b.SetTieBreaker(tieBreaker)
+	for i := 0; i < 12; i++ {
+		if _, err := b.AddNode(true, 100, []string{fmt.Sprintf("server%d", i), fmt.Sprintf("zone%d", i%4)}, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Ring()
+	return b
+}
+
+func TestTieBreaker(t *testing.T) {
+	base := newTieBreakerBuilder(t, nil).replicaToPartitionToNodeIndex
+	same := newTieBreakerBuilder(t, RandomTieBreaker(rand.NewSource(7))).replicaToPartitionToNodeIndex
+	if !reflect.DeepEqual(same, newTieBreakerBuilder(t, RandomTieBreaker(rand.NewSource(7))).replicaToPartitionToNodeIndex) {
+		t.Fatal("the same seed gave different placements")
+	}
+	if reflect.DeepEqual(same, base) {
+		t.Fatal("the tie breaker did not change the placements")
+	}
+	differ := false
+	for seed := int64(8); seed < 12 && !differ; seed++ {
+		differ = !reflect.DeepEqual(same, newTieBreakerBuilder(t, RandomTieBreaker(rand.NewSource(seed))).replicaToPartitionToNodeIndex)
+	}
+	if !differ {
+		t.Fatal("different seeds gave the same placements")
+	}
+	// An ordering can pin a scenario; preferring the last node has it take
+	// the first unassigned replica.
+	b := newTieBreakerBuilder(t, func(nodes NodeSlice) {
+		for i, j := 0, len(nodes)-1; i < j; i, j = i+1, j-1 {
+			nodes[i], nodes[j] = nodes[j], nodes[i]
+		}
+	})
+	last := int32(len(b.nodes) - 1)
+	if b.replicaToPartitionToNodeIndex[2][len(b.replicaToPartitionToNodeIndex[2])-1] != last {
+		t.Fatal(b.replicaToPartitionToNodeIndex[2])
+	}
+	// A TieBreaker dropping nodes is ignored.
+	b = newTieBreakerBuilder(t, func(nodes NodeSlice) { nodes[0] = nodes[1] })
+	if !reflect.DeepEqual(b.replicaToPartitionToNodeIndex, base) {
+		t.Fatal("a broken tie breaker changed the placements")
+	}
+}
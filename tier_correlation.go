@@ -0,0 +1,207 @@
+package ring
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// CorrelateTiers declares that the values given, all at the tier level, share
+// a failure domain even though they are distinct values; for example, two
+// racks fed by the same PDU. The rebalancer then treats the values as one
+// when dispersing the replicas of a partition at that level, so it will
+// avoid placing two replicas in the two racks just as it would avoid placing
+// them in the same rack. Strict tier hierarchies cannot express such wiring.
+//
+// Any existing correlation of one of the values at the level is merged with
+// the new one, as correlation is transitive. The values need not be in use
+// yet; correlations naming values no longer in use simply have no effect.
+func (b *Builder) CorrelateTiers(level int, values []string) error {
+	if level < 0 {
+		return fmt.Errorf("invalid tier level %d", level)
+	}
+	group := make(map[string]bool)
+	for _, value := range values {
+		if value == "" {
+			return fmt.Errorf("cannot correlate the empty tier value")
+		}
+		group[value] = true
+	}
+	if len(group) < 2 {
+		return fmt.Errorf("at least two distinct tier values are needed to correlate")
+	}
+	for len(b.tierCorrelations) <= level {
+		b.tierCorrelations = append(b.tierCorrelations, nil)
+	}
+	var groups [][]string
+	for _, existing := range b.tierCorrelations[level] {
+		merge := false
+		for _, value := range existing {
+			if group[value] {
+				merge = true
+				break
+			}
+		}
+		if merge {
+			for _, value := range existing {
+				group[value] = true
+			}
+		} else {
+			groups = append(groups, existing)
+		}
+	}
+	merged := make([]string, 0, len(group))
+	for value := range group {
+		merged = append(merged, value)
+	}
+	sort.Strings(merged)
+	b.tierCorrelations[level] = append(groups, merged)
+	b.dirty = true
+	return nil
+}
+
+// UncorrelateTier removes the tier value at the level from any correlation;
+// see CorrelateTiers.
+func (b *Builder) UncorrelateTier(level int, value string) {
+	if level < 0 || level >= len(b.tierCorrelations) {
+		return
+	}
+	var groups [][]string
+	for _, group := range b.tierCorrelations[level] {
+		var kept []string
+		for _, v := range group {
+			if v != value {
+				kept = append(kept, v)
+			}
+		}
+		if len(kept) != len(group) {
+			b.dirty = true
+		}
+		if len(kept) > 1 {
+			groups = append(groups, kept)
+		}
+	}
+	b.tierCorrelations[level] = groups
+}
+
+// TierCorrelations returns the groups of correlated tier values at each tier
+// level; see CorrelateTiers.
+func (b *Builder) TierCorrelations() [][][]string {
+	rv := make([][][]string, len(b.tierCorrelations))
+	for level, groups := range b.tierCorrelations {
+		rv[level] = make([][]string, len(groups))
+		for i, group := range groups {
+			rv[level][i] = make([]string, len(group))
+			copy(rv[level][i], group)
+		}
+	}
+	return rv
+}
+
+// tierDomains returns, for each tier level, a mapping from each tier value
+// index to the index of the value representing its failure domain; the value
+// itself unless correlated with others.
+func (b *Builder) tierDomains() [][]int32 {
+	domains := make([][]int32, len(b.tiers))
+	for level, values := range b.tiers {
+		domains[level] = make([]int32, len(values))
+		for i := range values {
+			domains[level][i] = int32(i)
+		}
+		if level >= len(b.tierCorrelations) {
+			continue
+		}
+		valueToIndex := make(map[string]int32, len(values))
+		for i, value := range values {
+			if i > 0 && value != "" {
+				valueToIndex[value] = int32(i)
+			}
+		}
+		for _, group := range b.tierCorrelations[level] {
+			domain := int32(-1)
+			for _, value := range group {
+				if i, ok := valueToIndex[value]; ok {
+					if domain < 0 {
+						domain = i
+					}
+					domains[level][i] = domain
+				}
+			}
+		}
+	}
+	return domains
+}
+
+func (b *Builder) writeTierCorrelations(w io.Writer) error {
+	if len(b.tierCorrelations) > math.MaxInt32 {
+		return fmt.Errorf("%d tier correlation levels is too large; max is %d", len(b.tierCorrelations), math.MaxInt32)
+	}
+	if err := binary.Write(w, binary.BigEndian, int32(len(b.tierCorrelations))); err != nil {
+		return err
+	}
+	for _, groups := range b.tierCorrelations {
+		if len(groups) > math.MaxInt32 {
+			return fmt.Errorf("%d tier correlations is too large; max is %d", len(groups), math.MaxInt32)
+		}
+		if err := binary.Write(w, binary.BigEndian, int32(len(groups))); err != nil {
+			return err
+		}
+		for _, group := range groups {
+			if len(group) > math.MaxInt32 {
+				return fmt.Errorf("%d correlated tier values is too large; max is %d", len(group), math.MaxInt32)
+			}
+			if err := binary.Write(w, binary.BigEndian, int32(len(group))); err != nil {
+				return err
+			}
+			for _, value := range group {
+				byts := []byte(value)
+				if len(byts) > math.MaxInt32 {
+					return fmt.Errorf("%d tier value length is too large; max is %d", len(byts), math.MaxInt32)
+				}
+				if err := binary.Write(w, binary.BigEndian, int32(len(byts))); err != nil {
+					return err
+				}
+				if _, err := w.Write(byts); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (b *Builder) readTierCorrelations(r io.Reader) error {
+	var levels int32
+	if err := binary.Read(r, binary.BigEndian, &levels); err != nil {
+		return err
+	}
+	b.tierCorrelations = make([][][]string, levels)
+	for level := range b.tierCorrelations {
+		var count int32
+		if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+			return err
+		}
+		b.tierCorrelations[level] = make([][]string, count)
+		for i := range b.tierCorrelations[level] {
+			if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+				return err
+			}
+			group := make([]string, count)
+			for j := range group {
+				var length int32
+				if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+					return err
+				}
+				byts := make([]byte, length)
+				if _, err := io.ReadFull(r, byts); err != nil {
+					return err
+				}
+				group[j] = string(byts)
+			}
+			b.tierCorrelations[level][i] = group
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package ring
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBuilderCorrelateTiers(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetReplicaCount(2)
+	b.SetMaxPartitionBitCount(4)
+	if err := b.CorrelateTiers(1, []string{"rack1"}); err == nil {
+		t.Fatal("expected error correlating a single value")
+	}
+	if err := b.CorrelateTiers(1, []string{"rack1", "rack2"}); err != nil {
+		t.Fatal(err)
+	}
+	var nodes []BuilderNode
+	for _, tiers := range [][]string{{"server1", "rack1"}, {"server2", "rack2"}, {"server3", "rack3"}} {
+		n, err := b.AddNode(true, 1, tiers, nil, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, n)
+	}
+	r := b.Ring()
+	// Racks 1 and 2 share a failure domain, so every partition must have a
+	// replica in rack 3.
+	for partition := Partition(0); partition < 1<<r.PartitionBitCount(); partition++ {
+		found := false
+		for _, n := range r.ResponsibleNodes(partition) {
+			if n.ID() == nodes[2].ID() {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("partition %d has no replica in rack3", partition)
+		}
+	}
+	if err := b.CorrelateTiers(1, []string{"rack2", "rack4"}); err != nil {
+		t.Fatal(err)
+	}
+	c := b.TierCorrelations()
+	if len(c) != 2 || len(c[1]) != 1 || len(c[1][0]) != 3 || c[1][0][0] != "rack1" || c[1][0][2] != "rack4" {
+		t.Fatal(c)
+	}
+	buf := &bytes.Buffer{}
+	if err := b.Persist(buf); err != nil {
+		t.Fatal(err)
+	}
+	b2, err := LoadBuilder(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2 := b2.TierCorrelations()
+	if len(c2) != 2 || len(c2[1]) != 1 || len(c2[1][0]) != 3 || c2[1][0][1] != "rack2" {
+		t.Fatal(c2)
+	}
+	b2.UncorrelateTier(1, "rack1")
+	b2.UncorrelateTier(1, "rack2")
+	if c2 = b2.TierCorrelations(); len(c2[1]) != 0 {
+		t.Fatal(c2)
+	}
+}
@@ -0,0 +1,38 @@
+package ring
+
+// tierScope limits a rebalance to the nodes with the tier value given at the
+// level given; see Builder.RingWithinTier.
+type tierScope struct {
+	level int
+	value string
+}
+
+// RingWithinTier is the same as Ring but the rebalance will only move
+// partition replicas among the nodes whose tier value at the level given is
+// the value given, such as RingWithinTier(1, "zone3") to rebalance only within
+// zone3 after replacing hardware there. Replicas on nodes outside the tier
+// stay where they are and no replicas cross into or out of the tier; the
+// nodes within it share the replicas they already have by their capacities.
+// Replicas on deactivated nodes outside the tier are left for a later,
+// unscoped rebalance, and unassigned replicas are always assigned, within the
+// tier if possible. The Builder's max move percentage still applies.
+func (b *Builder) RingWithinTier(level int, value string) Ring {
+	return b.ring(-1, &tierScope{level: level, value: value})
+}
+
+// initScope marks the nodes within the scope, if there is one.
+func (rb *rebalancer) initScope(scope *tierScope) {
+	if scope == nil {
+		return
+	}
+	rb.nodeIndexInScope = make([]bool, len(rb.builder.nodes))
+	for nodeIndex, n := range rb.builder.nodes {
+		rb.nodeIndexInScope[nodeIndex] = n.Tier(scope.level) == scope.value
+	}
+}
+
+// inScope returns true if the rebalance may move replicas to or from the
+// node; always true without a scope.
+func (rb *rebalancer) inScope(nodeIndex int32) bool {
+	return rb.nodeIndexInScope == nil || (nodeIndex >= 0 && rb.nodeIndexInScope[nodeIndex])
+}
@@ -0,0 +1,97 @@
+package ring
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBuilderRingWithinTier(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetReplicaCount(3)
+	for i := 0; i < 6; i++ {
+		if _, err := b.AddNode(true, 1, []string{fmt.Sprintf("server%d", i), fmt.Sprintf("zone%d", i%3)}, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Ring()
+	bits := b.partitionBitCount
+	b.PretendElapsed(b.MoveWait() + 1)
+	before := make([][]int32, len(b.replicaToPartitionToNodeIndex))
+	for replica, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+		before[replica] = append([]int32(nil), partitionToNodeIndex...)
+	}
+	outside, err := b.AddNode(true, 1, []string{"server6", "zone0"}, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inside, err := b.AddNode(true, 1, []string{"server7", "zone2"}, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := b.RingWithinTier(1, "zone2")
+	// The ring grows for the new nodes, splitting each partition without
+	// moving it.
+	shift := b.partitionBitCount - bits
+	moves := 0
+	for replica, partitionToNodeIndex := range b.replicaToPartitionToNodeIndex {
+		for partition, nodeIndex := range partitionToNodeIndex {
+			previous := before[replica][partition>>shift]
+			if nodeIndex == previous {
+				continue
+			}
+			moves++
+			if from, to := b.nodes[previous].Tier(1), b.nodes[nodeIndex].Tier(1); from != "zone2" || to != "zone2" {
+				t.Fatalf("replica %d of partition %d moved from %s to %s", replica, partition, from, to)
+			}
+		}
+	}
+	stats := r.Stats()
+	var insideCount, outsideCount int
+	for _, ns := range stats.NodeStats {
+		switch ns.NodeID {
+		case inside.ID():
+			insideCount = ns.AssignedCount
+		case outside.ID():
+			outsideCount = ns.AssignedCount
+		}
+	}
+	if moves == 0 || insideCount != moves || outsideCount != 0 {
+		t.Fatal(moves, insideCount, outsideCount)
+	}
+	// An unscoped rebalance then brings in the node outside the tier.
+	b.PretendElapsed(b.MoveWait() + 1)
+	for _, ns := range b.Ring().Stats().NodeStats {
+		if ns.NodeID == outside.ID() && ns.AssignedCount == 0 {
+			t.Fatal("node outside the tier still unassigned")
+		}
+	}
+}
+
+func TestBuilderRingWithinDrainedTier(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetReplicaCount(3)
+	var ids []uint64
+	for i := 0; i < 6; i++ {
+		n, err := b.AddNode(true, 1, []string{fmt.Sprintf("server%d", i), fmt.Sprintf("zone%d", i%3)}, nil, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, n.ID())
+	}
+	b.Ring()
+	for _, id := range []uint64{ids[2], ids[5]} {
+		if err := b.SetNodeDraining(id, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// With every node in scope draining, none desires any replicas.
+	rb := newScopedRebalancer(b, &tierScope{level: 1, value: "zone2"})
+	for nodeIndex, n := range b.nodes {
+		if !rb.inScope(int32(nodeIndex)) {
+			continue
+		}
+		if desire := rb.nodeIndexToDesire[nodeIndex]; desire != -int32(b.nodeAssignments(n.id)) {
+			t.Fatal(nodeIndex, desire, b.nodeAssignments(n.id))
+		}
+	}
+}
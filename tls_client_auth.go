@@ -0,0 +1,84 @@
+package ring
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+)
+
+// TLSClientAuth is a client certificate policy for the inbound connections of
+// a TCPMsgRing; see TCPMsgRingConfig.ClientAuth. The modes other than
+// TLSClientAuthDefault let a cluster move to mutual TLS incrementally: start
+// listeners with TLSClientAuthRequest, give each node its client certificate,
+// then switch listeners to TLSClientAuthRequire.
+type TLSClientAuth int
+
+const (
+	// TLSClientAuthDefault follows TCPMsgRingConfig.MutualTLS: if set, client
+	// certificates are required, verified against the CAFile, and must name
+	// the client's IP address; otherwise it is TLSClientAuthNone.
+	TLSClientAuthDefault TLSClientAuth = iota
+	// TLSClientAuthNone does not ask clients for certificates.
+	TLSClientAuthNone
+	// TLSClientAuthRequest asks clients for certificates but still accepts
+	// clients without one. A certificate given must verify against the
+	// CAFile and name the host of the ring address of the node the client
+	// identifies itself as.
+	TLSClientAuthRequest
+	// TLSClientAuthRequire requires client certificates, which must verify
+	// against the CAFile and name the host of the ring address of the node
+	// the client identifies itself as.
+	TLSClientAuthRequire
+)
+
+func (a TLSClientAuth) String() string {
+	switch a {
+	case TLSClientAuthDefault:
+		return "default"
+	case TLSClientAuthNone:
+		return "none"
+	case TLSClientAuthRequest:
+		return "request"
+	case TLSClientAuthRequire:
+		return "require"
+	}
+	return fmt.Sprintf("TLSClientAuth(%d)", int(a))
+}
+
+func (a TLSClientAuth) tlsClientAuthType() tls.ClientAuthType {
+	switch a {
+	case TLSClientAuthDefault, TLSClientAuthRequire:
+		return tls.RequireAndVerifyClientCert
+	case TLSClientAuthRequest:
+		return tls.VerifyClientCertIfGiven
+	}
+	return tls.NoClientCert
+}
+
+// verifyClientIdentity checks the client certificate of an inbound connection
+// against the ring identity the client gave in the handshake, its node's
+// address; see TLSClientAuthRequest and TLSClientAuthRequire.
+func (t *TCPMsgRing) verifyClientIdentity(netConn net.Conn, addr string) error {
+	if t.clientAuth != TLSClientAuthRequest && t.clientAuth != TLSClientAuthRequire {
+		return nil
+	}
+	tlsConn, ok := netConn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	chains := tlsConn.ConnectionState().VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		if t.clientAuth == TLSClientAuthRequire {
+			return fmt.Errorf("no verified client certificate")
+		}
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if err = chains[0][0].VerifyHostname(host); err != nil {
+		return fmt.Errorf("client certificate does not match ring identity: %s", err)
+	}
+	return nil
+}
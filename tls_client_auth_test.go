@@ -0,0 +1,173 @@
+package ring
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestTCPMsgRingClientAuthResolve(t *testing.T) {
+	if cfg := resolveTCPMsgRingConfig(nil); cfg.ClientAuth != TLSClientAuthNone {
+		t.Fatal(cfg.ClientAuth)
+	}
+	if cfg := resolveTCPMsgRingConfig(&TCPMsgRingConfig{MutualTLS: true}); cfg.ClientAuth != TLSClientAuthDefault {
+		t.Fatal(cfg.ClientAuth)
+	}
+	if cfg := resolveTCPMsgRingConfig(&TCPMsgRingConfig{MutualTLS: true, ClientAuth: TLSClientAuthRequest}); cfg.ClientAuth != TLSClientAuthRequest {
+		t.Fatal(cfg.ClientAuth)
+	}
+}
+
+// tlsClientAuthPair completes a TLS handshake over loopback between the
+// TCPMsgRing's server config and a client presenting the certificate given,
+// if any, and returns the server end.
+func tlsClientAuthPair(t *testing.T, msgRing *TCPMsgRing, clientCert *TLSCertFiles) (net.Conn, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	clientConf := &tls.Config{InsecureSkipVerify: true}
+	if clientCert != nil {
+		cert, err := tls.LoadX509KeyPair(clientCert.CertFile, clientCert.KeyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientConf.Certificates = []tls.Certificate{cert}
+	}
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tlsConn := tls.Client(conn, clientConf)
+		if tlsConn.Handshake() == nil {
+			tlsConn.Read(make([]byte, 1))
+		}
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConn := tls.Server(conn, msgRing.serverTLSConfig)
+	if err = tlsConn.Handshake(); err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func TestTCPMsgRingClientAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ringtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	server := writeTestCert(t, dir, "server", 1, []string{"server.example.com"})
+	client := writeTestCert(t, dir, "client", 2, []string{"client.example.com"})
+	newMsgRing := func(clientAuth TLSClientAuth) *TCPMsgRing {
+		msgRing, err := NewTCPMsgRing(&TCPMsgRingConfig{UseTLS: true, CertFile: server.CertFile, KeyFile: server.KeyFile, CAFile: client.CertFile, ClientAuth: clientAuth})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msgRing
+	}
+	request := newMsgRing(TLSClientAuthRequest)
+	defer request.Shutdown()
+	conn, err := tlsClientAuthPair(t, request, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = request.verifyClientIdentity(conn, "client.example.com:1234"); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	conn, err = tlsClientAuthPair(t, request, &client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = request.verifyClientIdentity(conn, "client.example.com:1234"); err != nil {
+		t.Fatal(err)
+	}
+	if err = request.verifyClientIdentity(conn, "other.example.com:1234"); err == nil {
+		t.Fatal("expected ring identity mismatch")
+	}
+	conn.Close()
+	require := newMsgRing(TLSClientAuthRequire)
+	defer require.Shutdown()
+	if _, err = tlsClientAuthPair(t, require, nil); err == nil {
+		t.Fatal("expected handshake to fail without a client certificate")
+	}
+	conn, err = tlsClientAuthPair(t, require, &client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = require.verifyClientIdentity(conn, "client.example.com:1234"); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	none := newMsgRing(TLSClientAuthNone)
+	defer none.Shutdown()
+	conn, err = tlsClientAuthPair(t, none, &client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = none.verifyClientIdentity(conn, "other.example.com:1234"); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestTCPMsgRingTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ringtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	server := writeTestCert(t, dir, "server", 1, []string{"server.example.com"})
+	client := writeTestCert(t, dir, "client", 2, []string{"client.example.com"})
+	cert, err := tls.LoadX509KeyPair(server.CertFile, server.KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pem, err := ioutil.ReadFile(client.CertFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(pem)
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, ClientCAs: pool, RootCAs: pool}
+	msgRing, err := NewTCPMsgRing(&TCPMsgRingConfig{UseTLS: true, MutualTLS: true, ClientAuth: TLSClientAuthRequire, TLSConfig: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer msgRing.Shutdown()
+	if cfg.ClientAuth != tls.NoClientCert {
+		t.Fatal("config given was changed")
+	}
+	if _, err = tlsClientAuthPair(t, msgRing, nil); err == nil {
+		t.Fatal("expected handshake to fail without a client certificate")
+	}
+	conn, err := tlsClientAuthPair(t, msgRing, &client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = msgRing.verifyClientIdentity(conn, "client.example.com:1234"); err != nil {
+		t.Fatal(err)
+	}
+	if err = msgRing.verifyClientIdentity(conn, "other.example.com:1234"); err == nil {
+		t.Fatal("expected ring identity mismatch")
+	}
+	conn.Close()
+	clientConf := msgRing.newClientTLSConfig("server.example.com:1234")
+	if clientConf.ServerName != "server.example.com" || len(clientConf.Certificates) != 1 || clientConf.RootCAs != pool {
+		t.Fatalf("%#v", clientConf)
+	}
+	if err = msgRing.ReloadCertificates(); err != nil {
+		t.Fatal(err)
+	}
+}
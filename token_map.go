@@ -0,0 +1,107 @@
+package ring
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"strconv"
+)
+
+// TokenMap is a Dynamo-style description of a Ring's layout, as output by
+// ExportTokenMap. Each partition becomes a token range, with tokens being
+// signed 64 bit values in the manner of Cassandra's Murmur3Partitioner: a
+// range covers the tokens after StartToken up to and including EndToken.
+// Tokens are given as strings since many JSON tools cannot represent all 64
+// bit integers.
+//
+// The token of a hash value is the hash, as used to choose partitions (see
+// Ring.PartitionBitCount), less 1<<63.
+type TokenMap struct {
+	Partitioner       string           `json:"partitioner"`
+	Version           int64            `json:"version"`
+	PartitionBitCount uint16           `json:"partition_bit_count"`
+	ReplicationFactor int              `json:"replication_factor"`
+	Nodes             []*TokenMapNode  `json:"nodes"`
+	Ranges            []*TokenMapRange `json:"token_ranges"`
+}
+
+// TokenMapNode describes a node in a TokenMap; Tokens lists the EndTokens of
+// the ranges for which the node is the primary (first) replica.
+type TokenMapNode struct {
+	ID       uint64   `json:"id,string"`
+	Address  string   `json:"address"`
+	Active   bool     `json:"active"`
+	Capacity uint64   `json:"capacity"`
+	Tiers    []string `json:"tiers,omitempty"`
+	Tokens   []string `json:"tokens"`
+}
+
+// TokenMapRange is a token range of a TokenMap; Endpoints lists the addresses
+// of the replicas and NodeIDs the corresponding node IDs, in replica order.
+type TokenMapRange struct {
+	Partition  Partition `json:"partition"`
+	StartToken string    `json:"start_token"`
+	EndToken   string    `json:"end_token"`
+	Endpoints  []string  `json:"endpoints"`
+	NodeIDs    []string  `json:"node_ids"`
+}
+
+// NewTokenMap returns the TokenMap for the Ring, using the address at the
+// addressIndex for node endpoints.
+func NewTokenMap(r Ring, addressIndex int) *TokenMap {
+	m := &TokenMap{
+		Partitioner:       "org.apache.cassandra.dht.Murmur3Partitioner",
+		Version:           r.Version(),
+		PartitionBitCount: r.PartitionBitCount(),
+		ReplicationFactor: r.ReplicaCount(),
+	}
+	nodeIDToNode := make(map[uint64]*TokenMapNode)
+	for _, n := range r.Nodes() {
+		mn := &TokenMapNode{
+			ID:       n.ID(),
+			Address:  n.Address(addressIndex),
+			Active:   n.Active(),
+			Capacity: n.Capacity(),
+			Tiers:    n.Tiers(),
+			Tokens:   []string{},
+		}
+		m.Nodes = append(m.Nodes, mn)
+		nodeIDToNode[n.ID()] = mn
+	}
+	shift := 64 - uint64(r.PartitionBitCount())
+	partitionCount := uint64(1) << r.PartitionBitCount()
+	for p := uint64(0); p < partitionCount; p++ {
+		start := int64(math.MinInt64)
+		if p > 0 {
+			start = int64((p<<shift)^(1<<63)) - 1
+		}
+		end := int64((((p + 1) << shift) - 1) ^ (1 << 63))
+		rng := &TokenMapRange{
+			Partition:  Partition(p),
+			StartToken: strconv.FormatInt(start, 10),
+			EndToken:   strconv.FormatInt(end, 10),
+		}
+		for i, n := range r.ResponsibleNodes(Partition(p)) {
+			rng.Endpoints = append(rng.Endpoints, n.Address(addressIndex))
+			rng.NodeIDs = append(rng.NodeIDs, strconv.FormatUint(n.ID(), 10))
+			if i == 0 {
+				mn := nodeIDToNode[n.ID()]
+				mn.Tokens = append(mn.Tokens, rng.EndToken)
+			}
+		}
+		m.Ranges = append(m.Ranges, rng)
+	}
+	return m
+}
+
+// ExportTokenMap writes the TokenMap for the Ring as indented JSON, for use
+// with Dynamo-family tooling that inspects token ring layouts.
+func ExportTokenMap(w io.Writer, r Ring, addressIndex int) error {
+	b, err := json.MarshalIndent(NewTokenMap(r, addressIndex), "", "    ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	_, err = w.Write(b)
+	return err
+}
@@ -0,0 +1,53 @@
+package ring
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestTokenMap(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetReplicaCount(2)
+	for i := 0; i < 3; i++ {
+		if _, err := b.AddNode(true, 1, nil, []string{"127.0.0." + strconv.Itoa(i+1) + ":9042"}, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := b.Ring()
+	buf := &bytes.Buffer{}
+	if err := ExportTokenMap(buf, r, 0); err != nil {
+		t.Fatal(err)
+	}
+	m := &TokenMap{}
+	if err := json.Unmarshal(buf.Bytes(), m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Ranges) != 1<<r.PartitionBitCount() || len(m.Nodes) != 3 || m.ReplicationFactor != 2 {
+		t.Fatalf("%d %d %d", len(m.Ranges), len(m.Nodes), m.ReplicationFactor)
+	}
+	if m.Ranges[0].StartToken != strconv.FormatInt(math.MinInt64, 10) {
+		t.Fatal(m.Ranges[0].StartToken)
+	}
+	if m.Ranges[len(m.Ranges)-1].EndToken != strconv.FormatInt(math.MaxInt64, 10) {
+		t.Fatal(m.Ranges[len(m.Ranges)-1].EndToken)
+	}
+	primaries := 0
+	for i, rng := range m.Ranges {
+		if i > 0 && rng.StartToken != m.Ranges[i-1].EndToken {
+			t.Fatalf("%d: %s != %s", i, rng.StartToken, m.Ranges[i-1].EndToken)
+		}
+		nodes := r.ResponsibleNodes(rng.Partition)
+		if len(rng.Endpoints) != 2 || rng.Endpoints[0] != nodes[0].Address(0) || rng.NodeIDs[1] != strconv.FormatUint(nodes[1].ID(), 10) {
+			t.Fatalf("%d: %v %v", i, rng.Endpoints, rng.NodeIDs)
+		}
+	}
+	for _, n := range m.Nodes {
+		primaries += len(n.Tokens)
+	}
+	if primaries != len(m.Ranges) {
+		t.Fatalf("%d != %d", primaries, len(m.Ranges))
+	}
+}
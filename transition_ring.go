@@ -0,0 +1,106 @@
+package ring
+
+import "time"
+
+// TransitionRing wraps the current Ring along with the previous Ring for a
+// window of time after a ring change, during which data may not have finished
+// moving from the previous owners of a partition to the new ones. All Ring
+// methods answer from the current Ring; ReadNodes and ReadResponsible also
+// include the previous owners while the window is open, so reads can fall
+// back to the nodes that may still hold the data.
+type TransitionRing struct {
+	Ring
+	previous Ring
+	until    time.Time
+	now      func() time.Time
+}
+
+// NewTransitionRing returns a TransitionRing for the change from the previous
+// to the current Ring, with the previous owners included for reads for the
+// window given; this would usually be about as long as a full replication
+// pass takes. The previous Ring may be nil, in which case there is no
+// transition.
+func NewTransitionRing(previous Ring, current Ring, window time.Duration) *TransitionRing {
+	t := &TransitionRing{Ring: current, previous: previous, now: time.Now}
+	t.until = t.now().Add(window)
+	return t
+}
+
+// Previous returns the previous Ring, or nil if the transition window has
+// closed.
+func (t *TransitionRing) Previous() Ring {
+	if t.previous == nil || !t.now().Before(t.until) {
+		return nil
+	}
+	return t.previous
+}
+
+// InTransition returns true while the transition window is open.
+func (t *TransitionRing) InTransition() bool {
+	return t.Previous() != nil
+}
+
+// ReadNodes returns the nodes to try when reading the partition: the
+// responsible nodes of the current Ring followed, during the transition
+// window, by any responsible nodes of the previous Ring not already listed.
+// Note that the previous owners may no longer be in the current Ring.
+func (t *TransitionRing) ReadNodes(partition Partition) NodeSlice {
+	nodes := t.Ring.ResponsibleNodes(partition)
+	previous := t.Previous()
+	if previous == nil {
+		return nodes
+	}
+	first, last := previousPartitions(t.Ring.PartitionBitCount(), previous.PartitionBitCount(), partition)
+	nodes = append(NodeSlice(nil), nodes...)
+	for p := first; ; p++ {
+	NEXT:
+		for _, pn := range previous.ResponsibleNodes(p) {
+			for _, n := range nodes {
+				if n.ID() == pn.ID() {
+					continue NEXT
+				}
+			}
+			nodes = append(nodes, pn)
+		}
+		if p == last {
+			break
+		}
+	}
+	return nodes
+}
+
+// ReadResponsible returns true if the local node is responsible for reads of
+// the partition; that is, if it is responsible in the current Ring or, during
+// the transition window, in the previous Ring.
+func (t *TransitionRing) ReadResponsible(partition Partition) bool {
+	if t.Ring.Responsible(partition) {
+		return true
+	}
+	local := t.Ring.LocalNode()
+	if local == nil {
+		return false
+	}
+	for _, n := range t.ReadNodes(partition) {
+		if n.ID() == local.ID() {
+			return true
+		}
+	}
+	return false
+}
+
+// previousPartitions returns the range of partitions of a previous ring that
+// hold the data of the partition of the current ring. The partition bit count
+// may have changed between the rings; the partition covers the same hash
+// values as the previous partition it is part of or, if the bit count shrank,
+// all the previous partitions that make it up.
+func previousPartitions(currentBitCount uint16, previousBitCount uint16, partition Partition) (Partition, Partition) {
+	first, last := partition, partition
+	if currentBitCount > previousBitCount {
+		first = partition >> (currentBitCount - previousBitCount)
+		last = first
+	} else if previousBitCount > currentBitCount {
+		first = partition << (previousBitCount - currentBitCount)
+		last = first + 1<<(previousBitCount-currentBitCount) - 1
+	}
+	return first, last
+}
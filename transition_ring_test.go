@@ -0,0 +1,66 @@
+package ring
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTransitionRing(t *testing.T) {
+	b := NewBuilder(64)
+	for i := 0; i < 3; i++ {
+		if _, err := b.AddNode(true, 1, nil, nil, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	previous := b.Ring()
+	b.PretendElapsed(math.MaxUint16)
+	n, err := b.AddNode(true, 3, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := b.Ring()
+	current.SetLocalNode(n.ID())
+	tr := NewTransitionRing(previous, current, time.Minute)
+	if !tr.InTransition() {
+		t.Fatal("should be in transition")
+	}
+	moved := -1
+	for p := Partition(0); p < 1<<current.PartitionBitCount(); p++ {
+		if current.ResponsibleNodes(p)[0].ID() == n.ID() {
+			moved = int(p)
+			break
+		}
+	}
+	if moved < 0 {
+		t.Fatal("no partition moved to the new node")
+	}
+	// The partition bit count may have grown with the new node.
+	previousPartition := Partition(moved) >> (current.PartitionBitCount() - previous.PartitionBitCount())
+	nodes := tr.ReadNodes(Partition(moved))
+	if len(nodes) != 2 || nodes[0].ID() != n.ID() || nodes[1].ID() != previous.ResponsibleNodes(previousPartition)[0].ID() {
+		t.Fatalf("%v", nodes)
+	}
+	if !tr.ReadResponsible(Partition(moved)) {
+		t.Fatal("local node should be responsible")
+	}
+	tr.now = func() time.Time { return time.Now().Add(time.Hour) }
+	if tr.InTransition() {
+		t.Fatal("should not be in transition")
+	}
+	if nodes = tr.ReadNodes(Partition(moved)); len(nodes) != 1 {
+		t.Fatalf("%v", nodes)
+	}
+	// Going the other way, a partition covers all the partitions of the
+	// larger ring that make it up.
+	tr = NewTransitionRing(current, previous, time.Minute)
+	found := false
+	for _, rn := range tr.ReadNodes(previousPartition) {
+		if rn.ID() == n.ID() {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("node %d not in %v", n.ID(), tr.ReadNodes(previousPartition))
+	}
+}
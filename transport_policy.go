@@ -0,0 +1,159 @@
+package ring
+
+import (
+	"compress/flate"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// TransportPolicy overrides TCPMsgRing settings for the connections between
+// two network zones, as WAN links between datacenters need very different
+// settings than LAN links within one; see TCPMsgRingConfig.TransportPolicy
+// and Node.NetworkZone. Zero values keep the TCPMsgRingConfig settings.
+type TransportPolicy struct {
+	// Compress indicates the connection should be compressed with DEFLATE;
+	// this trades CPU for bandwidth, usually only worthwhile on slower links.
+	// The two ends agree on compression during the handshake, compressing if
+	// either end's policy asks for it.
+	Compress bool
+	// ConnectTimeout indicates how many seconds to wait when dialing.
+	ConnectTimeout int
+	// WithinMessageTimeout indicates how many seconds to wait for reading or
+	// writing any part of a message.
+	WithinMessageTimeout int
+	// MaxBytesPerSecond caps how fast the connection is written to, in bytes
+	// on the wire, after any compression. Keep it high enough that a write
+	// chunk can be written within the WithinMessageTimeout.
+	MaxBytesPerSecond int
+}
+
+// CrossZoneTransportPolicy returns a func for TCPMsgRingConfig.TransportPolicy
+// that applies the policy given to connections between different network
+// zones only, such as to compress only links that leave a datacenter.
+func CrossZoneTransportPolicy(crossZone *TransportPolicy) func(localZone string, remoteZone string) *TransportPolicy {
+	return func(localZone string, remoteZone string) *TransportPolicy {
+		if localZone == remoteZone {
+			return nil
+		}
+		return crossZone
+	}
+}
+
+// transportPolicyFor returns the TransportPolicy for connections with the
+// node at the address in the current ring, or nil if none applies.
+func (t *TCPMsgRing) transportPolicyFor(addr string) *TransportPolicy {
+	if t.transportPolicy == nil {
+		return nil
+	}
+	ring, addressIndex := t.ringAndAddressIndex()
+	if ring == nil {
+		return nil
+	}
+	var localZone string
+	if localNode := ring.LocalNode(); localNode != nil {
+		localZone = localNode.NetworkZone()
+	}
+	for _, n := range ring.Nodes() {
+		if n.Address(addressIndex) == addr {
+			return t.transportPolicy(localZone, n.NetworkZone())
+		}
+	}
+	return nil
+}
+
+// connectTimeoutFor returns the ConnectTimeout to use when dialing the
+// address.
+func (t *TCPMsgRing) connectTimeoutFor(addr string) time.Duration {
+	if p := t.transportPolicyFor(addr); p != nil && p.ConnectTimeout > 0 {
+		return time.Duration(p.ConnectTimeout) * time.Second
+	}
+	return t.connectTimeout
+}
+
+// withinMessageTimeoutFor returns the WithinMessageTimeout to use with the
+// connection to the address.
+func (t *TCPMsgRing) withinMessageTimeoutFor(addr string) time.Duration {
+	if p := t.transportPolicyFor(addr); p != nil && p.WithinMessageTimeout > 0 {
+		return time.Duration(p.WithinMessageTimeout) * time.Second
+	}
+	return t.withinMessageTimeout
+}
+
+// policyConn applies the compression and bandwidth cap agreed upon for a
+// connection; it is used in place of the handshaked connection.
+func (t *TCPMsgRing) policyConn(netConn net.Conn, addr string, compress bool) net.Conn {
+	var maxBytesPerSecond int
+	if p := t.transportPolicyFor(addr); p != nil {
+		maxBytesPerSecond = p.MaxBytesPerSecond
+	}
+	if !compress && maxBytesPerSecond < 1 {
+		return netConn
+	}
+	c := &policyConn{Conn: netConn, maxBytesPerSecond: maxBytesPerSecond, start: time.Now()}
+	if compress {
+		atomic.AddInt32(&t.compressedConnections, 1)
+		c.reader = flate.NewReader(netConn)
+		// flate.NewWriter only errors with an invalid level.
+		c.writer, _ = flate.NewWriter(wireWriter{c}, flate.DefaultCompression)
+	}
+	return c
+}
+
+type policyConn struct {
+	net.Conn
+	reader            io.Reader
+	writer            *flate.Writer
+	maxBytesPerSecond int
+	start             time.Time
+	written           int64
+}
+
+func (c *policyConn) Read(p []byte) (int, error) {
+	if c.reader != nil {
+		return c.reader.Read(p)
+	}
+	return c.Conn.Read(p)
+}
+
+// Write compresses, if enabled, and flushes each write, as the TCPMsgRing
+// writes whole buffered chunks.
+func (c *policyConn) Write(p []byte) (int, error) {
+	if c.writer == nil {
+		return c.writeWire(p)
+	}
+	if _, err := c.writer.Write(p); err != nil {
+		return 0, err
+	}
+	if err := c.writer.Flush(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeWire writes to the underlying connection, first waiting as needed to
+// stay within the bandwidth cap.
+func (c *policyConn) writeWire(p []byte) (int, error) {
+	if c.maxBytesPerSecond > 0 {
+		elapsed := time.Since(c.start)
+		allowed := time.Duration(c.written) * time.Second / time.Duration(c.maxBytesPerSecond)
+		if elapsed > allowed+time.Second {
+			// The connection was idle; don't let it burst to catch up.
+			c.start = time.Now()
+			c.written = 0
+		} else if allowed > elapsed {
+			time.Sleep(allowed - elapsed)
+		}
+		c.written += int64(len(p))
+	}
+	return c.Conn.Write(p)
+}
+
+type wireWriter struct {
+	c *policyConn
+}
+
+func (w wireWriter) Write(p []byte) (int, error) {
+	return w.c.writeWire(p)
+}
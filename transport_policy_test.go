@@ -0,0 +1,249 @@
+package ring
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestZoneRings() (Ring, Ring, error) {
+	b := NewBuilder(64)
+	b.SetReplicaCount(2)
+	nA, err := b.AddNode(true, 1, nil, []string{"127.0.0.1:9999"}, "", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	nA.SetNetworkZone("east")
+	nB, err := b.AddNode(true, 1, nil, []string{"127.0.0.1:8888"}, "", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	nB.SetNetworkZone("west")
+	rA := b.Ring()
+	rA.SetLocalNode(nA.ID())
+	rB := b.Ring()
+	rB.SetLocalNode(nB.ID())
+	return rA, rB, nil
+}
+
+func TestCrossZoneTransportPolicy(t *testing.T) {
+	p := &TransportPolicy{Compress: true}
+	f := CrossZoneTransportPolicy(p)
+	if f("east", "east") != nil {
+		t.Fatal("same zone should have no policy")
+	}
+	if f("east", "west") != p {
+		t.Fatal("cross zone should have the policy")
+	}
+}
+
+func TestTCPMsgRingTransportPolicyFor(t *testing.T) {
+	rA, _, err := newTestZoneRings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgring, _ := NewTCPMsgRing(&TCPMsgRingConfig{
+		ConnectTimeout:       10,
+		WithinMessageTimeout: 2,
+		TransportPolicy:      CrossZoneTransportPolicy(&TransportPolicy{ConnectTimeout: 30}),
+	})
+	msgring.SetRing(rA)
+	if p := msgring.transportPolicyFor("127.0.0.1:9999"); p != nil {
+		t.Fatal(p)
+	}
+	if p := msgring.transportPolicyFor("127.0.0.1:8888"); p == nil {
+		t.Fatal("no policy for cross zone node")
+	}
+	if v := msgring.connectTimeoutFor("127.0.0.1:9999"); v != 10*time.Second {
+		t.Fatal(v)
+	}
+	if v := msgring.connectTimeoutFor("127.0.0.1:8888"); v != 30*time.Second {
+		t.Fatal(v)
+	}
+	if v := msgring.withinMessageTimeoutFor("127.0.0.1:8888"); v != 2*time.Second {
+		t.Fatal(v)
+	}
+}
+
+func TestTCPMsgRingHandshakeCompress(t *testing.T) {
+	rA, rB, err := newTestZoneRings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgringA, _ := NewTCPMsgRing(&TCPMsgRingConfig{
+		TransportPolicy: CrossZoneTransportPolicy(&TransportPolicy{Compress: true}),
+		MaxMsgLength:    1000,
+	})
+	msgringA.SetRing(rA)
+	// B has no policy of its own but should still agree to compress.
+	msgringB, _ := NewTCPMsgRing(nil)
+	msgringB.SetRing(rB)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	type result struct {
+		addr     string
+		compress bool
+		err      error
+		conn     net.Conn
+	}
+	resultChan := make(chan *result, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			resultChan <- &result{err: err}
+			return
+		}
+		addr, features, err := msgringB.handshake(conn)
+		resultChan <- &result{addr: addr, compress: features&featureCompress != 0, err: err, conn: conn}
+	}()
+	connA, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connA.Close()
+	addr, features, err := msgringA.handshake(connA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compress := features&featureCompress != 0
+	if addr != "127.0.0.1:8888" || !compress {
+		t.Fatal(addr, compress)
+	}
+	resB := <-resultChan
+	if resB.err != nil {
+		t.Fatal(resB.err)
+	}
+	defer resB.conn.Close()
+	if resB.addr != "127.0.0.1:9999" || !resB.compress {
+		t.Fatal(resB.addr, resB.compress)
+	}
+	// Each end learned the other's max message length.
+	if peer, _ := msgringB.Peer(resB.addr); peer.MaxMsgLength != 1000 {
+		t.Fatal(peer.MaxMsgLength)
+	}
+	if peer, _ := msgringA.Peer(addr); peer.MaxMsgLength != math.MaxUint64 {
+		t.Fatal(peer.MaxMsgLength)
+	}
+	pcA := msgringA.policyConn(connA, addr, compress)
+	pcB := msgringB.policyConn(resB.conn, resB.addr, resB.compress)
+	msg := bytes.Repeat([]byte("Testing"), 100)
+	go pcA.Write(msg)
+	buf := make([]byte, len(msg))
+	if _, err = io.ReadFull(pcB, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Fatal(string(buf))
+	}
+}
+
+func TestTCPMsgRingHandshakeFeatureSets(t *testing.T) {
+	rA, rB, err := newTestZoneRings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgringA, _ := NewTCPMsgRing(nil)
+	msgringA.SetRing(rA)
+	// handshakeWith handshakes with a peer sending the handshake block given
+	// and then "after", which should be the next thing read.
+	handshakeWith := func(block []byte) (byte, PeerInfo) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			buf := make([]byte, len(TCP_MSG_RING_VERSION)+8+2+len(block))
+			copy(buf, TCP_MSG_RING_VERSION)
+			binary.BigEndian.PutUint64(buf[len(TCP_MSG_RING_VERSION):], rB.LocalNode().ID())
+			binary.BigEndian.PutUint16(buf[len(TCP_MSG_RING_VERSION)+8:], uint16(len(block)))
+			copy(buf[len(TCP_MSG_RING_VERSION)+10:], block)
+			conn.Write(append(buf, "after"...))
+			io.ReadFull(conn, make([]byte, len(TCP_MSG_RING_VERSION)+8+2+handshakeBlockLength))
+		}()
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		addr, features, err := msgringA.handshake(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after := make([]byte, 5)
+		if _, err = io.ReadFull(conn, after); err != nil || string(after) != "after" {
+			t.Fatal(string(after), err)
+		}
+		peer, _ := msgringA.Peer(addr)
+		return features, peer
+	}
+	// A newer peer, with a flag and a field not known here.
+	block := make([]byte, handshakeBlockLength+6)
+	block[0] = featureCompress | 0x80
+	binary.BigEndian.PutUint64(block[1:], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint64(block[9:], 1234)
+	copy(block[handshakeBlockLength:], "future")
+	features, peer := handshakeWith(block)
+	if features != featureCompress || peer.MaxMsgLength != 1234 || peer.ClockSkew > time.Second || peer.ClockSkew < -time.Second {
+		t.Fatal(features, peer)
+	}
+	// An older peer, giving only its feature flags.
+	features, peer = handshakeWith([]byte{featureCompress})
+	if features != featureCompress || peer.MaxMsgLength != 0 {
+		t.Fatal(features, peer)
+	}
+}
+
+func TestPolicyConnCompress(t *testing.T) {
+	msgring, _ := NewTCPMsgRing(nil)
+	conn := &testConn{}
+	pc := msgring.policyConn(conn, "127.0.0.1:9999", true)
+	msg := bytes.Repeat([]byte("Testing"), 100)
+	if n, err := pc.Write(msg); err != nil || n != len(msg) {
+		t.Fatal(n, err)
+	}
+	if conn.writeBuf.Len() >= len(msg) {
+		t.Fatalf("%d >= %d", conn.writeBuf.Len(), len(msg))
+	}
+	conn.readBuf.Write(conn.writeBuf.Bytes())
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(pc, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Fatal(string(buf))
+	}
+	if pc = msgring.policyConn(conn, "127.0.0.1:9999", false); pc != conn {
+		t.Fatal("connection should not be wrapped without a policy")
+	}
+}
+
+func TestPolicyConnMaxBytesPerSecond(t *testing.T) {
+	conn := &testConn{}
+	pc := &policyConn{Conn: conn, maxBytesPerSecond: 1000, start: time.Now()}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := pc.Write(make([]byte, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first 100 bytes go at once, the next 200 take 200ms.
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond {
+		t.Fatal(elapsed)
+	}
+	if conn.writeBuf.Len() != 300 {
+		t.Fatal(conn.writeBuf.Len())
+	}
+}
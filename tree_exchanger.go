@@ -0,0 +1,390 @@
+package ring
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TREE_EXCHANGE_MSG_TYPE is the default message type used by the
+// TreeExchanger.
+const TREE_EXCHANGE_MSG_TYPE = 0x6c1f3b97e2a4d058
+
+// treeMsgHeaderLength is the wire length of a tree message before its nodes:
+// ring version, sender node ID, partition, tree depth, level, and node count.
+const treeMsgHeaderLength = 8 + 8 + 4 + 1 + 1 + 4
+
+// treeMsgNodeLength is the wire length of each node of a tree message: index
+// within the level and hash.
+const treeMsgNodeLength = 4 + 8
+
+// TreeExchangerConfig represents the set of values for configuring a
+// TreeExchanger.
+type TreeExchangerConfig struct {
+	// LogDebug sets the func to use for debug messages. Defaults not logging
+	// debug messages.
+	LogDebug LogFunc
+	// MsgType is the message type to use for tree messages. Defaults to
+	// TREE_EXCHANGE_MSG_TYPE.
+	MsgType uint64
+	// Interval indicates how many seconds to wait between passes. Defaults to
+	// 60 seconds.
+	Interval int
+	// MsgTimeout indicates how many milliseconds to wait when queueing tree
+	// messages for delivery. Defaults to 1000 milliseconds.
+	MsgTimeout int
+	// Tree returns the PartitionTree of the partition as stored locally, or
+	// nil if there is none yet, in which case the partition is skipped. All
+	// nodes must use the same tree depth. This must be set.
+	Tree func(partition Partition) *PartitionTree
+	// Differs will be called when the leaves of the local tree of a partition
+	// are found to differ from those of a replica peer. It will be called
+	// from the MsgRing's receiving goroutine, so any significant work should
+	// be done elsewhere.
+	Differs func(e *PartitionTreeDiff)
+}
+
+func resolveTreeExchangerConfig(c *TreeExchangerConfig) *TreeExchangerConfig {
+	cfg := &TreeExchangerConfig{}
+	if c != nil {
+		*cfg = *c
+	}
+	if cfg.MsgType == 0 {
+		cfg.MsgType = TREE_EXCHANGE_MSG_TYPE
+	}
+	if cfg.Interval < 1 {
+		cfg.Interval = 60
+	}
+	if cfg.MsgTimeout < 1 {
+		cfg.MsgTimeout = 1000
+	}
+	return cfg
+}
+
+// PartitionTreeDiff describes the leaves, the sub-ranges of a partition, whose
+// local hashes did not match those of another replica.
+type PartitionTreeDiff struct {
+	RingVersion int64
+	Partition   Partition
+	NodeID      uint64
+	Leaves      []int
+}
+
+// TreeExchanger is a merkle tree anti-entropy helper; on a schedule, it sends
+// the root hash of the PartitionTree of each partition the local node is
+// responsible for to the other replicas of that partition. A replica whose
+// tree differs answers with the hashes of the next level down, for just the
+// differing nodes, and so on back and forth until the differing leaves are
+// found and reported with Differs by whichever replica reaches them. This
+// narrows the data to compare to just the differing sub-ranges with a number
+// of messages bounded by the tree depth.
+//
+// Like all MsgRing messaging, tree messages may be dropped; a missed exchange
+// will simply be retried on the next pass.
+type TreeExchanger struct {
+	msgRing     MsgRing
+	logDebug    LogFunc
+	msgType     uint64
+	interval    time.Duration
+	msgTimeout  time.Duration
+	tree        func(partition Partition) *PartitionTree
+	differs     func(e *PartitionTreeDiff)
+	controlLock sync.Mutex
+	controlChan chan struct{}
+
+	passes            int32
+	sends             int32
+	receives          int32
+	replies           int32
+	ringVersionSkips  int32
+	notResponsibles   int32
+	noTrees           int32
+	depthMismatches   int32
+	differences       int32
+	receiveReadErrors int32
+}
+
+// NewTreeExchanger creates a TreeExchanger that will use the MsgRing for its
+// messaging; call Start to begin exchanging trees.
+func NewTreeExchanger(msgRing MsgRing, c *TreeExchangerConfig) *TreeExchanger {
+	cfg := resolveTreeExchangerConfig(c)
+	x := &TreeExchanger{
+		msgRing:    msgRing,
+		logDebug:   cfg.LogDebug,
+		msgType:    cfg.MsgType,
+		interval:   time.Duration(cfg.Interval) * time.Second,
+		msgTimeout: time.Duration(cfg.MsgTimeout) * time.Millisecond,
+		tree:       cfg.Tree,
+		differs:    cfg.Differs,
+	}
+	if x.logDebug == nil {
+		x.logDebug = nilLogFunc
+	}
+	msgRing.SetMsgHandler(x.msgType, x.handle)
+	return x
+}
+
+// Start launches the background passes; it does nothing if already started.
+func (x *TreeExchanger) Start() {
+	x.controlLock.Lock()
+	if x.controlChan == nil {
+		x.controlChan = make(chan struct{})
+		go x.run(x.controlChan)
+	}
+	x.controlLock.Unlock()
+}
+
+// Stop ends the background passes; it does nothing if not started. Incoming
+// tree messages will still be compared and answered.
+func (x *TreeExchanger) Stop() {
+	x.controlLock.Lock()
+	if x.controlChan != nil {
+		close(x.controlChan)
+		x.controlChan = nil
+	}
+	x.controlLock.Unlock()
+}
+
+func (x *TreeExchanger) run(controlChan chan struct{}) {
+	for {
+		x.Pass()
+		select {
+		case <-controlChan:
+			return
+		case <-time.After(x.interval):
+		}
+	}
+}
+
+// Pass sends the root hashes for all partitions the local node is
+// responsible for once; it is called automatically on a schedule after Start,
+// but may be called directly to force an immediate exchange.
+func (x *TreeExchanger) Pass() {
+	atomic.AddInt32(&x.passes, 1)
+	r := x.msgRing.Ring()
+	if r == nil {
+		x.logDebug("tree exchange: no ring\n")
+		return
+	}
+	localNode := r.LocalNode()
+	if localNode == nil {
+		x.logDebug("tree exchange: no local node\n")
+		return
+	}
+	partitionCount := Partition(1) << r.PartitionBitCount()
+	for partition := Partition(0); partition < partitionCount; partition++ {
+		if !r.Responsible(partition) {
+			continue
+		}
+		tree := x.tree(partition)
+		if tree == nil {
+			continue
+		}
+		atomic.AddInt32(&x.sends, 1)
+		x.msgRing.MsgToOtherReplicas(&treeMsg{
+			msgType:     x.msgType,
+			ringVersion: r.Version(),
+			nodeID:      localNode.ID(),
+			partition:   partition,
+			depth:       uint8(tree.Depth()),
+			indexes:     []uint32{0},
+			hashes:      []uint64{tree.Root()},
+		}, partition, x.msgTimeout)
+	}
+}
+
+func (x *TreeExchanger) handle(reader io.Reader, desiredBytesToRead uint64) (uint64, error) {
+	atomic.AddInt32(&x.receives, 1)
+	discard := func(read uint64) (uint64, error) {
+		atomic.AddInt32(&x.receiveReadErrors, 1)
+		n, err := io.CopyN(ioutil.Discard, reader, int64(desiredBytesToRead-read))
+		return read + uint64(n), err
+	}
+	if desiredBytesToRead < treeMsgHeaderLength {
+		return discard(0)
+	}
+	var header [treeMsgHeaderLength]byte
+	n, err := io.ReadFull(reader, header[:])
+	if err != nil {
+		atomic.AddInt32(&x.receiveReadErrors, 1)
+		return uint64(n), err
+	}
+	m := &treeMsg{}
+	count := m.unmarshalHeader(header[:])
+	if desiredBytesToRead != treeMsgHeaderLength+uint64(count)*treeMsgNodeLength || m.depth > MaxPartitionTreeDepth || m.level > m.depth || uint64(count) > 1<<m.level {
+		return discard(uint64(n))
+	}
+	buf := make([]byte, count*treeMsgNodeLength)
+	n2, err := io.ReadFull(reader, buf)
+	read := uint64(n + n2)
+	if err != nil {
+		atomic.AddInt32(&x.receiveReadErrors, 1)
+		return read, err
+	}
+	m.unmarshalNodes(buf, count)
+	r := x.msgRing.Ring()
+	if r == nil || r.Version() != m.ringVersion {
+		atomic.AddInt32(&x.ringVersionSkips, 1)
+		return read, nil
+	}
+	if m.partition >= Partition(1)<<r.PartitionBitCount() || !r.Responsible(m.partition) {
+		atomic.AddInt32(&x.notResponsibles, 1)
+		return read, nil
+	}
+	tree := x.tree(m.partition)
+	if tree == nil {
+		atomic.AddInt32(&x.noTrees, 1)
+		return read, nil
+	}
+	if tree.Depth() != int(m.depth) {
+		atomic.AddInt32(&x.depthMismatches, 1)
+		return read, nil
+	}
+	level := int(m.level)
+	var differing []int
+	for i, index := range m.indexes {
+		if index >= 1<<uint(level) {
+			atomic.AddInt32(&x.receiveReadErrors, 1)
+			return read, nil
+		}
+		if tree.Hash(level, int(index)) != m.hashes[i] {
+			differing = append(differing, int(index))
+		}
+	}
+	if len(differing) == 0 {
+		return read, nil
+	}
+	if level == tree.Depth() {
+		atomic.AddInt32(&x.differences, 1)
+		if x.differs != nil {
+			x.differs(&PartitionTreeDiff{
+				RingVersion: m.ringVersion,
+				Partition:   m.partition,
+				NodeID:      m.nodeID,
+				Leaves:      differing,
+			})
+		}
+		return read, nil
+	}
+	reply := &treeMsg{
+		msgType:     x.msgType,
+		ringVersion: m.ringVersion,
+		nodeID:      r.LocalNode().ID(),
+		partition:   m.partition,
+		depth:       m.depth,
+		level:       m.level + 1,
+	}
+	for _, index := range differing {
+		for _, child := range []int{index * 2, index*2 + 1} {
+			reply.indexes = append(reply.indexes, uint32(child))
+			reply.hashes = append(reply.hashes, tree.Hash(level+1, child))
+		}
+	}
+	atomic.AddInt32(&x.replies, 1)
+	x.msgRing.MsgToNode(reply, m.nodeID, x.msgTimeout)
+	return read, nil
+}
+
+// TreeExchangerStats gives an overview of the TreeExchanger activity.
+type TreeExchangerStats struct {
+	Passes            int32
+	Sends             int32
+	Receives          int32
+	Replies           int32
+	RingVersionSkips  int32
+	NotResponsibles   int32
+	NoTrees           int32
+	DepthMismatches   int32
+	Differences       int32
+	ReceiveReadErrors int32
+}
+
+// Stats returns the current stat counters and resets those counters.
+func (x *TreeExchanger) Stats() *TreeExchangerStats {
+	s := &TreeExchangerStats{
+		Passes:            atomic.LoadInt32(&x.passes),
+		Sends:             atomic.LoadInt32(&x.sends),
+		Receives:          atomic.LoadInt32(&x.receives),
+		Replies:           atomic.LoadInt32(&x.replies),
+		RingVersionSkips:  atomic.LoadInt32(&x.ringVersionSkips),
+		NotResponsibles:   atomic.LoadInt32(&x.notResponsibles),
+		NoTrees:           atomic.LoadInt32(&x.noTrees),
+		DepthMismatches:   atomic.LoadInt32(&x.depthMismatches),
+		Differences:       atomic.LoadInt32(&x.differences),
+		ReceiveReadErrors: atomic.LoadInt32(&x.receiveReadErrors),
+	}
+	atomic.AddInt32(&x.passes, -s.Passes)
+	atomic.AddInt32(&x.sends, -s.Sends)
+	atomic.AddInt32(&x.receives, -s.Receives)
+	atomic.AddInt32(&x.replies, -s.Replies)
+	atomic.AddInt32(&x.ringVersionSkips, -s.RingVersionSkips)
+	atomic.AddInt32(&x.notResponsibles, -s.NotResponsibles)
+	atomic.AddInt32(&x.noTrees, -s.NoTrees)
+	atomic.AddInt32(&x.depthMismatches, -s.DepthMismatches)
+	atomic.AddInt32(&x.differences, -s.Differences)
+	atomic.AddInt32(&x.receiveReadErrors, -s.ReceiveReadErrors)
+	return s
+}
+
+type treeMsg struct {
+	msgType     uint64
+	ringVersion int64
+	nodeID      uint64
+	partition   Partition
+	depth       uint8
+	level       uint8
+	indexes     []uint32
+	hashes      []uint64
+}
+
+func (m *treeMsg) MsgType() uint64 {
+	return m.msgType
+}
+
+func (m *treeMsg) MsgLength() uint64 {
+	return treeMsgHeaderLength + uint64(len(m.indexes))*treeMsgNodeLength
+}
+
+func (m *treeMsg) WriteContent(w io.Writer) (uint64, error) {
+	buf := make([]byte, m.MsgLength())
+	binary.BigEndian.PutUint64(buf[0:], uint64(m.ringVersion))
+	binary.BigEndian.PutUint64(buf[8:], m.nodeID)
+	binary.BigEndian.PutUint32(buf[16:], uint32(m.partition))
+	buf[20] = m.depth
+	buf[21] = m.level
+	binary.BigEndian.PutUint32(buf[22:], uint32(len(m.indexes)))
+	for i, index := range m.indexes {
+		b := buf[treeMsgHeaderLength+i*treeMsgNodeLength:]
+		binary.BigEndian.PutUint32(b, index)
+		binary.BigEndian.PutUint64(b[4:], m.hashes[i])
+	}
+	n, err := w.Write(buf)
+	return uint64(n), err
+}
+
+func (m *treeMsg) Free() {
+}
+
+// unmarshalHeader fills in the message from the header, returning the count
+// of nodes that follow.
+func (m *treeMsg) unmarshalHeader(buf []byte) uint32 {
+	m.ringVersion = int64(binary.BigEndian.Uint64(buf[0:]))
+	m.nodeID = binary.BigEndian.Uint64(buf[8:])
+	m.partition = Partition(binary.BigEndian.Uint32(buf[16:]))
+	m.depth = buf[20]
+	m.level = buf[21]
+	return binary.BigEndian.Uint32(buf[22:])
+}
+
+func (m *treeMsg) unmarshalNodes(buf []byte, count uint32) {
+	m.indexes = make([]uint32, count)
+	m.hashes = make([]uint64, count)
+	for i := range m.indexes {
+		b := buf[i*treeMsgNodeLength:]
+		m.indexes[i] = binary.BigEndian.Uint32(b)
+		m.hashes[i] = binary.BigEndian.Uint64(b[4:])
+	}
+}
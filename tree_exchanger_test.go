@@ -0,0 +1,74 @@
+package ring
+
+import "testing"
+
+func TestTreeExchanger(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetReplicaCount(2)
+	nA, err := b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nB, err := b.AddNode(true, 1, nil, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rA := b.Ring()
+	rA.SetLocalNode(nA.ID())
+	rB := b.Ring()
+	rB.SetLocalNode(nB.ID())
+	partitionCount := 1 << rA.PartitionBitCount()
+	treesA := make([]*PartitionTree, partitionCount)
+	treesB := make([]*PartitionTree, partitionCount)
+	for p := range treesA {
+		treesA[p] = NewPartitionTree(3)
+		treesB[p] = NewPartitionTree(3)
+		for leaf := 0; leaf < 8; leaf++ {
+			treesA[p].Add(leaf, uint64(p*8+leaf))
+			treesB[p].Add(leaf, uint64(p*8+leaf))
+		}
+	}
+	treesB[1].Add(2, 1000)
+	treesB[1].Add(5, 1000)
+	mrA := newTestMsgRing(rA)
+	mrB := newTestMsgRing(rB)
+	var diffs []*PartitionTreeDiff
+	record := func(e *PartitionTreeDiff) { diffs = append(diffs, e) }
+	xA := NewTreeExchanger(mrA, &TreeExchangerConfig{
+		Tree:    func(partition Partition) *PartitionTree { return treesA[partition] },
+		Differs: record,
+	})
+	xB := NewTreeExchanger(mrB, &TreeExchangerConfig{
+		Tree:    func(partition Partition) *PartitionTree { return treesB[partition] },
+		Differs: record,
+	})
+	xA.Pass()
+	if len(mrA.sent) != partitionCount {
+		t.Fatalf("%d != %d", len(mrA.sent), partitionCount)
+	}
+	// Root, then levels 1 through 3 back and forth.
+	for i := 0; i < 2; i++ {
+		if err = mrA.deliver(mrB); err != nil {
+			t.Fatal(err)
+		}
+		if err = mrB.deliver(mrA); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(mrA.sent) != 0 || len(mrB.sent) != 0 {
+		t.Fatalf("%d %d", len(mrA.sent), len(mrB.sent))
+	}
+	if len(diffs) != 1 {
+		t.Fatalf("%d != 1", len(diffs))
+	}
+	e := diffs[0]
+	if e.Partition != 1 || e.NodeID != nB.ID() || len(e.Leaves) != 2 || e.Leaves[0] != 2 || e.Leaves[1] != 5 || e.RingVersion != rA.Version() {
+		t.Fatalf("%#v", e)
+	}
+	if s := xB.Stats(); s.Receives != int32(partitionCount)+1 || s.Replies != 2 {
+		t.Fatalf("%#v", s)
+	}
+	if s := xA.Stats(); s.Receives != 2 || s.Replies != 1 || s.Differences != 1 {
+		t.Fatalf("%#v", s)
+	}
+}
@@ -1,7 +1,9 @@
 package ring
 
 import (
+	"bytes"
 	"compress/gzip"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -28,7 +30,7 @@ func RingOrBuilder(fileName string) (Ring, *Builder, error) {
 		return r, b, err
 	}
 	if string(header[:5]) == "RINGv" {
-		if string(header[:16]) != RINGVERSION {
+		if string(header[:16]) != RINGVERSION && string(header[:16]) != ringVersion1 {
 			return r, b, fmt.Errorf("Ring Version missmatch, expected %s found %s", RINGVERSION, header[:16])
 		}
 		gf.Close()
@@ -37,7 +39,7 @@ func RingOrBuilder(fileName string) (Ring, *Builder, error) {
 		}
 		r, err = LoadRing(f)
 	} else if string(header[:12]) == "RINGBUILDERv" {
-		if string(header[:16]) != BUILDERVERSION {
+		if string(header[:16]) != BUILDERVERSION && string(header[:16]) != builderVersion1 {
 			return r, b, fmt.Errorf("Builder Version missmatch, expected %s found %s", BUILDERVERSION, header[:16])
 		}
 		gf.Close()
@@ -49,8 +51,53 @@ func RingOrBuilder(fileName string) (Ring, *Builder, error) {
 	return r, b, err
 }
 
-// PersistRingOrBuilder persists a given ring/builder to the provided filename
+// BuilderConflictError is returned by PersistRingOrBuilder when the builder
+// file was persisted by another process after the Builder was loaded, so
+// persisting would silently discard the other process' changes.
+type BuilderConflictError struct {
+	Filename string
+	// Generation is the Builder.Generation of the Builder being persisted.
+	Generation uint64
+	// OnDisk is the newer generation found in the file.
+	OnDisk uint64
+}
+
+func (e *BuilderConflictError) Error() string {
+	return fmt.Sprintf("%s was changed since it was loaded; its generation %d is newer than %d", e.Filename, e.OnDisk, e.Generation)
+}
+
+// PersistRingOrBuilder persists a given ring/builder to the provided filename.
+//
+// A builder is not persisted if the file holds a builder of a newer
+// generation than the one given, returning a *BuilderConflictError instead;
+// reload the builder and redo the changes, or use ForcePersistRingOrBuilder
+// to overwrite the file anyway. The check is made just before the file is
+// replaced, so it guards against changes made in the meantime by other
+// administrative processes, not against truly simultaneous persists.
 func PersistRingOrBuilder(r Ring, b *Builder, filename string) error {
+	if r == nil {
+		onDisk, err := builderFileGeneration(filename)
+		if err != nil {
+			return err
+		}
+		if onDisk > b.generation {
+			return &BuilderConflictError{Filename: filename, Generation: b.generation, OnDisk: onDisk}
+		}
+	}
+	return ForcePersistRingOrBuilder(r, b, filename)
+}
+
+// ForcePersistRingOrBuilder is PersistRingOrBuilder without the check for a
+// newer builder file. A builder overwriting a newer one takes on a generation
+// past the newer one's, so other processes still holding builders loaded
+// before either persist will have conflicts.
+func ForcePersistRingOrBuilder(r Ring, b *Builder, filename string) error {
+	if r == nil {
+		// A file that cannot be read is simply overwritten.
+		if onDisk, _ := builderFileGeneration(filename); onDisk > b.generation {
+			b.generation = onDisk
+		}
+	}
 	dir, name := path.Split(filename)
 	if dir == "" {
 		dir = "."
@@ -75,3 +122,139 @@ func PersistRingOrBuilder(r Ring, b *Builder, filename string) error {
 	}
 	return os.Rename(tmp, filename)
 }
+
+// builderFileGeneration returns the Builder.Generation of the builder in the
+// file; 0 if there is no such file or it is not a builder of the current
+// format.
+func builderFileGeneration(filename string) (uint64, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, err
+	}
+	defer gr.Close()
+	header := make([]byte, 16)
+	if _, err = io.ReadFull(gr, header); err != nil {
+		return 0, err
+	}
+	if string(header) != BUILDERVERSION {
+		return 0, nil
+	}
+	var version int64
+	if err = binary.Read(gr, binary.BigEndian, &version); err != nil {
+		return 0, err
+	}
+	var generation uint64
+	if err = binary.Read(gr, binary.BigEndian, &generation); err != nil {
+		return 0, err
+	}
+	return generation, nil
+}
+
+// readToGzipEnd reads the rest of the gzip stream, which has the gzip.Reader
+// verify the stream's CRC-32 checksum and length, returning an error if they
+// do not match or if any data remains unread.
+func readToGzipEnd(gr *gzip.Reader) error {
+	n, err := io.Copy(ioutil.Discard, gr)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return fmt.Errorf("%d bytes of unexpected data at the end", n)
+	}
+	return nil
+}
+
+// loadAllocLimit bounds how many items LoadBuilder and LoadRing allocate for
+// ahead of reading them; longer lengths grow as their items are read, so a
+// corrupt length runs into the end of the data rather than attempting a huge
+// allocation.
+const loadAllocLimit = 1 << 16
+
+// readLength reads an int32 length or count, returning an error naming what it
+// is if it is negative.
+func readLength(r io.Reader, what string) (int32, error) {
+	var length int32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return 0, err
+	}
+	if length < 0 {
+		return 0, fmt.Errorf("invalid %s %d", what, length)
+	}
+	return length, nil
+}
+
+// allocLength is the capacity to allocate for reading length items.
+func allocLength(length int32) int32 {
+	if length > loadAllocLimit {
+		return loadAllocLimit
+	}
+	return length
+}
+
+// readBytes reads length bytes.
+func readBytes(r io.Reader, length int32) ([]byte, error) {
+	if length <= loadAllocLimit {
+		byts := make([]byte, length)
+		if _, err := io.ReadFull(r, byts); err != nil {
+			return nil, err
+		}
+		return byts, nil
+	}
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(io.LimitReader(r, int64(length))); err != nil {
+		return nil, err
+	}
+	if buf.Len() < int(length) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), nil
+}
+
+// readInt32s reads length big endian int32 values.
+func readInt32s(r io.Reader, length int32) ([]int32, error) {
+	values := make([]int32, 0, allocLength(length))
+	chunk := make([]int32, allocLength(length))
+	for remaining := int(length); remaining > 0; remaining -= len(chunk) {
+		if remaining < len(chunk) {
+			chunk = chunk[:remaining]
+		}
+		if err := binary.Read(r, binary.BigEndian, chunk); err != nil {
+			return nil, err
+		}
+		values = append(values, chunk...)
+	}
+	return values, nil
+}
+
+// readUint16s reads length big endian uint16 values.
+func readUint16s(r io.Reader, length int32) ([]uint16, error) {
+	values := make([]uint16, 0, allocLength(length))
+	chunk := make([]uint16, allocLength(length))
+	for remaining := int(length); remaining > 0; remaining -= len(chunk) {
+		if remaining < len(chunk) {
+			chunk = chunk[:remaining]
+		}
+		if err := binary.Read(r, binary.BigEndian, chunk); err != nil {
+			return nil, err
+		}
+		values = append(values, chunk...)
+	}
+	return values, nil
+}
+
+// checkPartitionCount returns an error unless count is the number of
+// partitions for partitionBitCount, as read for each replica's assignments.
+func checkPartitionCount(count int32, partitionBitCount uint16) error {
+	if partitionBitCount > 30 || count != 1<<partitionBitCount {
+		return fmt.Errorf("invalid partition count %d for partition bit count %d", count, partitionBitCount)
+	}
+	return nil
+}
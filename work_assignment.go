@@ -0,0 +1,174 @@
+package ring
+
+import (
+	"sort"
+	"sync"
+)
+
+// WorkAssignment is the local node's share of a background job, such as
+// scrubbing or auditing, as determined from a Ring; see WorkAssigner.
+type WorkAssignment struct {
+	// RingVersion is the Version of the Ring the assignment is from.
+	RingVersion int64
+	// PartitionBitCount is that of the Ring the assignment is from; the
+	// partition numbers only compare between assignments of the same
+	// PartitionBitCount.
+	PartitionBitCount uint16
+	// Partitions are those the local node is assigned, in ascending order.
+	Partitions []Partition
+}
+
+// Contains returns true if the partition is assigned.
+func (a *WorkAssignment) Contains(partition Partition) bool {
+	i := sort.Search(len(a.Partitions), func(i int) bool { return a.Partitions[i] >= partition })
+	return i < len(a.Partitions) && a.Partitions[i] == partition
+}
+
+// Changes returns the partitions assigned that were not in the previous
+// assignment, and those no longer assigned that were. If the
+// PartitionBitCount differs, or there is no previous assignment, all
+// partitions are considered changed.
+func (a *WorkAssignment) Changes(previous *WorkAssignment) (gained []Partition, lost []Partition) {
+	if previous == nil {
+		return append([]Partition(nil), a.Partitions...), nil
+	}
+	if previous.PartitionBitCount != a.PartitionBitCount {
+		return append([]Partition(nil), a.Partitions...), append([]Partition(nil), previous.Partitions...)
+	}
+	i, j := 0, 0
+	for i < len(a.Partitions) || j < len(previous.Partitions) {
+		switch {
+		case j >= len(previous.Partitions) || (i < len(a.Partitions) && a.Partitions[i] < previous.Partitions[j]):
+			gained = append(gained, a.Partitions[i])
+			i++
+		case i >= len(a.Partitions) || previous.Partitions[j] < a.Partitions[i]:
+			lost = append(lost, previous.Partitions[j])
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+	return gained, lost
+}
+
+// WorkAssignerConfig represents the set of values for configuring a
+// WorkAssigner.
+type WorkAssignerConfig struct {
+	// Replicas lists the replica indexes whose nodes are assigned the work
+	// for a partition. Defaults to just replica 0, so each partition has a
+	// single designated node; with unassigned replicas, the node
+	// ResponsibleNodes substitutes stands in.
+	Replicas []int
+	// Changed, if set, will be called by SetRing whenever the local node's
+	// assignment changes, with the previous assignment, nil at first, and
+	// the new one; see WorkAssignment.Changes. It is called with no locks
+	// held but calls are serialized.
+	Changed func(previous *WorkAssignment, current *WorkAssignment)
+}
+
+func resolveWorkAssignerConfig(c *WorkAssignerConfig) *WorkAssignerConfig {
+	cfg := &WorkAssignerConfig{}
+	if c != nil {
+		*cfg = *c
+	}
+	if len(cfg.Replicas) == 0 {
+		cfg.Replicas = []int{0}
+	}
+	return cfg
+}
+
+// WorkAssigner divides background work by partition among the nodes of a
+// ring, the common pattern for ring-aware maintenance daemons: each node
+// works on just the partitions it is the designated replica for, so every
+// partition is covered once without any coordination between the nodes.
+// Since the Builder moves few replicas between rings, assignments are stable
+// from ring to ring.
+//
+// Give it each new Ring with SetRing, which is usable directly as an
+// HTTPRingLoaderConfig.RingChanged func; the Ring must have its LocalNode
+// set.
+type WorkAssigner struct {
+	replicas    []int
+	changed     func(previous *WorkAssignment, current *WorkAssignment)
+	setRingLock sync.Mutex
+	lock        sync.RWMutex
+	assignment  *WorkAssignment
+}
+
+// NewWorkAssigner creates a WorkAssigner based on the configuration given;
+// it has no assignment until SetRing is called.
+func NewWorkAssigner(c *WorkAssignerConfig) *WorkAssigner {
+	cfg := resolveWorkAssignerConfig(c)
+	return &WorkAssigner{replicas: cfg.Replicas, changed: cfg.Changed}
+}
+
+// Assignment returns the current assignment, or nil if SetRing has not yet
+// been called. The assignment returned should not be modified.
+func (w *WorkAssigner) Assignment() *WorkAssignment {
+	w.lock.RLock()
+	a := w.assignment
+	w.lock.RUnlock()
+	return a
+}
+
+// SetRing computes the local node's assignment from the Ring, calling the
+// Changed func if it differs from the previous assignment.
+func (w *WorkAssigner) SetRing(r Ring) {
+	w.setRingLock.Lock()
+	defer w.setRingLock.Unlock()
+	current := workAssignment(r, w.replicas)
+	w.lock.Lock()
+	previous := w.assignment
+	w.assignment = current
+	w.lock.Unlock()
+	if w.changed == nil {
+		return
+	}
+	if previous != nil && previous.PartitionBitCount == current.PartitionBitCount && len(previous.Partitions) == len(current.Partitions) {
+		same := true
+		for i, partition := range previous.Partitions {
+			if current.Partitions[i] != partition {
+				same = false
+				break
+			}
+		}
+		if same {
+			return
+		}
+	}
+	w.changed(previous, current)
+}
+
+func workAssignment(r Ring, replicas []int) *WorkAssignment {
+	a := &WorkAssignment{RingVersion: r.Version(), PartitionBitCount: r.PartitionBitCount()}
+	localNode := r.LocalNode()
+	if localNode == nil {
+		return a
+	}
+	assigned := make(map[int]bool, len(replicas))
+	for _, replica := range replicas {
+		assigned[replica] = true
+	}
+	replicaCount := r.ReplicaCount()
+	partitionCount := Partition(1) << r.PartitionBitCount()
+	for partition := Partition(0); partition < partitionCount; partition++ {
+		if r.UnassignedReplicas(partition) == 0 {
+			if assigned[r.ResponsibleReplica(partition)] {
+				a.Partitions = append(a.Partitions, partition)
+			}
+			continue
+		}
+		nodes := r.ResponsibleNodes(partition)
+		if len(nodes) != replicaCount {
+			continue
+		}
+		for _, replica := range replicas {
+			if replica >= 0 && replica < replicaCount && nodes[replica].ID() == localNode.ID() {
+				a.Partitions = append(a.Partitions, partition)
+				break
+			}
+		}
+	}
+	return a
+}
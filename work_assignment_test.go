@@ -0,0 +1,97 @@
+package ring
+
+import (
+	"testing"
+)
+
+func TestWorkAssignmentChanges(t *testing.T) {
+	previous := &WorkAssignment{PartitionBitCount: 4, Partitions: []Partition{1, 3, 5, 7}}
+	current := &WorkAssignment{PartitionBitCount: 4, Partitions: []Partition{0, 3, 7, 9}}
+	gained, lost := current.Changes(previous)
+	if len(gained) != 2 || gained[0] != 0 || gained[1] != 9 {
+		t.Fatal(gained)
+	}
+	if len(lost) != 2 || lost[0] != 1 || lost[1] != 5 {
+		t.Fatal(lost)
+	}
+	gained, lost = current.Changes(nil)
+	if len(gained) != 4 || lost != nil {
+		t.Fatal(gained, lost)
+	}
+	previous.PartitionBitCount = 3
+	gained, lost = current.Changes(previous)
+	if len(gained) != 4 || len(lost) != 4 {
+		t.Fatal(gained, lost)
+	}
+	if !current.Contains(3) || current.Contains(4) || current.Contains(10) {
+		t.Fatal(current.Partitions)
+	}
+}
+
+func TestWorkAssigner(t *testing.T) {
+	b := NewBuilder(64)
+	b.SetReplicaCount(3)
+	b.SetMoveWait(0)
+	var ids []uint64
+	for i := 0; i < 4; i++ {
+		n, err := b.AddNode(true, 1, nil, nil, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, n.ID())
+	}
+	r := b.Ring()
+	partitionCount := 1 << r.PartitionBitCount()
+	counts := make([]int, partitionCount)
+	var changes int
+	var last *WorkAssignment
+	w := NewWorkAssigner(&WorkAssignerConfig{
+		Changed: func(previous *WorkAssignment, current *WorkAssignment) {
+			if (previous == nil) != (last == nil) || (previous != nil && len(previous.Partitions) != len(last.Partitions)) {
+				t.Fatal("previous assignment mismatch")
+			}
+			last = current
+			changes++
+		},
+	})
+	if w.Assignment() != nil {
+		t.Fatal(w.Assignment())
+	}
+	for _, id := range ids {
+		r.SetLocalNode(id)
+		for _, partition := range workAssignment(r, []int{0}).Partitions {
+			counts[partition]++
+		}
+	}
+	// Each partition has exactly one designated node.
+	for partition, count := range counts {
+		if count != 1 {
+			t.Fatalf("partition %d assigned %d times", partition, count)
+		}
+	}
+	r.SetLocalNode(ids[0])
+	w.SetRing(r)
+	if changes != 1 || w.Assignment() != last || w.Assignment().RingVersion != r.Version() {
+		t.Fatal(changes)
+	}
+	w.SetRing(r)
+	if changes != 1 {
+		t.Fatal(changes)
+	}
+	if _, err := b.AddNode(true, 4, nil, nil, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	r = b.Ring()
+	r.SetLocalNode(ids[0])
+	w.SetRing(r)
+	if changes != 2 {
+		t.Fatal(changes)
+	}
+	all := NewWorkAssigner(&WorkAssignerConfig{Replicas: []int{0, 1, 2}})
+	all.SetRing(r)
+	for partition := Partition(0); partition < Partition(1)<<r.PartitionBitCount(); partition++ {
+		if all.Assignment().Contains(partition) != r.Responsible(partition) {
+			t.Fatalf("partition %d", partition)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// Package zk contains tools for publishing rings to ZooKeeper and for
+// watching ZooKeeper for new rings.
+//
+// A ring is stored as two znodes under a base path: <path>/ring holds the ring
+// as persisted by Ring.Persist, and <path>/version holds the ring version and
+// the SHA-256 checksum of the ring data. Publishers write the ring data first
+// and the version znode last, and watchers only watch the version znode, so
+// watchers never act upon a partially published ring; they also verify the
+// checksum and version of the data read before delivering the new ring.
+//
+// To avoid forcing a particular ZooKeeper client library on users of the ring
+// package, this package works with the small Conn interface. An adapter for
+// the commonly used github.com/samuel/go-zookeeper/zk package would look
+// like:
+//
+//	type zkConn struct{ c *zk.Conn }
+//
+//	func (a *zkConn) Get(path string) ([]byte, error) {
+//		data, _, err := a.c.Get(path)
+//		if err == zk.ErrNoNode {
+//			err = ringzk.ErrNoNode
+//		}
+//		return data, err
+//	}
+//
+//	func (a *zkConn) GetW(path string) ([]byte, <-chan struct{}, error) {
+//		data, _, events, err := a.c.GetW(path)
+//		if err == zk.ErrNoNode {
+//			return nil, nil, ringzk.ErrNoNode
+//		}
+//		changed := make(chan struct{})
+//		go func() { <-events; close(changed) }()
+//		return data, changed, err
+//	}
+//
+//	func (a *zkConn) Set(path string, data []byte) error {
+//		_, err := a.c.Set(path, data, -1)
+//		if err == zk.ErrNoNode {
+//			_, err = a.c.Create(path, data, 0, zk.WorldACL(zk.PermAll))
+//		}
+//		return err
+//	}
+//
+// Note that ZooKeeper limits znodes to about 1M by default, which limits the
+// partition bits and node count of the ring that can be published.
+package zk
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gholt/ring"
+)
+
+// ErrNoNode must be returned by Conn implementations when a znode does not
+// exist.
+var ErrNoNode = errors.New("znode does not exist")
+
+// Conn is the subset of a ZooKeeper connection needed by this package.
+type Conn interface {
+	// Get returns the data of the znode.
+	Get(path string) ([]byte, error)
+	// GetW returns the data of the znode and a channel that will be closed
+	// when the znode changes or the watch is lost.
+	GetW(path string) ([]byte, <-chan struct{}, error)
+	// Set stores the data in the znode, creating it if needed.
+	Set(path string, data []byte) error
+}
+
+// Publish stores the Ring under the base path; the ring data is written
+// before the version znode so watchers only see complete rings.
+func Publish(conn Conn, path string, r ring.Ring) error {
+	buf := &bytes.Buffer{}
+	if err := r.Persist(buf); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	if err := conn.Set(path+"/ring", buf.Bytes()); err != nil {
+		return err
+	}
+	return conn.Set(path+"/version", []byte(fmt.Sprintf("%d %s", r.Version(), hex.EncodeToString(sum[:]))))
+}
+
+func parseVersion(data []byte) (int64, string, error) {
+	parts := strings.Fields(string(data))
+	if len(parts) != 2 {
+		return 0, "", fmt.Errorf("invalid version znode data %q", data)
+	}
+	version, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid version znode data %q: %s", data, err)
+	}
+	return version, parts[1], nil
+}
+
+// Load reads the Ring currently published under the base path, verifying its
+// checksum and version.
+func Load(conn Conn, path string) (ring.Ring, error) {
+	data, err := conn.Get(path + "/version")
+	if err != nil {
+		return nil, err
+	}
+	version, checksum, err := parseVersion(data)
+	if err != nil {
+		return nil, err
+	}
+	return load(conn, path, version, checksum)
+}
+
+func load(conn Conn, path string, version int64, checksum string) (ring.Ring, error) {
+	data, err := conn.Get(path + "/ring")
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != checksum {
+		return nil, fmt.Errorf("ring checksum %x did not match published checksum %s", sum, checksum)
+	}
+	r, err := ring.LoadRing(bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	if r.Version() != version {
+		return nil, fmt.Errorf("ring version %d did not match published version %d", r.Version(), version)
+	}
+	return r, nil
+}
+
+// WatcherConfig represents the set of values for configuring a Watch.
+type WatcherConfig struct {
+	// LogDebug sets the func to use for debug messages. Defaults not logging
+	// debug messages.
+	LogDebug ring.LogFunc
+	// RetryInterval indicates how many seconds to wait after an error, such
+	// as a lost connection or a bad ring, before trying again. Defaults to 10
+	// seconds.
+	RetryInterval int
+}
+
+// Watch watches the base path for newly published rings, calling ringChanged
+// with each one, including the ring published when Watch begins. The
+// ringChanged func can simply swap in the new Ring, such as with
+// TCPMsgRing.SetRing, as it will only be given complete, verified rings. Watch
+// does not return until the stop channel is closed.
+func Watch(conn Conn, path string, ringChanged func(r ring.Ring), stop chan struct{}, c *WatcherConfig) {
+	cfg := &WatcherConfig{}
+	if c != nil {
+		*cfg = *c
+	}
+	if cfg.LogDebug == nil {
+		cfg.LogDebug = func(string, ...interface{}) {}
+	}
+	if cfg.RetryInterval < 1 {
+		cfg.RetryInterval = 10
+	}
+	var lastVersion int64
+	var lastChecksum string
+	for {
+		data, changed, err := conn.GetW(path + "/version")
+		if err == nil {
+			var version int64
+			var checksum string
+			version, checksum, err = parseVersion(data)
+			if err == nil && (version != lastVersion || checksum != lastChecksum) {
+				var r ring.Ring
+				r, err = load(conn, path, version, checksum)
+				if err == nil {
+					lastVersion = version
+					lastChecksum = checksum
+					ringChanged(r)
+				}
+			}
+		}
+		if err != nil {
+			cfg.LogDebug("zk: watch %s: %s\n", path, err)
+			changed = nil
+		}
+		if changed == nil {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Duration(cfg.RetryInterval) * time.Second):
+			}
+			continue
+		}
+		select {
+		case <-stop:
+			return
+		case <-changed:
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package zk
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gholt/ring"
+)
+
+type testConn struct {
+	lock     sync.Mutex
+	data     map[string][]byte
+	watchers map[string][]chan struct{}
+}
+
+func newTestConn() *testConn {
+	return &testConn{data: make(map[string][]byte), watchers: make(map[string][]chan struct{})}
+}
+
+func (c *testConn) Get(path string) ([]byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	data, ok := c.data[path]
+	if !ok {
+		return nil, ErrNoNode
+	}
+	return data, nil
+}
+
+func (c *testConn) GetW(path string) ([]byte, <-chan struct{}, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	data, ok := c.data[path]
+	if !ok {
+		return nil, nil, ErrNoNode
+	}
+	changed := make(chan struct{})
+	c.watchers[path] = append(c.watchers[path], changed)
+	return data, changed, nil
+}
+
+func (c *testConn) Set(path string, data []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.data[path] = data
+	for _, changed := range c.watchers[path] {
+		close(changed)
+	}
+	c.watchers[path] = nil
+	return nil
+}
+
+func TestPublishWatch(t *testing.T) {
+	b := ring.NewBuilder(64)
+	b.AddNode(true, 1, nil, nil, "", nil)
+	r := b.Ring()
+	conn := newTestConn()
+	if err := Publish(conn, "/rings/store", r); err != nil {
+		t.Fatal(err)
+	}
+	r2, err := Load(conn, "/rings/store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r2.Version() != r.Version() {
+		t.Fatalf("%d != %d", r2.Version(), r.Version())
+	}
+	ringChan := make(chan ring.Ring, 2)
+	stop := make(chan struct{})
+	defer close(stop)
+	go Watch(conn, "/rings/store", func(r ring.Ring) { ringChan <- r }, stop, nil)
+	select {
+	case r2 = <-ringChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no initial ring")
+	}
+	if r2.Version() != r.Version() {
+		t.Fatalf("%d != %d", r2.Version(), r.Version())
+	}
+	b.AddNode(true, 1, nil, nil, "", nil)
+	r = b.Ring()
+	if err := Publish(conn, "/rings/store", r); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r2 = <-ringChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no new ring")
+	}
+	if r2.Version() != r.Version() {
+		t.Fatalf("%d != %d", r2.Version(), r.Version())
+	}
+}
+
+func TestLoadChecksumMismatch(t *testing.T) {
+	b := ring.NewBuilder(64)
+	b.AddNode(true, 1, nil, nil, "", nil)
+	conn := newTestConn()
+	if err := Publish(conn, "/r", b.Ring()); err != nil {
+		t.Fatal(err)
+	}
+	data := conn.data["/r/ring"]
+	corrupt := make([]byte, len(data))
+	copy(corrupt, data)
+	corrupt[len(corrupt)-1]++
+	conn.data["/r/ring"] = corrupt
+	if _, err := Load(conn, "/r"); err == nil {
+		t.Fatal("expected checksum error")
+	}
+	if _, err := Load(conn, "/missing"); err != ErrNoNode {
+		t.Fatalf("%v != %v", err, ErrNoNode)
+	}
+}